@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/json"
+	"goshawkdb.io/server/configuration"
+)
+
+// Config is a cluster configuration, exactly as written in a
+// configuration file. Fields are only ever added to Config, and each
+// new field's zero value preserves the existing behaviour.
+type Config struct {
+	ClusterId                     string
+	Version                       uint32
+	Hosts                         []string
+	F                             uint8
+	MaxRMCount                    uint16
+	NoSync                        bool
+	ClientCertificateFingerprints map[string]map[string]*RootCapability
+	Placement                     map[string][]string `json:",omitempty"`
+	Learners                      map[string][]string `json:",omitempty"`
+}
+
+// RootCapability is what a client certificate may do with a root.
+type RootCapability struct {
+	Read  bool
+	Write bool
+}
+
+// LoadConfig loads the configuration from path, in JSON, TOML or YAML
+// according to its extension, resolving includes, and validates it.
+func LoadConfig(path string) (*Config, error) {
+	config := &Config{}
+	if err := configuration.LoadFromPath(path, configuration.FormatAuto, config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ParseConfig decodes the configuration from JSON, and validates it.
+func ParseConfig(data []byte) (*Config, error) {
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate returns an error if the server would refuse config.
+func (config *Config) Validate() error {
+	data, err := json.Marshal(config)
+	if err == nil {
+		_, err = configuration.ConfigurationFromJSON(data)
+	}
+	return err
+}
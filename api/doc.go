@@ -0,0 +1,20 @@
+// Package api is the stable public Go API of the server, for tooling
+// which embeds a server or works with its configuration.
+//
+// Everything exported by this package follows semantic versioning,
+// as given by Version: within a major version, exported identifiers
+// are neither removed nor changed incompatibly, and the meaning of
+// configuration fields does not change. Nothing else in this
+// repository carries any such guarantee. In particular, the actors,
+// dispatchers and capnp messages of the other packages change
+// whenever the internals are refactored, so tooling should depend on
+// them only through this package.
+//
+// The one exception is where a value from inside the server must be
+// handed to this package, such as NewTransactor's
+// *network.ConnectionManager: such parameters are only ever obtained
+// by embedding the server, and are passed straight through.
+package api
+
+// Version is the version of this API.
+const Version = "1.1.0"
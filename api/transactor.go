@@ -0,0 +1,340 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	cmsgs "goshawkdb.io/common/capnp"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/client"
+	"goshawkdb.io/server/configuration"
+	"goshawkdb.io/server/network"
+	eng "goshawkdb.io/server/txnengine"
+	"sync"
+)
+
+// ErrShutdown is returned by RunTxn and Transact if the server shuts
+// down before the txn's outcome is known.
+var ErrShutdown = errors.New("Shutdown")
+
+// ErrContention is returned by Transact if the txn has still not
+// committed after the maximum number of attempts.
+var ErrContention = client.ErrContention
+
+// ActionKind is what an Action does to its var.
+type ActionKind uint8
+
+const (
+	Read      ActionKind = iota
+	Write     ActionKind = iota
+	ReadWrite ActionKind = iota
+	Create    ActionKind = iota
+)
+
+func (kind ActionKind) String() string {
+	switch kind {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case ReadWrite:
+		return "readwrite"
+	case Create:
+		return "create"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(kind))
+	}
+}
+
+// Reference is a reference from one var to another. Positions may be
+// nil only if the var is created by the same txn, or has already been
+// seen by the Transactor. A nil Capability grants read and write.
+type Reference struct {
+	VarUUId    *common.VarUUId
+	Positions  *common.Positions
+	Capability *common.Capability
+}
+
+// Action is one action of a Txn. Version is only used by Read and
+// ReadWrite; if nil, the var is taken to be unknown, and so its
+// current version will be returned in the Outcome. Value and
+// References are not used by Read. Positions is ignored for Create,
+// and otherwise is as for Reference.
+type Action struct {
+	Kind       ActionKind
+	VarUUId    *common.VarUUId
+	Positions  *common.Positions
+	Version    *common.TxnId
+	Value      []byte
+	References []Reference
+}
+
+// Txn is a txn to run. If Retry is set, the txn is a retry txn: it
+// does not commit, but waits until any var it reads is changed.
+type Txn struct {
+	Actions []Action
+	Retry   bool
+}
+
+// Outcome is the outcome of a Txn. If it committed, Created gives the
+// positions of the vars it created. Otherwise, Updates gives the
+// current versions of the vars which were out of date; if there are
+// none, the txn may simply be run again.
+type Outcome struct {
+	TxnId     *common.TxnId
+	Committed bool
+	Created   map[common.VarUUId]*common.Positions
+	Updates   []Update
+}
+
+// Update is the current version of a var. If Deleted is set, the var
+// no longer exists.
+type Update struct {
+	VarUUId    *common.VarUUId
+	Version    *common.TxnId
+	Deleted    bool
+	Value      []byte
+	References []Reference
+}
+
+// Transactor runs txns through an embedded server's own connection,
+// with the same semantics as txns submitted by a client. It must be
+// shut down once no longer needed.
+type Transactor struct {
+	sync.Mutex
+	connectionManager *network.ConnectionManager
+	topology          *configuration.Topology
+}
+
+func NewTransactor(cm *network.ConnectionManager) *Transactor {
+	t := &Transactor{connectionManager: cm}
+	t.topology = cm.AddTopologySubscriber(eng.ConnectionSubscriber, t)
+	return t
+}
+
+func (t *Transactor) Shutdown() {
+	t.connectionManager.RemoveTopologySubscriberAsync(eng.ConnectionSubscriber, t)
+}
+
+// TopologyChanged is called by the server; it is not part of the API.
+func (t *Transactor) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	t.Lock()
+	t.topology = topology
+	t.Unlock()
+	done(true)
+}
+
+// Roots returns references to the roots of the current topology.
+func (t *Transactor) Roots() map[string]Reference {
+	t.Lock()
+	topology := t.topology
+	t.Unlock()
+	if topology == nil || topology.IsBlank() {
+		return nil
+	}
+	roots := make(map[string]Reference, len(topology.Roots))
+	for idx, name := range topology.RootNames() {
+		if idx < len(topology.Roots) {
+			root := &topology.Roots[idx]
+			roots[name] = Reference{
+				VarUUId:    root.VarUUId,
+				Positions:  root.Positions,
+				Capability: common.MaxCapability,
+			}
+		}
+	}
+	return roots
+}
+
+// NextVarUUId returns a fresh VarUUId, for use by Create actions.
+func (t *Transactor) NextVarUUId() *common.VarUUId {
+	return t.connectionManager.LocalConnection().NextVarUUId()
+}
+
+// RunTxn runs txn and waits for its outcome.
+func (t *Transactor) RunTxn(txn *Txn) (*Outcome, error) {
+	ctxn, varPosMap, err := clientTxn(txn)
+	if err != nil {
+		return nil, err
+	}
+	txnReader, outcome, err := t.connectionManager.LocalConnection().RunClientTransaction(ctxn, varPosMap, nil)
+	if err != nil {
+		return nil, err
+	} else if outcome == nil {
+		return nil, ErrShutdown
+	}
+	if outcome.Which() == msgs.OUTCOME_COMMIT {
+		return committedOutcome(txnReader), nil
+	}
+	result := &Outcome{TxnId: txnReader.Id}
+	if abort := outcome.Abort(); abort.Which() == msgs.OUTCOMEABORT_RERUN {
+		result.Updates = updatesFromRerun(abort.Rerun())
+	}
+	return result, nil
+}
+
+// Transact runs the txn built by fun until it commits, and returns
+// its outcome. fun is given what is known of the vars seen so far,
+// and is called afresh whenever the txn fails, once it is known which
+// vars were out of date; it should read any var it needs but is not
+// given with a nil Version. If fun returns a nil Txn, nothing more is
+// run, and a nil Outcome is returned. If the txn has not committed
+// after maxAttempts, ErrContention is returned. Retry txns cannot be
+// run by Transact.
+func (t *Transactor) Transact(maxAttempts int, fun func(vars map[common.VarUUId]*Update) (*Txn, error)) (*Outcome, error) {
+	stopped := false
+	txnReader, err := t.connectionManager.LocalConnection().RunLocalTransaction(make(client.LocalTxnCache), maxAttempts, nil,
+		func(cache client.LocalTxnCache) (*cmsgs.ClientTxn, map[common.VarUUId]*common.Positions, error) {
+			vars := make(map[common.VarUUId]*Update, len(cache))
+			for vUUId, lv := range cache {
+				vUUIdCopy := vUUId
+				vars[vUUId] = &Update{
+					VarUUId:    &vUUIdCopy,
+					Version:    lv.Version,
+					Value:      lv.Value,
+					References: referencesFromVarIdPos(lv.References),
+				}
+			}
+			txn, err := fun(vars)
+			if err != nil || txn == nil {
+				stopped = true
+				return nil, nil, err
+			} else if txn.Retry {
+				return nil, nil, errors.New("Transact cannot run retry txns")
+			}
+			return clientTxn(txn)
+		})
+	switch {
+	case err == client.ErrContention:
+		return nil, ErrContention
+	case err != nil:
+		return nil, err
+	case txnReader != nil:
+		return committedOutcome(txnReader), nil
+	case stopped:
+		return nil, nil
+	default:
+		return nil, ErrShutdown
+	}
+}
+
+func clientTxn(txn *Txn) (*cmsgs.ClientTxn, map[common.VarUUId]*common.Positions, error) {
+	seg := capn.NewBuffer(nil)
+	ctxn := cmsgs.NewClientTxn(seg)
+	ctxn.SetRetry(txn.Retry)
+	varPosMap := make(map[common.VarUUId]*common.Positions)
+	actions := cmsgs.NewClientActionList(seg, len(txn.Actions))
+	for idx, action := range txn.Actions {
+		clientAction := actions.At(idx)
+		clientAction.SetVarId(action.VarUUId[:])
+		if action.Kind != Create && action.Positions != nil {
+			varPosMap[*action.VarUUId] = action.Positions
+		}
+		version := action.Version
+		if version == nil {
+			version = common.VersionZero
+		}
+		switch action.Kind {
+		case Read:
+			clientAction.SetRead()
+			clientAction.Read().SetVersion(version[:])
+		case Write:
+			clientAction.SetWrite()
+			write := clientAction.Write()
+			write.SetValue(action.Value)
+			write.SetReferences(clientReferences(seg, varPosMap, action.References))
+		case ReadWrite:
+			clientAction.SetReadwrite()
+			rw := clientAction.Readwrite()
+			rw.SetVersion(version[:])
+			rw.SetValue(action.Value)
+			rw.SetReferences(clientReferences(seg, varPosMap, action.References))
+		case Create:
+			clientAction.SetCreate()
+			create := clientAction.Create()
+			create.SetValue(action.Value)
+			create.SetReferences(clientReferences(seg, varPosMap, action.References))
+		default:
+			return nil, nil, fmt.Errorf("Action %v has unknown kind: %v", idx, action.Kind)
+		}
+	}
+	ctxn.SetActions(actions)
+	return &ctxn, varPosMap, nil
+}
+
+func committedOutcome(txnReader *eng.TxnReader) *Outcome {
+	result := &Outcome{
+		TxnId:     txnReader.Id,
+		Committed: true,
+		Created:   make(map[common.VarUUId]*common.Positions),
+	}
+	txnActions := txnReader.Actions(true).Actions()
+	for idx, l := 0, txnActions.Len(); idx < l; idx++ {
+		if action := txnActions.At(idx); action.Which() == msgs.ACTION_CREATE {
+			positions := common.Positions(action.Create().Positions())
+			result.Created[*common.MakeVarUUId(action.VarId())] = &positions
+		}
+	}
+	return result
+}
+
+func clientReferences(seg *capn.Segment, varPosMap map[common.VarUUId]*common.Positions, refs []Reference) cmsgs.ClientVarIdPos_List {
+	clientRefs := cmsgs.NewClientVarIdPosList(seg, len(refs))
+	for idx, ref := range refs {
+		clientRef := clientRefs.At(idx)
+		clientRef.SetVarId(ref.VarUUId[:])
+		capability := ref.Capability
+		if capability == nil {
+			capability = common.MaxCapability
+		}
+		clientRef.SetCapability(capability.Capability)
+		if ref.Positions != nil {
+			varPosMap[*ref.VarUUId] = ref.Positions
+		}
+	}
+	return clientRefs
+}
+
+func updatesFromRerun(rerun msgs.Update_List) []Update {
+	updates := []Update{}
+	for idx, l := 0, rerun.Len(); idx < l; idx++ {
+		update := rerun.At(idx)
+		txnId := common.MakeTxnId(update.TxnId())
+		actions := eng.TxnActionsFromData(update.Actions(), true).Actions()
+		for idy, m := 0, actions.Len(); idy < m; idy++ {
+			action := actions.At(idy)
+			vUUId := common.MakeVarUUId(action.VarId())
+			switch action.Which() {
+			case msgs.ACTION_WRITE:
+				write := action.Write()
+				updates = append(updates, Update{
+					VarUUId:    vUUId,
+					Version:    txnId,
+					Value:      eng.ActionValue(&action, write.Value()),
+					References: referencesFromVarIdPos(write.References().ToArray()),
+				})
+			case msgs.ACTION_MISSING:
+				updates = append(updates, Update{
+					VarUUId: vUUId,
+					Version: txnId,
+					Deleted: true,
+				})
+			}
+		}
+	}
+	return updates
+}
+
+func referencesFromVarIdPos(varIdPoses []msgs.VarIdPos) []Reference {
+	refs := make([]Reference, len(varIdPoses))
+	for idx, varIdPos := range varIdPoses {
+		positions := common.Positions(varIdPos.Positions())
+		refs[idx] = Reference{
+			VarUUId:    common.MakeVarUUId(varIdPos.Id()),
+			Positions:  &positions,
+			Capability: common.NewCapability(varIdPos.Capability()),
+		}
+	}
+	return refs
+}
@@ -0,0 +1,257 @@
+package capnp
+
+// AUTO GENERATED - DO NOT EDIT
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	C "github.com/glycerine/go-capnproto"
+	"io"
+)
+
+type Audit C.Struct
+
+func NewAudit(s *C.Segment) Audit      { return Audit(s.NewStruct(16, 1)) }
+func NewRootAudit(s *C.Segment) Audit  { return Audit(s.NewRootStruct(16, 1)) }
+func AutoNewAudit(s *C.Segment) Audit  { return Audit(s.NewStructAR(16, 1)) }
+func ReadRootAudit(s *C.Segment) Audit { return Audit(s.Root(0).ToStruct()) }
+func (s Audit) Id() uint64             { return C.Struct(s).Get64(0) }
+func (s Audit) SetId(v uint64)         { C.Struct(s).Set64(0, v) }
+func (s Audit) Prefix() uint8          { return C.Struct(s).Get8(8) }
+func (s Audit) SetPrefix(v uint8)      { C.Struct(s).Set8(8, v) }
+func (s Audit) Truncated() bool        { return C.Struct(s).Get1(72) }
+func (s Audit) SetTruncated(v bool)    { C.Struct(s).Set1(72, v) }
+func (s Audit) Vars() Var_List         { return Var_List(C.Struct(s).GetObject(0)) }
+func (s Audit) SetVars(v Var_List)     { C.Struct(s).SetObject(0, C.Object(v)) }
+func (s Audit) WriteJSON(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	var err error
+	var buf []byte
+	_ = buf
+	err = b.WriteByte('{')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"id\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Id()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"prefix\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Prefix()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"truncated\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Truncated()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"vars\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Vars()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				err = s.WriteJSON(b)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte('}')
+	if err != nil {
+		return err
+	}
+	err = b.Flush()
+	return err
+}
+func (s Audit) MarshalJSON() ([]byte, error) {
+	b := bytes.Buffer{}
+	err := s.WriteJSON(&b)
+	return b.Bytes(), err
+}
+func (s Audit) WriteCapLit(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	var err error
+	var buf []byte
+	_ = buf
+	err = b.WriteByte('(')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("id = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Id()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("prefix = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Prefix()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("truncated = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Truncated()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("vars = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Vars()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				err = s.WriteCapLit(b)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(')')
+	if err != nil {
+		return err
+	}
+	err = b.Flush()
+	return err
+}
+func (s Audit) MarshalCapLit() ([]byte, error) {
+	b := bytes.Buffer{}
+	err := s.WriteCapLit(&b)
+	return b.Bytes(), err
+}
+
+type Audit_List C.PointerList
+
+func NewAuditList(s *C.Segment, sz int) Audit_List {
+	return Audit_List(s.NewCompositeList(16, 1, sz))
+}
+func (s Audit_List) Len() int       { return C.PointerList(s).Len() }
+func (s Audit_List) At(i int) Audit { return Audit(C.PointerList(s).At(i).ToStruct()) }
+func (s Audit_List) ToArray() []Audit {
+	n := s.Len()
+	a := make([]Audit, n)
+	for i := 0; i < n; i++ {
+		a[i] = s.At(i)
+	}
+	return a
+}
+func (s Audit_List) Set(i int, item Audit) { C.PointerList(s).Set(i, C.Object(item)) }
@@ -20,9 +20,9 @@ const (
 	CONFIGURATION_STABLE          Configuration_Which = 1
 )
 
-func NewConfiguration(s *C.Segment) Configuration      { return Configuration(s.NewStruct(24, 14)) }
-func NewRootConfiguration(s *C.Segment) Configuration  { return Configuration(s.NewRootStruct(24, 14)) }
-func AutoNewConfiguration(s *C.Segment) Configuration  { return Configuration(s.NewStructAR(24, 14)) }
+func NewConfiguration(s *C.Segment) Configuration      { return Configuration(s.NewStruct(24, 18)) }
+func NewRootConfiguration(s *C.Segment) Configuration  { return Configuration(s.NewRootStruct(24, 18)) }
+func AutoNewConfiguration(s *C.Segment) Configuration  { return Configuration(s.NewStructAR(24, 18)) }
 func ReadRootConfiguration(s *C.Segment) Configuration { return Configuration(s.Root(0).ToStruct()) }
 func (s Configuration) Which() Configuration_Which     { return Configuration_Which(C.Struct(s).Get16(16)) }
 func (s Configuration) ClusterId() string              { return C.Struct(s).GetObject(0).ToText() }
@@ -48,6 +48,24 @@ func (s Configuration) Fingerprints() Fingerprint_List {
 	return Fingerprint_List(C.Struct(s).GetObject(4))
 }
 func (s Configuration) SetFingerprints(v Fingerprint_List) { C.Struct(s).SetObject(4, C.Object(v)) }
+func (s Configuration) Placement() Placement_List {
+	return Placement_List(C.Struct(s).GetObject(14))
+}
+func (s Configuration) SetPlacement(v Placement_List) { C.Struct(s).SetObject(14, C.Object(v)) }
+func (s Configuration) Learners() Learner_List {
+	return Learner_List(C.Struct(s).GetObject(15))
+}
+func (s Configuration) SetLearners(v Learner_List) { C.Struct(s).SetObject(15, C.Object(v)) }
+func (s Configuration) FailureDomains() FailureDomain_List {
+	return FailureDomain_List(C.Struct(s).GetObject(16))
+}
+func (s Configuration) SetFailureDomains(v FailureDomain_List) {
+	C.Struct(s).SetObject(16, C.Object(v))
+}
+func (s Configuration) SignedBundle() []byte { return C.Struct(s).GetObject(17).ToData() }
+func (s Configuration) SetSignedBundle(v []byte) {
+	C.Struct(s).SetObject(17, s.Segment.NewData(v))
+}
 func (s Configuration) TransitioningTo() ConfigurationTransitioningTo {
 	return ConfigurationTransitioningTo(s)
 }
@@ -720,6 +738,124 @@ func (s Configuration) WriteJSON(w io.Writer) error {
 			return err
 		}
 	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"placement\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Placement()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				err = s.WriteJSON(b)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"learners\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Learners()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				err = s.WriteJSON(b)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"failureDomains\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.FailureDomains()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				err = s.WriteJSON(b)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"signedBundle\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.SignedBundle()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
 	err = b.WriteByte('}')
 	if err != nil {
 		return err
@@ -1345,6 +1481,124 @@ func (s Configuration) WriteCapLit(w io.Writer) error {
 			return err
 		}
 	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("placement = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Placement()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				err = s.WriteCapLit(b)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("learners = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Learners()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				err = s.WriteCapLit(b)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("failureDomains = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.FailureDomains()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				err = s.WriteCapLit(b)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("signedBundle = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.SignedBundle()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
 	err = b.WriteByte(')')
 	if err != nil {
 		return err
@@ -1361,7 +1615,7 @@ func (s Configuration) MarshalCapLit() ([]byte, error) {
 type Configuration_List C.PointerList
 
 func NewConfigurationList(s *C.Segment, sz int) Configuration_List {
-	return Configuration_List(s.NewCompositeList(24, 14, sz))
+	return Configuration_List(s.NewCompositeList(24, 18, sz))
 }
 func (s Configuration_List) Len() int { return C.PointerList(s).Len() }
 func (s Configuration_List) At(i int) Configuration {
@@ -1543,6 +1797,531 @@ func (s Fingerprint_List) ToArray() []Fingerprint {
 }
 func (s Fingerprint_List) Set(i int, item Fingerprint) { C.PointerList(s).Set(i, C.Object(item)) }
 
+type Placement C.Struct
+
+func NewPlacement(s *C.Segment) Placement      { return Placement(s.NewStruct(0, 2)) }
+func NewRootPlacement(s *C.Segment) Placement  { return Placement(s.NewRootStruct(0, 2)) }
+func AutoNewPlacement(s *C.Segment) Placement  { return Placement(s.NewStructAR(0, 2)) }
+func ReadRootPlacement(s *C.Segment) Placement { return Placement(s.Root(0).ToStruct()) }
+func (s Placement) Root() string               { return C.Struct(s).GetObject(0).ToText() }
+func (s Placement) RootBytes() []byte          { return C.Struct(s).GetObject(0).ToDataTrimLastByte() }
+func (s Placement) SetRoot(v string)           { C.Struct(s).SetObject(0, s.Segment.NewText(v)) }
+func (s Placement) Hosts() C.TextList          { return C.TextList(C.Struct(s).GetObject(1)) }
+func (s Placement) SetHosts(v C.TextList)      { C.Struct(s).SetObject(1, C.Object(v)) }
+func (s Placement) WriteJSON(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	var err error
+	var buf []byte
+	_ = buf
+	err = b.WriteByte('{')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"root\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Root()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"hosts\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Hosts()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				buf, err = json.Marshal(s)
+				if err != nil {
+					return err
+				}
+				_, err = b.Write(buf)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte('}')
+	if err != nil {
+		return err
+	}
+	err = b.Flush()
+	return err
+}
+func (s Placement) MarshalJSON() ([]byte, error) {
+	b := bytes.Buffer{}
+	err := s.WriteJSON(&b)
+	return b.Bytes(), err
+}
+func (s Placement) WriteCapLit(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	var err error
+	var buf []byte
+	_ = buf
+	err = b.WriteByte('(')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("root = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Root()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("hosts = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Hosts()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				buf, err = json.Marshal(s)
+				if err != nil {
+					return err
+				}
+				_, err = b.Write(buf)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(')')
+	if err != nil {
+		return err
+	}
+	err = b.Flush()
+	return err
+}
+func (s Placement) MarshalCapLit() ([]byte, error) {
+	b := bytes.Buffer{}
+	err := s.WriteCapLit(&b)
+	return b.Bytes(), err
+}
+
+type Placement_List C.PointerList
+
+func NewPlacementList(s *C.Segment, sz int) Placement_List {
+	return Placement_List(s.NewCompositeList(0, 2, sz))
+}
+func (s Placement_List) Len() int           { return C.PointerList(s).Len() }
+func (s Placement_List) At(i int) Placement { return Placement(C.PointerList(s).At(i).ToStruct()) }
+func (s Placement_List) ToArray() []Placement {
+	n := s.Len()
+	a := make([]Placement, n)
+	for i := 0; i < n; i++ {
+		a[i] = s.At(i)
+	}
+	return a
+}
+func (s Placement_List) Set(i int, item Placement) { C.PointerList(s).Set(i, C.Object(item)) }
+
+type Learner C.Struct
+
+func NewLearner(s *C.Segment) Learner      { return Learner(s.NewStruct(0, 2)) }
+func NewRootLearner(s *C.Segment) Learner  { return Learner(s.NewRootStruct(0, 2)) }
+func AutoNewLearner(s *C.Segment) Learner  { return Learner(s.NewStructAR(0, 2)) }
+func ReadRootLearner(s *C.Segment) Learner { return Learner(s.Root(0).ToStruct()) }
+func (s Learner) Host() string                 { return C.Struct(s).GetObject(0).ToText() }
+func (s Learner) HostBytes() []byte            { return C.Struct(s).GetObject(0).ToDataTrimLastByte() }
+func (s Learner) SetHost(v string)             { C.Struct(s).SetObject(0, s.Segment.NewText(v)) }
+func (s Learner) Roots() C.TextList            { return C.TextList(C.Struct(s).GetObject(1)) }
+func (s Learner) SetRoots(v C.TextList)        { C.Struct(s).SetObject(1, C.Object(v)) }
+func (s Learner) WriteJSON(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	var err error
+	var buf []byte
+	_ = buf
+	err = b.WriteByte('{')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"host\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Host()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"roots\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Roots()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				buf, err = json.Marshal(s)
+				if err != nil {
+					return err
+				}
+				_, err = b.Write(buf)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte('}')
+	if err != nil {
+		return err
+	}
+	err = b.Flush()
+	return err
+}
+func (s Learner) MarshalJSON() ([]byte, error) {
+	b := bytes.Buffer{}
+	err := s.WriteJSON(&b)
+	return b.Bytes(), err
+}
+func (s Learner) WriteCapLit(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	var err error
+	var buf []byte
+	_ = buf
+	err = b.WriteByte('(')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("host = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Host()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("roots = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Roots()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				buf, err = json.Marshal(s)
+				if err != nil {
+					return err
+				}
+				_, err = b.Write(buf)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(')')
+	if err != nil {
+		return err
+	}
+	err = b.Flush()
+	return err
+}
+func (s Learner) MarshalCapLit() ([]byte, error) {
+	b := bytes.Buffer{}
+	err := s.WriteCapLit(&b)
+	return b.Bytes(), err
+}
+
+type Learner_List C.PointerList
+
+func NewLearnerList(s *C.Segment, sz int) Learner_List {
+	return Learner_List(s.NewCompositeList(0, 2, sz))
+}
+func (s Learner_List) Len() int           { return C.PointerList(s).Len() }
+func (s Learner_List) At(i int) Learner { return Learner(C.PointerList(s).At(i).ToStruct()) }
+func (s Learner_List) ToArray() []Learner {
+	n := s.Len()
+	a := make([]Learner, n)
+	for i := 0; i < n; i++ {
+		a[i] = s.At(i)
+	}
+	return a
+}
+func (s Learner_List) Set(i int, item Learner) { C.PointerList(s).Set(i, C.Object(item)) }
+
+type FailureDomain C.Struct
+
+func NewFailureDomain(s *C.Segment) FailureDomain      { return FailureDomain(s.NewStruct(0, 2)) }
+func NewRootFailureDomain(s *C.Segment) FailureDomain  { return FailureDomain(s.NewRootStruct(0, 2)) }
+func AutoNewFailureDomain(s *C.Segment) FailureDomain  { return FailureDomain(s.NewStructAR(0, 2)) }
+func ReadRootFailureDomain(s *C.Segment) FailureDomain { return FailureDomain(s.Root(0).ToStruct()) }
+func (s FailureDomain) Name() string                 { return C.Struct(s).GetObject(0).ToText() }
+func (s FailureDomain) NameBytes() []byte            { return C.Struct(s).GetObject(0).ToDataTrimLastByte() }
+func (s FailureDomain) SetName(v string)             { C.Struct(s).SetObject(0, s.Segment.NewText(v)) }
+func (s FailureDomain) Hosts() C.TextList            { return C.TextList(C.Struct(s).GetObject(1)) }
+func (s FailureDomain) SetHosts(v C.TextList)        { C.Struct(s).SetObject(1, C.Object(v)) }
+func (s FailureDomain) WriteJSON(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	var err error
+	var buf []byte
+	_ = buf
+	err = b.WriteByte('{')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"name\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Name()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"hosts\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Hosts()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				buf, err = json.Marshal(s)
+				if err != nil {
+					return err
+				}
+				_, err = b.Write(buf)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte('}')
+	if err != nil {
+		return err
+	}
+	err = b.Flush()
+	return err
+}
+func (s FailureDomain) MarshalJSON() ([]byte, error) {
+	b := bytes.Buffer{}
+	err := s.WriteJSON(&b)
+	return b.Bytes(), err
+}
+func (s FailureDomain) WriteCapLit(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	var err error
+	var buf []byte
+	_ = buf
+	err = b.WriteByte('(')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("name = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Name()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("hosts = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Hosts()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				buf, err = json.Marshal(s)
+				if err != nil {
+					return err
+				}
+				_, err = b.Write(buf)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(')')
+	if err != nil {
+		return err
+	}
+	err = b.Flush()
+	return err
+}
+func (s FailureDomain) MarshalCapLit() ([]byte, error) {
+	b := bytes.Buffer{}
+	err := s.WriteCapLit(&b)
+	return b.Bytes(), err
+}
+
+type FailureDomain_List C.PointerList
+
+func NewFailureDomainList(s *C.Segment, sz int) FailureDomain_List {
+	return FailureDomain_List(s.NewCompositeList(0, 2, sz))
+}
+func (s FailureDomain_List) Len() int           { return C.PointerList(s).Len() }
+func (s FailureDomain_List) At(i int) FailureDomain { return FailureDomain(C.PointerList(s).At(i).ToStruct()) }
+func (s FailureDomain_List) ToArray() []FailureDomain {
+	n := s.Len()
+	a := make([]FailureDomain, n)
+	for i := 0; i < n; i++ {
+		a[i] = s.At(i)
+	}
+	return a
+}
+func (s FailureDomain_List) Set(i int, item FailureDomain) { C.PointerList(s).Set(i, C.Object(item)) }
+
 type Root C.Struct
 
 func NewRoot(s *C.Segment) Root      { return Root(s.NewStruct(0, 2)) }
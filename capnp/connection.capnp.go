@@ -13,13 +13,13 @@ import (
 type HelloServerFromServer C.Struct
 
 func NewHelloServerFromServer(s *C.Segment) HelloServerFromServer {
-	return HelloServerFromServer(s.NewStruct(24, 2))
+	return HelloServerFromServer(s.NewStruct(32, 3))
 }
 func NewRootHelloServerFromServer(s *C.Segment) HelloServerFromServer {
-	return HelloServerFromServer(s.NewRootStruct(24, 2))
+	return HelloServerFromServer(s.NewRootStruct(32, 3))
 }
 func AutoNewHelloServerFromServer(s *C.Segment) HelloServerFromServer {
-	return HelloServerFromServer(s.NewStructAR(24, 2))
+	return HelloServerFromServer(s.NewStructAR(32, 3))
 }
 func ReadRootHelloServerFromServer(s *C.Segment) HelloServerFromServer {
 	return HelloServerFromServer(s.Root(0).ToStruct())
@@ -39,9 +39,17 @@ func (s HelloServerFromServer) ClusterId() string     { return C.Struct(s).GetOb
 func (s HelloServerFromServer) ClusterIdBytes() []byte {
 	return C.Struct(s).GetObject(1).ToDataTrimLastByte()
 }
-func (s HelloServerFromServer) SetClusterId(v string)   { C.Struct(s).SetObject(1, s.Segment.NewText(v)) }
-func (s HelloServerFromServer) ClusterUUId() uint64     { return C.Struct(s).Get64(16) }
-func (s HelloServerFromServer) SetClusterUUId(v uint64) { C.Struct(s).Set64(16, v) }
+func (s HelloServerFromServer) SetClusterId(v string)      { C.Struct(s).SetObject(1, s.Segment.NewText(v)) }
+func (s HelloServerFromServer) ClusterUUId() uint64        { return C.Struct(s).Get64(16) }
+func (s HelloServerFromServer) SetClusterUUId(v uint64)    { C.Struct(s).Set64(16, v) }
+func (s HelloServerFromServer) FeatureVersion() uint32     { return C.Struct(s).Get32(12) }
+func (s HelloServerFromServer) SetFeatureVersion(v uint32) { C.Struct(s).Set32(12, v) }
+func (s HelloServerFromServer) Link() uint8                { return C.Struct(s).Get8(24) }
+func (s HelloServerFromServer) SetLink(v uint8)            { C.Struct(s).Set8(24, v) }
+func (s HelloServerFromServer) Links() uint8               { return C.Struct(s).Get8(25) }
+func (s HelloServerFromServer) SetLinks(v uint8)           { C.Struct(s).Set8(25, v) }
+func (s HelloServerFromServer) Attestation() []byte         { return C.Struct(s).GetObject(2).ToData() }
+func (s HelloServerFromServer) SetAttestation(v []byte)     { C.Struct(s).SetObject(2, s.Segment.NewData(v)) }
 func (s HelloServerFromServer) WriteJSON(w io.Writer) error {
 	b := bufio.NewWriter(w)
 	var err error
@@ -161,6 +169,82 @@ func (s HelloServerFromServer) WriteJSON(w io.Writer) error {
 			return err
 		}
 	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"featureVersion\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.FeatureVersion()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"link\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Link()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"links\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Links()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"attestation\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Attestation()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
 	err = b.WriteByte('}')
 	if err != nil {
 		return err
@@ -292,6 +376,82 @@ func (s HelloServerFromServer) WriteCapLit(w io.Writer) error {
 			return err
 		}
 	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("featureVersion = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.FeatureVersion()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("link = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Link()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("links = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Links()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("attestation = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Attestation()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
 	err = b.WriteByte(')')
 	if err != nil {
 		return err
@@ -308,7 +468,7 @@ func (s HelloServerFromServer) MarshalCapLit() ([]byte, error) {
 type HelloServerFromServer_List C.PointerList
 
 func NewHelloServerFromServerList(s *C.Segment, sz int) HelloServerFromServer_List {
-	return HelloServerFromServer_List(s.NewCompositeList(24, 2, sz))
+	return HelloServerFromServer_List(s.NewCompositeList(32, 3, sz))
 }
 func (s HelloServerFromServer_List) Len() int { return C.PointerList(s).Len() }
 func (s HelloServerFromServer_List) At(i int) HelloServerFromServer {
@@ -346,6 +506,14 @@ const (
 	MESSAGE_TOPOLOGYCHANGEREQUEST Message_Which = 13
 	MESSAGE_MIGRATION             Message_Which = 14
 	MESSAGE_MIGRATIONCOMPLETE     Message_Which = 15
+	MESSAGE_FROZENVARS            Message_Which = 16
+	MESSAGE_PING                  Message_Which = 17
+	MESSAGE_PONG                  Message_Which = 18
+	MESSAGE_DEGRADED              Message_Which = 19
+	MESSAGE_AUDITREQUEST          Message_Which = 20
+	MESSAGE_AUDITRESPONSE         Message_Which = 21
+	MESSAGE_MIGRATIONESTIMATE     Message_Which = 22
+	MESSAGE_VOTEBATCH             Message_Which = 23
 )
 
 func NewMessage(s *C.Segment) Message          { return Message(s.NewStruct(8, 1)) }
@@ -438,6 +606,39 @@ func (s Message) SetMigrationComplete(v MigrationComplete) {
 	C.Struct(s).Set16(0, 15)
 	C.Struct(s).SetObject(0, C.Object(v))
 }
+func (s Message) FrozenVars() Update_List { return Update_List(C.Struct(s).GetObject(0)) }
+func (s Message) SetFrozenVars(v Update_List) {
+	C.Struct(s).Set16(0, 16)
+	C.Struct(s).SetObject(0, C.Object(v))
+}
+func (s Message) Ping() uint32     { return C.Struct(s).Get32(4) }
+func (s Message) SetPing(v uint32) { C.Struct(s).Set16(0, 17); C.Struct(s).Set32(4, v) }
+func (s Message) Pong() uint32     { return C.Struct(s).Get32(4) }
+func (s Message) SetPong(v uint32) { C.Struct(s).Set16(0, 18); C.Struct(s).Set32(4, v) }
+func (s Message) Degraded() bool     { return C.Struct(s).Get1(32) }
+func (s Message) SetDegraded(v bool) { C.Struct(s).Set16(0, 19); C.Struct(s).Set1(32, v) }
+func (s Message) AuditRequest() Audit  { return Audit(C.Struct(s).GetObject(0).ToStruct()) }
+func (s Message) SetAuditRequest(v Audit) {
+	C.Struct(s).Set16(0, 20)
+	C.Struct(s).SetObject(0, C.Object(v))
+}
+func (s Message) AuditResponse() Audit { return Audit(C.Struct(s).GetObject(0).ToStruct()) }
+func (s Message) SetAuditResponse(v Audit) {
+	C.Struct(s).Set16(0, 21)
+	C.Struct(s).SetObject(0, C.Object(v))
+}
+func (s Message) MigrationEstimate() MigrationEstimate {
+	return MigrationEstimate(C.Struct(s).GetObject(0).ToStruct())
+}
+func (s Message) SetMigrationEstimate(v MigrationEstimate) {
+	C.Struct(s).Set16(0, 22)
+	C.Struct(s).SetObject(0, C.Object(v))
+}
+func (s Message) VoteBatch() C.DataList { return C.DataList(C.Struct(s).GetObject(0)) }
+func (s Message) SetVoteBatch(v C.DataList) {
+	C.Struct(s).Set16(0, 23)
+	C.Struct(s).SetObject(0, C.Object(v))
+}
 func (s Message) WriteJSON(w io.Writer) error {
 	b := bufio.NewWriter(w)
 	var err error
@@ -659,6 +860,162 @@ func (s Message) WriteJSON(w io.Writer) error {
 			}
 		}
 	}
+	if s.Which() == MESSAGE_FROZENVARS {
+		_, err = b.WriteString("\"frozenVars\":")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.FrozenVars()
+			{
+				err = b.WriteByte('[')
+				if err != nil {
+					return err
+				}
+				for i, s := range s.ToArray() {
+					if i != 0 {
+						_, err = b.WriteString(", ")
+					}
+					if err != nil {
+						return err
+					}
+					err = s.WriteJSON(b)
+					if err != nil {
+						return err
+					}
+				}
+				err = b.WriteByte(']')
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_PING {
+		_, err = b.WriteString("\"ping\":")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.Ping()
+			buf, err = json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			_, err = b.Write(buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_PONG {
+		_, err = b.WriteString("\"pong\":")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.Pong()
+			buf, err = json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			_, err = b.Write(buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_DEGRADED {
+		_, err = b.WriteString("\"degraded\":")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.Degraded()
+			buf, err = json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			_, err = b.Write(buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_AUDITREQUEST {
+		_, err = b.WriteString("\"auditRequest\":")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.AuditRequest()
+			err = s.WriteJSON(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_AUDITRESPONSE {
+		_, err = b.WriteString("\"auditResponse\":")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.AuditResponse()
+			err = s.WriteJSON(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_MIGRATIONESTIMATE {
+		_, err = b.WriteString("\"migrationEstimate\":")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.MigrationEstimate()
+			err = s.WriteJSON(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_VOTEBATCH {
+		_, err = b.WriteString("\"voteBatch\":")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.VoteBatch()
+			{
+				err = b.WriteByte('[')
+				if err != nil {
+					return err
+				}
+				for i, s := range s.ToArray() {
+					if i != 0 {
+						_, err = b.WriteString(", ")
+					}
+					if err != nil {
+						return err
+					}
+					buf, err = json.Marshal(s)
+					if err != nil {
+						return err
+					}
+					_, err = b.Write(buf)
+					if err != nil {
+						return err
+					}
+				}
+				err = b.WriteByte(']')
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
 	err = b.WriteByte('}')
 	if err != nil {
 		return err
@@ -892,6 +1249,162 @@ func (s Message) WriteCapLit(w io.Writer) error {
 			}
 		}
 	}
+	if s.Which() == MESSAGE_FROZENVARS {
+		_, err = b.WriteString("frozenVars = ")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.FrozenVars()
+			{
+				err = b.WriteByte('[')
+				if err != nil {
+					return err
+				}
+				for i, s := range s.ToArray() {
+					if i != 0 {
+						_, err = b.WriteString(", ")
+					}
+					if err != nil {
+						return err
+					}
+					err = s.WriteCapLit(b)
+					if err != nil {
+						return err
+					}
+				}
+				err = b.WriteByte(']')
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_PING {
+		_, err = b.WriteString("ping = ")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.Ping()
+			buf, err = json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			_, err = b.Write(buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_PONG {
+		_, err = b.WriteString("pong = ")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.Pong()
+			buf, err = json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			_, err = b.Write(buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_DEGRADED {
+		_, err = b.WriteString("degraded = ")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.Degraded()
+			buf, err = json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			_, err = b.Write(buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_AUDITREQUEST {
+		_, err = b.WriteString("auditRequest = ")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.AuditRequest()
+			err = s.WriteCapLit(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_AUDITRESPONSE {
+		_, err = b.WriteString("auditResponse = ")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.AuditResponse()
+			err = s.WriteCapLit(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_MIGRATIONESTIMATE {
+		_, err = b.WriteString("migrationEstimate = ")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.MigrationEstimate()
+			err = s.WriteCapLit(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Which() == MESSAGE_VOTEBATCH {
+		_, err = b.WriteString("voteBatch = ")
+		if err != nil {
+			return err
+		}
+		{
+			s := s.VoteBatch()
+			{
+				err = b.WriteByte('[')
+				if err != nil {
+					return err
+				}
+				for i, s := range s.ToArray() {
+					if i != 0 {
+						_, err = b.WriteString(", ")
+					}
+					if err != nil {
+						return err
+					}
+					buf, err = json.Marshal(s)
+					if err != nil {
+						return err
+					}
+					_, err = b.Write(buf)
+					if err != nil {
+						return err
+					}
+				}
+				err = b.WriteByte(']')
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
 	err = b.WriteByte(')')
 	if err != nil {
 		return err
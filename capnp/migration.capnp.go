@@ -286,6 +286,154 @@ func (s MigrationComplete_List) Set(i int, item MigrationComplete) {
 	C.PointerList(s).Set(i, C.Object(item))
 }
 
+type MigrationEstimate C.Struct
+
+func NewMigrationEstimate(s *C.Segment) MigrationEstimate { return MigrationEstimate(s.NewStruct(16, 0)) }
+func NewRootMigrationEstimate(s *C.Segment) MigrationEstimate {
+	return MigrationEstimate(s.NewRootStruct(16, 0))
+}
+func AutoNewMigrationEstimate(s *C.Segment) MigrationEstimate {
+	return MigrationEstimate(s.NewStructAR(16, 0))
+}
+func ReadRootMigrationEstimate(s *C.Segment) MigrationEstimate {
+	return MigrationEstimate(s.Root(0).ToStruct())
+}
+func (s MigrationEstimate) Version() uint32     { return C.Struct(s).Get32(0) }
+func (s MigrationEstimate) SetVersion(v uint32) { C.Struct(s).Set32(0, v) }
+func (s MigrationEstimate) Bytes() uint64       { return C.Struct(s).Get64(8) }
+func (s MigrationEstimate) SetBytes(v uint64)   { C.Struct(s).Set64(8, v) }
+func (s MigrationEstimate) WriteJSON(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	var err error
+	var buf []byte
+	_ = buf
+	err = b.WriteByte('{')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"version\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Version()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"bytes\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Bytes()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte('}')
+	if err != nil {
+		return err
+	}
+	err = b.Flush()
+	return err
+}
+func (s MigrationEstimate) MarshalJSON() ([]byte, error) {
+	b := bytes.Buffer{}
+	err := s.WriteJSON(&b)
+	return b.Bytes(), err
+}
+func (s MigrationEstimate) WriteCapLit(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	var err error
+	var buf []byte
+	_ = buf
+	err = b.WriteByte('(')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("version = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Version()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("bytes = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Bytes()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(')')
+	if err != nil {
+		return err
+	}
+	err = b.Flush()
+	return err
+}
+func (s MigrationEstimate) MarshalCapLit() ([]byte, error) {
+	b := bytes.Buffer{}
+	err := s.WriteCapLit(&b)
+	return b.Bytes(), err
+}
+
+type MigrationEstimate_List C.PointerList
+
+func NewMigrationEstimateList(s *C.Segment, sz int) MigrationEstimate_List {
+	return MigrationEstimate_List(s.NewCompositeList(16, 0, sz))
+}
+func (s MigrationEstimate_List) Len() int { return C.PointerList(s).Len() }
+func (s MigrationEstimate_List) At(i int) MigrationEstimate {
+	return MigrationEstimate(C.PointerList(s).At(i).ToStruct())
+}
+func (s MigrationEstimate_List) ToArray() []MigrationEstimate {
+	n := s.Len()
+	a := make([]MigrationEstimate, n)
+	for i := 0; i < n; i++ {
+		a[i] = s.At(i)
+	}
+	return a
+}
+func (s MigrationEstimate_List) Set(i int, item MigrationEstimate) {
+	C.PointerList(s).Set(i, C.Object(item))
+}
+
 type MigrationElement C.Struct
 
 func NewMigrationElement(s *C.Segment) MigrationElement { return MigrationElement(s.NewStruct(0, 2)) }
@@ -12,9 +12,9 @@ import (
 
 type Txn C.Struct
 
-func NewTxn(s *C.Segment) Txn                  { return Txn(s.NewStruct(16, 3)) }
-func NewRootTxn(s *C.Segment) Txn              { return Txn(s.NewRootStruct(16, 3)) }
-func AutoNewTxn(s *C.Segment) Txn              { return Txn(s.NewStructAR(16, 3)) }
+func NewTxn(s *C.Segment) Txn                  { return Txn(s.NewStruct(24, 4)) }
+func NewRootTxn(s *C.Segment) Txn              { return Txn(s.NewRootStruct(24, 4)) }
+func AutoNewTxn(s *C.Segment) Txn              { return Txn(s.NewStructAR(24, 4)) }
 func ReadRootTxn(s *C.Segment) Txn             { return Txn(s.Root(0).ToStruct()) }
 func (s Txn) Id() []byte                       { return C.Struct(s).GetObject(0).ToData() }
 func (s Txn) SetId(v []byte)                   { C.Struct(s).SetObject(0, s.Segment.NewData(v)) }
@@ -32,6 +32,10 @@ func (s Txn) FInc() uint8                      { return C.Struct(s).Get8(9) }
 func (s Txn) SetFInc(v uint8)                  { C.Struct(s).Set8(9, v) }
 func (s Txn) TopologyVersion() uint32          { return C.Struct(s).Get32(12) }
 func (s Txn) SetTopologyVersion(v uint32)      { C.Struct(s).Set32(12, v) }
+func (s Txn) Acceptors() C.UInt32List         { return C.UInt32List(C.Struct(s).GetObject(3)) }
+func (s Txn) SetAcceptors(v C.UInt32List)     { C.Struct(s).SetObject(3, C.Object(v)) }
+func (s Txn) TraceId() uint64                  { return C.Struct(s).Get64(16) }
+func (s Txn) SetTraceId(v uint64)              { C.Struct(s).Set64(16, v) }
 func (s Txn) WriteJSON(w io.Writer) error {
 	b := bufio.NewWriter(w)
 	var err error
@@ -203,6 +207,62 @@ func (s Txn) WriteJSON(w io.Writer) error {
 			return err
 		}
 	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"acceptors\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Acceptors()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				buf, err = json.Marshal(s)
+				if err != nil {
+					return err
+				}
+				_, err = b.Write(buf)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"traceId\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.TraceId()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
 	err = b.WriteByte('}')
 	if err != nil {
 		return err
@@ -386,6 +446,62 @@ func (s Txn) WriteCapLit(w io.Writer) error {
 			return err
 		}
 	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("acceptors = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Acceptors()
+		{
+			err = b.WriteByte('[')
+			if err != nil {
+				return err
+			}
+			for i, s := range s.ToArray() {
+				if i != 0 {
+					_, err = b.WriteString(", ")
+				}
+				if err != nil {
+					return err
+				}
+				buf, err = json.Marshal(s)
+				if err != nil {
+					return err
+				}
+				_, err = b.Write(buf)
+				if err != nil {
+					return err
+				}
+			}
+			err = b.WriteByte(']')
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("traceId = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.TraceId()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
 	err = b.WriteByte(')')
 	if err != nil {
 		return err
@@ -401,7 +517,7 @@ func (s Txn) MarshalCapLit() ([]byte, error) {
 
 type Txn_List C.PointerList
 
-func NewTxnList(s *C.Segment, sz int) Txn_List { return Txn_List(s.NewCompositeList(16, 3, sz)) }
+func NewTxnList(s *C.Segment, sz int) Txn_List { return Txn_List(s.NewCompositeList(24, 4, sz)) }
 func (s Txn_List) Len() int                    { return C.PointerList(s).Len() }
 func (s Txn_List) At(i int) Txn                { return Txn(C.PointerList(s).At(i).ToStruct()) }
 func (s Txn_List) ToArray() []Txn {
@@ -609,6 +725,10 @@ func (s ActionRoll) Value() []byte                      { return C.Struct(s).Get
 func (s ActionRoll) SetValue(v []byte)                  { C.Struct(s).SetObject(2, s.Segment.NewData(v)) }
 func (s ActionRoll) References() VarIdPos_List          { return VarIdPos_List(C.Struct(s).GetObject(3)) }
 func (s ActionRoll) SetReferences(v VarIdPos_List)      { C.Struct(s).SetObject(3, C.Object(v)) }
+func (s Action) ValueCodec() uint8                      { return C.Struct(s).Get8(2) }
+func (s Action) SetValueCodec(v uint8)                  { C.Struct(s).Set8(2, v) }
+func (s Action) Frozen() bool                           { return C.Struct(s).Get1(24) }
+func (s Action) SetFrozen(v bool)                       { C.Struct(s).Set1(24, v) }
 func (s Action) WriteJSON(w io.Writer) error {
 	b := bufio.NewWriter(w)
 	var err error
@@ -1011,6 +1131,44 @@ func (s Action) WriteJSON(w io.Writer) error {
 			}
 		}
 	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"valueCodec\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.ValueCodec()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"frozen\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Frozen()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
 	err = b.WriteByte('}')
 	if err != nil {
 		return err
@@ -1425,6 +1583,44 @@ func (s Action) WriteCapLit(w io.Writer) error {
 			}
 		}
 	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("valueCodec = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.ValueCodec()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = b.WriteString(", ")
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("frozen = ")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Frozen()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
 	err = b.WriteByte(')')
 	if err != nil {
 		return err
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	capn "github.com/glycerine/go-capnproto"
+	"github.com/prometheus/client_golang/prometheus"
 	"goshawkdb.io/common"
 	cmsgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
@@ -12,6 +13,31 @@ import (
 	eng "goshawkdb.io/server/txnengine"
 )
 
+var (
+	clientTxnsCancelled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "client_txns_cancelled_total",
+		Help:      "Number of client txns aborted because their client went away before they completed.",
+	})
+	clientTxnReferences = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "goshawkdb",
+		Name:      "client_txn_widest_references",
+		Help:      "Most references given to a single var by each client txn.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	})
+	clientTxnsTooManyReferences = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "client_txns_too_many_references_total",
+		Help:      "Number of client txns rejected because they gave a var more than the maximum number of references.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(clientTxnsCancelled)
+	prometheus.MustRegister(clientTxnReferences)
+	prometheus.MustRegister(clientTxnsTooManyReferences)
+}
+
 type ClientTxnCompletionConsumer func(*cmsgs.ClientTxnOutcome, error) error
 
 type ClientTxnSubmitter struct {
@@ -19,18 +45,51 @@ type ClientTxnSubmitter struct {
 	versionCache versionCache
 	txnLive      bool
 	backoff      *server.BinaryBackoffEngine
+	idAuditor    IdAuditor
+	staleReads   func(drift uint64)
+	maxRefs      int
 }
 
-func NewClientTxnSubmitter(rmId common.RMId, bootCount uint32, roots map[common.VarUUId]*common.Capability, cm paxos.ConnectionManager) *ClientTxnSubmitter {
+func NewClientTxnSubmitter(rmId common.RMId, bootCount uint32, roots map[common.VarUUId]*common.Capability, cm paxos.ConnectionManager, idAuditor IdAuditor) *ClientTxnSubmitter {
 	sts := NewSimpleTxnSubmitter(rmId, bootCount, cm)
+	// Once the client has gone, nothing will receive the outcome of
+	// its txns, so there's no point letting them run to completion.
+	sts.abortOnShutdown = true
 	return &ClientTxnSubmitter{
 		SimpleTxnSubmitter: sts,
 		versionCache:       NewVersionCache(roots),
 		txnLive:            false,
 		backoff:            server.NewBinaryBackoffEngine(sts.rng, server.SubmissionMinSubmitDelay, server.SubmissionMaxSubmitDelay),
+		idAuditor:          idAuditor,
 	}
 }
 
+// AuditClientTransaction returns an error if the ids the client has
+// chosen for the txn are unacceptable. If no IdAuditor is in use,
+// all ids are accepted.
+func (cts *ClientTxnSubmitter) AuditClientTransaction(ctxnCap *cmsgs.ClientTxn) error {
+	if cts.idAuditor == nil {
+		return nil
+	}
+	return cts.idAuditor.AuditClientTransaction(ctxnCap)
+}
+
+// SetStaleReadObserver sets the function called whenever a client txn
+// aborts because it read out of date versions, with the number of
+// versions behind it was (see versionCache.Drift).
+func (cts *ClientTxnSubmitter) SetStaleReadObserver(fun func(drift uint64)) {
+	cts.staleReads = fun
+}
+
+// SetMaxReferences limits the number of references a client txn may
+// give any one var. Very wide reference lists make every txn which
+// writes the var, and every update of it sent to clients, large; an
+// application is better served by an index of several vars. 0 means
+// no limit.
+func (cts *ClientTxnSubmitter) SetMaxReferences(max int) {
+	cts.maxRefs = max
+}
+
 func (cts *ClientTxnSubmitter) Status(sc *server.StatusConsumer) {
 	sc.Emit(fmt.Sprintf("ClientTxnSubmitter: txnLive? %v", cts.txnLive))
 	cts.SimpleTxnSubmitter.Status(sc.Fork())
@@ -45,6 +104,13 @@ func (cts *ClientTxnSubmitter) SubmitClientTransaction(ctxnCap *cmsgs.ClientTxn,
 	if err := cts.versionCache.ValidateTransaction(ctxnCap); err != nil {
 		return continuation(nil, err)
 	}
+	actions := ctxnCap.Actions()
+	widest, err := validateReferences(&actions, cts.maxRefs)
+	clientTxnReferences.Observe(float64(widest))
+	if err != nil {
+		clientTxnsTooManyReferences.Inc()
+		return continuation(nil, err)
+	}
 
 	seg := capn.NewBuffer(nil)
 	clientOutcome := cmsgs.NewClientTxnOutcome(seg)
@@ -74,6 +140,11 @@ func (cts *ClientTxnSubmitter) SubmitClientTransaction(ctxnCap *cmsgs.ClientTxn,
 			resubmit := abort.Which() == msgs.OUTCOMEABORT_RESUBMIT
 			if !resubmit {
 				updates := abort.Rerun()
+				if cts.staleReads != nil {
+					if drift := cts.versionCache.Drift(&updates); drift != 0 {
+						cts.staleReads(drift)
+					}
+				}
 				validUpdates := cts.versionCache.UpdateFromAbort(&updates)
 				server.Log("Updates:", updates.Len(), "; valid: ", len(validUpdates))
 				resubmit = len(validUpdates) == 0
@@ -107,6 +178,16 @@ func (cts *ClientTxnSubmitter) SubmitClientTransaction(ctxnCap *cmsgs.ClientTxn,
 	return cts.SimpleTxnSubmitter.SubmitClientTransaction(nil, ctxnCap, curTxnId, cont, cts.backoff, false, cts.versionCache)
 }
 
+// TrimCache releases memory held for the client, returning an
+// estimate of the bytes released. Nothing is trimmed whilst a txn is
+// live, as its updates may yet need cached values.
+func (cts *ClientTxnSubmitter) TrimCache() int {
+	if cts.txnLive {
+		return 0
+	}
+	return cts.versionCache.TrimValues()
+}
+
 func (cts *ClientTxnSubmitter) addCreatesToCache(txn *eng.TxnReader) {
 	actions := txn.Actions(true).Actions()
 	for idx, l := 0, actions.Len(); idx < l; idx++ {
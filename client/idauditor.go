@@ -0,0 +1,107 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/common"
+	cmsgs "goshawkdb.io/common/capnp"
+	"log"
+)
+
+var idReuseRejected = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "goshawkdb",
+	Name:      "client_id_reuse_rejected_total",
+	Help:      "Number of client txns rejected by the id auditor.",
+})
+
+func init() {
+	prometheus.MustRegister(idReuseRejected)
+}
+
+// An IdAuditor checks the TxnIds and VarUUIds chosen by a client
+// before its txn is submitted. A non-nil error means the client is
+// misbehaving and its connection should be closed.
+type IdAuditor interface {
+	AuditClientTransaction(*cmsgs.ClientTxn) error
+}
+
+// An IdAuditorFactory creates an IdAuditor for a new client
+// connection, given the namespace issued to that connection.
+type IdAuditorFactory func(namespace []byte) IdAuditor
+
+// NewNamespaceIdAuditor creates an IdAuditor which requires that all
+// TxnIds and created VarUUIds are within the connection's namespace,
+// and that within that namespace they strictly increase. A client
+// which carries on using ids from before a reconnect will use the old
+// namespace and so will be caught. Reuse within a namespace would
+// otherwise silently corrupt the client's and our caches.
+func NewNamespaceIdAuditor(namespace []byte) IdAuditor {
+	return &namespaceIdAuditor{
+		namespace: namespace,
+	}
+}
+
+type namespaceIdAuditor struct {
+	namespace   []byte
+	txnIdSeen   bool
+	lastTxnId   uint64
+	varUUIdSeen bool
+	lastVarUUId uint64
+}
+
+func (nia *namespaceIdAuditor) AuditClientTransaction(ctxn *cmsgs.ClientTxn) error {
+	txnCounter, err := nia.counter("TxnId", ctxn.Id())
+	if err != nil {
+		return nia.reject(err)
+	}
+	if nia.txnIdSeen && txnCounter <= nia.lastTxnId {
+		return nia.reject(fmt.Errorf("TxnId %x reused or not increasing (last counter %v)", ctxn.Id(), nia.lastTxnId))
+	}
+
+	// Creates within a single txn can be in any order, so we only
+	// require they're all distinct and all beyond the creates of
+	// earlier txns.
+	actions := ctxn.Actions()
+	created := make(map[uint64]bool)
+	maxVarCounter := nia.lastVarUUId
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		if action.Which() != cmsgs.CLIENTACTION_CREATE {
+			continue
+		}
+		varCounter, err := nia.counter("VarUUId", action.VarId())
+		switch {
+		case err != nil:
+			return nia.reject(err)
+		case created[varCounter] || (nia.varUUIdSeen && varCounter <= nia.lastVarUUId):
+			return nia.reject(fmt.Errorf("VarUUId %x reused (last counter %v)", action.VarId(), nia.lastVarUUId))
+		}
+		created[varCounter] = true
+		if varCounter > maxVarCounter {
+			maxVarCounter = varCounter
+		}
+	}
+
+	nia.txnIdSeen = true
+	nia.lastTxnId = txnCounter
+	if len(created) > 0 {
+		nia.varUUIdSeen = true
+		nia.lastVarUUId = maxVarCounter
+	}
+	return nil
+}
+
+func (nia *namespaceIdAuditor) counter(kind string, id []byte) (uint64, error) {
+	if len(id) != common.KeyLen || !bytes.Equal(id[8:], nia.namespace) {
+		return 0, fmt.Errorf("%v %x is not within the connection's namespace %x", kind, id, nia.namespace)
+	}
+	return binary.BigEndian.Uint64(id[:8]), nil
+}
+
+func (nia *namespaceIdAuditor) reject(err error) error {
+	idReuseRejected.Inc()
+	log.Printf("Client id audit failure: %v\n", err)
+	return err
+}
@@ -26,9 +26,16 @@ type LocalConnection struct {
 	submitter         *SimpleTxnSubmitter
 	nextTxnNumber     uint64
 	nextVarNumber     uint64
+	varBalancer       VarBalancer
 	txnQuery          localConnectionTxnQuery
 }
 
+// VarBalancer reports the amount of work waiting for whatever would
+// manage a var locally.
+type VarBalancer interface {
+	PendingFor(*common.VarUUId) int
+}
+
 type localConnectionMsg interface {
 	witness() localConnectionMsg
 }
@@ -88,6 +95,7 @@ type localConnectionMsgRunClientTxn struct {
 	localConnectionMsgSyncQuery
 	txn                 *cmsgs.ClientTxn
 	varPosMap           map[common.VarUUId]*common.Positions
+	varHostsMap         map[common.VarUUId][]string
 	translationCallback eng.TranslationCallback
 	txnReader           *eng.TxnReader
 	outcome             *msgs.Outcome
@@ -126,7 +134,34 @@ func (lc *LocalConnection) NextVarUUId() *common.VarUUId {
 	vUUId := common.MakeVarUUId(lc.namespace)
 	binary.BigEndian.PutUint64(vUUId[0:8], lc.nextVarNumber)
 	lc.nextVarNumber++
-	return vUUId
+	if lc.varBalancer == nil {
+		return vUUId
+	}
+	// The var number's least significant byte picks the var's
+	// manager. A var can never move manager, but we are free to
+	// skip var numbers, so pick the least busy of the next few
+	// managers.
+	best, bestPending := vUUId, lc.varBalancer.PendingFor(vUUId)
+	for idx := 1; idx < server.VarBalanceCandidates && bestPending > 0; idx++ {
+		candidate := common.MakeVarUUId(lc.namespace)
+		binary.BigEndian.PutUint64(candidate[0:8], lc.nextVarNumber)
+		lc.nextVarNumber++
+		if pending := lc.varBalancer.PendingFor(candidate); pending < bestPending {
+			best, bestPending = candidate, pending
+		}
+	}
+	return best
+}
+
+// SetVarBalancer makes NextVarUUId balance the vars it creates
+// across managers by their load, according to vb. If vb is nil,
+// vars are created in sequence. This only affects vars created
+// through the LocalConnection: clients choose the ids of their own
+// vars, and so the managers of them.
+func (lc *LocalConnection) SetVarBalancer(vb VarBalancer) {
+	lc.Lock()
+	defer lc.Unlock()
+	lc.varBalancer = vb
 }
 
 func (lc *LocalConnection) enqueueQuery(msg localConnectionMsg) bool {
@@ -197,6 +232,22 @@ func (lc *LocalConnection) RunClientTransaction(txn *cmsgs.ClientTxn, varPosMap
 		varPosMap:           varPosMap,
 		translationCallback: translationCallback,
 	}
+	return lc.runClientTransactionQuery(query)
+}
+
+// RunPinnedClientTransaction is RunClientTransaction, except that
+// each var created by txn which is in varHostsMap is placed only on
+// the RMs of its hosts.
+func (lc *LocalConnection) RunPinnedClientTransaction(txn *cmsgs.ClientTxn, varPosMap map[common.VarUUId]*common.Positions, varHostsMap map[common.VarUUId][]string) (*eng.TxnReader, *msgs.Outcome, error) {
+	query := &localConnectionMsgRunClientTxn{
+		txn:         txn,
+		varPosMap:   varPosMap,
+		varHostsMap: varHostsMap,
+	}
+	return lc.runClientTransactionQuery(query)
+}
+
+func (lc *LocalConnection) runClientTransactionQuery(query *localConnectionMsgRunClientTxn) (*eng.TxnReader, *msgs.Outcome, error) {
 	query.init()
 	if lc.enqueueQuerySync(query, query.resultChan) {
 		return query.txnReader, query.outcome, query.err
@@ -339,6 +390,9 @@ func (lc *LocalConnection) runClientTransaction(txnQuery *localConnectionMsgRunC
 	if varPosMap := txnQuery.varPosMap; varPosMap != nil {
 		lc.submitter.EnsurePositions(varPosMap)
 	}
+	if varHostsMap := txnQuery.varHostsMap; varHostsMap != nil {
+		lc.submitter.EnsurePins(varHostsMap)
+	}
 	return lc.submitter.SubmitClientTransaction(txnQuery.translationCallback, txn, txnId, txnQuery.consumer, nil, true, nil)
 }
 
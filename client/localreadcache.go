@@ -0,0 +1,151 @@
+package client
+
+import (
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	cmsgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/configuration"
+	ch "goshawkdb.io/server/consistenthash"
+	"sync"
+)
+
+// LocalReadCache is a read-through cache of vars, shared by the
+// subsystems which read vars (typically system roots) through the
+// LocalConnection, so that rereading an unchanged var doesn't cost a
+// txn. Only vars held by this node are cached: every write committed
+// to such a var is applied here too, and VarCommitted, which must be
+// added as an observer of the VarDispatcher's Commits, drops it from
+// the cache once it has been. Vars held elsewhere are always read
+// afresh. The cache is emptied whenever the topology changes.
+type LocalReadCache struct {
+	sync.Mutex
+	localConnection *LocalConnection
+	rmId            common.RMId
+	topology        *configuration.Topology
+	resolver        *ch.Resolver
+	vars            map[common.VarUUId]*LocalVar
+	// reading holds the vars being read, and whether each has been
+	// written since its read started, in which case what's read may
+	// already be out of date, so it isn't cached.
+	reading map[common.VarUUId]bool
+	hits    uint64
+	misses  uint64
+}
+
+func NewLocalReadCache(lc *LocalConnection, rmId common.RMId) *LocalReadCache {
+	return &LocalReadCache{
+		localConnection: lc,
+		rmId:            rmId,
+		vars:            make(map[common.VarUUId]*LocalVar),
+		reading:         make(map[common.VarUUId]bool),
+	}
+}
+
+// VarCommitted is to be called for every write committed to a var
+// held by this node.
+func (lrc *LocalReadCache) VarCommitted(vUUId *common.VarUUId, txnId *common.TxnId) {
+	lrc.Lock()
+	defer lrc.Unlock()
+	delete(lrc.vars, *vUUId)
+	if _, found := lrc.reading[*vUUId]; found {
+		lrc.reading[*vUUId] = true
+	}
+}
+
+// Read returns the current state of the var, reading it through the
+// LocalConnection unless it's cached. Returns nil, with no error, if
+// the var has never been written, or if terminate is closed or the
+// server shuts down.
+func (lrc *LocalReadCache) Read(topology *configuration.Topology, vUUId *common.VarUUId, positions *common.Positions, maxAttempts int, terminate <-chan struct{}) (*LocalVar, error) {
+	lrc.Lock()
+	lrc.setTopology(topology)
+	if lv, found := lrc.vars[*vUUId]; found {
+		lrc.hits++
+		lrc.Unlock()
+		return lv, nil
+	}
+	lrc.misses++
+	_, concurrent := lrc.reading[*vUUId]
+	lrc.reading[*vUUId] = concurrent
+	lrc.Unlock()
+
+	cache := make(LocalTxnCache)
+	_, err := lrc.localConnection.RunLocalTransaction(cache, maxAttempts, terminate,
+		func(cache LocalTxnCache) (*cmsgs.ClientTxn, map[common.VarUUId]*common.Positions, error) {
+			if _, found := cache[*vUUId]; found {
+				return nil, nil, nil
+			}
+			return ReadTxn(vUUId, positions), map[common.VarUUId]*common.Positions{*vUUId: positions}, nil
+		})
+
+	lrc.Lock()
+	defer lrc.Unlock()
+	written, found := lrc.reading[*vUUId]
+	delete(lrc.reading, *vUUId)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %v: %v", vUUId, err)
+	}
+	lv := cache[*vUUId]
+	if lv != nil && found && !written && topology == lrc.topology && lrc.heldLocally(positions) {
+		lrc.vars[*vUUId] = lv
+	}
+	return lv, nil
+}
+
+// setTopology must be called with the cache locked.
+func (lrc *LocalReadCache) setTopology(topology *configuration.Topology) {
+	if topology == lrc.topology {
+		return
+	}
+	lrc.topology = topology
+	lrc.resolver = nil
+	if topology != nil && !topology.IsBlank() {
+		lrc.resolver = ch.NewResolver(topology.VoterRMs(), topology.TwoFInc)
+	}
+	lrc.vars = make(map[common.VarUUId]*LocalVar)
+	for vUUId := range lrc.reading {
+		lrc.reading[vUUId] = true
+	}
+}
+
+// heldLocally must be called with the cache locked.
+func (lrc *LocalReadCache) heldLocally(positions *common.Positions) bool {
+	if lrc.resolver == nil || positions == nil {
+		return false
+	}
+	rmIds, err := lrc.resolver.ResolveHashCodes((*capn.UInt8List)(positions).ToArray())
+	if err != nil {
+		return false
+	}
+	for _, rmId := range rmIds {
+		if rmId == lrc.rmId {
+			return true
+		}
+	}
+	return false
+}
+
+func (lrc *LocalReadCache) Status(sc *server.StatusConsumer) {
+	lrc.Lock()
+	defer lrc.Unlock()
+	sc.Emit(fmt.Sprintf("Local read cache: %v vars cached; %v hits; %v misses", len(lrc.vars), lrc.hits, lrc.misses))
+	sc.Join()
+}
+
+// ReadTxn builds a txn which reads the var at the version zero, so
+// that it aborts and tells us the var's current state, unless the var
+// has never been written.
+func ReadTxn(vUUId *common.VarUUId, positions *common.Positions) *cmsgs.ClientTxn {
+	seg := capn.NewBuffer(nil)
+	ctxn := cmsgs.NewClientTxn(seg)
+	ctxn.SetRetry(false)
+	actions := cmsgs.NewClientActionList(seg, 1)
+	action := actions.At(0)
+	action.SetVarId(vUUId[:])
+	action.SetRead()
+	action.Read().SetVersion(common.VersionZero[:])
+	ctxn.SetActions(actions)
+	return &ctxn
+}
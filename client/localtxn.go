@@ -0,0 +1,133 @@
+package client
+
+import (
+	"errors"
+	"goshawkdb.io/common"
+	cmsgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	eng "goshawkdb.io/server/txnengine"
+	"math/rand"
+	"time"
+)
+
+// ErrContention is returned by RunLocalTransaction if the txn is
+// still failing after the maximum number of attempts.
+var ErrContention = errors.New("too much contention")
+
+// LocalVar is what a LocalTxnCache knows of a var: the version it
+// was last seen at, and the value and references it then had.
+type LocalVar struct {
+	Version    *common.TxnId
+	Value      []byte
+	References []msgs.VarIdPos
+}
+
+// LocalTxnCache is the version cache of a subsystem running txns
+// through the LocalConnection. RunLocalTransaction keeps it up to
+// date with every outcome, so it may be kept between runs, so that
+// normally a txn only needs to be run once. It must be discarded if
+// the topology changes.
+type LocalTxnCache map[common.VarUUId]*LocalVar
+
+// UpdateFromRerun records the current state of the vars given in the
+// updates sent back when a txn aborts. A missing var is forgotten.
+func (cache LocalTxnCache) UpdateFromRerun(updates msgs.Update_List) {
+	for idx, l := 0, updates.Len(); idx < l; idx++ {
+		update := updates.At(idx)
+		txnId := common.MakeTxnId(update.TxnId())
+		actions := eng.TxnActionsFromData(update.Actions(), true).Actions()
+		for idy, m := 0, actions.Len(); idy < m; idy++ {
+			action := actions.At(idy)
+			vUUId := common.MakeVarUUId(action.VarId())
+			switch action.Which() {
+			case msgs.ACTION_WRITE:
+				write := action.Write()
+				cache[*vUUId] = &LocalVar{
+					Version:    txnId,
+					Value:      eng.ActionValue(&action, write.Value()),
+					References: write.References().ToArray(),
+				}
+			case msgs.ACTION_MISSING:
+				delete(cache, *vUUId)
+			}
+		}
+	}
+}
+
+// updateFromCommit records the vars written by txn, which has
+// committed.
+func (cache LocalTxnCache) updateFromCommit(txn *eng.TxnReader) {
+	actions := txn.Actions(true).Actions()
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		vUUId := common.MakeVarUUId(action.VarId())
+		switch action.Which() {
+		case msgs.ACTION_WRITE:
+			write := action.Write()
+			cache[*vUUId] = &LocalVar{Version: txn.Id, Value: eng.ActionValue(&action, write.Value()), References: write.References().ToArray()}
+		case msgs.ACTION_READWRITE:
+			rw := action.Readwrite()
+			cache[*vUUId] = &LocalVar{Version: txn.Id, Value: eng.ActionValue(&action, rw.Value()), References: rw.References().ToArray()}
+		case msgs.ACTION_CREATE:
+			create := action.Create()
+			cache[*vUUId] = &LocalVar{Version: txn.Id, Value: eng.ActionValue(&action, create.Value()), References: create.References().ToArray()}
+		}
+	}
+}
+
+// LocalTxnBuilder builds a txn from what the cache knows, and gives
+// the positions of the vars it uses. It is called afresh for every
+// attempt, so it must not assume anything which the cache does not
+// say. Returning a nil txn ends the run without running anything:
+// for example, a builder which only needs to read vars can stop once
+// the cache knows them.
+type LocalTxnBuilder func(cache LocalTxnCache) (*cmsgs.ClientTxn, map[common.VarUUId]*common.Positions, error)
+
+// RunLocalTransaction runs the txn built by build until it commits,
+// returning the committed txn. If the txn aborts, the cache is
+// updated from the abort and the txn is built and run again.
+// Resubmissions, and reruns after the first, back off first. A nil
+// txn, with no error, is returned if build builds nothing, or if the
+// server or terminate shuts down. After maxAttempts, ErrContention is
+// returned. Unlike txns from clients, the txn is not resubmitted on
+// our behalf, so it is safe to call from any go-routine other than
+// the LocalConnection's own.
+func (lc *LocalConnection) RunLocalTransaction(cache LocalTxnCache, maxAttempts int, terminate <-chan struct{}, build LocalTxnBuilder) (*eng.TxnReader, error) {
+	var backoff *server.BinaryBackoffEngine
+	reruns := 0
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		ctxn, varPosMap, err := build(cache)
+		if err != nil || ctxn == nil {
+			return nil, err
+		}
+		txn, outcome, err := lc.RunClientTransaction(ctxn, varPosMap, nil)
+		switch {
+		case err != nil:
+			return nil, err
+		case outcome == nil: // shutdown
+			return nil, nil
+		case outcome.Which() == msgs.OUTCOME_COMMIT:
+			cache.updateFromCommit(txn)
+			return txn, nil
+		}
+
+		if abort := outcome.Abort(); abort.Which() == msgs.OUTCOMEABORT_RERUN {
+			cache.UpdateFromRerun(abort.Rerun())
+			reruns++
+			if reruns == 1 {
+				continue
+			}
+		}
+		if backoff == nil {
+			backoff = server.NewBinaryBackoffEngine(rand.New(rand.NewSource(time.Now().UnixNano())), server.SubmissionMinSubmitDelay, server.SubmissionMaxSubmitDelay)
+		}
+		backoff.Advance()
+		select {
+		case <-terminate:
+			return nil, nil
+		case <-time.After(backoff.Cur):
+		}
+	}
+	return nil, ErrContention
+}
@@ -30,6 +30,9 @@ type SimpleTxnSubmitter struct {
 	topology            *configuration.Topology
 	rng                 *rand.Rand
 	bufferedSubmissions []func() error
+	rootNames           []string
+	pinnedVars          map[common.VarUUId][]string
+	abortOnShutdown     bool
 }
 
 type txnOutcomeConsumer func(common.RMId, *eng.TxnReader, *msgs.Outcome) error
@@ -72,25 +75,44 @@ func (sts *SimpleTxnSubmitter) EnsurePositions(varPosMap map[common.VarUUId]*com
 	}
 }
 
+// SetRootNames sets the roots on whose behalf this submitter
+// submits txns. Every var it creates is pinned to the hosts which
+// all the named roots are pinned to by the configuration's placement
+// (if any), and the learners of any of the roots learn its txns.
+func (sts *SimpleTxnSubmitter) SetRootNames(rootNames []string) {
+	sts.rootNames = rootNames
+}
+
+// EnsurePins pins the creation of each var in varHostsMap to its
+// hosts, in preference to any SetRootNames.
+func (sts *SimpleTxnSubmitter) EnsurePins(varHostsMap map[common.VarUUId][]string) {
+	if sts.pinnedVars == nil {
+		sts.pinnedVars = make(map[common.VarUUId][]string, len(varHostsMap))
+	}
+	for vUUId, hosts := range varHostsMap {
+		sts.pinnedVars[vUUId] = hosts
+	}
+}
+
 func (sts *SimpleTxnSubmitter) SubmissionOutcomeReceived(sender common.RMId, txn *eng.TxnReader, outcome *msgs.Outcome) error {
 	txnId := txn.Id
 	if consumer, found := sts.outcomeConsumers[*txnId]; found {
 		return consumer(sender, txn, outcome)
 	} else {
-		// OSS is safe here - it's the default action on receipt of an unknown txnid
-		paxos.NewOneShotSender(paxos.MakeTxnSubmissionCompleteMsg(txnId), sts.connPub, sender)
+		// SendOnce is safe here - it's the default action on receipt of an unknown txnid
+		sts.connPub.ResendScheduler().SendOnce(paxos.MakeTxnSubmissionCompleteMsg(txnId), sender)
 		return nil
 	}
 }
 
 // txnCap must be a root
 func (sts *SimpleTxnSubmitter) SubmitTransaction(txnCap *msgs.Txn, txnId *common.TxnId, activeRMs []common.RMId, continuation TxnCompletionConsumer, delay *server.BinaryBackoffEngine) {
-	seg := capn.NewBuffer(nil)
+	seg := server.NewPooledSegment(len(txnCap.Segment.Data))
 	msg := msgs.NewRootMessage(seg)
 	msg.SetTxnSubmission(server.SegToBytes(txnCap.Segment))
 
 	server.Log(txnId, "Submitting txn with actives:", activeRMs)
-	txnSender := paxos.NewRepeatingSender(server.SegToBytes(seg), activeRMs...)
+	txnSender := paxos.NewRepeatingSender(server.SegToBytesAndRelease(seg), activeRMs...)
 	sleeping := delay != nil && delay.Cur > 0
 	var removeSenderCh chan chan server.EmptyStruct
 	if sleeping {
@@ -106,9 +128,11 @@ func (sts *SimpleTxnSubmitter) SubmitTransaction(txnCap *msgs.Txn, txnId *common
 		sts.connPub.AddServerConnectionSubscriber(txnSender)
 	}
 	acceptors := paxos.GetAcceptorsFromTxn(*txnCap)
+	outcomeAccumulator := paxos.NewOutcomeAccumulator(int(txnCap.FInc()), acceptors)
 
 	shutdownFun := func(shutdown bool) error {
 		delete(sts.outcomeConsumers, *txnId)
+		outcomeAccumulator.Release()
 		// fmt.Printf("sts%v ", len(sts.outcomeConsumers))
 		if sleeping {
 			txnSenderRemovedChan := make(chan server.EmptyStruct)
@@ -117,15 +141,20 @@ func (sts *SimpleTxnSubmitter) SubmitTransaction(txnCap *msgs.Txn, txnId *common
 		} else {
 			sts.connPub.RemoveServerConnectionSubscriber(txnSender)
 		}
-		// OSS is safe here - see above.
-		paxos.NewOneShotSender(paxos.MakeTxnSubmissionCompleteMsg(txnId), sts.connPub, acceptors...)
+		// SendOnce is safe here - see above.
+		sts.connPub.ResendScheduler().SendOnce(paxos.MakeTxnSubmissionCompleteMsg(txnId), acceptors...)
 		if shutdown {
-			if txnCap.Retry() {
+			if txnCap.Retry() || sts.abortOnShutdown {
 				// If this msg doesn't make it then proposers should
 				// observe our death and tidy up anyway. If it's just this
 				// connection shutting down then there should be no
-				// problem with these msgs getting to the propposers.
-				paxos.NewOneShotSender(paxos.MakeTxnSubmissionAbortMsg(txnId), sts.connPub, activeRMs...)
+				// problem with these msgs getting to the propposers. A
+				// proposer which has already voted ignores the abort, so
+				// this only cancels txns yet to reach consensus.
+				sts.connPub.ResendScheduler().SendOnce(paxos.MakeTxnSubmissionAbortMsg(txnId), activeRMs...)
+				if sts.abortOnShutdown {
+					clientTxnsCancelled.Inc()
+				}
 			}
 			return continuation(nil, nil, nil)
 		} else {
@@ -135,7 +164,6 @@ func (sts *SimpleTxnSubmitter) SubmitTransaction(txnCap *msgs.Txn, txnId *common
 	shutdownFunPtr := &shutdownFun
 	sts.onShutdown[shutdownFunPtr] = server.EmptyStructVal
 
-	outcomeAccumulator := paxos.NewOutcomeAccumulator(int(txnCap.FInc()), acceptors)
 	consumer := func(sender common.RMId, txn *eng.TxnReader, outcome *msgs.Outcome) error {
 		if outcome, _ = outcomeAccumulator.BallotOutcomeReceived(sender, outcome); outcome != nil {
 			delete(sts.onShutdown, shutdownFunPtr)
@@ -184,7 +212,7 @@ func (sts *SimpleTxnSubmitter) TopologyChanged(topology *configuration.Topology)
 		return nil
 	}
 	sts.topology = topology
-	sts.resolver = ch.NewResolver(topology.RMs(), topology.TwoFInc)
+	sts.resolver = ch.NewResolver(topology.VoterRMs(), topology.TwoFInc)
 	sts.hashCache.SetResolver(sts.resolver)
 	if topology.Roots != nil {
 		for _, root := range topology.Roots {
@@ -254,6 +282,7 @@ func (sts *SimpleTxnSubmitter) clientToServerTxn(translationCallback eng.Transla
 	actions := msgs.NewActionList(actionsListSeg, clientActions.Len())
 	actionsWrapper.SetActions(actions)
 	picker := ch.NewCombinationPicker(int(sts.topology.FInc), sts.disabledHashCodes)
+	picker.Avoid(sts.connPub.DegradedRMs().RMs())
 
 	rmIdToActionIndices, err := sts.translateActions(translationCallback, actionsListSeg, picker, &actions, &clientActions, vc)
 	if err != nil {
@@ -268,13 +297,77 @@ func (sts *SimpleTxnSubmitter) clientToServerTxn(translationCallback eng.Transla
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	allocations := msgs.NewAllocationList(outgoingSeg, len(activeRMs)+len(passiveRMs))
+	learnerRMs := sts.learnerRMs(rmIdToActionIndices, &actions)
+	allocations := msgs.NewAllocationList(outgoingSeg, len(activeRMs)+len(passiveRMs)+len(learnerRMs))
 	txnCap.SetAllocations(allocations)
 	sts.setAllocations(0, rmIdToActionIndices, &allocations, outgoingSeg, true, activeRMs)
 	sts.setAllocations(len(activeRMs), rmIdToActionIndices, &allocations, outgoingSeg, false, passiveRMs)
+	sts.setAllocations(len(activeRMs)+len(passiveRMs), rmIdToActionIndices, &allocations, outgoingSeg, false, learnerRMs)
+	if acceptors := sts.chooseAcceptors(); acceptors != nil {
+		acceptorsCap := outgoingSeg.NewUInt32List(len(acceptors))
+		for idx, rmId := range acceptors {
+			acceptorsCap.Set(idx, uint32(rmId))
+		}
+		txnCap.SetAcceptors(acceptorsCap)
+	}
 	return &txnCap, activeRMs, passiveRMs, nil
 }
 
+// chooseAcceptors returns the acceptors for a new txn if they're to be
+// chosen by latency, rather than taken from its allocations. Whilst
+// the topology is changing, the set of RMs is too, so we stick with
+// the allocations. Learners never vote, so are never acceptors.
+func (sts *SimpleTxnSubmitter) chooseAcceptors() common.RMIds {
+	if sts.topology.Next() != nil {
+		return nil
+	}
+	degraded := sts.connPub.DegradedRMs().RMs()
+	voters := sts.topology.VoterRMs()
+	candidates := make([]common.RMId, 0, len(voters))
+	for _, rmId := range voters {
+		if rmId == common.RMIdEmpty {
+			continue
+		} else if _, found := sts.disabledHashCodes[rmId]; found {
+			continue
+		} else if _, found := degraded[rmId]; found {
+			continue
+		}
+		candidates = append(candidates, rmId)
+	}
+	return sts.connPub.PeerLatencies().Acceptors(int(sts.topology.FInc), sts.rmId, candidates)
+}
+
+// learnerRMs finds the learners of our roots and allocates them every
+// action which is not a read. Learners are only ever passive: they
+// never hold any var as one of its RMs so they are never voters, but
+// as passives they are sent the outcome and apply the writes.
+func (sts *SimpleTxnSubmitter) learnerRMs(rmIdToActionIndices map[common.RMId]*[]int, actions *msgs.Action_List) []common.RMId {
+	learners := sts.topology.LearnersOfRoots(sts.rootNames)
+	if len(learners) == 0 {
+		return nil
+	}
+	actionIndices := []int{}
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		if actions.At(idx).Which() != msgs.ACTION_READ {
+			actionIndices = append(actionIndices, idx)
+		}
+	}
+	if len(actionIndices) == 0 {
+		return nil
+	}
+	rmIds := make([]common.RMId, 0, len(learners))
+	for _, rmId := range learners {
+		if _, found := rmIdToActionIndices[rmId]; found {
+			continue
+		}
+		indices := make([]int, len(actionIndices))
+		copy(indices, actionIndices)
+		rmIdToActionIndices[rmId] = &indices
+		rmIds = append(rmIds, rmId)
+	}
+	return rmIds
+}
+
 func (sts *SimpleTxnSubmitter) setAllocations(allocIdx int, rmIdToActionIndices map[common.RMId]*[]int, allocations *msgs.Allocation_List, seg *capn.Segment, active bool, rmIds []common.RMId) {
 	for _, rmId := range rmIds {
 		actionIndices := *(rmIdToActionIndices[rmId])
@@ -394,7 +487,7 @@ func (sts *SimpleTxnSubmitter) translateRead(action *msgs.Action, clientRead cms
 func (sts *SimpleTxnSubmitter) translateWrite(vc versionCache, outgoingSeg *capn.Segment, referencesInNeedOfPositions *[]*msgs.VarIdPos, vUUId *common.VarUUId, action *msgs.Action, clientWrite cmsgs.ClientActionWrite) error {
 	action.SetWrite()
 	write := action.Write()
-	write.SetValue(clientWrite.Value())
+	write.SetValue(eng.CompressActionValue(action, clientWrite.Value()))
 	clientReferences := clientWrite.References()
 	refs, err := copyReferences(vc, outgoingSeg, referencesInNeedOfPositions, &clientReferences)
 	if err != nil {
@@ -409,7 +502,7 @@ func (sts *SimpleTxnSubmitter) translateReadWrite(vc versionCache, outgoingSeg *
 	action.SetReadwrite()
 	readWrite := action.Readwrite()
 	readWrite.SetVersion(clientReadWrite.Version())
-	readWrite.SetValue(clientReadWrite.Value())
+	readWrite.SetValue(eng.CompressActionValue(action, clientReadWrite.Value()))
 	refs, err := copyReferences(vc, outgoingSeg, referencesInNeedOfPositions, &clientReferences)
 	if err != nil {
 		return err
@@ -421,8 +514,8 @@ func (sts *SimpleTxnSubmitter) translateReadWrite(vc versionCache, outgoingSeg *
 func (sts *SimpleTxnSubmitter) translateCreate(vc versionCache, outgoingSeg *capn.Segment, referencesInNeedOfPositions *[]*msgs.VarIdPos, vUUId *common.VarUUId, action *msgs.Action, clientCreate cmsgs.ClientActionCreate) (*common.Positions, []common.RMId, error) {
 	action.SetCreate()
 	create := action.Create()
-	create.SetValue(clientCreate.Value())
-	positions, hashCodes, err := sts.hashCache.CreatePositions(vUUId, int(sts.topology.MaxRMCount))
+	create.SetValue(eng.CompressActionValue(action, clientCreate.Value()))
+	positions, hashCodes, err := sts.createPositions(vUUId)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -436,11 +529,28 @@ func (sts *SimpleTxnSubmitter) translateCreate(vc versionCache, outgoingSeg *cap
 	return positions, hashCodes, nil
 }
 
+// createPositions honours any placement pinning. If the pinned hosts
+// no longer map to enough RMs in the current topology, the var is
+// created unpinned rather than not at all.
+func (sts *SimpleTxnSubmitter) createPositions(vUUId *common.VarUUId) (*common.Positions, []common.RMId, error) {
+	maxRMCount := int(sts.topology.MaxRMCount)
+	hosts, found := sts.pinnedVars[*vUUId]
+	if !found {
+		hosts = sts.topology.PinnedHosts(sts.rootNames)
+	}
+	if len(hosts) != 0 {
+		if rmIds := sts.topology.RMsOfHosts(hosts); len(rmIds) >= int(sts.topology.TwoFInc) {
+			return sts.hashCache.CreatePositionsWithin(vUUId, maxRMCount, rmIds)
+		}
+	}
+	return sts.hashCache.CreatePositions(vUUId, maxRMCount)
+}
+
 func (sts *SimpleTxnSubmitter) translateRoll(vc versionCache, outgoingSeg *capn.Segment, referencesInNeedOfPositions *[]*msgs.VarIdPos, action *msgs.Action, clientRoll cmsgs.ClientActionRoll) error {
 	action.SetRoll()
 	roll := action.Roll()
 	roll.SetVersion(clientRoll.Version())
-	roll.SetValue(clientRoll.Value())
+	roll.SetValue(eng.CompressActionValue(action, clientRoll.Value()))
 	clientReferences := clientRoll.References()
 	refs, err := copyReferences(vc, outgoingSeg, referencesInNeedOfPositions, &clientReferences)
 	if err != nil {
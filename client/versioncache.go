@@ -5,6 +5,7 @@ import (
 	capn "github.com/glycerine/go-capnproto"
 	"goshawkdb.io/common"
 	cmsgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
 	msgs "goshawkdb.io/server/capnp"
 	ch "goshawkdb.io/server/consistenthash"
 	eng "goshawkdb.io/server/txnengine"
@@ -45,8 +46,21 @@ func NewVersionCache(roots map[common.VarUUId]*common.Capability) versionCache {
 	return cache
 }
 
+// ValidateTransaction checks the client txn is well formed, and that
+// every action is permitted by the capabilities the client has
+// been granted. All the roots a client knows of come from the roots
+// granted to its certificate, so a txn touching several roots is
+// still checked against the client's own capabilities on each. Badly
+// formed txns must be caught here: further in, the engine assumes
+// one action per var, and ids of the right length.
 func (vc versionCache) ValidateTransaction(cTxn *cmsgs.ClientTxn) error {
 	actions := cTxn.Actions()
+	if actions.Len() == 0 {
+		return fmt.Errorf("Transaction contains no actions")
+	}
+	if err := validateActionIds(&actions); err != nil {
+		return err
+	}
 	if cTxn.Retry() {
 		for idx, l := 0, actions.Len(); idx < l; idx++ {
 			action := actions.At(idx)
@@ -96,6 +110,85 @@ func (vc versionCache) ValidateTransaction(cTxn *cmsgs.ClientTxn) error {
 	return nil
 }
 
+// validateActionIds checks that every action is on a distinct var,
+// and that the var ids and any versions read are of the right length.
+func validateActionIds(actions *cmsgs.ClientAction_List) error {
+	seen := make(map[common.VarUUId]server.EmptyStruct, actions.Len())
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		varId := action.VarId()
+		if len(varId) != common.KeyLen {
+			return fmt.Errorf("Transaction action %v has illegal object id of length %v", idx, len(varId))
+		}
+		vUUId := common.MakeVarUUId(varId)
+		if _, found := seen[*vUUId]; found {
+			return fmt.Errorf("Transaction contains multiple actions on object %v", vUUId)
+		}
+		seen[*vUUId] = server.EmptyStructVal
+		var version []byte
+		switch action.Which() {
+		case cmsgs.CLIENTACTION_READ:
+			version = action.Read().Version()
+		case cmsgs.CLIENTACTION_READWRITE:
+			version = action.Readwrite().Version()
+		default:
+			continue
+		}
+		if len(version) != common.KeyLen {
+			return fmt.Errorf("Transaction reads object %v at illegal version of length %v", vUUId, len(version))
+		}
+	}
+	return nil
+}
+
+// validateReferences checks that no action gives its var more than
+// maxReferences references (0 means no limit), and returns the most
+// references any action gives.
+func validateReferences(actions *cmsgs.ClientAction_List, maxReferences int) (int, error) {
+	widest := 0
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		var refs int
+		switch action.Which() {
+		case cmsgs.CLIENTACTION_WRITE:
+			refs = action.Write().References().Len()
+		case cmsgs.CLIENTACTION_READWRITE:
+			refs = action.Readwrite().References().Len()
+		case cmsgs.CLIENTACTION_CREATE:
+			refs = action.Create().References().Len()
+		default:
+			continue
+		}
+		if maxReferences != 0 && refs > maxReferences {
+			return refs, fmt.Errorf("Transaction gives object %v %v references, but at most %v are permitted",
+				common.MakeVarUUId(action.VarId()), refs, maxReferences)
+		} else if refs > widest {
+			widest = refs
+		}
+	}
+	return widest, nil
+}
+
+// TrimValues forgets the values of vars the client can read, returning
+// the number of bytes forgotten. The client has already been sent
+// those values, and a cached value is only ever sent again when the
+// client gains read on a var it could not read before. Versions,
+// capabilities and references are kept: they are needed to validate
+// txns and to work out what the client can reach.
+func (vc versionCache) TrimValues() int {
+	trimmed := 0
+	for _, c := range vc {
+		if c.value == nil || c.caps == nil {
+			continue
+		}
+		if cap := c.caps.Which(); cap == cmsgs.CAPABILITY_READ || cap == cmsgs.CAPABILITY_READWRITE {
+			trimmed += len(c.value)
+			c.value = nil
+		}
+	}
+	return trimmed
+}
+
 func (vc versionCache) EnsureSubset(vUUId *common.VarUUId, cap cmsgs.Capability) bool {
 	if vc == nil {
 		return true
@@ -132,7 +225,7 @@ func (vc versionCache) UpdateFromCommit(txn *eng.TxnReader, outcome *msgs.Outcom
 					txnId:      txnId,
 					clockElem:  clock.At(vUUId),
 					caps:       common.MaxCapability,
-					value:      create.Value(),
+					value:      eng.ActionValue(&action, create.Value()),
 					references: create.References().ToArray(),
 				}
 				vc[*vUUId] = c
@@ -146,11 +239,11 @@ func (vc versionCache) UpdateFromCommit(txn *eng.TxnReader, outcome *msgs.Outcom
 			switch act {
 			case msgs.ACTION_WRITE:
 				write := action.Write()
-				c.value = write.Value()
+				c.value = eng.ActionValue(&action, write.Value())
 				c.references = write.References().ToArray()
 			case msgs.ACTION_READWRITE:
 				rw := action.Readwrite()
-				c.value = rw.Value()
+				c.value = eng.ActionValue(&action, rw.Value())
 				c.references = rw.References().ToArray()
 			case msgs.ACTION_CREATE:
 			default:
@@ -160,6 +253,29 @@ func (vc versionCache) UpdateFromCommit(txn *eng.TxnReader, outcome *msgs.Outcom
 	}
 }
 
+// Drift returns how far behind the cache was, for the most out of
+// date of the vars written by the updates: that is, how many writes of
+// the var the client had yet to learn of. Vars whose version the cache
+// doesn't know are ignored. It must be called before UpdateFromAbort.
+func (vc versionCache) Drift(updatesCap *msgs.Update_List) uint64 {
+	drift := uint64(0)
+	for idx, l := 0, updatesCap.Len(); idx < l; idx++ {
+		updateCap := updatesCap.At(idx)
+		clock := eng.VectorClockFromData(updateCap.Clock(), true)
+		actionsCap := eng.TxnActionsFromData(updateCap.Actions(), true).Actions()
+		for idy, m := 0, actionsCap.Len(); idy < m; idy++ {
+			actionCap := actionsCap.At(idy)
+			vUUId := common.MakeVarUUId(actionCap.VarId())
+			if c, found := vc[*vUUId]; found && c.txnId != nil {
+				if clockElem := clock.At(vUUId); clockElem > c.clockElem && clockElem-c.clockElem > drift {
+					drift = clockElem - c.clockElem
+				}
+			}
+		}
+	}
+	return drift
+}
+
 func (vc versionCache) UpdateFromAbort(updatesCap *msgs.Update_List) map[common.TxnId]*[]*update {
 	updateGraph := make(map[common.VarUUId]*cacheOverlay)
 
@@ -257,7 +373,7 @@ func (vc versionCache) updateExisting(updatesCap *msgs.Update_List, updateGraph
 					if updating {
 						c.txnId = txnId
 						c.clockElem = clockElem
-						c.value = write.Value()
+						c.value = eng.ActionValue(&actionCap, write.Value())
 						c.references = write.References().ToArray()
 						updateGraph[*vUUId] = &cacheOverlay{
 							cached:       c,
@@ -273,7 +389,7 @@ func (vc versionCache) updateExisting(updatesCap *msgs.Update_List, updateGraph
 						cached: &cached{
 							txnId:      txnId,
 							clockElem:  clockElem,
-							value:      write.Value(),
+							value:      eng.ActionValue(&actionCap, write.Value()),
 							references: write.References().ToArray(),
 						},
 						txnId:        txnId,
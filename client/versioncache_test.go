@@ -0,0 +1,200 @@
+package client
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	cmsgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	eng "goshawkdb.io/server/txnengine"
+	"math/rand"
+	"testing"
+)
+
+type testAction struct {
+	which   cmsgs.ClientAction_Which
+	varId   []byte
+	version []byte
+}
+
+func testVarId(n byte) []byte {
+	varId := make([]byte, common.KeyLen)
+	varId[common.KeyLen-1] = n
+	return varId
+}
+
+func testReadCapability() *common.Capability {
+	seg := capn.NewBuffer(nil)
+	cap := cmsgs.NewCapability(seg)
+	cap.SetRead()
+	return common.NewCapability(cap)
+}
+
+func testTxn(retry bool, actions []testAction) *cmsgs.ClientTxn {
+	seg := capn.NewBuffer(nil)
+	ctxn := cmsgs.NewClientTxn(seg)
+	ctxn.SetId(testVarId(0))
+	ctxn.SetRetry(retry)
+	clientActions := cmsgs.NewClientActionList(seg, len(actions))
+	for idx, action := range actions {
+		clientAction := clientActions.At(idx)
+		clientAction.SetVarId(action.varId)
+		switch action.which {
+		case cmsgs.CLIENTACTION_READ:
+			clientAction.SetRead()
+			clientAction.Read().SetVersion(action.version)
+		case cmsgs.CLIENTACTION_WRITE:
+			clientAction.SetWrite()
+			clientAction.Write().SetReferences(cmsgs.NewClientVarIdPosList(seg, 0))
+		case cmsgs.CLIENTACTION_READWRITE:
+			clientAction.SetReadwrite()
+			clientAction.Readwrite().SetVersion(action.version)
+			clientAction.Readwrite().SetReferences(cmsgs.NewClientVarIdPosList(seg, 0))
+		case cmsgs.CLIENTACTION_CREATE:
+			clientAction.SetCreate()
+			clientAction.Create().SetReferences(cmsgs.NewClientVarIdPosList(seg, 0))
+		}
+	}
+	ctxn.SetActions(clientActions)
+	return &ctxn
+}
+
+// Two roots: 1 is readwrite, 2 is read only.
+func testVersionCache() versionCache {
+	return NewVersionCache(map[common.VarUUId]*common.Capability{
+		*common.MakeVarUUId(testVarId(1)): common.MaxCapability,
+		*common.MakeVarUUId(testVarId(2)): testReadCapability(),
+	})
+}
+
+func TestValidateTransaction(t *testing.T) {
+	version := common.VersionZero[:]
+	cases := []struct {
+		name    string
+		retry   bool
+		actions []testAction
+		valid   bool
+	}{
+		{"empty", false, nil, false},
+		{"read", false, []testAction{{cmsgs.CLIENTACTION_READ, testVarId(1), version}}, true},
+		{"multi-root", false, []testAction{
+			{cmsgs.CLIENTACTION_READWRITE, testVarId(1), version},
+			{cmsgs.CLIENTACTION_READ, testVarId(2), version},
+		}, true},
+		{"multi-root illegal write", false, []testAction{
+			{cmsgs.CLIENTACTION_WRITE, testVarId(1), nil},
+			{cmsgs.CLIENTACTION_WRITE, testVarId(2), nil},
+		}, false},
+		{"unknown", false, []testAction{{cmsgs.CLIENTACTION_READ, testVarId(3), version}}, false},
+		{"create", false, []testAction{{cmsgs.CLIENTACTION_CREATE, testVarId(3), nil}}, true},
+		{"create existing", false, []testAction{{cmsgs.CLIENTACTION_CREATE, testVarId(1), nil}}, false},
+		{"create twice", false, []testAction{
+			{cmsgs.CLIENTACTION_CREATE, testVarId(3), nil},
+			{cmsgs.CLIENTACTION_CREATE, testVarId(3), nil},
+		}, false},
+		{"read and write", false, []testAction{
+			{cmsgs.CLIENTACTION_READ, testVarId(1), version},
+			{cmsgs.CLIENTACTION_WRITE, testVarId(1), nil},
+		}, false},
+		{"short id", false, []testAction{{cmsgs.CLIENTACTION_CREATE, testVarId(3)[1:], nil}}, false},
+		{"short version", false, []testAction{{cmsgs.CLIENTACTION_READ, testVarId(1), version[1:]}}, false},
+		{"retry read", true, []testAction{{cmsgs.CLIENTACTION_READ, testVarId(2), version}}, true},
+		{"retry write", true, []testAction{{cmsgs.CLIENTACTION_WRITE, testVarId(1), nil}}, false},
+	}
+	for _, c := range cases {
+		err := testVersionCache().ValidateTransaction(testTxn(c.retry, c.actions))
+		if c.valid && err != nil {
+			t.Errorf("%v: expected valid txn; got %v", c.name, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%v: expected invalid txn", c.name)
+		}
+	}
+}
+
+// Random txns over a small set of vars must never panic, and must
+// always be rejected if they touch a var more than once.
+func TestValidateTransactionRandom(t *testing.T) {
+	whiches := []cmsgs.ClientAction_Which{
+		cmsgs.CLIENTACTION_READ, cmsgs.CLIENTACTION_WRITE, cmsgs.CLIENTACTION_READWRITE, cmsgs.CLIENTACTION_CREATE,
+	}
+	rng := rand.New(rand.NewSource(0))
+	for iteration := 0; iteration < 10000; iteration++ {
+		actions := make([]testAction, rng.Intn(6))
+		seen := make(map[byte]bool)
+		duplicate := false
+		for idx := range actions {
+			n := byte(rng.Intn(5))
+			duplicate = duplicate || seen[n]
+			seen[n] = true
+			actions[idx] = testAction{
+				which:   whiches[rng.Intn(len(whiches))],
+				varId:   testVarId(n),
+				version: common.VersionZero[:],
+			}
+		}
+		err := testVersionCache().ValidateTransaction(testTxn(rng.Intn(4) == 0, actions))
+		if duplicate && err == nil {
+			t.Fatalf("Txn with duplicate actions accepted: %v", actions)
+		} else if len(actions) == 0 && err == nil {
+			t.Fatal("Empty txn accepted")
+		}
+	}
+}
+
+func TestValidateReferences(t *testing.T) {
+	seg := capn.NewBuffer(nil)
+	clientActions := cmsgs.NewClientActionList(seg, 2)
+	for idx, refs := range []int{3, 5} {
+		clientAction := clientActions.At(idx)
+		clientAction.SetVarId(testVarId(byte(3 + idx)))
+		clientAction.SetCreate()
+		clientAction.Create().SetReferences(cmsgs.NewClientVarIdPosList(seg, refs))
+	}
+	cases := []struct {
+		max   int
+		valid bool
+	}{{0, true}, {5, true}, {4, false}}
+	for _, c := range cases {
+		widest, err := validateReferences(&clientActions, c.max)
+		if c.valid && (err != nil || widest != 5) {
+			t.Errorf("Max %v: expected valid txn with widest 5; got %v, %v", c.max, widest, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("Max %v: expected invalid txn", c.max)
+		}
+	}
+}
+
+func testUpdates(vUUId *common.VarUUId, clockElem uint64) *msgs.Update_List {
+	seg := capn.NewBuffer(nil)
+	updates := msgs.NewUpdateList(seg, 1)
+	update := updates.At(0)
+	update.SetTxnId(testVarId(9))
+	actionsSeg := capn.NewBuffer(nil)
+	wrapper := msgs.NewRootActionListWrapper(actionsSeg)
+	actions := msgs.NewActionList(actionsSeg, 1)
+	wrapper.SetActions(actions)
+	action := actions.At(0)
+	action.SetVarId(vUUId[:])
+	action.SetWrite()
+	action.Write().SetReferences(msgs.NewVarIdPosList(actionsSeg, 0))
+	update.SetActions(server.SegToBytes(actionsSeg))
+	update.SetClock(eng.NewVectorClock().AsMutable().Bump(vUUId, clockElem).AsData())
+	return &updates
+}
+
+func TestDrift(t *testing.T) {
+	vc := testVersionCache()
+	known := common.MakeVarUUId(testVarId(1))
+	vc[*known].txnId = common.MakeTxnId(testVarId(8))
+	vc[*known].clockElem = 3
+	if drift := vc.Drift(testUpdates(known, 7)); drift != 4 {
+		t.Errorf("Expected drift of 4; got %v", drift)
+	}
+	if drift := vc.Drift(testUpdates(known, 2)); drift != 0 {
+		t.Errorf("Expected no drift for an older update; got %v", drift)
+	}
+	// Root 2 has never been read, so its version is unknown.
+	if drift := vc.Drift(testUpdates(common.MakeVarUUId(testVarId(2)), 7)); drift != 0 {
+		t.Errorf("Expected no drift for a var never read; got %v", drift)
+	}
+}
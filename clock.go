@@ -0,0 +1,128 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the subsystems whose behaviour
+// depends on it (the VarManagers' timer wheels and Poisson
+// estimates, the ProposerManagers' latency measurements, backoffs
+// and connection restart delays). In production this is always
+// RealClock. Tests can instead use a VirtualClock, which only moves
+// when told to, so that timing-sensitive behaviour can be reproduced
+// deterministically.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc arranges for f to be called once d has elapsed.
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+type ClockTimer interface {
+	// Stop prevents the timer from firing. Returns false if the timer
+	// has already fired or been stopped.
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (rc realClock) Now() time.Time { return time.Now() }
+
+func (rc realClock) AfterFunc(d time.Duration, f func()) ClockTimer { return time.AfterFunc(d, f) }
+
+var RealClock Clock = realClock{}
+
+// VirtualClock is a Clock which only advances when Advance is
+// called. Timers fire, in order of their deadlines, as Advance moves
+// the clock past them.
+type VirtualClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*virtualTimer
+}
+
+type virtualTimer struct {
+	clock    *VirtualClock
+	deadline time.Time
+	f        func()
+	fired    bool
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (vc *VirtualClock) Now() time.Time {
+	vc.Lock()
+	defer vc.Unlock()
+	return vc.now
+}
+
+func (vc *VirtualClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	vc.Lock()
+	defer vc.Unlock()
+	vt := &virtualTimer{
+		clock:    vc,
+		deadline: vc.now.Add(d),
+		f:        f,
+	}
+	// keep timers in deadline order; equal deadlines fire in the order
+	// they were created.
+	idx := len(vc.timers)
+	for idx > 0 && vc.timers[idx-1].deadline.After(vt.deadline) {
+		idx--
+	}
+	vc.timers = append(vc.timers, nil)
+	copy(vc.timers[idx+1:], vc.timers[idx:])
+	vc.timers[idx] = vt
+	return vt
+}
+
+// Pending returns the number of timers yet to fire.
+func (vc *VirtualClock) Pending() int {
+	vc.Lock()
+	defer vc.Unlock()
+	return len(vc.timers)
+}
+
+// Advance moves the clock forwards by d, firing every timer whose
+// deadline is reached. Unlike real timers, the timers' functions are
+// called synchronously, in deadline order, with Now returning each
+// timer's deadline in turn.
+func (vc *VirtualClock) Advance(d time.Duration) {
+	vc.Lock()
+	target := vc.now.Add(d)
+	for {
+		if len(vc.timers) == 0 || vc.timers[0].deadline.After(target) {
+			break
+		}
+		vt := vc.timers[0]
+		vc.timers = vc.timers[1:]
+		vt.fired = true
+		if vt.deadline.After(vc.now) {
+			vc.now = vt.deadline
+		}
+		vc.Unlock()
+		vt.f()
+		vc.Lock()
+	}
+	vc.now = target
+	vc.Unlock()
+}
+
+func (vt *virtualTimer) Stop() bool {
+	vc := vt.clock
+	vc.Lock()
+	defer vc.Unlock()
+	if vt.fired {
+		return false
+	}
+	for idx, t := range vc.timers {
+		if t == vt {
+			vc.timers = append(vc.timers[:idx], vc.timers[idx+1:]...)
+			vt.fired = true
+			return true
+		}
+	}
+	return false
+}
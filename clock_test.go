@@ -0,0 +1,60 @@
+package server
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestVirtualClockFiresInDeadlineOrder(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := NewVirtualClock(start)
+	fired := []int{}
+	firedAt := []time.Time{}
+	for idx, d := range []time.Duration{3 * time.Second, time.Second, 2 * time.Second, time.Second} {
+		idxCopy := idx
+		clock.AfterFunc(d, func() {
+			fired = append(fired, idxCopy)
+			firedAt = append(firedAt, clock.Now())
+		})
+	}
+	stopped := clock.AfterFunc(time.Second, func() { t.Fatal("Stopped timer fired") })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("Expected only the first Stop to succeed")
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	if len(fired) != 2 || fired[0] != 1 || fired[1] != 3 {
+		t.Fatalf("Expected timers 1 and 3 to have fired; fired %v", fired)
+	}
+	if !firedAt[0].Equal(start.Add(time.Second)) {
+		t.Fatalf("Expected timer to observe its deadline; observed %v", firedAt[0])
+	}
+	if now := clock.Now(); !now.Equal(start.Add(1500 * time.Millisecond)) {
+		t.Fatalf("Clock at %v after advance", now)
+	}
+
+	clock.Advance(10 * time.Second)
+	if len(fired) != 4 || fired[2] != 2 || fired[3] != 0 || clock.Pending() != 0 {
+		t.Fatalf("Expected all timers to have fired in order; fired %v, %v pending", fired, clock.Pending())
+	}
+}
+
+func TestBinaryBackoffEngineWithVirtualClock(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	rng := rand.New(rand.NewSource(0))
+	bbe := NewBinaryBackoffEngineWithClock(rng, clock, time.Millisecond, time.Second)
+	for bbe.Cur == 0 {
+		bbe.Advance()
+	}
+	done := false
+	bbe.After(func() { done = true })
+	clock.Advance(bbe.Cur - 1)
+	if done {
+		t.Fatal("Backoff finished early")
+	}
+	clock.Advance(1)
+	if !done {
+		t.Fatal("Backoff did not finish")
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// benchLatencySamples is the most latencies kept, per kind of op,
+	// for calculating percentiles. Beyond that, a uniform sample of
+	// all the latencies is kept, so a long soak doesn't grow without
+	// bound.
+	benchLatencySamples = 100000
+	benchRequestTimeout = 30 * time.Second
+)
+
+type benchOp int
+
+const (
+	benchRead benchOp = iota
+	benchWrite
+	benchTxn
+	benchOpCount
+)
+
+var benchOpNames = [benchOpCount]string{"read", "write", "txn"}
+
+// runBenchCommand implements `goshawkdb bench`, which runs a client
+// workload against a cluster and reports throughput and latency
+// percentiles, so that performance can be compared across releases
+// without any other tooling. The workload is driven through the REST
+// gateway of each target node (started with -rest), using a client
+// certificate granted read and write to the root. Each op is a read
+// of a var, a write of a var, or a txn which reads one var and writes
+// another, mixed according to the given weights. The vars used are
+// the root and the vars it refers to: contention is the fraction of
+// ops that use the root itself, with the remainder spread evenly over
+// its references. The REST gateway cannot create vars, so the
+// references of the root must be set up beforehand.
+func runBenchCommand(args []string) error {
+	var targets, clientCertFile, clusterCertFile, rootName string
+	var workers, valueSize, reads, writes, txns int
+	var duration, interval time.Duration
+	var contention float64
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.StringVar(&targets, "targets", "", "Comma separated host:port of the HTTPS port of each node to send ops to (required).")
+	flags.StringVar(&clientCertFile, "cert", "", "`Path` to a client certificate and key pair, as generated by -gen-client-cert (required).")
+	flags.StringVar(&clusterCertFile, "clustercert", "", "`Path` to the cluster certificate, to verify the nodes (optional; not verified if empty).")
+	flags.StringVar(&rootName, "root", "", "Name of the root to use (required).")
+	flags.IntVar(&workers, "workers", 16, "Number of concurrent clients. Each has at most one op in flight.")
+	flags.DurationVar(&duration, "duration", time.Minute, "How long to run for.")
+	flags.DurationVar(&interval, "interval", 10*time.Second, "How often to report progress (optional; disabled if 0).")
+	flags.IntVar(&reads, "reads", 80, "Relative weight of reads.")
+	flags.IntVar(&writes, "writes", 15, "Relative weight of writes.")
+	flags.IntVar(&txns, "txns", 5, "Relative weight of txns which read one var and write another.")
+	flags.Float64Var(&contention, "contention", 0, "Fraction of ops, between 0 and 1, which use the root var rather than one of its references.")
+	flags.IntVar(&valueSize, "valuesize", 64, "Size in bytes of the values written.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	targetList := []string{}
+	for _, target := range strings.Split(targets, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targetList = append(targetList, target)
+		}
+	}
+	if len(targetList) == 0 {
+		return fmt.Errorf("No targets supplied (missing -targets parameter).")
+	} else if clientCertFile == "" {
+		return fmt.Errorf("No client certificate supplied (missing -cert parameter).")
+	} else if rootName == "" {
+		return fmt.Errorf("No root supplied (missing -root parameter).")
+	} else if workers < 1 {
+		return fmt.Errorf("Supplied number of workers is illegal (%v). Must be > 0", workers)
+	} else if duration <= 0 {
+		return fmt.Errorf("Supplied duration is illegal (%v). Must be > 0", duration)
+	} else if interval < 0 {
+		return fmt.Errorf("Supplied interval is illegal (%v). Must be >= 0", interval)
+	} else if reads < 0 || writes < 0 || txns < 0 || reads+writes+txns == 0 {
+		return fmt.Errorf("Supplied op weights are illegal (%v, %v, %v). Must all be >= 0, and not all 0", reads, writes, txns)
+	} else if !(0 <= contention && contention <= 1) {
+		return fmt.Errorf("Supplied contention is illegal (%v). Must be >= 0 and <= 1", contention)
+	} else if valueSize < 0 {
+		return fmt.Errorf("Supplied value size is illegal (%v). Must be >= 0", valueSize)
+	}
+
+	tlsConfig, err := benchTLSConfig(clientCertFile, clusterCertFile)
+	if err != nil {
+		return err
+	}
+	b := &bench{
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, MaxIdleConnsPerHost: workers},
+			Timeout:   benchRequestTimeout,
+		},
+		targets:    targetList,
+		root:       rootName,
+		weights:    [benchOpCount]int{reads, writes, txns},
+		contention: contention,
+		valueSize:  valueSize,
+	}
+	if b.references, err = b.rootReferences(); err != nil {
+		return err
+	}
+	if b.references == 0 && contention < 1 {
+		log.Printf("Warning: root %v has no references, so every op will use the root var.\n", rootName)
+	}
+	log.Printf("Running %v workers against %v for %v: weights %v reads, %v writes, %v txns; contention %v over %v vars.\n",
+		workers, strings.Join(targetList, ", "), duration, reads, writes, txns, contention, b.references+1)
+	b.run(workers, duration, interval)
+	return nil
+}
+
+func benchTLSConfig(clientCertFile, clusterCertFile string) (*tls.Config, error) {
+	clientPEM, err := ioutil.ReadFile(clientCertFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCert, err := tls.X509KeyPair(clientPEM, clientPEM)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load client certificate from %v: %v", clientCertFile, err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		// Node certificates don't name their hosts, so we verify them
+		// ourselves, if we can, against the cluster certificate.
+		InsecureSkipVerify: true,
+	}
+	if clusterCertFile == "" {
+		log.Println("Warning: no cluster certificate supplied (missing -clustercert parameter): nodes will not be verified.")
+		return config, nil
+	}
+	clusterPEM, err := ioutil.ReadFile(clusterCertFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(clusterPEM) {
+		return nil, fmt.Errorf("No certificate found in %v", clusterCertFile)
+	}
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("Node supplied no certificate")
+		}
+		intermediates := x509.NewCertPool()
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for idx, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[idx] = cert
+			if idx > 0 {
+				intermediates.AddCert(cert)
+			}
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		return err
+	}
+	return config, nil
+}
+
+type bench struct {
+	client     *http.Client
+	targets    []string
+	root       string
+	references int
+	weights    [benchOpCount]int
+	contention float64
+	valueSize  int
+	lock       sync.Mutex
+	stats      [benchOpCount]*benchStats
+}
+
+// Mirrors the REST gateway's JSON.
+type benchVarResponse struct {
+	References int
+}
+
+type benchTxnRequest struct {
+	Actions []benchTxnAction
+}
+
+type benchTxnAction struct {
+	Root  string
+	Path  []int
+	Read  bool
+	Write []byte `json:",omitempty"`
+}
+
+type benchTxnResponse struct {
+	Committed bool
+}
+
+// errBenchConflict marks an op which failed due to contention. These
+// are counted, but are not errors.
+var errBenchConflict = errors.New("conflict")
+
+func (b *bench) rootReferences() (int, error) {
+	body, err := b.do(b.targets[0], "GET", b.varURL(b.targets[0], nil), nil)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to read root %v: %v", b.root, err)
+	}
+	response := &benchVarResponse{}
+	if err = json.Unmarshal(body, response); err != nil {
+		return 0, fmt.Errorf("Unable to read root %v: %v", b.root, err)
+	}
+	return response.References, nil
+}
+
+func (b *bench) run(workers int, duration, interval time.Duration) {
+	for op := range b.stats {
+		b.stats[op] = &benchStats{}
+	}
+	terminate := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	for idx := 0; idx < workers; idx++ {
+		wg.Add(1)
+		go b.worker(b.targets[idx%len(b.targets)], mrand.New(mrand.NewSource(time.Now().UnixNano()+int64(idx))), terminate, wg)
+	}
+
+	start := time.Now()
+	end := time.After(duration)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last, lastCounts := start, [benchOpCount]uint64{}
+	for running := true; running; {
+		select {
+		case <-end:
+			running = false
+		case now := <-tick:
+			b.lock.Lock()
+			elapsed := now.Sub(last).Seconds()
+			progress := make([]string, 0, benchOpCount)
+			for op, stats := range b.stats {
+				if b.weights[op] != 0 {
+					progress = append(progress, fmt.Sprintf("%v %.1f/s", benchOpNames[op], float64(stats.count-lastCounts[op])/elapsed))
+					lastCounts[op] = stats.count
+				}
+			}
+			b.lock.Unlock()
+			last = now
+			log.Printf("%v: %v\n", now.Sub(start)/time.Second*time.Second, strings.Join(progress, "; "))
+		}
+	}
+	close(terminate)
+	wg.Wait()
+
+	elapsed := time.Since(start).Seconds()
+	fmt.Printf("\nCompleted in %.1fs:\n", elapsed)
+	for op, stats := range b.stats {
+		if b.weights[op] != 0 {
+			fmt.Printf("%-6v %v\n", benchOpNames[op]+":", stats.summary(elapsed))
+		}
+	}
+}
+
+func (b *bench) worker(target string, rng *mrand.Rand, terminate chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	value := make([]byte, b.valueSize)
+	total := b.weights[benchRead] + b.weights[benchWrite] + b.weights[benchTxn]
+	for {
+		select {
+		case <-terminate:
+			return
+		default:
+		}
+		op, n := benchRead, rng.Intn(total)
+		for ; n >= b.weights[op]; op++ {
+			n -= b.weights[op]
+		}
+		rand.Read(value)
+
+		start := time.Now()
+		var err error
+		switch op {
+		case benchRead:
+			_, err = b.do(target, "GET", b.varURL(target, b.pickPath(rng)), nil)
+		case benchWrite:
+			_, err = b.do(target, "PUT", b.varURL(target, b.pickPath(rng)), value)
+		case benchTxn:
+			err = b.txn(target, b.pickPath(rng), b.pickPath(rng), value)
+		}
+		latency := time.Since(start)
+
+		b.lock.Lock()
+		b.stats[op].record(latency, err, rng)
+		b.lock.Unlock()
+	}
+}
+
+// pickPath returns the path from the root of the var to use: nil for
+// the root itself.
+func (b *bench) pickPath(rng *mrand.Rand) []int {
+	if b.references == 0 || rng.Float64() < b.contention {
+		return nil
+	}
+	return []int{rng.Intn(b.references)}
+}
+
+func (b *bench) txn(target string, readPath, writePath []int, value []byte) error {
+	txnReq := &benchTxnRequest{Actions: []benchTxnAction{
+		{Root: b.root, Path: writePath, Write: value},
+	}}
+	if len(readPath) == len(writePath) && (len(readPath) == 0 || readPath[0] == writePath[0]) {
+		txnReq.Actions[0].Read = true
+	} else {
+		txnReq.Actions = append(txnReq.Actions, benchTxnAction{Root: b.root, Path: readPath, Read: true})
+	}
+	reqBody, err := json.Marshal(txnReq)
+	if err != nil {
+		return err
+	}
+	body, err := b.do(target, "POST", "https://"+target+"/txn", reqBody)
+	if err != nil {
+		return err
+	}
+	response := &benchTxnResponse{}
+	if err = json.Unmarshal(body, response); err != nil {
+		return err
+	} else if !response.Committed {
+		return errBenchConflict
+	}
+	return nil
+}
+
+func (b *bench) varURL(target string, path []int) string {
+	url := fmt.Sprintf("https://%v/vars/%v", target, b.root)
+	for _, idx := range path {
+		url += fmt.Sprintf("/%d", idx)
+	}
+	return url
+}
+
+func (b *bench) do(target, method, url string, reqBody []byte) ([]byte, error) {
+	var bodyReader io.Reader
+	if reqBody != nil {
+		bodyReader = bytes.NewReader(reqBody)
+	}
+	req, err := http.NewRequest(method, url, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return nil, errBenchConflict
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("%v: %v %v: %v", target, method, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// benchStats accumulates the outcomes of one kind of op. Latencies are
+// only recorded for ops which succeed.
+type benchStats struct {
+	count     uint64
+	ok        uint64
+	conflicts uint64
+	errors    uint64
+	lastErr   error
+	max       time.Duration
+	latencies benchLatencies
+}
+
+func (bs *benchStats) record(latency time.Duration, err error, rng *mrand.Rand) {
+	bs.count++
+	switch {
+	case err == errBenchConflict:
+		bs.conflicts++
+		return
+	case err != nil:
+		bs.errors++
+		bs.lastErr = err
+		return
+	}
+	bs.ok++
+	if latency > bs.max {
+		bs.max = latency
+	}
+	if len(bs.latencies) < benchLatencySamples {
+		bs.latencies = append(bs.latencies, latency)
+	} else if idx := rng.Int63n(int64(bs.ok)); idx < benchLatencySamples {
+		bs.latencies[idx] = latency
+	}
+}
+
+func (bs *benchStats) summary(elapsed float64) string {
+	summary := fmt.Sprintf("%v ops (%.1f/s); %v conflicts; %v errors", bs.ok, float64(bs.ok)/elapsed, bs.conflicts, bs.errors)
+	if len(bs.latencies) != 0 {
+		sort.Sort(bs.latencies)
+		summary += fmt.Sprintf("; latency p50 %v, p90 %v, p99 %v, max %v",
+			bs.latencies.percentile(0.5), bs.latencies.percentile(0.9), bs.latencies.percentile(0.99), bs.max)
+	}
+	if bs.lastErr != nil {
+		summary += fmt.Sprintf("; last error: %v", bs.lastErr)
+	}
+	return summary
+}
+
+type benchLatencies []time.Duration
+
+func (bl benchLatencies) Len() int           { return len(bl) }
+func (bl benchLatencies) Less(i, j int) bool { return bl[i] < bl[j] }
+func (bl benchLatencies) Swap(i, j int)      { bl[i], bl[j] = bl[j], bl[i] }
+
+// percentile requires bl to be sorted.
+func (bl benchLatencies) percentile(p float64) time.Duration {
+	return bl[int(p*float64(len(bl)-1))]
+}
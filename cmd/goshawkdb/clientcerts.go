@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"goshawkdb.io/common/certs"
+	"goshawkdb.io/server/configuration"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// clientCertsRequest describes a batch of client certificates to
+// generate with -gen-client-cert. Each certificate key pair is
+// written either to stdout (only if there is just one) or to its own
+// file, named by filePattern with %d replaced by the number of the
+// certificate (from 1). Alongside, the fingerprints of the new
+// certificates are written as a fragment of configuration, granting
+// each certificate read and write to roots, ready to paste into the
+// cluster configuration.
+type clientCertsRequest struct {
+	count            int
+	filePattern      string
+	fingerprintsFile string
+	roots            []string
+}
+
+func (req *clientCertsRequest) validate() error {
+	if req.count < 1 {
+		return fmt.Errorf("Number of client certificates to generate must be at least 1: %v", req.count)
+	}
+	if req.filePattern == "" {
+		if req.count > 1 {
+			return fmt.Errorf("Generating %v client certificates requires -clientcertfile.", req.count)
+		}
+	} else if verbs := strings.Count(req.filePattern, "%"); req.count > 1 && (verbs != 1 || strings.Count(req.filePattern, "%d") != 1) {
+		return fmt.Errorf("Client certificate file pattern must contain exactly one %%d when generating several: %v", req.filePattern)
+	} else if req.count == 1 && verbs > 1 {
+		return fmt.Errorf("Client certificate file pattern must contain at most one %%d: %v", req.filePattern)
+	}
+	return nil
+}
+
+func (req *clientCertsRequest) fileName(idx int) string {
+	if strings.Contains(req.filePattern, "%d") {
+		return fmt.Sprintf(req.filePattern, idx)
+	}
+	return req.filePattern
+}
+
+func (req *clientCertsRequest) generate(clusterCertificate []byte) error {
+	if err := req.validate(); err != nil {
+		return err
+	}
+	fingerprints := make(map[string]map[string]*configuration.RootCapability, req.count)
+	for idx := 1; idx <= req.count; idx++ {
+		certificatePrivateKeyPair, err := certs.NewClientCertificate(clusterCertificate)
+		if err != nil {
+			return err
+		}
+		pem := certificatePrivateKeyPair.CertificatePEM + certificatePrivateKeyPair.PrivateKeyPEM
+		fingerprint := sha256.Sum256(certificatePrivateKeyPair.Certificate)
+		fingerprintHex := hex.EncodeToString(fingerprint[:])
+
+		if req.filePattern == "" {
+			fmt.Print(pem)
+		} else {
+			name := req.fileName(idx)
+			if err := createFile(name, []byte(pem), 0600); err != nil {
+				return err
+			}
+			log.Printf("Client certificate key pair written to %v.\n", name)
+		}
+		log.Printf("Fingerprint: %v\n", fingerprintHex)
+
+		roots := make(map[string]*configuration.RootCapability, len(req.roots))
+		for _, root := range req.roots {
+			roots[root] = &configuration.RootCapability{Read: true, Write: true}
+		}
+		fingerprints[fingerprintHex] = roots
+	}
+
+	if req.fingerprintsFile == "" && req.filePattern == "" {
+		return nil
+	}
+	fragment, err := json.MarshalIndent(map[string]interface{}{"ClientCertificateFingerprints": fingerprints}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fragment = append(fragment, '\n')
+	if req.fingerprintsFile == "" {
+		_, err = os.Stdout.Write(fragment)
+		return err
+	}
+	if err = ioutil.WriteFile(req.fingerprintsFile, fragment, 0640); err == nil {
+		log.Printf("Client certificate fingerprints written to %v.\n", req.fingerprintsFile)
+	}
+	return err
+}
+
+// createFile writes data to a new file, failing if the file already
+// exists: it may hold a key still in use.
+func createFile(name string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	mdbs "github.com/msackman/gomdb/server"
+	goshawk "goshawkdb.io/server"
+	"goshawkdb.io/server/configuration"
+	"goshawkdb.io/server/db"
+	"goshawkdb.io/server/network"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// runConfigCommand implements `goshawkdb config history`, which lists
+// the configurations a node has applied, as recorded in its data
+// directory, or with -diff, how one version differs from another; and
+// `goshawkdb config sign` (see runConfigSignCommand).
+func runConfigCommand(args []string) error {
+	if len(args) != 0 && args[0] == "sign" {
+		return runConfigSignCommand(args[1:])
+	} else if len(args) == 0 || args[0] != "history" {
+		return fmt.Errorf("Usage: %v config history -dir Path [-diff from,to]\n       %v config sign -cert Path -config Path -out Path", os.Args[0], os.Args[0])
+	}
+	var dataDir, diff string
+	flags := flag.NewFlagSet("config history", flag.ContinueOnError)
+	flags.StringVar(&dataDir, "dir", "", "`Path` to data directory (required).")
+	flags.StringVar(&diff, "diff", "", "Two comma separated versions: show how the second differs from the first (optional).")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if dataDir == "" {
+		return fmt.Errorf("No data dir supplied (missing -dir parameter).")
+	}
+	dataDir, err := followRelocations(dataDir)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(dataDir); err != nil {
+		return err
+	}
+
+	disk, err := mdbs.NewMDBServer(dataDir, 0, 0600, goshawk.MDBInitialSize, 1, time.Millisecond, db.DB)
+	if err != nil {
+		return err
+	}
+	dbs := disk.(*db.Databases)
+	defer dbs.Shutdown()
+
+	entries, err := network.LoadConfigHistory(dbs)
+	if err != nil {
+		return err
+	}
+	if diff == "" {
+		for _, entry := range entries {
+			fmt.Println(entry)
+		}
+		return nil
+	}
+	diffs, err := network.DiffConfigHistory(entries, diff)
+	if err != nil {
+		return err
+	}
+	for _, line := range diffs {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// runConfigSignCommand implements `goshawkdb config sign`, which
+// writes a configuration file as a bundle signed with the cluster
+// certificate's key, for use with -signedconfig.
+func runConfigSignCommand(args []string) error {
+	var certFile, configFile, configFormat, outFile string
+	flags := flag.NewFlagSet("config sign", flag.ContinueOnError)
+	flags.StringVar(&certFile, "cert", "", "`Path` to cluster certificate and key file (required).")
+	flags.StringVar(&configFile, "config", "", "`Path` to the configuration file to sign (required).")
+	flags.StringVar(&configFormat, "configformat", "auto", "Format of the configuration file: json, toml, yaml, or auto to detect from the file extension.")
+	flags.StringVar(&outFile, "out", "", "`Path` to write the signed bundle to (required).")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if certFile == "" {
+		return fmt.Errorf("No certificate supplied (missing -cert parameter).")
+	} else if configFile == "" {
+		return fmt.Errorf("No configuration file supplied (missing -config parameter).")
+	} else if outFile == "" {
+		return fmt.Errorf("No output file supplied (missing -out parameter).")
+	}
+	format, err := configuration.ParseFormat(configFormat)
+	if err != nil {
+		return err
+	}
+	certificate, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	bundle, err := configuration.SignConfigurationFromPath(configFile, format, certificate)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outFile, bundle, 0640)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"goshawkdb.io/common"
+	"goshawkdb.io/common/certs"
+	"goshawkdb.io/server/configuration"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runInitClusterCommand implements `goshawkdb init-cluster`, which
+// performs the getting started steps for a new cluster in one go: it
+// generates the cluster certificate, client certificates granted
+// read and write to the given roots, and a configuration listing the
+// given hosts, checks that each host can be reached, and prints the
+// command to run on each host. Everything is written into a new
+// directory, which is then to be copied to every host.
+func runInitClusterCommand(args []string) error {
+	var hosts, outDir, clusterId, roots, dataDir string
+	var f, maxRMCount, clientCerts int
+	var noCheck bool
+	flags := flag.NewFlagSet("init-cluster", flag.ContinueOnError)
+	flags.StringVar(&hosts, "hosts", "", "Comma separated host[:port] of every node in the cluster (required).")
+	flags.IntVar(&f, "f", 0, "Number of node failures the cluster must tolerate; at least 2F+1 hosts are required.")
+	flags.StringVar(&outDir, "out", "", "`Path` to a new directory to write the configuration and certificates into (required).")
+	flags.StringVar(&clusterId, "clusterid", "", "Cluster id (optional; random if empty).")
+	flags.IntVar(&maxRMCount, "maxrmcount", 0, "Maximum number of nodes the cluster may ever grow to (optional; twice the number of hosts if 0).")
+	flags.StringVar(&roots, "roots", "test", "Comma separated roots to create and grant the client certificates read and write to.")
+	flags.IntVar(&clientCerts, "clientcerts", 1, "Number of client certificate key pairs to generate. At least 1 is required, as the configuration must grant some client access.")
+	flags.StringVar(&dataDir, "dir", "/var/lib/goshawkdb", "`Path` to the data directory on each host, used in the printed commands.")
+	flags.BoolVar(&noCheck, "nocheck", false, "Do not check that each host can be reached.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if hosts == "" {
+		return fmt.Errorf("No hosts supplied (missing -hosts parameter).")
+	} else if outDir == "" {
+		return fmt.Errorf("No output directory supplied (missing -out parameter).")
+	} else if !(0 <= f && f < 128) {
+		return fmt.Errorf("Supplied F is illegal (%v). Must be >= 0 and < 128", f)
+	} else if clientCerts < 1 {
+		return fmt.Errorf("Supplied number of client certificates is illegal (%v). Must be > 0", clientCerts)
+	}
+	hostList := []string{}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hostList = append(hostList, host)
+		}
+	}
+	if maxRMCount == 0 {
+		maxRMCount = 2 * len(hostList)
+	}
+	if !(0 < maxRMCount && maxRMCount < 65536) {
+		return fmt.Errorf("Supplied MaxRMCount is illegal (%v). Must be > 0 and < 65536", maxRMCount)
+	}
+	if clusterId == "" {
+		randomBytes := make([]byte, 8)
+		if _, err := rand.Read(randomBytes); err != nil {
+			return err
+		}
+		clusterId = fmt.Sprintf("%v-%v", common.ProductName, hex.EncodeToString(randomBytes))
+	}
+	rootCapabilities := make(map[string]*configuration.RootCapability)
+	for _, root := range strings.Split(roots, ",") {
+		if root = strings.TrimSpace(root); root != "" {
+			rootCapabilities[root] = &configuration.RootCapability{Read: true, Write: true}
+		}
+	}
+
+	clusterCertificate, err := certs.NewClusterCertificate()
+	if err != nil {
+		return err
+	}
+	clientPEMs := make([]string, clientCerts)
+	fingerprints := make(map[string]map[string]*configuration.RootCapability, clientCerts)
+	for idx := range clientPEMs {
+		certificatePrivateKeyPair, err := certs.NewClientCertificate([]byte(clusterCertificate.CertificatePEM + clusterCertificate.PrivateKeyPEM))
+		if err != nil {
+			return err
+		}
+		clientPEMs[idx] = certificatePrivateKeyPair.CertificatePEM + certificatePrivateKeyPair.PrivateKeyPEM
+		fingerprint := sha256.Sum256(certificatePrivateKeyPair.Certificate)
+		fingerprints[hex.EncodeToString(fingerprint[:])] = rootCapabilities
+	}
+
+	configJSON, err := json.MarshalIndent(map[string]interface{}{
+		"ClusterId":                     clusterId,
+		"Version":                       1,
+		"Hosts":                         hostList,
+		"F":                             f,
+		"MaxRMCount":                    maxRMCount,
+		"ClientCertificateFingerprints": fingerprints,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	configJSON = append(configJSON, '\n')
+	// Validate exactly as the server will, before writing anything.
+	config, err := configuration.ConfigurationFromJSON(configJSON)
+	if err != nil {
+		return err
+	}
+
+	if !noCheck {
+		for _, hostPort := range config.Hosts {
+			checkHostReachable(hostPort)
+		}
+	}
+
+	if err = os.MkdirAll(outDir, 0750); err != nil {
+		return err
+	}
+	configFile := filepath.Join(outDir, "config.json")
+	certFile := filepath.Join(outDir, "cluster.pem")
+	if err = createFile(configFile, configJSON, 0640); err != nil {
+		return err
+	}
+	if err = createFile(certFile, []byte(clusterCertificate.CertificatePEM+clusterCertificate.PrivateKeyPEM), 0600); err != nil {
+		return err
+	}
+	for idx, pem := range clientPEMs {
+		name := filepath.Join(outDir, fmt.Sprintf("client-%d.pem", idx+1))
+		if err = createFile(name, []byte(pem), 0600); err != nil {
+			return err
+		}
+	}
+	log.Printf("Configuration, cluster certificate and %v client certificate key pairs written to %v.\n", clientCerts, outDir)
+
+	fmt.Printf("Copy %v to every host, and then run:\n", outDir)
+	for _, hostPort := range config.Hosts {
+		host, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  on %v: %v -config %v -cert %v -dir %v -port %v\n",
+			host, os.Args[0], configFile, certFile, dataDir, port)
+	}
+	return nil
+}
+
+// checkHostReachable reports whether anything answers on hostPort. As
+// the cluster is yet to be started, a refused connection is the
+// expected answer: it shows the host is up and the port is free.
+func checkHostReachable(hostPort string) {
+	conn, err := net.DialTimeout("tcp", hostPort, 5*time.Second)
+	if err == nil {
+		conn.Close()
+		log.Printf("Warning: %v: something is already listening on this port.\n", hostPort)
+	} else if opErr, ok := err.(*net.OpError); ok && isConnectionRefused(opErr.Err) {
+		log.Printf("%v: reachable.\n", hostPort)
+	} else {
+		log.Printf("Warning: %v: unreachable (%v). Check the host is up and no firewall blocks the port.\n", hostPort, err)
+	}
+}
+
+func isConnectionRefused(err error) bool {
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
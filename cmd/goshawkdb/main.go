@@ -11,18 +11,25 @@ import (
 	"goshawkdb.io/common"
 	"goshawkdb.io/common/certs"
 	goshawk "goshawkdb.io/server"
+	"goshawkdb.io/server/client"
 	"goshawkdb.io/server/configuration"
 	"goshawkdb.io/server/db"
+	"goshawkdb.io/server/dispatcher"
 	"goshawkdb.io/server/network"
 	"goshawkdb.io/server/paxos"
+	eng "goshawkdb.io/server/txnengine"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"runtime/trace"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -31,12 +38,41 @@ import (
 func main() {
 	log.SetPrefix(common.ProductName + " ")
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+	log.SetOutput(io.MultiWriter(os.Stderr, goshawk.RecentLog))
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfigCommand(os.Args[2:]); err != nil {
+			fmt.Printf("\n%v\n\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "init-cluster" {
+		if err := runInitClusterCommand(os.Args[2:]); err != nil {
+			fmt.Printf("\n%v\n\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sessions" {
+		if err := runSessionsCommand(os.Args[2:]); err != nil {
+			fmt.Printf("\n%v\n\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBenchCommand(os.Args[2:]); err != nil {
+			fmt.Printf("\n%v\n\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	log.Printf("GoshawkDB Version %s with %s; %v", goshawk.ServerVersion, mdb.Version(), os.Args)
 
 	if s, err := newServer(); err != nil {
 		fmt.Printf("\n%v\n\n", err)
 		flag.Usage()
-		fmt.Println("\nSee https://goshawkdb.io/starting.html for the Getting Started guide.")
+		fmt.Println("\nSee https://goshawkdb.io/starting.html for the Getting Started guide, or run `goshawkdb init-cluster -hosts a,b,c -f 1 -out Path` to set up a new cluster.")
 		os.Exit(1)
 	} else if s != nil {
 		s.start()
@@ -44,17 +80,72 @@ func main() {
 }
 
 func newServer() (*server, error) {
-	var configFile, dataDir, certFile string
-	var port int
-	var version, genClusterCert, genClientCert bool
+	var configFile, configFormat, configComment, dataDir, certFile, listenersFile, captureFile, captureTxns, frameLogFile, sessionLogFile, metricsExport, adminFingerprints, quotasFile, compression, gcMode, clientCertFile, clientCertRoots, fingerprintsFile, queueLimits, pprofAddr string
+	var port, httpPort, discover, serverLinks, handshakeRate, compressionMinSize, metricsSamples, clusterEvents, driftWarn, maxClients, maxHandshakes, clientCerts, memoryBudget, warmupVars, immigrationBuffer, maxReferences, maxClientMsg, maxServerMsg int
+	var gcGrace, metricsInterval, statsInterval, standbyCheck, metricsExportInterval, readerWarn, readerDeadline, diskSlow, diskSlowFor, journalPeriod time.Duration
+	var version, genClusterCert, genClientCert, restGateway, browser, auditIds, noResumption, adaptiveBeats, balanceVars, diskShed, fastAcceptors, pprofEnabled, signedConfig bool
 
 	flag.StringVar(&configFile, "config", "", "`Path` to configuration file (required to start server).")
+	flag.StringVar(&configFormat, "configformat", "auto", "Format of the configuration file: json, toml, yaml, or auto to detect from the file extension.")
+	flag.StringVar(&configComment, "configcomment", "", "Comment to record in the configuration history if the configuration file causes a configuration change (optional).")
+	flag.BoolVar(&signedConfig, "signedconfig", false, "The configuration file is a signed bundle, made with `goshawkdb config sign`. Configuration changes, whether from the file on SIGHUP, from other nodes, or written by clients to the topology request root, are only accepted if signed with the cluster certificate. Decommissioning is refused, as it would require an unsigned configuration.")
 	flag.StringVar(&dataDir, "dir", "", "`Path` to data directory (required to run server).")
 	flag.StringVar(&certFile, "cert", "", "`Path` to cluster certificate and key file (required to run server).")
 	flag.IntVar(&port, "port", common.DefaultPort, "Port to listen on (required if non-default).")
+	flag.IntVar(&discover, "discover", 0, "Development only: discover this many nodes (including this one) on the LAN to use as hosts if the configuration lists none (optional; disabled if 0).")
+	flag.BoolVar(&balanceVars, "balancevars", false, "Create the vars this node creates itself (for the system roots, topology changes and the embedded API) on whichever of the next few var managers has least work waiting, rather than strictly in sequence. Clients choose the ids of the vars they create, so their vars are unaffected. Vars never move between managers, so this only balances new vars.")
+	flag.BoolVar(&adaptiveBeats, "adaptiveheartbeats", false, "Adapt the heartbeat timeout and restart delay of each connection to another node to the measured round trip time and loss of that connection.")
+	flag.IntVar(&serverLinks, "serverlinks", goshawk.ServerLinks, "Number of parallel connections to each other node in the cluster. Only nodes which both ask for more than one connection use more than one.")
+	flag.StringVar(&listenersFile, "listeners", "", "`Path` to additional client listeners configuration file (optional; reloaded on SIGHUP).")
+	flag.IntVar(&httpPort, "httpport", 0, "Port to listen on for HTTPS (optional; disabled if 0).")
+	flag.BoolVar(&restGateway, "rest", false, "Enable the REST gateway on the HTTPS port (requires -httpport).")
+	flag.StringVar(&adminFingerprints, "adminfingerprints", "", "Comma separated hex fingerprints of client certificates permitted to use the admin API on the HTTPS port (optional; requires -httpport).")
+	flag.BoolVar(&browser, "browser", false, "Enable the database browser web UI at /admin/browser/ on the HTTPS port (requires -adminfingerprints).")
+	flag.StringVar(&pprofAddr, "pprofaddr", "", "Address (host:port) on which to serve the profiling endpoints over plain HTTP, without authentication (optional). With -adminfingerprints, they are also served at /admin/debug/pprof/ on the HTTPS port.")
+	flag.BoolVar(&pprofEnabled, "pprof", false, "Enable the profiling endpoints at start up. They can be enabled and disabled at runtime with the admin API's pprof operation.")
+	flag.StringVar(&quotasFile, "quotas", "", "`Path` to root quotas file; txns creating vars in roots near their quota are delayed (optional).")
+	flag.IntVar(&handshakeRate, "handshakerate", goshawk.ClientHandshakeRate, "Maximum client TLS handshakes per second; excess handshakes are delayed (0 for unlimited).")
+	flag.IntVar(&maxClients, "maxclients", 0, "Maximum concurrent client connections, including those still handshaking; excess connections are rejected (0 for unlimited).")
+	flag.IntVar(&maxHandshakes, "maxhandshakes", 0, "Maximum concurrent client handshakes in progress; excess connections are rejected (0 for unlimited).")
+	flag.IntVar(&maxClientMsg, "maxclientmessage", goshawk.ClientMessageMaxSize, "Maximum size in bytes of a message from a client; a client sending a larger message is disconnected.")
+	flag.IntVar(&maxServerMsg, "maxservermessage", goshawk.ServerMessageMaxSize, "Maximum size in bytes of a message from another node; a larger message restarts the connection. Must be at least as large as the largest var value.")
+	flag.BoolVar(&noResumption, "noresumption", false, "Disable TLS session resumption for clients.")
+	flag.IntVar(&maxReferences, "maxreferences", 0, "Reject client txns which give a var more than this many references (optional; unlimited if 0). The admin API's references operation lists the vars with the most references.")
+	flag.IntVar(&driftWarn, "driftwarn", 0, "Log a warning when a client txn aborts because its reads were at least this many versions out of date (optional; disabled if 0).")
+	flag.StringVar(&compression, "compression", "none", "Codec with which to compress var values: none or deflate. Values are left uncompressed until every node in the cluster supports compression.")
+	flag.IntVar(&compressionMinSize, "compressionminsize", goshawk.ValueCompressionMinSize, "Minimum size in bytes of var values to compress.")
+	flag.StringVar(&gcMode, "gc", "off", "Garbage collection of vars unreachable from the roots: off, dryrun or on. In dryrun mode, the vars which would be collected are reported but not collected.")
+	flag.DurationVar(&gcGrace, "gcgrace", goshawk.GCGracePeriod, "Minimum time a var must be continuously unreachable before it is collected. Must be at least "+goshawk.GCInterval.String()+": clients holding a reference to an unreachable var for longer than this must not write it back.")
+	flag.DurationVar(&metricsInterval, "metricsinterval", goshawk.MetricsPublishInterval, "Interval between samples of metrics written into the "+goshawk.MetricsRootName+" root, if the configuration has such a root (0 to disable).")
+	flag.IntVar(&metricsSamples, "metricssamples", goshawk.MetricsSamplesRetained, "Number of metrics samples retained in the "+goshawk.MetricsRootName+" root. Once this many have been published, each sample overwrites the oldest.")
+	flag.DurationVar(&statsInterval, "statsinterval", goshawk.NodeStatsInterval, "Interval between updates of this node's stats in the "+goshawk.NodeStatsRootName+" root, if the configuration has such a root (0 to disable).")
+	flag.IntVar(&warmupVars, "warmupvars", goshawk.HotVarsWarmupBudget, "Number of recently used vars to remember, and to read from disk at start up so their first use after a restart is fast (0 to disable).")
+	flag.IntVar(&immigrationBuffer, "immigrationbuffer", goshawk.ImmigrationMemoryBudget>>20, "MiB of vars received from other nodes during a topology change to hold in memory whilst they're applied; beyond that they're staged on disk (0 means unbounded).")
+	flag.IntVar(&memoryBudget, "memorybudget", 0, "Heap budget in MiB: whilst the heap in use exceeds it, roll read-only var frames early so their vars can be evicted, and trim client caches (optional; disabled if 0).")
+	flag.DurationVar(&standbyCheck, "standbycheck", goshawk.StandbyCheckInterval, "Interval between checks that the configuration's learners are keeping up (0 to disable).")
+	flag.StringVar(&metricsExport, "metricsexport", "", "`Endpoint` to push metrics to: statsd://host:port for StatsD over UDP, or an http(s) URL to POST OpenMetrics to (optional).")
+	flag.DurationVar(&metricsExportInterval, "metricsexportinterval", goshawk.MetricsExportInterval, "Interval between pushes of metrics to the -metricsexport endpoint.")
+	flag.IntVar(&clusterEvents, "clusterevents", goshawk.ClusterEventsRetained, "Number of cluster events retained in the "+goshawk.ClusterEventsRootName+" root, if the configuration has such a root (0 to disable).")
+	flag.DurationVar(&readerWarn, "readerwarn", goshawk.DBReaderWarnThreshold, "Warn about readonly disk txns held open for longer than this.")
+	flag.DurationVar(&diskSlow, "diskslow", goshawk.DiskSlowThreshold, "Consider the disk degraded when the 99th percentile latency of disk writes exceeds this.")
+	flag.DurationVar(&diskSlowFor, "diskslowfor", goshawk.DiskSlowPeriod, "Only consider the disk degraded, or recovered, once its write latency has been over, or within, -diskslow for this long.")
+	flag.BoolVar(&diskShed, "diskshed", false, "Whilst the disk is degraded, ask every node to avoid this node as an acceptor for new txns where they can. Takes effect once every node in the cluster supports it.")
+	flag.BoolVar(&fastAcceptors, "latencyacceptors", false, "Choose the acceptors of txns submitted to this node as the connected nodes with the lowest round trip times, rather than those holding the txn's vars. Takes effect once every node in the cluster supports it.")
+	flag.StringVar(&queueLimits, "queuelimits", "", "Comma separated name=capacity:policy bounds on the queues of the executors of each dispatcher (VarDispatcher, ProposerDispatcher or AcceptorDispatcher), where policy is block, drop-oldest-idempotent or reject (default block). Only optional work, such as inspection requests and housekeeping, is ever held back: protocol work is always queued, so this does not bound the memory used by the queues (optional; unbounded if omitted). Whether or not they are bounded, executors time every piece of work queued and record its wait in a histogram, which adds two clock reads and a few metric updates to each.")
+	flag.DurationVar(&journalPeriod, "journal", 0, "Retain a journal of committed txns for this long, queryable through the admin API (optional; disabled if 0).")
+	flag.DurationVar(&readerDeadline, "readerdeadline", goshawk.DBReaderDeadline, "Expire readonly disk txns held open for longer than this, where they can be safely abandoned (0 to disable).")
+	flag.BoolVar(&auditIds, "auditids", false, "Audit TxnIds and VarUUIds chosen by clients, disconnecting clients which reuse ids.")
+	flag.StringVar(&captureFile, "capture", "", "`Path` to file to capture consensus messages into, for use with paxosreplay (optional).")
+	flag.StringVar(&captureTxns, "capturetxns", "", "Comma separated hex TxnIds to capture (optional; all txns captured if empty; requires -capture).")
+	flag.StringVar(&sessionLogFile, "sessionlog", "", "`Path` to file to record client connects, authentications and disconnects into, for reading with goshawkdb sessions (optional). The file is a ring of fixed size, and is added to across restarts.")
+	flag.StringVar(&frameLogFile, "framelog", "", "`Path` to file to record var frame events into, for replay by txnengine.FrameReplayer (optional; development only: the file grows without limit).")
 	flag.BoolVar(&version, "version", false, "Display version and exit.")
 	flag.BoolVar(&genClusterCert, "gen-cluster-cert", false, "Generate new cluster certificate key pair.")
 	flag.BoolVar(&genClientCert, "gen-client-cert", false, "Generate client certificate key pair.")
+	flag.IntVar(&clientCerts, "clientcerts", 1, "Number of client certificate key pairs to generate with -gen-client-cert.")
+	flag.StringVar(&clientCertFile, "clientcertfile", "", "`Pattern` of the file name to write each client certificate key pair generated with -gen-client-cert to, with %d replaced by its number (optional; written to stdout if empty, which requires -clientcerts=1).")
+	flag.StringVar(&clientCertRoots, "clientcertroots", "", "Comma separated roots to grant read and write to in the fingerprints configuration written by -gen-client-cert (optional).")
+	flag.StringVar(&fingerprintsFile, "fingerprintsfile", "", "`Path` to write the ClientCertificateFingerprints configuration of the client certificates generated with -gen-client-cert to (optional; written to stdout if certificates are written to files).")
 	flag.Parse()
 
 	if version {
@@ -80,14 +171,17 @@ func newServer() (*server, error) {
 	}
 
 	if genClientCert {
-		certificatePrivateKeyPair, err := certs.NewClientCertificate(certificate)
-		if err != nil {
-			return nil, err
+		req := &clientCertsRequest{
+			count:            clientCerts,
+			filePattern:      clientCertFile,
+			fingerprintsFile: fingerprintsFile,
 		}
-		fmt.Printf("%v%v", certificatePrivateKeyPair.CertificatePEM, certificatePrivateKeyPair.PrivateKeyPEM)
-		fingerprint := sha256.Sum256(certificatePrivateKeyPair.Certificate)
-		log.Printf("Fingerprint: %v\n", hex.EncodeToString(fingerprint[:]))
-		return nil, nil
+		for _, root := range strings.Split(clientCertRoots, ",") {
+			if root = strings.TrimSpace(root); root != "" {
+				req.roots = append(req.roots, root)
+			}
+		}
+		return nil, req.generate(certificate)
 	}
 
 	if dataDir == "" {
@@ -97,10 +191,15 @@ func newServer() (*server, error) {
 		}
 		log.Printf("No data dir supplied (missing -dir parameter). Using %v for data.\n", dataDir)
 	}
+	dataDir, err = followRelocations(dataDir)
+	if err != nil {
+		return nil, err
+	}
 	err = os.MkdirAll(dataDir, 0750)
 	if err != nil {
 		return nil, err
 	}
+	goshawk.CrashReportDir = dataDir
 
 	if configFile != "" {
 		_, err := ioutil.ReadFile(configFile)
@@ -108,18 +207,252 @@ func newServer() (*server, error) {
 			return nil, err
 		}
 	}
+	format, err := configuration.ParseFormat(configFormat)
+	if err != nil {
+		return nil, err
+	}
 
 	if !(0 < port && port < 65536) {
 		return nil, fmt.Errorf("Supplied port is illegal (%v). Port must be > 0 and < 65536", port)
 	}
 
+	if !(0 <= httpPort && httpPort < 65536) || httpPort == port {
+		return nil, fmt.Errorf("Supplied HTTP port is illegal (%v). HTTP port must be >= 0, < 65536 and not equal to port", httpPort)
+	}
+	if restGateway && httpPort == 0 {
+		return nil, fmt.Errorf("REST gateway requested but no HTTP port supplied (missing -httpport parameter).")
+	}
+
+	var admins [][sha256.Size]byte
+	if adminFingerprints != "" {
+		if httpPort == 0 {
+			return nil, fmt.Errorf("Admin fingerprints supplied but no HTTP port supplied (missing -httpport parameter).")
+		}
+		for _, fingerprint := range strings.Split(adminFingerprints, ",") {
+			fingerprintBytes, err := hex.DecodeString(strings.TrimSpace(fingerprint))
+			if err != nil {
+				return nil, err
+			} else if l := len(fingerprintBytes); l != sha256.Size {
+				return nil, fmt.Errorf("Invalid fingerprint: expected %v bytes, and found %v", sha256.Size, l)
+			}
+			ary := [sha256.Size]byte{}
+			copy(ary[:], fingerprintBytes)
+			admins = append(admins, ary)
+		}
+	}
+
+	if browser && len(admins) == 0 {
+		return nil, fmt.Errorf("Browser requested but no admin fingerprints supplied (missing -adminfingerprints parameter).")
+	}
+
+	if pprofEnabled && pprofAddr == "" && len(admins) == 0 {
+		return nil, fmt.Errorf("Profiling requested but nowhere to serve it (missing -pprofaddr or -adminfingerprints parameter).")
+	}
+
+	if !(0 < serverLinks && serverLinks < 256) {
+		return nil, fmt.Errorf("Supplied number of server links is illegal (%v). Must be > 0 and < 256", serverLinks)
+	}
+
+	if handshakeRate < 0 {
+		return nil, fmt.Errorf("Supplied handshake rate is illegal (%v). Must be >= 0", handshakeRate)
+	}
+
+	if maxClients < 0 {
+		return nil, fmt.Errorf("Supplied maximum client connections is illegal (%v). Must be >= 0", maxClients)
+	}
+
+	if maxHandshakes < 0 {
+		return nil, fmt.Errorf("Supplied maximum client handshakes is illegal (%v). Must be >= 0", maxHandshakes)
+	}
+
+	if maxReferences < 0 {
+		return nil, fmt.Errorf("Supplied maximum references is illegal (%v). Must be >= 0", maxReferences)
+	}
+
+	if driftWarn < 0 {
+		return nil, fmt.Errorf("Supplied drift warning threshold is illegal (%v). Must be >= 0", driftWarn)
+	}
+
+	valueCodec, err := eng.ParseValueCodec(compression)
+	if err != nil {
+		return nil, err
+	} else if compressionMinSize < 0 {
+		return nil, fmt.Errorf("Supplied compression minimum size is illegal (%v). Must be >= 0", compressionMinSize)
+	}
+	eng.SetValueCompression(eng.ValueCompression{Codec: valueCodec, MinSize: compressionMinSize})
+
+	queueLimitsParsed, err := dispatcher.ParseQueueLimits(queueLimits)
+	if err != nil {
+		return nil, err
+	}
+	dispatcher.SetQueueLimits(queueLimitsParsed)
+
+	gcModeParsed, err := network.ParseGCMode(gcMode)
+	if err != nil {
+		return nil, err
+	} else if gcGrace < goshawk.GCInterval {
+		return nil, fmt.Errorf("Supplied garbage collection grace period is illegal (%v). Must be >= %v", gcGrace, goshawk.GCInterval)
+	}
+
+	if metricsInterval < 0 {
+		return nil, fmt.Errorf("Supplied metrics interval is illegal (%v). Must be >= 0", metricsInterval)
+	} else if metricsSamples < 1 {
+		return nil, fmt.Errorf("Supplied metrics samples is illegal (%v). Must be > 0", metricsSamples)
+	}
+
+	if statsInterval < 0 {
+		return nil, fmt.Errorf("Supplied stats interval is illegal (%v). Must be >= 0", statsInterval)
+	}
+
+	if standbyCheck < 0 {
+		return nil, fmt.Errorf("Supplied standby check interval is illegal (%v). Must be >= 0", standbyCheck)
+	}
+
+	if warmupVars < 0 {
+		return nil, fmt.Errorf("Supplied warm up vars is illegal (%v). Must be >= 0", warmupVars)
+	}
+
+	if immigrationBuffer < 0 {
+		return nil, fmt.Errorf("Supplied immigration buffer is illegal (%v). Must be >= 0", immigrationBuffer)
+	}
+
+	if memoryBudget < 0 {
+		return nil, fmt.Errorf("Supplied memory budget is illegal (%v). Must be >= 0", memoryBudget)
+	}
+
+	if clusterEvents < 0 {
+		return nil, fmt.Errorf("Supplied cluster events count is illegal (%v). Must be >= 0", clusterEvents)
+	}
+
+	var metricsExportEndpoint *url.URL
+	if metricsExport != "" {
+		if metricsExportEndpoint, err = network.ParseMetricsExportEndpoint(metricsExport); err != nil {
+			return nil, err
+		} else if metricsExportInterval <= 0 {
+			return nil, fmt.Errorf("Supplied metrics export interval is illegal (%v). Must be > 0", metricsExportInterval)
+		}
+	}
+
+	if readerWarn <= 0 {
+		return nil, fmt.Errorf("Supplied reader warning threshold is illegal (%v). Must be > 0", readerWarn)
+	} else if readerDeadline < 0 {
+		return nil, fmt.Errorf("Supplied reader deadline is illegal (%v). Must be >= 0", readerDeadline)
+	}
+
+	if diskSlow <= 0 {
+		return nil, fmt.Errorf("Supplied disk slow threshold is illegal (%v). Must be > 0", diskSlow)
+	} else if diskSlowFor <= 0 {
+		return nil, fmt.Errorf("Supplied disk slow period is illegal (%v). Must be > 0", diskSlowFor)
+	}
+
+	if journalPeriod < 0 {
+		return nil, fmt.Errorf("Supplied journal retention period is illegal (%v). Must be >= 0", journalPeriod)
+	}
+
+	if discover < 0 {
+		return nil, fmt.Errorf("Supplied discover count is illegal (%v). Must be >= 0", discover)
+	} else if discover > 0 && configFile == "" {
+		return nil, fmt.Errorf("Discovery requested but no configuration file supplied (missing -config parameter).")
+	}
+
+	var configVerifier *configuration.BundleVerifier
+	if signedConfig {
+		if discover > 0 {
+			return nil, fmt.Errorf("Discovery cannot be used with a signed configuration: the discovered hosts would not be signed.")
+		}
+		configVerifier, err = configuration.NewBundleVerifier(certificate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var captureTxnIds []*common.TxnId
+	if captureTxns != "" {
+		if captureFile == "" {
+			return nil, fmt.Errorf("TxnIds to capture supplied but no capture file (missing -capture parameter).")
+		}
+		captureTxnIds, err = paxos.ParseTxnIds(captureTxns)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var quotas map[string]*configuration.RootQuota
+	if quotasFile != "" {
+		quotas, err = configuration.LoadRootQuotasFromPath(quotasFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var listeners []*configuration.ListenerConfiguration
+	if maxClientMsg <= 0 || maxServerMsg <= 0 {
+		return nil, fmt.Errorf("Supplied maximum message sizes are illegal (%v, %v). Must be > 0", maxClientMsg, maxServerMsg)
+	}
+
+	if listenersFile != "" {
+		listeners, err = loadListeners(listenersFile, uint16(port), uint16(httpPort))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	s := &server{
-		configFile:   configFile,
-		certificate:  certificate,
-		dataDir:      dataDir,
-		port:         uint16(port),
-		onShutdown:   []func(){},
-		shutdownChan: make(chan goshawk.EmptyStruct),
+		configFile:      configFile,
+		configFormat:    format,
+		configComment:   configComment,
+		configVerifier:  configVerifier,
+		certificate:     certificate,
+		dataDir:         dataDir,
+		port:            uint16(port),
+		httpPort:        uint16(httpPort),
+		restGateway:     restGateway,
+		browser:         browser,
+		auditIds:        auditIds,
+		resumption:      !noResumption,
+		serverLinks:     uint8(serverLinks),
+		adaptiveBeats:   adaptiveBeats,
+		balanceVars:     balanceVars,
+		handshakeRate:   handshakeRate,
+		driftWarn:       uint64(driftWarn),
+		maxReferences:   maxReferences,
+		maxClients:      maxClients,
+		maxHandshakes:   maxHandshakes,
+		maxClientMsg:    maxClientMsg,
+		maxServerMsg:    maxServerMsg,
+		listenersFile:   listenersFile,
+		listeners:       listeners,
+		discover:        discover,
+		captureFile:     captureFile,
+		frameLogFile:    frameLogFile,
+		sessionLogFile:  sessionLogFile,
+		captureTxns:     captureTxnIds,
+		admins:          admins,
+		pprofAddr:       pprofAddr,
+		profiling:       network.NewProfiling(pprofEnabled),
+		quotas:          quotas,
+		gcMode:          gcModeParsed,
+		gcGrace:         gcGrace,
+		metricsInterval: metricsInterval,
+		metricsSamples:  metricsSamples,
+		statsInterval:   statsInterval,
+		standbyCheck:    standbyCheck,
+		memoryBudget:    uint64(memoryBudget) << 20,
+		immigrationBuf:  immigrationBuffer << 20,
+		warmupVars:      warmupVars,
+		clusterEvents:   clusterEvents,
+		metricsExport:   metricsExportEndpoint,
+		exportInterval:  metricsExportInterval,
+		readerWarn:      readerWarn,
+		readerDeadline:  readerDeadline,
+		diskSlow:        diskSlow,
+		diskSlowFor:     diskSlowFor,
+		diskShed:        diskShed,
+		fastAcceptors:   fastAcceptors,
+		journalPeriod:   journalPeriod,
+		relocation:      &relocation{},
+		onShutdown:      []func(){},
+		shutdownChan:    make(chan goshawk.EmptyStruct),
 	}
 
 	if err = s.ensureRMId(); err != nil {
@@ -134,13 +467,81 @@ func newServer() (*server, error) {
 
 type server struct {
 	configFile        string
+	configFormat      configuration.Format
+	configComment     string
+	configVerifier    *configuration.BundleVerifier
 	certificate       []byte
 	dataDir           string
 	port              uint16
+	httpPort          uint16
+	restGateway       bool
+	browser           bool
+	auditIds          bool
+	resumption        bool
+	serverLinks       uint8
+	adaptiveBeats     bool
+	balanceVars       bool
+	handshakeRate     int
+	driftWarn         uint64
+	maxReferences     int
+	maxClients        int
+	maxHandshakes     int
+	maxClientMsg      int
+	maxServerMsg      int
+	listenersFile     string
+	listeners         []*configuration.ListenerConfiguration
+	clientListeners   *network.ClientListeners
+	discover          int
+	discoveredHosts   []string
+	captureFile       string
+	captureTxns       []*common.TxnId
+	capture           *paxos.Capture
+	frameLogFile      string
+	frameRecorder     *eng.FrameRecorder
+	sessionLogFile    string
+	sessionLog        *network.SessionLog
+	admins            [][sha256.Size]byte
+	pprofAddr         string
+	profiling         *network.Profiling
+	quotas            map[string]*configuration.RootQuota
+	gcMode            network.GCMode
+	gcGrace           time.Duration
+	metricsInterval   time.Duration
+	metricsSamples    int
+	statsInterval     time.Duration
+	standbyCheck      time.Duration
+	memoryBudget      uint64
+	immigrationBuf    int
+	warmupVars        int
+	clusterEvents     int
+	metricsExport     *url.URL
+	exportInterval    time.Duration
+	readerWarn        time.Duration
+	readerDeadline    time.Duration
+	diskSlow          time.Duration
+	diskSlowFor       time.Duration
+	diskShed          bool
+	fastAcceptors     bool
+	journalPeriod     time.Duration
+	relocation        *relocation
 	rmId              common.RMId
 	bootCount         uint32
 	connectionManager *network.ConnectionManager
 	transmogrifier    *network.TopologyTransmogrifier
+	storageAccountant *network.StorageAccountant
+	garbageCollector  *network.GarbageCollector
+	metricsPublisher  *network.MetricsPublisher
+	eventsPublisher   *network.ClusterEventsPublisher
+	statsPublisher    *network.NodeStatsPublisher
+	topologyRequests  *network.TopologyRequestWatcher
+	standbyMonitor    *network.StandbyMonitor
+	memoryMonitor     *network.MemoryPressureMonitor
+	hotVarsWarmer     *network.HotVarsWarmer
+	decommissioner    *network.Decommissioner
+	metricsExporter   *network.MetricsExporter
+	txnJournal        *network.TxnJournal
+	readerMonitor     *db.ReaderMonitor
+	diskMonitor       *db.DiskMonitor
 	profileFile       *os.File
 	traceFile         *os.File
 	onShutdown        []func()
@@ -170,13 +571,133 @@ func (s *server) start() {
 	disk, err := mdbs.NewMDBServer(s.dataDir, 0, 0600, goshawk.MDBInitialSize, procs/2, time.Millisecond, db.DB)
 	s.maybeShutdown(err)
 	db := disk.(*db.Databases)
+	s.addOnShutdown(func() {
+		if s.decommissioner != nil {
+			s.decommissioner.WipeIfRemoved(s.dataDir)
+		}
+	})
 	s.addOnShutdown(db.Shutdown)
+	readerMonitor := db.MonitorReaders(s.readerWarn, s.readerDeadline)
+	s.addOnShutdown(readerMonitor.Shutdown)
+	s.readerMonitor = readerMonitor
+	s.addOnShutdown(func() { s.relocation.complete(db, s.dataDir) })
+
+	if s.captureFile != "" {
+		capture, err := paxos.NewCapture(s.captureFile, goshawk.PaxosCaptureFileSize, s.captureTxns)
+		s.maybeShutdown(err)
+		s.addOnShutdown(capture.Close)
+		s.capture = capture
+	}
+
+	if s.frameLogFile != "" {
+		frameRecorder, err := eng.NewFrameRecorder(s.frameLogFile, s.rmId)
+		s.maybeShutdown(err)
+		s.addOnShutdown(frameRecorder.Close)
+		s.frameRecorder = frameRecorder
+	}
+
+	if s.sessionLogFile != "" {
+		sessionLog, err := network.NewSessionLog(s.sessionLogFile, goshawk.SessionLogFileSize)
+		s.maybeShutdown(err)
+		s.addOnShutdown(sessionLog.Close)
+		s.sessionLog = sessionLog
+	}
 
-	cm, transmogrifier := network.NewConnectionManager(s.rmId, s.bootCount, procs, db, nodeCertPrivKeyPair, s.port, s, commandLineConfig)
+	txnJournal := network.NewTxnJournal(db, s.journalPeriod)
+	s.addOnShutdown(txnJournal.Shutdown)
+	s.txnJournal = txnJournal
+
+	cm, transmogrifier := network.NewConnectionManager(s.rmId, s.bootCount, procs, db, nodeCertPrivKeyPair, s.port, s, commandLineConfig, s.configComment, s.capture, s.serverLinks, txnJournal, goshawk.RealClock)
 	s.addOnShutdown(func() { cm.Shutdown(paxos.Sync) })
 	s.addOnShutdown(transmogrifier.Shutdown)
 	s.connectionManager = cm
 	s.transmogrifier = transmogrifier
+	transmogrifier.SetImmigrationMemoryBudget(s.immigrationBuf)
+	transmogrifier.SetDataDir(s.dataDir)
+	if s.auditIds {
+		cm.IdAuditorFactory = client.NewNamespaceIdAuditor
+	}
+	cm.ClientHandshakes = network.NewClientHandshakes(s.resumption, s.handshakeRate)
+	cm.ClientReconnects = network.NewClientReconnects()
+	cm.ClientDriftWarn = s.driftWarn
+	cm.MaxReferences = s.maxReferences
+	cm.ConfigVerifier = s.configVerifier
+	cm.AdaptiveHeartbeats = s.adaptiveBeats
+	cm.MaxClientMessageSize = s.maxClientMsg
+	cm.MaxServerMessageSize = s.maxServerMsg
+	cm.PeerLatencies().SetChooseAcceptors(s.fastAcceptors)
+	if s.balanceVars {
+		cm.LocalConnection().SetVarBalancer(cm.Dispatchers.VarDispatcher)
+	}
+	cm.Dispatchers.VarDispatcher.SetFrameRecorder(s.frameRecorder)
+	cm.ConnectionLimits = network.NewConnectionLimits(s.maxClients, s.maxHandshakes)
+	cm.SessionLog = s.sessionLog
+
+	diskMonitor := db.MonitorDisk(s.diskSlow, s.diskSlowFor, func(degraded bool) {
+		if s.diskShed {
+			cm.SetDegraded(degraded)
+		}
+	})
+	s.addOnShutdown(diskMonitor.Shutdown)
+	s.diskMonitor = diskMonitor
+
+	storageAccountant := network.NewStorageAccountant(db, cm)
+	s.addOnShutdown(storageAccountant.Shutdown)
+	s.storageAccountant = storageAccountant
+	if len(s.quotas) != 0 {
+		cm.CreationThrottle = network.NewCreationThrottle(s.quotas, storageAccountant)
+	}
+
+	garbageCollector := network.NewGarbageCollector(db, cm, s.gcMode, s.gcGrace)
+	s.addOnShutdown(garbageCollector.Shutdown)
+	s.garbageCollector = garbageCollector
+
+	metricsPublisher := network.NewMetricsPublisher(cm, s.metricsInterval, s.metricsSamples)
+	s.addOnShutdown(metricsPublisher.Shutdown)
+	s.metricsPublisher = metricsPublisher
+
+	eventsPublisher := network.NewClusterEventsPublisher(cm, s.clusterEvents)
+	s.addOnShutdown(eventsPublisher.Shutdown)
+	s.eventsPublisher = eventsPublisher
+
+	statsPublisher := network.NewNodeStatsPublisher(cm, s.statsInterval, s.dataDir)
+	s.addOnShutdown(statsPublisher.Shutdown)
+	s.statsPublisher = statsPublisher
+
+	topologyRequests := network.NewTopologyRequestWatcher(cm, s.transmogrifier)
+	s.addOnShutdown(topologyRequests.Shutdown)
+	s.topologyRequests = topologyRequests
+
+	standbyMonitor := network.NewStandbyMonitor(cm, s.standbyCheck)
+	s.addOnShutdown(standbyMonitor.Shutdown)
+	s.standbyMonitor = standbyMonitor
+
+	memoryMonitor := network.NewMemoryPressureMonitor(cm, s.memoryBudget)
+	s.addOnShutdown(memoryMonitor.Shutdown)
+	s.memoryMonitor = memoryMonitor
+
+	hotVarsWarmer := network.NewHotVarsWarmer(cm, db, s.dataDir, s.warmupVars)
+	s.addOnShutdown(hotVarsWarmer.Shutdown)
+	s.hotVarsWarmer = hotVarsWarmer
+
+	decommissioner, err := network.NewDecommissioner(cm, s.transmogrifier, s.dataDir)
+	s.maybeShutdown(err)
+	s.addOnShutdown(decommissioner.Shutdown)
+	s.decommissioner = decommissioner
+	if decommissioner.Removed() {
+		s.maybeShutdown(fmt.Errorf("This node has been decommissioned. Remove %v to reuse this node.", s.dataDir))
+	}
+	cm.Decommissioner = decommissioner
+
+	if s.metricsExport != nil {
+		metricsExporter := network.NewMetricsExporter(s.metricsExport, s.exportInterval, s.rmId)
+		s.addOnShutdown(metricsExporter.Shutdown)
+		s.metricsExporter = metricsExporter
+	}
+
+	clientListeners := network.NewClientListeners(cm)
+	s.addOnShutdown(clientListeners.Shutdown)
+	s.clientListeners = clientListeners
 
 	go s.signalHandler()
 
@@ -184,6 +705,45 @@ func (s *server) start() {
 	s.maybeShutdown(err)
 	s.addOnShutdown(listener.Shutdown)
 
+	s.maybeShutdown(clientListeners.Reconfigure(s.listeners))
+
+	if s.pprofAddr != "" {
+		s.maybeShutdown(s.profiling.Listen(s.pprofAddr))
+		s.addOnShutdown(s.profiling.Shutdown)
+	}
+
+	if s.httpPort != 0 {
+		httpListener, err := network.NewHTTPListener(s.httpPort, cm)
+		s.maybeShutdown(err)
+		s.addOnShutdown(httpListener.Shutdown)
+		if s.restGateway {
+			gateway, err := network.NewRESTGateway(cm, httpListener, db)
+			s.maybeShutdown(err)
+			s.addOnShutdown(gateway.Shutdown)
+		}
+		if len(s.admins) != 0 {
+			adminAPI := network.NewAdminAPI(httpListener, s.admins)
+			adminAPI.HandleFunc("relocate", s.handleRelocate)
+			adminAPI.HandleFunc("connections", cm.ServeClientConnectionStats)
+			adminAPI.HandleFunc("gc", garbageCollector.ServeReport)
+			adminAPI.HandleFunc("references", storageAccountant.ServeWidestVars)
+			adminAPI.HandleFunc("contention", cm.ServeContention)
+			adminAPI.HandleFunc("journal", txnJournal.ServeQuery)
+			adminAPI.HandleFunc("confighistory", transmogrifier.ServeConfigHistory)
+			adminAPI.HandleFunc("txn", cm.ServeTxn)
+			adminAPI.HandleFunc("subscribers", cm.ServeSubscribers)
+			adminAPI.HandleFunc("audit", cm.Auditor().ServeAudit)
+			adminAPI.HandleFunc("decommission", decommissioner.ServeDecommission)
+			adminAPI.HandleFunc("recycle", cm.ServeRecyclePeer)
+			s.profiling.AddToAdminAPI(adminAPI)
+			network.AddChaosToAdminAPI(adminAPI)
+			if s.browser {
+				browser := network.NewBrowser(cm, adminAPI)
+				s.addOnShutdown(browser.Shutdown)
+			}
+		}
+	}
+
 	defer s.shutdown(nil)
 	<-s.shutdownChan
 }
@@ -212,7 +772,7 @@ func (s *server) maybeShutdown(err error) {
 }
 
 func (s *server) ensureRMId() error {
-	path := s.dataDir + "/rmid"
+	path := filepath.Join(s.dataDir, db.RMIdFileName)
 	if b, err := ioutil.ReadFile(path); err == nil {
 		s.rmId = common.RMId(binary.BigEndian.Uint32(b))
 		return nil
@@ -229,7 +789,7 @@ func (s *server) ensureRMId() error {
 }
 
 func (s *server) ensureBootCount() error {
-	path := s.dataDir + "/bootcount"
+	path := filepath.Join(s.dataDir, db.BootCountFileName)
 	if b, err := ioutil.ReadFile(path); err == nil {
 		s.bootCount = binary.BigEndian.Uint32(b) + 1
 	} else {
@@ -242,11 +802,29 @@ func (s *server) ensureBootCount() error {
 
 func (s *server) commandLineConfig() (*configuration.Configuration, error) {
 	if s.configFile != "" {
-		return configuration.LoadConfigurationFromPath(s.configFile)
+		return s.loadConfig()
 	}
 	return nil, nil
 }
 
+func (s *server) loadConfig() (*configuration.Configuration, error) {
+	if s.configVerifier != nil {
+		return s.configVerifier.LoadConfigurationFromPath(s.configFile)
+	} else if s.discover == 0 {
+		return configuration.LoadConfigurationFromPath(s.configFile, s.configFormat)
+	}
+	return configuration.LoadConfigurationWithDiscoveredHosts(s.configFile, s.configFormat, func(clusterId string) ([]string, error) {
+		if s.discoveredHosts == nil {
+			hosts, err := network.Discover(clusterId, s.port, s.discover)
+			if err != nil {
+				return nil, err
+			}
+			s.discoveredHosts = hosts
+		}
+		return s.discoveredHosts, nil
+	})
+}
+
 func (s *server) SignalShutdown() {
 	// this may fail if stdout has died
 	log.Println("Shutting down.")
@@ -260,23 +838,91 @@ func (s *server) signalStatus() {
 	go sc.Consume(func(str string) {
 		log.Printf("System Status for %v\n%v\nStatus End\n", s.rmId, str)
 	})
-	sc.Emit(fmt.Sprintf("Configuration File: %v", s.configFile))
-	sc.Emit(fmt.Sprintf("Data Directory: %v", s.dataDir))
+	sc.Emit(fmt.Sprintf("Configuration File: %v (signed? %v)", s.configFile, s.configVerifier != nil))
+	sc.Emit(fmt.Sprintf("Data Directory: %v (%v)", s.dataDir, s.relocation))
 	sc.Emit(fmt.Sprintf("Port: %v", s.port))
+	if s.discover != 0 {
+		sc.Emit(fmt.Sprintf("Discovered hosts: %v", s.discoveredHosts))
+	}
+	sc.Emit(fmt.Sprintf("HTTP Port: %v (REST gateway: %v; browser: %v)", s.httpPort, s.restGateway, s.browser))
+	sc.Emit(fmt.Sprintf("Client id auditing: %v", s.auditIds))
+	sc.Emit(fmt.Sprintf("Client drift warning threshold: %v", s.driftWarn))
+	sc.Emit(fmt.Sprintf("Maximum references per var: %v", s.maxReferences))
+	sc.Emit(fmt.Sprintf("Adaptive heartbeats: %v", s.adaptiveBeats))
+	sc.Emit(fmt.Sprintf("Balanced creation of this node's own vars: %v", s.balanceVars))
+	sc.Emit(fmt.Sprintf("Value compression: %v", eng.CurrentValueCompression()))
+	sps := goshawk.GetSegmentPoolStats()
+	sc.Emit(fmt.Sprintf("Segment pool: %v gets; %v misses; %v releases; %v discards", sps.Gets, sps.Misses, sps.Releases, sps.Discards))
+	for _, rq := range s.quotas {
+		sc.Emit(fmt.Sprintf("Root quota: %v: %v vars (throttling from %v; max delay %vms)", rq.Root, rq.MaxVars, rq.SoftThreshold, rq.MaxDelayMS))
+	}
+	s.clientListeners.Status(sc.Fork())
+	s.connectionManager.ClientHandshakes.Status(sc.Fork())
+	s.connectionManager.ClientReconnects.Status(sc.Fork())
+	s.profiling.Status(sc.Fork())
+	s.connectionManager.ConnectionLimits.Status(sc.Fork())
+	s.storageAccountant.Status(sc.Fork())
+	s.garbageCollector.Status(sc.Fork())
+	s.metricsPublisher.Status(sc.Fork())
+	s.eventsPublisher.Status(sc.Fork())
+	s.statsPublisher.Status(sc.Fork())
+	s.topologyRequests.Status(sc.Fork())
+	s.standbyMonitor.Status(sc.Fork())
+	s.memoryMonitor.Status(sc.Fork())
+	s.hotVarsWarmer.Status(sc.Fork())
+	s.decommissioner.Status(sc.Fork())
+	s.metricsExporter.Status(sc.Fork())
+	s.txnJournal.Status(sc.Fork())
+	s.readerMonitor.Status(sc.Fork())
+	s.diskMonitor.Status(sc.Fork())
+	s.capture.Status(sc.Fork())
+	s.frameRecorder.Status(sc.Fork())
+	s.sessionLog.Status(sc.Fork())
+	s.transmogrifier.Status(sc.Fork())
 	s.connectionManager.Status(sc)
 }
 
 func (s *server) signalReloadConfig() {
+	s.reloadListeners()
 	if s.configFile == "" {
 		log.Println("Attempt to reload config failed as no path to configuration provided on command line.")
 		return
 	}
-	config, err := configuration.LoadConfigurationFromPath(s.configFile)
+	config, err := s.loadConfig()
 	if err != nil {
 		log.Println("Cannot reload config due to error:", err)
 		return
 	}
-	s.transmogrifier.RequestConfigurationChange(config)
+	s.transmogrifier.RequestConfigurationChange(config, network.ConfigSourceSIGHUP, "")
+}
+
+// reloadListeners reloads the additional client listeners
+// configuration, and starts and stops listeners to match it.
+func (s *server) reloadListeners() {
+	if s.listenersFile == "" {
+		return
+	}
+	listeners, err := loadListeners(s.listenersFile, s.port, s.httpPort)
+	if err != nil {
+		log.Println("Cannot reload listeners due to error:", err)
+		return
+	}
+	if err = s.clientListeners.Reconfigure(listeners); err != nil {
+		log.Println(err)
+	}
+}
+
+func loadListeners(path string, port, httpPort uint16) ([]*configuration.ListenerConfiguration, error) {
+	listeners, err := configuration.LoadListenerConfigurationsFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, lc := range listeners {
+		if lc.Port == port || lc.Port == httpPort {
+			return nil, fmt.Errorf("Additional listener port %v clashes with port or HTTP port", lc.Port)
+		}
+	}
+	return listeners, nil
 }
 
 func (s *server) signalDumpStacks() {
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"goshawkdb.io/server/db"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The data directory can be moved to a new location: an admin
+// requests the relocation, and then when the node is next shut down
+// (by which point nothing is writing to the database any more) the
+// database and the node's state files (see db.CopyNodeStateTo) are
+// copied to the new location and a marker is left in the
+// old directory. When the node is restarted with the old -dir, it
+// follows the marker (and any symlinks) to the new location. Thus the
+// node is only down for as long as a normal restart plus the copy.
+//
+// Relocation is deliberately not live. The db.Databases is shared by
+// every var manager, proposer and acceptor, each of which may have db
+// txns in flight, and the mdbs server can not switch environments
+// beneath them. Quiescing all of them would stall the node for the
+// whole copy anyway, so the copy is done across a restart, and the
+// admin must arrange that restart.
+type relocation struct {
+	sync.Mutex
+	to       string
+	copied   int64
+	total    int64
+	finished bool
+}
+
+const maxRelocationHops = 16
+
+// followRelocations resolves symlinks and relocation markers to find
+// the data directory actually in use.
+func followRelocations(dataDir string) (string, error) {
+	for hop := 0; hop < maxRelocationHops; hop++ {
+		if resolved, err := filepath.EvalSymlinks(dataDir); err == nil {
+			dataDir = resolved
+		} else if os.IsNotExist(err) {
+			return dataDir, nil
+		} else {
+			return "", err
+		}
+		to, err := ioutil.ReadFile(filepath.Join(dataDir, db.RelocatedFileName))
+		if os.IsNotExist(err) {
+			return dataDir, nil
+		} else if err != nil {
+			return "", err
+		}
+		log.Printf("Data directory %v has been relocated to %v.\n", dataDir, string(to))
+		dataDir = string(to)
+	}
+	return "", fmt.Errorf("Too many relocations of data directory (loop?): %v", dataDir)
+}
+
+func (s *server) handleRelocate(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		fmt.Fprintln(w, s.relocation.String())
+	case "POST":
+		if err := s.relocation.request(s.dataDir, strings.TrimSpace(req.FormValue("dir"))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, s.relocation.String())
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *relocation) request(dataDir, to string) error {
+	if to == "" {
+		return fmt.Errorf("No dir supplied")
+	} else if !filepath.IsAbs(to) {
+		return fmt.Errorf("Dir must be an absolute path: %v", to)
+	}
+	to = filepath.Clean(to)
+	if to == filepath.Clean(dataDir) {
+		return fmt.Errorf("Dir is the current data directory: %v", to)
+	}
+	if err := os.MkdirAll(to, 0750); err != nil {
+		return err
+	}
+	if entries, err := ioutil.ReadDir(to); err != nil {
+		return err
+	} else if len(entries) != 0 {
+		return fmt.Errorf("Dir is not empty: %v", to)
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.finished {
+		return fmt.Errorf("Relocation already completed")
+	}
+	r.to = to
+	log.Printf("Relocation of data directory to %v requested. It will be carried out when this node next shuts down; restart the node to complete it.\n", to)
+	return nil
+}
+
+func (r *relocation) String() string {
+	r.Lock()
+	defer r.Unlock()
+	switch {
+	case r.to == "":
+		return "No relocation requested."
+	case r.finished:
+		return fmt.Sprintf("Relocated to %v.", r.to)
+	case r.total != 0:
+		return fmt.Sprintf("Relocating to %v: copied %v of %v bytes.", r.to, r.copied, r.total)
+	default:
+		return fmt.Sprintf("Relocation to %v will happen when this node next shuts down: restart the node to complete it.", r.to)
+	}
+}
+
+// complete performs the relocation, if one has been requested. It
+// must only be called once nothing else is using the database.
+func (r *relocation) complete(disk *db.Databases, dataDir string) {
+	r.Lock()
+	to := r.to
+	r.Unlock()
+	if to == "" {
+		return
+	}
+	log.Printf("Relocating data directory from %v to %v.\n", dataDir, to)
+	err := disk.CopyTo(dataDir, to, func(copied, total int64) {
+		r.Lock()
+		r.copied, r.total = copied, total
+		r.Unlock()
+		log.Printf("Relocation: copied %v of %v bytes.\n", copied, total)
+	})
+	if err == nil {
+		err = db.CopyNodeStateTo(dataDir, to)
+	}
+	if err == nil {
+		// Only once the marker is written does the old dir stop being
+		// used, so a failure before now leaves the old dir intact.
+		err = ioutil.WriteFile(filepath.Join(dataDir, db.RelocatedFileName), []byte(to), 0600)
+	}
+	if err != nil {
+		log.Println("Relocation failed; continuing to use", dataDir, "due to error:", err)
+		return
+	}
+	r.Lock()
+	r.finished = true
+	r.Unlock()
+	log.Printf("Relocation complete. Restart with -dir %v (or the old dir, which now refers to the new).\n", to)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"goshawkdb.io/server/network"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runSessionsCommand implements `goshawkdb sessions`, which lists the
+// client connection events recorded in a session log (see
+// -sessionlog), or with -at, the client connections which were open
+// at a given time.
+func runSessionsCommand(args []string) error {
+	var logFile, at, fingerprint string
+	flags := flag.NewFlagSet("sessions", flag.ContinueOnError)
+	flags.StringVar(&logFile, "log", "", "`Path` to the session log file (required).")
+	flags.StringVar(&at, "at", "", "RFC3339 `time`: list the client connections open at this time, rather than every event (optional).")
+	flags.StringVar(&fingerprint, "fingerprint", "", "Hex fingerprint of a client certificate: only show events for connections which authenticated with it (optional).")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if logFile == "" {
+		return fmt.Errorf("Usage: %v sessions -log Path [-at Time] [-fingerprint Hex]", os.Args[0])
+	}
+	fingerprint = strings.ToLower(fingerprint)
+	var atTime time.Time
+	if at != "" {
+		var err error
+		if atTime, err = time.Parse(time.RFC3339, at); err != nil {
+			return err
+		}
+	}
+
+	// Connection numbers are only unique between start events, and
+	// only disconnects are sure to know the fingerprint, so every
+	// event for a connection is held until we know whether to show
+	// them.
+	open := make(map[uint32][]*network.SessionEvent)
+	var events []*network.SessionEvent
+	show := func(connEvents []*network.SessionEvent) {
+		last := connEvents[len(connEvents)-1]
+		if fingerprint == "" || last.Fingerprint == fingerprint {
+			events = append(events, connEvents...)
+		}
+	}
+	err := network.ReadSessionLog(logFile, func(event *network.SessionEvent) error {
+		if at != "" && event.Time.After(atTime) {
+			return nil
+		}
+		switch event.Event {
+		case network.SessionStart:
+			for _, connEvents := range open {
+				if at == "" {
+					show(connEvents)
+				}
+			}
+			open = make(map[uint32][]*network.SessionEvent)
+			if at == "" && fingerprint == "" {
+				events = append(events, event)
+			}
+		case network.SessionDisconnect:
+			connEvents := append(open[event.Connection], event)
+			delete(open, event.Connection)
+			if at == "" {
+				show(connEvents)
+			}
+		default:
+			open[event.Connection] = append(open[event.Connection], event)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, connEvents := range open {
+		show(connEvents)
+	}
+
+	sort.Sort(sessionEventsBySeq(events))
+	for _, event := range events {
+		fmt.Println(event)
+	}
+	return nil
+}
+
+type sessionEventsBySeq []*network.SessionEvent
+
+func (s sessionEventsBySeq) Len() int           { return len(s) }
+func (s sessionEventsBySeq) Less(i, j int) bool { return s[i].Seq < s[j].Seq }
+func (s sessionEventsBySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server/paxos"
+	"log"
+	"os"
+)
+
+func main() {
+	log.SetPrefix(common.ProductName + "PaxosReplay ")
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+
+	var txns string
+	flag.StringVar(&txns, "txns", "", "Comma separated hex TxnIds to replay (optional; if empty, lists the txns in the capture).")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatal("Supply exactly one capture file")
+	}
+	path := flag.Arg(0)
+
+	if txns == "" {
+		if err := listTxns(path); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	txnIds, err := paxos.ParseTxnIds(txns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	replayers := make([]*paxos.Replayer, len(txnIds))
+	for idx, txnId := range txnIds {
+		replayers[idx] = paxos.NewReplayer(txnId, os.Stdout)
+	}
+	err = paxos.ReadCapture(path, func(rec *paxos.CaptureRecord) error {
+		for _, replayer := range replayers {
+			replayer.Replay(rec)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, replayer := range replayers {
+		replayer.Finish()
+	}
+}
+
+func listTxns(path string) error {
+	order := []*common.TxnId{}
+	counts := make(map[common.TxnId]int)
+	err := paxos.ReadCapture(path, func(rec *paxos.CaptureRecord) error {
+		if rec.TxnId == nil {
+			return nil
+		}
+		if _, found := counts[*rec.TxnId]; !found {
+			order = append(order, rec.TxnId)
+		}
+		counts[*rec.TxnId]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, txnId := range order {
+		log.Printf("%x: %v messages\n", txnId[:], counts[*txnId])
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package configuration
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// A signed bundle holds a configuration, as JSON, and a signature of
+// it made with the cluster certificate's private key. Only holders of
+// that key can make one, and a bundle made for one cluster can't be
+// verified by the nodes of another.
+type signedBundle struct {
+	Configuration []byte
+	Signature     []byte
+}
+
+// SignConfigurationFromPath loads the configuration from path (see
+// LoadFromPath), and returns it as a signed bundle, signed with the
+// cluster certificate and key in clusterCertificatePEM. Includes are
+// resolved before signing, so the bundle is self-contained.
+func SignConfigurationFromPath(path string, format Format, clusterCertificatePEM []byte) ([]byte, error) {
+	var value interface{}
+	if err := LoadFromPath(path, format, &value); err != nil {
+		return nil, err
+	}
+	configJSON, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	// Refuse to sign anything the nodes would refuse to apply.
+	if _, err = ConfigurationFromJSON(configJSON); err != nil {
+		return nil, err
+	}
+	keyPair, err := tls.X509KeyPair(clusterCertificatePEM, clusterCertificatePEM)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load cluster certificate and key: %v", err)
+	}
+	signer, ok := keyPair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Cluster key cannot be used for signing")
+	}
+	digest := sha256.Sum256(configJSON)
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := json.MarshalIndent(&signedBundle{Configuration: configJSON, Signature: signature}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(bundle, '\n'), nil
+}
+
+// BundleVerifier checks signed bundles against the cluster
+// certificate. A nil BundleVerifier accepts every configuration,
+// signed or not.
+type BundleVerifier struct {
+	certificate *x509.Certificate
+	algorithm   x509.SignatureAlgorithm
+}
+
+// NewBundleVerifier creates a BundleVerifier for the first
+// certificate in clusterCertificatePEM. Any private key is ignored.
+func NewBundleVerifier(clusterCertificatePEM []byte) (*BundleVerifier, error) {
+	for rest := clusterCertificatePEM; len(rest) != 0; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		} else if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		bv := &BundleVerifier{certificate: certificate}
+		switch certificate.PublicKeyAlgorithm {
+		case x509.ECDSA:
+			bv.algorithm = x509.ECDSAWithSHA256
+		case x509.RSA:
+			bv.algorithm = x509.SHA256WithRSA
+		default:
+			return nil, fmt.Errorf("Unsupported cluster certificate key algorithm: %v", certificate.PublicKeyAlgorithm)
+		}
+		return bv, nil
+	}
+	return nil, errors.New("No cluster certificate found")
+}
+
+// LoadConfigurationFromPath loads and verifies the signed bundle at
+// path, returning the configuration it holds.
+func (bv *BundleVerifier) LoadConfigurationFromPath(path string) (*Configuration, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := bv.configurationFromBundle(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid signed configuration %v: %v", path, err)
+	}
+	return config, nil
+}
+
+// ConfigurationFromData decodes a configuration supplied by some
+// means other than the configuration file. A nil BundleVerifier takes
+// the configuration as JSON; otherwise it must be a signed bundle.
+func (bv *BundleVerifier) ConfigurationFromData(data []byte) (*Configuration, error) {
+	if bv == nil {
+		return ConfigurationFromJSON(data)
+	}
+	return bv.configurationFromBundle(data)
+}
+
+// Verify returns an error unless config carries a correctly signed
+// bundle of itself. Configurations received from other nodes carry
+// the bundle they were loaded from.
+func (bv *BundleVerifier) Verify(config *Configuration) error {
+	if bv == nil {
+		return nil
+	} else if len(config.signedBundle) == 0 {
+		return fmt.Errorf("Configuration version %v is not signed", config.Version)
+	}
+	signed, err := bv.configurationFromBundle(config.signedBundle)
+	if err != nil {
+		return err
+	}
+	// The bundle says nothing of the cluster's state; only of what's
+	// configured.
+	signed.clusterUUId = config.clusterUUId
+	signed.rms = config.rms
+	signed.rmsRemoved = config.rmsRemoved
+	signed.nextConfiguration = config.nextConfiguration
+	if !signed.Equal(config) {
+		return fmt.Errorf("Configuration version %v differs from the configuration signed", config.Version)
+	}
+	return nil
+}
+
+func (bv *BundleVerifier) configurationFromBundle(data []byte) (*Configuration, error) {
+	bundle := &signedBundle{}
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return nil, fmt.Errorf("Unable to decode signed bundle: %v", err)
+	} else if len(bundle.Configuration) == 0 || len(bundle.Signature) == 0 {
+		return nil, errors.New("Signed bundle must contain both Configuration and Signature")
+	}
+	if err := bv.certificate.CheckSignature(bv.algorithm, bundle.Configuration, bundle.Signature); err != nil {
+		return nil, fmt.Errorf("Signature not made by the cluster certificate: %v", err)
+	}
+	config, err := ConfigurationFromJSON(bundle.Configuration)
+	if err != nil {
+		return nil, err
+	}
+	config.signedBundle = data
+	return config, nil
+}
@@ -14,7 +14,6 @@ import (
 	ch "goshawkdb.io/server/consistenthash"
 	"math/rand"
 	"net"
-	"os"
 	"sort"
 	"strconv"
 	"time"
@@ -28,11 +27,18 @@ type Configuration struct {
 	MaxRMCount                    uint16
 	NoSync                        bool
 	ClientCertificateFingerprints map[string]map[string]*RootCapability
+	Placement                     map[string][]string
+	Learners                      map[string][]string
+	FailureDomains                map[string][]string
 	clusterUUId                   uint64
 	roots                         []string
 	rms                           common.RMIds
 	rmsRemoved                    map[common.RMId]server.EmptyStruct
 	fingerprints                  map[[sha256.Size]byte]map[string]*common.Capability
+	placement                     map[string][]string
+	learners                      map[string][]string
+	failureDomains                map[string][]string
+	signedBundle                  []byte
 	nextConfiguration             *NextConfiguration
 }
 
@@ -144,26 +150,29 @@ func (next *NextConfiguration) Clone() *NextConfiguration {
 	}
 }
 
-func LoadConfigurationFromPath(path string) (*Configuration, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	config, err := decodeConfiguration(decoder)
-	if err != nil {
+// LoadConfigurationFromPath loads the configuration from path, which
+// is in the given format (see LoadFromPath).
+func LoadConfigurationFromPath(path string, format Format) (*Configuration, error) {
+	var config Configuration
+	if err := LoadFromPath(path, format, &config); err != nil {
 		return nil, err
 	}
-	return config, nil
+	return validateConfiguration(&config)
 }
 
-func decodeConfiguration(decoder *json.Decoder) (*Configuration, error) {
+// ConfigurationFromJSON decodes and validates a configuration from
+// data, which is as would be found in a JSON configuration file
+// (without includes).
+func ConfigurationFromJSON(data []byte) (*Configuration, error) {
 	var config Configuration
-	err := decoder.Decode(&config)
-	if err != nil {
+	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, err
 	}
+	return validateConfiguration(&config)
+}
+
+func validateConfiguration(config *Configuration) (*Configuration, error) {
+	var err error
 	if config.ClusterId == "" {
 		return nil, fmt.Errorf("Invalid configuration cluster id must not be empty")
 	}
@@ -182,17 +191,10 @@ func decodeConfiguration(decoder *json.Decoder) (*Configuration, error) {
 		return nil, fmt.Errorf("MaxRMCount given as %v but must be at least the number of hosts (%v).", config.MaxRMCount, len(config.Hosts))
 	}
 	for idx, hostPort := range config.Hosts {
-		port := common.DefaultPort
-		hostOnly := hostPort
-		if host, portStr, err := net.SplitHostPort(hostPort); err == nil {
-			portInt64, err := strconv.ParseUint(portStr, 0, 16)
-			if err != nil {
-				return nil, err
-			}
-			port = int(portInt64)
-			hostOnly = host
+		hostPort, err := normaliseHostPort(hostPort)
+		if err != nil {
+			return nil, err
 		}
-		hostPort = net.JoinHostPort(hostOnly, fmt.Sprint(port))
 		config.Hosts[idx] = hostPort
 		if _, err := net.ResolveTCPAddr("tcp", hostPort); err != nil {
 			return nil, err
@@ -252,8 +254,167 @@ func decodeConfiguration(decoder *json.Decoder) (*Configuration, error) {
 		config.ClientCertificateFingerprints = nil
 		sort.Strings(rootsName)
 		config.roots = rootsName
+
+		if len(config.Placement) != 0 {
+			placement, err := validatePlacement(config, rootsMap, twoFInc)
+			if err != nil {
+				return nil, err
+			}
+			config.placement = placement
+		}
+		config.Placement = nil
+
+		if len(config.Learners) != 0 {
+			learners, err := validateLearners(config, rootsMap, twoFInc)
+			if err != nil {
+				return nil, err
+			}
+			config.learners = learners
+		}
+		config.Learners = nil
+
+		if len(config.FailureDomains) != 0 {
+			failureDomains, err := validateFailureDomains(config)
+			if err != nil {
+				return nil, err
+			}
+			config.failureDomains = failureDomains
+		}
+		config.FailureDomains = nil
+	}
+	return config, err
+}
+
+// validateFailureDomains checks that every host of a failure domain
+// is in Hosts, and in no other failure domain, and that the hosts
+// span at least F+1 failure domains: otherwise the loss of a single
+// failure domain could lose every copy of some vars.
+func validateFailureDomains(config *Configuration) (map[string][]string, error) {
+	hostsMap := make(map[string]server.EmptyStruct, len(config.Hosts))
+	for _, host := range config.Hosts {
+		hostsMap[host] = server.EmptyStructVal
+	}
+	hostToDomain := make(map[string]string, len(config.Hosts))
+	failureDomains := make(map[string][]string, len(config.FailureDomains))
+	for name, hostPorts := range config.FailureDomains {
+		hosts := make([]string, 0, len(hostPorts))
+		for _, hostPort := range hostPorts {
+			hostPort, err := normaliseHostPort(hostPort)
+			if err != nil {
+				return nil, err
+			}
+			if _, found := hostsMap[hostPort]; !found {
+				return nil, fmt.Errorf("Failure domain %s includes host %v which is not in Hosts.", name, hostPort)
+			}
+			if domain, found := hostToDomain[hostPort]; found && domain != name {
+				return nil, fmt.Errorf("Host %v is in both failure domains %s and %s.", hostPort, domain, name)
+			} else if !found {
+				hostToDomain[hostPort] = name
+				hosts = append(hosts, hostPort)
+			}
+		}
+		if len(hosts) != 0 {
+			sort.Strings(hosts)
+			failureDomains[name] = hosts
+		}
+	}
+	// Hosts in no failure domain are each a failure domain of their own.
+	domains := len(failureDomains) + len(config.Hosts) - len(hostToDomain)
+	if fInc := int(config.F) + 1; domains < fInc {
+		return nil, fmt.Errorf("F given as %v, requires Hosts span at least F+1=%v failure domains but they span only %v.",
+			config.F, fInc, domains)
+	}
+	return failureDomains, nil
+}
+
+// validateLearners checks that every learner is in Hosts, learns at
+// least one existing root, and that enough hosts which are not
+// learners remain to satisfy F.
+func validateLearners(config *Configuration, rootsMap map[string]server.EmptyStruct, twoFInc int) (map[string][]string, error) {
+	hostsMap := make(map[string]server.EmptyStruct, len(config.Hosts))
+	for _, host := range config.Hosts {
+		hostsMap[host] = server.EmptyStructVal
+	}
+	learners := make(map[string][]string, len(config.Learners))
+	for hostPort, names := range config.Learners {
+		hostPort, err := normaliseHostPort(hostPort)
+		if err != nil {
+			return nil, err
+		}
+		if _, found := hostsMap[hostPort]; !found {
+			return nil, fmt.Errorf("Learner %v is not in Hosts.", hostPort)
+		} else if _, found := learners[hostPort]; found {
+			return nil, fmt.Errorf("Learner %v is given more than once.", hostPort)
+		} else if len(names) == 0 {
+			return nil, fmt.Errorf("No roots configured for learner %v; at least 1 needed", hostPort)
+		}
+		roots := make([]string, 0, len(names))
+		for _, name := range names {
+			if _, found := rootsMap[name]; !found {
+				return nil, fmt.Errorf("Learner %v is given root %s, but no client fingerprint is granted that root.", hostPort, name)
+			}
+			roots = append(roots, name)
+		}
+		sort.Strings(roots)
+		learners[hostPort] = roots
+	}
+	if voters := len(config.Hosts) - len(learners); voters < twoFInc {
+		return nil, fmt.Errorf("F given as %v, requires minimum 2F+1=%v hosts which are not learners but only %v such hosts specified.",
+			config.F, twoFInc, voters)
+	}
+	return learners, nil
+}
+
+// validatePlacement checks that every pinned root exists, and is
+// pinned to at least 2F+1 distinct hosts all of which are in Hosts:
+// otherwise vars could never be created within the pinned hosts.
+func validatePlacement(config *Configuration, rootsMap map[string]server.EmptyStruct, twoFInc int) (map[string][]string, error) {
+	hostsMap := make(map[string]server.EmptyStruct, len(config.Hosts))
+	for _, host := range config.Hosts {
+		hostsMap[host] = server.EmptyStructVal
+	}
+	placement := make(map[string][]string, len(config.Placement))
+	for name, hostPorts := range config.Placement {
+		if _, found := rootsMap[name]; !found {
+			return nil, fmt.Errorf("Placement given for root %s, but no client fingerprint is granted that root.", name)
+		}
+		pinned := make(map[string]server.EmptyStruct, len(hostPorts))
+		hosts := make([]string, 0, len(hostPorts))
+		for _, hostPort := range hostPorts {
+			hostPort, err := normaliseHostPort(hostPort)
+			if err != nil {
+				return nil, err
+			}
+			if _, found := hostsMap[hostPort]; !found {
+				return nil, fmt.Errorf("Placement for root %s includes host %v which is not in Hosts.", name, hostPort)
+			}
+			if _, found := pinned[hostPort]; !found {
+				pinned[hostPort] = server.EmptyStructVal
+				hosts = append(hosts, hostPort)
+			}
+		}
+		if len(hosts) < twoFInc {
+			return nil, fmt.Errorf("Placement for root %s gives %v hosts, but F is %v so at least 2F+1=%v hosts are required.",
+				name, len(hosts), config.F, twoFInc)
+		}
+		sort.Strings(hosts)
+		placement[name] = hosts
 	}
-	return &config, err
+	return placement, nil
+}
+
+func normaliseHostPort(hostPort string) (string, error) {
+	port := common.DefaultPort
+	hostOnly := hostPort
+	if host, portStr, err := net.SplitHostPort(hostPort); err == nil {
+		portInt64, err := strconv.ParseUint(portStr, 0, 16)
+		if err != nil {
+			return "", err
+		}
+		port = int(portInt64)
+		hostOnly = host
+	}
+	return net.JoinHostPort(hostOnly, fmt.Sprint(port)), nil
 }
 
 func ConfigurationFromCap(config *msgs.Configuration) *Configuration {
@@ -305,6 +466,34 @@ func ConfigurationFromCap(config *msgs.Configuration) *Configuration {
 	sort.Strings(rootsName)
 	c.roots = rootsName
 
+	if learners := config.Learners(); learners.Len() != 0 {
+		c.learners = make(map[string][]string, learners.Len())
+		for idx, l := 0, learners.Len(); idx < l; idx++ {
+			learner := learners.At(idx)
+			c.learners[learner.Host()] = learner.Roots().ToArray()
+		}
+	}
+
+	if placement := config.Placement(); placement.Len() != 0 {
+		c.placement = make(map[string][]string, placement.Len())
+		for idx, l := 0, placement.Len(); idx < l; idx++ {
+			pin := placement.At(idx)
+			c.placement[pin.Root()] = pin.Hosts().ToArray()
+		}
+	}
+
+	if failureDomains := config.FailureDomains(); failureDomains.Len() != 0 {
+		c.failureDomains = make(map[string][]string, failureDomains.Len())
+		for idx, l := 0, failureDomains.Len(); idx < l; idx++ {
+			domain := failureDomains.At(idx)
+			c.failureDomains[domain.Name()] = domain.Hosts().ToArray()
+		}
+	}
+
+	if signedBundle := config.SignedBundle(); len(signedBundle) != 0 {
+		c.signedBundle = append([]byte{}, signedBundle...)
+	}
+
 	if config.Which() == msgs.CONFIGURATION_TRANSITIONINGTO {
 		next := config.TransitioningTo()
 		nextConfig := next.Configuration()
@@ -364,7 +553,7 @@ func (a *Configuration) Equal(b *Configuration) bool {
 	if a == nil || b == nil {
 		return a == b
 	}
-	if !(a.ClusterId == b.ClusterId && a.clusterUUId == b.clusterUUId && a.Version == b.Version && a.F == b.F && a.MaxRMCount == b.MaxRMCount && a.NoSync == b.NoSync && len(a.Hosts) == len(b.Hosts) && len(a.fingerprints) == len(b.fingerprints) && len(a.rms) == len(b.rms) && len(a.rmsRemoved) == len(b.rmsRemoved)) {
+	if !(a.ClusterId == b.ClusterId && a.clusterUUId == b.clusterUUId && a.Version == b.Version && a.F == b.F && a.MaxRMCount == b.MaxRMCount && a.NoSync == b.NoSync && len(a.Hosts) == len(b.Hosts) && len(a.rms) == len(b.rms) && len(a.rmsRemoved) == len(b.rmsRemoved)) {
 		return false
 	}
 	for idx, aHost := range a.Hosts {
@@ -382,6 +571,13 @@ func (a *Configuration) Equal(b *Configuration) bool {
 			return false
 		}
 	}
+	return a.fingerprintsEqual(b) && a.placementEqual(b) && stringListsEqual(a.learners, b.learners) && stringListsEqual(a.failureDomains, b.failureDomains) && a.nextConfiguration.Equal(b.nextConfiguration)
+}
+
+func (a *Configuration) fingerprintsEqual(b *Configuration) bool {
+	if len(a.fingerprints) != len(b.fingerprints) {
+		return false
+	}
 	for fingerprint, aRoots := range a.fingerprints {
 		if bRoots, found := b.fingerprints[fingerprint]; !found || len(aRoots) != len(bRoots) {
 			return false
@@ -393,7 +589,73 @@ func (a *Configuration) Equal(b *Configuration) bool {
 			}
 		}
 	}
-	return a.nextConfiguration.Equal(b.nextConfiguration)
+	return true
+}
+
+func (a *Configuration) placementEqual(b *Configuration) bool {
+	return stringListsEqual(a.placement, b.placement)
+}
+
+func stringListsEqual(a, b map[string][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, aList := range a {
+		if bList, found := b[key]; !found || len(aList) != len(bList) {
+			return false
+		} else {
+			for idx, aElem := range aList {
+				if aElem != bList[idx] {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// IsFingerprintsDelta returns true iff b is the version after a, and
+// differs from a in, and only in, the capabilities granted to client
+// fingerprints, over the same root names, and a is not in the middle
+// of changing. Such a change needs no new roots, nor any migration,
+// so can be applied without a full topology change.
+//
+// The version still moves on by one: it is only a counter here, and
+// starts none of the quiet or migration machinery, but every node,
+// and the loader of the configuration file, tells configurations
+// apart by version alone. A new set of fingerprints at the same
+// version would be indistinguishable from the old one, and nodes
+// which missed the change would never adopt it.
+func (a *Configuration) IsFingerprintsDelta(b *Configuration) bool {
+	if a == nil || b == nil || a.nextConfiguration != nil || b.nextConfiguration != nil {
+		return false
+	}
+	if !(a.ClusterId == b.ClusterId && b.Version == a.Version+1 && a.F == b.F && a.MaxRMCount == b.MaxRMCount && a.NoSync == b.NoSync && len(a.Hosts) == len(b.Hosts) && len(a.roots) == len(b.roots)) {
+		return false
+	}
+	for idx, aHost := range a.Hosts {
+		if aHost != b.Hosts[idx] {
+			return false
+		}
+	}
+	for idx, aRoot := range a.roots {
+		if aRoot != b.roots[idx] {
+			return false
+		}
+	}
+	return !a.fingerprintsEqual(b) && a.placementEqual(b) && stringListsEqual(a.learners, b.learners) && stringListsEqual(a.failureDomains, b.failureDomains)
+}
+
+// WithFingerprintsOf returns a copy of a with the version, client
+// fingerprints and signed bundle of b. b must be a fingerprints delta
+// of a (see IsFingerprintsDelta), in which case the result is equal
+// to b, but keeps the cluster state of a.
+func (a *Configuration) WithFingerprintsOf(b *Configuration) *Configuration {
+	c := a.Clone()
+	c.Version = b.Version
+	c.fingerprints = b.fingerprints
+	c.signedBundle = b.signedBundle
+	return c
 }
 
 func (config *Configuration) String() string {
@@ -428,6 +690,291 @@ func (config *Configuration) RootNames() []string {
 	return config.roots
 }
 
+// Placement returns, for each root which is pinned, the hosts to
+// which vars reachable from that root are pinned.
+func (config *Configuration) Placement() map[string][]string {
+	return config.placement
+}
+
+// PinnedHosts returns the hosts which every one of the named roots
+// is pinned to. It returns nil (i.e. no pinning) if any of the roots
+// is not pinned.
+func (config *Configuration) PinnedHosts(rootNames []string) []string {
+	if len(config.placement) == 0 || len(rootNames) == 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, name := range rootNames {
+		hosts, found := config.placement[name]
+		if !found {
+			return nil
+		}
+		for _, host := range hosts {
+			counts[host]++
+		}
+	}
+	hosts := make([]string, 0, len(counts))
+	for host, count := range counts {
+		if count == len(rootNames) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Learners returns, for each host which is a learner, the roots it
+// learns. A learner never holds vars as one of their 2F+1 RMs, and
+// so never votes on txns; instead it learns the committed outcomes
+// of txns submitted by clients of its roots.
+func (config *Configuration) Learners() map[string][]string {
+	return config.learners
+}
+
+// LearnersCompatible returns true iff every host in both a and b is
+// either a learner in both or a learner in neither. Vars are placed
+// only on RMs which are not learners, so a host cannot change between
+// the two without its RM's vars moving.
+func (a *Configuration) LearnersCompatible(b *Configuration) bool {
+	bHosts := make(map[string]server.EmptyStruct, len(b.Hosts))
+	for _, host := range b.Hosts {
+		bHosts[host] = server.EmptyStructVal
+	}
+	for _, host := range a.Hosts {
+		if _, found := bHosts[host]; !found {
+			continue
+		}
+		_, aLearner := a.learners[host]
+		_, bLearner := b.learners[host]
+		if aLearner != bLearner {
+			return false
+		}
+	}
+	return true
+}
+
+// LearnersOfRoots returns the RMs of the learners of any of the named
+// roots.
+func (config *Configuration) LearnersOfRoots(rootNames []string) common.RMIds {
+	if len(config.learners) == 0 {
+		return nil
+	}
+	names := make(map[string]server.EmptyStruct, len(rootNames))
+	for _, name := range rootNames {
+		names[name] = server.EmptyStructVal
+	}
+	hosts := []string{}
+	for host, roots := range config.learners {
+		for _, root := range roots {
+			if _, found := names[root]; found {
+				hosts = append(hosts, host)
+				break
+			}
+		}
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+	return config.RMsOfHosts(hosts)
+}
+
+// LearnerRMs returns the RMs of all the learners.
+func (config *Configuration) LearnerRMs() common.RMIds {
+	if len(config.learners) == 0 {
+		return nil
+	}
+	hosts := make([]string, 0, len(config.learners))
+	for host := range config.learners {
+		hosts = append(hosts, host)
+	}
+	return config.RMsOfHosts(hosts)
+}
+
+// IsLearner returns true iff rmId is the RM of a learner.
+func (config *Configuration) IsLearner(rmId common.RMId) bool {
+	if rmId == common.RMIdEmpty {
+		return false
+	}
+	for _, learner := range config.LearnerRMs() {
+		if learner == rmId {
+			return true
+		}
+	}
+	return false
+}
+
+// VoterRMs returns RMs, but with the RMs of learners replaced by
+// RMIdEmpty. This is what vars are placed over: as for removed RMs,
+// blanking learners in place leaves every other var's RMs unchanged.
+func (config *Configuration) VoterRMs() common.RMIds {
+	if len(config.learners) == 0 {
+		return config.rms
+	}
+	voters := make([]common.RMId, len(config.rms))
+	copy(voters, config.rms)
+	hostIdx := 0
+	for idx, rmId := range voters {
+		if rmId == common.RMIdEmpty {
+			continue
+		}
+		if hostIdx < len(config.Hosts) {
+			if _, found := config.learners[config.Hosts[hostIdx]]; found {
+				voters[idx] = common.RMIdEmpty
+			}
+		}
+		hostIdx++
+	}
+	return voters
+}
+
+// FailureDomainOf returns the name of the failure domain of host. A
+// host in no failure domain is a failure domain of its own, named
+// after the host.
+func (config *Configuration) FailureDomainOf(host string) string {
+	for name, hosts := range config.failureDomains {
+		for _, h := range hosts {
+			if h == host {
+				return name
+			}
+		}
+	}
+	return host
+}
+
+// Staged returns a clone of config, but with hosts as its Hosts, for
+// use as an intermediate step of the change from the configuration
+// from to config. hosts must include every one of config's Hosts;
+// the rest must be Hosts of from, and keep the learner roots and
+// failure domains they have in from.
+func (config *Configuration) Staged(hosts []string, from *Configuration) *Configuration {
+	staged := config.Clone()
+	staged.Hosts = hosts
+	staged.signedBundle = nil
+	current := make(map[string]server.EmptyStruct, len(config.Hosts))
+	for _, host := range config.Hosts {
+		current[host] = server.EmptyStructVal
+	}
+	learners := make(map[string][]string, len(config.learners))
+	for host, roots := range config.learners {
+		learners[host] = roots
+	}
+	failureDomains := make(map[string][]string, len(config.failureDomains))
+	for name, domainHosts := range config.failureDomains {
+		failureDomains[name] = domainHosts
+	}
+	for _, host := range hosts {
+		if _, found := current[host]; found {
+			continue
+		}
+		if roots, found := from.learners[host]; found {
+			learners[host] = roots
+		}
+		if name := from.FailureDomainOf(host); name != host {
+			domainHosts := append(append([]string{}, failureDomains[name]...), host)
+			sort.Strings(domainHosts)
+			failureDomains[name] = domainHosts
+		}
+	}
+	if len(learners) != 0 {
+		staged.learners = learners
+	}
+	if len(failureDomains) != 0 {
+		staged.failureDomains = failureDomains
+	}
+	return staged
+}
+
+// WithoutHosts returns a configuration like config, but at the next
+// version and without hosts. It is validated as if it had been loaded
+// from a file: the remaining hosts keep their learner roots,
+// placements and failure domains, which must still satisfy F.
+func (config *Configuration) WithoutHosts(hosts []string) (*Configuration, error) {
+	removing := make(map[string]server.EmptyStruct, len(hosts))
+	for _, host := range hosts {
+		removing[host] = server.EmptyStructVal
+	}
+	without := func(hostPorts []string) []string {
+		kept := make([]string, 0, len(hostPorts))
+		for _, host := range hostPorts {
+			if _, found := removing[host]; !found {
+				kept = append(kept, host)
+			}
+		}
+		return kept
+	}
+
+	next := &Configuration{
+		ClusterId:                     config.ClusterId,
+		Version:                       config.Version + 1,
+		Hosts:                         without(config.Hosts),
+		F:                             config.F,
+		MaxRMCount:                    config.MaxRMCount,
+		NoSync:                        config.NoSync,
+		ClientCertificateFingerprints: make(map[string]map[string]*RootCapability, len(config.fingerprints)),
+	}
+	for fingerprint, roots := range config.fingerprints {
+		rootsCapability := make(map[string]*RootCapability, len(roots))
+		for name, capability := range roots {
+			switch capability.Which() {
+			case cmsgs.CAPABILITY_READ:
+				rootsCapability[name] = &RootCapability{Read: true}
+			case cmsgs.CAPABILITY_WRITE:
+				rootsCapability[name] = &RootCapability{Write: true}
+			case cmsgs.CAPABILITY_READWRITE:
+				rootsCapability[name] = &RootCapability{Read: true, Write: true}
+			}
+		}
+		next.ClientCertificateFingerprints[hex.EncodeToString(fingerprint[:])] = rootsCapability
+	}
+	if len(config.placement) != 0 {
+		next.Placement = make(map[string][]string, len(config.placement))
+		for name, hostPorts := range config.placement {
+			next.Placement[name] = without(hostPorts)
+		}
+	}
+	if len(config.learners) != 0 {
+		next.Learners = make(map[string][]string, len(config.learners))
+		for host, roots := range config.learners {
+			if _, found := removing[host]; !found {
+				next.Learners[host] = roots
+			}
+		}
+	}
+	if len(config.failureDomains) != 0 {
+		next.FailureDomains = make(map[string][]string, len(config.failureDomains))
+		for name, hostPorts := range config.failureDomains {
+			if kept := without(hostPorts); len(kept) != 0 {
+				next.FailureDomains[name] = kept
+			}
+		}
+	}
+	return validateConfiguration(next)
+}
+
+// RMsOfHosts returns the RMs of those of the hosts which are in
+// Hosts.
+func (config *Configuration) RMsOfHosts(hosts []string) common.RMIds {
+	wanted := make(map[string]server.EmptyStruct, len(hosts))
+	for _, host := range hosts {
+		wanted[host] = server.EmptyStructVal
+	}
+	// Hosts is in the same order as the non-empty RMs.
+	rmIds := make([]common.RMId, 0, len(hosts))
+	hostIdx := 0
+	for _, rmId := range config.rms {
+		if rmId == common.RMIdEmpty {
+			continue
+		}
+		if hostIdx < len(config.Hosts) {
+			if _, found := wanted[config.Hosts[hostIdx]]; found {
+				rmIds = append(rmIds, rmId)
+			}
+		}
+		hostIdx++
+	}
+	return rmIds
+}
+
 func (config *Configuration) NextBarrierReached1(rmId common.RMId) bool {
 	if config.nextConfiguration != nil {
 		for _, r := range config.nextConfiguration.BarrierReached1 {
@@ -488,6 +1035,10 @@ func (config *Configuration) Clone() *Configuration {
 		rms:               make([]common.RMId, len(config.rms)),
 		rmsRemoved:        make(map[common.RMId]server.EmptyStruct, len(config.rmsRemoved)),
 		fingerprints:      make(map[[sha256.Size]byte]map[string]*common.Capability, len(config.fingerprints)),
+		placement:         config.placement,
+		learners:          config.learners,
+		failureDomains:    config.failureDomains,
+		signedBundle:      config.signedBundle,
 		nextConfiguration: config.nextConfiguration.Clone(),
 	}
 
@@ -506,6 +1057,24 @@ func (config *Configuration) Clone() *Configuration {
 	for k, v := range config.fingerprints {
 		clone.fingerprints[k] = v
 	}
+	if config.Placement != nil {
+		clone.Placement = make(map[string][]string, len(config.Placement))
+		for k, v := range config.Placement {
+			clone.Placement[k] = v
+		}
+	}
+	if config.Learners != nil {
+		clone.Learners = make(map[string][]string, len(config.Learners))
+		for k, v := range config.Learners {
+			clone.Learners[k] = v
+		}
+	}
+	if config.FailureDomains != nil {
+		clone.FailureDomains = make(map[string][]string, len(config.FailureDomains))
+		for k, v := range config.FailureDomains {
+			clone.FailureDomains[k] = v
+		}
+	}
 	return clone
 }
 
@@ -560,6 +1129,55 @@ func (config *Configuration) AddToSegAutoRoot(seg *capn.Segment) msgs.Configurat
 	}
 	cap.SetFingerprints(fingerprintsCap)
 
+	placementCap := msgs.NewPlacementList(seg, len(config.placement))
+	idx = 0
+	for name, hosts := range config.placement {
+		pinCap := msgs.NewPlacement(seg)
+		pinCap.SetRoot(name)
+		hostsCap := seg.NewTextList(len(hosts))
+		for idy, host := range hosts {
+			hostsCap.Set(idy, host)
+		}
+		pinCap.SetHosts(hostsCap)
+		placementCap.Set(idx, pinCap)
+		idx++
+	}
+	cap.SetPlacement(placementCap)
+
+	learnersCap := msgs.NewLearnerList(seg, len(config.learners))
+	idx = 0
+	for host, roots := range config.learners {
+		learnerCap := msgs.NewLearner(seg)
+		learnerCap.SetHost(host)
+		rootsCap := seg.NewTextList(len(roots))
+		for idy, root := range roots {
+			rootsCap.Set(idy, root)
+		}
+		learnerCap.SetRoots(rootsCap)
+		learnersCap.Set(idx, learnerCap)
+		idx++
+	}
+	cap.SetLearners(learnersCap)
+
+	failureDomainsCap := msgs.NewFailureDomainList(seg, len(config.failureDomains))
+	idx = 0
+	for name, hosts := range config.failureDomains {
+		domainCap := msgs.NewFailureDomain(seg)
+		domainCap.SetName(name)
+		hostsCap := seg.NewTextList(len(hosts))
+		for idy, host := range hosts {
+			hostsCap.Set(idy, host)
+		}
+		domainCap.SetHosts(hostsCap)
+		failureDomainsCap.Set(idx, domainCap)
+		idx++
+	}
+	cap.SetFailureDomains(failureDomainsCap)
+
+	if len(config.signedBundle) != 0 {
+		cap.SetSignedBundle(config.signedBundle)
+	}
+
 	if config.nextConfiguration == nil {
 		cap.SetStable()
 	} else {
@@ -917,11 +1535,11 @@ func (g *Generator) String() string {
 }
 
 func (g *Generator) SatisfiedBy(topology *Topology, positions *common.Positions) (bool, error) {
-	rms := topology.RMs()
+	rms := topology.VoterRMs()
 	twoFInc := topology.TwoFInc
 	if g.UseNext {
 		next := topology.Next()
-		rms = next.RMs()
+		rms = next.VoterRMs()
 		twoFInc = (uint16(next.F) * 2) + 1
 	}
 	server.Log("Generator:SatisfiedBy:NewResolver:", rms, twoFInc)
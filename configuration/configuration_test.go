@@ -0,0 +1,49 @@
+package configuration
+
+import (
+	"crypto/sha256"
+	"goshawkdb.io/common"
+	"testing"
+)
+
+func testConfiguration(version uint32, fingerprints ...byte) *Configuration {
+	config := &Configuration{
+		ClusterId:    "test",
+		Version:      version,
+		Hosts:        []string{"a:7894", "b:7894", "c:7894"},
+		F:            1,
+		MaxRMCount:   5,
+		roots:        []string{"test"},
+		fingerprints: make(map[[sha256.Size]byte]map[string]*common.Capability),
+	}
+	for _, fingerprint := range fingerprints {
+		config.fingerprints[[sha256.Size]byte{fingerprint}] = map[string]*common.Capability{"test": common.MaxCapability}
+	}
+	return config
+}
+
+func TestFingerprintsDelta(t *testing.T) {
+	active := testConfiguration(3, 1)
+
+	if next := testConfiguration(4, 1, 2); !active.IsFingerprintsDelta(next) {
+		t.Fatal("Expected an added fingerprint at the next version to be a fingerprints delta")
+	} else if applied := active.WithFingerprintsOf(next); !applied.Equal(next) {
+		t.Fatalf("Expected applying the delta to give %v; got %v", next, applied)
+	}
+
+	if active.IsFingerprintsDelta(testConfiguration(4, 1)) {
+		t.Fatal("Expected unchanged fingerprints not to be a fingerprints delta")
+	}
+	if active.IsFingerprintsDelta(testConfiguration(3, 1, 2)) {
+		t.Fatal("Expected changed fingerprints at the same version not to be a fingerprints delta")
+	}
+	if active.IsFingerprintsDelta(testConfiguration(5, 1, 2)) {
+		t.Fatal("Expected changed fingerprints beyond the next version not to be a fingerprints delta")
+	}
+
+	moved := testConfiguration(4, 1, 2)
+	moved.Hosts[2] = "d:7894"
+	if active.IsFingerprintsDelta(moved) {
+		t.Fatal("Expected a change of hosts not to be a fingerprints delta")
+	}
+}
@@ -0,0 +1,20 @@
+package configuration
+
+// LoadConfigurationWithDiscoveredHosts is like
+// LoadConfigurationFromPath, except that the configuration may leave
+// Hosts empty, in which case discover is called (with the ClusterId)
+// to find them. This is intended only for development clusters.
+func LoadConfigurationWithDiscoveredHosts(path string, format Format, discover func(clusterId string) ([]string, error)) (*Configuration, error) {
+	var config Configuration
+	if err := LoadFromPath(path, format, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Hosts) == 0 && config.ClusterId != "" {
+		hosts, err := discover(config.ClusterId)
+		if err != nil {
+			return nil, err
+		}
+		config.Hosts = hosts
+	}
+	return validateConfiguration(&config)
+}
@@ -0,0 +1,100 @@
+package configuration
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"goshawkdb.io/server"
+)
+
+// ListenerConfiguration describes an additional client-only
+// listener. Such listeners present their own certificates (chosen by
+// SNI if there are several), and may restrict which of the client
+// fingerprints in the cluster configuration can connect through
+// them. The roots and capabilities granted to a client still come
+// from the cluster configuration.
+type ListenerConfiguration struct {
+	Port                          uint16
+	Certificates                  []ListenerCertificate
+	ClientCertificateFingerprints []string
+	fingerprints                  map[[sha256.Size]byte]server.EmptyStruct
+}
+
+type ListenerCertificate struct {
+	CertificateFile string
+	KeyFile         string
+}
+
+func (lc *ListenerConfiguration) String() string {
+	return fmt.Sprintf("Listener on port %v (%v certificates; %v fingerprints)", lc.Port, len(lc.Certificates), len(lc.fingerprints))
+}
+
+// Permits returns true if a client with the given fingerprint may
+// connect through this listener. If no fingerprints were configured,
+// every fingerprint is permitted.
+func (lc *ListenerConfiguration) Permits(fingerprint [sha256.Size]byte) bool {
+	if lc.fingerprints == nil {
+		return true
+	}
+	_, found := lc.fingerprints[fingerprint]
+	return found
+}
+
+func (a *ListenerConfiguration) Equal(b *ListenerConfiguration) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Port != b.Port || len(a.Certificates) != len(b.Certificates) || len(a.ClientCertificateFingerprints) != len(b.ClientCertificateFingerprints) {
+		return false
+	}
+	for idx, cert := range a.Certificates {
+		if cert != b.Certificates[idx] {
+			return false
+		}
+	}
+	for idx, fingerprint := range a.ClientCertificateFingerprints {
+		if fingerprint != b.ClientCertificateFingerprints[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+func LoadListenerConfigurationsFromPath(path string) ([]*ListenerConfiguration, error) {
+	var listeners []*ListenerConfiguration
+	if err := LoadFromPath(path, FormatAuto, &listeners); err != nil {
+		return nil, err
+	}
+	ports := make(map[uint16]server.EmptyStruct, len(listeners))
+	for _, lc := range listeners {
+		if lc.Port == 0 {
+			return nil, fmt.Errorf("Invalid listener configuration: port must be > 0")
+		} else if _, found := ports[lc.Port]; found {
+			return nil, fmt.Errorf("Invalid listener configuration: port %v used more than once", lc.Port)
+		}
+		ports[lc.Port] = server.EmptyStructVal
+		if len(lc.Certificates) == 0 {
+			return nil, fmt.Errorf("Invalid listener configuration for port %v: no certificates", lc.Port)
+		}
+		for _, cert := range lc.Certificates {
+			if cert.CertificateFile == "" || cert.KeyFile == "" {
+				return nil, fmt.Errorf("Invalid listener configuration for port %v: certificates need both CertificateFile and KeyFile", lc.Port)
+			}
+		}
+		if len(lc.ClientCertificateFingerprints) != 0 {
+			lc.fingerprints = make(map[[sha256.Size]byte]server.EmptyStruct, len(lc.ClientCertificateFingerprints))
+			for _, fingerprint := range lc.ClientCertificateFingerprints {
+				fingerprintBytes, err := hex.DecodeString(fingerprint)
+				if err != nil {
+					return nil, err
+				} else if l := len(fingerprintBytes); l != sha256.Size {
+					return nil, fmt.Errorf("Invalid fingerprint: expected %v bytes, and found %v", sha256.Size, l)
+				}
+				ary := [sha256.Size]byte{}
+				copy(ary[:], fingerprintBytes)
+				lc.fingerprints[ary] = server.EmptyStructVal
+			}
+		}
+	}
+	return listeners, nil
+}
@@ -0,0 +1,244 @@
+package configuration
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+type Format uint8
+
+const (
+	FormatAuto Format = iota
+	FormatJSON Format = iota
+	FormatTOML Format = iota
+	FormatYAML Format = iota
+)
+
+// includeKey may appear in any object of a configuration file. Its
+// value is a path, or list of paths, to further files (in any
+// format), relative to the including file. The objects in those files
+// are merged into the including object. This is mainly intended to
+// allow ClientCertificateFingerprints to be kept in separate files.
+const (
+	includeKey      = "Include"
+	maxIncludeDepth = 16
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatAuto:
+		return "auto"
+	case FormatJSON:
+		return "json"
+	case FormatTOML:
+		return "toml"
+	case FormatYAML:
+		return "yaml"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(f))
+	}
+}
+
+func ParseFormat(str string) (Format, error) {
+	for _, f := range []Format{FormatAuto, FormatJSON, FormatTOML, FormatYAML} {
+		if strings.EqualFold(str, f.String()) {
+			return f, nil
+		}
+	}
+	if strings.EqualFold(str, "yml") {
+		return FormatYAML, nil
+	}
+	return FormatAuto, fmt.Errorf("Unknown configuration format: %v", str)
+}
+
+// DetectFormat guesses the format of path from its extension,
+// defaulting to JSON.
+func DetectFormat(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return FormatTOML
+	case ".yaml", ".yml":
+		return FormatYAML
+	default:
+		return FormatJSON
+	}
+}
+
+// LoadFromPath decodes the file at path into v. The file is decoded
+// according to format (or, if FormatAuto, the format detected from
+// the file's extension), includes are resolved, and the result is
+// then decoded into v exactly as if it had been written in JSON. So
+// field names match as they do for JSON, regardless of format.
+func LoadFromPath(path string, format Format, v interface{}) error {
+	value, err := loadValue(path, format, 0)
+	if err != nil {
+		return err
+	}
+	normalized, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(normalized, v)
+}
+
+func loadValue(path string, format Format, depth int) (interface{}, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("Includes nested too deeply (cycle?) at %v", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == FormatAuto {
+		format = DetectFormat(path)
+	}
+	var value interface{}
+	switch format {
+	case FormatJSON:
+		err = json.Unmarshal(data, &value)
+	case FormatTOML:
+		table := make(map[string]interface{})
+		_, err = toml.Decode(string(data), &table)
+		value = table
+	case FormatYAML:
+		err = yaml.Unmarshal(data, &value)
+	default:
+		err = fmt.Errorf("Unknown configuration format: %v", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode %v as %v: %v", path, format, err)
+	}
+	value, err = normalizeValue(value)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode %v as %v: %v", path, format, err)
+	}
+	return resolveIncludes(value, filepath.Dir(path), depth)
+}
+
+// normalizeValue converts the maps produced by the YAML decoder,
+// which may have non-string keys, into maps with string keys.
+func normalizeValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("Non-string key %v", key)
+			}
+			elem, err := normalizeValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			m[keyStr] = elem
+		}
+		return m, nil
+	case map[string]interface{}:
+		for key, elem := range v {
+			elem, err := normalizeValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = elem
+		}
+		return v, nil
+	case []map[string]interface{}:
+		// TOML arrays of tables
+		l := make([]interface{}, len(v))
+		for idx, elem := range v {
+			l[idx] = elem
+		}
+		return normalizeValue(l)
+	case []interface{}:
+		for idx, elem := range v {
+			elem, err := normalizeValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			v[idx] = elem
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+}
+
+func resolveIncludes(value interface{}, dir string, depth int) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			if key == includeKey {
+				continue
+			}
+			elem, err := resolveIncludes(elem, dir, depth)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = elem
+		}
+		include, found := v[includeKey]
+		if !found {
+			return v, nil
+		}
+		delete(v, includeKey)
+		paths, err := includePaths(include)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			included, err := loadValue(path, FormatAuto, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			includedMap, ok := included.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Included file %v does not contain an object", path)
+			}
+			for key, elem := range includedMap {
+				if _, found := v[key]; found {
+					return nil, fmt.Errorf("Included file %v redefines %v", path, key)
+				}
+				v[key] = elem
+			}
+		}
+		return v, nil
+	case []interface{}:
+		for idx, elem := range v {
+			elem, err := resolveIncludes(elem, dir, depth)
+			if err != nil {
+				return nil, err
+			}
+			v[idx] = elem
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+}
+
+func includePaths(include interface{}) ([]string, error) {
+	switch v := include.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		paths := make([]string, len(v))
+		for idx, elem := range v {
+			path, ok := elem.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v must be a path or list of paths", includeKey)
+			}
+			paths[idx] = path
+		}
+		return paths, nil
+	default:
+		return nil, fmt.Errorf("%v must be a path or list of paths", includeKey)
+	}
+}
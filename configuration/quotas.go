@@ -0,0 +1,75 @@
+package configuration
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// RootQuota is a soft quota on the number of vars reachable from a
+// root. Once usage passes SoftThreshold (a fraction of MaxVars), txns
+// which create vars are delayed, increasingly so as usage approaches
+// MaxVars, following a curve of the given Exponent. At or beyond
+// MaxVars the delay is MaxDelayMS. Txns are never rejected.
+type RootQuota struct {
+	Root          string
+	MaxVars       uint64
+	SoftThreshold float64
+	MaxDelayMS    uint64
+	Exponent      float64
+}
+
+const (
+	defaultQuotaSoftThreshold = 0.8
+	defaultQuotaMaxDelayMS    = 1000
+	defaultQuotaExponent      = 2
+)
+
+// Delay returns how long a txn which creates vars should be delayed
+// given the current number of vars reachable from the root.
+func (rq *RootQuota) Delay(vars uint64) time.Duration {
+	utilization := rq.Utilization(vars)
+	if utilization <= rq.SoftThreshold {
+		return 0
+	} else if utilization > 1 {
+		utilization = 1
+	}
+	fraction := math.Pow((utilization-rq.SoftThreshold)/(1-rq.SoftThreshold), rq.Exponent)
+	return time.Duration(fraction * float64(time.Duration(rq.MaxDelayMS)*time.Millisecond))
+}
+
+func (rq *RootQuota) Utilization(vars uint64) float64 {
+	return float64(vars) / float64(rq.MaxVars)
+}
+
+func LoadRootQuotasFromPath(path string) (map[string]*RootQuota, error) {
+	var quotas []*RootQuota
+	if err := LoadFromPath(path, FormatAuto, &quotas); err != nil {
+		return nil, err
+	}
+	result := make(map[string]*RootQuota, len(quotas))
+	for _, rq := range quotas {
+		if rq.Root == "" {
+			return nil, fmt.Errorf("Invalid quota configuration: Root must be given")
+		} else if _, found := result[rq.Root]; found {
+			return nil, fmt.Errorf("Invalid quota configuration: root %v given more than once", rq.Root)
+		} else if rq.MaxVars == 0 {
+			return nil, fmt.Errorf("Invalid quota configuration for root %v: MaxVars must be > 0", rq.Root)
+		}
+		if rq.SoftThreshold == 0 {
+			rq.SoftThreshold = defaultQuotaSoftThreshold
+		} else if rq.SoftThreshold < 0 || rq.SoftThreshold >= 1 {
+			return nil, fmt.Errorf("Invalid quota configuration for root %v: SoftThreshold must be >= 0 and < 1", rq.Root)
+		}
+		if rq.MaxDelayMS == 0 {
+			rq.MaxDelayMS = defaultQuotaMaxDelayMS
+		}
+		if rq.Exponent == 0 {
+			rq.Exponent = defaultQuotaExponent
+		} else if rq.Exponent < 0 {
+			return nil, fmt.Errorf("Invalid quota configuration for root %v: Exponent must be > 0", rq.Root)
+		}
+		result[rq.Root] = rq
+	}
+	return result, nil
+}
@@ -120,5 +120,5 @@ func (t *Topology) String() string {
 }
 
 func (t *Topology) IsBlank() bool {
-	return t == nil || t.MaxRMCount == 0 || t.RMs().NonEmptyLen() < int(t.TwoFInc)
+	return t == nil || t.MaxRMCount == 0 || t.VoterRMs().NonEmptyLen() < int(t.TwoFInc)
 }
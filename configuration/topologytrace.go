@@ -0,0 +1,57 @@
+package configuration
+
+import (
+	"encoding/json"
+	"fmt"
+	"goshawkdb.io/common"
+	"log"
+	"time"
+)
+
+// Topology transitions are driven independently by every node, and
+// the txns which record their progress are voted on by yet more
+// nodes, so working out why one stalled or failed means piecing
+// together the logs of the whole cluster. To make that possible,
+// each step of a transition is logged as a single line of JSON
+// tagged with the transition's trace id. The trace id is derived
+// from the version being transitioned to, so every node arrives at
+// the same id without coordination; it is also carried in every
+// topology txn, so that nodes which only vote on the txn can tag
+// what they see too. Merging the logs of all nodes and selecting a
+// trace id gives the full history of that transition.
+
+// TopologyTraceId returns the trace id of the transition to version.
+// Zero is never a valid trace id, and marks txns which are not
+// traced.
+func TopologyTraceId(version uint32) uint64 {
+	return uint64(version)
+}
+
+// TraceTopology logs event, as observed by rmId, in the history of the
+// transition traceId. fields are alternating names and values.
+func TraceTopology(traceId uint64, rmId common.RMId, event string, fields ...interface{}) {
+	if traceId == 0 {
+		return
+	}
+	entry := make(map[string]interface{}, 4+len(fields)/2)
+	for idx := 0; idx+1 < len(fields); idx += 2 {
+		value := fields[idx+1]
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		}
+		entry[fmt.Sprint(fields[idx])] = value
+	}
+	entry["trace"] = fmt.Sprintf("topology-v%d", traceId)
+	entry["rm"] = rmId.String()
+	entry["event"] = event
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("TopologyTrace: unable to encode %v event: %v", event, err)
+		return
+	}
+	log.Printf("TopologyTrace: %s", line)
+}
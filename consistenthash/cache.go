@@ -82,25 +82,44 @@ func (chc *ConsistentHashCache) Remove(vUUId *common.VarUUId) {
 // In here, we don't actually add to the cache because we don't know
 // if the corresponding txn is going to commit or not.
 func (chc *ConsistentHashCache) CreatePositions(vUUId *common.VarUUId, positionsLength int) (*common.Positions, []common.RMId, error) {
-	positionsCap := capn.NewBuffer(make([]byte, 0, positionsLength*2)).NewUInt8List(positionsLength)
+	return chc.resolvePositions(chc.randomPositions(positionsLength))
+}
+
+// CreatePositionsWithin is CreatePositions, but the positions created
+// resolve only to hashcodes within allowed. Positions beyond the
+// current hashcodes are random as usual, so should further hashcodes
+// be added to the topology later on, the var may move outside of
+// allowed.
+func (chc *ConsistentHashCache) CreatePositionsWithin(vUUId *common.VarUUId, positionsLength int, allowed common.RMIds) (*common.Positions, []common.RMId, error) {
+	positionsSlice := chc.randomPositions(positionsLength)
+	if err := chc.resolver.ConstrainPositions(positionsSlice, allowed, chc.rng); err != nil {
+		return nil, nil, err
+	}
+	return chc.resolvePositions(positionsSlice)
+}
+
+func (chc *ConsistentHashCache) randomPositions(positionsLength int) []uint8 {
 	positionsSlice := make([]uint8, positionsLength)
 	n, entropy := uint64(chc.rng.Int63()), uint64(server.TwoToTheSixtyThree)
 	for idx := range positionsSlice {
-		if idx == 0 {
-			positionsCap.Set(idx, 0)
-			positionsSlice[idx] = 0
-		} else {
+		if idx != 0 {
 			idy := uint64(idx + 1)
 			if entropy < uint64(idy) {
 				n, entropy = uint64(chc.rng.Int63()), server.TwoToTheSixtyThree
 			}
-			pos := uint8(n % idy)
+			positionsSlice[idx] = uint8(n % idy)
 			n = n / idy
 			entropy = entropy / uint64(idy)
-			positionsCap.Set(idx, pos)
-			positionsSlice[idx] = pos
 		}
 	}
+	return positionsSlice
+}
+
+func (chc *ConsistentHashCache) resolvePositions(positionsSlice []uint8) (*common.Positions, []common.RMId, error) {
+	positionsCap := capn.NewBuffer(make([]byte, 0, len(positionsSlice)*2)).NewUInt8List(len(positionsSlice))
+	for idx, pos := range positionsSlice {
+		positionsCap.Set(idx, pos)
+	}
 	positions := (*common.Positions)(&positionsCap)
 	hashCodes, err := chc.resolver.ResolveHashCodes(positionsSlice)
 	if err == nil {
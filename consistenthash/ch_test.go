@@ -78,6 +78,43 @@ func isPermutationPrefixOf(perm, hashcodes []common.RMId, l int) bool {
 	return len(freq) == 0
 }
 
+func TestConstrainPositions(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	workingHashCodes := make([]common.RMId, 12)
+	copy(workingHashCodes, hashcodes)
+	workingHashCodes[3] = common.RMIdEmpty
+	workingHashCodes[7] = common.RMIdEmpty
+	allowed := common.RMIds{hashcodes[0], hashcodes[2], hashcodes[5], hashcodes[6], hashcodes[10]}
+
+	for l := 1; l <= len(allowed); l++ {
+		res := NewResolver(workingHashCodes, uint16(l))
+		for idx := 0; idx < 1000; idx++ {
+			positions := make([]uint8, len(randomPositions[idx]))
+			copy(positions, randomPositions[idx])
+			if err := res.ConstrainPositions(positions, allowed, rng); err != nil {
+				t.Fatal(err)
+			}
+			for idy, pos := range positions {
+				if int(pos) > idy {
+					t.Fatal("Illegal position", positions)
+				}
+			}
+			perm, err := res.ResolveHashCodes(positions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isPermutationPrefixOf(perm, allowed, l) {
+				t.Fatal("Not within allowed hashcodes", perm, allowed, positions, l)
+			}
+		}
+	}
+
+	res := NewResolver(workingHashCodes, uint16(len(allowed)+1))
+	if err := res.ConstrainPositions(make([]uint8, len(workingHashCodes)), allowed, rng); err == nil {
+		t.Fatal("Expected too few allowed hashcodes to be an error")
+	}
+}
+
 func BenchmarkHash4_4(b *testing.B) {
 	benchmarkHash(NewResolver(hashcodes[:4], 4), b)
 }
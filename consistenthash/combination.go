@@ -52,6 +52,7 @@ type CombinationPicker struct {
 	rmIdToOverProvision map[common.RMId]*[]*int
 	disabledHashCodes   map[common.RMId]bool
 	excluded            common.RMIds
+	avoid               map[common.RMId]server.EmptyStruct
 	errored             bool
 }
 
@@ -91,6 +92,13 @@ func (cp *CombinationPicker) AddPermutation(perm common.RMIds) {
 	}
 }
 
+// Avoid asks Choose to exclude rmIds wherever that still leaves
+// desiredLen RMIds of every permutation. Unlike disabled hash codes,
+// avoided RMIds are used if they must be.
+func (cp *CombinationPicker) Avoid(rmIds map[common.RMId]server.EmptyStruct) {
+	cp.avoid = rmIds
+}
+
 // Consider that the lists here will always be the same length, and
 // will be zipped together to pairs when used. I.e. this is a cheap
 // way of doing a map in which we never need to do random lookups.
@@ -134,9 +142,30 @@ func (cp *CombinationPicker) Choose() (common.RMIds, common.RMIds, error) {
 		return nil, nil, TooManyDisabledHashCodes
 	}
 
+	excluded := cp.excluded
+	for rmId := range cp.avoid {
+		overProvisions, found := cp.rmIdToOverProvision[rmId]
+		if !found {
+			continue
+		}
+		removable := true
+		for _, op := range *overProvisions {
+			if *op <= 0 {
+				removable = false
+				break
+			}
+		}
+		if removable {
+			excluded = append(excluded, rmId)
+			for _, op := range *overProvisions {
+				(*op)--
+			}
+			delete(cp.rmIdToOverProvision, rmId)
+		}
+	}
+
 	freqs, freqToRMOPLs := cp.freqAnalysis()
 	included := make([]common.RMId, 0, cp.desiredLen)
-	excluded := cp.excluded
 
 	for _, freq := range freqs {
 		r2opls := freqToRMOPLs[freq]
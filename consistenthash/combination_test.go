@@ -250,6 +250,43 @@ func TestCombinationDisabled(t *testing.T) {
 	}
 }
 
+func TestCombinationAvoid(t *testing.T) {
+	permA, permB := []common.RMId{hashcodes[0], hashcodes[1], hashcodes[2]}, []common.RMId{hashcodes[2], hashcodes[1], hashcodes[0]}
+	disabled := make(map[common.RMId]server.EmptyStruct)
+	avoid := make(map[common.RMId]server.EmptyStruct)
+	avoid[hashcodes[0]] = server.EmptyStructVal
+
+	cp := NewCombinationPicker(2, disabled)
+	cp.Avoid(avoid)
+	cp.AddPermutation(permA)
+	cp.AddPermutation(permB)
+	inc, exc, err := cp.Choose()
+	if err != nil {
+		t.Fatal(err)
+	}
+	perm := []common.RMId{hashcodes[1], hashcodes[2]}
+	if !isPermutationOf(inc, perm) {
+		t.Errorf("Expecting combination to be permutation of %v, but was actually %v", perm, inc)
+	}
+	if len(exc) != 1 || exc[0] != hashcodes[0] {
+		t.Errorf("Expecting exclusion to be %v, but was actually %v", []common.RMId{hashcodes[0]}, exc)
+	}
+
+	// Avoided RMIds are still used if they must be.
+	avoid[hashcodes[1]] = server.EmptyStructVal
+	cp = NewCombinationPicker(2, disabled)
+	cp.Avoid(avoid)
+	cp.AddPermutation(permA)
+	cp.AddPermutation(permB)
+	inc, exc, err = cp.Choose()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inc) != 2 || len(exc) != 1 || !(inc[0] == hashcodes[2] || inc[1] == hashcodes[2]) {
+		t.Errorf("Expecting combination of length 2 including %v, but was actually %v (excluded %v)", hashcodes[2], inc, exc)
+	}
+}
+
 func isPermutationOf(perm, hashcodes []common.RMId) bool {
 	if len(perm) != len(hashcodes) {
 		return false
@@ -3,6 +3,8 @@ package consistenthash
 import (
 	"fmt"
 	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"math/rand"
 	"sort"
 )
 
@@ -124,3 +126,57 @@ func (r *Resolver) RMIdHasVar(rmIdIdx int, positions []uint8) (bool, error) {
 	}
 	return false, nil
 }
+
+// ConstrainPositions rewrites the first len(hashCodes) positions so
+// that they resolve only to hashcodes within allowed, which must
+// contain at least desiredLength of our non-empty hashcodes. The
+// positions select a slot for each hashcode, and a resolution is
+// the first desiredLength non-empty hashcodes in slot order. So we
+// give randomly ordered allowed hashcodes the lowest slots, the rest
+// the remaining slots, and then invert that back to positions.
+func (r *Resolver) ConstrainPositions(positions []uint8, allowed common.RMIds, rng *rand.Rand) error {
+	hcLen := len(r.hashCodes)
+	if hcLen > len(positions) {
+		return InsufficientPositionsError
+	}
+	allowedMap := make(map[common.RMId]server.EmptyStruct, len(allowed))
+	for _, rmId := range allowed {
+		if rmId != common.RMIdEmpty {
+			allowedMap[rmId] = server.EmptyStructVal
+		}
+	}
+	preferred := make([]int, 0, hcLen)
+	others := make([]int, 0, hcLen)
+	for depth, rmId := range r.hashCodes {
+		if _, found := allowedMap[rmId]; found {
+			preferred = append(preferred, depth)
+		} else {
+			others = append(others, depth)
+		}
+	}
+	if len(preferred) < r.desiredLength {
+		return fmt.Errorf("Too few allowed hashcodes: %v of %v are allowed but need at least %v", allowed, r.hashCodes, r.desiredLength)
+	}
+
+	slots := make([]uint16, hcLen)
+	slot := uint16(0)
+	for _, depths := range [][]int{preferred, others} {
+		for _, idx := range rng.Perm(len(depths)) {
+			slots[depths[idx]] = slot
+			slot++
+		}
+	}
+
+	indices := make([]uint16, hcLen)
+	copy(indices, r.indices)
+	for depth := hcLen - 1; depth >= 0; depth-- {
+		for position, index := range indices[:depth+1] {
+			if index == slots[depth] {
+				positions[depth] = uint8(position)
+				copy(indices[position:], indices[position+1:])
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -17,7 +17,98 @@ const (
 	VarRollForceNotFirstAfter     = time.Second
 	ConnectionRestartDelayRangeMS = 5000
 	ConnectionRestartDelayMin     = 3 * time.Second
+	ServerLinks                   = 1
+	ServerLinkEstablishTimeout    = 10 * time.Second
+	ClientMessageMaxSize          = 67108864
+	ServerMessageMaxSize          = 268435456
+	VoteBatchWindow               = 500 * time.Microsecond
+	VoteBatchMaxVotes             = 64
 	MostRandomByteIndex           = 7 // will be the lsb of a big-endian client-n in the txnid.
 	MigrationBatchElemCount       = 64
+	ImmigrationMemoryBudget       = 256 * 1024 * 1024
+	MigrationSpaceHeadroom        = 1.5
 	PoissonSamples                = 64
+	RESTGatewayMaxAttempts        = 16
+	RESTGatewayMaxBodySize        = 16777216
+	RESTDeleteBatchSize           = 64
+	RESTDeleteVarsPerSecond       = 1024
+	OutcomeAccumulatorHighWater   = 65536
+	OutcomeAccumulatorLowWater    = 49152
+	OutcomeAccumulatorPauseMax    = 500 * time.Millisecond
+	StorageAccountingInterval     = 10 * time.Minute
+	StorageAccountingBatchSize    = 256
+	StorageAccountingBatchDelay   = 10 * time.Millisecond
+	WidestVarsReported            = 16
+	IdempotencyKeyTTL             = 24 * time.Hour
+	IdempotencyKeysPerFingerprint = 1024
+	IdempotencyKeyMaxLength       = 256
+	DiscoveryGroupAddr            = "239.255.71.68:7893"
+	DiscoveryAnnounceInterval     = time.Second
+	DiscoveryLinger               = 30 * time.Second
+	PaxosCaptureFileSize          = 268435456
+	SessionLogFileSize            = 16777216
+	ClientHandshakeRate           = 256
+	ClientHandshakeBurstFraction  = 0.25
+	ClientSessionKeyRotation      = 24 * time.Hour
+	ClientReconnectMinDelay       = time.Second
+	ClientReconnectMaxDelay       = time.Minute
+	CrashReportLogLines           = 256
+	ValueCompressionMinSize       = 256
+	GCInterval                    = time.Hour
+	GCGracePeriod                 = 24 * time.Hour
+	GCBatchSize                   = 256
+	GCBatchDelay                  = 10 * time.Millisecond
+	GCMaxAttempts                 = 16
+	MetricsRootName               = "system:metrics"
+	MetricsPublishInterval        = time.Minute
+	MetricsSamplesRetained        = 60
+	MetricsMaxAttempts            = 16
+	ClusterEventsRootName         = "system:events"
+	ClusterEventsRetained         = 256
+	ClusterEventsMaxAttempts      = 16
+	ClusterEventsQueueMax         = 1024
+	NodeStatsRootName             = "system:stats"
+	NodeStatsInterval             = 30 * time.Second
+	NodeStatsMaxAttempts          = 16
+	TopologyRequestRootName       = "system:topology-request"
+	TopologyRequestPollInterval   = 5 * time.Second
+	TopologyRequestMaxAttempts    = 16
+	SystemRootPrefix              = "system:"
+	RootRelocationMaxAttempts     = 16
+	MetricsExportInterval         = 10 * time.Second
+	MetricsExportTimeout          = 5 * time.Second
+	MetricsExportStatsDPacketSize = 1432
+	DBReaderWarnThreshold         = 30 * time.Second
+	DBReaderDeadline              = 10 * time.Minute
+	DBReaderCheckInterval         = time.Second
+	DiskCheckInterval             = 5 * time.Second
+	DiskSlowThreshold             = 250 * time.Millisecond
+	DiskSlowPeriod                = time.Minute
+	DiskLatencySampleRate         = 8
+	DiskLatencySamplesMax         = 4096
+	DiskLatencySamplesMin         = 16
+	AuditTimeout                  = 30 * time.Second
+	AuditRecheckDelay             = 5 * time.Second
+	AuditMaxVars                  = 65536
+	AuditScanBatch                = 1024
+	ContentionStatusVars          = 8
+	ContentionReportVars          = 64
+	ContentionTxnIdsMax           = 16
+	TxnJournalFlushInterval       = 100 * time.Millisecond
+	TxnJournalPruneInterval       = time.Minute
+	TxnJournalBatchSize           = 256
+	TxnJournalQueryLimit          = 1024
+	FrozenVarsCacheLimit          = 65536
+	ClientDriftWarnInterval       = time.Minute
+	PeerQualityPingWindow         = 16
+	PeerQualityMaxMissingBeats    = 6
+	PeerQualityLossDelayScale     = 4
+	VarBalanceCandidates          = 8
+	StandbyCheckInterval          = 30 * time.Second
+	StandbyLagWarn                = 5 * time.Minute
+	MemoryPressureCheckInterval   = 5 * time.Second
+	MemoryPressureRollsPerManager = 256
+	HotVarsWarmupBudget           = 16384
+	HotVarsPersistInterval        = time.Minute
+	HotVarsWarmBatch              = 256
 )
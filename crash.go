@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CrashReportDir is the directory into which crash reports are
+// written. If empty, reports are only logged.
+var CrashReportDir string
+
+// RecentLog retains the most recent lines logged, so that they can
+// be included in crash reports. It must be added as a log output to
+// be of any use.
+var RecentLog = NewLogRing(CrashReportLogLines)
+
+// LogRing is an io.Writer which retains the last few lines written.
+type LogRing struct {
+	sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func NewLogRing(size int) *LogRing {
+	return &LogRing{lines: make([]string, size)}
+}
+
+func (lr *LogRing) Write(p []byte) (int, error) {
+	lr.Lock()
+	defer lr.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		lr.lines[lr.next] = line
+		lr.next++
+		if lr.next == len(lr.lines) {
+			lr.next = 0
+			lr.full = true
+		}
+	}
+	return len(p), nil
+}
+
+// Lines returns the retained lines, oldest first.
+func (lr *LogRing) Lines() []string {
+	lr.Lock()
+	defer lr.Unlock()
+	if !lr.full {
+		return append([]string{}, lr.lines[:lr.next]...)
+	}
+	return append(append([]string{}, lr.lines[lr.next:]...), lr.lines[:lr.next]...)
+}
+
+// A CrashReport records a panic caught at a panic boundary.
+type CrashReport struct {
+	Time      time.Time
+	Subsystem string
+	Context   string
+	Panic     string
+	Stack     string
+	RecentLog []string
+	Path      string `json:"-"`
+}
+
+// Guard runs fun within a panic boundary. If fun panics, a crash
+// report is written and returned, and it is up to the caller to
+// decide whether it is safe to carry on (for example, by restarting
+// the actor) or whether the process must exit (see Fatal). context
+// may be nil; it is only evaluated if fun panics.
+func Guard(subsystem string, context fmt.Stringer, fun func()) (report *CrashReport) {
+	defer func() {
+		if r := recover(); r != nil {
+			report = &CrashReport{
+				Time:      time.Now(),
+				Subsystem: subsystem,
+				Panic:     fmt.Sprint(r),
+				Stack:     string(debug.Stack()),
+				RecentLog: RecentLog.Lines(),
+			}
+			if context != nil {
+				report.Context = context.String()
+			}
+			report.write()
+		}
+	}()
+	fun()
+	return nil
+}
+
+func (report *CrashReport) write() {
+	log.Printf("Panic in %v (%v): %v", report.Subsystem, report.Context, report.Panic)
+	if CrashReportDir == "" {
+		log.Printf("Crash report:\n%s", report.Stack)
+		return
+	}
+	report.Path = filepath.Join(CrashReportDir, fmt.Sprintf("crash-%v-%v.json", report.Time.Format("20060102T150405.000000"), report.Subsystem))
+	if b, err := json.MarshalIndent(report, "", "  "); err != nil {
+		log.Println("Unable to encode crash report:", err)
+	} else if err = ioutil.WriteFile(report.Path, b, 0600); err != nil {
+		log.Println("Unable to write crash report:", err)
+		log.Printf("Crash report:\n%s", report.Stack)
+	} else {
+		log.Println("Crash report written to", report.Path)
+	}
+}
+
+// Fatal exits the process, for use when a panic has left state which
+// can not be safely recovered.
+func (report *CrashReport) Fatal() {
+	log.Printf("Exiting due to unrecoverable panic in %v.", report.Subsystem)
+	os.Exit(2)
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	mdb "github.com/msackman/gomdb"
+	"syscall"
+)
+
+// UsedBytes returns the number of bytes of the environment's map
+// which are in use: that is, up to and including the last page
+// written.
+func (db *Databases) UsedBytes() (uint64, error) {
+	result, err := db.WithEnv(func(env *mdb.Env) (interface{}, error) {
+		info, err := env.Info()
+		if err != nil {
+			return nil, err
+		}
+		stat, err := env.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return uint64(info.LastPNO+1) * uint64(stat.PSize), nil
+	}).ResultError()
+	if err != nil {
+		return 0, err
+	}
+	return result.(uint64), nil
+}
+
+// EnsureMapSize grows the environment's map so that it is at least
+// size bytes. The map is otherwise only grown once it is full, which
+// during a bulk load such as immigration means growing it many times
+// over.
+func (db *Databases) EnsureMapSize(size uint64) error {
+	_, err := db.WithEnv(func(env *mdb.Env) (interface{}, error) {
+		info, err := env.Info()
+		if err != nil {
+			return nil, err
+		}
+		if uint64(info.MapSize) >= size {
+			return nil, nil
+		}
+		return nil, env.SetMapSize(size)
+	}).ResultError()
+	return err
+}
+
+// FreeDiskBytes returns the number of bytes available to us on the
+// filesystem holding dir.
+func FreeDiskBytes(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -6,24 +6,38 @@ import (
 
 type Databases struct {
 	*mdbs.MDBServer
-	Vars            *mdbs.DBISettings
-	Proposers       *mdbs.DBISettings
-	BallotOutcomes  *mdbs.DBISettings
-	Transactions    *mdbs.DBISettings
-	TransactionRefs *mdbs.DBISettings
+	Vars               *mdbs.DBISettings
+	Proposers          *mdbs.DBISettings
+	BallotOutcomes     *mdbs.DBISettings
+	Transactions       *mdbs.DBISettings
+	TransactionRefs    *mdbs.DBISettings
+	IdempotencyKeys    *mdbs.DBISettings
+	TxnJournal         *mdbs.DBISettings
+	ConfigHistory      *mdbs.DBISettings
+	ImmigrationBatches *mdbs.DBISettings
+	ImmigrationStaging *mdbs.DBISettings
+	readers            *readerTracker
+	writes             *writeTracker
 }
 
 var (
-	DB = &Databases{}
+	DB = &Databases{readers: newReaderTracker(), writes: newWriteTracker()}
 )
 
 func (db *Databases) Clone() mdbs.DBIsInterface {
 	return &Databases{
-		Vars:            db.Vars.Clone(),
-		Proposers:       db.Proposers.Clone(),
-		BallotOutcomes:  db.BallotOutcomes.Clone(),
-		Transactions:    db.Transactions.Clone(),
-		TransactionRefs: db.TransactionRefs.Clone(),
+		Vars:               db.Vars.Clone(),
+		Proposers:          db.Proposers.Clone(),
+		BallotOutcomes:     db.BallotOutcomes.Clone(),
+		Transactions:       db.Transactions.Clone(),
+		TransactionRefs:    db.TransactionRefs.Clone(),
+		IdempotencyKeys:    db.IdempotencyKeys.Clone(),
+		TxnJournal:         db.TxnJournal.Clone(),
+		ConfigHistory:      db.ConfigHistory.Clone(),
+		ImmigrationBatches: db.ImmigrationBatches.Clone(),
+		ImmigrationStaging: db.ImmigrationStaging.Clone(),
+		readers:            db.readers,
+		writes:             db.writes,
 	}
 }
 
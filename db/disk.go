@@ -0,0 +1,186 @@
+package db
+
+import (
+	"fmt"
+	mdbs "github.com/msackman/gomdb/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/server"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	writeSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "goshawkdb",
+		Name:      "db_write_seconds",
+		Help:      "Time from submission of sampled read-write txns until they have run.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+	})
+	writeP99Seconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "db_write_p99_seconds",
+		Help:      "99th percentile of db_write_seconds over the last check.",
+	})
+	diskDegraded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "disk_degraded",
+		Help:      "1 if this node's disk is currently considered degraded, otherwise 0.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(writeSeconds)
+	prometheus.MustRegister(writeP99Seconds)
+	prometheus.MustRegister(diskDegraded)
+}
+
+// The MDBServer runs read-write txns one batch at a time, and a batch
+// can't start until the previous batch has been committed and synced
+// to disk. So the time from submitting a read-write txn until it runs
+// grows with the latency of the disk. writeTracker samples this time.
+type writeTracker struct {
+	sync.Mutex
+	count   uint64 // atomic
+	samples []time.Duration
+}
+
+func newWriteTracker() *writeTracker {
+	return &writeTracker{}
+}
+
+// ReadWriteTransaction runs txnFunc in a read-write txn, exactly as
+// the MDBServer does, but samples how long it waits to run.
+func (db *Databases) ReadWriteTransaction(forceCommit bool, txnFunc func(rwtxn *mdbs.RWTxn) interface{}) mdbs.TransactionFuture {
+	if atomic.AddUint64(&db.writes.count, 1)%server.DiskLatencySampleRate != 0 {
+		return db.MDBServer.ReadWriteTransaction(forceCommit, txnFunc)
+	}
+	submitted := time.Now()
+	return db.MDBServer.ReadWriteTransaction(forceCommit, func(rwtxn *mdbs.RWTxn) interface{} {
+		db.writes.add(time.Since(submitted))
+		return txnFunc(rwtxn)
+	})
+}
+
+func (wt *writeTracker) add(latency time.Duration) {
+	writeSeconds.Observe(latency.Seconds())
+	wt.Lock()
+	if len(wt.samples) < server.DiskLatencySamplesMax {
+		wt.samples = append(wt.samples, latency)
+	}
+	wt.Unlock()
+}
+
+// p99 returns the 99th percentile of the samples taken since the last
+// call, and the number of samples.
+func (wt *writeTracker) p99() (time.Duration, int) {
+	wt.Lock()
+	samples := wt.samples
+	wt.samples = nil
+	wt.Unlock()
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	sort.Sort(durations(samples))
+	return samples[(len(samples)*99)/100], len(samples)
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// DiskMonitor periodically checks the latency of read-write txns. If
+// the 99th percentile stays above threshold for period, the disk is
+// considered degraded, until the 99th percentile stays at or below
+// threshold for period again. Checks with too few samples to be
+// meaningful change nothing. onChange is called (from the monitor's
+// own go-routine) every time the disk becomes or ceases to be
+// degraded.
+type DiskMonitor struct {
+	sync.Mutex
+	db         *Databases
+	threshold  time.Duration
+	period     time.Duration
+	onChange   func(degraded bool)
+	degraded   bool
+	since      time.Time
+	lastP99    time.Duration
+	terminate  chan struct{}
+	terminated chan struct{}
+}
+
+func (db *Databases) MonitorDisk(threshold, period time.Duration, onChange func(degraded bool)) *DiskMonitor {
+	dm := &DiskMonitor{
+		db:         db,
+		threshold:  threshold,
+		period:     period,
+		onChange:   onChange,
+		terminate:  make(chan struct{}),
+		terminated: make(chan struct{}),
+	}
+	go dm.run()
+	return dm
+}
+
+func (dm *DiskMonitor) Shutdown() {
+	close(dm.terminate)
+	<-dm.terminated
+}
+
+func (dm *DiskMonitor) Status(sc *server.StatusConsumer) {
+	dm.Lock()
+	defer dm.Unlock()
+	sc.Emit(fmt.Sprintf("Disk degraded: %v (write p99 %v; threshold %v for %v)", dm.degraded, dm.lastP99, dm.threshold, dm.period))
+	sc.Join()
+}
+
+func (dm *DiskMonitor) run() {
+	defer close(dm.terminated)
+	ticker := time.NewTicker(server.DiskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dm.terminate:
+			return
+		case <-ticker.C:
+		}
+		p99, count := dm.db.writes.p99()
+		if count < server.DiskLatencySamplesMin {
+			continue
+		}
+		writeP99Seconds.Set(p99.Seconds())
+		now := time.Now()
+		dm.Lock()
+		dm.lastP99 = p99
+		changed := false
+		// since is when p99 started disagreeing with our current state.
+		if slow := p99 > dm.threshold; slow == dm.degraded {
+			dm.since = time.Time{}
+		} else if dm.since.IsZero() {
+			dm.since = now
+		} else if now.Sub(dm.since) >= dm.period {
+			dm.degraded = slow
+			dm.since = time.Time{}
+			changed = true
+		}
+		degraded := dm.degraded
+		dm.Unlock()
+		if !changed {
+			continue
+		}
+		if degraded {
+			diskDegraded.Set(1)
+			log.Printf("Warning: disk degraded: write p99 of %v has exceeded %v for at least %v.\n", p99, dm.threshold, dm.period)
+		} else {
+			diskDegraded.Set(0)
+			log.Printf("Disk recovered: write p99 of %v has been within %v for at least %v.\n", p99, dm.threshold, dm.period)
+		}
+		if dm.onChange != nil {
+			dm.onChange(degraded)
+		}
+	}
+}
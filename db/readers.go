@@ -0,0 +1,225 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	mdb "github.com/msackman/gomdb"
+	mdbs "github.com/msackman/gomdb/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/server"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var (
+	readersOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "db_readers_open",
+		Help:      "Number of readonly txns currently open.",
+	})
+	readerSlots = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "db_reader_slots_used",
+		Help:      "Number of LMDB reader slots in use.",
+	})
+	readerSlotsMax = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "db_reader_slots_max",
+		Help:      "Number of LMDB reader slots available.",
+	})
+	readerSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "goshawkdb",
+		Name:      "db_reader_seconds",
+		Help:      "Time readonly txns are held open.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 14),
+	})
+	readersLong = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "db_readers_long_total",
+		Help:      "Number of readonly txns held open beyond the warning threshold.",
+	})
+	readersExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "db_readers_expired_total",
+		Help:      "Number of readonly txns expired for being held open beyond the deadline.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(readersOpen)
+	prometheus.MustRegister(readerSlots)
+	prometheus.MustRegister(readerSlotsMax)
+	prometheus.MustRegister(readerSeconds)
+	prometheus.MustRegister(readersLong)
+	prometheus.MustRegister(readersExpired)
+}
+
+var ErrReaderExpired = errors.New("Readonly txn held open beyond the reader deadline")
+
+// A readonly txn holds an LMDB reader slot for as long as it is
+// open, and prevents pages freed by later writes from being reused,
+// so the database grows. readerTracker records every open readonly
+// txn so that the ReaderMonitor can find those held for too long.
+type readerTracker struct {
+	sync.Mutex
+	open map[*mdbs.RTxn]*reader
+}
+
+type reader struct {
+	started time.Time
+	caller  uintptr
+	warned  bool
+	expired bool
+}
+
+func newReaderTracker() *readerTracker {
+	return &readerTracker{
+		open: make(map[*mdbs.RTxn]*reader),
+	}
+}
+
+// ReadonlyTransaction runs txnFunc in a readonly txn, exactly as the
+// MDBServer does, but tracks the txn whilst it is open.
+func (db *Databases) ReadonlyTransaction(txnFunc func(rtxn *mdbs.RTxn) interface{}) mdbs.TransactionFuture {
+	pcs := []uintptr{0}
+	runtime.Callers(2, pcs)
+	return db.MDBServer.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+		db.readers.add(rtxn, pcs[0])
+		defer db.readers.remove(rtxn)
+		return txnFunc(rtxn)
+	})
+}
+
+// ReaderExpired returns true iff rtxn has been held open beyond the
+// reader deadline. LMDB offers no way to abort a txn from outside, so
+// txn funcs which may run for a long time (for example, those
+// iterating with a cursor) should check this periodically, and if it
+// returns true, abandon the txn with ErrReaderExpired.
+func (db *Databases) ReaderExpired(rtxn *mdbs.RTxn) bool {
+	return db.readers.expired(rtxn)
+}
+
+func (rt *readerTracker) add(rtxn *mdbs.RTxn, caller uintptr) {
+	rt.Lock()
+	rt.open[rtxn] = &reader{started: time.Now(), caller: caller}
+	rt.Unlock()
+	readersOpen.Inc()
+}
+
+func (rt *readerTracker) remove(rtxn *mdbs.RTxn) {
+	rt.Lock()
+	r := rt.open[rtxn]
+	delete(rt.open, rtxn)
+	rt.Unlock()
+	readersOpen.Dec()
+	readerSeconds.Observe(time.Since(r.started).Seconds())
+}
+
+func (rt *readerTracker) expired(rtxn *mdbs.RTxn) bool {
+	rt.Lock()
+	defer rt.Unlock()
+	r, found := rt.open[rtxn]
+	return found && r.expired
+}
+
+// check warns about readers held open beyond warn, and marks as
+// expired those held open beyond deadline (if non-zero).
+func (rt *readerTracker) check(warn, deadline time.Duration) {
+	rt.Lock()
+	defer rt.Unlock()
+	now := time.Now()
+	for _, r := range rt.open {
+		age := now.Sub(r.started)
+		if age >= warn && !r.warned {
+			r.warned = true
+			readersLong.Inc()
+			log.Printf("Warning: readonly txn from %v held open for %v.", r.callerName(), age)
+		}
+		if deadline > 0 && age >= deadline && !r.expired {
+			r.expired = true
+			readersExpired.Inc()
+			log.Printf("Readonly txn from %v held open for %v: expiring.", r.callerName(), age)
+		}
+	}
+}
+
+func (r *reader) callerName() string {
+	if f := runtime.FuncForPC(r.caller); f != nil {
+		file, line := f.FileLine(r.caller)
+		return fmt.Sprintf("%v (%v:%v)", f.Name(), file, line)
+	}
+	return "unknown"
+}
+
+// ReaderMonitor periodically checks the readonly txns open on the
+// Databases, and reports the use of LMDB reader slots. Slots left
+// behind by processes which died with txns open are cleared.
+type ReaderMonitor struct {
+	db         *Databases
+	warn       time.Duration
+	deadline   time.Duration
+	terminate  chan struct{}
+	terminated chan struct{}
+}
+
+func (db *Databases) MonitorReaders(warn, deadline time.Duration) *ReaderMonitor {
+	rm := &ReaderMonitor{
+		db:         db,
+		warn:       warn,
+		deadline:   deadline,
+		terminate:  make(chan struct{}),
+		terminated: make(chan struct{}),
+	}
+	go rm.run()
+	return rm
+}
+
+func (rm *ReaderMonitor) Shutdown() {
+	close(rm.terminate)
+	<-rm.terminated
+}
+
+func (rm *ReaderMonitor) Status(sc *server.StatusConsumer) {
+	rm.db.readers.Lock()
+	open := len(rm.db.readers.open)
+	rm.db.readers.Unlock()
+	deadline := "none"
+	if rm.deadline > 0 {
+		deadline = rm.deadline.String()
+	}
+	sc.Emit(fmt.Sprintf("Readonly txns open: %v (warn after %v; deadline %v)", open, rm.warn, deadline))
+	sc.Join()
+}
+
+func (rm *ReaderMonitor) run() {
+	defer close(rm.terminated)
+	ticker := time.NewTicker(server.DBReaderCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rm.terminate:
+			return
+		case <-ticker.C:
+		}
+		rm.db.readers.check(rm.warn, rm.deadline)
+		_, err := rm.db.WithEnv(func(env *mdb.Env) (interface{}, error) {
+			if cleared, err := env.ReaderCheck(); err != nil {
+				return nil, err
+			} else if cleared > 0 {
+				log.Printf("Cleared %v stale LMDB reader slots.", cleared)
+			}
+			info, err := env.Info()
+			if err != nil {
+				return nil, err
+			}
+			readerSlots.Set(float64(info.NumReaders))
+			readerSlotsMax.Set(float64(info.MaxReaders))
+			return nil, nil
+		}).ResultError()
+		if err != nil {
+			log.Println("Error when checking LMDB readers:", err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	mdb "github.com/msackman/gomdb"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	dataFileName = "data.mdb"
+	// RelocatedFileName is left in a data directory whose contents
+	// have been copied elsewhere. It contains the path of the new
+	// data directory.
+	RelocatedFileName = "relocated"
+)
+
+// The files, besides the LMDB environment, in which a node keeps its
+// own state in its data directory. Anything which keeps state in the
+// data directory must name its file here, so that CopyNodeStateTo
+// (and thus relocation) carries it over.
+const (
+	RMIdFileName         = "rmid"
+	BootCountFileName    = "bootcount"
+	DecommissionFileName = "decommission"
+	HotVarsFileName      = "hotvars"
+)
+
+var nodeStateFileNames = []string{RMIdFileName, BootCountFileName, DecommissionFileName, HotVarsFileName}
+
+// CopyTo makes a consistent copy of the environment (found in srcDir)
+// into dstDir, which must exist and be empty. Whilst the copy is in
+// progress, progress is called periodically with the number of bytes
+// copied so far and the size of the source. The copy is consistent
+// with respect to committed LMDB txns, but writes committed after
+// the copy starts are not included: callers which need an exact copy
+// must stop writing first.
+func (db *Databases) CopyTo(srcDir, dstDir string, progress func(copied, total int64)) error {
+	total := int64(0)
+	if info, err := os.Stat(filepath.Join(srcDir, dataFileName)); err == nil {
+		total = info.Size()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if progress != nil {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if info, err := os.Stat(filepath.Join(dstDir, dataFileName)); err == nil {
+						progress(info.Size(), total)
+					}
+				}
+			}
+		}()
+	}
+
+	_, err := db.WithEnv(func(env *mdb.Env) (interface{}, error) {
+		return nil, env.Copy(dstDir)
+	}).ResultError()
+	if err == nil && progress != nil {
+		progress(total, total)
+	}
+	return err
+}
+
+// CopyNodeStateTo copies the node's state files which exist in srcDir
+// into dstDir, preserving their permissions.
+func CopyNodeStateTo(srcDir, dstDir string) error {
+	for _, name := range nodeStateFileNames {
+		src := filepath.Join(srcDir, name)
+		info, err := os.Stat(src)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(filepath.Join(dstDir, name), b, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
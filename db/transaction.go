@@ -13,6 +13,11 @@ func init() {
 	DB.TransactionRefs = &mdbs.DBISettings{Flags: mdb.CREATE}
 }
 
+// Txn payloads are stored once in Transactions, no matter how many
+// var frames refer to them. TransactionRefs holds a big-endian uint32
+// count of the references to each payload: WriteTxnToDisk stores the
+// payload only when the count is first created, and DeleteTxnFromDisk
+// removes it only when the count falls to zero.
 func (db *Databases) WriteTxnToDisk(rwtxn *mdbs.RWTxn, txnId *common.TxnId, txnBites []byte) error {
 	bites, err := rwtxn.Get(db.TransactionRefs, txnId[:])
 
@@ -1,22 +1,68 @@
 package dispatcher
 
 import (
+	"fmt"
 	cc "github.com/msackman/chancell"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/server"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var (
+	executorBusySeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "executor_busy_seconds_total",
+		Help:      "Time each executor has spent running work. Its rate is the utilization of the executor.",
+	}, []string{"executor"})
+	executorTasks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "executor_tasks_total",
+		Help:      "Number of pieces of work each executor has run.",
+	}, []string{"executor"})
+	executorQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "executor_queue_length",
+		Help:      "Number of pieces of work waiting for each executor.",
+	}, []string{"executor"})
+	executorQueueWaitSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "goshawkdb",
+		Name:      "executor_queue_wait_seconds",
+		Help:      "Time pieces of work have waited in each executor's queue before being run.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 12),
+	}, []string{"executor"})
+	executorQueueOverflows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "executor_queue_overflows_total",
+		Help:      "Number of pieces of work offered to each executor when its queue was full, by what happened to them: blocked, dropped or rejected.",
+	}, []string{"executor", "action"})
+)
+
+func init() {
+	prometheus.MustRegister(executorBusySeconds)
+	prometheus.MustRegister(executorTasks)
+	prometheus.MustRegister(executorQueueLength)
+	prometheus.MustRegister(executorQueueWaitSeconds)
+	prometheus.MustRegister(executorQueueOverflows)
+}
+
 type Dispatcher struct {
 	ExecutorCount uint8
 	Executors     []*Executor
+	QueueLimit    QueueLimit
 }
 
-func (dis *Dispatcher) Init(count uint8) {
+func (dis *Dispatcher) Init(name string, count uint8) {
+	limit := queueLimitFor(name)
 	executors := make([]*Executor, count)
 	for idx := range executors {
-		executors[idx] = newExecutor()
+		executors[idx] = newExecutor(fmt.Sprintf("%v-%v", name, idx), limit)
 	}
 	dis.Executors = executors
 	dis.ExecutorCount = count
+	dis.QueueLimit = limit
 }
 
 func (dis *Dispatcher) Shutdown() {
@@ -39,21 +85,64 @@ type applyQuery func()
 
 func (aq applyQuery) witness() executorQuery { return aq }
 
+type contextQuery struct {
+	context fmt.Stringer
+	fun     func()
+}
+
+func (cq *contextQuery) witness() executorQuery { return cq }
+
+type queuedQuery struct {
+	query      executorQuery
+	enqueuedAt time.Time
+	idempotent bool
+}
+
+// Executors are sharded statically, by a byte of the id of whatever
+// they work on, so a hot shard can saturate its executor whilst
+// others idle. Hence we measure the utilization of every executor.
+// The measurements are taken for every piece of work, bounded or
+// not: the time it was queued and the time it started (for the queue
+// wait histogram), the queue length gauge as it joins and leaves the
+// queue, and its running time. BenchmarkExecutorEnqueue shows their
+// cost against a bare channel.
 type Executor struct {
-	cellTail  *cc.ChanCellTail
-	enqueue   func(executorQuery, *cc.ChanCell, cc.CurCellConsumer) (bool, cc.CurCellConsumer)
-	queryChan <-chan executorQuery
+	name        string
+	cellTail    *cc.ChanCellTail
+	enqueue     func(queuedQuery, *cc.ChanCell, cc.CurCellConsumer) (bool, cc.CurCellConsumer)
+	queryChan   <-chan queuedQuery
+	pending     int64 // atomic
+	busySeconds prometheus.Counter
+	tasks       prometheus.Counter
+	queueLength prometheus.Gauge
+	queueWait   prometheus.Observer
+	limit       QueueLimit
+	// lock guards the bookkeeping of offered work, only needed if the
+	// queue is bounded.
+	lock       sync.Mutex
+	space      *sync.Cond
+	idempotent int64 // idempotent offered work waiting
+	toDrop     int64 // of which, this many are to be dropped
+	terminated bool
 }
 
-func newExecutor() *Executor {
-	exe := &Executor{}
+func newExecutor(name string, limit QueueLimit) *Executor {
+	exe := &Executor{
+		name:        name,
+		busySeconds: executorBusySeconds.WithLabelValues(name),
+		tasks:       executorTasks.WithLabelValues(name),
+		queueLength: executorQueueLength.WithLabelValues(name),
+		queueWait:   executorQueueWaitSeconds.WithLabelValues(name),
+		limit:       limit,
+	}
+	exe.space = sync.NewCond(&exe.lock)
 	var head *cc.ChanCellHead
 	head, exe.cellTail = cc.NewChanCellTail(
 		func(n int, cell *cc.ChanCell) {
-			queryChan := make(chan executorQuery, n)
+			queryChan := make(chan queuedQuery, n)
 			cell.Open = func() { exe.queryChan = queryChan }
 			cell.Close = func() { close(queryChan) }
-			exe.enqueue = func(msg executorQuery, curCell *cc.ChanCell, cont cc.CurCellConsumer) (bool, cc.CurCellConsumer) {
+			exe.enqueue = func(msg queuedQuery, curCell *cc.ChanCell, cont cc.CurCellConsumer) (bool, cc.CurCellConsumer) {
 				if curCell == cell {
 					select {
 					case queryChan <- msg:
@@ -73,18 +162,26 @@ func newExecutor() *Executor {
 func (exe *Executor) loop(head *cc.ChanCellHead) {
 	terminate := false
 	var (
-		queryChan <-chan executorQuery
+		queryChan <-chan queuedQuery
 		queryCell *cc.ChanCell
 	)
 	chanFun := func(cell *cc.ChanCell) { queryChan, queryCell = exe.queryChan, cell }
 	head.WithCell(chanFun)
 	for !terminate {
 		if msg, ok := <-queryChan; ok {
-			switch query := msg.(type) {
+			atomic.AddInt64(&exe.pending, -1)
+			exe.queueLength.Dec()
+			exe.queueWait.Observe(time.Since(msg.enqueuedAt).Seconds())
+			if exe.dequeued(msg.idempotent) {
+				continue
+			}
+			switch query := msg.query.(type) {
 			case shutdownQuery:
 				terminate = true
 			case applyQuery:
-				query()
+				exe.run(nil, query)
+			case *contextQuery:
+				exe.run(query.context, query.fun)
 			default:
 				log.Printf("Fatal to Executor: Received unexpected message: %#v", query)
 				terminate = true
@@ -96,16 +193,122 @@ func (exe *Executor) loop(head *cc.ChanCellHead) {
 	exe.cellTail.Terminate()
 }
 
-func (exe *Executor) send(msg executorQuery) bool {
+func (exe *Executor) run(context fmt.Stringer, fun func()) {
+	start := time.Now()
+	exe.guard(context, fun)
+	exe.busySeconds.Add(time.Since(start).Seconds())
+	exe.tasks.Inc()
+}
+
+// An executor's state is shared by everything it runs, so after a
+// panic it can not be trusted: we write a crash report and exit.
+func (exe *Executor) guard(context fmt.Stringer, fun func()) {
+	if report := server.Guard(exe.name, context, fun); report != nil {
+		report.Fatal()
+	}
+}
+
+// admit decides whether offered work may join a bounded queue,
+// waiting for space if the policy is to block. Idempotent work which
+// is admitted is counted, so that it can later be dropped.
+func (exe *Executor) admit(idempotent bool) bool {
+	exe.lock.Lock()
+	defer exe.lock.Unlock()
+	blocked := false
+	for int64(exe.Pending())-exe.toDrop >= int64(exe.limit.Capacity) {
+		if exe.limit.Policy == QueueBlock && !exe.terminated {
+			if !blocked {
+				blocked = true
+				executorQueueOverflows.WithLabelValues(exe.name, "blocked").Inc()
+			}
+			exe.space.Wait()
+		} else if exe.limit.Policy == QueueDropOldestIdempotent && idempotent && exe.idempotent > exe.toDrop {
+			exe.toDrop++
+		} else {
+			executorQueueOverflows.WithLabelValues(exe.name, "rejected").Inc()
+			return false
+		}
+	}
+	if idempotent {
+		exe.idempotent++
+	}
+	return true
+}
+
+// dequeued updates the bookkeeping of a bounded queue as work leaves
+// it, returning true if the work is to be dropped.
+func (exe *Executor) dequeued(idempotent bool) bool {
+	if exe.limit.Capacity == 0 {
+		return false
+	}
+	exe.lock.Lock()
+	defer exe.lock.Unlock()
+	exe.space.Signal()
+	if idempotent {
+		exe.idempotent--
+		if exe.toDrop > 0 {
+			exe.toDrop--
+			executorQueueOverflows.WithLabelValues(exe.name, "dropped").Inc()
+			return true
+		}
+	}
+	return false
+}
+
+func (exe *Executor) send(query executorQuery, offered, idempotent bool) bool {
+	idempotent = idempotent && offered && exe.limit.Capacity > 0
+	if offered && exe.limit.Capacity > 0 && !exe.admit(idempotent) {
+		return false
+	}
+	msg := queuedQuery{query: query, enqueuedAt: time.Now(), idempotent: idempotent}
+	// Count it before it can possibly be received, so that pending
+	// never goes negative.
+	atomic.AddInt64(&exe.pending, 1)
+	exe.queueLength.Inc()
 	var f cc.CurCellConsumer
 	f = func(cell *cc.ChanCell) (bool, cc.CurCellConsumer) {
 		return exe.enqueue(msg, cell, f)
 	}
-	return exe.cellTail.WithCell(f)
+	if exe.cellTail.WithCell(f) {
+		return true
+	}
+	atomic.AddInt64(&exe.pending, -1)
+	exe.queueLength.Dec()
+	if idempotent {
+		exe.lock.Lock()
+		exe.idempotent--
+		exe.lock.Unlock()
+	}
+	return false
+}
+
+// Pending returns the number of pieces of work waiting to be run.
+func (exe *Executor) Pending() int {
+	return int(atomic.LoadInt64(&exe.pending))
 }
 
 func (exe *Executor) Enqueue(fun func()) bool {
-	return exe.send(applyQuery(fun))
+	return exe.send(applyQuery(fun), false, false)
+}
+
+// Offer is Enqueue for optional work, which is subject to the
+// executor's QueueLimit, and so may be refused. As it may block, it
+// must not be called by work running on the same executor.
+func (exe *Executor) Offer(fun func()) bool {
+	return exe.send(applyQuery(fun), true, false)
+}
+
+// OfferIdempotent is Offer for work which is superseded by any later
+// offer of the same work, such as periodic housekeeping, and so which
+// may be dropped by QueueDropOldestIdempotent.
+func (exe *Executor) OfferIdempotent(fun func()) bool {
+	return exe.send(applyQuery(fun), true, true)
+}
+
+// EnqueueFor is the same as Enqueue, but context (typically the TxnId
+// or VarUUId being worked on) is recorded in any crash report.
+func (exe *Executor) EnqueueFor(context fmt.Stringer, fun func()) bool {
+	return exe.send(&contextQuery{context: context, fun: fun}, false, false)
 }
 
 func (exe *Executor) WithTerminatedChan(fun func(chan struct{})) {
@@ -113,7 +316,12 @@ func (exe *Executor) WithTerminatedChan(fun func(chan struct{})) {
 }
 
 func (exe *Executor) shutdown() {
-	if exe.send(shutdownQuery{}) {
+	// Wake anyone blocked offering work, which will now be refused.
+	exe.lock.Lock()
+	exe.terminated = true
+	exe.space.Broadcast()
+	exe.lock.Unlock()
+	if exe.send(shutdownQuery{}, false, false) {
 		exe.cellTail.Wait()
 	}
 }
@@ -0,0 +1,51 @@
+package dispatcher
+
+import (
+	"sync"
+	"testing"
+)
+
+// The per-task overhead of an executor, and of its queue wait and
+// length metrics, is the difference between these benchmarks and
+// BenchmarkChannelBaseline.
+
+func BenchmarkChannelBaseline(b *testing.B) {
+	c := make(chan func(), 1024)
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	go func() {
+		for fun := range c {
+			fun()
+		}
+	}()
+	fun := func() { wg.Done() }
+	b.ResetTimer()
+	for idx := 0; idx < b.N; idx++ {
+		c <- fun
+	}
+	wg.Wait()
+	close(c)
+}
+
+func BenchmarkExecutorEnqueue(b *testing.B) {
+	benchmarkExecutor(b, QueueLimit{}, (*Executor).Enqueue)
+}
+
+func BenchmarkExecutorOfferBounded(b *testing.B) {
+	benchmarkExecutor(b, QueueLimit{Capacity: 1024, Policy: QueueBlock}, (*Executor).Offer)
+}
+
+func benchmarkExecutor(b *testing.B, limit QueueLimit, submit func(*Executor, func()) bool) {
+	exe := newExecutor("benchmark-"+limit.String(), limit)
+	defer exe.shutdown()
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	fun := func() { wg.Done() }
+	b.ResetTimer()
+	for idx := 0; idx < b.N; idx++ {
+		if !submit(exe, fun) {
+			b.Fatal("Executor refused work")
+		}
+	}
+	wg.Wait()
+}
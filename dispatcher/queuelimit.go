@@ -0,0 +1,106 @@
+package dispatcher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// By default an executor's queue is unbounded: Enqueue never refuses
+// work whilst the executor is running. Most work must not be refused,
+// as it is a step of some protocol which would otherwise stall, but
+// some work (status and inspection requests, periodic housekeeping)
+// is optional, and is Offered rather than Enqueued. A QueueLimit
+// bounds how much Offered work may join a queue: once Capacity pieces
+// of work of any sort are waiting, the Policy decides what happens to
+// further Offered work. Enqueued work is never affected, so a
+// QueueLimit does not bound the memory a queue may use: a backlog of
+// protocol work still grows without limit.
+type QueuePolicy uint8
+
+const (
+	// QueueBlock makes the offerer wait until the queue has space.
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldestIdempotent makes space for idempotent work by
+	// dropping the oldest idempotent work waiting, which the new work
+	// supersedes. Other work is refused.
+	QueueDropOldestIdempotent QueuePolicy = iota
+	// QueueReject refuses work.
+	QueueReject QueuePolicy = iota
+)
+
+var queuePolicyNames = map[QueuePolicy]string{
+	QueueBlock:                "block",
+	QueueDropOldestIdempotent: "drop-oldest-idempotent",
+	QueueReject:               "reject",
+}
+
+func (qp QueuePolicy) String() string {
+	if name, found := queuePolicyNames[qp]; found {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(qp))
+}
+
+func ParseQueuePolicy(name string) (QueuePolicy, error) {
+	for qp, qpName := range queuePolicyNames {
+		if strings.EqualFold(name, qpName) {
+			return qp, nil
+		}
+	}
+	return QueueBlock, fmt.Errorf("Unknown queue policy: %v", name)
+}
+
+// QueueLimit bounds the queue of every executor of a Dispatcher. A
+// Capacity of 0 leaves the queue unbounded.
+type QueueLimit struct {
+	Capacity int
+	Policy   QueuePolicy
+}
+
+func (ql QueueLimit) String() string {
+	if ql.Capacity == 0 {
+		return "unbounded"
+	}
+	return fmt.Sprintf("%v (%v)", ql.Capacity, ql.Policy)
+}
+
+var queueLimits = make(map[string]QueueLimit)
+
+// ParseQueueLimits parses comma separated name=capacity:policy, where
+// name is that of a Dispatcher (for example VarDispatcher), matched
+// case insensitively, and the policy defaults to block.
+func ParseQueueLimits(str string) (map[string]QueueLimit, error) {
+	limits := make(map[string]QueueLimit)
+	for _, elem := range strings.Split(str, ",") {
+		if elem = strings.TrimSpace(elem); elem == "" {
+			continue
+		}
+		nameLimit := strings.SplitN(elem, "=", 2)
+		if len(nameLimit) != 2 {
+			return nil, fmt.Errorf("Queue limit must be of the form name=capacity:policy: %v", elem)
+		}
+		capacityPolicy := strings.SplitN(nameLimit[1], ":", 2)
+		capacity, err := strconv.Atoi(capacityPolicy[0])
+		if err != nil || capacity < 0 {
+			return nil, fmt.Errorf("Queue capacity is illegal (%v). Must be >= 0", capacityPolicy[0])
+		}
+		limit := QueueLimit{Capacity: capacity}
+		if len(capacityPolicy) == 2 {
+			if limit.Policy, err = ParseQueuePolicy(capacityPolicy[1]); err != nil {
+				return nil, err
+			}
+		}
+		limits[strings.ToLower(nameLimit[0])] = limit
+	}
+	return limits, nil
+}
+
+// SetQueueLimits must be called before any Dispatchers are created.
+func SetQueueLimits(limits map[string]QueueLimit) {
+	queueLimits = limits
+}
+
+func queueLimitFor(name string) QueueLimit {
+	return queueLimits[strings.ToLower(name)]
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"sync/atomic"
+)
+
+// Servers announce the FeatureVersion they support in their
+// handshake. During a rolling upgrade, the cluster runs at the lowest
+// version announced by any server in the topology, and features newer
+// than that are not used. Servers which predate negotiation announce
+// FeatureBaseline, as that is what the field reads as.
+const (
+	FeatureBaseline         uint32 = 0
+	FeatureValueCompression uint32 = 1
+	FeatureServerLinks      uint32 = 2
+	FeatureServerTieBreak   uint32 = 3
+	FeatureFrozenVars       uint32 = 4
+	FeatureHeartbeatPing    uint32 = 5
+	FeatureDegradedNotice   uint32 = 6
+	FeatureAudit            uint32 = 7
+	FeatureTxnAcceptors     uint32 = 8
+	FeatureNodeAttestation  uint32 = 9
+	FeatureMigrationSize    uint32 = 10
+	FeatureVoteBatches      uint32 = 11
+	FeatureVersion          uint32 = FeatureVoteBatches
+)
+
+var clusterFeatureVersion = FeatureBaseline
+
+func ClusterFeatureVersion() uint32 {
+	return atomic.LoadUint32(&clusterFeatureVersion)
+}
+
+func SetClusterFeatureVersion(version uint32) {
+	atomic.StoreUint32(&clusterFeatureVersion, version)
+}
+
+// FeatureEnabled returns true iff every server in the cluster
+// supports feature.
+func FeatureEnabled(feature uint32) bool {
+	return ClusterFeatureVersion() >= feature
+}
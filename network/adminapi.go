@@ -0,0 +1,50 @@
+package network
+
+import (
+	"crypto/sha256"
+	"goshawkdb.io/common"
+	"log"
+	"net/http"
+)
+
+const adminAPIPrefix = "/admin/"
+
+// AdminAPI serves node administration operations on the
+// HTTPListener. Unlike the REST gateway, access is not governed by
+// the roots in the topology: only clients presenting a certificate
+// with one of the admin fingerprints given on the command line may
+// use it. Every admin request other than a GET is logged, along with
+// the fingerprint of the client which made it, as an audit trail.
+type AdminAPI struct {
+	httpListener *HTTPListener
+	fingerprints map[[sha256.Size]byte]map[string]*common.Capability
+}
+
+func NewAdminAPI(l *HTTPListener, fingerprints [][sha256.Size]byte) *AdminAPI {
+	api := &AdminAPI{
+		httpListener: l,
+		fingerprints: make(map[[sha256.Size]byte]map[string]*common.Capability, len(fingerprints)),
+	}
+	for _, fingerprint := range fingerprints {
+		api.fingerprints[fingerprint] = nil
+	}
+	return api
+}
+
+// HandleFunc registers handler for the admin operation name, which
+// is served at /admin/name. The handler is only invoked for
+// authenticated admin clients.
+func (api *AdminAPI) HandleFunc(name string, handler func(http.ResponseWriter, *http.Request)) {
+	api.httpListener.HandleFunc(adminAPIPrefix+name, func(w http.ResponseWriter, req *http.Request) {
+		authenticated, fingerprint, _ := api.httpListener.Authenticate(req, api.fingerprints)
+		if !authenticated {
+			http.Error(w, "Not an admin client certificate", http.StatusForbidden)
+			return
+		}
+		if req.Method != "GET" {
+			req.ParseForm()
+			log.Printf("Admin: %v %v %v by %x from %v", req.Method, req.URL.Path, req.Form.Encode(), fingerprint, req.RemoteAddr)
+		}
+		handler(w, req)
+	})
+}
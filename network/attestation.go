@@ -0,0 +1,89 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/common"
+	"goshawkdb.io/common/certs"
+	"math/big"
+)
+
+var serverAttestationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "goshawkdb",
+	Name:      "server_attestation_failures_total",
+	Help:      "Number of server handshakes refused because the remote node's attestation was missing or invalid.",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(serverAttestationFailures)
+}
+
+// Every node generates its own node certificate at start up, signed
+// by the cluster certificate. TLS alone proves only that a peer holds
+// some such node certificate: anyone who steals one could then claim
+// to be any RMId. So in its hello, each node also sends an
+// attestation: a signature, made with the cluster key, binding its
+// RMId and boot count to its node certificate. Node keys are
+// ephemeral and the cluster key never leaves the cluster certificate
+// file, so a stolen node certificate can only ever be used to claim
+// the RMId and boot count it was issued with.
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func attestationDigest(clusterId string, rmId common.RMId, bootCount uint32, nodeCertificate []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte("goshawkdb node attestation\x00"))
+	hash.Write([]byte(clusterId))
+	hash.Write([]byte{0})
+	ids := make([]byte, 8)
+	binary.BigEndian.PutUint32(ids[0:4], uint32(rmId))
+	binary.BigEndian.PutUint32(ids[4:8], bootCount)
+	hash.Write(ids)
+	hash.Write(nodeCertificate)
+	return hash.Sum(nil)
+}
+
+// newNodeAttestation signs our RMId and boot count, binding them to
+// our node certificate.
+func newNodeAttestation(nodeCertPrivKeyPair *certs.NodeCertificatePrivateKeyPair, clusterId string, rmId common.RMId, bootCount uint32) ([]byte, error) {
+	digest := attestationDigest(clusterId, rmId, bootCount, nodeCertPrivKeyPair.Certificate)
+	r, s, err := ecdsa.Sign(rand.Reader, nodeCertPrivKeyPair.PrivateKeyRoot, digest)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ecdsaSignature{R: r, S: s})
+}
+
+// verifyNodeAttestation checks that attestation was signed by the
+// cluster key for the remote's RMId, boot count and the certificate
+// it presented in the TLS handshake. The error's reason is used to
+// label the failure.
+func verifyNodeAttestation(root *x509.Certificate, attestation []byte, clusterId string, rmId common.RMId, bootCount uint32, peerCertificate *x509.Certificate) (reason string, err error) {
+	if len(attestation) == 0 {
+		return "missing", errors.New("No attestation supplied")
+	}
+	publicKey, ok := root.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return "key", fmt.Errorf("Cluster certificate does not have an ECDSA key: %T", root.PublicKey)
+	}
+	var sig ecdsaSignature
+	if rest, err := asn1.Unmarshal(attestation, &sig); err != nil {
+		return "malformed", err
+	} else if len(rest) != 0 || sig.R == nil || sig.S == nil {
+		return "malformed", errors.New("Malformed attestation")
+	}
+	digest := attestationDigest(clusterId, rmId, bootCount, peerCertificate.Raw)
+	if !ecdsa.Verify(publicKey, digest, sig.R, sig.S) {
+		return "mismatch", fmt.Errorf("Attestation does not match RMId %v, boot count %v and certificate", rmId, bootCount)
+	}
+	return "", nil
+}
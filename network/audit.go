@@ -0,0 +1,538 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	mdb "github.com/msackman/gomdb"
+	mdbs "github.com/msackman/gomdb/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/configuration"
+	ch "goshawkdb.io/server/consistenthash"
+	"goshawkdb.io/server/db"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	auditsRun = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "audits_total",
+		Help:      "Number of cross-node audits run from this node.",
+	})
+	auditMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "audit_mismatches_total",
+		Help:      "Number of vars found by audits to have diverged between the RMs holding them.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(auditsRun)
+	prometheus.MustRegister(auditMismatches)
+}
+
+var errAuditRunning = errors.New("An audit is already running")
+
+// Auditor checks that the RMs holding each var agree on its
+// version. An audit covers the slice of the keyspace whose vars have
+// a given first position. Every voting RM sends the version of every
+// var in the slice that it holds on disk, and for each var, the RMs
+// to which its positions resolve are compared. Consensus should make
+// divergence impossible, so a mismatch which persists is a sign of a
+// bug or of disk corruption.
+//
+// Txns in flight mean the RMs holding a var do not all apply its
+// writes at the same moment, so any mismatched vars are checked
+// again after AuditRecheckDelay. A mismatch is only reported if it
+// remains and some RM's version has not moved in the meantime even
+// though another RM's version differs from it.
+//
+// Every node answers audit requests, but audits are only started
+// through the admin API. Audits are refused whilst a topology change
+// is in progress, as vars may then legitimately be moving between
+// RMs.
+type Auditor struct {
+	sync.Mutex
+	connectionManager *ConnectionManager
+	db                *db.Databases
+	topology          *configuration.Topology
+	nextId            uint64
+	pending           map[uint64]*pendingAudit
+	running           bool
+	last              *auditReport
+}
+
+type pendingAudit struct {
+	expected  int
+	responses map[common.RMId]*auditSlice
+	done      chan struct{}
+}
+
+// auditSlice is the vars one RM holds in the slice. If truncated,
+// the RM held more than AuditMaxVars, and vars after upTo were not
+// sent.
+type auditSlice struct {
+	vars      map[common.VarUUId]*auditVar
+	truncated bool
+	upTo      *common.VarUUId
+}
+
+type auditVar struct {
+	positions []uint8
+	txnId     *common.TxnId
+}
+
+type auditReport struct {
+	Prefix       uint8
+	Started      time.Time
+	Duration     string
+	RMs          []common.RMId
+	Unresponsive []common.RMId
+	Truncated    []common.RMId
+	Vars         int
+	Transient    int
+	Mismatches   []*auditMismatch
+}
+
+// auditMismatch gives the version of the var on each RM which should
+// hold it, or the empty string where the RM does not have it.
+type auditMismatch struct {
+	VarUUId  string
+	Versions map[string]string
+}
+
+func newAuditor(cm *ConnectionManager, db *db.Databases) *Auditor {
+	return &Auditor{
+		connectionManager: cm,
+		db:                db,
+		nextId:            uint64(cm.BootCount()) << 32,
+		pending:           make(map[uint64]*pendingAudit),
+	}
+}
+
+func (cm *ConnectionManager) Auditor() *Auditor {
+	return cm.auditor
+}
+
+func (a *Auditor) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	a.Lock()
+	a.topology = topology
+	a.Unlock()
+	done(true)
+}
+
+func (a *Auditor) Status(sc *server.StatusConsumer) {
+	a.Lock()
+	defer a.Unlock()
+	if a.running {
+		sc.Emit("Audit: running")
+	} else if a.last != nil {
+		sc.Emit(fmt.Sprintf("Audit: last of prefix %v at %v; %v vars; %v mismatches", a.last.Prefix, a.last.Started, a.last.Vars, len(a.last.Mismatches)))
+	}
+	sc.Join()
+}
+
+// ServeAudit runs an audit on a POST, of the slice given by the
+// prefix parameter (or of a random slice if absent), and writes the
+// report as JSON. A GET writes the report of the last audit.
+func (a *Auditor) ServeAudit(w http.ResponseWriter, req *http.Request) {
+	var report *auditReport
+	switch req.Method {
+	case "GET":
+		a.Lock()
+		report = a.last
+		a.Unlock()
+		if report == nil {
+			http.Error(w, "No audit has been run", http.StatusNotFound)
+			return
+		}
+	case "POST":
+		prefix := uint8(rand.Intn(256))
+		if str := req.FormValue("prefix"); str != "" {
+			p, err := strconv.ParseUint(str, 10, 8)
+			if err != nil {
+				http.Error(w, "Illegal prefix: must be 0 to 255", http.StatusBadRequest)
+				return
+			}
+			prefix = uint8(p)
+		}
+		var err error
+		if report, err = a.Audit(prefix); err == errAuditRunning {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Audit audits the slice of vars whose first position is prefix.
+func (a *Auditor) Audit(prefix uint8) (*auditReport, error) {
+	a.Lock()
+	topology := a.topology
+	if a.running {
+		a.Unlock()
+		return nil, errAuditRunning
+	}
+	a.running = true
+	a.Unlock()
+	defer func() {
+		a.Lock()
+		a.running = false
+		a.Unlock()
+	}()
+
+	switch {
+	case topology == nil || topology.IsBlank():
+		return nil, errors.New("No topology is installed")
+	case topology.Next() != nil:
+		return nil, errors.New("A topology change is in progress")
+	case !server.FeatureEnabled(server.FeatureAudit):
+		return nil, errors.New("Audits are not supported until every server in the cluster has been upgraded")
+	}
+
+	auditsRun.Inc()
+	report := &auditReport{Prefix: prefix, Started: time.Now()}
+	rmIds := topology.VoterRMs()
+	resolver := ch.NewResolver(rmIds, topology.TwoFInc)
+	first, err := a.round(rmIds, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, rmId := range rmIds {
+		if slice, found := first[rmId]; !found {
+			report.Unresponsive = append(report.Unresponsive, rmId)
+		} else {
+			report.RMs = append(report.RMs, rmId)
+			if slice.truncated {
+				report.Truncated = append(report.Truncated, rmId)
+			}
+		}
+	}
+	vars, mismatched := compareAuditSlices(resolver, first, nil)
+	report.Vars = vars
+
+	if len(mismatched) != 0 {
+		time.Sleep(server.AuditRecheckDelay)
+		second, err := a.round(rmIds, prefix)
+		if err != nil {
+			return nil, err
+		}
+		_, remaining := compareAuditSlices(resolver, second, mismatched)
+		for vUUId, before := range mismatched {
+			after, found := remaining[vUUId]
+			if !found || !auditStuck(before, after) {
+				report.Transient++
+				continue
+			}
+			mismatch := &auditMismatch{
+				VarUUId:  hex.EncodeToString(vUUId[:]),
+				Versions: make(map[string]string, len(after)),
+			}
+			for rmId, txnId := range after {
+				if txnId == nil {
+					mismatch.Versions[rmId.String()] = ""
+				} else {
+					mismatch.Versions[rmId.String()] = hex.EncodeToString(txnId[:])
+				}
+			}
+			report.Mismatches = append(report.Mismatches, mismatch)
+		}
+	}
+	sort.Sort(auditMismatchesByVar(report.Mismatches))
+	report.Duration = time.Since(report.Started).String()
+
+	if l := len(report.Mismatches); l != 0 {
+		auditMismatches.Add(float64(l))
+		log.Printf("Warning: audit of prefix %v found %v vars whose versions differ between RMs.\n", prefix, l)
+	}
+	a.Lock()
+	a.last = report
+	a.Unlock()
+	return report, nil
+}
+
+// round gathers the slice from every RM in rmIds, waiting at most
+// AuditTimeout for them to respond.
+func (a *Auditor) round(rmIds common.RMIds, prefix uint8) (map[common.RMId]*auditSlice, error) {
+	pa := &pendingAudit{
+		expected:  len(rmIds),
+		responses: make(map[common.RMId]*auditSlice, len(rmIds)),
+		done:      make(chan struct{}),
+	}
+	a.Lock()
+	a.nextId++
+	id := a.nextId
+	a.pending[id] = pa
+	a.Unlock()
+	defer func() {
+		a.Lock()
+		delete(a.pending, id)
+		a.Unlock()
+	}()
+
+	seg := capn.NewBuffer(nil)
+	msg := msgs.NewRootMessage(seg)
+	audit := msgs.NewAudit(seg)
+	audit.SetId(id)
+	audit.SetPrefix(prefix)
+	msg.SetAuditRequest(audit)
+	remote := make([]common.RMId, 0, len(rmIds))
+	for _, rmId := range rmIds {
+		if rmId != a.connectionManager.RMId {
+			remote = append(remote, rmId)
+		}
+	}
+	a.connectionManager.ResendScheduler().SendOnce(server.SegToBytes(seg), remote...)
+
+	if len(remote) != len(rmIds) {
+		slice, err := a.scan(prefix)
+		if err != nil {
+			return nil, err
+		}
+		a.received(id, a.connectionManager.RMId, slice)
+	}
+
+	select {
+	case <-pa.done:
+	case <-time.After(server.AuditTimeout):
+	}
+	a.Lock()
+	defer a.Unlock()
+	responses := make(map[common.RMId]*auditSlice, len(pa.responses))
+	for rmId, slice := range pa.responses {
+		responses[rmId] = slice
+	}
+	return responses, nil
+}
+
+func (a *Auditor) received(id uint64, sender common.RMId, slice *auditSlice) {
+	a.Lock()
+	defer a.Unlock()
+	if pa, found := a.pending[id]; found {
+		if _, dup := pa.responses[sender]; !dup {
+			pa.responses[sender] = slice
+			if len(pa.responses) == pa.expected {
+				close(pa.done)
+			}
+		}
+	}
+}
+
+// AuditRequestReceived scans our slice, and sends it back to the
+// auditing RM.
+func (a *Auditor) AuditRequestReceived(sender common.RMId, audit msgs.Audit) {
+	id, prefix := audit.Id(), audit.Prefix()
+	go func() {
+		slice, err := a.scan(prefix)
+		if err != nil {
+			log.Printf("Error when scanning vars for audit from %v: %v\n", sender, err)
+			return
+		}
+		seg := capn.NewBuffer(nil)
+		msg := msgs.NewRootMessage(seg)
+		response := msgs.NewAudit(seg)
+		response.SetId(id)
+		response.SetPrefix(prefix)
+		response.SetTruncated(slice.truncated)
+		vars := msgs.NewVarList(seg, len(slice.vars))
+		idx := 0
+		for vUUId, v := range slice.vars {
+			varCap := vars.At(idx)
+			varCap.SetId(vUUId[:])
+			positions := seg.NewUInt8List(len(v.positions))
+			for idy, p := range v.positions {
+				positions.Set(idy, p)
+			}
+			varCap.SetPositions(positions)
+			varCap.SetWriteTxnId(v.txnId[:])
+			idx++
+		}
+		response.SetVars(vars)
+		msg.SetAuditResponse(response)
+		a.connectionManager.ResendScheduler().SendOnce(server.SegToBytes(seg), sender)
+	}()
+}
+
+// AuditResponseReceived records the slice sent by sender for an
+// audit we're running. Responses to audits which have finished are
+// dropped.
+func (a *Auditor) AuditResponseReceived(sender common.RMId, audit msgs.Audit) {
+	varsCap := audit.Vars()
+	slice := &auditSlice{
+		vars:      make(map[common.VarUUId]*auditVar, varsCap.Len()),
+		truncated: audit.Truncated(),
+	}
+	for idx, l := 0, varsCap.Len(); idx < l; idx++ {
+		varCap := varsCap.At(idx)
+		vUUId := common.MakeVarUUId(varCap.Id())
+		slice.vars[*vUUId] = &auditVar{
+			positions: varCap.Positions().ToArray(),
+			txnId:     common.MakeTxnId(varCap.WriteTxnId()),
+		}
+		if slice.truncated && (slice.upTo == nil || slice.upTo.Compare(vUUId) == common.LT) {
+			slice.upTo = vUUId
+		}
+	}
+	a.received(audit.Id(), sender, slice)
+}
+
+// scan finds the vars we hold on disk whose first position is
+// prefix.
+func (a *Auditor) scan(prefix uint8) (*auditSlice, error) {
+	slice := &auditSlice{vars: make(map[common.VarUUId]*auditVar)}
+	var from []byte
+	for {
+		res, err := a.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+			res, _ := rtxn.WithCursor(a.db.Vars, func(cursor *mdbs.Cursor) interface{} {
+				var last []byte
+				scanned := 0
+				var key, value []byte
+				var err error
+				if from == nil {
+					key, value, err = cursor.Get(nil, nil, mdb.FIRST)
+				} else if key, value, err = cursor.Get(from, nil, mdb.SET_RANGE); err == nil && string(key) == string(from) {
+					key, value, err = cursor.Get(nil, nil, mdb.NEXT)
+				}
+				for ; err == nil && scanned < server.AuditScanBatch; key, value, err = cursor.Get(nil, nil, mdb.NEXT) {
+					if a.db.ReaderExpired(cursor.RTxn) {
+						cursor.Error(db.ErrReaderExpired)
+						return nil
+					}
+					scanned++
+					last = append([]byte{}, key...)
+					seg, _, err := capn.ReadFromMemoryZeroCopy(value)
+					if err != nil {
+						cursor.Error(err)
+						return nil
+					}
+					varCap := msgs.ReadRootVar(seg)
+					if positions := varCap.Positions(); positions.Len() == 0 || positions.At(0) != prefix {
+						continue
+					}
+					vUUId := common.MakeVarUUId(key)
+					slice.vars[*vUUId] = &auditVar{
+						positions: varCap.Positions().ToArray(),
+						txnId:     common.MakeTxnId(varCap.WriteTxnId()),
+					}
+					if len(slice.vars) == server.AuditMaxVars {
+						slice.truncated = true
+						slice.upTo = vUUId
+						return nil
+					}
+				}
+				if err != nil && err != mdb.NotFound {
+					cursor.Error(err)
+					return nil
+				}
+				return last
+			})
+			return res
+		}).ResultError()
+		if err != nil {
+			return nil, err
+		}
+		last, _ := res.([]byte)
+		if slice.truncated || last == nil {
+			return slice, nil
+		}
+		from = last
+	}
+}
+
+// compareAuditSlices compares, for every var in the slices (or only
+// those in only, if non-nil), the versions held by the RMs to which
+// its positions resolve. RMs which did not respond, or which
+// truncated their slice before the var, are left out. It returns the
+// number of vars compared, and the versions of those which differ.
+func compareAuditSlices(resolver *ch.Resolver, slices map[common.RMId]*auditSlice, only map[common.VarUUId]map[common.RMId]*common.TxnId) (int, map[common.VarUUId]map[common.RMId]*common.TxnId) {
+	positions := make(map[common.VarUUId][]uint8)
+	for _, slice := range slices {
+		for vUUId, v := range slice.vars {
+			if only != nil {
+				if _, found := only[vUUId]; !found {
+					continue
+				}
+			}
+			positions[vUUId] = v.positions
+		}
+	}
+	mismatched := make(map[common.VarUUId]map[common.RMId]*common.TxnId)
+	for vUUId, pos := range positions {
+		vUUId := vUUId
+		holders, err := resolver.ResolveHashCodes(pos)
+		if err != nil {
+			continue
+		}
+		versions := make(map[common.RMId]*common.TxnId, len(holders))
+		var first *common.TxnId
+		differ, seen := false, false
+		for _, rmId := range holders {
+			slice, found := slices[rmId]
+			if !found || (slice.truncated && slice.upTo.Compare(&vUUId) == common.LT) {
+				continue
+			}
+			var txnId *common.TxnId
+			if v, found := slice.vars[vUUId]; found {
+				txnId = v.txnId
+			}
+			versions[rmId] = txnId
+			if !seen {
+				first, seen = txnId, true
+			} else if !sameAuditVersion(first, txnId) {
+				differ = true
+			}
+		}
+		if differ {
+			mismatched[vUUId] = versions
+		}
+	}
+	return len(positions), mismatched
+}
+
+// auditStuck returns true if some RM has the same version in both
+// rounds, and that version differs from another RM's version in the
+// second round.
+func auditStuck(before, after map[common.RMId]*common.TxnId) bool {
+	for rmId, txnId := range after {
+		if prev, found := before[rmId]; !found || !sameAuditVersion(prev, txnId) {
+			continue
+		}
+		for _, other := range after {
+			if !sameAuditVersion(txnId, other) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameAuditVersion(a, b *common.TxnId) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Compare(b) == common.EQ
+}
+
+type auditMismatchesByVar []*auditMismatch
+
+func (a auditMismatchesByVar) Len() int           { return len(a) }
+func (a auditMismatchesByVar) Less(i, j int) bool { return a[i].VarUUId < a[j].VarUUId }
+func (a auditMismatchesByVar) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
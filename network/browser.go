@@ -0,0 +1,384 @@
+package network
+
+import (
+	"encoding/hex"
+	"goshawkdb.io/common"
+	cmsgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/configuration"
+	eng "goshawkdb.io/server/txnengine"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	browserName            = "browser/"
+	browserPrefix          = adminAPIPrefix + browserName
+	browserTopologyPath    = "api/topology"
+	browserVarsPrefix      = "api/vars/"
+	browserMetricsPath     = "api/metrics"
+	browserRefreshInterval = 2 * time.Second
+)
+
+// Browser is a small web UI for operators, served by the AdminAPI at
+// /admin/browser/. It shows the topology, the object graph reachable
+// from each root, and the node's txn metrics, refreshed live. Being
+// part of the AdminAPI, only admin clients may use it. But being an
+// admin does not grant access to any vars: values and references are
+// only shown where the roots granted to the same client certificate
+// by the topology, and the capabilities of the references followed,
+// permit reading.
+type Browser struct {
+	sync.RWMutex
+	restVarReader
+	httpListener *HTTPListener
+	topology     *configuration.Topology
+}
+
+type browserTopology struct {
+	ClusterId  string
+	Version    uint32
+	Hosts      []string
+	F          uint8
+	MaxRMCount uint16
+	RMs        common.RMIds
+	Next       string
+	Roots      []browserRoot
+}
+
+type browserRoot struct {
+	Name       string
+	VarUUId    string
+	Capability string
+}
+
+type browserVar struct {
+	VarUUId    string
+	Capability string
+	Version    string
+	Value      []byte
+	Text       string
+	References []browserReference
+}
+
+type browserReference struct {
+	VarUUId    string
+	Capability string
+}
+
+type browserMetrics struct {
+	RMId    common.RMId
+	Time    time.Time
+	Metrics map[string]float64
+}
+
+func NewBrowser(cm *ConnectionManager, api *AdminAPI) *Browser {
+	b := &Browser{
+		restVarReader: restVarReader{connectionManager: cm},
+		httpListener:  api.httpListener,
+	}
+	b.topology = cm.AddTopologySubscriber(eng.ConnectionSubscriber, b)
+	api.HandleFunc(browserName, b.serve)
+	return b
+}
+
+func (b *Browser) Shutdown() {
+	b.connectionManager.RemoveTopologySubscriberAsync(eng.ConnectionSubscriber, b)
+}
+
+func (b *Browser) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	b.Lock()
+	b.topology = topology
+	b.Unlock()
+	done(true)
+}
+
+func (b *Browser) serve(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method "+req.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b.RLock()
+	topology := b.topology
+	b.RUnlock()
+	// The roots available are those granted to the admin's certificate
+	// as a client, if any.
+	roots := make(map[string]*common.Capability)
+	if topology != nil {
+		if authenticated, _, granted := b.httpListener.Authenticate(req, topology.Fingerprints()); authenticated {
+			roots = granted
+		}
+	}
+
+	switch path := strings.TrimPrefix(req.URL.Path, browserPrefix); {
+	case path == "":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(browserPage))
+	case path == browserTopologyPath:
+		b.writeJSON(w, b.topologyResponse(topology, roots))
+	case path == browserMetricsPath:
+		metrics, err := gatherMetrics()
+		if err != nil {
+			b.writeError(w, err)
+			return
+		}
+		b.writeJSON(w, &browserMetrics{
+			RMId:    b.connectionManager.RMId,
+			Time:    time.Now(),
+			Metrics: metrics,
+		})
+	case strings.HasPrefix(path, browserVarsPrefix):
+		if topology.IsBlank() {
+			b.writeError(w, newRESTError(http.StatusServiceUnavailable, "Cluster not yet formed"))
+			return
+		}
+		rootName, refPath, err := parseRESTVarPath(strings.TrimPrefix(path, browserVarsPrefix))
+		if err != nil {
+			b.writeError(w, err)
+			return
+		}
+		consistency, err := eng.ParseReadConsistency(req.URL.Query().Get("consistency"))
+		if err != nil {
+			b.writeError(w, newRESTError(http.StatusBadRequest, "%v", err))
+			return
+		}
+		rv, err := b.resolve(topology, roots, rootName, refPath, consistency)
+		if err != nil {
+			b.writeError(w, err)
+			return
+		}
+		bv := &browserVar{
+			VarUUId:    rv.vUUId.String(),
+			Capability: capabilityName(rv.capability),
+		}
+		if rv.canRead() {
+			if err = b.readVar(rv, true); err != nil {
+				b.writeError(w, err)
+				return
+			}
+			bv.Version = hex.EncodeToString(rv.version[:])
+			bv.Value = rv.value
+			if utf8.Valid(rv.value) {
+				bv.Text = string(rv.value)
+			}
+			bv.References = make([]browserReference, len(rv.references))
+			for idx, ref := range rv.references {
+				bv.References[idx] = browserReference{
+					VarUUId:    common.MakeVarUUId(ref.Id()).String(),
+					Capability: capabilityName(common.NewCapability(ref.Capability())),
+				}
+			}
+		}
+		b.writeJSON(w, bv)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (b *Browser) topologyResponse(topology *configuration.Topology, roots map[string]*common.Capability) *browserTopology {
+	if topology == nil {
+		return &browserTopology{}
+	}
+	bt := &browserTopology{
+		ClusterId:  topology.ClusterId,
+		Version:    topology.Version,
+		Hosts:      topology.Hosts,
+		F:          topology.F,
+		MaxRMCount: topology.MaxRMCount,
+		RMs:        topology.RMs(),
+		Roots:      make([]browserRoot, len(topology.Roots)),
+	}
+	if next := topology.Next(); next != nil {
+		bt.Next = next.String()
+	}
+	for idx, name := range topology.RootNames() {
+		capability := "none"
+		if c, found := roots[name]; found {
+			capability = capabilityName(c)
+		}
+		bt.Roots[idx] = browserRoot{
+			Name:       name,
+			VarUUId:    topology.Roots[idx].VarUUId.String(),
+			Capability: capability,
+		}
+	}
+	return bt
+}
+
+func capabilityName(c *common.Capability) string {
+	switch c.Which() {
+	case cmsgs.CAPABILITY_READ:
+		return "read"
+	case cmsgs.CAPABILITY_WRITE:
+		return "write"
+	case cmsgs.CAPABILITY_READWRITE:
+		return "readwrite"
+	default:
+		return "none"
+	}
+}
+
+var browserPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>` + common.ProductName + ` browser</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+h2 { border-bottom: 1px solid #ccc; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.8em; text-align: left; vertical-align: top; }
+pre { background: #f4f4f4; padding: 0.5em; max-height: 20em; overflow: auto; white-space: pre-wrap; }
+a { cursor: pointer; color: #0645ad; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>` + common.ProductName + ` ` + server.ServerVersion + `</h1>
+
+<h2>Topology</h2>
+<div id="topology"></div>
+
+<h2>Vars</h2>
+<div>
+<label><input type="checkbox" id="local"> Read locally (may be stale)</label>
+</div>
+<div id="path"></div>
+<div id="var"></div>
+
+<h2>Metrics</h2>
+<table id="metrics"></table>
+
+<script>
+"use strict";
+var prefix = "` + browserPrefix + `";
+var path = null;
+var lastMetrics = null;
+
+function el(tag, text) {
+	var e = document.createElement(tag);
+	if (text !== undefined) { e.textContent = text; }
+	return e;
+}
+
+function link(text, fn) {
+	var a = el("a", text);
+	a.onclick = fn;
+	return a;
+}
+
+function get(url, fn, errFn) {
+	var req = new XMLHttpRequest();
+	req.onload = function() {
+		if (req.status === 200) { fn(JSON.parse(req.responseText)); } else { errFn(req.responseText); }
+	};
+	req.onerror = function() { errFn("Request failed"); };
+	req.open("GET", url);
+	req.send();
+}
+
+function showError(target, msg) {
+	target.textContent = "";
+	target.appendChild(el("p", msg)).className = "error";
+}
+
+function loadTopology() {
+	var target = document.getElementById("topology");
+	get(prefix + "` + browserTopologyPath + `", function(t) {
+		target.textContent = "";
+		var table = target.appendChild(el("table"));
+		[["Cluster", t.ClusterId], ["Version", t.Version], ["Hosts", (t.Hosts || []).join(", ")],
+		 ["F", t.F], ["Max RM count", t.MaxRMCount], ["RMs", (t.RMs || []).join(", ")],
+		 ["Next", t.Next || "none"]].forEach(function(row) {
+			var tr = table.appendChild(el("tr"));
+			tr.appendChild(el("th", row[0]));
+			tr.appendChild(el("td", String(row[1])));
+		});
+		var roots = target.appendChild(el("table"));
+		var hdr = roots.appendChild(el("tr"));
+		["Root", "VarUUId", "Capability"].forEach(function(h) { hdr.appendChild(el("th", h)); });
+		(t.Roots || []).forEach(function(r) {
+			var tr = roots.appendChild(el("tr"));
+			var td = tr.appendChild(el("td"));
+			td.appendChild(link(r.Name, function() { showVar([r.Name]); }));
+			tr.appendChild(el("td", r.VarUUId));
+			tr.appendChild(el("td", r.Capability));
+		});
+	}, function(msg) { showError(target, msg); });
+}
+
+function showVar(p) {
+	path = p;
+	var crumbs = document.getElementById("path");
+	crumbs.textContent = "";
+	p.forEach(function(elem, idx) {
+		if (idx > 0) { crumbs.appendChild(document.createTextNode(" / ")); }
+		crumbs.appendChild(link(String(elem), function() { showVar(p.slice(0, idx + 1)); }));
+	});
+	var target = document.getElementById("var");
+	var url = prefix + "` + browserVarsPrefix + `" + p.map(encodeURIComponent).join("/");
+	if (document.getElementById("local").checked) { url += "?consistency=local"; }
+	get(url, function(v) {
+		target.textContent = "";
+		var table = target.appendChild(el("table"));
+		[["VarUUId", v.VarUUId], ["Capability", v.Capability], ["Version", v.Version || ""]].forEach(function(row) {
+			var tr = table.appendChild(el("tr"));
+			tr.appendChild(el("th", row[0]));
+			tr.appendChild(el("td", row[1]));
+		});
+		if (v.References === null || v.References === undefined) {
+			target.appendChild(el("p", "Capability does not permit reading this var."));
+			return;
+		}
+		target.appendChild(el("pre", v.Text !== "" ? v.Text : "base64: " + (v.Value || "")));
+		var refs = target.appendChild(el("table"));
+		var hdr = refs.appendChild(el("tr"));
+		["Reference", "VarUUId", "Capability"].forEach(function(h) { hdr.appendChild(el("th", h)); });
+		v.References.forEach(function(ref, idx) {
+			var tr = refs.appendChild(el("tr"));
+			var td = tr.appendChild(el("td"));
+			td.appendChild(link(String(idx), function() { showVar(p.concat([idx])); }));
+			tr.appendChild(el("td", ref.VarUUId));
+			tr.appendChild(el("td", ref.Capability));
+		});
+	}, function(msg) { showError(target, msg); });
+}
+
+function loadMetrics() {
+	var target = document.getElementById("metrics");
+	get(prefix + "` + browserMetricsPath + `", function(m) {
+		target.textContent = "";
+		var hdr = target.appendChild(el("tr"));
+		["Metric", "Value", "Per second"].forEach(function(h) { hdr.appendChild(el("th", h)); });
+		var elapsed = lastMetrics === null ? 0 : (Date.parse(m.Time) - Date.parse(lastMetrics.Time)) / 1000;
+		Object.keys(m.Metrics).sort().forEach(function(name) {
+			var tr = target.appendChild(el("tr"));
+			tr.appendChild(el("td", name));
+			tr.appendChild(el("td", String(m.Metrics[name])));
+			var rate = "";
+			if (elapsed > 0 && lastMetrics.Metrics[name] !== undefined) {
+				rate = ((m.Metrics[name] - lastMetrics.Metrics[name]) / elapsed).toFixed(2);
+			}
+			tr.appendChild(el("td", rate));
+		});
+		lastMetrics = m;
+	}, function(msg) { target.textContent = msg; });
+}
+
+function refresh() {
+	loadTopology();
+	loadMetrics();
+}
+
+document.getElementById("local").onchange = function() { if (path !== null) { showVar(path); } };
+refresh();
+setInterval(refresh, ` + strconv.Itoa(int(browserRefreshInterval/time.Millisecond)) + `);
+</script>
+</body>
+</html>
+`
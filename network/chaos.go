@@ -0,0 +1,166 @@
+// +build chaos
+
+package network
+
+import (
+	"fmt"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/server/capnp"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TopologyMessageInterceptor is given every Migration,
+// MigrationComplete and TopologyChangeRequest message received from
+// another RM, before it is acted upon. It returns the message to act
+// upon instead, which may be msg itself or a modified copy, and false
+// if the message should be dropped. It is called from the receiving
+// connection's goroutine, so must not block for long. To simulate a
+// delayed message, drop it and later pass it to DispatchMessage (or
+// RequestConfigurationChange) directly.
+//
+// This hook only exists in builds with the chaos tag, for
+// integration tests which need to simulate partially delivered
+// migrations and topology changes.
+type TopologyMessageInterceptor func(sender common.RMId, msg msgs.Message) (msgs.Message, bool)
+
+var topologyMessageInterceptor struct {
+	sync.RWMutex
+	interceptor TopologyMessageInterceptor
+}
+
+// SetTopologyMessageInterceptor installs interceptor, replacing any
+// previous one. Passing nil removes it.
+func SetTopologyMessageInterceptor(interceptor TopologyMessageInterceptor) {
+	topologyMessageInterceptor.Lock()
+	topologyMessageInterceptor.interceptor = interceptor
+	topologyMessageInterceptor.Unlock()
+}
+
+func interceptTopologyMessage(sender common.RMId, msg msgs.Message) (msgs.Message, bool) {
+	topologyMessageInterceptor.RLock()
+	interceptor := topologyMessageInterceptor.interceptor
+	topologyMessageInterceptor.RUnlock()
+	if interceptor == nil {
+		return msg, true
+	}
+	return interceptor(sender, msg)
+}
+
+// A partition fault simulates a poor or absent network between this
+// node and a peer, named by its host as given in the configuration.
+// Messages from the peer can be delayed, which holds up every later
+// message on the connection too, as a slow network would; and
+// messages in both directions can be dropped, which includes
+// heartbeats, so the connection is eventually restarted, as it would
+// be by a real partition. A fault only affects this node's side: for
+// a symmetric partition, set it on both nodes.
+//
+// Partition faults only exist in builds with the chaos tag, for
+// game-day testing of staging clusters. In them, the partition admin
+// operation sets and clears faults.
+type partitionFault struct {
+	drop  bool
+	delay time.Duration
+}
+
+var partitionFaults struct {
+	sync.RWMutex
+	faults map[string]partitionFault
+}
+
+func partitionFaultFor(host string) (partitionFault, bool) {
+	partitionFaults.RLock()
+	defer partitionFaults.RUnlock()
+	fault, found := partitionFaults.faults[host]
+	return fault, found
+}
+
+// dropPeerMessage returns true if a message to or from host is to be
+// dropped.
+func dropPeerMessage(host string) bool {
+	fault, found := partitionFaultFor(host)
+	return found && fault.drop
+}
+
+// delayPeerMessage waits for the delay, if any, of messages from
+// host. It returns false if terminate is closed whilst waiting.
+func delayPeerMessage(host string, terminate chan struct{}) bool {
+	if fault, found := partitionFaultFor(host); found && fault.delay > 0 {
+		select {
+		case <-time.After(fault.delay):
+		case <-terminate:
+			return false
+		}
+	}
+	return true
+}
+
+// AddChaosToAdminAPI serves the partition operation on the AdminAPI.
+func AddChaosToAdminAPI(api *AdminAPI) {
+	api.HandleFunc("partition", servePartition)
+}
+
+// servePartition lists the partition faults. A POST with peer=host
+// sets the fault for that peer: drop=true drops its messages, and
+// delay=duration delays those from it. A POST with only peer=host
+// clears its fault, and with no peer clears every fault.
+func servePartition(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		peer := req.FormValue("peer")
+		fault := partitionFault{}
+		if dropStr := req.FormValue("drop"); dropStr != "" {
+			drop, err := strconv.ParseBool(dropStr)
+			if err != nil {
+				http.Error(w, "drop must be true or false", http.StatusBadRequest)
+				return
+			}
+			fault.drop = drop
+		}
+		if delayStr := req.FormValue("delay"); delayStr != "" {
+			delay, err := time.ParseDuration(delayStr)
+			if err != nil || delay < 0 {
+				http.Error(w, "delay must be a non-negative duration, e.g. 200ms", http.StatusBadRequest)
+				return
+			}
+			fault.delay = delay
+		}
+		partitionFaults.Lock()
+		switch {
+		case peer == "":
+			partitionFaults.faults = nil
+			log.Println("Partition faults cleared.")
+		case !fault.drop && fault.delay == 0:
+			delete(partitionFaults.faults, peer)
+			log.Printf("Partition fault for %v cleared.\n", peer)
+		default:
+			if partitionFaults.faults == nil {
+				partitionFaults.faults = make(map[string]partitionFault)
+			}
+			partitionFaults.faults[peer] = fault
+			log.Printf("Partition fault for %v set: drop? %v; delay %v.\n", peer, fault.drop, fault.delay)
+		}
+		partitionFaults.Unlock()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	partitionFaults.RLock()
+	hosts := make([]string, 0, len(partitionFaults.faults))
+	for host := range partitionFaults.faults {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	w.Header().Set("Content-Type", "text/plain")
+	for _, host := range hosts {
+		fault := partitionFaults.faults[host]
+		fmt.Fprintf(w, "%v: drop? %v; delay %v\n", host, fault.drop, fault.delay)
+	}
+	partitionFaults.RUnlock()
+}
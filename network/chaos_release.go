@@ -0,0 +1,26 @@
+// +build !chaos
+
+package network
+
+import (
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/server/capnp"
+)
+
+// interceptTopologyMessage is a no-op except in chaos builds: see
+// chaos.go.
+func interceptTopologyMessage(sender common.RMId, msg msgs.Message) (msgs.Message, bool) {
+	return msg, true
+}
+
+func dropPeerMessage(host string) bool {
+	return false
+}
+
+func delayPeerMessage(host string, terminate chan struct{}) bool {
+	return true
+}
+
+// AddChaosToAdminAPI does nothing except in chaos builds, where it
+// adds the partition operation.
+func AddChaosToAdminAPI(api *AdminAPI) {}
@@ -0,0 +1,95 @@
+package network
+
+import (
+	"fmt"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/configuration"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ClientListeners holds the additional client-only listeners, and
+// can change them whilst the server is running. Reconfiguring shuts
+// down the listeners whose configuration has gone or changed, and
+// then starts listeners for the new and changed configurations. The
+// listeners whose configuration is unchanged are left alone. Shutting
+// down a listener only stops it accepting connections: clients
+// already connected through it stay connected.
+type ClientListeners struct {
+	sync.Mutex
+	connectionManager *ConnectionManager
+	listeners         map[uint16]*clientListener
+}
+
+type clientListener struct {
+	config   *configuration.ListenerConfiguration
+	listener *Listener
+}
+
+func NewClientListeners(cm *ConnectionManager) *ClientListeners {
+	return &ClientListeners{
+		connectionManager: cm,
+		listeners:         make(map[uint16]*clientListener),
+	}
+}
+
+// Reconfigure makes the running listeners match configs. If some
+// listeners can't be started, the others are still started, and the
+// error reports the ones which failed.
+func (cls *ClientListeners) Reconfigure(configs []*configuration.ListenerConfiguration) error {
+	cls.Lock()
+	defer cls.Unlock()
+
+	wanted := make(map[uint16]*configuration.ListenerConfiguration, len(configs))
+	for _, config := range configs {
+		wanted[config.Port] = config
+	}
+	for port, cl := range cls.listeners {
+		if config, found := wanted[port]; !found || !config.Equal(cl.config) {
+			log.Printf("Stopping additional client %v", cl.config)
+			cl.listener.Shutdown()
+			delete(cls.listeners, port)
+		}
+	}
+
+	failures := []string{}
+	for _, config := range configs {
+		if _, found := cls.listeners[config.Port]; found {
+			continue
+		}
+		listener, err := NewClientListener(config, cls.connectionManager)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("port %v: %v", config.Port, err))
+			continue
+		}
+		log.Printf("Started additional client %v", config)
+		cls.listeners[config.Port] = &clientListener{
+			config:   config,
+			listener: listener,
+		}
+	}
+	if len(failures) != 0 {
+		return fmt.Errorf("Unable to start additional client listeners: %v", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (cls *ClientListeners) Shutdown() {
+	cls.Reconfigure(nil)
+}
+
+func (cls *ClientListeners) Status(sc *server.StatusConsumer) {
+	cls.Lock()
+	ports := make([]int, 0, len(cls.listeners))
+	for port := range cls.listeners {
+		ports = append(ports, int(port))
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		sc.Emit(fmt.Sprintf("Additional client %v", cls.listeners[uint16(port)].config))
+	}
+	cls.Unlock()
+	sc.Join()
+}
@@ -0,0 +1,134 @@
+package network
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/server"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+var clientReconnectsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "goshawkdb",
+	Name:      "client_reconnects_rejected_total",
+	Help:      "Number of client connections closed or refused whose reconnects are then rate limited, by reason.",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(clientReconnectsRejected)
+}
+
+// clientRejectionReason is why a client's connection was closed or
+// refused. The client protocol has no way to tell the client the
+// reason, or when to retry: its connection is just closed.
+type clientRejectionReason string
+
+const (
+	clientRejectionRateLimited        clientRejectionReason = "rateLimited"
+	clientRejectionUnknownCertificate clientRejectionReason = "unknownCertificate"
+	clientRejectionRootsChanged       clientRejectionReason = "rootsChanged"
+	clientRejectionDecommissioning    clientRejectionReason = "decommissioning"
+)
+
+// ClientReconnects limits the rate at which a client may reconnect
+// after its connection has been closed or refused because of its
+// certificate or roots. When the roots change, every affected client
+// is disconnected at once; without a limit they all reconnect at
+// once, and those still presenting old certificates are refused and
+// reconnect again, indefinitely. So every such client (identified by
+// its certificate's fingerprint) must wait before retrying, and a
+// client which retries sooner is refused again without being
+// authenticated. Each refusal doubles the wait, up to
+// server.ClientReconnectMaxDelay, with jitter so that refused clients
+// don't return in lock-step. A fingerprint which waits out its delay
+// and then stays away for server.ClientReconnectMaxDelay is forgotten.
+type ClientReconnects struct {
+	sync.Mutex
+	fingerprints map[[sha256.Size]byte]*clientReconnect
+	prunedAt     time.Time
+	rng          *mrand.Rand
+	rejected     uint64
+	refused      uint64
+}
+
+type clientReconnect struct {
+	delay time.Duration
+	until time.Time
+}
+
+func NewClientReconnects() *ClientReconnects {
+	return &ClientReconnects{
+		fingerprints: make(map[[sha256.Size]byte]*clientReconnect),
+		prunedAt:     time.Now(),
+		rng:          mrand.New(mrand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// reject records that the client with fingerprint has had its
+// connection closed or refused, so must wait before reconnecting.
+func (rc *ClientReconnects) reject(fingerprint [sha256.Size]byte, reason clientRejectionReason) {
+	clientReconnectsRejected.WithLabelValues(string(reason)).Inc()
+	if rc == nil {
+		return
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	rc.rejected++
+	rc.delay(fingerprint, time.Now())
+}
+
+// admit returns 0 if the client with fingerprint may connect now,
+// otherwise how much longer it must wait. Connecting too early
+// doubles the wait.
+func (rc *ClientReconnects) admit(fingerprint [sha256.Size]byte) time.Duration {
+	if rc == nil {
+		return 0
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	now := time.Now()
+	if r, found := rc.fingerprints[fingerprint]; !found || !now.Before(r.until) {
+		return 0
+	}
+	rc.refused++
+	clientReconnectsRejected.WithLabelValues(string(clientRejectionRateLimited)).Inc()
+	return rc.delay(fingerprint, now)
+}
+
+func (rc *ClientReconnects) delay(fingerprint [sha256.Size]byte, now time.Time) time.Duration {
+	if now.Sub(rc.prunedAt) > server.ClientReconnectMaxDelay {
+		rc.prunedAt = now
+		for fp, r := range rc.fingerprints {
+			if now.Sub(r.until) > server.ClientReconnectMaxDelay {
+				delete(rc.fingerprints, fp)
+			}
+		}
+	}
+	r, found := rc.fingerprints[fingerprint]
+	if !found {
+		r = &clientReconnect{}
+		rc.fingerprints[fingerprint] = r
+	}
+	r.delay *= 2
+	if r.delay < server.ClientReconnectMinDelay {
+		r.delay = server.ClientReconnectMinDelay
+	} else if r.delay > server.ClientReconnectMaxDelay {
+		r.delay = server.ClientReconnectMaxDelay
+	}
+	retryAfter := r.delay + time.Duration(rc.rng.Int63n(int64(r.delay)/2+1))
+	r.until = now.Add(retryAfter)
+	return retryAfter
+}
+
+func (rc *ClientReconnects) Status(sc *server.StatusConsumer) {
+	if rc == nil {
+		return
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	sc.Emit(fmt.Sprintf("Client reconnects: %v rejected; %v refused for reconnecting too soon; %v fingerprints tracked",
+		rc.rejected, rc.refused, len(rc.fingerprints)))
+	sc.Join()
+}
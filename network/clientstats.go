@@ -0,0 +1,184 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	cmsgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var clientReadDrift = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "goshawkdb",
+	Name:      "client_read_drift_versions",
+	Help:      "Number of versions behind the reads of client txns aborted for reading out of date versions were.",
+	Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+})
+
+func init() {
+	prometheus.MustRegister(clientReadDrift)
+}
+
+// clientConnectionStats is maintained by a client Connection. The
+// counters are updated from both the connection's actor and its
+// reader, so must only be accessed atomically. driftWarned is only
+// used from the actor.
+type clientConnectionStats struct {
+	connectedAt   time.Time
+	fingerprint   [sha256.Size]byte
+	txnsSubmitted uint64
+	commits       uint64
+	aborts        uint64
+	errors        uint64
+	bytesIn       uint64
+	bytesOut      uint64
+	staleReads    uint64
+	driftTotal    uint64
+	driftMax      uint64
+	driftWarned   time.Time
+}
+
+// ClientConnectionStats is a snapshot of the statistics of a single
+// client connection.
+type ClientConnectionStats struct {
+	ConnectionNumber uint32
+	RemoteHost       string
+	Fingerprint      string
+	ConnectedAt      time.Time
+	TxnsSubmitted    uint64
+	Commits          uint64
+	Aborts           uint64
+	Errors           uint64
+	BytesIn          uint64
+	BytesOut         uint64
+	StaleReads       uint64
+	MeanDrift        float64
+	MaxDrift         uint64
+}
+
+func newClientConnectionStats(fingerprint [sha256.Size]byte) *clientConnectionStats {
+	return &clientConnectionStats{
+		connectedAt: time.Now(),
+		fingerprint: fingerprint,
+	}
+}
+
+func (ccs *clientConnectionStats) outcome(clientOutcome *cmsgs.ClientTxnOutcome, err error) {
+	switch {
+	case err != nil:
+		atomic.AddUint64(&ccs.errors, 1)
+	case clientOutcome == nil:
+	case clientOutcome.Which() == cmsgs.CLIENTTXNOUTCOME_COMMIT:
+		atomic.AddUint64(&ccs.commits, 1)
+	case clientOutcome.Which() == cmsgs.CLIENTTXNOUTCOME_ABORT:
+		atomic.AddUint64(&ccs.aborts, 1)
+	default:
+		atomic.AddUint64(&ccs.errors, 1)
+	}
+}
+
+// staleRead records that a txn of the client aborted because its
+// reads were drift versions behind. A client which keeps reading far
+// out of date versions is most likely caching too aggressively. If
+// warnDrift is non-zero, reads at least that far behind are logged,
+// at most once per ClientDriftWarnInterval.
+func (ccs *clientConnectionStats) staleRead(drift, warnDrift uint64, conn *Connection) {
+	clientReadDrift.Observe(float64(drift))
+	atomic.AddUint64(&ccs.staleReads, 1)
+	atomic.AddUint64(&ccs.driftTotal, drift)
+	for {
+		old := atomic.LoadUint64(&ccs.driftMax)
+		if drift <= old || atomic.CompareAndSwapUint64(&ccs.driftMax, old, drift) {
+			break
+		}
+	}
+	if warnDrift != 0 && drift >= warnDrift {
+		if now := time.Now(); now.Sub(ccs.driftWarned) >= server.ClientDriftWarnInterval {
+			ccs.driftWarned = now
+			log.Printf("Warning: client %v (%v, %x) read versions %v behind the latest; it may be caching too aggressively.\n",
+				conn.ConnectionNumber, conn.remoteHost, ccs.fingerprint, drift)
+		}
+	}
+}
+
+func (ccs *clientConnectionStats) snapshot(conn *Connection) *ClientConnectionStats {
+	staleReads := atomic.LoadUint64(&ccs.staleReads)
+	meanDrift := 0.0
+	if staleReads != 0 {
+		meanDrift = float64(atomic.LoadUint64(&ccs.driftTotal)) / float64(staleReads)
+	}
+	return &ClientConnectionStats{
+		ConnectionNumber: conn.ConnectionNumber,
+		RemoteHost:       conn.remoteHost,
+		Fingerprint:      hex.EncodeToString(ccs.fingerprint[:]),
+		ConnectedAt:      ccs.connectedAt,
+		TxnsSubmitted:    atomic.LoadUint64(&ccs.txnsSubmitted),
+		Commits:          atomic.LoadUint64(&ccs.commits),
+		Aborts:           atomic.LoadUint64(&ccs.aborts),
+		Errors:           atomic.LoadUint64(&ccs.errors),
+		BytesIn:          atomic.LoadUint64(&ccs.bytesIn),
+		BytesOut:         atomic.LoadUint64(&ccs.bytesOut),
+		StaleReads:       staleReads,
+		MeanDrift:        meanDrift,
+		MaxDrift:         atomic.LoadUint64(&ccs.driftMax),
+	}
+}
+
+func (stats *ClientConnectionStats) String() string {
+	return fmt.Sprintf("Client %v (%v, %v) connected at %v: %v txns submitted; %v commits; %v aborts; %v errors; %v bytes in; %v bytes out; %v stale reads (mean drift %.1f; max drift %v)",
+		stats.ConnectionNumber, stats.RemoteHost, stats.Fingerprint, stats.ConnectedAt,
+		stats.TxnsSubmitted, stats.Commits, stats.Aborts, stats.Errors, stats.BytesIn, stats.BytesOut,
+		stats.StaleReads, stats.MeanDrift, stats.MaxDrift)
+}
+
+// countingReader counts the bytes read from a client socket.
+type countingReader struct {
+	io.Reader
+	count *uint64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	atomic.AddUint64(cr.count, uint64(n))
+	return n, err
+}
+
+// ClientConnectionStats returns the statistics of every current
+// client connection, ordered by connection number.
+func (cm *ConnectionManager) ClientConnectionStats() []*ClientConnectionStats {
+	cm.RLock()
+	result := make([]*ClientConnectionStats, 0, len(cm.connCountToClient))
+	for _, conn := range cm.connCountToClient {
+		if c, ok := conn.(*Connection); ok && c.clientStats != nil {
+			result = append(result, c.clientStats.snapshot(c))
+		}
+	}
+	cm.RUnlock()
+	sort.Sort(statsByConnNumber(result))
+	return result
+}
+
+type statsByConnNumber []*ClientConnectionStats
+
+func (s statsByConnNumber) Len() int           { return len(s) }
+func (s statsByConnNumber) Less(i, j int) bool { return s[i].ConnectionNumber < s[j].ConnectionNumber }
+func (s statsByConnNumber) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// ServeClientConnectionStats writes the statistics of every current
+// client connection as JSON.
+func (cm *ConnectionManager) ServeClientConnectionStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cm.ClientConnectionStats())
+}
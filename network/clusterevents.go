@@ -0,0 +1,230 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/configuration"
+	eng "goshawkdb.io/server/txnengine"
+	"log"
+	"sync"
+	"time"
+)
+
+// The types of ClusterEvent.
+const (
+	ClusterEventRMAdded                = "rm-added"
+	ClusterEventRMRemoved              = "rm-removed"
+	ClusterEventTopologyChangeStarted  = "topology-change-started"
+	ClusterEventTopologyVersionChanged = "topology-version-changed"
+)
+
+// ClusterEvent is a change to the cluster, as published into the
+// ClusterEventsRootName root.
+type ClusterEvent struct {
+	Type            string
+	Time            time.Time
+	Reporter        common.RMId
+	TopologyVersion uint32
+	PreviousVersion uint32      `json:",omitempty"`
+	NextVersion     uint32      `json:",omitempty"`
+	RMId            common.RMId `json:",omitempty"`
+}
+
+// ClusterEventsPublisher appends an event to the
+// ClusterEventsRootName root for each change to the cluster: RMs
+// being added and removed, topology changes starting, and the
+// topology version changing. Each event is a var holding JSON, so
+// clients granted the root can subscribe to cluster events through
+// the normal client protocol. The root's value is the latest event,
+// and its references are the most recent events, newest first. Once
+// retain events have been published, each event overwrites the var
+// of the oldest (see rootAppender).
+//
+// Every node observes the same changes, so to avoid duplicates, only
+// the node with the lowest RMId in the new topology publishes
+// them. Events are queued and published in order; if the queue
+// becomes full, the oldest events are dropped.
+type ClusterEventsPublisher struct {
+	sync.Mutex
+	connectionManager *ConnectionManager
+	retain            int
+	appender          *rootAppender // only used by run
+	topology          *configuration.Topology
+	queue             []*ClusterEvent
+	published         uint64
+	dropped           uint64
+	lastErr           error
+	wakeup            chan struct{}
+	terminate         chan struct{}
+	terminated        chan struct{}
+}
+
+func NewClusterEventsPublisher(cm *ConnectionManager, retain int) *ClusterEventsPublisher {
+	cep := &ClusterEventsPublisher{
+		connectionManager: cm,
+		retain:            retain,
+		wakeup:            make(chan struct{}, 1),
+		terminate:         make(chan struct{}),
+		terminated:        make(chan struct{}),
+	}
+	cep.appender = newRootAppender(cm, server.ClusterEventsRootName, retain, server.ClusterEventsMaxAttempts, cep.terminate)
+	cep.topology = cm.AddTopologySubscriber(eng.ConnectionSubscriber, cep)
+	go cep.run()
+	return cep
+}
+
+func (cep *ClusterEventsPublisher) Shutdown() {
+	cep.connectionManager.RemoveTopologySubscriberAsync(eng.ConnectionSubscriber, cep)
+	close(cep.terminate)
+	<-cep.terminated
+}
+
+func (cep *ClusterEventsPublisher) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	cep.Lock()
+	defer cep.Unlock()
+	old := cep.topology
+	cep.topology = topology
+	done(true)
+	if cep.retain == 0 || old == nil || old.IsBlank() || topology == nil || topology.IsBlank() {
+		return
+	}
+	for _, rmId := range topology.RMs().NonEmpty() {
+		if rmId < cep.connectionManager.RMId {
+			return
+		}
+	}
+	for _, event := range clusterEvents(old, topology) {
+		event.Reporter = cep.connectionManager.RMId
+		cep.enqueue(event)
+	}
+}
+
+// clusterEvents returns the events which took the cluster from old
+// to topology.
+func clusterEvents(old, topology *configuration.Topology) []*ClusterEvent {
+	now := time.Now()
+	events := []*ClusterEvent{}
+	if topology.Version != old.Version {
+		events = append(events, &ClusterEvent{
+			Type:            ClusterEventTopologyVersionChanged,
+			Time:            now,
+			TopologyVersion: topology.Version,
+			PreviousVersion: old.Version,
+		})
+	}
+	if next := topology.Next(); next != nil && (old.Next() == nil || old.Next().Version != next.Version) {
+		events = append(events, &ClusterEvent{
+			Type:            ClusterEventTopologyChangeStarted,
+			Time:            now,
+			TopologyVersion: topology.Version,
+			NextVersion:     next.Version,
+		})
+	}
+	oldRMIds := make(map[common.RMId]server.EmptyStruct)
+	for _, rmId := range old.RMs().NonEmpty() {
+		oldRMIds[rmId] = server.EmptyStructVal
+	}
+	for _, rmId := range topology.RMs().NonEmpty() {
+		if _, found := oldRMIds[rmId]; found {
+			delete(oldRMIds, rmId)
+		} else {
+			events = append(events, &ClusterEvent{
+				Type:            ClusterEventRMAdded,
+				Time:            now,
+				TopologyVersion: topology.Version,
+				RMId:            rmId,
+			})
+		}
+	}
+	for _, rmId := range old.RMs().NonEmpty() {
+		if _, found := oldRMIds[rmId]; found {
+			events = append(events, &ClusterEvent{
+				Type:            ClusterEventRMRemoved,
+				Time:            now,
+				TopologyVersion: topology.Version,
+				RMId:            rmId,
+			})
+		}
+	}
+	return events
+}
+
+// enqueue must be called with the lock held.
+func (cep *ClusterEventsPublisher) enqueue(event *ClusterEvent) {
+	if len(cep.queue) >= server.ClusterEventsQueueMax {
+		cep.queue = cep.queue[1:]
+		cep.dropped++
+	}
+	cep.queue = append(cep.queue, event)
+	select {
+	case cep.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (cep *ClusterEventsPublisher) Status(sc *server.StatusConsumer) {
+	cep.Lock()
+	defer cep.Unlock()
+	if cep.retain == 0 {
+		sc.Emit(fmt.Sprintf("Cluster events publishing to %v: disabled", server.ClusterEventsRootName))
+	} else {
+		sc.Emit(fmt.Sprintf("Cluster events publishing to %v: retaining %v events; %v published, %v queued, %v dropped; last error: %v",
+			server.ClusterEventsRootName, cep.retain, cep.published, len(cep.queue), cep.dropped, cep.lastErr))
+	}
+	sc.Join()
+}
+
+func (cep *ClusterEventsPublisher) run() {
+	defer close(cep.terminated)
+	for {
+		select {
+		case <-cep.terminate:
+			return
+		case <-cep.wakeup:
+		}
+		for {
+			cep.Lock()
+			if len(cep.queue) == 0 {
+				cep.Unlock()
+				break
+			}
+			event, topology := cep.queue[0], cep.topology
+			cep.Unlock()
+
+			err := cep.publish(topology, event)
+			if err != nil {
+				log.Println("Cluster events publishing error:", err)
+			}
+			cep.Lock()
+			// Whether or not it was published, we're done with the
+			// event, unless it was dropped whilst we were publishing.
+			if len(cep.queue) != 0 && cep.queue[0] == event {
+				cep.queue = cep.queue[1:]
+			}
+			cep.lastErr = err
+			cep.Unlock()
+
+			select {
+			case <-cep.terminate:
+				return
+			default:
+			}
+		}
+	}
+}
+
+func (cep *ClusterEventsPublisher) publish(topology *configuration.Topology, event *ClusterEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	published, err := cep.appender.append(topology, value)
+	if published {
+		cep.Lock()
+		cep.published++
+		cep.Unlock()
+	}
+	return err
+}
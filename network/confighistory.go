@@ -0,0 +1,402 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mdb "github.com/msackman/gomdb"
+	mdbs "github.com/msackman/gomdb/server"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server/configuration"
+	"goshawkdb.io/server/db"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	db.DB.ConfigHistory = &mdbs.DBISettings{Flags: mdb.CREATE}
+}
+
+// Where a configuration change came from. A node which learns of a
+// new topology from the rest of the cluster, rather than being asked
+// to change to it, records it as observed.
+const (
+	ConfigSourceCommandLine = "cmdline"
+	ConfigSourceSIGHUP      = "sighup"
+	ConfigSourceRemote      = "remote"
+	ConfigSourceClient      = "client"
+	ConfigSourceObserved    = "observed"
+	ConfigSourceAdmin       = "admin"
+)
+
+// ConfigHistoryEntry is a configuration this node has applied, along
+// with where the change came from and any comment made by the
+// operator, either when requesting the change or afterwards.
+type ConfigHistoryEntry struct {
+	Version      uint32
+	Time         time.Time
+	Source       string
+	Comment      string `json:",omitempty"`
+	ClusterId    string
+	ClusterUUId  uint64
+	Hosts        []string
+	F            uint8
+	MaxRMCount   uint16
+	NoSync       bool
+	RMs          common.RMIds
+	RMsRemoved   common.RMIds
+	Fingerprints map[string]map[string]string
+	Placement    map[string][]string `json:",omitempty"`
+	Learners     map[string][]string `json:",omitempty"`
+}
+
+type configRequest struct {
+	source  string
+	comment string
+}
+
+// configHistory durably records every configuration which the
+// TopologyTransmogrifier applies, keyed by version. It is only used
+// from within the TopologyTransmogrifier's actor, except for the
+// read-only and annotation functions, which go straight to disk.
+type configHistory struct {
+	db       *db.Databases
+	requests map[uint32]*configRequest
+	latest   uint32
+}
+
+func newConfigHistory(db *db.Databases) *configHistory {
+	ch := &configHistory{
+		db:       db,
+		requests: make(map[uint32]*configRequest),
+	}
+	if entries, err := LoadConfigHistory(db); err != nil {
+		log.Println("Unable to load configuration history:", err)
+	} else if len(entries) != 0 {
+		ch.latest = entries[len(entries)-1].Version
+	}
+	return ch
+}
+
+func configHistoryDBKey(version uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, version)
+	return key
+}
+
+// requested remembers where the request to change to config came
+// from, for when it is applied.
+func (ch *configHistory) requested(config *configuration.Configuration, source, comment string) {
+	if config != nil && config.Version > ch.latest {
+		ch.requests[config.Version] = &configRequest{source: source, comment: comment}
+	}
+}
+
+// applied records topology if it is newer than anything already
+// recorded.
+func (ch *configHistory) applied(topology *configuration.Topology) {
+	if topology.Version <= ch.latest {
+		return
+	}
+	entry := newConfigHistoryEntry(topology.Configuration)
+	entry.Source = ConfigSourceObserved
+	if req, found := ch.requests[topology.Version]; found {
+		entry.Source = req.source
+		entry.Comment = req.comment
+	}
+	for version := range ch.requests {
+		if version <= topology.Version {
+			delete(ch.requests, version)
+		}
+	}
+	if err := ch.put(entry); err != nil {
+		log.Println("Unable to record configuration history:", err)
+		return
+	}
+	ch.latest = topology.Version
+}
+
+func (ch *configHistory) put(entry *ConfigHistoryEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = ch.db.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
+		if err := rwtxn.Put(ch.db.ConfigHistory, configHistoryDBKey(entry.Version), value, 0); err != nil {
+			rwtxn.Error(err)
+		}
+		return nil
+	}).ResultError()
+	return err
+}
+
+// annotate sets the comment on the entry for version.
+func (ch *configHistory) annotate(version uint32, comment string) error {
+	_, err := ch.db.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
+		key := configHistoryDBKey(version)
+		value, err := rwtxn.Get(ch.db.ConfigHistory, key)
+		if err == mdb.NotFound {
+			rwtxn.Error(fmt.Errorf("No configuration with version %v in history", version))
+			return nil
+		} else if err != nil {
+			rwtxn.Error(err)
+			return nil
+		}
+		entry := &ConfigHistoryEntry{}
+		if err = json.Unmarshal(value, entry); err != nil {
+			rwtxn.Error(err)
+			return nil
+		}
+		entry.Comment = comment
+		if value, err = json.Marshal(entry); err != nil {
+			rwtxn.Error(err)
+		} else if err = rwtxn.Put(ch.db.ConfigHistory, key, value, 0); err != nil {
+			rwtxn.Error(err)
+		}
+		return nil
+	}).ResultError()
+	return err
+}
+
+func newConfigHistoryEntry(config *configuration.Configuration) *ConfigHistoryEntry {
+	entry := &ConfigHistoryEntry{
+		Version:      config.Version,
+		Time:         time.Now(),
+		ClusterId:    config.ClusterId,
+		ClusterUUId:  config.ClusterUUId(),
+		Hosts:        config.Hosts,
+		F:            config.F,
+		MaxRMCount:   config.MaxRMCount,
+		NoSync:       config.NoSync,
+		RMs:          config.RMs(),
+		RMsRemoved:   make(common.RMIds, 0, len(config.RMsRemoved())),
+		Fingerprints: make(map[string]map[string]string, len(config.Fingerprints())),
+		Placement:    config.Placement(),
+		Learners:     config.Learners(),
+	}
+	for rmId := range config.RMsRemoved() {
+		entry.RMsRemoved = append(entry.RMsRemoved, rmId)
+		for idx := len(entry.RMsRemoved) - 1; idx > 0 && entry.RMsRemoved[idx] < entry.RMsRemoved[idx-1]; idx-- {
+			entry.RMsRemoved[idx], entry.RMsRemoved[idx-1] = entry.RMsRemoved[idx-1], entry.RMsRemoved[idx]
+		}
+	}
+	for fingerprint, roots := range config.Fingerprints() {
+		rootsCaps := make(map[string]string, len(roots))
+		for name, capability := range roots {
+			rootsCaps[name] = capabilityName(capability)
+		}
+		entry.Fingerprints[hex.EncodeToString(fingerprint[:])] = rootsCaps
+	}
+	return entry
+}
+
+// LoadConfigHistory returns every recorded configuration, oldest
+// first.
+func LoadConfigHistory(db *db.Databases) ([]*ConfigHistoryEntry, error) {
+	res, err := db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+		res, _ := rtxn.WithCursor(db.ConfigHistory, func(cursor *mdbs.Cursor) interface{} {
+			entries := []*ConfigHistoryEntry{}
+			_, value, err := cursor.Get(nil, nil, mdb.FIRST)
+			for ; err == nil; _, value, err = cursor.Get(nil, nil, mdb.NEXT) {
+				entry := &ConfigHistoryEntry{}
+				if err := json.Unmarshal(value, entry); err != nil {
+					cursor.Error(err)
+					return nil
+				}
+				entries = append(entries, entry)
+			}
+			if err != mdb.NotFound {
+				cursor.Error(err)
+				return nil
+			}
+			return entries
+		})
+		return res
+	}).ResultError()
+	if err != nil {
+		return nil, err
+	}
+	entries, _ := res.([]*ConfigHistoryEntry)
+	return entries, nil
+}
+
+func (entry *ConfigHistoryEntry) String() string {
+	str := fmt.Sprintf("%v\t%v\t%v", entry.Version, entry.Time.Format(time.RFC3339), entry.Source)
+	if entry.Comment != "" {
+		str += "\t" + entry.Comment
+	}
+	return str
+}
+
+// Diff describes, one line per difference, how b differs from a.
+func (a *ConfigHistoryEntry) Diff(b *ConfigHistoryEntry) []string {
+	diffs := []string{}
+	field := func(name string, av, bv interface{}) {
+		if fmt.Sprint(av) != fmt.Sprint(bv) {
+			diffs = append(diffs, fmt.Sprintf("%v: %v -> %v", name, av, bv))
+		}
+	}
+	field("ClusterId", a.ClusterId, b.ClusterId)
+	field("ClusterUUId", a.ClusterUUId, b.ClusterUUId)
+	field("F", a.F, b.F)
+	field("MaxRMCount", a.MaxRMCount, b.MaxRMCount)
+	field("NoSync", a.NoSync, b.NoSync)
+	diffs = append(diffs, diffStrings("Hosts", a.Hosts, b.Hosts)...)
+	diffs = append(diffs, diffStrings("RMs", rmIdStrings(a.RMs), rmIdStrings(b.RMs))...)
+	diffs = append(diffs, diffStrings("RMsRemoved", rmIdStrings(a.RMsRemoved), rmIdStrings(b.RMsRemoved))...)
+	fingerprints := make(map[string]bool)
+	for fingerprint := range a.Fingerprints {
+		fingerprints[fingerprint] = true
+	}
+	for fingerprint := range b.Fingerprints {
+		fingerprints[fingerprint] = true
+	}
+	sorted := make([]string, 0, len(fingerprints))
+	for fingerprint := range fingerprints {
+		sorted = append(sorted, fingerprint)
+	}
+	sort.Strings(sorted)
+	for _, fingerprint := range sorted {
+		aRoots, aFound := a.Fingerprints[fingerprint]
+		bRoots, bFound := b.Fingerprints[fingerprint]
+		switch {
+		case !aFound:
+			diffs = append(diffs, fmt.Sprintf("+ Fingerprint %v: %v", fingerprint, bRoots))
+		case !bFound:
+			diffs = append(diffs, fmt.Sprintf("- Fingerprint %v: %v", fingerprint, aRoots))
+		default:
+			field("Fingerprint "+fingerprint, aRoots, bRoots)
+		}
+	}
+	roots := make(map[string]bool)
+	for name := range a.Placement {
+		roots[name] = true
+	}
+	for name := range b.Placement {
+		roots[name] = true
+	}
+	sorted = sorted[:0]
+	for name := range roots {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		diffs = append(diffs, diffStrings("Placement "+name, a.Placement[name], b.Placement[name])...)
+	}
+	hosts := make(map[string]bool)
+	for host := range a.Learners {
+		hosts[host] = true
+	}
+	for host := range b.Learners {
+		hosts[host] = true
+	}
+	sorted = sorted[:0]
+	for host := range hosts {
+		sorted = append(sorted, host)
+	}
+	sort.Strings(sorted)
+	for _, host := range sorted {
+		diffs = append(diffs, diffStrings("Learner "+host, a.Learners[host], b.Learners[host])...)
+	}
+	return diffs
+}
+
+func rmIdStrings(rmIds common.RMIds) []string {
+	strs := make([]string, len(rmIds))
+	for idx, rmId := range rmIds {
+		strs[idx] = fmt.Sprint(rmId)
+	}
+	return strs
+}
+
+func diffStrings(name string, a, b []string) []string {
+	diffs := []string{}
+	inA := make(map[string]bool, len(a))
+	for _, s := range a {
+		inA[s] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, s := range b {
+		inB[s] = true
+		if !inA[s] {
+			diffs = append(diffs, fmt.Sprintf("+ %v: %v", name, s))
+		}
+	}
+	for _, s := range a {
+		if !inB[s] {
+			diffs = append(diffs, fmt.Sprintf("- %v: %v", name, s))
+		}
+	}
+	return diffs
+}
+
+// ServeConfigHistory lists (GET) the configurations this node has
+// applied, as JSON. With the diff query parameter (two comma
+// separated versions) it instead returns how the second version
+// differs from the first. POST sets the comment on the version given.
+func (tt *TopologyTransmogrifier) ServeConfigHistory(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		entries, err := LoadConfigHistory(tt.db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if diff := req.FormValue("diff"); diff != "" {
+			diffs, err := DiffConfigHistory(entries, diff)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(diffs)
+		} else {
+			json.NewEncoder(w).Encode(entries)
+		}
+	case "POST":
+		version, err := strconv.ParseUint(req.FormValue("version"), 10, 32)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Illegal version: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := tt.configHistory.annotate(uint32(version), strings.TrimSpace(req.FormValue("comment"))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DiffConfigHistory finds the two versions named in versions (comma
+// separated) in entries, and returns how the second differs from the
+// first.
+func DiffConfigHistory(entries []*ConfigHistoryEntry, versions string) ([]string, error) {
+	parts := strings.Split(versions, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Diff requires two comma separated versions, not %q", versions)
+	}
+	found := make([]*ConfigHistoryEntry, 2)
+	for idx, part := range parts {
+		version, err := strconv.ParseUint(strings.TrimSpace(part), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Illegal version %q: %v", part, err)
+		}
+		for _, entry := range entries {
+			if entry.Version == uint32(version) {
+				found[idx] = entry
+				break
+			}
+		}
+		if found[idx] == nil {
+			return nil, fmt.Errorf("No configuration with version %v in history", version)
+		}
+	}
+	return found[0].Diff(found[1]), nil
+}
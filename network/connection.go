@@ -10,6 +10,7 @@ import (
 	"fmt"
 	capn "github.com/glycerine/go-capnproto"
 	cc "github.com/msackman/chancell"
+	"github.com/prometheus/client_golang/prometheus"
 	"goshawkdb.io/common"
 	cmsgs "goshawkdb.io/common/capnp"
 	"goshawkdb.io/server"
@@ -22,23 +23,51 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var clientReadsPaused = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "goshawkdb",
+	Name:      "client_reads_paused_total",
+	Help:      "Number of client txns delayed due to outcome accumulator pressure.",
+})
+
+var serverDuplicateConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "goshawkdb",
+	Name:      "server_duplicate_connections_total",
+	Help:      "Number of duplicate connections between servers closed, by whether they were refused in the handshake or closed once established.",
+}, []string{"resolved"})
+
+func init() {
+	prometheus.MustRegister(clientReadsPaused)
+	prometheus.MustRegister(serverDuplicateConnections)
+}
+
 type Connection struct {
 	remoteHost        string
 	remoteRMId        common.RMId
 	remoteBootCount   uint32
 	remoteClusterUUId uint64
+	remoteFeatures    uint32
+	remoteLinks       uint8
+	link              uint8
+	dialled           bool
+	dialActive        int32
 	combinedTieBreak  uint32
 	socket            net.Conn
 	ConnectionNumber  uint32
 	connectionManager *ConnectionManager
+	clientOnly        *clientOnlyListener
 	submitter         *client.ClientTxnSubmitter
+	clientStats       *clientConnectionStats
+	identity          atomic.Value // *clientIdentity
+	limitSlot         connectionLimitSlot
 	cellTail          *cc.ChanCellTail
 	enqueueQueryInner func(connectionMsg, *cc.ChanCell, cc.CurCellConsumer) (bool, cc.CurCellConsumer)
 	queryChan         <-chan connectionMsg
 	rng               *rand.Rand
+	quality           *peerQuality
 	currentState      connectionStateMachineComponent
 	connectionDelay
 	connectionDial
@@ -88,6 +117,8 @@ type connectionMsgStatus struct {
 	*server.StatusConsumer
 }
 
+type connectionMsgTrimCache struct{ connectionMsgBasic }
+
 func (conn *Connection) Shutdown(sync paxos.Blocking) {
 	if conn.enqueueQuery(connectionMsgShutdown{}) && sync == paxos.Sync {
 		conn.cellTail.Wait()
@@ -98,6 +129,21 @@ func (conn *Connection) Send(msg []byte) {
 	conn.enqueueQuery(connectionMsgSend(msg))
 }
 
+// clientIdentity is who a client connection is. It is published, and
+// never changed, once the client's handshake completes, so it may be
+// read from any go-routine, unlike the rest of the connection's
+// state.
+type clientIdentity struct {
+	remoteHost  string
+	fingerprint [sha256.Size]byte
+}
+
+// clientIdentity returns nil until the client's handshake completes.
+func (conn *Connection) clientIdentity() *clientIdentity {
+	identity, _ := conn.identity.Load().(*clientIdentity)
+	return identity
+}
+
 func (conn *Connection) SubmissionOutcomeReceived(sender common.RMId, txn *eng.TxnReader, outcome *msgs.Outcome) {
 	conn.enqueueQuery(connectionMsgOutcomeReceived{
 		sender:  sender,
@@ -128,6 +174,12 @@ func (conn *Connection) Status(sc *server.StatusConsumer) {
 	conn.enqueueQuery(connectionMsgStatus{StatusConsumer: sc})
 }
 
+// TrimCache asks a client connection to release what memory it can
+// from its cache of what the client knows. See MemoryPressureMonitor.
+func (conn *Connection) TrimCache() {
+	conn.enqueueQuery(connectionMsgTrimCache{})
+}
+
 type connectionMsgServerConnectionsChanged struct {
 	servers map[common.RMId]paxos.Connection
 	done    func()
@@ -163,12 +215,26 @@ func NewConnectionToDial(host string, cm *ConnectionManager) *Connection {
 	conn := &Connection{
 		remoteHost:        host,
 		connectionManager: cm,
+		dialled:           true,
+	}
+	conn.start()
+	return conn
+}
+
+// newConnectionToDialLink dials an extra link in the pool of
+// connections to host. See serverLinks.
+func newConnectionToDialLink(host string, cm *ConnectionManager, link uint8) *Connection {
+	conn := &Connection{
+		remoteHost:        host,
+		connectionManager: cm,
+		link:              link,
+		dialled:           true,
 	}
 	conn.start()
 	return conn
 }
 
-func NewConnectionFromTCPConn(socket *net.TCPConn, cm *ConnectionManager, count uint32) *Connection {
+func NewConnectionFromTCPConn(socket *net.TCPConn, cm *ConnectionManager, count uint32, clientOnly *clientOnlyListener) *Connection {
 	if err := common.ConfigureSocket(socket); err != nil {
 		log.Println(err)
 		return nil
@@ -177,6 +243,7 @@ func NewConnectionFromTCPConn(socket *net.TCPConn, cm *ConnectionManager, count
 		socket:            socket,
 		connectionManager: cm,
 		ConnectionNumber:  count,
+		clientOnly:        clientOnly,
 	}
 	conn.start()
 	return conn
@@ -242,9 +309,9 @@ func (conn *Connection) actorLoop(head *cc.ChanCellHead) {
 	for !terminate {
 		if oldState != conn.currentState {
 			oldState = conn.currentState
-			terminate, err = conn.currentState.start()
+			terminate, err = conn.guard(&connectionCrashContext{Connection: conn}, conn.currentState.start)
 		} else if msg, ok := <-queryChan; ok {
-			terminate, err = conn.handleMsg(msg)
+			terminate, err = conn.guard(&connectionCrashContext{Connection: conn, msg: msg}, func() (bool, error) { return conn.handleMsg(msg) })
 		} else {
 			head.Next(queryCell, chanFun)
 		}
@@ -255,6 +322,44 @@ func (conn *Connection) actorLoop(head *cc.ChanCellHead) {
 	log.Println("Connection terminated")
 }
 
+// A panic whilst handling a message leaves the connection in an
+// unknown state, but nothing beyond the connection itself: the
+// connection is terminated and, for server connections, the
+// ConnectionManager will redial as normal.
+func (conn *Connection) guard(context fmt.Stringer, fun func() (bool, error)) (terminate bool, err error) {
+	if report := server.Guard("Connection", context, func() { terminate, err = fun() }); report != nil {
+		return true, fmt.Errorf("Connection terminated due to panic: %v", report.Panic)
+	}
+	return
+}
+
+type connectionCrashContext struct {
+	*Connection
+	msg connectionMsg
+}
+
+func (ccc *connectionCrashContext) String() string {
+	str := fmt.Sprintf("Connection %v to %v (RMId %v) in %v", ccc.ConnectionNumber, ccc.remoteHost, ccc.remoteRMId, ccc.currentState)
+	switch msgT := ccc.msg.(type) {
+	case nil:
+	case connectionReadMessage:
+		msg := (msgs.Message)(msgT)
+		str += fmt.Sprintf("; handling server message %v", msg.Which())
+		if txnId := paxos.MessageTxnId(msg); txnId != nil {
+			str += fmt.Sprintf(" for TxnId %v", txnId)
+		}
+	case connectionReadClientMessage:
+		msg := (cmsgs.ClientMessage)(msgT)
+		str += fmt.Sprintf("; handling client message %v", msg.Which())
+		if msg.Which() == cmsgs.CLIENTMESSAGE_CLIENTTXNSUBMISSION {
+			str += fmt.Sprintf(" for TxnId %v", common.MakeTxnId(msg.ClientTxnSubmission().Id()))
+		}
+	default:
+		str += fmt.Sprintf("; handling %T", msgT)
+	}
+	return str
+}
+
 func (conn *Connection) handleMsg(msg connectionMsg) (terminate bool, err error) {
 	switch msgT := msg.(type) {
 	case connectionMsgShutdown:
@@ -272,7 +377,19 @@ func (conn *Connection) handleMsg(msg connectionMsg) (terminate bool, err error)
 	case connectionReadClientMessage:
 		err = conn.handleMsgFromClient((cmsgs.ClientMessage)(msgT))
 	case connectionMsgSend:
-		err = conn.sendMessage(msgT)
+		if conn.isServer {
+			if dropPeerMessage(conn.remoteHost) {
+				break
+			}
+			conn.connectionManager.capture.Outgoing(conn.remoteRMId, msgT)
+			err = conn.sendServerMessage(msgT)
+		} else {
+			err = conn.sendMessage(msgT)
+		}
+	case connectionMsgFlushVotes:
+		err = conn.flushVotes()
+	case connectionMsgRecycle:
+		err = conn.connectionRun.maybeRestartConnection(errRecycled)
 	case connectionMsgOutcomeReceived:
 		err = conn.outcomeReceived(msgT)
 	case *connectionMsgTopologyChanged:
@@ -284,6 +401,10 @@ func (conn *Connection) handleMsg(msg connectionMsg) (terminate bool, err error)
 		}
 	case connectionMsgStatus:
 		conn.status(msgT.StatusConsumer)
+	case connectionMsgTrimCache:
+		if conn.submitter != nil {
+			memoryPressureReclaimed.WithLabelValues("client_cache").Add(float64(conn.submitter.TrimCache()))
+		}
 	default:
 		err = fmt.Errorf("Fatal to Connection: Received unexpected message: %#v", msgT)
 	}
@@ -296,14 +417,22 @@ func (conn *Connection) handleShutdown(err error) {
 	}
 	conn.maybeStopBeater()
 	conn.maybeStopReaderAndCloseSocket()
+	conn.connectionManager.ConnectionLimits.release(conn.limitSlot)
+	conn.limitSlot = connectionLimitNone
 	if conn.isClient {
+		conn.connectionManager.SessionLog.disconnected(conn, err)
 		conn.connectionManager.ClientLost(conn.ConnectionNumber, conn)
 		if conn.submitter != nil {
 			conn.submitter.Shutdown()
 		}
 	}
 	if conn.isServer {
-		conn.connectionManager.ServerLost(conn, conn.remoteRMId, false)
+		conn.quality.forget()
+		if conn.link == 0 {
+			conn.connectionManager.ServerLost(conn, conn.remoteRMId, false)
+		} else {
+			conn.connectionManager.ServerLinkLost(conn, conn.remoteRMId, conn.link)
+		}
 	}
 }
 
@@ -338,7 +467,19 @@ func (conn *Connection) status(sc *server.StatusConsumer) {
 	sc.Emit(fmt.Sprintf("Connection to %v (%v, %v)", conn.remoteHost, conn.remoteRMId, conn.remoteBootCount))
 	sc.Emit(fmt.Sprintf("- Current State: %v", conn.currentState))
 	sc.Emit(fmt.Sprintf("- IsServer? %v", conn.isServer))
+	if conn.link != 0 {
+		sc.Emit(fmt.Sprintf("- Link: %v", conn.link))
+	}
 	sc.Emit(fmt.Sprintf("- IsClient? %v", conn.isClient))
+	if conn.clientOnly != nil {
+		sc.Emit(fmt.Sprintf("- Via: %v", conn.clientOnly))
+	}
+	if conn.clientStats != nil {
+		sc.Emit(fmt.Sprintf("- %v", conn.clientStats.snapshot(conn)))
+	}
+	if conn.quality != nil {
+		sc.Emit(fmt.Sprintf("- %v", conn.quality))
+	}
 	if conn.submitter != nil {
 		conn.submitter.Status(sc.Fork())
 	}
@@ -350,7 +491,7 @@ func (conn *Connection) status(sc *server.StatusConsumer) {
 type connectionDelay struct {
 	connectionMsgBasic
 	*Connection
-	delay *time.Timer
+	delay server.ClockTimer
 }
 
 func (cd *connectionDelay) connectionStateMachineComponentWitness() {}
@@ -361,14 +502,15 @@ func (cd *connectionDelay) init(conn *Connection) {
 }
 
 func (cd *connectionDelay) start() (bool, error) {
+	atomic.StoreInt32(&cd.dialActive, 0)
 	cd.maybeStopReaderAndCloseSocket()
 	cd.maybeStopBeater()
 	cd.isServer = false
 	cd.isClient = false
 	cd.peerCerts = nil
 	if cd.delay == nil {
-		delay := server.ConnectionRestartDelayMin + time.Duration(cd.rng.Intn(server.ConnectionRestartDelayRangeMS))*time.Millisecond
-		cd.delay = time.AfterFunc(delay, func() {
+		delay := cd.quality.restartDelay(cd.rng, cd.connectionManager.AdaptiveHeartbeats)
+		cd.delay = cd.connectionManager.Clock.AfterFunc(delay, func() {
 			cd.enqueueQuery(cd)
 		})
 	}
@@ -396,6 +538,7 @@ func (cc *connectionDial) init(conn *Connection) {
 }
 
 func (cc *connectionDial) start() (bool, error) {
+	atomic.StoreInt32(&cc.dialActive, 1)
 	tcpAddr, err := net.ResolveTCPAddr("tcp", cc.remoteHost)
 	if err != nil {
 		log.Println(err)
@@ -445,9 +588,19 @@ func (cah *connectionAwaitHandshake) start() (bool, error) {
 		hello := cmsgs.ReadRootHello(seg)
 		if cah.verifyHello(&hello) {
 			if hello.IsClient() {
+				slot, err := cah.connectionManager.ConnectionLimits.beginHandshake()
+				if err != nil {
+					return cah.maybeRestartConnection(err)
+				}
+				cah.limitSlot = slot
 				cah.isClient = true
+				cah.remoteHost = cah.socket.RemoteAddr().String()
+				cah.connectionManager.SessionLog.connected(cah.Connection)
 				cah.nextState(&cah.connectionAwaitClientHandshake)
 
+			} else if cah.clientOnly != nil {
+				return cah.maybeRestartConnection(fmt.Errorf("Server connection rejected: %v only accepts clients", cah.clientOnly))
+
 			} else {
 				cah.isServer = true
 				cah.nextState(&cah.connectionAwaitServerHandshake)
@@ -482,6 +635,9 @@ func (cah *connectionAwaitHandshake) makeHello() *capn.Segment {
 
 func (cah *connectionAwaitHandshake) send(msg []byte) error {
 	l := len(msg)
+	if cah.clientStats != nil {
+		atomic.AddUint64(&cah.clientStats.bytesOut, uint64(l))
+	}
 	for l > 0 {
 		switch w, err := cah.socket.Write(msg); {
 		case err != nil:
@@ -496,8 +652,16 @@ func (cah *connectionAwaitHandshake) send(msg []byte) error {
 	return nil
 }
 
+// readOne reads the next message from the socket. Until the
+// handshake has established that the remote is a server, the client
+// maximum message size applies.
 func (cah *connectionAwaitHandshake) readOne() (*capn.Segment, error) {
-	return capn.ReadFromStream(cah.socket, nil)
+	if cah.isServer {
+		return readMessage(cah.socket, cah.connectionManager.MaxServerMessageSize, "server")
+	} else if cah.clientStats != nil {
+		return readMessage(countingReader{Reader: cah.socket, count: &cah.clientStats.bytesIn}, cah.connectionManager.MaxClientMessageSize, "client")
+	}
+	return readMessage(cah.socket, cah.connectionManager.MaxClientMessageSize, "client")
 }
 
 func (cah *connectionAwaitHandshake) verifyHello(hello *cmsgs.Hello) bool {
@@ -615,7 +779,22 @@ func (cash *connectionAwaitServerHandshake) start() (bool, error) {
 
 			cash.remoteClusterUUId = hello.ClusterUUId()
 			cash.remoteBootCount = hello.BootCount()
+			cash.remoteFeatures = hello.FeatureVersion()
+			cash.remoteLinks = hello.Links()
+			if err := cash.verifyAttestation(&hello); err != nil {
+				if cash.dialled {
+					return cash.connectionAwaitHandshake.maybeRestartConnection(err)
+				}
+				return false, err
+			}
+			if cash.link == 0 {
+				// We came from the listener: the dialler tells us which link we are.
+				cash.link = hello.Link()
+			}
 			cash.combinedTieBreak = cash.combinedTieBreak ^ hello.TieBreak()
+			if ok, err := cash.resolveDuplicate(); !ok {
+				return false, err
+			}
 			cash.nextState(nil)
 			return false, nil
 		} else {
@@ -626,6 +805,53 @@ func (cash *connectionAwaitServerHandshake) start() (bool, error) {
 	}
 }
 
+// resolveDuplicate stops two RMs which dial each other at the same
+// time from both ending up with two connections. The connection
+// dialled by the RM with the higher RMId is always preferred. So
+// once the hellos have been exchanged over a connection dialled by
+// the lower RM, the higher RM sends its verdict: it refuses the
+// connection if it has a connection of its own to the lower RM which
+// is either established or being dialled. The lower RM then backs
+// off and waits for that connection to arrive. Returns true iff the
+// handshake may continue; otherwise the results are to be returned
+// from start.
+func (cash *connectionAwaitServerHandshake) resolveDuplicate() (bool, error) {
+	cm := cash.connectionManager
+	if cash.link != 0 || cash.remoteFeatures < server.FeatureServerTieBreak || cash.dialled != (cm.RMId < cash.remoteRMId) {
+		return true, nil
+	}
+
+	if cash.dialled {
+		seg, err := cash.readOne()
+		if err != nil {
+			return cash.connectionAwaitHandshake.maybeRestartConnection(err)
+		}
+		if msg := msgs.ReadRootMessage(seg); msg.Which() == msgs.MESSAGE_CONNECTIONERROR {
+			serverDuplicateConnections.WithLabelValues("handshake").Inc()
+			return cash.connectionAwaitHandshake.maybeRestartConnection(
+				fmt.Errorf("Connection to %v (%v) refused: %s", cash.remoteHost, cash.remoteRMId, msg.ConnectionError()))
+		}
+		return true, nil
+	}
+
+	duplicate := cm.serverDuplicate(cash.remoteHost, cash.remoteRMId, cash.remoteBootCount)
+	seg := capn.NewBuffer(nil)
+	msg := msgs.NewRootMessage(seg)
+	if duplicate {
+		msg.SetConnectionError(fmt.Sprintf("%v already has a connection to %v", cm.RMId, cash.remoteRMId))
+	} else {
+		msg.SetHeartbeat()
+	}
+	if err := cash.send(server.SegToBytes(seg)); err != nil {
+		return false, err
+	}
+	if duplicate {
+		serverDuplicateConnections.WithLabelValues("handshake").Inc()
+		return false, fmt.Errorf("Refused duplicate connection from %v (%v)", cash.remoteHost, cash.remoteRMId)
+	}
+	return true, nil
+}
+
 func (cash *connectionAwaitServerHandshake) verifyTopology(remote *msgs.HelloServerFromServer) bool {
 	if cash.topology.ClusterId == remote.ClusterId() {
 		remoteUUId := remote.ClusterUUId()
@@ -635,6 +861,33 @@ func (cash *connectionAwaitServerHandshake) verifyTopology(remote *msgs.HelloSer
 	return false
 }
 
+// verifyAttestation checks the remote's attestation, if it sent one
+// or should have. A remote which does not yet support attestations is
+// only let off whilst some server in the cluster does not either,
+// otherwise a thief could dodge the check by claiming to be old.
+func (cash *connectionAwaitServerHandshake) verifyAttestation(remote *msgs.HelloServerFromServer) error {
+	attestation := remote.Attestation()
+	if len(attestation) == 0 && cash.remoteFeatures < server.FeatureNodeAttestation && !server.FeatureEnabled(server.FeatureNodeAttestation) {
+		return nil
+	}
+	var peerCerts []*x509.Certificate
+	if socket, ok := cash.socket.(*tls.Conn); ok {
+		peerCerts = socket.ConnectionState().PeerCertificates
+	}
+	if len(peerCerts) == 0 {
+		return fmt.Errorf("No certificate from %v (%v) to verify attestation against", cash.remoteHost, cash.remoteRMId)
+	}
+	root := cash.connectionManager.NodeCertificatePrivateKeyPair.CertificateRoot
+	reason, err := verifyNodeAttestation(root, attestation, cash.topology.ClusterId, cash.remoteRMId, cash.remoteBootCount, peerCerts[0])
+	if err != nil {
+		serverAttestationFailures.WithLabelValues(reason).Inc()
+		log.Printf("Warning: %v claiming to be %v (boot count %v) failed attestation; possible impersonation with a stolen node certificate: %v",
+			cash.remoteHost, cash.remoteRMId, cash.remoteBootCount, err)
+		return fmt.Errorf("Attestation from %v (%v) failed: %v", cash.remoteHost, cash.remoteRMId, err)
+	}
+	return nil
+}
+
 func (cash *connectionAwaitServerHandshake) makeHelloServerFromServer() *capn.Segment {
 	seg := capn.NewBuffer(nil)
 	hello := msgs.NewRootHelloServerFromServer(seg)
@@ -647,6 +900,15 @@ func (cash *connectionAwaitServerHandshake) makeHelloServerFromServer() *capn.Se
 	hello.SetTieBreak(tieBreak)
 	hello.SetClusterId(cash.topology.ClusterId)
 	hello.SetClusterUUId(cash.topology.ClusterUUId())
+	hello.SetFeatureVersion(server.FeatureVersion)
+	hello.SetLink(cash.link)
+	hello.SetLinks(cash.connectionManager.links)
+	cm := cash.connectionManager
+	if attestation, err := newNodeAttestation(cm.NodeCertificatePrivateKeyPair, cash.topology.ClusterId, cm.RMId, cm.BootCount()); err == nil {
+		hello.SetAttestation(attestation)
+	} else {
+		log.Printf("Unable to create attestation: %v", err)
+	}
 	return seg
 }
 
@@ -669,11 +931,23 @@ func (cach *connectionAwaitClientHandshake) init(conn *Connection) {
 func (cach *connectionAwaitClientHandshake) start() (bool, error) {
 	config := cach.commonTLSConfig()
 	config.ClientAuth = tls.RequireAnyClientCert
+	if cach.clientOnly != nil {
+		// These certificates need not be signed by the cluster
+		// certificate, nor use ECDSA keys.
+		config.Certificates = cach.clientOnly.certificates
+		config.CipherSuites = append(config.CipherSuites, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+		config.BuildNameToCertificate()
+	}
+	handshakes := cach.connectionManager.ClientHandshakes
+	handshakes.configure(config)
+	handshakes.await()
 	socket := tls.Server(cach.socket, config)
 	cach.socket = socket
+	handshakeStart := time.Now()
 	if err := socket.Handshake(); err != nil {
 		return false, err
 	}
+	handshakes.observe(handshakeStart, socket.ConnectionState())
 
 	if cach.topology.ClusterUUId() == 0 {
 		return false, errors.New("Cluster not yet formed")
@@ -682,18 +956,31 @@ func (cach *connectionAwaitClientHandshake) start() (bool, error) {
 	}
 
 	peerCerts := socket.ConnectionState().PeerCertificates
+	reconnects := cach.connectionManager.ClientReconnects
 	if authenticated, hashsum, roots := cach.verifyPeerCerts(peerCerts); authenticated {
+		if retryAfter := reconnects.admit(hashsum); retryAfter != 0 {
+			return false, fmt.Errorf("Client connection rejected: reconnected too soon (retry after %v)", retryAfter)
+		}
+		if cach.connectionManager.Decommissioner.Cordoned() {
+			reconnects.reject(hashsum, clientRejectionDecommissioning)
+			return false, errors.New("Client connection rejected: node is being decommissioned")
+		}
 		cach.peerCerts = peerCerts
 		cach.roots = roots
+		cach.clientStats = newClientConnectionStats(hashsum)
 		log.Printf("User '%s' authenticated", hex.EncodeToString(hashsum[:]))
+		cach.connectionManager.SessionLog.authenticated(cach.Connection)
 		helloFromServer := cach.makeHelloClientFromServer()
 		if err := cach.send(server.SegToBytes(helloFromServer)); err != nil {
 			return false, err
 		}
 		cach.remoteHost = cach.socket.RemoteAddr().String()
+		cach.identity.Store(&clientIdentity{remoteHost: cach.remoteHost, fingerprint: hashsum})
+		cach.limitSlot = cach.connectionManager.ConnectionLimits.handshakeComplete(cach.limitSlot)
 		cach.nextState(nil)
 		return false, nil
 	} else {
+		reconnects.reject(hashsum, clientRejectionUnknownCertificate)
 		return false, errors.New("Client connection rejected: No client certificate known")
 	}
 }
@@ -702,6 +989,9 @@ func (cach *connectionAwaitClientHandshake) verifyPeerCerts(peerCerts []*x509.Ce
 	fingerprints := cach.topology.Fingerprints()
 	for _, cert := range peerCerts {
 		hashsum = sha256.Sum256(cert.Raw)
+		if cach.clientOnly != nil && !cach.clientOnly.Permits(hashsum) {
+			continue
+		}
 		if roots, found := fingerprints[hashsum]; found {
 			return true, hashsum, roots
 		}
@@ -709,14 +999,20 @@ func (cach *connectionAwaitClientHandshake) verifyPeerCerts(peerCerts []*x509.Ce
 	return false, hashsum, nil
 }
 
+// The namespace is the suffix of every TxnId and VarUUId the client
+// creates, which makes them unique across the cluster.
+func (conn *Connection) clientNamespace() []byte {
+	namespace := make([]byte, common.KeyLen-8)
+	binary.BigEndian.PutUint32(namespace[0:4], conn.ConnectionNumber)
+	binary.BigEndian.PutUint32(namespace[4:8], conn.connectionManager.BootCount())
+	binary.BigEndian.PutUint32(namespace[8:], uint32(conn.connectionManager.RMId))
+	return namespace
+}
+
 func (cach *connectionAwaitClientHandshake) makeHelloClientFromServer() *capn.Segment {
 	seg := capn.NewBuffer(nil)
 	hello := cmsgs.NewRootHelloClientFromServer(seg)
-	namespace := make([]byte, common.KeyLen-8)
-	binary.BigEndian.PutUint32(namespace[0:4], cach.ConnectionNumber)
-	binary.BigEndian.PutUint32(namespace[4:8], cach.connectionManager.BootCount())
-	binary.BigEndian.PutUint32(namespace[8:], uint32(cach.connectionManager.RMId))
-	hello.SetNamespace(namespace)
+	hello.SetNamespace(cach.clientNamespace())
 	rootsCap := cmsgs.NewRootList(seg, len(cach.roots))
 	idy := 0
 	rootsVar := make(map[common.VarUUId]*common.Capability, len(cach.roots))
@@ -747,6 +1043,7 @@ type connectionRun struct {
 	beatBytes     []byte
 	restart       bool
 	submitterIdle *connectionMsgTopologyChanged
+	votes         voteBatch
 }
 
 func (cr *connectionRun) connectionStateMachineComponentWitness() {}
@@ -774,6 +1071,7 @@ func (cr *connectionRun) start() (bool, error) {
 	log.Printf("Connection established to %v (%v)\n", cr.remoteHost, cr.remoteRMId)
 
 	cr.restart = true
+	cr.resetVotes()
 
 	seg := capn.NewBuffer(nil)
 	if cr.isClient {
@@ -785,19 +1083,45 @@ func (cr *connectionRun) start() (bool, error) {
 	}
 	cr.beatBytes = server.SegToBytes(seg)
 
-	if cr.isServer {
+	switch {
+	case !cr.isServer || cr.remoteFeatures < server.FeatureHeartbeatPing:
+		cr.quality.forget()
+		cr.quality = nil
+	case cr.quality == nil || cr.quality.rmId != cr.remoteRMId:
+		cr.quality.forget()
+		cr.quality = newPeerQuality(cr.remoteRMId, cr.link == 0, cr.connectionManager.PeerLatencies())
+	default:
+		cr.quality.reset()
+	}
+
+	if cr.isServer && cr.link != 0 {
+		cr.connectionManager.ServerLinkEstablished(cr.Connection, cr.remoteRMId, cr.remoteBootCount, cr.link)
+	} else if cr.isServer {
 		flushSeg := capn.NewBuffer(nil)
 		flushMsg := msgs.NewRootMessage(flushSeg)
 		flushMsg.SetFlushed()
 		flushBytes := server.SegToBytes(flushSeg)
-		cr.connectionManager.ServerEstablished(cr.Connection, cr.remoteHost, cr.remoteRMId, cr.remoteBootCount, cr.combinedTieBreak, cr.remoteClusterUUId, func() { cr.Send(flushBytes) })
+		cr.connectionManager.ServerEstablished(cr.Connection, cr.remoteHost, cr.remoteRMId, cr.remoteBootCount, cr.combinedTieBreak, cr.remoteClusterUUId, cr.remoteFeatures, cr.remoteLinks, func() { cr.Send(flushBytes) })
 	}
 	if cr.isClient {
 		servers := cr.connectionManager.ClientEstablished(cr.ConnectionNumber, cr.Connection)
 		if servers == nil {
 			return false, errors.New("Not ready for client connections")
 		}
-		cr.submitter = client.NewClientTxnSubmitter(cr.connectionManager.RMId, cr.connectionManager.BootCount(), cr.rootsVar, cr.connectionManager)
+		var idAuditor client.IdAuditor
+		if factory := cr.connectionManager.IdAuditorFactory; factory != nil {
+			idAuditor = factory(cr.clientNamespace())
+		}
+		cr.submitter = client.NewClientTxnSubmitter(cr.connectionManager.RMId, cr.connectionManager.BootCount(), cr.rootsVar, cr.connectionManager, idAuditor)
+		rootNames := make([]string, 0, len(cr.roots))
+		for name := range cr.roots {
+			rootNames = append(rootNames, name)
+		}
+		cr.submitter.SetRootNames(rootNames)
+		cr.submitter.SetMaxReferences(cr.connectionManager.MaxReferences)
+		cr.submitter.SetStaleReadObserver(func(drift uint64) {
+			cr.clientStats.staleRead(drift, cr.connectionManager.ClientDriftWarn, cr.Connection)
+		})
 		cr.submitter.TopologyChanged(cr.topology)
 		cr.submitter.ServerConnectionsChanged(servers)
 	}
@@ -817,6 +1141,22 @@ func (cr *connectionRun) start() (bool, error) {
 	return false, nil
 }
 
+// rootsRelocated reports whether any of the client's roots is no
+// longer in the topology, as happens when a system root is relocated
+// and so becomes a different var.
+func (cr *connectionRun) rootsRelocated(topology *configuration.Topology) bool {
+	current := make(map[common.VarUUId]server.EmptyStruct, len(topology.Roots))
+	for _, root := range topology.Roots {
+		current[*root.VarUUId] = server.EmptyStructVal
+	}
+	for vUUId := range cr.rootsVar {
+		if _, found := current[vUUId]; !found {
+			return true
+		}
+	}
+	return false
+}
+
 func (cr *connectionRun) topologyChanged(tc *connectionMsgTopologyChanged) error {
 	if si := cr.submitterIdle; si != nil {
 		cr.submitterIdle = nil
@@ -835,18 +1175,21 @@ func (cr *connectionRun) topologyChanged(tc *connectionMsgTopologyChanged) error
 			if authenticated, _, roots := cr.verifyPeerCerts(cr.peerCerts); !authenticated {
 				server.Log("Connection", cr.Connection, "topologyChanged", tc, "(client unauthed)")
 				tc.maybeClose()
+				cr.rejectClient(clientRejectionUnknownCertificate)
 				return errors.New("Client connection closed: No client certificate known")
-			} else if len(roots) == len(cr.roots) {
+			} else if len(roots) == len(cr.roots) && !cr.rootsRelocated(topology) {
 				for name, capsOld := range cr.roots {
 					if capsNew, found := roots[name]; !found || !capsNew.Equal(capsOld) {
 						server.Log("Connection", cr.Connection, "topologyChanged", tc, "(roots changed)")
 						tc.maybeClose()
+						cr.rejectClient(clientRejectionRootsChanged)
 						return errors.New("Client connection closed: roots have changed")
 					}
 				}
 			} else {
 				server.Log("Connection", cr.Connection, "topologyChanged", tc, "(roots changed)")
 				tc.maybeClose()
+				cr.rejectClient(clientRejectionRootsChanged)
 				return errors.New("Client connection closed: roots have changed")
 			}
 		}
@@ -894,7 +1237,13 @@ func (cr *connectionRun) handleMsgFromClient(msg cmsgs.ClientMessage) error {
 	case cmsgs.CLIENTMESSAGE_CLIENTTXNSUBMISSION:
 		ctxn := msg.ClientTxnSubmission()
 		origTxnId := common.MakeTxnId(ctxn.Id())
+		if err := cr.submitter.AuditClientTransaction(&ctxn); err != nil {
+			cr.clientTxnError(&ctxn, err, origTxnId)
+			return cr.maybeRestartConnection(err)
+		}
+		atomic.AddUint64(&cr.clientStats.txnsSubmitted, 1)
 		return cr.submitter.SubmitClientTransaction(&ctxn, func(clientOutcome *cmsgs.ClientTxnOutcome, err error) error {
+			cr.clientStats.outcome(clientOutcome, err)
 			switch {
 			case err != nil:
 				return cr.clientTxnError(&ctxn, err, origTxnId)
@@ -921,9 +1270,24 @@ func (cr *connectionRun) handleMsgFromServer(msg msgs.Message) error {
 	switch which := msg.Which(); which {
 	case msgs.MESSAGE_HEARTBEAT:
 		// do nothing
+	case msgs.MESSAGE_PING:
+		seg := capn.NewBuffer(nil)
+		pong := msgs.NewRootMessage(seg)
+		pong.SetPong(msg.Ping())
+		return cr.sendMessage(server.SegToBytes(seg))
+	case msgs.MESSAGE_PONG:
+		cr.quality.pong(msg.Pong(), cr.connectionManager.Clock.Now())
 	case msgs.MESSAGE_CONNECTIONERROR:
 		return fmt.Errorf("Error received from %v: \"%s\"", cr.remoteRMId, msg.ConnectionError())
+	case msgs.MESSAGE_DEGRADED:
+		cr.connectionManager.DegradedRMs().Set(cr.remoteRMId, msg.Degraded())
+	case msgs.MESSAGE_VOTEBATCH:
+		return cr.voteBatchReceived(msg)
 	case msgs.MESSAGE_TOPOLOGYCHANGEREQUEST:
+		msg, deliver := interceptTopologyMessage(cr.remoteRMId, msg)
+		if !deliver {
+			return nil
+		}
 		configCap := msg.TopologyChangeRequest()
 		config := configuration.ConfigurationFromCap(&configCap)
 		cr.connectionManager.RequestConfigurationChange(config)
@@ -961,6 +1325,13 @@ func (cr *connectionRun) maybeRestartConnection(err error) error {
 	case err == nil || cr.currentState != cr:
 		return nil
 
+	case cr.isServer && cr.link != 0:
+		// Links are redialled by the ConnectionManager along with the
+		// primary connection, never on their own.
+		log.Printf("Error on server link %v to %v: %v", cr.link, cr.remoteRMId, err)
+		cr.connectionManager.ServerLinkLost(cr.Connection, cr.remoteRMId, cr.link)
+		return err
+
 	case cr.isServer:
 		log.Printf("Error on server connection to %v: %v", cr.remoteRMId, err)
 		cr.connectionManager.ServerLost(cr.Connection, cr.remoteRMId, cr.restart)
@@ -981,6 +1352,12 @@ func (cr *connectionRun) maybeRestartConnection(err error) error {
 	}
 }
 
+// rejectClient records that the client's connection is about to be
+// closed, so that it may not reconnect straight away.
+func (cr *connectionRun) rejectClient(reason clientRejectionReason) {
+	cr.connectionManager.ClientReconnects.reject(cr.clientStats.fingerprint, reason)
+}
+
 func (cr *connectionRun) sendMessage(msg []byte) error {
 	if cr.currentState == cr {
 		cr.mustSendBeat = false
@@ -993,7 +1370,7 @@ func (cr *connectionRun) beat() error {
 	if cr.currentState != cr {
 		return nil
 	}
-	if cr.missingBeats == 2 {
+	if cr.missingBeats >= cr.quality.maxMissingBeats(cr.connectionManager.AdaptiveHeartbeats) {
 		return cr.maybeRestartConnection(
 			fmt.Errorf("Missed too many connection heartbeats. Restarting connection."))
 	}
@@ -1005,7 +1382,11 @@ func (cr *connectionRun) beat() error {
 		}
 	*/
 	cr.missingBeats++
-	if cr.mustSendBeat {
+	if cr.quality != nil {
+		// Ping on every beat, even when busy, so that the peer's RTT
+		// keeps being measured.
+		return cr.maybeRestartConnection(cr.send(cr.quality.ping(cr.connectionManager.Clock.Now())))
+	} else if cr.mustSendBeat {
 		return cr.maybeRestartConnection(cr.send(cr.beatBytes))
 	} else {
 		cr.mustSendBeat = true
@@ -1080,6 +1461,10 @@ type connectionReader struct {
 	terminated *sync.WaitGroup
 }
 
+func (cr *connectionReader) String() string {
+	return fmt.Sprintf("Reader for connection %v to %v (RMId %v)", cr.ConnectionNumber, cr.remoteHost, cr.remoteRMId)
+}
+
 func newConnectionReader(conn *Connection) *connectionReader {
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
@@ -1092,7 +1477,16 @@ func newConnectionReader(conn *Connection) *connectionReader {
 
 func (cr *connectionReader) readServer() {
 	cr.read(func(seg *capn.Segment) bool {
+		if dropPeerMessage(cr.remoteHost) {
+			return true
+		} else if !delayPeerMessage(cr.remoteHost, cr.terminate) {
+			return false
+		}
 		msg := msgs.ReadRootMessage(seg)
+		if err := paxos.ValidateMessage(msg); err != nil {
+			cr.enqueueQuery(connectionReadError{error: err})
+			return false
+		}
 		return cr.enqueueQuery(connectionReadMessage(msg))
 	})
 }
@@ -1100,10 +1494,73 @@ func (cr *connectionReader) readServer() {
 func (cr *connectionReader) readClient() {
 	cr.read(func(seg *capn.Segment) bool {
 		msg := cmsgs.ReadRootClientMessage(seg)
-		return cr.enqueueQuery(connectionReadClientMessage(msg))
+		return cr.awaitCreationThrottle(msg) && cr.awaitAccumulatorPressureRelief(msg) && cr.enqueueQuery(connectionReadClientMessage(msg))
 	})
 }
 
+// If too many outcome accumulators are live (typically because
+// acceptors are flapping), txn submissions are held back here until
+// enough of them have been released, but for no longer than
+// OutcomeAccumulatorPauseMax. The wait must stay well below the
+// heartbeat interval: whilst we wait we aren't reading, and a client
+// whose heartbeats go unread is disconnected. A client only has one
+// txn live at a time, so delaying each submission still pushes back
+// on clients via TCP rather than letting memory grow without bound.
+// Heartbeats are never held back.
+func (cr *connectionReader) awaitAccumulatorPressureRelief(msg cmsgs.ClientMessage) bool {
+	if msg.Which() != cmsgs.CLIENTMESSAGE_CLIENTTXNSUBMISSION {
+		return true
+	}
+	relieved := paxos.OutcomeAccumulatorPressure()
+	if relieved == nil {
+		return true
+	}
+	clientReadsPaused.Inc()
+	server.Log("Connection", cr.remoteHost, "delaying txn due to outcome accumulator pressure.")
+	timer := time.NewTimer(server.OutcomeAccumulatorPauseMax)
+	defer timer.Stop()
+	select {
+	case <-relieved:
+		return true
+	case <-timer.C:
+		return true
+	case <-cr.terminate:
+		return false
+	}
+}
+
+// If the client's roots are near their quotas, txns which create vars
+// are held back here, before they reach the submitter. As with
+// accumulator pressure, this pushes back on the client via TCP.
+func (cr *connectionReader) awaitCreationThrottle(msg cmsgs.ClientMessage) bool {
+	throttle := cr.connectionManager.CreationThrottle
+	if throttle == nil || msg.Which() != cmsgs.CLIENTMESSAGE_CLIENTTXNSUBMISSION {
+		return true
+	}
+	actions := msg.ClientTxnSubmission().Actions()
+	creates := false
+	for idx, l := 0, actions.Len(); idx < l && !creates; idx++ {
+		creates = actions.At(idx).Which() == cmsgs.CLIENTACTION_CREATE
+	}
+	if !creates {
+		return true
+	}
+	delay, root := throttle.Delay(cr.roots)
+	if delay == 0 {
+		return true
+	}
+	throttle.throttled(root, delay)
+	server.Log("Connection", cr.remoteHost, "delaying txn by", delay, "due to quota of root", root)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cr.terminate:
+		return false
+	}
+}
+
 func (cr *connectionReader) read(fun func(*capn.Segment) bool) {
 	defer cr.terminated.Done()
 	for {
@@ -1111,13 +1568,25 @@ func (cr *connectionReader) read(fun func(*capn.Segment) bool) {
 		case <-cr.terminate:
 			return
 		default:
-			if seg, err := cr.readOne(); err == nil {
-				if !fun(seg) {
-					return
+			var (
+				seg *capn.Segment
+				err error
+				ok  bool
+			)
+			// Decoding untrusted input can panic: treat that as a read error.
+			report := server.Guard("ConnectionReader", cr, func() {
+				if seg, err = cr.readOne(); err == nil {
+					ok = fun(seg)
 				}
-			} else {
+			})
+			if report != nil {
+				err = fmt.Errorf("Panic when reading from connection: %v", report.Panic)
+			}
+			if err != nil {
 				cr.enqueueQuery(connectionReadError{error: err})
 				return
+			} else if !ok {
+				return
 			}
 		}
 	}
@@ -0,0 +1,158 @@
+package network
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/server"
+	"sync"
+)
+
+var (
+	clientConnectionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "client_connections_rejected_total",
+		Help:      "Number of client connections rejected due to the connection and handshake limits.",
+	}, []string{"limit"})
+	clientConnectionsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "client_connections",
+		Help:      "Number of established client connections.",
+	})
+	clientHandshakesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "client_handshakes_in_progress",
+		Help:      "Number of client handshakes in progress.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(clientConnectionsRejected)
+	prometheus.MustRegister(clientConnectionsGauge)
+	prometheus.MustRegister(clientHandshakesGauge)
+}
+
+// The limit a connection counts against, if any.
+type connectionLimitSlot uint8
+
+const (
+	connectionLimitNone      connectionLimitSlot = iota
+	connectionLimitHandshake connectionLimitSlot = iota
+	connectionLimitClient    connectionLimitSlot = iota
+)
+
+// ConnectionLimits bounds the number of client connections, and
+// separately the number of client handshakes in progress, so that a
+// misbehaving pool of clients can't exhaust our file descriptors and
+// so prevent connections between servers. A client handshake counts
+// towards both limits, so that a client which completes its handshake
+// always has room to connect. Connections between servers are never
+// limited. A limit of 0 means unlimited.
+type ConnectionLimits struct {
+	sync.Mutex
+	maxClients    int
+	maxHandshakes int
+	clients       int
+	handshakes    int
+	rejected      uint64
+}
+
+func NewConnectionLimits(maxClients, maxHandshakes int) *ConnectionLimits {
+	return &ConnectionLimits{
+		maxClients:    maxClients,
+		maxHandshakes: maxHandshakes,
+	}
+}
+
+// full is a cheap check made by client-only listeners as they accept
+// connections, so that when we're full, sockets are closed as soon as
+// possible.
+func (cl *ConnectionLimits) full() bool {
+	if cl == nil {
+		return false
+	}
+	cl.Lock()
+	defer cl.Unlock()
+	if err := cl.check(); err != nil {
+		cl.rejected++
+		return true
+	}
+	return false
+}
+
+func (cl *ConnectionLimits) check() error {
+	switch {
+	case cl.maxClients != 0 && cl.clients+cl.handshakes >= cl.maxClients:
+		clientConnectionsRejected.WithLabelValues("connections").Inc()
+		return fmt.Errorf("Client connection rejected: too many client connections (limit %v)", cl.maxClients)
+	case cl.maxHandshakes != 0 && cl.handshakes >= cl.maxHandshakes:
+		clientConnectionsRejected.WithLabelValues("handshakes").Inc()
+		return fmt.Errorf("Client connection rejected: too many client handshakes in progress (limit %v)", cl.maxHandshakes)
+	default:
+		return nil
+	}
+}
+
+// beginHandshake reserves room for a client handshake, and for the
+// connection once the handshake is complete.
+func (cl *ConnectionLimits) beginHandshake() (connectionLimitSlot, error) {
+	if cl == nil {
+		return connectionLimitNone, nil
+	}
+	cl.Lock()
+	defer cl.Unlock()
+	if err := cl.check(); err != nil {
+		cl.rejected++
+		return connectionLimitNone, err
+	}
+	cl.handshakes++
+	clientHandshakesGauge.Inc()
+	return connectionLimitHandshake, nil
+}
+
+// handshakeComplete turns a handshake into an established client
+// connection. Room for it was reserved by beginHandshake.
+func (cl *ConnectionLimits) handshakeComplete(slot connectionLimitSlot) connectionLimitSlot {
+	if cl == nil || slot != connectionLimitHandshake {
+		return slot
+	}
+	cl.Lock()
+	defer cl.Unlock()
+	cl.handshakes--
+	cl.clients++
+	clientHandshakesGauge.Dec()
+	clientConnectionsGauge.Inc()
+	return connectionLimitClient
+}
+
+func (cl *ConnectionLimits) release(slot connectionLimitSlot) {
+	if cl == nil || slot == connectionLimitNone {
+		return
+	}
+	cl.Lock()
+	defer cl.Unlock()
+	switch slot {
+	case connectionLimitHandshake:
+		cl.handshakes--
+		clientHandshakesGauge.Dec()
+	case connectionLimitClient:
+		cl.clients--
+		clientConnectionsGauge.Dec()
+	}
+}
+
+func (cl *ConnectionLimits) Status(sc *server.StatusConsumer) {
+	if cl == nil {
+		return
+	}
+	cl.Lock()
+	defer cl.Unlock()
+	limit := func(l int) string {
+		if l == 0 {
+			return "unlimited"
+		}
+		return fmt.Sprint(l)
+	}
+	sc.Emit(fmt.Sprintf("Client connections: %v (limit %v); handshakes in progress: %v (limit %v); %v rejected",
+		cl.clients, limit(cl.maxClients), cl.handshakes, limit(cl.maxHandshakes), cl.rejected))
+	sc.Join()
+}
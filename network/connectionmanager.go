@@ -5,6 +5,7 @@ import (
 	"fmt"
 	capn "github.com/glycerine/go-capnproto"
 	cc "github.com/msackman/chancell"
+	"github.com/prometheus/client_golang/prometheus"
 	"goshawkdb.io/common"
 	"goshawkdb.io/common/certs"
 	"goshawkdb.io/server"
@@ -16,8 +17,19 @@ import (
 	eng "goshawkdb.io/server/txnengine"
 	"log"
 	"sync"
+	"sync/atomic"
 )
 
+var futureBootCountOutcomes = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "goshawkdb",
+	Name:      "future_bootcount_outcomes_total",
+	Help:      "Outcomes received for txns submitted under a boot count newer than ours, which were refused (and completed without being delivered).",
+})
+
+func init() {
+	prometheus.MustRegister(futureBootCountOutcomes)
+}
+
 type ShutdownSignaller interface {
 	SignalShutdown()
 }
@@ -35,12 +47,40 @@ type ConnectionManager struct {
 	queryChan                     <-chan connectionManagerMsg
 	servers                       map[string]*connectionManagerMsgServerEstablished
 	rmToServer                    map[common.RMId]*connectionManagerMsgServerEstablished
+	movedHosts                    map[string]common.RMId
+	rmToFeatures                  map[common.RMId]uint32
+	links                         uint8
+	rmToLinks                     map[common.RMId]*serverLinks
 	flushedServers                map[common.RMId]server.EmptyStruct
 	connCountToClient             map[uint32]paxos.ClientConnection
+	futureBootCounts              map[uint32]server.EmptyStruct
 	desired                       []string
 	serverConnSubscribers         serverConnSubscribers
 	topologySubscribers           topologySubscribers
 	Dispatchers                   *paxos.Dispatchers
+	localConnection               *client.LocalConnection
+	readCache                     *client.LocalReadCache
+	IdAuditorFactory              client.IdAuditorFactory
+	CreationThrottle              *CreationThrottle
+	ClientDriftWarn               uint64
+	MaxReferences                 int
+	ClientHandshakes              *ClientHandshakes
+	ClientReconnects              *ClientReconnects
+	Decommissioner                *Decommissioner
+	ConfigVerifier                *configuration.BundleVerifier
+	ConnectionLimits              *ConnectionLimits
+	SessionLog                    *SessionLog
+	AdaptiveHeartbeats            bool
+	MaxClientMessageSize          int
+	MaxServerMessageSize          int
+	capture                       *paxos.Capture
+	resends                       *paxos.ResendScheduler
+	degradedRMs                   *paxos.DegradedRMs
+	degradedNotice                *degradedNotice
+	peerLatencies                 *paxos.PeerLatencies
+	auditor                       *Auditor
+	Clock                         server.Clock
+	connectionCount               uint32
 }
 
 type serverConnSubscribers struct {
@@ -51,6 +91,7 @@ type serverConnSubscribers struct {
 type topologySubscribers struct {
 	*ConnectionManager
 	subscribers []map[eng.TopologySubscriber]server.EmptyStruct
+	installers  []*topologyInstaller
 }
 
 func (cm *ConnectionManager) BootCount() uint32 {
@@ -58,6 +99,14 @@ func (cm *ConnectionManager) BootCount() uint32 {
 }
 
 func (cm *ConnectionManager) DispatchMessage(sender common.RMId, msgType msgs.Message_Which, msg msgs.Message) {
+	cm.capture.Incoming(sender, msg)
+	switch msgType {
+	case msgs.MESSAGE_MIGRATION, msgs.MESSAGE_MIGRATIONCOMPLETE:
+		var deliver bool
+		if msg, deliver = interceptTopologyMessage(sender, msg); !deliver {
+			return
+		}
+	}
 	d := cm.Dispatchers
 	switch msgType {
 	case msgs.MESSAGE_TXNSUBMISSION:
@@ -69,9 +118,12 @@ func (cm *ConnectionManager) DispatchMessage(sender common.RMId, msgType msgs.Me
 		txnId := txn.Id
 		connNumber := binary.BigEndian.Uint32(txnId[8:12])
 		bootNumber := binary.BigEndian.Uint32(txnId[12:16])
-		if conn := cm.GetClient(bootNumber, connNumber); conn == nil {
-			// OSS is safe here - it's the default action on receipt of outcome for unknown client.
-			paxos.NewOneShotSender(paxos.MakeTxnSubmissionCompleteMsg(txnId), cm, sender)
+		if bootNumber > cm.bootcount {
+			cm.futureBootCount(sender, txnId, bootNumber)
+			cm.ResendScheduler().SendOnce(paxos.MakeTxnSubmissionCompleteMsg(txnId), sender)
+		} else if conn := cm.GetClient(bootNumber, connNumber); conn == nil {
+			// SendOnce is safe here - it's the default action on receipt of outcome for unknown client.
+			cm.ResendScheduler().SendOnce(paxos.MakeTxnSubmissionCompleteMsg(txnId), sender)
 		} else {
 			conn.SubmissionOutcomeReceived(sender, txn, &outcome)
 			return
@@ -108,8 +160,18 @@ func (cm *ConnectionManager) DispatchMessage(sender common.RMId, msgType msgs.Me
 	case msgs.MESSAGE_MIGRATIONCOMPLETE:
 		migrationComplete := msg.MigrationComplete()
 		cm.Transmogrifier.MigrationCompleteReceived(sender, &migrationComplete)
+	case msgs.MESSAGE_MIGRATIONESTIMATE:
+		migrationEstimate := msg.MigrationEstimate()
+		cm.Transmogrifier.MigrationEstimateReceived(sender, &migrationEstimate)
+	case msgs.MESSAGE_FROZENVARS:
+		frozenVars := msg.FrozenVars()
+		d.VarDispatcher.Frozen.LearnFromUpdates(&frozenVars)
 	case msgs.MESSAGE_FLUSHED:
 		cm.ServerConnectionFlushed(sender)
+	case msgs.MESSAGE_AUDITREQUEST:
+		cm.auditor.AuditRequestReceived(sender, msg.AuditRequest())
+	case msgs.MESSAGE_AUDITRESPONSE:
+		cm.auditor.AuditResponseReceived(sender, msg.AuditResponse())
 	default:
 		panic(fmt.Sprintf("Unexpected message received from %v (%v)", sender, msgType))
 	}
@@ -143,6 +205,8 @@ type connectionManagerMsgServerEstablished struct {
 	bootCount     uint32
 	tieBreak      uint32
 	clusterUUId   uint64
+	features      uint32
+	links         uint8
 	flushCallback func()
 }
 
@@ -153,6 +217,30 @@ type connectionManagerMsgServerLost struct {
 	restarting bool
 }
 
+type connectionManagerMsgServerLinkEstablished struct {
+	connectionManagerMsgBasic
+	*Connection
+	rmId      common.RMId
+	bootCount uint32
+	link      uint8
+}
+
+type connectionManagerMsgServerLinkLost struct {
+	connectionManagerMsgBasic
+	*Connection
+	rmId common.RMId
+	link uint8
+}
+
+type connectionManagerMsgServerDuplicate struct {
+	connectionManagerMsgBasic
+	host       string
+	rmId       common.RMId
+	bootCount  uint32
+	duplicate  bool
+	resultChan chan struct{}
+}
+
 type connectionManagerMsgServerFlushed struct {
 	connectionManagerMsgBasic
 	rmId common.RMId
@@ -221,7 +309,7 @@ func (cm *ConnectionManager) SetDesiredServers(localhost string, remotehosts []s
 	})
 }
 
-func (cm *ConnectionManager) ServerEstablished(conn *Connection, host string, rmId common.RMId, bootCount uint32, tieBreak uint32, clusterUUId uint64, flushCallback func()) {
+func (cm *ConnectionManager) ServerEstablished(conn *Connection, host string, rmId common.RMId, bootCount uint32, tieBreak uint32, clusterUUId uint64, features uint32, links uint8, flushCallback func()) {
 	cm.enqueueQuery(&connectionManagerMsgServerEstablished{
 		Connection:    conn,
 		send:          conn.Send,
@@ -231,6 +319,8 @@ func (cm *ConnectionManager) ServerEstablished(conn *Connection, host string, rm
 		bootCount:     bootCount,
 		tieBreak:      tieBreak,
 		clusterUUId:   clusterUUId,
+		features:      features,
+		links:         links,
 		flushCallback: flushCallback,
 	})
 }
@@ -243,6 +333,40 @@ func (cm *ConnectionManager) ServerLost(conn *Connection, rmId common.RMId, rest
 	})
 }
 
+func (cm *ConnectionManager) ServerLinkEstablished(conn *Connection, rmId common.RMId, bootCount uint32, link uint8) {
+	cm.enqueueQuery(connectionManagerMsgServerLinkEstablished{
+		Connection: conn,
+		rmId:       rmId,
+		bootCount:  bootCount,
+		link:       link,
+	})
+}
+
+func (cm *ConnectionManager) ServerLinkLost(conn *Connection, rmId common.RMId, link uint8) {
+	cm.enqueueQuery(connectionManagerMsgServerLinkLost{
+		Connection: conn,
+		rmId:       rmId,
+		link:       link,
+	})
+}
+
+// serverDuplicate returns true iff we have a connection of our own to
+// the RM at host which is either established or being dialled. See
+// connectionAwaitServerHandshake.resolveDuplicate.
+func (cm *ConnectionManager) serverDuplicate(host string, rmId common.RMId, bootCount uint32) bool {
+	query := &connectionManagerMsgServerDuplicate{
+		host:       host,
+		rmId:       rmId,
+		bootCount:  bootCount,
+		resultChan: make(chan struct{}),
+	}
+	if cm.enqueueSyncQuery(query, query.resultChan) {
+		return query.duplicate
+	} else {
+		return false
+	}
+}
+
 func (cm *ConnectionManager) ServerConnectionFlushed(rmId common.RMId) {
 	cm.enqueueQuery(connectionManagerMsgServerFlushed{
 		rmId: rmId,
@@ -280,12 +404,42 @@ func (cm *ConnectionManager) GetClient(bootNumber, connNumber uint32) paxos.Clie
 	return cm.connCountToClient[connNumber]
 }
 
+// futureBootCount refuses an outcome for a txn which we submitted,
+// apparently, under a boot count newer than ours. The only way that
+// can happen is if our boot count has gone backwards: the node has
+// been restored from a backup, or its boot count file rolled back. In
+// which case we may be reusing TxnIds, and the outcome could belong
+// to a txn of our own with the same TxnId, so it must not be
+// delivered. We still tell the acceptors we're done with it (as we
+// would for a client which has gone away), so that they release the
+// outcome rather than resending it forever. The error is logged once
+// per boot count, and the metric keeps the problem visible.
+func (cm *ConnectionManager) futureBootCount(sender common.RMId, txnId *common.TxnId, bootNumber uint32) {
+	futureBootCountOutcomes.Inc()
+	cm.Lock()
+	_, found := cm.futureBootCounts[bootNumber]
+	if !found {
+		cm.futureBootCounts[bootNumber] = server.EmptyStructVal
+	}
+	cm.Unlock()
+	if !found {
+		log.Printf("Error: Received outcome from %v of txn %v which was submitted by us with boot count %v, but our boot count is %v. Has this node been restored from a backup, or its boot count file rolled back? TxnIds may be being reused. Refusing to process outcomes for boot count %v.\n",
+			sender, txnId, bootNumber, cm.bootcount, bootNumber)
+	}
+}
+
 func (cm *ConnectionManager) LocalHost() string {
 	cm.RLock()
 	defer cm.RUnlock()
 	return cm.localHost
 }
 
+// LocalConnection returns the connection through which this server
+// runs its own txns.
+func (cm *ConnectionManager) LocalConnection() *client.LocalConnection {
+	return cm.localConnection
+}
+
 func (cm *ConnectionManager) AddServerConnectionSubscriber(obs paxos.ServerConnectionSubscriber) {
 	cm.enqueueQuery(connectionManagerMsgServerConnAddSubscriber{ServerConnectionSubscriber: obs})
 }
@@ -294,6 +448,10 @@ func (cm *ConnectionManager) RemoveServerConnectionSubscriber(obs paxos.ServerCo
 	cm.enqueueQuery(connectionManagerMsgServerConnRemoveSubscriber{ServerConnectionSubscriber: obs})
 }
 
+func (cm *ConnectionManager) ResendScheduler() *paxos.ResendScheduler {
+	return cm.resends
+}
+
 func (cm *ConnectionManager) SetTopology(topology *configuration.Topology, callbacks map[eng.TopologyChangeSubscriberType]func()) {
 	cm.enqueueQuery(connectionManagerMsgSetTopology{
 		topology:  topology,
@@ -324,6 +482,12 @@ func (cm *ConnectionManager) RequestConfigurationChange(config *configuration.Co
 	cm.enqueueQuery(connectionManagerMsgRequestConfigChange{config: config})
 }
 
+// Connection numbers must be unique across all listeners as they
+// form part of each client's namespace.
+func (cm *ConnectionManager) nextConnectionNumber() uint32 {
+	return atomic.AddUint32(&cm.connectionCount, 1)
+}
+
 func (cm *ConnectionManager) Status(sc *server.StatusConsumer) {
 	cm.enqueueQuery(connectionManagerMsgStatus{StatusConsumer: sc})
 }
@@ -349,16 +513,25 @@ func (cm *ConnectionManager) enqueueSyncQuery(msg connectionManagerMsg, resultCh
 	}
 }
 
-func NewConnectionManager(rmId common.RMId, bootCount uint32, procs int, db *db.Databases, nodeCertPrivKeyPair *certs.NodeCertificatePrivateKeyPair, port uint16, ss ShutdownSignaller, config *configuration.Configuration) (*ConnectionManager, *TopologyTransmogrifier) {
+func NewConnectionManager(rmId common.RMId, bootCount uint32, procs int, db *db.Databases, nodeCertPrivKeyPair *certs.NodeCertificatePrivateKeyPair, port uint16, ss ShutdownSignaller, config *configuration.Configuration, configComment string, capture *paxos.Capture, links uint8, journal *TxnJournal, clock server.Clock) (*ConnectionManager, *TopologyTransmogrifier) {
 	cm := &ConnectionManager{
 		RMId:                          rmId,
 		bootcount:                     bootCount,
 		NodeCertificatePrivateKeyPair: nodeCertPrivKeyPair,
+		MaxClientMessageSize:          server.ClientMessageMaxSize,
+		MaxServerMessageSize:          server.ServerMessageMaxSize,
 		servers:           make(map[string]*connectionManagerMsgServerEstablished),
 		rmToServer:        make(map[common.RMId]*connectionManagerMsgServerEstablished),
+		movedHosts:        make(map[string]common.RMId),
+		rmToFeatures:      make(map[common.RMId]uint32),
+		links:             links,
+		rmToLinks:         make(map[common.RMId]*serverLinks),
 		flushedServers:    make(map[common.RMId]server.EmptyStruct),
 		connCountToClient: make(map[uint32]paxos.ClientConnection),
+		futureBootCounts:  make(map[uint32]server.EmptyStruct),
 		desired:           nil,
+		capture:           capture,
+		Clock:             clock,
 	}
 	cm.serverConnSubscribers.subscribers = make(map[paxos.ServerConnectionSubscriber]server.EmptyStruct)
 	cm.serverConnSubscribers.ConnectionManager = cm
@@ -369,6 +542,7 @@ func NewConnectionManager(rmId common.RMId, bootCount uint32, procs int, db *db.
 	}
 	topSubs[eng.ConnectionManagerSubscriber][cm] = server.EmptyStructVal
 	cm.topologySubscribers.subscribers = topSubs
+	cm.topologySubscribers.installers = newTopologyInstallers()
 	cm.topologySubscribers.ConnectionManager = cm
 
 	var head *cc.ChanCellHead
@@ -395,12 +569,26 @@ func NewConnectionManager(rmId common.RMId, bootCount uint32, procs int, db *db.
 		established: true,
 		rmId:        rmId,
 		bootCount:   bootCount,
+		features:    server.FeatureVersion,
 	}
 	cm.rmToServer[cd.rmId] = cd
 	cm.servers[cd.host] = cd
+	cm.resends = paxos.NewResendScheduler(cm)
+	cm.degradedRMs = paxos.NewDegradedRMs(cm)
+	cm.degradedNotice = newDegradedNotice(cm)
+	cm.peerLatencies = paxos.NewPeerLatencies(cm)
+	cm.auditor = newAuditor(cm, db)
+	topSubs[eng.ConnectionSubscriber][cm.auditor] = server.EmptyStructVal
 	lc := client.NewLocalConnection(rmId, bootCount, cm)
-	cm.Dispatchers = paxos.NewDispatchers(cm, rmId, uint8(procs), db, lc)
-	transmogrifier, localEstablished := NewTopologyTransmogrifier(db, cm, lc, port, ss, config)
+	cm.localConnection = lc
+	if journal != nil {
+		journal.connectionManager = cm
+	}
+	cm.Dispatchers = paxos.NewDispatchers(cm, rmId, uint8(procs), db, lc, journal, clock)
+	cm.Dispatchers.VarDispatcher.Frozen.SetGossip(cm.gossipFrozenVar)
+	cm.readCache = client.NewLocalReadCache(lc, rmId)
+	cm.Dispatchers.VarDispatcher.Commits.AddObserver(cm.readCache.VarCommitted)
+	transmogrifier, localEstablished := NewTopologyTransmogrifier(db, cm, lc, port, ss, config, configComment)
 	cm.Transmogrifier = transmogrifier
 	go cm.actorLoop(head)
 	<-localEstablished
@@ -429,6 +617,14 @@ func (cm *ConnectionManager) actorLoop(head *cc.ChanCellHead) {
 				cm.serverEstablished(msgT)
 			case connectionManagerMsgServerLost:
 				cm.serverLost(msgT)
+			case connectionManagerMsgServerLinkEstablished:
+				cm.serverLinkEstablished(msgT)
+			case connectionManagerMsgServerLinkLost:
+				cm.serverLinkLost(msgT)
+			case *connectionManagerMsgServerDuplicate:
+				cm.serverDuplicateQuery(msgT)
+			case *connectionManagerMsgServerRecycle:
+				cm.serverRecycleQuery(msgT)
 			case connectionManagerMsgServerFlushed:
 				cm.serverFlushed(msgT.rmId)
 			case *connectionManagerMsgClientEstablished:
@@ -446,7 +642,11 @@ func (cm *ConnectionManager) actorLoop(head *cc.ChanCellHead) {
 			case connectionManagerMsgTopologyRemoveSubscriber:
 				cm.topologySubscribers.RemoveSubscriber(msgT.subType, msgT.TopologySubscriber)
 			case connectionManagerMsgRequestConfigChange:
-				cm.Transmogrifier.RequestConfigurationChange(msgT.config)
+				if err := cm.ConfigVerifier.Verify(msgT.config); err != nil {
+					log.Println("Ignoring configuration change requested by another node:", err)
+				} else {
+					cm.Transmogrifier.RequestConfigurationChange(msgT.config, ConfigSourceRemote, "")
+				}
 			case connectionManagerMsgStatus:
 				cm.status(msgT.StatusConsumer)
 			default:
@@ -461,6 +661,9 @@ func (cm *ConnectionManager) actorLoop(head *cc.ChanCellHead) {
 		panic(err)
 	}
 	cm.cellTail.Terminate()
+	for _, sl := range cm.rmToLinks {
+		sl.shutdown(paxos.Sync)
+	}
 	for _, cd := range cm.servers {
 		cd.Shutdown(paxos.Sync)
 	}
@@ -496,6 +699,9 @@ func (cm *ConnectionManager) setDesiredServers(hosts connectionManagerMsgSetDesi
 	desiredMap := make(map[string]server.EmptyStruct, len(hosts.remote))
 	for _, host := range hosts.remote {
 		desiredMap[host] = server.EmptyStructVal
+		if _, moved := cm.movedHosts[host]; moved {
+			continue
+		}
 		if _, found := cm.servers[host]; !found {
 			cm.servers[host] = &connectionManagerMsgServerEstablished{
 				Connection: NewConnectionToDial(host, cm),
@@ -509,6 +715,11 @@ func (cm *ConnectionManager) setDesiredServers(hosts connectionManagerMsgSetDesi
 			delete(cm.servers, host)
 		}
 	}
+	for host := range cm.movedHosts {
+		if _, found := desiredMap[host]; !found {
+			delete(cm.movedHosts, host)
+		}
+	}
 }
 
 func (cm *ConnectionManager) serverEstablished(connEst *connectionManagerMsgServerEstablished) {
@@ -526,6 +737,12 @@ func (cm *ConnectionManager) serverEstablished(connEst *connectionManagerMsgServ
 			killOld = true
 		case cd.bootCount > connEst.bootCount:
 			killNew = true
+		case cd.features >= server.FeatureServerTieBreak && connEst.features >= server.FeatureServerTieBreak &&
+			cm.dialledByHigher(cd) != cm.dialledByHigher(connEst):
+			// Both ends agree on who dialled each connection, so
+			// both ends keep the same one.
+			killOld = !cm.dialledByHigher(cd)
+			killNew = !killOld
 		case cd.tieBreak == connEst.tieBreak:
 			killOld, killNew = true, true
 		default:
@@ -533,10 +750,14 @@ func (cm *ConnectionManager) serverEstablished(connEst *connectionManagerMsgServ
 			killNew = !killOld
 		}
 
+		if cd.established && cd.rmId == connEst.rmId && cd.bootCount == connEst.bootCount && killOld != killNew {
+			serverDuplicateConnections.WithLabelValues("established").Inc()
+		}
 		if killOld {
 			cd.Shutdown(paxos.Async)
 			if cd.established {
 				delete(cm.rmToServer, cd.rmId)
+				cm.dropServerLinks(cd.rmId)
 				cm.serverConnSubscribers.ServerConnLost(cd.rmId)
 			}
 		}
@@ -561,12 +782,29 @@ func (cm *ConnectionManager) serverEstablished(connEst *connectionManagerMsgServ
 			host:       connEst.host,
 		}
 
+	} else if found && connEst.host != cd.host && connEst.bootCount >= cd.bootCount {
+		// The same RM, at least as recently booted, under a new host:
+		// it has moved (or is reachable by more than one name). Switch
+		// to the new host immediately rather than waiting for the old
+		// connection to fail.
+		log.Printf("%v has moved from %v to %v.", connEst.rmId, cd.host, connEst.host)
+		cd.Shutdown(paxos.Async)
+		delete(cm.rmToServer, cd.rmId)
+		cm.dropServerLinks(cd.rmId)
+		cm.serverConnSubscribers.ServerConnLost(cd.rmId)
+		if cd1, found := cm.servers[cd.host]; found && cd1 == cd {
+			delete(cm.servers, cd.host)
+		}
+		cm.movedHosts[cd.host] = cd.rmId
+		cm.addServer(connEst)
+
 	} else if found && connEst.host != cd.host {
 		log.Printf("%v claimed by multiple servers: %v and %v. Recreating both connections.",
 			connEst.rmId, cd.host, connEst.host)
 		cd.Shutdown(paxos.Async)
 		connEst.Shutdown(paxos.Async)
 		delete(cm.rmToServer, cd.rmId)
+		cm.dropServerLinks(cd.rmId)
 		cm.serverConnSubscribers.ServerConnLost(cd.rmId)
 		cm.servers[cd.host] = &connectionManagerMsgServerEstablished{
 			Connection: NewConnectionToDial(cd.host, cm),
@@ -578,18 +816,47 @@ func (cm *ConnectionManager) serverEstablished(connEst *connectionManagerMsgServ
 		}
 
 	} else {
-		cm.servers[connEst.host] = connEst
-		cm.rmToServer[connEst.rmId] = connEst
-		cm.serverConnSubscribers.ServerConnEstablished(connEst, connEst.flushCallback)
+		cm.addServer(connEst)
 	}
 }
 
+func (cm *ConnectionManager) dialledByHigher(cd *connectionManagerMsgServerEstablished) bool {
+	return cd.dialled == (cm.RMId > cd.rmId)
+}
+
+func (cm *ConnectionManager) serverDuplicateQuery(query *connectionManagerMsgServerDuplicate) {
+	if cd, found := cm.servers[query.host]; found && cd.Connection != nil && cd.dialled {
+		if cd.established {
+			query.duplicate = cd.rmId == query.rmId && cd.bootCount == query.bootCount
+		} else {
+			query.duplicate = atomic.LoadInt32(&cd.dialActive) == 1
+		}
+	}
+	close(query.resultChan)
+}
+
+func (cm *ConnectionManager) addServer(connEst *connectionManagerMsgServerEstablished) {
+	delete(cm.movedHosts, connEst.host)
+	cm.servers[connEst.host] = connEst
+	cm.rmToServer[connEst.rmId] = connEst
+	cm.rmToFeatures[connEst.rmId] = connEst.features
+	cm.updateClusterFeatures()
+	cm.dropServerLinks(connEst.rmId)
+	if count := serverLinkCount(cm.links, connEst.links, connEst.features); count > 1 {
+		sl := newServerLinks(cm, connEst, count)
+		cm.rmToLinks[connEst.rmId] = sl
+		connEst.send = sl.Send
+	}
+	cm.serverConnSubscribers.ServerConnEstablished(connEst, connEst.flushCallback)
+}
+
 func (cm *ConnectionManager) serverLost(connLost connectionManagerMsgServerLost) {
 	rmId := connLost.rmId
 	if cd, found := cm.rmToServer[connLost.rmId]; found && cd.Connection == connLost.Connection {
 		log.Printf("Connection to RMId %v lost\n", rmId)
 		cd.established = false
 		delete(cm.rmToServer, rmId)
+		cm.dropServerLinks(rmId)
 		if !connLost.restarting {
 			if cd1, found := cm.servers[cd.host]; found && cd1 == cd {
 				delete(cm.servers, cd.host)
@@ -604,10 +871,60 @@ func (cm *ConnectionManager) serverLost(connLost connectionManagerMsgServerLost)
 				}
 			}
 		}
+		cm.forgetMoves(rmId)
 		cm.serverConnSubscribers.ServerConnLost(rmId)
 	}
 }
 
+// forgetMoves is called when we lose the connection to rmId: we no
+// longer know where it is, so any old hosts it moved from which are
+// still desired are dialled again.
+func (cm *ConnectionManager) forgetMoves(rmId common.RMId) {
+	for host, movedRMId := range cm.movedHosts {
+		if movedRMId != rmId {
+			continue
+		}
+		delete(cm.movedHosts, host)
+		if _, found := cm.servers[host]; found {
+			continue
+		}
+		for _, desired := range cm.desired {
+			if host == desired {
+				cm.servers[host] = &connectionManagerMsgServerEstablished{
+					Connection: NewConnectionToDial(host, cm),
+					host:       host,
+				}
+				break
+			}
+		}
+	}
+}
+
+func (cm *ConnectionManager) serverLinkEstablished(linkEst connectionManagerMsgServerLinkEstablished) {
+	if sl, found := cm.rmToLinks[linkEst.rmId]; found && sl.linkEstablished(linkEst.Connection, linkEst.bootCount, linkEst.link) {
+		log.Printf("Link %v to RMId %v established\n", linkEst.link, linkEst.rmId)
+	} else {
+		log.Printf("Unexpected link %v from RMId %v: shutting it down.\n", linkEst.link, linkEst.rmId)
+		linkEst.Shutdown(paxos.Async)
+	}
+}
+
+// Messages may have been lost with the link, so the primary connection
+// is restarted, which tells the subscribers and tears down the pool.
+func (cm *ConnectionManager) serverLinkLost(linkLost connectionManagerMsgServerLinkLost) {
+	if sl, found := cm.rmToLinks[linkLost.rmId]; found && sl.linkLost(linkLost.Connection, linkLost.link) {
+		log.Printf("Link %v to RMId %v lost: restarting connection.\n", linkLost.link, linkLost.rmId)
+		sl.primary.Shutdown(paxos.Async)
+	}
+}
+
+func (cm *ConnectionManager) dropServerLinks(rmId common.RMId) {
+	if sl, found := cm.rmToLinks[rmId]; found {
+		delete(cm.rmToLinks, rmId)
+		sl.shutdown(paxos.Async)
+	}
+}
+
 func (cm *ConnectionManager) serverFlushed(rmId common.RMId) {
 	if cm.flushedServers != nil {
 		cm.flushedServers[rmId] = server.EmptyStructVal
@@ -631,6 +948,7 @@ func (cm *ConnectionManager) clientEstablished(msg *connectionManagerMsgClientEs
 func (cm *ConnectionManager) setTopology(topology *configuration.Topology, callbacks map[eng.TopologyChangeSubscriberType]func()) {
 	server.Log("Topology change:", topology)
 	cm.topology = topology
+	cm.updateClusterFeatures()
 	cm.topologySubscribers.TopologyChanged(topology, callbacks)
 	cd := cm.rmToServer[cm.RMId]
 	if clusterUUId := topology.ClusterUUId(); cd.clusterUUId == 0 && clusterUUId != 0 {
@@ -644,6 +962,31 @@ func (cm *ConnectionManager) setTopology(topology *configuration.Topology, callb
 	}
 }
 
+// updateClusterFeatures sets the cluster feature version to the
+// lowest announced by any server in the topology. Servers we have
+// never heard from are assumed to support only the baseline. Versions
+// are remembered across disconnections: a server that restarts having
+// been downgraded will announce its new version when it reconnects.
+func (cm *ConnectionManager) updateClusterFeatures() {
+	features := server.FeatureVersion
+	if cm.topology != nil {
+		for _, rmId := range cm.topology.RMs() {
+			if rmId == common.RMIdEmpty || rmId == cm.RMId {
+				continue
+			}
+			if rmFeatures, found := cm.rmToFeatures[rmId]; !found {
+				features = server.FeatureBaseline
+			} else if rmFeatures < features {
+				features = rmFeatures
+			}
+		}
+	}
+	if old := server.ClusterFeatureVersion(); old != features {
+		log.Printf("Cluster feature version changed from %v to %v.", old, features)
+		server.SetClusterFeatureVersion(features)
+	}
+}
+
 func (cm *ConnectionManager) TopologyChanged(topology *configuration.Topology, done func(bool)) {
 	cm.checkFlushed(topology)
 	done(true)
@@ -675,6 +1018,7 @@ func (cm *ConnectionManager) cloneRMToServer() map[common.RMId]paxos.Connection
 func (cm *ConnectionManager) status(sc *server.StatusConsumer) {
 	sc.Emit(fmt.Sprintf("Address: %v", cm.localHost))
 	sc.Emit(fmt.Sprintf("Boot Count: %v", cm.bootcount))
+	sc.Emit(fmt.Sprintf("Feature Version: %v (cluster: %v)", server.FeatureVersion, server.ClusterFeatureVersion()))
 	sc.Emit(fmt.Sprintf("Current Topology: %v", cm.topology))
 	if cm.topology != nil && cm.topology.Next() != nil {
 		sc.Emit(fmt.Sprintf("Next Topology: %v", cm.topology.Next()))
@@ -684,6 +1028,10 @@ func (cm *ConnectionManager) status(sc *server.StatusConsumer) {
 		serverConnections = append(serverConnections, server)
 	}
 	sc.Emit(fmt.Sprintf("ServerConnectionSubscribers: %v", len(cm.serverConnSubscribers.subscribers)))
+	cm.resends.Status(sc.Fork())
+	cm.degradedRMs.Status(sc.Fork())
+	cm.peerLatencies.Status(sc.Fork())
+	cm.auditor.Status(sc.Fork())
 	topSubs := make([]int, eng.TopologyChangeSubscriberTypeLimit)
 	for idx, subs := range cm.topologySubscribers.subscribers {
 		topSubs[idx] = len(subs)
@@ -696,11 +1044,18 @@ func (cm *ConnectionManager) status(sc *server.StatusConsumer) {
 	sc.Emit(fmt.Sprintf("Active Server RMIds: %v", rms))
 	sc.Emit(fmt.Sprintf("Active Server Connections: %v", serverConnections))
 	sc.Emit(fmt.Sprintf("Desired Server Connections: %v", cm.desired))
+	if len(cm.movedHosts) != 0 {
+		sc.Emit(fmt.Sprintf("Moved Hosts: %v", cm.movedHosts))
+	}
+	sc.Emit(fmt.Sprintf("Server Links: %v", cm.links))
 	for _, conn := range cm.servers {
 		if conn.Connection != nil {
 			conn.Connection.Status(sc.Fork())
 		}
 	}
+	for _, sl := range cm.rmToLinks {
+		sl.status(sc.Fork())
+	}
 	cm.RLock()
 	sc.Emit(fmt.Sprintf("Client Connection Count: %v", len(cm.connCountToClient)))
 	cm.connCountToClient[0].(*client.LocalConnection).Status(sc.Fork())
@@ -710,16 +1065,22 @@ func (cm *ConnectionManager) status(sc *server.StatusConsumer) {
 		}
 	}
 	cm.RUnlock()
+	sc.Emit(fmt.Sprintf("Recovery: %v", cm.Dispatchers.Recovery()))
 	cm.Dispatchers.VarDispatcher.Status(sc.Fork())
 	cm.Dispatchers.ProposerDispatcher.Status(sc.Fork())
 	cm.Dispatchers.AcceptorDispatcher.Status(sc.Fork())
+	cm.readCache.Status(sc.Fork())
 	sc.Join()
 }
 
 // paxos.Connection interface to allow sending to ourself.
 func (cm *ConnectionManager) Send(b []byte) {
 	seg, _, err := capn.ReadFromMemoryZeroCopy(b)
-	server.CheckFatal(err)
+	if err != nil {
+		// Resends will cover the loss, if the message matters.
+		log.Println("Dropping undecodable message to ourself:", err)
+		return
+	}
 	msg := msgs.ReadRootMessage(seg)
 	cm.DispatchMessage(cm.RMId, msg.Which(), msg)
 }
@@ -756,12 +1117,14 @@ func (subs serverConnSubscribers) AddSubscriber(ob paxos.ServerConnectionSubscri
 		server.Log(ob, "CM found duplicate add serverConn subscriber")
 	} else {
 		subs.subscribers[ob] = server.EmptyStructVal
+		paxos.SenderSubscribed(ob)
 		ob.ConnectedRMs(subs.cloneRMToServer())
 	}
 }
 
 func (subs serverConnSubscribers) RemoveSubscriber(ob paxos.ServerConnectionSubscriber) {
 	delete(subs.subscribers, ob)
+	paxos.SenderUnsubscribed(ob)
 }
 
 // topologySubscribers
@@ -772,9 +1135,19 @@ func (subs topologySubscribers) TopologyChanged(topology *configuration.Topology
 		resultChan := make(chan bool, len(subsMap))
 		done := func(success bool) { resultChan <- success }
 		expected := 0
-		for sub := range subsMap {
-			expected++
-			sub.TopologyChanged(topology, done)
+		if installer := subs.installers[subType]; installer != nil {
+			// snapshot the subscribers: the installer runs after we return.
+			subsList := make([]eng.TopologySubscriber, 0, len(subsMap))
+			for sub := range subsMap {
+				subsList = append(subsList, sub)
+			}
+			expected = len(subsList)
+			installer.install(topology, subsList, done)
+		} else {
+			for sub := range subsMap {
+				expected++
+				sub.TopologyChanged(topology, done)
+			}
 		}
 		if cb, found := callbacks[eng.TopologyChangeSubscriberType(subType)]; found {
 			cbCopy := cb
@@ -847,5 +1220,7 @@ func (cd *connectionManagerMsgServerEstablished) clone() *connectionManagerMsgSe
 		bootCount:   cd.bootCount,
 		tieBreak:    cd.tieBreak,
 		clusterUUId: cd.clusterUUId,
+		features:    cd.features,
+		links:       cd.links,
 	}
 }
@@ -0,0 +1,53 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"goshawkdb.io/server"
+	"net/http"
+	"strconv"
+)
+
+type varContentionReport struct {
+	VarUUId string
+	Pending int
+	Reads   int
+	Writes  int
+	TxnIds  []string
+}
+
+// ServeContention writes, as JSON, the vars on this node with the most
+// reads and writes awaiting their outcome, most contended first. The
+// number of vars reported can be set with the limit query parameter.
+func (cm *ConnectionManager) ServeContention(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := server.ContentionReportVars
+	if limitStr := req.URL.Query().Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l < 1 {
+			http.Error(w, "Illegal limit: must be > 0", http.StatusBadRequest)
+			return
+		}
+		limit = l
+	}
+	contention := cm.Dispatchers.VarDispatcher.Contention(limit)
+	report := make([]*varContentionReport, len(contention))
+	for idx, vc := range contention {
+		txnIds := make([]string, len(vc.TxnIds))
+		for idy, txnId := range vc.TxnIds {
+			txnIds[idy] = hex.EncodeToString(txnId[:])
+		}
+		report[idx] = &varContentionReport{
+			VarUUId: hex.EncodeToString(vc.VarUUId[:]),
+			Pending: vc.Pending(),
+			Reads:   vc.Reads,
+			Writes:  vc.Writes,
+			TxnIds:  txnIds,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,87 @@
+package network
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server/configuration"
+	"time"
+)
+
+var (
+	creationThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "creation_throttled_total",
+		Help:      "Number of client txns creating vars which were delayed due to root quotas.",
+	}, []string{"root"})
+	creationThrottledSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "creation_throttled_seconds_total",
+		Help:      "Total time client txns creating vars have been delayed due to root quotas.",
+	}, []string{"root"})
+	rootQuotaUtilizationDesc = prometheus.NewDesc("goshawkdb_root_quota_utilization",
+		"Fraction of each root's var quota in use.", []string{"root"}, nil)
+	rootCreationDelayDesc = prometheus.NewDesc("goshawkdb_root_creation_delay_seconds",
+		"Current delay applied to each client txn which creates vars reachable from the root.", []string{"root"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(creationThrottled)
+	prometheus.MustRegister(creationThrottledSeconds)
+}
+
+// CreationThrottle applies soft back-pressure to clients which create
+// vars in roots that are approaching their quotas. Usage comes from
+// the StorageAccountant, so it is only as fresh as the last walk.
+type CreationThrottle struct {
+	quotas            map[string]*configuration.RootQuota
+	storageAccountant *StorageAccountant
+}
+
+func NewCreationThrottle(quotas map[string]*configuration.RootQuota, sa *StorageAccountant) *CreationThrottle {
+	ct := &CreationThrottle{
+		quotas:            quotas,
+		storageAccountant: sa,
+	}
+	prometheus.MustRegister(ct)
+	return ct
+}
+
+// Delay returns how long to delay a txn which creates vars, submitted
+// by a client with access to the given roots, and the root
+// responsible. A client with several roots is delayed according to
+// the root closest to its quota: we can't tell which root the new
+// vars will end up reachable from.
+func (ct *CreationThrottle) Delay(roots map[string]*common.Capability) (time.Duration, string) {
+	delay, culprit := time.Duration(0), ""
+	for name := range roots {
+		rq, found := ct.quotas[name]
+		if !found {
+			continue
+		}
+		if vars, known := ct.storageAccountant.Usage(name); known {
+			if d := rq.Delay(vars); d > delay {
+				delay, culprit = d, name
+			}
+		}
+	}
+	return delay, culprit
+}
+
+func (ct *CreationThrottle) throttled(root string, delay time.Duration) {
+	creationThrottled.WithLabelValues(root).Inc()
+	creationThrottledSeconds.WithLabelValues(root).Add(delay.Seconds())
+}
+
+func (ct *CreationThrottle) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rootQuotaUtilizationDesc
+	ch <- rootCreationDelayDesc
+}
+
+func (ct *CreationThrottle) Collect(ch chan<- prometheus.Metric) {
+	for name, rq := range ct.quotas {
+		if vars, known := ct.storageAccountant.Usage(name); known {
+			ch <- prometheus.MustNewConstMetric(rootQuotaUtilizationDesc, prometheus.GaugeValue, rq.Utilization(vars), name)
+			ch <- prometheus.MustNewConstMetric(rootCreationDelayDesc, prometheus.GaugeValue, rq.Delay(vars).Seconds(), name)
+		}
+	}
+}
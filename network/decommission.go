@@ -0,0 +1,335 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/configuration"
+	"goshawkdb.io/server/db"
+	eng "goshawkdb.io/server/txnengine"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The steps of a decommission, in order. Each is recorded in the data
+// directory before it is acted upon, so a decommission interrupted
+// by a restart resumes where it left off.
+const (
+	decommissionCordoned = "cordoned"
+	decommissionRemoving = "removing"
+	decommissionRemoved  = "removed"
+)
+
+// Decommissioner guides the removal of this node from the cluster.
+// When an admin asks for a decommission, the node is first cordoned:
+// new client connections are refused. Then a configuration without
+// this node is requested, which migrates the node's vars to the
+// remaining nodes. Once that configuration is installed, it is
+// checked that no RM position refers to this node, so that no var
+// can be allocated to it; the node then shuts down, as any removed
+// node does. If asked, the data directory is wiped at shutdown. Asking
+// again is harmless: it resumes from the current step.
+type Decommissioner struct {
+	sync.Mutex
+	connectionManager *ConnectionManager
+	transmogrifier    *TopologyTransmogrifier
+	path              string
+	state             decommissionState
+	topology          *configuration.Topology
+}
+
+type decommissionState struct {
+	Step    string
+	Host    string
+	Version uint32
+	Wipe    bool
+	Started time.Time
+	Err     string `json:",omitempty"`
+}
+
+func NewDecommissioner(cm *ConnectionManager, tt *TopologyTransmogrifier, dataDir string) (*Decommissioner, error) {
+	d := &Decommissioner{
+		connectionManager: cm,
+		transmogrifier:    tt,
+		path:              filepath.Join(dataDir, db.DecommissionFileName),
+	}
+	if b, err := ioutil.ReadFile(d.path); err == nil {
+		if err = json.Unmarshal(b, &d.state); err != nil {
+			return nil, fmt.Errorf("Unable to read decommission state from %v: %v", d.path, err)
+		}
+		log.Printf("Decommission of this node resuming from step %v.\n", d.state.Step)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	topology := cm.AddTopologySubscriber(eng.ConnectionSubscriber, d)
+	d.Lock()
+	defer d.Unlock()
+	d.topology = topology
+	if d.state.Step != "" && d.state.Step != decommissionRemoved {
+		// Any request made before the restart may have been lost.
+		d.advance(true)
+	}
+	return d, nil
+}
+
+func (d *Decommissioner) Shutdown() {
+	d.connectionManager.RemoveTopologySubscriberAsync(eng.ConnectionSubscriber, d)
+}
+
+// Cordoned returns true if new client connections are to be refused.
+func (d *Decommissioner) Cordoned() bool {
+	if d == nil {
+		return false
+	}
+	d.Lock()
+	defer d.Unlock()
+	return d.state.Step != ""
+}
+
+// Removed returns true if this node has been decommissioned.
+func (d *Decommissioner) Removed() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.state.Step == decommissionRemoved
+}
+
+// Start starts, or resumes, the decommission. If wipe is true, the
+// data directory is wiped once the node has been removed and has shut
+// down.
+func (d *Decommissioner) Start(wipe bool) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.state.Step == decommissionRemoved {
+		return nil
+	}
+	if d.state.Step == "" {
+		// The configuration without this node is made here, so can't
+		// be signed.
+		if d.connectionManager.ConfigVerifier != nil {
+			return errors.New("Configurations must be signed: remove this node by signing a configuration without it and sending SIGHUP")
+		}
+		host, err := d.ourHost()
+		if err != nil {
+			return err
+		}
+		d.state = decommissionState{
+			Step:    decommissionCordoned,
+			Host:    host,
+			Started: time.Now(),
+		}
+		log.Printf("Decommission of this node (%v) started: refusing new client connections.\n", host)
+	}
+	d.state.Wipe = d.state.Wipe || wipe
+	if err := d.save(); err != nil {
+		return err
+	}
+	d.advance(true)
+	return nil
+}
+
+func (d *Decommissioner) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	d.Lock()
+	d.topology = topology
+	if d.state.Step == decommissionRemoving {
+		d.advance(false)
+	}
+	d.Unlock()
+	done(true)
+}
+
+// removed is called by the TopologyTransmogrifier when it finds this
+// node has been removed from the cluster, just before it shuts the
+// node down.
+func (d *Decommissioner) removed(topology *configuration.Topology) {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.state.Step != decommissionRemoving {
+		return
+	}
+	for _, rmId := range topology.RMs() {
+		if rmId == d.connectionManager.RMId {
+			d.fail(fmt.Errorf("Removed, but %v still has positions in configuration version %v", rmId, topology.Version))
+			return
+		}
+	}
+	d.state.Step = decommissionRemoved
+	d.state.Err = ""
+	if err := d.save(); err != nil {
+		log.Println("Decommission: unable to record removal:", err)
+	}
+	log.Printf("Decommission: removed from the cluster at configuration version %v; no vars are allocated to this node.\n", topology.Version)
+}
+
+// advance requests the configuration without this node, if that's
+// the next step, or if the previous request appears to have been
+// lost or superseded. d must be locked.
+func (d *Decommissioner) advance(resume bool) {
+	topology := d.topology
+	if topology == nil || topology.IsBlank() {
+		return
+	}
+	switch d.state.Step {
+	case decommissionCordoned:
+	case decommissionRemoving:
+		if topology.Next() != nil {
+			return // a change is in progress; which may well be ours
+		}
+		if !resume && topology.Version < d.state.Version {
+			return // ours has not yet been started
+		}
+		if _, err := d.ourHost(); err != nil {
+			return // we're already gone
+		}
+	default:
+		return
+	}
+	if d.connectionManager.ConfigVerifier != nil {
+		d.fail(errors.New("Configurations must be signed: unable to request a configuration without this node"))
+		return
+	}
+	config, err := topology.Configuration.WithoutHosts([]string{d.state.Host})
+	if err != nil {
+		d.fail(fmt.Errorf("Unable to remove %v from configuration version %v: %v", d.state.Host, topology.Version, err))
+		return
+	}
+	d.state.Step = decommissionRemoving
+	d.state.Version = config.Version
+	d.state.Err = ""
+	if err := d.save(); err != nil {
+		d.fail(err)
+		return
+	}
+	log.Printf("Decommission: requesting configuration version %v without %v.\n", config.Version, d.state.Host)
+	d.transmogrifier.RequestConfigurationChange(config, ConfigSourceAdmin, "decommission of "+d.state.Host)
+}
+
+// fail records err as the reason the decommission is stuck. It will
+// be retried when next started. d must be locked.
+func (d *Decommissioner) fail(err error) {
+	log.Println("Decommission:", err)
+	d.state.Err = err.Error()
+	if err := d.save(); err != nil {
+		log.Println("Decommission: unable to record state:", err)
+	}
+}
+
+// ourHost finds the host of this node in the current topology. d
+// must be locked.
+func (d *Decommissioner) ourHost() (string, error) {
+	topology := d.topology
+	if topology == nil || topology.IsBlank() {
+		return "", errors.New("Cluster not yet formed")
+	}
+	// Hosts is in the same order as the non-empty RMs.
+	hostIdx := 0
+	for _, rmId := range topology.RMs() {
+		if rmId == common.RMIdEmpty {
+			continue
+		}
+		if rmId == d.connectionManager.RMId && hostIdx < len(topology.Hosts) {
+			return topology.Hosts[hostIdx], nil
+		}
+		hostIdx++
+	}
+	return "", fmt.Errorf("This node (%v) is not in configuration version %v", d.connectionManager.RMId, topology.Version)
+}
+
+func (d *Decommissioner) save() error {
+	b, err := json.Marshal(&d.state)
+	if err != nil {
+		return err
+	}
+	tmp := d.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
+
+// WipeIfRemoved removes everything in dataDir if this node has been
+// removed and the wipe was asked for. It must only be called once
+// nothing else is using the data directory.
+func (d *Decommissioner) WipeIfRemoved(dataDir string) {
+	d.Lock()
+	wipe := d.state.Step == decommissionRemoved && d.state.Wipe
+	d.Unlock()
+	if !wipe {
+		return
+	}
+	log.Println("Decommission: wiping data directory", dataDir)
+	entries, err := ioutil.ReadDir(dataDir)
+	for idx := 0; err == nil && idx < len(entries); idx++ {
+		err = os.RemoveAll(filepath.Join(dataDir, entries[idx].Name()))
+	}
+	if err != nil {
+		log.Println("Decommission: unable to wipe data directory:", err)
+	}
+}
+
+func (d *Decommissioner) String() string {
+	d.Lock()
+	defer d.Unlock()
+	state := d.state
+	var progress string
+	switch state.Step {
+	case "":
+		return "No decommission requested."
+	case decommissionCordoned:
+		progress = "cordoned; removal not yet requested"
+	case decommissionRemoving:
+		progress = fmt.Sprintf("removal requested as configuration version %v", state.Version)
+		if topology := d.topology; topology != nil && topology.Next() != nil {
+			next := topology.Next()
+			progress += fmt.Sprintf("; migrating to version %v: %v nodes awaiting vars", next.Version, len(next.Pending))
+		}
+	case decommissionRemoved:
+		progress = "removed; no vars are allocated to this node"
+	}
+	if state.Err != "" {
+		progress += "; stuck: " + state.Err
+	}
+	return fmt.Sprintf("Decommission of %v started at %v: %s (wipe data directory? %v).", state.Host, state.Started, progress, state.Wipe)
+}
+
+// ServeDecommission reports the progress of the decommission. A POST
+// starts or resumes it; with wipe=true, the data directory is wiped
+// once the node has been removed.
+func (d *Decommissioner) ServeDecommission(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		fmt.Fprintln(w, d.String())
+	case "POST":
+		wipe := false
+		if wipeStr := req.FormValue("wipe"); wipeStr != "" {
+			var err error
+			if wipe, err = strconv.ParseBool(wipeStr); err != nil {
+				http.Error(w, "wipe must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := d.Start(wipe); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, d.String())
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *Decommissioner) Status(sc *server.StatusConsumer) {
+	sc.Emit(d.String())
+	sc.Join()
+}
@@ -0,0 +1,88 @@
+package network
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/paxos"
+	"sync"
+)
+
+// degradedNotice tells every other server whether our disk is
+// degraded, so that their submitters avoid us as an acceptor for new
+// txns. It is told whenever that changes, and tells each server as it
+// connects if we're currently degraded; servers forget on
+// disconnection. Servers which predate the notice would not
+// understand the message, so we only send it once the whole cluster
+// supports it.
+type degradedNotice struct {
+	sync.Mutex
+	cm       *ConnectionManager
+	conns    map[common.RMId]paxos.Connection
+	degraded bool
+}
+
+func newDegradedNotice(cm *ConnectionManager) *degradedNotice {
+	dn := &degradedNotice{cm: cm}
+	cm.AddServerConnectionSubscriber(dn)
+	return dn
+}
+
+// SetDegraded marks this server's disk as degraded or recovered, both
+// locally and to every other server.
+func (cm *ConnectionManager) SetDegraded(degraded bool) {
+	cm.degradedRMs.Set(cm.RMId, degraded)
+	cm.degradedNotice.set(degraded)
+}
+
+func (cm *ConnectionManager) DegradedRMs() *paxos.DegradedRMs {
+	return cm.degradedRMs
+}
+
+func (dn *degradedNotice) set(degraded bool) {
+	dn.Lock()
+	dn.degraded = degraded
+	conns := dn.conns
+	dn.Unlock()
+	msg := dn.msg(degraded)
+	for _, conn := range conns {
+		dn.send(conn, msg)
+	}
+}
+
+func (dn *degradedNotice) msg(degraded bool) []byte {
+	seg := capn.NewBuffer(nil)
+	msg := msgs.NewRootMessage(seg)
+	msg.SetDegraded(degraded)
+	return server.SegToBytes(seg)
+}
+
+func (dn *degradedNotice) send(conn paxos.Connection, msg []byte) {
+	if conn.RMId() != dn.cm.RMId && server.FeatureEnabled(server.FeatureDegradedNotice) {
+		conn.Send(msg)
+	}
+}
+
+func (dn *degradedNotice) ConnectedRMs(conns map[common.RMId]paxos.Connection) {
+	dn.Lock()
+	defer dn.Unlock()
+	dn.conns = conns
+}
+
+func (dn *degradedNotice) ConnectionLost(rmId common.RMId, conns map[common.RMId]paxos.Connection) {
+	dn.Lock()
+	defer dn.Unlock()
+	dn.conns = conns
+}
+
+func (dn *degradedNotice) ConnectionEstablished(rmId common.RMId, conn paxos.Connection, conns map[common.RMId]paxos.Connection, done func()) {
+	dn.Lock()
+	dn.conns = conns
+	degraded := dn.degraded
+	dn.Unlock()
+	if degraded {
+		dn.send(conn, dn.msg(true))
+	}
+	done()
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"goshawkdb.io/server"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// Discovery is for development clusters only: it lets nodes on the
+// same LAN (or the same machine) which share a ClusterId find each
+// other, so that the list of hosts doesn't have to be written by
+// hand. Each node multicasts an announcement of its ClusterId and
+// port, and listens for the announcements of others. There is no
+// authentication whatsoever, which is why it must never be used in
+// production.
+type discoveryAnnouncement struct {
+	ClusterId string
+	Port      uint16
+}
+
+// Discover blocks until count distinct nodes (including ourself)
+// announcing the same ClusterId have been seen, and returns their
+// host:port addresses sorted so that every node arrives at the same
+// list. We carry on announcing for a while afterwards so that slower
+// nodes can also complete.
+func Discover(clusterId string, listenPort uint16, count int) ([]string, error) {
+	group, err := net.ResolveUDPAddr("udp4", server.DiscoveryGroupAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	announcement, err := json.Marshal(&discoveryAnnouncement{ClusterId: clusterId, Port: listenPort})
+	if err != nil {
+		return nil, err
+	}
+	terminate := make(chan struct{})
+	go discoveryAnnounce(group, announcement, terminate)
+
+	log.Printf("Discovery: looking for %v nodes for cluster %v. This is for development use only.\n", count, clusterId)
+	hosts := make(map[string]server.EmptyStruct)
+	buf := make([]byte, 1024)
+	for len(hosts) < count {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			close(terminate)
+			return nil, err
+		}
+		remote := &discoveryAnnouncement{}
+		if err := json.Unmarshal(buf[:n], remote); err != nil || remote.ClusterId != clusterId || remote.Port == 0 {
+			continue
+		}
+		// Our own announcements loop back with the address of the
+		// sending interface, which is what the other nodes see too, so
+		// all nodes agree on the addresses.
+		hostPort := net.JoinHostPort(from.IP.String(), fmt.Sprint(remote.Port))
+		if _, found := hosts[hostPort]; !found {
+			hosts[hostPort] = server.EmptyStructVal
+			log.Printf("Discovery: found %v (%v of %v)\n", hostPort, len(hosts), count)
+		}
+	}
+	time.AfterFunc(server.DiscoveryLinger, func() { close(terminate) })
+
+	result := make([]string, 0, len(hosts))
+	for hostPort := range hosts {
+		result = append(result, hostPort)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func discoveryAnnounce(group *net.UDPAddr, announcement []byte, terminate chan struct{}) {
+	conn, err := net.DialUDP("udp4", nil, group)
+	if err != nil {
+		log.Println("Discovery: unable to announce:", err)
+		return
+	}
+	defer conn.Close()
+	ticker := time.NewTicker(server.DiscoveryAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := conn.Write(announcement); err != nil {
+			server.Log("Discovery: error when announcing:", err)
+		}
+		select {
+		case <-terminate:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package network
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/paxos"
+	eng "goshawkdb.io/server/txnengine"
+)
+
+// gossipFrozenVar sends the state of a var which has just been
+// frozen to every other server we're currently connected to. Servers
+// we're not connected to, or which miss the gossip, learn of the var
+// lazily instead, from their own reads of it. Servers which predate
+// frozen vars would not understand the message, so we only gossip
+// once the whole cluster supports them.
+func (cm *ConnectionManager) gossipFrozenVar(vUUId *common.VarUUId, lr *eng.LocalRead) {
+	if !server.FeatureEnabled(server.FeatureFrozenVars) {
+		return
+	}
+	seg := capn.NewBuffer(nil)
+	msg := msgs.NewRootMessage(seg)
+	updates := msgs.NewUpdateList(seg, 1)
+	lr.SetUpdate(vUUId, updates.At(0))
+	msg.SetFrozenVars(updates)
+	cm.AddServerConnectionSubscriber(&frozenVarGossip{
+		msg: server.SegToBytes(seg),
+		cm:  cm,
+	})
+}
+
+type frozenVarGossip struct {
+	msg []byte
+	cm  *ConnectionManager
+}
+
+func (fvg *frozenVarGossip) ConnectedRMs(conns map[common.RMId]paxos.Connection) {
+	for rmId, conn := range conns {
+		if rmId != fvg.cm.RMId {
+			conn.Send(fvg.msg)
+		}
+	}
+	fvg.cm.RemoveServerConnectionSubscriber(fvg)
+}
+
+func (fvg *frozenVarGossip) ConnectionLost(common.RMId, map[common.RMId]paxos.Connection) {}
+
+func (fvg *frozenVarGossip) ConnectionEstablished(rmId common.RMId, conn paxos.Connection, conns map[common.RMId]paxos.Connection, done func()) {
+	done()
+}
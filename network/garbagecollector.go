@@ -0,0 +1,674 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	mdb "github.com/msackman/gomdb"
+	mdbs "github.com/msackman/gomdb/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/common"
+	cmsgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/configuration"
+	ch "goshawkdb.io/server/consistenthash"
+	"goshawkdb.io/server/db"
+	eng "goshawkdb.io/server/txnengine"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	gcCycles = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "gc_cycles_total",
+		Help:      "Number of completed garbage collection cycles.",
+	})
+	gcMarked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "gc_marked_vars_total",
+		Help:      "Number of vars found reachable whilst tracing from the roots.",
+	})
+	gcReachable = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "gc_reachable_vars",
+		Help:      "Number of vars found reachable from the roots by the last garbage collection cycle.",
+	})
+	gcUnreachable = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "gc_unreachable_vars",
+		Help:      "Number of unreachable vars this node is responsible for collecting.",
+	})
+	gcCollected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "gc_collected_vars_total",
+		Help:      "Number of unreachable vars collected.",
+	})
+	gcCycleSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "gc_cycle_seconds",
+		Help:      "Duration of the last garbage collection cycle.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(gcCycles)
+	prometheus.MustRegister(gcMarked)
+	prometheus.MustRegister(gcReachable)
+	prometheus.MustRegister(gcUnreachable)
+	prometheus.MustRegister(gcCollected)
+	prometheus.MustRegister(gcCycleSeconds)
+}
+
+type GCMode uint8
+
+const (
+	GCOff    GCMode = iota
+	GCDryRun GCMode = iota
+	GCOn     GCMode = iota
+)
+
+func (mode GCMode) String() string {
+	switch mode {
+	case GCOff:
+		return "off"
+	case GCDryRun:
+		return "dryrun"
+	case GCOn:
+		return "on"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(mode))
+	}
+}
+
+func ParseGCMode(str string) (GCMode, error) {
+	for _, mode := range []GCMode{GCOff, GCDryRun, GCOn} {
+		if strings.EqualFold(str, mode.String()) {
+			return mode, nil
+		}
+	}
+	return GCOff, fmt.Errorf("Unknown garbage collection mode: %v", str)
+}
+
+// GarbageCollector finds vars which are no longer reachable from any
+// root and collects them. Each cycle:
+//
+// 1. Marks every var reachable from the roots. Vars are read through
+// the local connection (by reading at version zero, as the REST
+// gateway does), so the trace follows the current committed state
+// across the whole cluster and not just the vars held here.
+//
+// 2. Finds the vars held locally which were not marked. The work is
+// sharded using the vars' positions: only the first RM to which a
+// var's positions resolve considers it.
+//
+// 3. Collects vars which have been continuously unreachable for at
+// least the grace period, by writing them with an empty value and no
+// references. This releases their values and the references they
+// hold (so the graph beneath them becomes collectable in turn). The
+// vars themselves remain, as tombstones. A tombstone is recognised
+// from its last write, held on disk, so tombstones are not
+// reconsidered in later cycles (nor after a restart), and nothing
+// about them is kept in memory.
+//
+// The mark phase is not sharded: every node traces the whole graph.
+// Sweeping is only safe against the complete reachable set, and a var
+// held here may be referenced from anywhere in the graph, so a
+// sharded mark would need every node's marks exchanged before any
+// node could sweep. The trace is a series of reads at version zero,
+// which are answered from the vars' current frames without voting,
+// and it is throttled by GCBatchSize and GCBatchDelay, so the cost of
+// the repeated work is bounded by the size of the reachable graph and
+// spread over the cycle.
+//
+// The grace period exists because clients may still hold references
+// to vars which have become unreachable, and could write those
+// references back into the graph. Such a write may land after the
+// mark, so before anything is collected the roots are traced again,
+// and any collectable var found reachable is dropped (and its grace
+// period starts afresh should it become unreachable again). That
+// leaves only writes landing between the second trace and the
+// collection, by clients holding a reference for at least the whole
+// grace period, which is why the grace period must be long (at least
+// GCInterval). Cycles are skipped whilst a
+// topology change is in progress. In dry-run mode, nothing is
+// collected but the report shows what would be.
+type GarbageCollector struct {
+	sync.Mutex
+	connectionManager *ConnectionManager
+	db                *db.Databases
+	mode              GCMode
+	grace             time.Duration
+	topology          *configuration.Topology
+	candidates        map[common.VarUUId]*gcCandidate
+	cycles            uint64
+	completed         time.Time
+	duration          time.Duration
+	reachable         uint64
+	collected         uint64
+	terminate         chan struct{}
+	terminated        chan struct{}
+}
+
+type gcCandidate struct {
+	vUUId     *common.VarUUId
+	positions *common.Positions
+	since     time.Time
+}
+
+type gcVar struct {
+	vUUId     *common.VarUUId
+	positions *common.Positions
+}
+
+func NewGarbageCollector(db *db.Databases, cm *ConnectionManager, mode GCMode, grace time.Duration) *GarbageCollector {
+	gc := &GarbageCollector{
+		connectionManager: cm,
+		db:                db,
+		mode:              mode,
+		grace:             grace,
+		candidates:        make(map[common.VarUUId]*gcCandidate),
+		terminate:         make(chan struct{}),
+		terminated:        make(chan struct{}),
+	}
+	gc.topology = cm.AddTopologySubscriber(eng.ConnectionSubscriber, gc)
+	go gc.run()
+	return gc
+}
+
+func (gc *GarbageCollector) Shutdown() {
+	gc.connectionManager.RemoveTopologySubscriberAsync(eng.ConnectionSubscriber, gc)
+	close(gc.terminate)
+	<-gc.terminated
+}
+
+func (gc *GarbageCollector) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	gc.Lock()
+	gc.topology = topology
+	gc.Unlock()
+	done(true)
+}
+
+func (gc *GarbageCollector) Status(sc *server.StatusConsumer) {
+	gc.Lock()
+	defer gc.Unlock()
+	sc.Emit(fmt.Sprintf("Garbage collection: %v (grace period %v)", gc.mode, gc.grace))
+	if gc.cycles != 0 {
+		sc.Emit(fmt.Sprintf("- Last cycle completed %v; took %v; %v reachable vars; %v unreachable vars; %v collected in total",
+			gc.completed, gc.duration, gc.reachable, len(gc.candidates), gc.collected))
+	}
+	sc.Join()
+}
+
+type gcReport struct {
+	Mode       string
+	Grace      string
+	Cycles     uint64
+	Completed  time.Time
+	Duration   string
+	Reachable  uint64
+	Collected  uint64
+	Candidates []*gcCandidateReport
+}
+
+type gcCandidateReport struct {
+	VarUUId          string
+	UnreachableSince time.Time
+	CollectableAt    time.Time
+}
+
+// ServeReport writes, as JSON, the result of the last cycle,
+// including the vars which are (or, in dry-run mode, would be)
+// collected.
+func (gc *GarbageCollector) ServeReport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	gc.Lock()
+	report := &gcReport{
+		Mode:       gc.mode.String(),
+		Grace:      gc.grace.String(),
+		Cycles:     gc.cycles,
+		Completed:  gc.completed,
+		Duration:   gc.duration.String(),
+		Reachable:  gc.reachable,
+		Collected:  gc.collected,
+		Candidates: make([]*gcCandidateReport, 0, len(gc.candidates)),
+	}
+	for _, c := range gc.candidates {
+		report.Candidates = append(report.Candidates, &gcCandidateReport{
+			VarUUId:          hex.EncodeToString(c.vUUId[:]),
+			UnreachableSince: c.since,
+			CollectableAt:    c.since.Add(gc.grace),
+		})
+	}
+	gc.Unlock()
+	sort.Sort(candidatesBySince(report.Candidates))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+type candidatesBySince []*gcCandidateReport
+
+func (c candidatesBySince) Len() int { return len(c) }
+func (c candidatesBySince) Less(i, j int) bool {
+	return c[i].UnreachableSince.Before(c[j].UnreachableSince)
+}
+func (c candidatesBySince) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+func (gc *GarbageCollector) run() {
+	defer close(gc.terminated)
+	if gc.mode == GCOff {
+		<-gc.terminate
+		return
+	}
+	ticker := time.NewTicker(server.GCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-gc.terminate:
+			return
+		case <-ticker.C:
+		}
+		if err := gc.cycle(); err != nil {
+			log.Println("Garbage collection error:", err)
+		}
+	}
+}
+
+func (gc *GarbageCollector) cycle() error {
+	gc.Lock()
+	topology := gc.topology
+	gc.Unlock()
+	if topology == nil || topology.IsBlank() || len(topology.Roots) == 0 {
+		return nil
+	} else if topology.Next() != nil {
+		server.Log("GC: skipping cycle due to topology change in progress.")
+		return nil
+	} else if topology.IsLearner(gc.connectionManager.RMId) {
+		// Learners hold no vars as one of their RMs, so never collect.
+		return nil
+	}
+
+	start := time.Now()
+	reachable, err := gc.mark(topology)
+	if err != nil || reachable == nil {
+		return err
+	}
+	unreachable, err := gc.sweep(topology, reachable)
+	if err != nil || unreachable == nil {
+		return err
+	}
+
+	collectable := gc.updateCandidates(unreachable, start, time.Now())
+
+	collected := uint64(0)
+	if gc.mode == GCOn && len(collectable) != 0 {
+		if reachable, err = gc.mark(topology); err != nil || reachable == nil {
+			return err
+		}
+		collectable = gc.retrace(collectable, reachable)
+		for _, c := range collectable {
+			if done, err := gc.collect(c); err != nil {
+				return err
+			} else if done {
+				collected++
+			}
+			select {
+			case <-gc.terminate:
+				return nil
+			case <-time.After(server.GCBatchDelay):
+			}
+		}
+	}
+
+	gc.Lock()
+	gc.cycles++
+	gc.completed = time.Now()
+	gc.duration = gc.completed.Sub(start)
+	gc.reachable = uint64(len(reachable))
+	gc.collected += collected
+	gcUnreachable.Set(float64(len(gc.candidates)))
+	gc.Unlock()
+	gcCycles.Inc()
+	gcReachable.Set(float64(len(reachable)))
+	gcCycleSeconds.Set(time.Since(start).Seconds())
+	log.Printf("GC (%v): %v reachable vars; %v unreachable vars; %v collectable; %v collected.",
+		gc.mode, len(reachable), len(unreachable), len(collectable), collected)
+	return nil
+}
+
+// updateCandidates replaces the candidates with the vars found
+// unreachable by the cycle which started at start. A var which was
+// already a candidate keeps the time it was first found unreachable;
+// a var which is no longer unreachable stops being a candidate, so
+// its grace period starts afresh if it becomes unreachable again.
+// Returns the candidates which, at now, have been unreachable for at
+// least the grace period.
+func (gc *GarbageCollector) updateCandidates(unreachable []*gcVar, start, now time.Time) []*gcCandidate {
+	collectable := []*gcCandidate{}
+	gc.Lock()
+	defer gc.Unlock()
+	candidates := make(map[common.VarUUId]*gcCandidate, len(unreachable))
+	for _, v := range unreachable {
+		c, found := gc.candidates[*v.vUUId]
+		if !found {
+			c = &gcCandidate{vUUId: v.vUUId, positions: v.positions, since: start}
+		}
+		candidates[*v.vUUId] = c
+		if now.Sub(c.since) >= gc.grace {
+			collectable = append(collectable, c)
+		}
+	}
+	gc.candidates = candidates
+	return collectable
+}
+
+// retrace returns the collectable vars which are still unreachable,
+// according to a fresh mark. Those which are now reachable stop being
+// candidates.
+func (gc *GarbageCollector) retrace(collectable []*gcCandidate, reachable map[common.VarUUId]server.EmptyStruct) []*gcCandidate {
+	stillUnreachable := make([]*gcCandidate, 0, len(collectable))
+	gc.Lock()
+	defer gc.Unlock()
+	for _, c := range collectable {
+		if _, found := reachable[*c.vUUId]; found {
+			server.Log("GC: var became reachable again:", c.vUUId)
+			delete(gc.candidates, *c.vUUId)
+		} else {
+			stillUnreachable = append(stillUnreachable, c)
+		}
+	}
+	return stillUnreachable
+}
+
+// mark returns the set of vars reachable from the roots, or nil if
+// terminated.
+func (gc *GarbageCollector) mark(topology *configuration.Topology) (map[common.VarUUId]server.EmptyStruct, error) {
+	reachable := make(map[common.VarUUId]server.EmptyStruct)
+	queue := make([]*gcVar, 0, len(topology.Roots))
+	for _, root := range topology.Roots {
+		reachable[*root.VarUUId] = server.EmptyStructVal
+		queue = append(queue, &gcVar{vUUId: root.VarUUId, positions: root.Positions})
+	}
+	for len(queue) != 0 {
+		batchSize := server.GCBatchSize
+		if batchSize > len(queue) {
+			batchSize = len(queue)
+		}
+		batch := queue[:batchSize]
+		queue = queue[batchSize:]
+		refs, err := gc.readReferences(batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			vUUId := common.MakeVarUUId(ref.Id())
+			if _, found := reachable[*vUUId]; !found {
+				reachable[*vUUId] = server.EmptyStructVal
+				positions := common.Positions(ref.Positions())
+				queue = append(queue, &gcVar{vUUId: vUUId, positions: &positions})
+				gcMarked.Inc()
+			}
+		}
+		select {
+		case <-gc.terminate:
+			return nil, nil
+		case <-time.After(server.GCBatchDelay):
+		}
+	}
+	return reachable, nil
+}
+
+// readReferences reads the current state of the vars in batch, in a
+// single txn, and returns all their references.
+func (gc *GarbageCollector) readReferences(batch []*gcVar) ([]msgs.VarIdPos, error) {
+	for attempt := 0; attempt < server.GCMaxAttempts; attempt++ {
+		seg := capn.NewBuffer(nil)
+		ctxn := cmsgs.NewClientTxn(seg)
+		ctxn.SetRetry(false)
+		actions := cmsgs.NewClientActionList(seg, len(batch))
+		varPosMap := make(map[common.VarUUId]*common.Positions, len(batch))
+		for idx, v := range batch {
+			action := actions.At(idx)
+			action.SetVarId(v.vUUId[:])
+			action.SetRead()
+			action.Read().SetVersion(common.VersionZero[:])
+			varPosMap[*v.vUUId] = v.positions
+		}
+		ctxn.SetActions(actions)
+		_, outcome, err := gc.connectionManager.localConnection.RunClientTransaction(&ctxn, varPosMap, nil)
+		switch {
+		case err != nil:
+			return nil, err
+		case outcome == nil:
+			return nil, errors.New("Shutdown")
+		case outcome.Which() == msgs.OUTCOME_COMMIT:
+			return nil, nil
+		}
+		abort := outcome.Abort()
+		if abort.Which() == msgs.OUTCOMEABORT_RESUBMIT {
+			continue
+		}
+		refs := []msgs.VarIdPos{}
+		updates := abort.Rerun()
+		for idx, l := 0, updates.Len(); idx < l; idx++ {
+			actions := eng.TxnActionsFromData(updates.At(idx).Actions(), true).Actions()
+			for idy, m := 0, actions.Len(); idy < m; idy++ {
+				if action := actions.At(idy); action.Which() == msgs.ACTION_WRITE {
+					refs = append(refs, action.Write().References().ToArray()...)
+				}
+			}
+		}
+		return refs, nil
+	}
+	return nil, fmt.Errorf("Unable to read %v vars: too much contention", len(batch))
+}
+
+// sweep returns the vars held locally, and which this node is
+// responsible for, which are not in reachable and are not already
+// tombstones. Returns nil if terminated.
+func (gc *GarbageCollector) sweep(topology *configuration.Topology, reachable map[common.VarUUId]server.EmptyStruct) ([]*gcVar, error) {
+	resolver := ch.NewResolver(topology.VoterRMs(), topology.TwoFInc)
+	rmId := gc.connectionManager.RMId
+	unreachable := []*gcVar{}
+	var from []byte
+	for {
+		res, err := gc.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+			res, _ := rtxn.WithCursor(gc.db.Vars, func(cursor *mdbs.Cursor) interface{} {
+				batch := &gcSweepBatch{}
+				var key, value []byte
+				var err error
+				if from == nil {
+					key, value, err = cursor.Get(nil, nil, mdb.FIRST)
+				} else if key, value, err = cursor.Get(from, nil, mdb.SET_RANGE); err == nil && string(key) == string(from) {
+					key, value, err = cursor.Get(nil, nil, mdb.NEXT)
+				}
+				for scanned := 0; err == nil && scanned < server.GCBatchSize; key, value, err = cursor.Get(nil, nil, mdb.NEXT) {
+					if gc.db.ReaderExpired(cursor.RTxn) {
+						cursor.Error(db.ErrReaderExpired)
+						return nil
+					}
+					scanned++
+					batch.last = common.MakeVarUUId(key)
+					if _, found := reachable[*batch.last]; found {
+						continue
+					}
+					// the positions must outlive the txn, so don't decode
+					// directly from the db's memory.
+					seg, _, err := capn.ReadFromMemoryZeroCopy(append([]byte{}, value...))
+					if err != nil {
+						cursor.Error(err)
+						return nil
+					}
+					varCap := msgs.ReadRootVar(seg)
+					positions := common.Positions(varCap.Positions())
+					v := &gcVar{vUUId: batch.last, positions: &positions}
+					txnBytes := gc.db.ReadTxnBytesFromDisk(cursor.RTxn, common.MakeTxnId(varCap.WriteTxnId()))
+					if ok, err := sweepable(v, txnBytes, resolver, rmId); err != nil {
+						cursor.Error(err)
+						return nil
+					} else if ok {
+						batch.unreachable = append(batch.unreachable, v)
+					}
+				}
+				if err != nil && err != mdb.NotFound {
+					cursor.Error(err)
+					return nil
+				}
+				return batch
+			})
+			return res
+		}).ResultError()
+		if err != nil {
+			return nil, err
+		}
+		batch, _ := res.(*gcSweepBatch)
+		if batch == nil || batch.last == nil {
+			return unreachable, nil
+		}
+		from = batch.last[:]
+		unreachable = append(unreachable, batch.unreachable...)
+
+		select {
+		case <-gc.terminate:
+			return nil, nil
+		case <-time.After(server.GCBatchDelay):
+		}
+	}
+}
+
+// gcSweepBatch is the result of sweeping one batch of the local
+// vars: last is the last var scanned, or nil if there were none.
+type gcSweepBatch struct {
+	unreachable []*gcVar
+	last        *common.VarUUId
+}
+
+// sweepable reports whether v, a var held locally which was not
+// marked, is for this node to collect. The topology var is never
+// collected, nor is a var which is already a tombstone (its last
+// write, txnBytes, left it with an empty value and no
+// references). Otherwise v is ours iff we are the first RM to which
+// its positions resolve.
+func sweepable(v *gcVar, txnBytes []byte, resolver *ch.Resolver, rmId common.RMId) (bool, error) {
+	if v.vUUId.Compare(configuration.TopologyVarUUId) == common.EQ {
+		return false, nil
+	} else if txnBytes == nil {
+		return false, fmt.Errorf("Unable to find last write of var %v", v.vUUId)
+	} else if isTombstone(v.vUUId, txnBytes) {
+		return false, nil
+	}
+	hashCodes, err := resolver.ResolveHashCodes((*capn.UInt8List)(v.positions).ToArray())
+	if err != nil {
+		return false, err
+	}
+	return len(hashCodes) != 0 && hashCodes[0] == rmId, nil
+}
+
+// isTombstone reports whether txnBytes writes vUUId with an empty
+// value and no references.
+func isTombstone(vUUId *common.VarUUId, txnBytes []byte) bool {
+	actions := eng.TxnReaderFromData(txnBytes).Actions(true).Actions()
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		if !bytes.Equal(action.VarId(), vUUId[:]) {
+			continue
+		}
+		switch action.Which() {
+		case msgs.ACTION_WRITE:
+			return len(action.Write().Value()) == 0 && action.Write().References().Len() == 0
+		case msgs.ACTION_READWRITE:
+			return len(action.Readwrite().Value()) == 0 && action.Readwrite().References().Len() == 0
+		case msgs.ACTION_CREATE:
+			return len(action.Create().Value()) == 0 && action.Create().References().Len() == 0
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// collect writes c with an empty value and no references. The write
+// reads c's current version, so if c has been modified since it was
+// last read, the txn is resubmitted. Returns true iff c is now a
+// tombstone.
+func (gc *GarbageCollector) collect(c *gcCandidate) (bool, error) {
+	for attempt := 0; attempt < server.GCMaxAttempts; attempt++ {
+		seg := capn.NewBuffer(nil)
+		ctxn := cmsgs.NewClientTxn(seg)
+		ctxn.SetRetry(false)
+		actions := cmsgs.NewClientActionList(seg, 1)
+		action := actions.At(0)
+		action.SetVarId(c.vUUId[:])
+		action.SetRead()
+		action.Read().SetVersion(common.VersionZero[:])
+		ctxn.SetActions(actions)
+		varPosMap := map[common.VarUUId]*common.Positions{*c.vUUId: c.positions}
+		_, outcome, err := gc.connectionManager.localConnection.RunClientTransaction(&ctxn, varPosMap, nil)
+		if err != nil {
+			return false, err
+		} else if outcome == nil || outcome.Which() == msgs.OUTCOME_COMMIT {
+			return false, nil
+		}
+		abort := outcome.Abort()
+		if abort.Which() == msgs.OUTCOMEABORT_RESUBMIT {
+			continue
+		}
+		var version *common.TxnId
+		empty := false
+		updates := abort.Rerun()
+		for idx, l := 0, updates.Len(); idx < l && version == nil; idx++ {
+			update := updates.At(idx)
+			actions := eng.TxnActionsFromData(update.Actions(), true).Actions()
+			for idy, m := 0, actions.Len(); idy < m; idy++ {
+				if action := actions.At(idy); action.Which() == msgs.ACTION_WRITE {
+					write := action.Write()
+					version = common.MakeTxnId(update.TxnId())
+					empty = len(write.Value()) == 0 && write.References().Len() == 0
+					break
+				}
+			}
+		}
+		if version == nil {
+			return false, nil
+		} else if !empty {
+			seg = capn.NewBuffer(nil)
+			ctxn = cmsgs.NewClientTxn(seg)
+			ctxn.SetRetry(false)
+			actions = cmsgs.NewClientActionList(seg, 1)
+			action = actions.At(0)
+			action.SetVarId(c.vUUId[:])
+			action.SetReadwrite()
+			rw := action.Readwrite()
+			rw.SetVersion(version[:])
+			rw.SetValue([]byte{})
+			rw.SetReferences(cmsgs.NewClientVarIdPosList(seg, 0))
+			ctxn.SetActions(actions)
+			_, outcome, err = gc.connectionManager.localConnection.RunClientTransaction(&ctxn, varPosMap, nil)
+			if err != nil {
+				return false, err
+			} else if outcome == nil {
+				return false, nil
+			} else if outcome.Which() != msgs.OUTCOME_COMMIT {
+				continue
+			}
+			server.Log("GC: collected", c.vUUId)
+			gcCollected.Inc()
+		}
+		gc.Lock()
+		delete(gc.candidates, *c.vUUId)
+		gc.Unlock()
+		return !empty, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,148 @@
+package network
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/configuration"
+	ch "goshawkdb.io/server/consistenthash"
+	"testing"
+	"time"
+)
+
+func testGCVar(n byte) *gcVar {
+	id := make([]byte, common.KeyLen)
+	id[common.KeyLen-1] = n
+	seg := capn.NewBuffer(nil)
+	positions := common.Positions(seg.NewUInt8List(3))
+	return &gcVar{vUUId: common.MakeVarUUId(id), positions: &positions}
+}
+
+// A txn which writes value and refs references into v.
+func testGCWriteTxn(v *gcVar, value []byte, refs int) []byte {
+	actionsSeg := capn.NewBuffer(nil)
+	wrapper := msgs.NewRootActionListWrapper(actionsSeg)
+	actions := msgs.NewActionList(actionsSeg, 1)
+	wrapper.SetActions(actions)
+	action := actions.At(0)
+	action.SetVarId(v.vUUId[:])
+	action.SetWrite()
+	write := action.Write()
+	write.SetValue(value)
+	refsCap := msgs.NewVarIdPosList(actionsSeg, refs)
+	for idx := 0; idx < refs; idx++ {
+		refsCap.At(idx).SetId(testGCVar(byte(100 + idx)).vUUId[:])
+	}
+	write.SetReferences(refsCap)
+
+	seg := capn.NewBuffer(nil)
+	txn := msgs.NewRootTxn(seg)
+	txn.SetId(make([]byte, common.KeyLen))
+	txn.SetActions(server.SegToBytes(actionsSeg))
+	return server.SegToBytes(seg)
+}
+
+// A var only becomes collectable once it has been continuously
+// unreachable for the grace period: it keeps the time it was first
+// found unreachable across cycles, and starts afresh if it is found
+// reachable in between.
+func TestGCCandidateGrace(t *testing.T) {
+	gc := &GarbageCollector{
+		grace:      time.Minute,
+		candidates: make(map[common.VarUUId]*gcCandidate),
+	}
+	a, b := testGCVar(1), testGCVar(2)
+	t0 := time.Now()
+
+	if collectable := gc.updateCandidates([]*gcVar{a, b}, t0, t0); len(collectable) != 0 {
+		t.Fatalf("Expected nothing collectable within the grace period; found %v", len(collectable))
+	}
+	if len(gc.candidates) != 2 {
+		t.Fatalf("Expected 2 candidates; found %v", len(gc.candidates))
+	}
+
+	// b is reachable again.
+	t1 := t0.Add(30 * time.Second)
+	if collectable := gc.updateCandidates([]*gcVar{a}, t1, t1); len(collectable) != 0 {
+		t.Fatalf("Expected nothing collectable within the grace period; found %v", len(collectable))
+	}
+	if _, found := gc.candidates[*b.vUUId]; found || len(gc.candidates) != 1 {
+		t.Fatal("Expected a reachable var to stop being a candidate")
+	}
+
+	t2 := t0.Add(time.Minute)
+	collectable := gc.updateCandidates([]*gcVar{a, b}, t2, t2)
+	if len(collectable) != 1 || collectable[0].vUUId.Compare(a.vUUId) != common.EQ {
+		t.Fatalf("Expected only the continuously unreachable var to be collectable; found %v", len(collectable))
+	}
+	if c := gc.candidates[*b.vUUId]; c == nil || !c.since.Equal(t2) {
+		t.Fatal("Expected a var unreachable once more to start its grace period afresh")
+	}
+}
+
+// Tombstones and the topology var are never swept, and of the rest,
+// a node only sweeps the vars whose positions resolve first to it.
+func TestGCSweepable(t *testing.T) {
+	rmIds := common.RMIds{1, 2, 3}
+	resolver := ch.NewResolver(rmIds, 2)
+	v := testGCVar(1)
+	hashCodes, err := resolver.ResolveHashCodes((*capn.UInt8List)(v.positions).ToArray())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := hashCodes[0]
+	live := testGCWriteTxn(v, []byte("value"), 0)
+	for _, rmId := range rmIds {
+		if ok, err := sweepable(v, live, resolver, rmId); err != nil {
+			t.Fatal(err)
+		} else if ok != (rmId == first) {
+			t.Fatalf("RM %v: expected sweepable to be %v", rmId, rmId == first)
+		}
+	}
+
+	if ok, err := sweepable(v, testGCWriteTxn(v, []byte{}, 1), resolver, first); err != nil || !ok {
+		t.Fatalf("Expected a var with references to be sweepable (%v)", err)
+	}
+	if ok, err := sweepable(v, testGCWriteTxn(v, []byte{}, 0), resolver, first); err != nil || ok {
+		t.Fatalf("Expected a tombstone not to be sweepable (%v)", err)
+	}
+	if ok, err := sweepable(v, testGCWriteTxn(testGCVar(2), []byte{}, 0), resolver, first); err != nil || !ok {
+		t.Fatalf("Expected a txn which doesn't write the var not to make it a tombstone (%v)", err)
+	}
+
+	topologyVar := &gcVar{vUUId: configuration.TopologyVarUUId, positions: v.positions}
+	if ok, err := sweepable(topologyVar, live, resolver, first); err != nil || ok {
+		t.Fatalf("Expected the topology var not to be sweepable (%v)", err)
+	}
+	if _, err := sweepable(v, nil, resolver, first); err == nil {
+		t.Fatal("Expected an error when the var's last write is missing")
+	}
+}
+
+// A reference may be written back to a collectable var after the
+// mark, so vars found reachable by the second trace are not
+// collected, and stop being candidates.
+func TestGCRetrace(t *testing.T) {
+	gc := &GarbageCollector{
+		grace:      time.Minute,
+		candidates: make(map[common.VarUUId]*gcCandidate),
+	}
+	a, b := testGCVar(1), testGCVar(2)
+	t0 := time.Now()
+	gc.updateCandidates([]*gcVar{a, b}, t0, t0)
+	t1 := t0.Add(time.Minute)
+	collectable := gc.updateCandidates([]*gcVar{a, b}, t1, t1)
+	if len(collectable) != 2 {
+		t.Fatalf("Expected 2 collectable vars; found %v", len(collectable))
+	}
+
+	reachable := map[common.VarUUId]server.EmptyStruct{*b.vUUId: server.EmptyStructVal}
+	collectable = gc.retrace(collectable, reachable)
+	if len(collectable) != 1 || collectable[0].vUUId.Compare(a.vUUId) != common.EQ {
+		t.Fatalf("Expected only the still unreachable var to be collectable; found %v", len(collectable))
+	}
+	if _, found := gc.candidates[*b.vUUId]; found {
+		t.Fatal("Expected a var found reachable again to stop being a candidate")
+	}
+}
@@ -0,0 +1,162 @@
+package network
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/server"
+	"log"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	clientHandshakeSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "goshawkdb",
+		Name:      "client_tls_handshake_seconds",
+		Help:      "Duration of client TLS handshakes.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"resumed"})
+	clientHandshakeDelaySeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "goshawkdb",
+		Name:      "client_tls_handshake_delay_seconds",
+		Help:      "Time client TLS handshakes were delayed by the handshake rate limiter.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(clientHandshakeSeconds)
+	prometheus.MustRegister(clientHandshakeDelaySeconds)
+}
+
+// ClientHandshakes reduces the cost of client TLS handshakes during
+// reconnect storms (e.g. after a network blip, when every client
+// reconnects at once). Firstly, all client handshakes share the same
+// session ticket keys, so a reconnecting client can resume its
+// previous session rather than perform a full handshake. Secondly,
+// the rate of handshakes is limited by a token bucket, with jitter
+// added to delayed handshakes so that waiting clients don't all
+// proceed in lock-step. Server-server handshakes are not affected.
+type ClientHandshakes struct {
+	sync.Mutex
+	resumption bool
+	ticketKeys [][32]byte
+	rotatedAt  time.Time
+	rate       float64
+	burst      float64
+	tokens     float64
+	updatedAt  time.Time
+	rng        *mrand.Rand
+	handshakes uint64
+	resumed    uint64
+	delayed    uint64
+}
+
+// NewClientHandshakes creates a ClientHandshakes which permits rate
+// client handshakes per second (unlimited if 0), and enables session
+// resumption if resumption is true.
+func NewClientHandshakes(resumption bool, rate int) *ClientHandshakes {
+	burst := float64(rate) * server.ClientHandshakeBurstFraction
+	if burst < 1 {
+		burst = 1
+	}
+	return &ClientHandshakes{
+		resumption: resumption,
+		rate:       float64(rate),
+		burst:      burst,
+		tokens:     burst,
+		updatedAt:  time.Now(),
+		rng:        mrand.New(mrand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// configure sets up session resumption on the config for a client
+// handshake. The keys are rotated periodically; the previous key is
+// retained so that tickets issued shortly before rotation can still
+// be resumed.
+func (ch *ClientHandshakes) configure(config *tls.Config) {
+	if ch == nil {
+		return
+	}
+	ch.Lock()
+	defer ch.Unlock()
+	if !ch.resumption {
+		config.SessionTicketsDisabled = true
+		return
+	}
+	if now := time.Now(); ch.ticketKeys == nil || now.Sub(ch.rotatedAt) > server.ClientSessionKeyRotation {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			log.Println("Unable to generate session ticket key; session resumption disabled:", err)
+			ch.resumption = false
+			config.SessionTicketsDisabled = true
+			return
+		}
+		keys := [][32]byte{key}
+		if len(ch.ticketKeys) != 0 {
+			keys = append(keys, ch.ticketKeys[0])
+		}
+		ch.ticketKeys = keys
+		ch.rotatedAt = now
+	}
+	config.SetSessionTicketKeys(ch.ticketKeys)
+}
+
+// await blocks until the handshake rate limiter permits another
+// client handshake. Tokens are reserved in advance, so concurrent
+// waiters are admitted in turn.
+func (ch *ClientHandshakes) await() {
+	if ch == nil || ch.rate == 0 {
+		return
+	}
+	ch.Lock()
+	now := time.Now()
+	ch.tokens += now.Sub(ch.updatedAt).Seconds() * ch.rate
+	if ch.tokens > ch.burst {
+		ch.tokens = ch.burst
+	}
+	ch.updatedAt = now
+	ch.tokens--
+	var delay time.Duration
+	if ch.tokens < 0 {
+		delay = time.Duration(-ch.tokens / ch.rate * float64(time.Second))
+		delay += time.Duration(ch.rng.Int63n(int64(delay)/2 + 1))
+		ch.delayed++
+	}
+	ch.Unlock()
+	if delay > 0 {
+		clientHandshakeDelaySeconds.Observe(delay.Seconds())
+		time.Sleep(delay)
+	}
+}
+
+func (ch *ClientHandshakes) observe(start time.Time, state tls.ConnectionState) {
+	if ch == nil {
+		return
+	}
+	clientHandshakeSeconds.WithLabelValues(fmt.Sprint(state.DidResume)).Observe(time.Since(start).Seconds())
+	ch.Lock()
+	ch.handshakes++
+	if state.DidResume {
+		ch.resumed++
+	}
+	ch.Unlock()
+}
+
+func (ch *ClientHandshakes) Status(sc *server.StatusConsumer) {
+	if ch == nil {
+		return
+	}
+	ch.Lock()
+	defer ch.Unlock()
+	limit := "unlimited"
+	if ch.rate != 0 {
+		limit = fmt.Sprintf("%v/s", ch.rate)
+	}
+	sc.Emit(fmt.Sprintf("Client handshakes: %v (%v resumed; %v delayed); session resumption: %v; rate limit: %v",
+		ch.handshakes, ch.resumed, ch.delayed, ch.resumption, limit))
+	sc.Join()
+}
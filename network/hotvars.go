@@ -0,0 +1,148 @@
+package network
+
+import (
+	"fmt"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/db"
+	eng "goshawkdb.io/server/txnengine"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HotVarsWarmer reduces the spike in latency after a restart, when
+// every var has to be read from disk. Whilst running, the VarManagers
+// track the vars they've used most recently, and every
+// HotVarsPersistInterval (and at shutdown) the hottest budget of them
+// are written to the data directory. At start up, the vars last
+// written are read from disk (see txnengine.WarmVars), in the
+// background and in batches, so that the pages holding them are
+// already in the page cache when clients next use them.
+type HotVarsWarmer struct {
+	sync.Mutex
+	connectionManager *ConnectionManager
+	db                *db.Databases
+	path              string
+	budget            int
+	warmed            int
+	persisted         int
+	persistedAt       time.Time
+	terminate         chan struct{}
+	terminated        chan struct{}
+}
+
+func NewHotVarsWarmer(cm *ConnectionManager, db *db.Databases, dataDir string, budget int) *HotVarsWarmer {
+	hvw := &HotVarsWarmer{
+		connectionManager: cm,
+		db:                db,
+		path:              filepath.Join(dataDir, db.HotVarsFileName),
+		budget:            budget,
+		terminate:         make(chan struct{}),
+		terminated:        make(chan struct{}),
+	}
+	cm.Dispatchers.VarDispatcher.TrackHotVars(budget)
+	go hvw.run()
+	return hvw
+}
+
+func (hvw *HotVarsWarmer) Shutdown() {
+	close(hvw.terminate)
+	<-hvw.terminated
+}
+
+func (hvw *HotVarsWarmer) Status(sc *server.StatusConsumer) {
+	hvw.Lock()
+	defer hvw.Unlock()
+	if hvw.budget == 0 {
+		sc.Emit("Hot vars warmer: disabled")
+	} else {
+		sc.Emit(fmt.Sprintf("Hot vars warmer: budget %v vars; %v warmed at start up; %v persisted at %v",
+			hvw.budget, hvw.warmed, hvw.persisted, hvw.persistedAt))
+	}
+	sc.Join()
+}
+
+func (hvw *HotVarsWarmer) run() {
+	defer close(hvw.terminated)
+	if hvw.budget == 0 {
+		os.Remove(hvw.path)
+		<-hvw.terminate
+		return
+	}
+	hvw.warm()
+	ticker := time.NewTicker(server.HotVarsPersistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hvw.terminate:
+			hvw.persist()
+			return
+		case <-ticker.C:
+			hvw.persist()
+		}
+	}
+}
+
+func (hvw *HotVarsWarmer) warm() {
+	bites, err := ioutil.ReadFile(hvw.path)
+	if os.IsNotExist(err) {
+		return
+	} else if server.CheckWarn(err) {
+		return
+	}
+	vUUIds := make([]*common.VarUUId, 0, len(bites)/common.KeyLen)
+	for len(bites) >= common.KeyLen && len(vUUIds) < hvw.budget {
+		vUUIds = append(vUUIds, common.MakeVarUUId(bites[:common.KeyLen]))
+		bites = bites[common.KeyLen:]
+	}
+	start := time.Now()
+	warmed := 0
+	for len(vUUIds) != 0 {
+		select {
+		case <-hvw.terminate:
+			return
+		default:
+		}
+		batch := vUUIds
+		if len(batch) > server.HotVarsWarmBatch {
+			batch = batch[:server.HotVarsWarmBatch]
+		}
+		vUUIds = vUUIds[len(batch):]
+		found, err := eng.WarmVars(hvw.db, batch)
+		if server.CheckWarn(err) {
+			return
+		}
+		warmed += found
+		hvw.Lock()
+		hvw.warmed = warmed
+		hvw.Unlock()
+	}
+	log.Printf("Warmed %v hot vars from disk in %v.\n", warmed, time.Since(start))
+}
+
+// persist writes the hottest vars, replacing the file atomically so
+// that a crash part way through leaves the previous list intact. If
+// no vars have been used (or the VarManagers have already shut down),
+// the previous list is kept.
+func (hvw *HotVarsWarmer) persist() {
+	vUUIds := hvw.connectionManager.Dispatchers.VarDispatcher.HotVars(hvw.budget)
+	if len(vUUIds) == 0 {
+		return
+	}
+	bites := make([]byte, 0, len(vUUIds)*common.KeyLen)
+	for _, vUUId := range vUUIds {
+		bites = append(bites, vUUId[:]...)
+	}
+	tmp := hvw.path + ".tmp"
+	if server.CheckWarn(ioutil.WriteFile(tmp, bites, 0600)) || server.CheckWarn(os.Rename(tmp, hvw.path)) {
+		return
+	}
+	hvw.Lock()
+	hvw.persisted = len(vUUIds)
+	hvw.persistedAt = time.Now()
+	hvw.Unlock()
+}
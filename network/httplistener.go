@@ -0,0 +1,107 @@
+package network
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"goshawkdb.io/common"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// HTTPListener serves HTTPS on a port distinct from the main
+// client/server listener. Clients must present a certificate, and
+// handlers can use Authenticate to map it onto the roots granted by
+// the current topology.
+type HTTPListener struct {
+	connectionManager *ConnectionManager
+	listener          net.Listener
+	mux               *http.ServeMux
+	server            *http.Server
+	shutdown          int32
+	terminated        chan struct{}
+}
+
+func NewHTTPListener(listenPort uint16, cm *ConnectionManager) (*HTTPListener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%v", listenPort))
+	if err != nil {
+		return nil, err
+	}
+	l := &HTTPListener{
+		connectionManager: cm,
+		mux:               http.NewServeMux(),
+		terminated:        make(chan struct{}),
+	}
+	l.server = &http.Server{
+		Handler:   l.mux,
+		TLSConfig: l.tlsConfig(),
+	}
+	l.listener = tls.NewListener(ln, l.server.TLSConfig)
+	l.mux.Handle("/metrics", promhttp.Handler())
+	go l.serve()
+	return l, nil
+}
+
+func (l *HTTPListener) tlsConfig() *tls.Config {
+	nodeCertPrivKeyPair := l.connectionManager.NodeCertificatePrivateKeyPair
+	roots := x509.NewCertPool()
+	roots.AddCert(nodeCertPrivKeyPair.CertificateRoot)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{
+			tls.Certificate{
+				Certificate: [][]byte{nodeCertPrivKeyPair.Certificate},
+				PrivateKey:  nodeCertPrivKeyPair.PrivateKey,
+			},
+		},
+		CipherSuites:             []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+		ClientAuth:               tls.RequireAnyClientCert,
+		ClientCAs:                roots,
+	}
+}
+
+func (l *HTTPListener) serve() {
+	defer close(l.terminated)
+	if err := l.server.Serve(l.listener); err != nil && atomic.LoadInt32(&l.shutdown) == 0 {
+		log.Println("HTTP listen error:", err)
+	}
+}
+
+func (l *HTTPListener) Handle(pattern string, handler http.Handler) {
+	l.mux.Handle(pattern, handler)
+}
+
+func (l *HTTPListener) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	l.mux.HandleFunc(pattern, handler)
+}
+
+// Authenticate finds the roots (and capabilities on those roots)
+// granted to the client certificate presented with the request, and
+// the fingerprint of that certificate. The fingerprints are looked up
+// in the supplied topology, so revoking a fingerprint takes effect as
+// soon as the topology changes.
+func (l *HTTPListener) Authenticate(req *http.Request, fingerprints map[[sha256.Size]byte]map[string]*common.Capability) (bool, [sha256.Size]byte, map[string]*common.Capability) {
+	hashsum := [sha256.Size]byte{}
+	if req.TLS == nil || fingerprints == nil {
+		return false, hashsum, nil
+	}
+	for _, cert := range req.TLS.PeerCertificates {
+		hashsum = sha256.Sum256(cert.Raw)
+		if roots, found := fingerprints[hashsum]; found {
+			return true, hashsum, roots
+		}
+	}
+	return false, hashsum, nil
+}
+
+func (l *HTTPListener) Shutdown() {
+	atomic.StoreInt32(&l.shutdown, 1)
+	l.listener.Close()
+	<-l.terminated
+}
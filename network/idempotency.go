@@ -0,0 +1,204 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	mdb "github.com/msackman/gomdb"
+	mdbs "github.com/msackman/gomdb/server"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/db"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func init() {
+	db.DB.IdempotencyKeys = &mdbs.DBISettings{Flags: mdb.CREATE}
+}
+
+// idempotencyStore durably records the outcomes of requests which
+// carried an idempotency key, so that a client which resubmits after
+// a connection failure gets the original outcome rather than running
+// the txn a second time. Keys are scoped by client fingerprint. Each
+// fingerprint has a bounded history, and entries expire after a TTL.
+type idempotencyStore struct {
+	sync.Mutex
+	db      *db.Databases
+	history map[[sha256.Size]byte][]*idempotencyEntry // oldest first
+	pending map[string]server.EmptyStruct
+}
+
+type idempotencyEntry struct {
+	key     string
+	expires time.Time
+}
+
+// idempotentOutcome is what we store against each key. We don't keep
+// the full response (which could contain large values), just enough
+// to tell the client what happened, and a digest of the original
+// response so that the client can match it up if it needs to.
+type idempotentOutcome struct {
+	Expires   int64
+	Status    int
+	Committed bool
+	Digest    []byte
+}
+
+func newIdempotencyStore(db *db.Databases) (*idempotencyStore, error) {
+	is := &idempotencyStore{
+		db:      db,
+		history: make(map[[sha256.Size]byte][]*idempotencyEntry),
+		pending: make(map[string]server.EmptyStruct),
+	}
+	return is, is.load()
+}
+
+func idempotencyDBKey(fingerprint [sha256.Size]byte, key string) []byte {
+	return append(fingerprint[:], key...)
+}
+
+func (is *idempotencyStore) load() error {
+	now := time.Now()
+	res, err := is.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+		res, _ := rtxn.WithCursor(is.db.IdempotencyKeys, func(cursor *mdbs.Cursor) interface{} {
+			history := make(map[[sha256.Size]byte][]*idempotencyEntry)
+			dbKey, value, err := cursor.Get(nil, nil, mdb.FIRST)
+			for ; err == nil; dbKey, value, err = cursor.Get(nil, nil, mdb.NEXT) {
+				outcome := &idempotentOutcome{}
+				if err := json.Unmarshal(value, outcome); err != nil {
+					cursor.Error(err)
+					return nil
+				}
+				expires := time.Unix(0, outcome.Expires)
+				if expires.Before(now) || len(dbKey) < sha256.Size {
+					continue
+				}
+				fingerprint := [sha256.Size]byte{}
+				copy(fingerprint[:], dbKey)
+				history[fingerprint] = append(history[fingerprint], &idempotencyEntry{
+					key:     string(dbKey[sha256.Size:]),
+					expires: expires,
+				})
+			}
+			if err == mdb.NotFound {
+				return history
+			} else {
+				cursor.Error(err)
+				return nil
+			}
+		})
+		return res
+	}).ResultError()
+	if err != nil {
+		return err
+	}
+	if history, ok := res.(map[[sha256.Size]byte][]*idempotencyEntry); ok {
+		for fingerprint, entries := range history {
+			sortIdempotencyEntries(entries)
+			is.history[fingerprint] = entries
+		}
+	}
+	return nil
+}
+
+func sortIdempotencyEntries(entries []*idempotencyEntry) {
+	// insertion sort: histories are small and mostly sorted already
+	for idx := 1; idx < len(entries); idx++ {
+		for idy := idx; idy > 0 && entries[idy].expires.Before(entries[idy-1].expires); idy-- {
+			entries[idy], entries[idy-1] = entries[idy-1], entries[idy]
+		}
+	}
+}
+
+// begin looks up the key. If an unexpired outcome is found, it is
+// returned. Otherwise the key is marked as pending and the caller
+// must call either finish or abandon once the request is done.
+func (is *idempotencyStore) begin(fingerprint [sha256.Size]byte, key string) (*idempotentOutcome, error) {
+	dbKey := idempotencyDBKey(fingerprint, key)
+	is.Lock()
+	if _, found := is.pending[string(dbKey)]; found {
+		is.Unlock()
+		return nil, newRESTError(http.StatusConflict, "Request with idempotency key %q already in progress", key)
+	}
+	is.pending[string(dbKey)] = server.EmptyStructVal
+	is.Unlock()
+
+	res, err := is.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+		value, err := rtxn.Get(is.db.IdempotencyKeys, dbKey)
+		if err == mdb.NotFound {
+			return nil
+		} else if err != nil {
+			rtxn.Error(err)
+			return nil
+		}
+		outcome := &idempotentOutcome{}
+		if err = json.Unmarshal(value, outcome); err != nil {
+			rtxn.Error(err)
+			return nil
+		}
+		return outcome
+	}).ResultError()
+	if err != nil {
+		is.abandon(fingerprint, key)
+		return nil, err
+	}
+	if outcome, ok := res.(*idempotentOutcome); ok && time.Now().Before(time.Unix(0, outcome.Expires)) {
+		is.abandon(fingerprint, key)
+		return outcome, nil
+	}
+	return nil, nil
+}
+
+func (is *idempotencyStore) abandon(fingerprint [sha256.Size]byte, key string) {
+	is.Lock()
+	delete(is.pending, string(idempotencyDBKey(fingerprint, key)))
+	is.Unlock()
+}
+
+// finish durably records the outcome against the key, and evicts
+// expired entries and any entries beyond the per-fingerprint bound.
+func (is *idempotencyStore) finish(fingerprint [sha256.Size]byte, key string, status int, committed bool, response []byte) error {
+	defer is.abandon(fingerprint, key)
+	now := time.Now()
+	expires := now.Add(server.IdempotencyKeyTTL)
+	digest := sha256.Sum256(response)
+	value, err := json.Marshal(&idempotentOutcome{
+		Expires:   expires.UnixNano(),
+		Status:    status,
+		Committed: committed,
+		Digest:    digest[:],
+	})
+	if err != nil {
+		return err
+	}
+
+	is.Lock()
+	entries := []*idempotencyEntry{}
+	for _, entry := range is.history[fingerprint] {
+		if entry.key != key { // we're about to replace it
+			entries = append(entries, entry)
+		}
+	}
+	evict := []*idempotencyEntry{}
+	for len(entries) != 0 && (entries[0].expires.Before(now) || len(entries) >= server.IdempotencyKeysPerFingerprint) {
+		evict = append(evict, entries[0])
+		entries = entries[1:]
+	}
+	is.history[fingerprint] = append(entries, &idempotencyEntry{key: key, expires: expires})
+	is.Unlock()
+
+	_, err = is.db.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
+		for _, entry := range evict {
+			if err := rwtxn.Del(is.db.IdempotencyKeys, idempotencyDBKey(fingerprint, entry.key), nil); err != nil && err != mdb.NotFound {
+				rwtxn.Error(err)
+				return nil
+			}
+		}
+		if err := rwtxn.Put(is.db.IdempotencyKeys, idempotencyDBKey(fingerprint, key), value, 0); err != nil {
+			rwtxn.Error(err)
+			return nil
+		}
+		return true
+	}).ResultError()
+	return err
+}
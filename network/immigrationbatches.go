@@ -0,0 +1,208 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	mdb "github.com/msackman/gomdb"
+	mdbs "github.com/msackman/gomdb/server"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/db"
+	"log"
+	"time"
+)
+
+func init() {
+	db.DB.ImmigrationBatches = &mdbs.DBISettings{Flags: mdb.CREATE}
+}
+
+type immigrationBatchId [sha256.Size]byte
+
+func (id immigrationBatchId) String() string {
+	return hex.EncodeToString(id[:8])
+}
+
+// immigrationBatchIdOf identifies a migration batch by its
+// content. Migrations carry no id of their own, but an emigrator
+// which resends a batch (for example, after a restart of either end)
+// resends the same txns for the same vars.
+func immigrationBatchIdOf(migration *msgs.Migration) immigrationBatchId {
+	h := sha256.New()
+	elems := migration.Elems()
+	for idx, l := 0, elems.Len(); idx < l; idx++ {
+		elem := elems.At(idx)
+		txn := elem.Txn()
+		lenBites := make([]byte, 4)
+		binary.BigEndian.PutUint32(lenBites, uint32(len(txn)))
+		h.Write(lenBites)
+		h.Write(txn)
+		vars := elem.Vars()
+		for idy, m := 0, vars.Len(); idy < m; idy++ {
+			h.Write(vars.At(idy).Id())
+		}
+	}
+	id := immigrationBatchId{}
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// immigrationBatches durably records which migration batches have
+// been applied (i.e. all their txns have become locally complete, and
+// so gone to disk), keyed by topology version and sender, so that a
+// batch which is resent is not applied a second time, even across
+// restarts. Batches currently being applied are tracked in memory
+// only: if we crash part way through a batch, it must be applied
+// again in full. It is only used from within the
+// TopologyTransmogrifier's actor.
+type immigrationBatches struct {
+	db       *db.Databases
+	applied  map[uint32]map[common.RMId]map[immigrationBatchId]server.EmptyStruct
+	inflight map[uint32]map[common.RMId]map[immigrationBatchId]server.EmptyStruct
+}
+
+func newImmigrationBatches(db *db.Databases) *immigrationBatches {
+	ib := &immigrationBatches{
+		db:       db,
+		applied:  make(map[uint32]map[common.RMId]map[immigrationBatchId]server.EmptyStruct),
+		inflight: make(map[uint32]map[common.RMId]map[immigrationBatchId]server.EmptyStruct),
+	}
+	if err := ib.load(); err != nil {
+		log.Println("Unable to load applied immigration batches:", err)
+	}
+	return ib
+}
+
+func immigrationBatchDBKey(version uint32, sender common.RMId, id immigrationBatchId) []byte {
+	key := make([]byte, 8+len(id))
+	binary.BigEndian.PutUint32(key[0:4], version)
+	binary.BigEndian.PutUint32(key[4:8], uint32(sender))
+	copy(key[8:], id[:])
+	return key
+}
+
+func (ib *immigrationBatches) load() error {
+	res, err := ib.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+		res, _ := rtxn.WithCursor(ib.db.ImmigrationBatches, func(cursor *mdbs.Cursor) interface{} {
+			keys := [][]byte{}
+			key, _, err := cursor.Get(nil, nil, mdb.FIRST)
+			for ; err == nil; key, _, err = cursor.Get(nil, nil, mdb.NEXT) {
+				keys = append(keys, append([]byte{}, key...))
+			}
+			if err != nil && err != mdb.NotFound {
+				cursor.Error(err)
+				return nil
+			}
+			return keys
+		})
+		return res
+	}).ResultError()
+	if err != nil {
+		return err
+	}
+	keys, _ := res.([][]byte)
+	for _, key := range keys {
+		if len(key) != 8+sha256.Size {
+			continue
+		}
+		id := immigrationBatchId{}
+		copy(id[:], key[8:])
+		immigrationBatchesAdd(ib.applied, binary.BigEndian.Uint32(key[0:4]), common.RMId(binary.BigEndian.Uint32(key[4:8])), id)
+	}
+	return nil
+}
+
+func immigrationBatchesAdd(batches map[uint32]map[common.RMId]map[immigrationBatchId]server.EmptyStruct, version uint32, sender common.RMId, id immigrationBatchId) {
+	senders, found := batches[version]
+	if !found {
+		senders = make(map[common.RMId]map[immigrationBatchId]server.EmptyStruct)
+		batches[version] = senders
+	}
+	ids, found := senders[sender]
+	if !found {
+		ids = make(map[immigrationBatchId]server.EmptyStruct)
+		senders[sender] = ids
+	}
+	ids[id] = server.EmptyStructVal
+}
+
+func immigrationBatchesContains(batches map[uint32]map[common.RMId]map[immigrationBatchId]server.EmptyStruct, version uint32, sender common.RMId, id immigrationBatchId) bool {
+	_, found := batches[version][sender][id]
+	return found
+}
+
+// started returns false if the batch has already been applied, or is
+// currently being applied, in which case it should be ignored.
+func (ib *immigrationBatches) started(version uint32, sender common.RMId, id immigrationBatchId) bool {
+	if immigrationBatchesContains(ib.applied, version, sender, id) ||
+		immigrationBatchesContains(ib.inflight, version, sender, id) {
+		return false
+	}
+	immigrationBatchesAdd(ib.inflight, version, sender, id)
+	return true
+}
+
+// finished records that all the txns of the batch are locally
+// complete.
+func (ib *immigrationBatches) finished(version uint32, sender common.RMId, id immigrationBatchId) {
+	if ids, found := ib.inflight[version][sender]; found {
+		delete(ids, id)
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(time.Now().Unix()))
+	_, err := ib.db.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
+		if err := rwtxn.Put(ib.db.ImmigrationBatches, immigrationBatchDBKey(version, sender, id), value, 0); err != nil {
+			rwtxn.Error(err)
+		}
+		return nil
+	}).ResultError()
+	if err != nil {
+		log.Printf("Topology: Unable to record immigration batch %v from %v (v%v): %v", id, sender, version, err)
+		return
+	}
+	immigrationBatchesAdd(ib.applied, version, sender, id)
+}
+
+// forget drops all batches for topology versions up to and including
+// version: those topology changes are complete, so any migrations
+// for them are ignored anyway.
+func (ib *immigrationBatches) forget(version uint32) {
+	keys := [][]byte{}
+	for v, senders := range ib.applied {
+		if v > version {
+			continue
+		}
+		for sender, ids := range senders {
+			for id := range ids {
+				keys = append(keys, immigrationBatchDBKey(v, sender, id))
+			}
+		}
+	}
+	for v := range ib.inflight {
+		if v <= version {
+			delete(ib.inflight, v)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	_, err := ib.db.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
+		for _, key := range keys {
+			if err := rwtxn.Del(ib.db.ImmigrationBatches, key, nil); err != nil && err != mdb.NotFound {
+				rwtxn.Error(err)
+				return nil
+			}
+		}
+		return nil
+	}).ResultError()
+	if err != nil {
+		log.Println("Topology: Unable to forget applied immigration batches:", err)
+		return
+	}
+	for v := range ib.applied {
+		if v <= version {
+			delete(ib.applied, v)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	mdb "github.com/msackman/gomdb"
+	mdbs "github.com/msackman/gomdb/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/db"
+	"log"
+)
+
+var immigrationSpilled = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "goshawkdb",
+	Name:      "immigration_spilled_batches_total",
+	Help:      "Number of received migration batches staged on disk because the immigration memory budget was exhausted.",
+})
+
+func init() {
+	db.DB.ImmigrationStaging = &mdbs.DBISettings{Flags: mdb.CREATE}
+	prometheus.MustRegister(immigrationSpilled)
+}
+
+// immigrationStaging bounds the memory used by received migration
+// batches. A batch is held in memory from when it is applied until
+// all its txns are locally complete. Whilst the batches being applied
+// exceed the budget, further batches are staged on disk, in arrival
+// order, and are applied as earlier batches complete. At least one
+// batch is always applied, however large. Staged batches have not
+// been applied, so are not recorded as such by immigrationBatches: if
+// we restart, the emigrators resend them, and so any left on disk are
+// discarded at start up. It is only used from within the
+// TopologyTransmogrifier's actor.
+type immigrationStaging struct {
+	db       *db.Databases
+	budget   int
+	inMemory int
+	seq      uint64
+	staged   []*stagedImmigration
+	spilled  uint64
+}
+
+type stagedImmigration struct {
+	key     []byte
+	version uint32
+	lsc     *migrationTxnLocalStateChange
+}
+
+func newImmigrationStaging(db *db.Databases) *immigrationStaging {
+	is := &immigrationStaging{
+		db:     db,
+		budget: server.ImmigrationMemoryBudget,
+	}
+	if err := is.discard(^uint32(0)); err != nil {
+		log.Println("Unable to discard staged immigration batches:", err)
+	}
+	return is
+}
+
+func immigrationStagingDBKey(version uint32, seq uint64) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint32(key[0:4], version)
+	binary.BigEndian.PutUint64(key[4:12], seq)
+	return key
+}
+
+// add returns true if the batch should be applied now. Otherwise it
+// has been staged on disk, and will be returned by released when
+// there's room for it.
+func (is *immigrationStaging) add(migration *msgs.Migration, lsc *migrationTxnLocalStateChange) bool {
+	seg := capn.Struct(*migration).Segment
+	lsc.size = len(seg.Data)
+	if is.budget == 0 || is.inMemory == 0 || (len(is.staged) == 0 && is.inMemory+lsc.size <= is.budget) {
+		is.inMemory += lsc.size
+		return true
+	}
+	is.seq++
+	key := immigrationStagingDBKey(migration.Version(), is.seq)
+	value := server.SegToBytes(seg)
+	_, err := is.db.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
+		if err := rwtxn.Put(is.db.ImmigrationStaging, key, value, 0); err != nil {
+			rwtxn.Error(err)
+		}
+		return nil
+	}).ResultError()
+	if err != nil {
+		// Better to risk the memory than to lose the batch.
+		log.Println("Topology: Unable to stage immigration batch on disk:", err)
+		is.inMemory += lsc.size
+		return true
+	}
+	is.staged = append(is.staged, &stagedImmigration{key: key, version: migration.Version(), lsc: lsc})
+	is.spilled++
+	immigrationSpilled.Inc()
+	return false
+}
+
+// released records that a batch of size bytes is locally complete,
+// and calls apply with each staged batch for which there is now
+// room. apply returns false if the batch is no longer wanted.
+func (is *immigrationStaging) released(size int, apply func(*msgs.Migration, *migrationTxnLocalStateChange) bool) {
+	is.inMemory -= size
+	for len(is.staged) != 0 {
+		staged := is.staged[0]
+		if is.budget != 0 && is.inMemory != 0 && is.inMemory+staged.lsc.size > is.budget {
+			return
+		}
+		is.staged = is.staged[1:]
+		migration, err := is.load(staged.key)
+		if err != nil {
+			log.Println("Topology: Unable to load staged immigration batch:", err)
+			continue
+		}
+		if apply(migration, staged.lsc) {
+			is.inMemory += staged.lsc.size
+		}
+	}
+}
+
+func (is *immigrationStaging) load(key []byte) (*msgs.Migration, error) {
+	res, err := is.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+		value, err := rtxn.Get(is.db.ImmigrationStaging, key)
+		if err != nil {
+			rtxn.Error(err)
+			return nil
+		}
+		return append([]byte{}, value...)
+	}).ResultError()
+	if err != nil {
+		return nil, err
+	}
+	_, err = is.db.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
+		if err := rwtxn.Del(is.db.ImmigrationStaging, key, nil); err != nil && err != mdb.NotFound {
+			rwtxn.Error(err)
+		}
+		return nil
+	}).ResultError()
+	if err != nil {
+		return nil, err
+	}
+	seg, _, err := capn.ReadFromMemoryZeroCopy(res.([]byte))
+	if err != nil {
+		return nil, err
+	}
+	migration := msgs.ReadRootMessage(seg).Migration()
+	return &migration, nil
+}
+
+// discard drops all staged batches for topology versions up to and
+// including version: those topology changes are complete, so the
+// batches would be ignored anyway.
+func (is *immigrationStaging) discard(version uint32) error {
+	staged := is.staged[:0]
+	for _, s := range is.staged {
+		if s.version > version {
+			staged = append(staged, s)
+		}
+	}
+	is.staged = staged
+
+	res, err := is.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+		res, _ := rtxn.WithCursor(is.db.ImmigrationStaging, func(cursor *mdbs.Cursor) interface{} {
+			keys := [][]byte{}
+			key, _, err := cursor.Get(nil, nil, mdb.FIRST)
+			for ; err == nil && binary.BigEndian.Uint32(key[0:4]) <= version; key, _, err = cursor.Get(nil, nil, mdb.NEXT) {
+				keys = append(keys, append([]byte{}, key...))
+			}
+			if err != nil && err != mdb.NotFound {
+				cursor.Error(err)
+				return nil
+			}
+			return keys
+		})
+		return res
+	}).ResultError()
+	if err != nil {
+		return err
+	}
+	keys, _ := res.([][]byte)
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err = is.db.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
+		for _, key := range keys {
+			if err := rwtxn.Del(is.db.ImmigrationStaging, key, nil); err != nil && err != mdb.NotFound {
+				rwtxn.Error(err)
+				return nil
+			}
+		}
+		return nil
+	}).ResultError()
+	return err
+}
+
+func (is *immigrationStaging) String() string {
+	if is.budget == 0 {
+		return fmt.Sprintf("Immigration buffer: unbounded; %v bytes in memory", is.inMemory)
+	}
+	return fmt.Sprintf("Immigration buffer: %v of %v bytes in memory; %v batches staged on disk; %v staged in total",
+		is.inMemory, is.budget, len(is.staged), is.spilled)
+}
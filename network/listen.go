@@ -1,8 +1,10 @@
 package network
 
 import (
+	"crypto/tls"
 	"fmt"
 	cc "github.com/msackman/chancell"
+	"goshawkdb.io/server/configuration"
 	"log"
 	"net"
 )
@@ -13,6 +15,14 @@ type Listener struct {
 	queryChan         <-chan listenerMsg
 	connectionManager *ConnectionManager
 	listener          *net.TCPListener
+	clientOnly        *clientOnlyListener
+}
+
+// Settings for a listener that only accepts clients. The main
+// listener (with nil clientOnly) accepts both servers and clients.
+type clientOnlyListener struct {
+	*configuration.ListenerConfiguration
+	certificates []tls.Certificate
 }
 
 type listenerMsg interface {
@@ -48,6 +58,29 @@ func (l *Listener) enqueueQuery(msg listenerMsg) bool {
 }
 
 func NewListener(listenPort uint16, cm *ConnectionManager) (*Listener, error) {
+	return newListener(listenPort, cm, nil)
+}
+
+// NewClientListener creates an additional listener which only accepts
+// client connections, using the certificates and fingerprint
+// restrictions of the supplied configuration. Connections from all
+// listeners share the same ConnectionManager.
+func NewClientListener(config *configuration.ListenerConfiguration, cm *ConnectionManager) (*Listener, error) {
+	clientOnly := &clientOnlyListener{
+		ListenerConfiguration: config,
+		certificates:          make([]tls.Certificate, len(config.Certificates)),
+	}
+	for idx, cert := range config.Certificates {
+		keyPair, err := tls.LoadX509KeyPair(cert.CertificateFile, cert.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		clientOnly.certificates[idx] = keyPair
+	}
+	return newListener(config.Port, cm, clientOnly)
+}
+
+func newListener(listenPort uint16, cm *ConnectionManager, clientOnly *clientOnlyListener) (*Listener, error) {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%v", listenPort))
 	if err != nil {
 		return nil, err
@@ -59,6 +92,7 @@ func NewListener(listenPort uint16, cm *ConnectionManager) (*Listener, error) {
 	l := &Listener{
 		connectionManager: cm,
 		listener:          ln,
+		clientOnly:        clientOnly,
 	}
 	var head *cc.ChanCellHead
 	head, l.cellTail = cc.NewChanCellTail(
@@ -97,7 +131,6 @@ func (l *Listener) acceptLoop() {
 }
 
 func (l *Listener) actorLoop(head *cc.ChanCellHead) {
-	connectionCount := uint32(0)
 	var (
 		err       error
 		queryChan <-chan listenerMsg
@@ -114,8 +147,14 @@ func (l *Listener) actorLoop(head *cc.ChanCellHead) {
 			case listenerAcceptError:
 				err = msgT
 			case *listenerConnMsg:
-				connectionCount++
-				NewConnectionFromTCPConn((*net.TCPConn)(msgT), l.connectionManager, connectionCount)
+				if l.clientOnly != nil && l.connectionManager.ConnectionLimits.full() {
+					// No point in even starting the handshake.
+					log.Printf("%v: Client connection from %v rejected: too many client connections or handshakes",
+						l.clientOnly, (*net.TCPConn)(msgT).RemoteAddr())
+					(*net.TCPConn)(msgT).Close()
+				} else {
+					NewConnectionFromTCPConn((*net.TCPConn)(msgT), l.connectionManager, l.connectionManager.nextConnectionNumber(), l.clientOnly)
+				}
 			}
 			terminate = terminate || err != nil
 		} else {
@@ -125,6 +164,8 @@ func (l *Listener) actorLoop(head *cc.ChanCellHead) {
 	if err != nil {
 		log.Println("Listen error:", err)
 	}
-	l.cellTail.Terminate()
+	// Close first, so that once Shutdown returns, the port can be
+	// listened on again.
 	l.listener.Close()
+	l.cellTail.Terminate()
 }
@@ -0,0 +1,141 @@
+package network
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/server"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var (
+	memoryPressureRounds = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "memory_pressure_rounds_total",
+		Help:      "Number of rounds of eviction run because the heap exceeded the memory budget.",
+	})
+	memoryPressureRolls = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "memory_pressure_rolls_total",
+		Help:      "Number of read-only var frames rolled early, so their vars can be evicted, because of memory pressure.",
+	})
+	memoryPressureReclaimed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "memory_pressure_reclaimed_bytes_total",
+		Help:      "Estimated bytes reclaimed because of memory pressure, by source: client_cache for values trimmed from client caches, and heap for the fall in heap in use across each round.",
+	}, []string{"source"})
+)
+
+func init() {
+	prometheus.MustRegister(memoryPressureRounds)
+	prometheus.MustRegister(memoryPressureRolls)
+	prometheus.MustRegister(memoryPressureReclaimed)
+}
+
+// MemoryPressureMonitor keeps the heap within a budget, so that we
+// shed what we can before the OS OOM killer shoots us. Every
+// MemoryPressureCheckInterval it checks the heap in use, and if that
+// exceeds the budget, it runs a round of eviction: read-only var
+// frames are rolled now rather than when their vars go quiet, so
+// that those vars become idle and are evicted, and every client
+// connection trims the values it caches for its client. Then the
+// freed memory is returned to the OS. Rolls complete asynchronously,
+// so their effect mostly shows in later rounds.
+type MemoryPressureMonitor struct {
+	sync.Mutex
+	connectionManager *ConnectionManager
+	budget            uint64
+	heapInUse         uint64
+	rounds            uint64
+	lastRound         time.Time
+	terminate         chan struct{}
+	terminated        chan struct{}
+}
+
+func NewMemoryPressureMonitor(cm *ConnectionManager, budget uint64) *MemoryPressureMonitor {
+	mpm := &MemoryPressureMonitor{
+		connectionManager: cm,
+		budget:            budget,
+		terminate:         make(chan struct{}),
+		terminated:        make(chan struct{}),
+	}
+	go mpm.run()
+	return mpm
+}
+
+func (mpm *MemoryPressureMonitor) Shutdown() {
+	close(mpm.terminate)
+	<-mpm.terminated
+}
+
+func (mpm *MemoryPressureMonitor) Status(sc *server.StatusConsumer) {
+	mpm.Lock()
+	defer mpm.Unlock()
+	if mpm.budget == 0 {
+		sc.Emit("Memory pressure monitor: disabled")
+	} else {
+		sc.Emit(fmt.Sprintf("Memory pressure monitor: budget %v bytes; heap in use %v bytes; %v rounds; last round %v",
+			mpm.budget, mpm.heapInUse, mpm.rounds, mpm.lastRound))
+	}
+	sc.Join()
+}
+
+func (mpm *MemoryPressureMonitor) run() {
+	defer close(mpm.terminated)
+	if mpm.budget == 0 {
+		<-mpm.terminate
+		return
+	}
+	ticker := time.NewTicker(server.MemoryPressureCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mpm.terminate:
+			return
+		case <-ticker.C:
+		}
+		mpm.check()
+	}
+}
+
+func (mpm *MemoryPressureMonitor) check() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	before := stats.HeapInuse
+	mpm.Lock()
+	mpm.heapInUse = before
+	mpm.Unlock()
+	if before <= mpm.budget {
+		return
+	}
+
+	cm := mpm.connectionManager
+	rolls := cm.Dispatchers.VarDispatcher.RelieveMemoryPressure(server.MemoryPressureRollsPerManager)
+	memoryPressureRolls.Add(float64(rolls))
+	cm.RLock()
+	for _, conn := range cm.connCountToClient {
+		if c, ok := conn.(*Connection); ok {
+			c.TrimCache()
+		}
+	}
+	cm.RUnlock()
+	debug.FreeOSMemory()
+
+	runtime.ReadMemStats(&stats)
+	after := stats.HeapInuse
+	if after < before {
+		memoryPressureReclaimed.WithLabelValues("heap").Add(float64(before - after))
+	}
+	memoryPressureRounds.Inc()
+	log.Printf("Memory pressure: heap in use %v bytes exceeds budget of %v bytes; rolled %v frames early; heap in use now %v bytes.\n",
+		before, mpm.budget, rolls, after)
+
+	mpm.Lock()
+	mpm.heapInUse = after
+	mpm.rounds++
+	mpm.lastRound = time.Now()
+	mpm.Unlock()
+}
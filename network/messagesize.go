@@ -0,0 +1,89 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"sync"
+)
+
+var (
+	largestMessage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "largest_message_bytes",
+		Help:      "Size of the largest message received, by connection type.",
+	}, []string{"type"})
+	oversizedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "oversized_messages_total",
+		Help:      "Number of messages refused for exceeding the maximum message size, by connection type.",
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(largestMessage)
+	prometheus.MustRegister(oversizedMessages)
+}
+
+var largestMessages struct {
+	sync.Mutex
+	sizes map[string]int
+}
+
+func observeMessageSize(connType string, size int) {
+	largestMessages.Lock()
+	defer largestMessages.Unlock()
+	if largestMessages.sizes == nil {
+		largestMessages.sizes = make(map[string]int)
+	}
+	if size > largestMessages.sizes[connType] {
+		largestMessages.sizes[connType] = size
+		largestMessage.WithLabelValues(connType).Set(float64(size))
+	}
+}
+
+// messageMaxSegments bounds the segment table, which is read before
+// the message size is known.
+const messageMaxSegments = 512
+
+// readMessage reads a single capnp message from r, in the standard
+// stream framing. capn.ReadFromStream allocates whatever the framing
+// claims, so instead the segment table is read first and the message
+// refused, before anything else is read or allocated, if it would
+// exceed maxSize bytes.
+func readMessage(r io.Reader, maxSize int, connType string) (*capn.Segment, error) {
+	var first [4]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return nil, err
+	}
+	segCount := int(binary.LittleEndian.Uint32(first[:])) + 1
+	if segCount > messageMaxSegments {
+		oversizedMessages.WithLabelValues(connType).Inc()
+		return nil, fmt.Errorf("Message of %v segments exceeds maximum of %v", segCount, messageMaxSegments)
+	}
+	// The segment table is padded to a whole number of words.
+	tableLen := (4 + 4*segCount + 7) &^ 7
+	table := make([]byte, tableLen)
+	copy(table, first[:])
+	if _, err := io.ReadFull(r, table[4:]); err != nil {
+		return nil, err
+	}
+	size := tableLen
+	for idx := 0; idx < segCount; idx++ {
+		size += 8 * int(binary.LittleEndian.Uint32(table[4+4*idx:]))
+		if size > maxSize {
+			oversizedMessages.WithLabelValues(connType).Inc()
+			return nil, fmt.Errorf("Message exceeds maximum size of %v bytes", maxSize)
+		}
+	}
+	observeMessageSize(connType, size)
+	data := make([]byte, size)
+	copy(data, table)
+	if _, err := io.ReadFull(r, data[tableLen:]); err != nil {
+		return nil, err
+	}
+	seg, _, err := capn.ReadFromMemoryZeroCopy(data)
+	return seg, err
+}
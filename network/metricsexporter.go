@@ -0,0 +1,316 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsExporter periodically pushes the metrics of the default
+// prometheus registry (the same metrics served on /metrics) to an
+// endpoint, for monitoring which is unable to scrape nodes. The
+// endpoint is either statsd://host:port, to which metrics are sent
+// over UDP in the StatsD line format, or an http or https URL, to
+// which metrics are POSTed in the OpenMetrics text format. All the
+// methods are safe to call on a nil *MetricsExporter, which exports
+// nothing.
+//
+// For StatsD, gauges are sent as gauges, and counters (and the count
+// and sum of histograms) are sent as the increase since the last
+// push. Each metric's name is suffixed with our RMId and then its
+// label values. For OpenMetrics, each metric gains an rmid label.
+type MetricsExporter struct {
+	sync.Mutex
+	endpoint   *url.URL
+	interval   time.Duration
+	rmId       common.RMId
+	client     *http.Client
+	counters   map[string]float64 // only used by run
+	exported   uint64
+	lastErr    error
+	terminate  chan struct{}
+	terminated chan struct{}
+}
+
+// ParseMetricsExportEndpoint checks that endpoint is something a
+// MetricsExporter can push to.
+func ParseMetricsExportEndpoint(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "statsd":
+		if _, _, err = net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("StatsD endpoint must be statsd://host:port: %v", err)
+		}
+	case "http", "https":
+		if u.Host == "" {
+			return nil, fmt.Errorf("OpenMetrics endpoint has no host: %v", endpoint)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported metrics export endpoint (must be statsd, http or https): %v", endpoint)
+	}
+	return u, nil
+}
+
+func NewMetricsExporter(endpoint *url.URL, interval time.Duration, rmId common.RMId) *MetricsExporter {
+	me := &MetricsExporter{
+		endpoint:   endpoint,
+		interval:   interval,
+		rmId:       rmId,
+		client:     &http.Client{Timeout: server.MetricsExportTimeout},
+		counters:   make(map[string]float64),
+		terminate:  make(chan struct{}),
+		terminated: make(chan struct{}),
+	}
+	go me.run()
+	return me
+}
+
+func (me *MetricsExporter) Shutdown() {
+	if me == nil {
+		return
+	}
+	close(me.terminate)
+	<-me.terminated
+}
+
+func (me *MetricsExporter) Status(sc *server.StatusConsumer) {
+	if me == nil {
+		sc.Emit("Metrics export: disabled")
+	} else {
+		me.Lock()
+		sc.Emit(fmt.Sprintf("Metrics export to %v: every %v; %v pushes; last error: %v", me.endpoint, me.interval, me.exported, me.lastErr))
+		me.Unlock()
+	}
+	sc.Join()
+}
+
+func (me *MetricsExporter) run() {
+	defer close(me.terminated)
+	ticker := time.NewTicker(me.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-me.terminate:
+			return
+		case <-ticker.C:
+		}
+		err := me.export()
+		if err != nil {
+			log.Println("Metrics export error:", err)
+		}
+		me.Lock()
+		if err == nil {
+			me.exported++
+		}
+		me.lastErr = err
+		me.Unlock()
+	}
+}
+
+func (me *MetricsExporter) export() error {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return err
+	}
+	if me.endpoint.Scheme == "statsd" {
+		return me.exportStatsD(families)
+	} else {
+		return me.exportOpenMetrics(families)
+	}
+}
+
+func (me *MetricsExporter) exportStatsD(families []*dto.MetricFamily) error {
+	conn, err := net.Dial("udp", me.endpoint.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	packet := new(bytes.Buffer)
+	emit := func(line string) error {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > server.MetricsExportStatsDPacketSize {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+		return nil
+	}
+	counter := func(key string, value float64) error {
+		delta := value - me.counters[key]
+		me.counters[key] = value
+		if delta < 0 { // counter has been reset
+			delta = value
+		}
+		return emit(fmt.Sprintf("%s:%s|c", key, formatMetricValue(delta)))
+	}
+
+	prefix := fmt.Sprintf(".%v", me.rmId)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			key := statsDKey(family.GetName(), prefix, metric)
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				err = counter(key, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				err = emit(fmt.Sprintf("%s:%s|g", key, formatMetricValue(metric.GetGauge().GetValue())))
+			case dto.MetricType_HISTOGRAM:
+				if err = counter(key+".count", float64(metric.GetHistogram().GetSampleCount())); err == nil {
+					err = counter(key+".sum", metric.GetHistogram().GetSampleSum())
+				}
+			case dto.MetricType_SUMMARY:
+				if err = counter(key+".count", float64(metric.GetSummary().GetSampleCount())); err == nil {
+					err = counter(key+".sum", metric.GetSummary().GetSampleSum())
+				}
+			case dto.MetricType_UNTYPED:
+				err = emit(fmt.Sprintf("%s:%s|g", key, formatMetricValue(metric.GetUntyped().GetValue())))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if packet.Len() > 0 {
+		_, err = conn.Write(packet.Bytes())
+	}
+	return err
+}
+
+func statsDKey(name, prefix string, metric *dto.Metric) string {
+	key := name + prefix
+	for _, label := range metric.GetLabel() {
+		key += "." + strings.Map(func(r rune) rune {
+			switch r {
+			case ':', '|', '@', '.', '\n', ' ':
+				return '_'
+			default:
+				return r
+			}
+		}, label.GetValue())
+	}
+	return key
+}
+
+func (me *MetricsExporter) exportOpenMetrics(families []*dto.MetricFamily) error {
+	body := new(bytes.Buffer)
+	rmIdName, rmIdValue := "rmid", fmt.Sprint(me.rmId)
+	rmIdLabel := &dto.LabelPair{Name: &rmIdName, Value: &rmIdValue}
+	for _, family := range families {
+		writeOpenMetricsFamily(body, family, rmIdLabel)
+	}
+	body.WriteString("# EOF\n")
+
+	req, err := http.NewRequest("POST", me.endpoint.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	resp, err := me.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OpenMetrics endpoint responded %v", resp.Status)
+	}
+	return nil
+}
+
+func writeOpenMetricsFamily(buf *bytes.Buffer, family *dto.MetricFamily, extra *dto.LabelPair) {
+	name := family.GetName()
+	var kind string
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		kind = "counter"
+		name = strings.TrimSuffix(name, "_total")
+	case dto.MetricType_GAUGE:
+		kind = "gauge"
+	case dto.MetricType_HISTOGRAM:
+		kind = "histogram"
+	case dto.MetricType_SUMMARY:
+		kind = "summary"
+	default:
+		kind = "unknown"
+	}
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, kind)
+	if help := family.GetHelp(); help != "" {
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, escapeOpenMetrics(help, false))
+	}
+	for _, metric := range family.GetMetric() {
+		labels := append([]*dto.LabelPair{extra}, metric.GetLabel()...)
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			writeOpenMetricsSample(buf, name+"_total", labels, nil, metric.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			writeOpenMetricsSample(buf, name, labels, nil, metric.GetGauge().GetValue())
+		case dto.MetricType_HISTOGRAM:
+			histogram := metric.GetHistogram()
+			infSeen := false
+			for _, bucket := range histogram.GetBucket() {
+				le := formatMetricValue(bucket.GetUpperBound())
+				infSeen = infSeen || le == "+Inf"
+				writeOpenMetricsSample(buf, name+"_bucket", labels, []string{"le", le}, float64(bucket.GetCumulativeCount()))
+			}
+			if !infSeen {
+				writeOpenMetricsSample(buf, name+"_bucket", labels, []string{"le", "+Inf"}, float64(histogram.GetSampleCount()))
+			}
+			writeOpenMetricsSample(buf, name+"_count", labels, nil, float64(histogram.GetSampleCount()))
+			writeOpenMetricsSample(buf, name+"_sum", labels, nil, histogram.GetSampleSum())
+		case dto.MetricType_SUMMARY:
+			summary := metric.GetSummary()
+			for _, quantile := range summary.GetQuantile() {
+				writeOpenMetricsSample(buf, name, labels, []string{"quantile", formatMetricValue(quantile.GetQuantile())}, quantile.GetValue())
+			}
+			writeOpenMetricsSample(buf, name+"_count", labels, nil, float64(summary.GetSampleCount()))
+			writeOpenMetricsSample(buf, name+"_sum", labels, nil, summary.GetSampleSum())
+		default:
+			writeOpenMetricsSample(buf, name, labels, nil, metric.GetUntyped().GetValue())
+		}
+	}
+}
+
+func writeOpenMetricsSample(buf *bytes.Buffer, name string, labels []*dto.LabelPair, extra []string, value float64) {
+	pairs := make([]string, 0, len(labels)+1)
+	for _, label := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label.GetName(), escapeOpenMetrics(label.GetValue(), true)))
+	}
+	sort.Strings(pairs[1:])
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[0], extra[1]))
+	}
+	fmt.Fprintf(buf, "%s{%s} %s\n", name, strings.Join(pairs, ","), formatMetricValue(value))
+}
+
+func escapeOpenMetrics(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+// formatMetricValue formats as both StatsD and OpenMetrics expect
+// (infinities are +Inf and -Inf).
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,183 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/configuration"
+	eng "goshawkdb.io/server/txnengine"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsPublisher periodically writes a sample of this node's
+// metrics into the MetricsRootName root, so that clients granted
+// that root can observe the health of the cluster through the
+// database itself. Each sample is a var holding JSON, appended to the
+// root by a rootAppender: the root's value is the latest sample, and
+// its references are the most recent samples (from every node in the
+// cluster), newest first. Once retain samples have been published,
+// each sample overwrites the var of the oldest, so publishing doesn't
+// grow the store even when garbage collection is off. Nothing is
+// published unless the configuration grants some client the ability
+// to read the root.
+type MetricsPublisher struct {
+	sync.Mutex
+	connectionManager *ConnectionManager
+	interval          time.Duration
+	retain            int
+	appender          *rootAppender // only used by run
+	topology          *configuration.Topology
+	published         uint64
+	lastPublished     time.Time
+	lastErr           error
+	terminate         chan struct{}
+	terminated        chan struct{}
+}
+
+type metricsSample struct {
+	RMId            common.RMId
+	BootCount       uint32
+	Time            time.Time
+	TopologyVersion uint32
+	Hosts           int
+	Metrics         map[string]float64
+}
+
+func NewMetricsPublisher(cm *ConnectionManager, interval time.Duration, retain int) *MetricsPublisher {
+	mp := &MetricsPublisher{
+		connectionManager: cm,
+		interval:          interval,
+		retain:            retain,
+		terminate:         make(chan struct{}),
+		terminated:        make(chan struct{}),
+	}
+	mp.appender = newRootAppender(cm, server.MetricsRootName, retain, server.MetricsMaxAttempts, mp.terminate)
+	mp.topology = cm.AddTopologySubscriber(eng.ConnectionSubscriber, mp)
+	go mp.run()
+	return mp
+}
+
+func (mp *MetricsPublisher) Shutdown() {
+	mp.connectionManager.RemoveTopologySubscriberAsync(eng.ConnectionSubscriber, mp)
+	close(mp.terminate)
+	<-mp.terminated
+}
+
+func (mp *MetricsPublisher) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	mp.Lock()
+	mp.topology = topology
+	mp.Unlock()
+	done(true)
+}
+
+func (mp *MetricsPublisher) Status(sc *server.StatusConsumer) {
+	mp.Lock()
+	defer mp.Unlock()
+	if mp.interval == 0 {
+		sc.Emit(fmt.Sprintf("Metrics publishing to %v: disabled", server.MetricsRootName))
+	} else {
+		sc.Emit(fmt.Sprintf("Metrics publishing to %v: every %v, retaining %v samples; %v published (last %v); last error: %v",
+			server.MetricsRootName, mp.interval, mp.retain, mp.published, mp.lastPublished, mp.lastErr))
+	}
+	sc.Join()
+}
+
+func (mp *MetricsPublisher) run() {
+	defer close(mp.terminated)
+	if mp.interval == 0 {
+		<-mp.terminate
+		return
+	}
+	ticker := time.NewTicker(mp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mp.terminate:
+			return
+		case <-ticker.C:
+		}
+		err := mp.publish()
+		if err != nil {
+			log.Println("Metrics publishing error:", err)
+		}
+		mp.Lock()
+		mp.lastErr = err
+		mp.Unlock()
+	}
+}
+
+func (mp *MetricsPublisher) publish() error {
+	mp.Lock()
+	topology := mp.topology
+	mp.Unlock()
+	if topology == nil || topology.IsBlank() || mp.appender.root(topology) == nil {
+		return nil
+	}
+
+	sample, err := mp.sample(topology)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	published, err := mp.appender.append(topology, value)
+	if published {
+		mp.Lock()
+		mp.published++
+		mp.lastPublished = sample.Time
+		mp.Unlock()
+	}
+	return err
+}
+
+func (mp *MetricsPublisher) sample(topology *configuration.Topology) (*metricsSample, error) {
+	metrics, err := gatherMetrics()
+	if err != nil {
+		return nil, err
+	}
+	return &metricsSample{
+		RMId:            mp.connectionManager.RMId,
+		BootCount:       mp.connectionManager.BootCount(),
+		Time:            time.Now(),
+		TopologyVersion: topology.Version,
+		Hosts:           len(topology.Hosts),
+		Metrics:         metrics,
+	}, nil
+}
+
+// gatherMetrics flattens the goshawkdb metrics in the default
+// prometheus registry, summing across labels. Histograms contribute
+// their sample count and sum.
+func gatherMetrics() (map[string]float64, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	metrics := make(map[string]float64)
+	for _, family := range families {
+		name := family.GetName()
+		if !strings.HasPrefix(name, "goshawkdb_") {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				metrics[name] += metric.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				metrics[name] += metric.GetGauge().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				metrics[name+"_count"] += float64(metric.GetHistogram().GetSampleCount())
+				metrics[name+"_sum"] += metric.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,175 @@
+package network
+
+import (
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/configuration"
+	"goshawkdb.io/server/db"
+	"log"
+)
+
+// Before an RM records that it has reached barrier 2, and so before
+// anyone starts emigrating to it, an RM which is to receive data
+// checks that it has room for it. Every RM of the old topology sends
+// each receiving RM an estimate of how much data it holds. With vars
+// spread evenly, an RM ends up holding roughly as much as any other,
+// so we take the largest estimate as the volume we'll end up with. If
+// the disk doesn't have room for that, with server.MigrationSpaceHeadroom
+// to spare, we refuse to reach barrier 2, and the transition stops
+// before any data has been moved. Otherwise we grow the LMDB map to
+// fit in one go.
+type migrationCapacity struct {
+	dataDir   string
+	estimates map[uint32]map[common.RMId]uint64
+	local     uint64
+	localFor  uint32
+	checked   uint32
+	err       error
+}
+
+func newMigrationCapacity() *migrationCapacity {
+	return &migrationCapacity{
+		estimates: make(map[uint32]map[common.RMId]uint64),
+	}
+}
+
+func (mc *migrationCapacity) String() string {
+	if mc.err == nil {
+		return "Migration capacity: ok"
+	}
+	return fmt.Sprintf("Migration capacity: %v", mc.err)
+}
+
+// forget drops all estimates for topology changes up to and including
+// version.
+func (mc *migrationCapacity) forget(version uint32) {
+	for v := range mc.estimates {
+		if v <= version {
+			delete(mc.estimates, v)
+		}
+	}
+}
+
+// SetDataDir sets the directory which holds the LMDB environment, so
+// that free disk space can be checked before immigration starts. If
+// it is not set, only the LMDB map is grown.
+func (tt *TopologyTransmogrifier) SetDataDir(dataDir string) {
+	tt.enqueueQuery(topologyTransmogrifierMsgExe(func() error {
+		tt.capacity.dataDir = dataDir
+		return nil
+	}))
+}
+
+func (tt *TopologyTransmogrifier) MigrationEstimateReceived(sender common.RMId, estimate *msgs.MigrationEstimate) {
+	version, bytes := estimate.Version(), estimate.Bytes()
+	tt.enqueueQuery(topologyTransmogrifierMsgExe(func() error {
+		if version <= tt.active.Version {
+			return nil
+		}
+		estimates, found := tt.capacity.estimates[version]
+		if !found {
+			estimates = make(map[common.RMId]uint64)
+			tt.capacity.estimates[version] = estimates
+		}
+		estimates[sender] = bytes
+		if tt.task != nil {
+			return tt.task.tick()
+		}
+		return nil
+	}))
+}
+
+// sendMigrationEstimates sends our estimate to every RM which is to
+// receive data and has yet to reach barrier 2. Estimates are small,
+// so we just send again on every tick rather than track who has
+// them.
+func (task *targetConfig) sendMigrationEstimates(next *configuration.NextConfiguration) {
+	if !server.FeatureEnabled(server.FeatureMigrationSize) || !task.isInRMs(task.active.RMs()) {
+		return
+	}
+	if task.capacity.localFor != next.Version {
+		used, err := task.db.UsedBytes()
+		if err != nil {
+			log.Println("Topology: Unable to estimate size of local data:", err)
+			return
+		}
+		task.capacity.local, task.capacity.localFor = used, next.Version
+	}
+	var msg []byte
+	for rmId := range next.Pending {
+		conn, found := task.activeConnections[rmId]
+		if rmId == task.connectionManager.RMId || !found || task.active.NextBarrierReached2(rmId) {
+			continue
+		}
+		if msg == nil {
+			seg := capn.NewBuffer(nil)
+			msgCap := msgs.NewRootMessage(seg)
+			estimate := msgs.NewMigrationEstimate(seg)
+			estimate.SetVersion(next.Version)
+			estimate.SetBytes(task.capacity.local)
+			msgCap.SetMigrationEstimate(estimate)
+			msg = server.SegToBytes(seg)
+		}
+		conn.Send(msg)
+	}
+}
+
+// ensureMigrationCapacity returns true once we know we have room for
+// the data we're to receive. It returns false if we're still waiting
+// for estimates, and an error if we don't have room.
+func (task *targetConfig) ensureMigrationCapacity(next *configuration.NextConfiguration) (bool, error) {
+	if _, found := next.Pending[task.connectionManager.RMId]; !found || task.capacity.checked == next.Version {
+		return true, nil
+	} else if !server.FeatureEnabled(server.FeatureMigrationSize) {
+		// Older RMs won't send us estimates.
+		return true, nil
+	}
+
+	expected := uint64(0)
+	estimates := task.capacity.estimates[next.Version]
+	for _, rmId := range task.active.RMs() {
+		if rmId == common.RMIdEmpty || rmId == task.connectionManager.RMId {
+			continue
+		} else if _, found := task.activeConnections[rmId]; !found {
+			// It can't emigrate to us whilst it's disconnected either.
+			continue
+		}
+		estimate, found := estimates[rmId]
+		if !found {
+			log.Printf("Topology: awaiting migration estimate from %v.", rmId)
+			return false, nil
+		} else if estimate > expected {
+			expected = estimate
+		}
+	}
+
+	used, err := task.db.UsedBytes()
+	if err != nil {
+		return false, err
+	}
+	required := uint64(0)
+	if expected > used {
+		required = uint64(float64(expected-used) * server.MigrationSpaceHeadroom)
+	}
+	if dataDir := task.capacity.dataDir; dataDir != "" && required > 0 {
+		free, err := db.FreeDiskBytes(dataDir)
+		if err != nil {
+			return false, err
+		}
+		if free < required {
+			task.capacity.err = fmt.Errorf("Insufficient disk space to accept migration for topology version %v: expecting %v bytes of data (%v held already); %v needed but only %v free in %v.",
+				next.Version, expected, used, required, free, dataDir)
+			return false, task.capacity.err
+		}
+	}
+	if err := task.db.EnsureMapSize(used + required); err != nil {
+		return false, fmt.Errorf("Unable to grow LMDB map to %v bytes ahead of migration: %v", used+required, err)
+	}
+	log.Printf("Topology: Room for migration: expecting %v bytes of data (%v held already).", expected, used)
+	task.capacity.checked = next.Version
+	task.capacity.err = nil
+	return true, nil
+}
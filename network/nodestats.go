@@ -0,0 +1,331 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	cmsgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/client"
+	"goshawkdb.io/server/configuration"
+	eng "goshawkdb.io/server/txnengine"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NodeStatsPublisher keeps an object of node-level stats (uptime,
+// boot count, version, disk usage, resident vars) for this node up
+// to date in the NodeStatsRootName root, so that cluster dashboards
+// can be built purely as clients. The root's references are one var
+// per node, and the root's value is a JSON object mapping each
+// node's RMId to the index of its var in the references. A node adds
+// its var to the root once (and again after a topology change, when
+// the vars of nodes which have left are dropped), and from then on
+// just overwrites its own var, so nodes don't contend on the
+// root. Nothing is published unless the configuration grants some
+// client the ability to read the root.
+type NodeStatsPublisher struct {
+	sync.Mutex
+	connectionManager *ConnectionManager
+	interval          time.Duration
+	dataDir           string
+	started           time.Time
+	roots             *rootAppender        // only used by run, to find the root
+	cache             client.LocalTxnCache // only used by run
+	mine              *msgs.VarIdPos
+	mineTopology      *configuration.Topology
+	topology          *configuration.Topology
+	published         uint64
+	lastPublished     time.Time
+	lastErr           error
+	terminate         chan struct{}
+	terminated        chan struct{}
+}
+
+type nodeStats struct {
+	RMId            common.RMId
+	BootCount       uint32
+	Version         string
+	Started         time.Time
+	Time            time.Time
+	UptimeSeconds   float64
+	TopologyVersion uint32
+	DiskBytes       int64
+	ResidentVars    int
+}
+
+func NewNodeStatsPublisher(cm *ConnectionManager, interval time.Duration, dataDir string) *NodeStatsPublisher {
+	nsp := &NodeStatsPublisher{
+		connectionManager: cm,
+		interval:          interval,
+		dataDir:           dataDir,
+		started:           time.Now(),
+		cache:             make(client.LocalTxnCache),
+		terminate:         make(chan struct{}),
+		terminated:        make(chan struct{}),
+	}
+	nsp.roots = newRootAppender(cm, server.NodeStatsRootName, 0, server.NodeStatsMaxAttempts, nsp.terminate)
+	nsp.topology = cm.AddTopologySubscriber(eng.ConnectionSubscriber, nsp)
+	go nsp.run()
+	return nsp
+}
+
+func (nsp *NodeStatsPublisher) Shutdown() {
+	nsp.connectionManager.RemoveTopologySubscriberAsync(eng.ConnectionSubscriber, nsp)
+	close(nsp.terminate)
+	<-nsp.terminated
+}
+
+func (nsp *NodeStatsPublisher) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	nsp.Lock()
+	nsp.topology = topology
+	nsp.Unlock()
+	done(true)
+}
+
+func (nsp *NodeStatsPublisher) Status(sc *server.StatusConsumer) {
+	nsp.Lock()
+	defer nsp.Unlock()
+	if nsp.interval == 0 {
+		sc.Emit(fmt.Sprintf("Node stats publishing to %v: disabled", server.NodeStatsRootName))
+	} else {
+		sc.Emit(fmt.Sprintf("Node stats publishing to %v: every %v; %v published (last %v); last error: %v",
+			server.NodeStatsRootName, nsp.interval, nsp.published, nsp.lastPublished, nsp.lastErr))
+	}
+	sc.Join()
+}
+
+func (nsp *NodeStatsPublisher) run() {
+	defer close(nsp.terminated)
+	if nsp.interval == 0 {
+		<-nsp.terminate
+		return
+	}
+	ticker := time.NewTicker(nsp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-nsp.terminate:
+			return
+		case <-ticker.C:
+		}
+		err := nsp.publish()
+		if err != nil {
+			log.Println("Node stats publishing error:", err)
+		}
+		nsp.Lock()
+		nsp.lastErr = err
+		nsp.Unlock()
+	}
+}
+
+func (nsp *NodeStatsPublisher) publish() error {
+	nsp.Lock()
+	topology := nsp.topology
+	nsp.Unlock()
+	if topology == nil || topology.IsBlank() {
+		return nil
+	}
+	root := nsp.roots.root(topology)
+	if root == nil {
+		return nil
+	}
+	if topology != nsp.mineTopology {
+		nsp.mineTopology = topology
+		nsp.mine = nil
+		nsp.cache = make(client.LocalTxnCache)
+	}
+
+	stats, err := nsp.stats(topology)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	// A rerun of our overwrite shows someone else has written our var:
+	// forget it, and register afresh.
+	overwriting := false
+	txn, err := nsp.connectionManager.localConnection.RunLocalTransaction(nsp.cache, server.NodeStatsMaxAttempts, nsp.terminate,
+		func(cache client.LocalTxnCache) (*cmsgs.ClientTxn, map[common.VarUUId]*common.Positions, error) {
+			if overwriting {
+				if _, found := cache[*common.MakeVarUUId(nsp.mine.Id())]; found {
+					nsp.mine = nil
+				}
+			}
+			if nsp.mine == nil {
+				ctxn, varPosMap, err := nsp.register(cache, topology, root, value)
+				overwriting = nsp.mine != nil
+				return ctxn, varPosMap, err
+			}
+			overwriting = true
+			ctxn, varPosMap := nsp.overwrite(value)
+			return ctxn, varPosMap, nil
+		})
+	if err != nil {
+		return fmt.Errorf("Unable to write to %v: %v", server.NodeStatsRootName, err)
+	} else if txn == nil {
+		return nil
+	}
+	if rootVar, found := nsp.cache[*root.VarUUId]; found && rootVar.Version.Compare(txn.Id) == common.EQ && len(rootVar.References) != 0 {
+		// We registered: our var is the root's last reference.
+		nsp.mine = &rootVar.References[len(rootVar.References)-1]
+	} else if nsp.mine == nil {
+		// The root has never been written.
+		return nil
+	}
+	nsp.Lock()
+	nsp.published++
+	nsp.lastPublished = stats.Time
+	nsp.Unlock()
+	return nil
+}
+
+func (nsp *NodeStatsPublisher) stats(topology *configuration.Topology) (*nodeStats, error) {
+	diskBytes, err := diskUsage(nsp.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &nodeStats{
+		RMId:            nsp.connectionManager.RMId,
+		BootCount:       nsp.connectionManager.BootCount(),
+		Version:         server.ServerVersion,
+		Started:         nsp.started,
+		Time:            now,
+		UptimeSeconds:   now.Sub(nsp.started).Seconds(),
+		TopologyVersion: topology.Version,
+		DiskBytes:       diskBytes,
+		ResidentVars:    nsp.connectionManager.Dispatchers.VarDispatcher.ResidentVarCount(),
+	}, nil
+}
+
+// diskUsage sums the sizes of the files in the data directory.
+func diskUsage(dataDir string) (int64, error) {
+	infos, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return 0, err
+	}
+	total := int64(0)
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+	}
+	return total, nil
+}
+
+// register builds a txn which creates our var, holding value, and
+// adds it to the root, dropping the vars of nodes no longer in the
+// topology. If the root is unknown, it builds a txn to read the root
+// instead. If our var is already in the root, it builds a txn to
+// overwrite it instead.
+func (nsp *NodeStatsPublisher) register(cache client.LocalTxnCache, topology *configuration.Topology, root *configuration.Root, value []byte) (*cmsgs.ClientTxn, map[common.VarUUId]*common.Positions, error) {
+	rootVar, found := cache[*root.VarUUId]
+	if !found {
+		return client.ReadTxn(root.VarUUId, root.Positions), map[common.VarUUId]*common.Positions{*root.VarUUId: root.Positions}, nil
+	}
+	refs := rootVar.References
+	index := make(map[string]int)
+	if len(rootVar.Value) != 0 {
+		if err := json.Unmarshal(rootVar.Value, &index); err != nil {
+			return nil, nil, fmt.Errorf("Unable to parse the value of %v: %v", server.NodeStatsRootName, err)
+		}
+	}
+	self := fmt.Sprint(nsp.connectionManager.RMId)
+	if idx, found := index[self]; found && idx >= 0 && idx < len(refs) {
+		nsp.mine = &refs[idx]
+		ctxn, varPosMap := nsp.overwrite(value)
+		return ctxn, varPosMap, nil
+	}
+
+	current := make(map[string]server.EmptyStruct)
+	for _, rmId := range topology.RMs() {
+		current[fmt.Sprint(rmId)] = server.EmptyStructVal
+	}
+	names := make([]string, 0, len(index))
+	for name, idx := range index {
+		if _, found := current[name]; found && idx >= 0 && idx < len(refs) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	newIndex := make(map[string]int, len(names)+1)
+	newRefs := make([]msgs.VarIdPos, 0, len(names))
+	for _, name := range names {
+		newIndex[name] = len(newRefs)
+		newRefs = append(newRefs, refs[index[name]])
+	}
+	newIndex[self] = len(newRefs)
+	newRootValue, err := json.Marshal(newIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	mineVUUId := nsp.connectionManager.localConnection.NextVarUUId()
+
+	seg := capn.NewBuffer(nil)
+	ctxn := cmsgs.NewClientTxn(seg)
+	ctxn.SetRetry(false)
+	actions := cmsgs.NewClientActionList(seg, 2)
+	varPosMap := make(map[common.VarUUId]*common.Positions, len(newRefs)+1)
+	varPosMap[*root.VarUUId] = root.Positions
+
+	rootAction := actions.At(0)
+	rootAction.SetVarId(root.VarUUId[:])
+	rootAction.SetReadwrite()
+	rw := rootAction.Readwrite()
+	rw.SetVersion(rootVar.Version[:])
+	rw.SetValue(newRootValue)
+	clientRefs := cmsgs.NewClientVarIdPosList(seg, len(newRefs)+1)
+	for idx, ref := range newRefs {
+		clientRef := clientRefs.At(idx)
+		clientRef.SetVarId(ref.Id())
+		clientRef.SetCapability(ref.Capability())
+		positions := common.Positions(ref.Positions())
+		varPosMap[*common.MakeVarUUId(ref.Id())] = &positions
+	}
+	mineRef := clientRefs.At(len(newRefs))
+	mineRef.SetVarId(mineVUUId[:])
+	mineRef.SetCapability(common.MaxCapability.Capability)
+	rw.SetReferences(clientRefs)
+
+	mineAction := actions.At(1)
+	mineAction.SetVarId(mineVUUId[:])
+	mineAction.SetCreate()
+	create := mineAction.Create()
+	create.SetValue(value)
+	create.SetReferences(cmsgs.NewClientVarIdPosList(seg, 0))
+
+	ctxn.SetActions(actions)
+	return &ctxn, varPosMap, nil
+}
+
+// overwrite builds a txn which writes value into our var. Our var is
+// first forgotten from the cache, so that if the txn is rerun, the
+// cache shows that someone else has written it.
+func (nsp *NodeStatsPublisher) overwrite(value []byte) (*cmsgs.ClientTxn, map[common.VarUUId]*common.Positions) {
+	mineVUUId := common.MakeVarUUId(nsp.mine.Id())
+	positions := common.Positions(nsp.mine.Positions())
+	varPosMap := map[common.VarUUId]*common.Positions{*mineVUUId: &positions}
+	delete(nsp.cache, *mineVUUId)
+
+	seg := capn.NewBuffer(nil)
+	ctxn := cmsgs.NewClientTxn(seg)
+	ctxn.SetRetry(false)
+	actions := cmsgs.NewClientActionList(seg, 1)
+	action := actions.At(0)
+	action.SetVarId(mineVUUId[:])
+	action.SetWrite()
+	write := action.Write()
+	write.SetValue(value)
+	write.SetReferences(cmsgs.NewClientVarIdPosList(seg, 0))
+	ctxn.SetActions(actions)
+	return &ctxn, varPosMap
+}
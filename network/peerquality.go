@@ -0,0 +1,196 @@
+package network
+
+import (
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/paxos"
+	"math/rand"
+	"time"
+)
+
+var (
+	serverRTTSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "server_rtt_seconds",
+		Help:      "Smoothed round trip time of heartbeat pings to each server.",
+	}, []string{"rmid"})
+	serverPingLoss = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "server_ping_loss_ratio",
+		Help:      "Smoothed fraction of heartbeat pings to each server which went unanswered.",
+	}, []string{"rmid"})
+)
+
+func init() {
+	prometheus.MustRegister(serverRTTSeconds)
+	prometheus.MustRegister(serverPingLoss)
+}
+
+// peerQuality measures the network path to another server. On
+// connections to servers which support FeatureHeartbeatPing, every
+// heartbeat is a ping carrying a sequence number, which the remote
+// echoes straight back as a pong. Round trip times are smoothed as
+// TCP does (RFC 6298), and a ping still unanswered once
+// PeerQualityPingWindow further pings have been sent counts as
+// lost. A peerQuality belongs to a Connection and so survives
+// restarts of it, which lets the restart delay depend on how the
+// previous connection fared. It is only used from the Connection's
+// own goroutine, and all the methods are safe to call on a nil
+// *peerQuality.
+type peerQuality struct {
+	rmId      common.RMId
+	export    bool
+	latencies *paxos.PeerLatencies
+	nextSeq   uint32
+	pings     [server.PeerQualityPingWindow]peerPing
+	samples   uint64
+	srtt      time.Duration
+	rttvar    time.Duration
+	loss      float64
+}
+
+type peerPing struct {
+	seq      uint32
+	sentAt   time.Time
+	inflight bool
+}
+
+// Only the primary connection to each server exports metrics, and
+// its round trip time to latencies, so that links don't overwrite
+// each other's measurements.
+func newPeerQuality(rmId common.RMId, export bool, latencies *paxos.PeerLatencies) *peerQuality {
+	return &peerQuality{
+		rmId:      rmId,
+		export:    export,
+		latencies: latencies,
+	}
+}
+
+func (cm *ConnectionManager) PeerLatencies() *paxos.PeerLatencies {
+	return cm.peerLatencies
+}
+
+func (pq *peerQuality) String() string {
+	if pq.samples == 0 {
+		return "RTT: unknown"
+	}
+	return fmt.Sprintf("RTT: %v (±%v); ping loss: %.1f%%; %v samples", pq.srtt, pq.rttvar, pq.loss*100, pq.samples)
+}
+
+// reset forgets the pings in flight: they can't be answered once the
+// connection they were sent on has gone.
+func (pq *peerQuality) reset() {
+	if pq == nil {
+		return
+	}
+	for idx := range pq.pings {
+		pq.pings[idx].inflight = false
+	}
+}
+
+// ping returns the next ping message to send.
+func (pq *peerQuality) ping(now time.Time) []byte {
+	seq := pq.nextSeq
+	pq.nextSeq++
+	p := &pq.pings[seq%server.PeerQualityPingWindow]
+	if p.inflight {
+		pq.observeLoss(1)
+	}
+	p.seq = seq
+	p.sentAt = now
+	p.inflight = true
+
+	seg := capn.NewBuffer(nil)
+	msg := msgs.NewRootMessage(seg)
+	msg.SetPing(seq)
+	return server.SegToBytes(seg)
+}
+
+func (pq *peerQuality) pong(seq uint32, now time.Time) {
+	if pq == nil {
+		return
+	}
+	p := &pq.pings[seq%server.PeerQualityPingWindow]
+	if !p.inflight || p.seq != seq {
+		return
+	}
+	p.inflight = false
+	rtt := now.Sub(p.sentAt)
+	if pq.samples == 0 {
+		pq.srtt = rtt
+		pq.rttvar = rtt / 2
+	} else {
+		delta := pq.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		pq.rttvar = (3*pq.rttvar + delta) / 4
+		pq.srtt = (7*pq.srtt + rtt) / 8
+	}
+	pq.samples++
+	pq.observeLoss(0)
+	if pq.export {
+		rmId := fmt.Sprint(pq.rmId)
+		serverRTTSeconds.WithLabelValues(rmId).Set(pq.srtt.Seconds())
+		serverPingLoss.WithLabelValues(rmId).Set(pq.loss)
+		pq.latencies.Set(pq.rmId, pq.srtt)
+	}
+}
+
+func (pq *peerQuality) observeLoss(lost float64) {
+	pq.loss += (lost - pq.loss) / server.PeerQualityPingWindow
+}
+
+// forget stops exporting metrics for the peer.
+func (pq *peerQuality) forget() {
+	if pq != nil && pq.export {
+		rmId := fmt.Sprint(pq.rmId)
+		serverRTTSeconds.DeleteLabelValues(rmId)
+		serverPingLoss.DeleteLabelValues(rmId)
+	}
+}
+
+func (pq *peerQuality) measured(adaptive bool) bool {
+	return adaptive && pq != nil && pq.samples != 0
+}
+
+// timeout is the RFC 6298 retransmission timeout: how long we might
+// reasonably wait for a reply from the peer.
+func (pq *peerQuality) timeout() time.Duration {
+	return pq.srtt + 4*pq.rttvar
+}
+
+// maxMissingBeats is the number of heartbeat intervals which may pass
+// without hearing from the peer before the connection is
+// restarted. The interval itself can't change, as the peer expects
+// our heartbeats at its own interval. With adaptive heartbeats, slow
+// or lossy peers are given longer, up to PeerQualityMaxMissingBeats.
+func (pq *peerQuality) maxMissingBeats(adaptive bool) int {
+	if !pq.measured(adaptive) {
+		return 2
+	}
+	beats := 2 + int(pq.timeout()/common.HeartbeatInterval) + int(pq.loss*server.PeerQualityLossDelayScale)
+	if beats > server.PeerQualityMaxMissingBeats {
+		beats = server.PeerQualityMaxMissingBeats
+	}
+	return beats
+}
+
+// restartDelay is how long to wait before redialling the peer. With
+// adaptive heartbeats, a healthy peer is redialled in half the usual
+// time, and a lossy one (which is likely to fail again straight away)
+// is backed off from.
+func (pq *peerQuality) restartDelay(rng *rand.Rand, adaptive bool) time.Duration {
+	min := server.ConnectionRestartDelayMin
+	spread := time.Duration(server.ConnectionRestartDelayRangeMS) * time.Millisecond
+	if pq.measured(adaptive) {
+		scale := 0.5 + server.PeerQualityLossDelayScale*pq.loss
+		min = time.Duration(float64(min)*scale) + pq.timeout()
+		spread = time.Duration(float64(spread) * scale)
+	}
+	return min + time.Duration(rng.Int63n(int64(spread)))
+}
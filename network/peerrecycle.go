@@ -0,0 +1,81 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"goshawkdb.io/common"
+	"log"
+	"net/http"
+)
+
+type connectionMsgRecycle struct{ connectionMsgBasic }
+
+var errRecycled = errors.New("Connection recycled by admin request")
+
+// Recycle closes the connection and redials it, exactly as if it had
+// failed.
+func (conn *Connection) Recycle() {
+	conn.enqueueQuery(connectionMsgRecycle{})
+}
+
+type connectionManagerMsgServerRecycle struct {
+	connectionManagerMsgBasic
+	peer       string
+	host       string
+	rmId       common.RMId
+	found      bool
+	resultChan chan struct{}
+}
+
+// recyclePeer recycles the connection to the server named by peer,
+// which is either its host or its RMId. Returns false if there is no
+// such connection.
+func (cm *ConnectionManager) recyclePeer(peer string) (string, common.RMId, bool) {
+	query := &connectionManagerMsgServerRecycle{
+		peer:       peer,
+		resultChan: make(chan struct{}),
+	}
+	if cm.enqueueSyncQuery(query, query.resultChan) {
+		return query.host, query.rmId, query.found
+	} else {
+		return "", common.RMIdEmpty, false
+	}
+}
+
+func (cm *ConnectionManager) serverRecycleQuery(query *connectionManagerMsgServerRecycle) {
+	for host, cd := range cm.servers {
+		if cd.Connection == nil || !(host == query.peer || (cd.established && cd.rmId.String() == query.peer)) {
+			continue
+		}
+		log.Printf("Recycling connection to %v (%v) by admin request.", host, cd.rmId)
+		query.host, query.rmId, query.found = host, cd.rmId, true
+		cd.Connection.Recycle()
+		break
+	}
+	close(query.resultChan)
+}
+
+// ServeRecyclePeer handles a POST with peer=host or peer=RMId by
+// closing the connection to that server and redialling it, for when
+// a connection has got into a bad state (half-open, stale TLS) and
+// restarting the whole node would be overkill. The connection's
+// links are redialled with it, and messages in flight are resent as
+// they are whenever a connection restarts.
+func (cm *ConnectionManager) ServeRecyclePeer(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	peer := req.FormValue("peer")
+	if peer == "" {
+		http.Error(w, "peer must be given: the host or RMId of a server", http.StatusBadRequest)
+		return
+	}
+	host, rmId, found := cm.recyclePeer(peer)
+	if !found {
+		http.Error(w, fmt.Sprintf("No connection to server %v", peer), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Recycling connection to %v (%v)\n", host, rmId)
+}
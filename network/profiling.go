@@ -0,0 +1,135 @@
+package network
+
+import (
+	"fmt"
+	"goshawkdb.io/server"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const profilingPrefix = "/debug/pprof/"
+
+// Profiling serves the net/http/pprof endpoints. They can be served
+// by the AdminAPI, at /admin/debug/pprof/, so only admin clients may
+// use them; and they can be served without authentication on a plain
+// HTTP listener of their own, for profiling tools which can not
+// present a client certificate. That listener may be bound to any
+// address, so that it is reachable from outside a container, in
+// which case the address must only be reachable by operators. Either
+// way, the endpoints can be enabled and disabled at runtime through
+// the AdminAPI; whilst disabled they are not found.
+type Profiling struct {
+	enabled    int32
+	mux        *http.ServeMux
+	listener   net.Listener
+	server     *http.Server
+	shutdown   int32
+	terminated chan struct{}
+}
+
+func NewProfiling(enabled bool) *Profiling {
+	p := &Profiling{
+		mux: http.NewServeMux(),
+	}
+	p.SetEnabled(enabled)
+	p.mux.HandleFunc(profilingPrefix, pprof.Index)
+	p.mux.HandleFunc(profilingPrefix+"cmdline", pprof.Cmdline)
+	p.mux.HandleFunc(profilingPrefix+"profile", pprof.Profile)
+	p.mux.HandleFunc(profilingPrefix+"symbol", pprof.Symbol)
+	p.mux.HandleFunc(profilingPrefix+"trace", pprof.Trace)
+	return p
+}
+
+// Listen serves the endpoints, without authentication, on addr
+// (host:port).
+func (p *Profiling) Listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.listener = ln
+	p.server = &http.Server{Handler: p}
+	p.terminated = make(chan struct{})
+	go p.serve()
+	return nil
+}
+
+func (p *Profiling) serve() {
+	defer close(p.terminated)
+	if err := p.server.Serve(p.listener); err != nil && atomic.LoadInt32(&p.shutdown) == 0 {
+		log.Println("Profiling listen error:", err)
+	}
+}
+
+// AddToAdminAPI serves the endpoints, and the pprof operation which
+// enables and disables them, on the AdminAPI.
+func (p *Profiling) AddToAdminAPI(api *AdminAPI) {
+	api.HandleFunc("pprof", p.ServeControl)
+	api.HandleFunc(profilingPrefix[1:], http.StripPrefix(strings.TrimSuffix(adminAPIPrefix, "/"), p).ServeHTTP)
+}
+
+func (p *Profiling) Enabled() bool {
+	return atomic.LoadInt32(&p.enabled) != 0
+}
+
+func (p *Profiling) SetEnabled(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&p.enabled, 1)
+	} else {
+		atomic.StoreInt32(&p.enabled, 0)
+	}
+}
+
+func (p *Profiling) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !p.Enabled() {
+		http.NotFound(w, req)
+		return
+	}
+	p.mux.ServeHTTP(w, req)
+}
+
+// ServeControl reports whether the endpoints are enabled. A POST
+// with enabled=true or enabled=false enables or disables them.
+func (p *Profiling) ServeControl(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		enabled, err := strconv.ParseBool(req.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "POST requires enabled=true or enabled=false", http.StatusBadRequest)
+			return
+		}
+		if enabled != p.Enabled() {
+			p.SetEnabled(enabled)
+			log.Printf("Profiling endpoints enabled: %v\n", enabled)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%v\n", p.Enabled())
+}
+
+func (p *Profiling) Shutdown() {
+	if p.listener == nil {
+		return
+	}
+	atomic.StoreInt32(&p.shutdown, 1)
+	p.listener.Close()
+	<-p.terminated
+}
+
+func (p *Profiling) Status(sc *server.StatusConsumer) {
+	listening := "none"
+	if p.listener != nil {
+		listening = p.listener.Addr().String()
+	}
+	sc.Emit(fmt.Sprintf("Profiling endpoints: enabled? %v; unauthenticated listener: %v", p.Enabled(), listening))
+	sc.Join()
+}
@@ -0,0 +1,135 @@
+package network
+
+import (
+	"encoding/json"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/configuration"
+	eng "goshawkdb.io/server/txnengine"
+	"net/http"
+	"time"
+)
+
+// restDeleteProgress is streamed to the client, one JSON object per
+// line, after each batch of a subtree deletion.
+type restDeleteProgress struct {
+	Visited   int
+	Truncated int
+	Skipped   int
+	Done      bool   `json:",omitempty"`
+	Error     string `json:",omitempty"`
+}
+
+// deleteSubtree deletes every var reachable from the addressed var
+// (including itself). Vars are never deleted directly: instead each
+// is truncated, i.e. written with an empty value and no references,
+// and the garbage collector then collects the vars which have become
+// unreachable. The subtree is walked breadth first, and truncated in
+// batches of RESTDeleteBatchSize vars, each batch being a single
+// txn, at no more than RESTDeleteVarsPerSecond vars per second. A
+// var is only descended into if its capability grants read, and only
+// truncated if it grants write and the var is not frozen; vars which
+// can't be truncated are skipped. Progress is reported after every
+// batch. As each batch is committed separately, a deletion which
+// fails part way through leaves the subtree partially truncated;
+// repeating the deletion finishes it.
+func (gw *RESTGateway) deleteSubtree(w http.ResponseWriter, topology *configuration.Topology, roots map[string]*common.Capability, rootName string, path []int) {
+	rv, err := gw.resolve(topology, roots, rootName, path, eng.ReadQuorum)
+	if err != nil {
+		gw.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	progress := &restDeleteProgress{}
+	report := func() {
+		if err := encoder.Encode(progress); err != nil {
+			server.Log("REST gateway: error writing response:", err)
+		} else if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	seen := map[common.VarUUId]server.EmptyStruct{*rv.vUUId: server.EmptyStructVal}
+	queue := []*restVar{rv}
+	start := time.Now()
+	for len(queue) != 0 {
+		batch := queue
+		if len(batch) > server.RESTDeleteBatchSize {
+			batch = batch[:server.RESTDeleteBatchSize]
+		}
+		queue = queue[len(batch):]
+		children, err := gw.truncateBatch(batch, progress)
+		if err != nil {
+			progress.Error = err.Error()
+			report()
+			return
+		}
+		for _, child := range children {
+			if _, found := seen[*child.vUUId]; !found {
+				seen[*child.vUUId] = server.EmptyStructVal
+				queue = append(queue, child)
+			}
+		}
+		report()
+		due := start.Add(time.Duration(progress.Truncated) * time.Second / server.RESTDeleteVarsPerSecond)
+		if delay := due.Sub(time.Now()); delay > 0 && len(queue) != 0 {
+			time.Sleep(delay)
+		}
+	}
+	progress.Done = true
+	report()
+}
+
+// truncateBatch truncates, in a single txn, the vars of batch which
+// may be truncated, and returns the vars they referenced (or still
+// reference, if they can't be truncated) which may be descended into.
+func (gw *RESTGateway) truncateBatch(batch []*restVar, progress *restDeleteProgress) ([]*restVar, error) {
+	for attempt := 0; attempt < server.RESTGatewayMaxAttempts; attempt++ {
+		children := []*restVar{}
+		actions := make([]*restAction, 0, len(batch))
+		skipped := 0
+		for _, rv := range batch {
+			if err := gw.readVar(rv, false); err != nil {
+				if re, ok := err.(restError); ok && re.status == http.StatusNotFound {
+					skipped++
+					continue
+				}
+				return nil, err
+			}
+			if rv.canRead() {
+				for _, ref := range rv.references {
+					positions := common.Positions(ref.Positions())
+					children = append(children, &restVar{
+						vUUId:       common.MakeVarUUId(ref.Id()),
+						positions:   &positions,
+						capability:  common.NewCapability(ref.Capability()),
+						consistency: eng.ReadQuorum,
+					})
+				}
+			}
+			if rv.frozen || !rv.canWrite() {
+				skipped++
+				continue
+			}
+			truncated := *rv
+			truncated.references = nil
+			actions = append(actions, &restAction{restVar: &truncated, read: rv.canRead(), write: []byte{}})
+		}
+		if len(actions) != 0 {
+			clock, err := gw.submit(actions)
+			if err != nil {
+				return nil, err
+			} else if clock == nil {
+				continue
+			}
+		}
+		progress.Visited += len(batch)
+		progress.Truncated += len(actions)
+		progress.Skipped += skipped
+		return children, nil
+	}
+	return nil, newRESTError(http.StatusConflict, "Unable to delete: too much contention")
+}
@@ -0,0 +1,717 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	cmsgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/configuration"
+	"goshawkdb.io/server/db"
+	eng "goshawkdb.io/server/txnengine"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	restGatewayVarsPrefix        = "/vars/"
+	restGatewayTxnPath           = "/txn"
+	restGatewayDigestsPath       = "/digests"
+	restGatewayIdempotencyKey    = "Idempotency-Key"
+	restGatewayIdempotentReplay  = "Idempotent-Replay"
+	restGatewayIdempotencyDigest = "Idempotency-Digest"
+)
+
+// RESTGateway exposes a small HTTP API on top of the
+// LocalConnection. It is intended for low-throughput integrations
+// which cannot speak the native client protocol. Vars are addressed
+// by the name of a root followed by a path of reference indices, for
+// example /vars/myRoot/0/3 is the 4th reference of the 1st reference
+// of myRoot.
+type RESTGateway struct {
+	sync.RWMutex
+	restVarReader
+	httpListener *HTTPListener
+	idempotency  *idempotencyStore
+	topology     *configuration.Topology
+}
+
+type restError struct {
+	status int
+	error
+}
+
+func newRESTError(status int, format string, args ...interface{}) restError {
+	return restError{status: status, error: fmt.Errorf(format, args...)}
+}
+
+var errRESTShutdown = restError{status: http.StatusServiceUnavailable, error: errors.New("Server is shutting down")}
+var errRESTFreezeUnsupported = restError{status: http.StatusServiceUnavailable, error: errors.New("Freezing vars is not supported until every server in the cluster has been upgraded")}
+
+type restVarResponse struct {
+	Version     string
+	Value       []byte
+	References  int
+	Consistency string
+	Clock       map[string]uint64
+	Frozen      bool `json:",omitempty"`
+}
+
+type restTxnRequest struct {
+	Actions []restTxnRequestAction
+}
+
+type restTxnRequestAction struct {
+	Root   string
+	Path   []int
+	Read   bool
+	Write  []byte
+	Freeze bool
+}
+
+type restTxnResponse struct {
+	Committed bool
+	Clock     map[string]uint64
+	Results   []*restVarResponse
+}
+
+type restDigestsResponse struct {
+	RMId      common.RMId
+	BootCount uint32
+	Ranges    []eng.RangeDigest
+}
+
+// NewRESTGateway adds the REST endpoints to the HTTPListener. A GET
+// of a var may ask for ?consistency=local, in which case the vars
+// along the path are read from this node without consensus where
+// possible (see eng.ReadConsistency); the response records the
+// consistency actually achieved. Reads, and committed txns, carry the
+// vector clock of the txn concerned (see restClock). Writes
+// (PUT of a var, or POST of a txn) may carry an Idempotency-Key
+// header: if a request with the same key from the same client
+// certificate has already completed then its outcome is returned
+// (marked with an Idempotent-Replay header) and nothing is re-run.
+// A write may also freeze the var it writes (PUT with ?freeze=true,
+// or Freeze in a txn action), after which the var can never be
+// written again, and reads of it are answered locally (see
+// eng.FrozenVars). A DELETE of a var deletes the subtree rooted at
+// it (see deleteSubtree).
+func NewRESTGateway(cm *ConnectionManager, l *HTTPListener, db *db.Databases) (*RESTGateway, error) {
+	idempotency, err := newIdempotencyStore(db)
+	if err != nil {
+		return nil, err
+	}
+	gw := &RESTGateway{
+		restVarReader: restVarReader{connectionManager: cm},
+		httpListener:  l,
+		idempotency:   idempotency,
+	}
+	gw.topology = cm.AddTopologySubscriber(eng.ConnectionSubscriber, gw)
+	l.HandleFunc(restGatewayVarsPrefix, gw.handleVar)
+	l.HandleFunc(restGatewayTxnPath, gw.handleTxn)
+	l.HandleFunc(restGatewayDigestsPath, gw.handleDigests)
+	return gw, nil
+}
+
+func (gw *RESTGateway) Shutdown() {
+	gw.connectionManager.RemoveTopologySubscriberAsync(eng.ConnectionSubscriber, gw)
+}
+
+func (gw *RESTGateway) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	gw.Lock()
+	gw.topology = topology
+	gw.Unlock()
+	done(true)
+}
+
+func (gw *RESTGateway) authenticate(req *http.Request) (*configuration.Topology, [sha256.Size]byte, map[string]*common.Capability, error) {
+	gw.RLock()
+	topology := gw.topology
+	gw.RUnlock()
+	if topology.IsBlank() || len(topology.Roots) == 0 {
+		return nil, [sha256.Size]byte{}, nil, newRESTError(http.StatusServiceUnavailable, "Cluster not yet formed")
+	}
+	if authenticated, fingerprint, roots := gw.httpListener.Authenticate(req, topology.Fingerprints()); authenticated {
+		return topology, fingerprint, roots, nil
+	}
+	return nil, [sha256.Size]byte{}, nil, newRESTError(http.StatusForbidden, "No client certificate known")
+}
+
+// idempotentResponseWriter captures the status and body of a response
+// so that its outcome can be recorded against an idempotency key.
+type idempotentResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (irw *idempotentResponseWriter) WriteHeader(status int) {
+	irw.status = status
+	irw.ResponseWriter.WriteHeader(status)
+}
+
+func (irw *idempotentResponseWriter) Write(b []byte) (int, error) {
+	if irw.status == 0 {
+		irw.status = http.StatusOK
+	}
+	irw.body.Write(b)
+	return irw.ResponseWriter.Write(b)
+}
+
+// idempotent invokes fun, which must return whether or not it
+// committed, unless the request carries an idempotency key that we
+// have already seen, in which case the original outcome is
+// replayed. Only commits are recorded: if the request errored or
+// failed to commit, the client may try again with the same key.
+func (gw *RESTGateway) idempotent(w http.ResponseWriter, req *http.Request, fingerprint [sha256.Size]byte, fun func(http.ResponseWriter) bool) {
+	key := req.Header.Get(restGatewayIdempotencyKey)
+	if key == "" {
+		fun(w)
+		return
+	} else if len(key) > server.IdempotencyKeyMaxLength {
+		gw.writeError(w, newRESTError(http.StatusBadRequest, "Idempotency key too long (max %v)", server.IdempotencyKeyMaxLength))
+		return
+	}
+
+	outcome, err := gw.idempotency.begin(fingerprint, key)
+	if err != nil {
+		gw.writeError(w, err)
+		return
+	} else if outcome != nil {
+		w.Header().Set(restGatewayIdempotentReplay, "true")
+		w.Header().Set(restGatewayIdempotencyDigest, hex.EncodeToString(outcome.Digest))
+		if outcome.Status == http.StatusNoContent {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			gw.writeJSON(w, &restTxnResponse{Committed: outcome.Committed})
+		}
+		return
+	}
+
+	irw := &idempotentResponseWriter{ResponseWriter: w}
+	committed := fun(irw)
+	if committed {
+		if err := gw.idempotency.finish(fingerprint, key, irw.status, committed, irw.body.Bytes()); err != nil {
+			log.Printf("REST gateway: unable to record idempotency key: %v\n", err)
+		}
+	} else {
+		gw.idempotency.abandon(fingerprint, key)
+	}
+}
+
+func (rvr *restVarReader) writeError(w http.ResponseWriter, err error) {
+	if re, ok := err.(restError); ok {
+		http.Error(w, re.Error(), re.status)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (rvr *restVarReader) writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		server.Log("REST gateway: error writing response:", err)
+	}
+}
+
+func (gw *RESTGateway) handleVar(w http.ResponseWriter, req *http.Request) {
+	topology, fingerprint, roots, err := gw.authenticate(req)
+	if err != nil {
+		gw.writeError(w, err)
+		return
+	}
+	rootName, path, err := parseRESTVarPath(strings.TrimPrefix(req.URL.Path, restGatewayVarsPrefix))
+	if err != nil {
+		gw.writeError(w, err)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		consistency, err := eng.ParseReadConsistency(req.URL.Query().Get("consistency"))
+		if err != nil {
+			gw.writeError(w, newRESTError(http.StatusBadRequest, "%v", err))
+			return
+		}
+		rv, err := gw.resolve(topology, roots, rootName, path, consistency)
+		if err == nil {
+			err = gw.readVar(rv, true)
+		}
+		if err != nil {
+			gw.writeError(w, err)
+			return
+		}
+		gw.writeJSON(w, rv.response())
+
+	case "PUT":
+		freeze, err := parseRESTFreeze(req.URL.Query().Get("freeze"))
+		if err != nil {
+			gw.writeError(w, err)
+			return
+		}
+		value, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, server.RESTGatewayMaxBodySize))
+		if err != nil {
+			gw.writeError(w, newRESTError(http.StatusBadRequest, "Unable to read request body: %v", err))
+			return
+		}
+		gw.idempotent(w, req, fingerprint, func(w http.ResponseWriter) bool {
+			return gw.putVar(w, topology, roots, rootName, path, value, freeze)
+		})
+
+	case "DELETE":
+		gw.deleteSubtree(w, topology, roots, rootName, path)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		gw.writeError(w, newRESTError(http.StatusMethodNotAllowed, "Method %v not allowed", req.Method))
+	}
+}
+
+func (gw *RESTGateway) putVar(w http.ResponseWriter, topology *configuration.Topology, roots map[string]*common.Capability, rootName string, path []int, value []byte, freeze bool) bool {
+	for attempt := 0; attempt < server.RESTGatewayMaxAttempts; attempt++ {
+		rv, err := gw.resolve(topology, roots, rootName, path, eng.ReadQuorum)
+		if err == nil {
+			err = gw.readVar(rv, false)
+		}
+		if err == nil {
+			err = rv.checkWritable()
+		}
+		var clock *eng.VectorClock
+		if err == nil {
+			// where possible, use a readwrite so that we can't
+			// clobber concurrent changes to the references.
+			action := &restAction{restVar: rv, read: rv.canRead(), write: value, freeze: freeze}
+			clock, err = gw.submit([]*restAction{action})
+		}
+		if err != nil {
+			gw.writeError(w, err)
+			return false
+		} else if clock != nil {
+			w.WriteHeader(http.StatusNoContent)
+			return true
+		}
+	}
+	gw.writeError(w, newRESTError(http.StatusConflict, "Unable to write: too much contention"))
+	return false
+}
+
+func (gw *RESTGateway) handleTxn(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		gw.writeError(w, newRESTError(http.StatusMethodNotAllowed, "Method %v not allowed", req.Method))
+		return
+	}
+	topology, fingerprint, roots, err := gw.authenticate(req)
+	if err != nil {
+		gw.writeError(w, err)
+		return
+	}
+	txnReq := &restTxnRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, server.RESTGatewayMaxBodySize)).Decode(txnReq); err != nil {
+		gw.writeError(w, newRESTError(http.StatusBadRequest, "Unable to decode txn: %v", err))
+		return
+	} else if len(txnReq.Actions) == 0 {
+		gw.writeError(w, newRESTError(http.StatusBadRequest, "Txn contains no actions"))
+		return
+	}
+
+	gw.idempotent(w, req, fingerprint, func(w http.ResponseWriter) bool {
+		return gw.runTxn(w, topology, roots, txnReq)
+	})
+}
+
+// handleDigests returns the range digests of this node. Vars held by
+// other nodes are not covered, so a client should always ask the same
+// node, and treat a change of RMId or BootCount as a change of every
+// range.
+func (gw *RESTGateway) handleDigests(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		gw.writeError(w, newRESTError(http.StatusMethodNotAllowed, "Method %v not allowed", req.Method))
+		return
+	}
+	if _, _, _, err := gw.authenticate(req); err != nil {
+		gw.writeError(w, err)
+		return
+	}
+	gw.writeJSON(w, &restDigestsResponse{
+		RMId:      gw.connectionManager.RMId,
+		BootCount: gw.connectionManager.BootCount(),
+		Ranges:    gw.connectionManager.Dispatchers.VarDispatcher.RangeDigests(),
+	})
+}
+
+func (gw *RESTGateway) runTxn(w http.ResponseWriter, topology *configuration.Topology, roots map[string]*common.Capability, txnReq *restTxnRequest) bool {
+	for attempt := 0; attempt < server.RESTGatewayMaxAttempts; attempt++ {
+		actions, err := gw.resolveTxn(topology, roots, txnReq)
+		var clock *eng.VectorClock
+		if err == nil {
+			clock, err = gw.submit(actions)
+		}
+		if err != nil {
+			gw.writeError(w, err)
+			return false
+		} else if clock != nil {
+			response := &restTxnResponse{
+				Committed: true,
+				Clock:     restClock(clock),
+				Results:   make([]*restVarResponse, len(actions)),
+			}
+			for idx, action := range actions {
+				if action.read {
+					response.Results[idx] = action.response()
+				}
+			}
+			gw.writeJSON(w, response)
+			return true
+		}
+	}
+	gw.writeJSON(w, &restTxnResponse{Committed: false})
+	return false
+}
+
+func (gw *RESTGateway) resolveTxn(topology *configuration.Topology, roots map[string]*common.Capability, txnReq *restTxnRequest) ([]*restAction, error) {
+	actions := make([]*restAction, len(txnReq.Actions))
+	seen := make(map[common.VarUUId]server.EmptyStruct, len(actions))
+	for idx, reqAction := range txnReq.Actions {
+		if !reqAction.Read && reqAction.Write == nil {
+			return nil, newRESTError(http.StatusBadRequest, "Action %v neither reads nor writes", idx)
+		} else if reqAction.Freeze && reqAction.Write == nil {
+			return nil, newRESTError(http.StatusBadRequest, "Action %v freezes without writing", idx)
+		} else if reqAction.Freeze && !server.FeatureEnabled(server.FeatureFrozenVars) {
+			return nil, errRESTFreezeUnsupported
+		}
+		rv, err := gw.resolve(topology, roots, reqAction.Root, reqAction.Path, eng.ReadQuorum)
+		if err == nil {
+			err = gw.readVar(rv, reqAction.Read)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if reqAction.Write != nil {
+			if err = rv.checkWritable(); err != nil {
+				return nil, err
+			}
+		}
+		if _, found := seen[*rv.vUUId]; found {
+			return nil, newRESTError(http.StatusBadRequest, "Txn contains multiple actions on %v", rv.vUUId)
+		}
+		seen[*rv.vUUId] = server.EmptyStructVal
+		actions[idx] = &restAction{
+			restVar: rv,
+			read:    reqAction.Read,
+			write:   reqAction.Write,
+			freeze:  reqAction.Freeze,
+		}
+	}
+	return actions, nil
+}
+
+func parseRESTFreeze(str string) (bool, error) {
+	if str == "" {
+		return false, nil
+	}
+	freeze, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, newRESTError(http.StatusBadRequest, "Invalid freeze '%s'", str)
+	} else if freeze && !server.FeatureEnabled(server.FeatureFrozenVars) {
+		return false, errRESTFreezeUnsupported
+	}
+	return freeze, nil
+}
+
+func parseRESTVarPath(str string) (string, []int, error) {
+	elems := strings.Split(strings.Trim(str, "/"), "/")
+	if len(elems[0]) == 0 {
+		return "", nil, newRESTError(http.StatusNotFound, "No root specified")
+	}
+	path := make([]int, len(elems)-1)
+	for idx, elem := range elems[1:] {
+		refIdx, err := strconv.Atoi(elem)
+		if err != nil {
+			return "", nil, newRESTError(http.StatusBadRequest, "Invalid reference index '%s'", elem)
+		}
+		path[idx] = refIdx
+	}
+	return elems[0], path, nil
+}
+
+// restVar is the gateway's view of a var: the positions and
+// capability through which it was reached, and, once read, its
+// current version, value and references.
+type restVar struct {
+	vUUId       *common.VarUUId
+	positions   *common.Positions
+	capability  *common.Capability
+	consistency eng.ReadConsistency
+	version     *common.TxnId
+	value       []byte
+	references  []msgs.VarIdPos
+	clock       eng.VectorClockInterface
+	frozen      bool
+}
+
+func (rv *restVar) canRead() bool {
+	cap := rv.capability.Which()
+	return cap == cmsgs.CAPABILITY_READ || cap == cmsgs.CAPABILITY_READWRITE
+}
+
+func (rv *restVar) canWrite() bool {
+	cap := rv.capability.Which()
+	return cap == cmsgs.CAPABILITY_WRITE || cap == cmsgs.CAPABILITY_READWRITE
+}
+
+// checkWritable returns an error unless the var may be written.
+func (rv *restVar) checkWritable() error {
+	switch {
+	case !rv.canWrite():
+		return newRESTError(http.StatusForbidden, "Write of %v not permitted", rv.vUUId)
+	case rv.frozen:
+		return newRESTError(http.StatusConflict, "%v is frozen", rv.vUUId)
+	default:
+		return nil
+	}
+}
+
+func (rv *restVar) response() *restVarResponse {
+	return &restVarResponse{
+		Version:     hex.EncodeToString(rv.version[:]),
+		Value:       rv.value,
+		References:  len(rv.references),
+		Consistency: rv.consistency.String(),
+		Clock:       restClock(rv.clock),
+		Frozen:      rv.frozen,
+	}
+}
+
+// restClock renders a vector clock for clients, keyed by VarUUId. A
+// var's clock element increases with every txn which writes it, so
+// clients can use clocks to order the versions they observe and to
+// detect concurrent updates. Native clients aren't given clocks: the
+// client schema has no way to carry them.
+func restClock(clock eng.VectorClockInterface) map[string]uint64 {
+	if clock == nil {
+		return nil
+	}
+	elems := make(map[string]uint64, clock.Len())
+	clock.ForEach(func(vUUId *common.VarUUId, v uint64) bool {
+		elems[vUUId.String()] = v
+		return true
+	})
+	return elems
+}
+
+func (rv *restVar) applyUpdates(updates *msgs.Update_List) bool {
+	for idx, l := 0, updates.Len(); idx < l; idx++ {
+		update := updates.At(idx)
+		actions := eng.TxnActionsFromData(update.Actions(), true).Actions()
+		for idy, m := 0, actions.Len(); idy < m; idy++ {
+			action := actions.At(idy)
+			if action.Which() == msgs.ACTION_WRITE && bytes.Equal(action.VarId(), rv.vUUId[:]) {
+				write := action.Write()
+				rv.version = common.MakeTxnId(update.TxnId())
+				rv.value = eng.ActionValue(&action, write.Value())
+				rv.references = write.References().ToArray()
+				rv.clock = eng.VectorClockFromData(update.Clock(), true)
+				rv.frozen = action.Frozen()
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (rv *restVar) clientReferences(seg *capn.Segment, varPosMap map[common.VarUUId]*common.Positions) cmsgs.ClientVarIdPos_List {
+	refs := cmsgs.NewClientVarIdPosList(seg, len(rv.references))
+	for idx, ref := range rv.references {
+		clientRef := refs.At(idx)
+		clientRef.SetVarId(ref.Id())
+		clientRef.SetCapability(ref.Capability())
+		positions := common.Positions(ref.Positions())
+		varPosMap[*common.MakeVarUUId(ref.Id())] = &positions
+	}
+	return refs
+}
+
+type restAction struct {
+	*restVar
+	read   bool
+	write  []byte
+	freeze bool
+}
+
+// restVarReader resolves and reads vars through the LocalConnection,
+// and writes responses, on behalf of the REST gateway and the
+// browser.
+type restVarReader struct {
+	connectionManager *ConnectionManager
+}
+
+func (rvr *restVarReader) resolve(topology *configuration.Topology, roots map[string]*common.Capability, rootName string, path []int, consistency eng.ReadConsistency) (*restVar, error) {
+	capability, found := roots[rootName]
+	if !found {
+		return nil, newRESTError(http.StatusNotFound, "Unknown root '%s'", rootName)
+	}
+	var rv *restVar
+	for idx, name := range topology.RootNames() {
+		if name == rootName {
+			root := topology.Roots[idx]
+			rv = &restVar{
+				vUUId:       root.VarUUId,
+				positions:   root.Positions,
+				capability:  capability,
+				consistency: consistency,
+			}
+			break
+		}
+	}
+	if rv == nil {
+		return nil, newRESTError(http.StatusNotFound, "Unknown root '%s'", rootName)
+	}
+	for _, refIdx := range path {
+		if err := rvr.readVar(rv, true); err != nil {
+			return nil, err
+		}
+		if refIdx < 0 || refIdx >= len(rv.references) {
+			return nil, newRESTError(http.StatusNotFound, "%v has no reference at index %v", rv.vUUId, refIdx)
+		}
+		ref := rv.references[refIdx]
+		positions := common.Positions(ref.Positions())
+		rv = &restVar{
+			vUUId:       common.MakeVarUUId(ref.Id()),
+			positions:   &positions,
+			capability:  common.NewCapability(ref.Capability()),
+			consistency: consistency,
+		}
+	}
+	return rv, nil
+}
+
+// readVar populates rv with the current version, value and references
+// of the var. It does this by reading the var at version zero: the
+// abort then carries the current state. If checkCapability is false,
+// the read is done even when the capability does not grant read: this
+// is needed to preserve references when only writing. Vars known to
+// be frozen are always read from here. For ReadLocal, if this node
+// holds the var then it is read from here; otherwise the read falls
+// back to ReadQuorum.
+func (rvr *restVarReader) readVar(rv *restVar, checkCapability bool) error {
+	if checkCapability && !rv.canRead() {
+		return newRESTError(http.StatusForbidden, "Read of %v not permitted", rv.vUUId)
+	}
+	frozenVars := rvr.connectionManager.Dispatchers.VarDispatcher.Frozen
+	var lr *eng.LocalRead
+	if rv.consistency == eng.ReadLocal {
+		lr = rvr.connectionManager.Dispatchers.VarDispatcher.LocalRead(rv.vUUId)
+	} else {
+		lr = frozenVars.Get(rv.vUUId)
+	}
+	if lr != nil {
+		rv.version = lr.Version
+		rv.value = lr.Value
+		rv.references = lr.References
+		rv.clock = lr.Clock
+		rv.frozen = lr.Frozen
+		return nil
+	}
+	rv.consistency = eng.ReadQuorum
+	for attempt := 0; attempt < server.RESTGatewayMaxAttempts; attempt++ {
+		seg := capn.NewBuffer(nil)
+		ctxn := cmsgs.NewClientTxn(seg)
+		ctxn.SetRetry(false)
+		actions := cmsgs.NewClientActionList(seg, 1)
+		action := actions.At(0)
+		action.SetVarId(rv.vUUId[:])
+		action.SetRead()
+		action.Read().SetVersion(common.VersionZero[:])
+		ctxn.SetActions(actions)
+		varPosMap := map[common.VarUUId]*common.Positions{*rv.vUUId: rv.positions}
+		_, outcome, err := rvr.connectionManager.localConnection.RunClientTransaction(&ctxn, varPosMap, nil)
+		switch {
+		case err != nil:
+			return err
+		case outcome == nil:
+			return errRESTShutdown
+		case outcome.Which() == msgs.OUTCOME_COMMIT:
+			return newRESTError(http.StatusNotFound, "%v has never been written", rv.vUUId)
+		}
+		abort := outcome.Abort()
+		if abort.Which() == msgs.OUTCOMEABORT_RESUBMIT {
+			continue
+		}
+		updates := abort.Rerun()
+		frozenVars.LearnFromUpdates(&updates)
+		if rv.applyUpdates(&updates) {
+			return nil
+		}
+		return newRESTError(http.StatusNotFound, "%v not found", rv.vUUId)
+	}
+	return newRESTError(http.StatusServiceUnavailable, "Unable to read %v: too much contention", rv.vUUId)
+}
+
+// submit runs the actions as a single txn. Vars which are written
+// keep their existing references. Returns the commit clock iff the
+// txn commits.
+func (gw *RESTGateway) submit(actions []*restAction) (*eng.VectorClock, error) {
+	seg := capn.NewBuffer(nil)
+	ctxn := cmsgs.NewClientTxn(seg)
+	ctxn.SetRetry(false)
+	clientActions := cmsgs.NewClientActionList(seg, len(actions))
+	varPosMap := make(map[common.VarUUId]*common.Positions, len(actions))
+	frozen := make(map[common.VarUUId]server.EmptyStruct)
+	for idx, action := range actions {
+		clientAction := clientActions.At(idx)
+		clientAction.SetVarId(action.vUUId[:])
+		varPosMap[*action.vUUId] = action.positions
+		if action.freeze {
+			frozen[*action.vUUId] = server.EmptyStructVal
+		}
+		switch {
+		case action.write == nil:
+			clientAction.SetRead()
+			clientAction.Read().SetVersion(action.version[:])
+		case action.read:
+			clientAction.SetReadwrite()
+			rw := clientAction.Readwrite()
+			rw.SetVersion(action.version[:])
+			rw.SetValue(action.write)
+			rw.SetReferences(action.clientReferences(seg, varPosMap))
+		default:
+			clientAction.SetWrite()
+			write := clientAction.Write()
+			write.SetValue(action.write)
+			write.SetReferences(action.clientReferences(seg, varPosMap))
+		}
+	}
+	ctxn.SetActions(clientActions)
+	var translationCallback eng.TranslationCallback
+	if len(frozen) != 0 {
+		translationCallback = func(cAction *cmsgs.ClientAction, action *msgs.Action, hashCodes []common.RMId, connections map[common.RMId]bool) error {
+			if _, found := frozen[*common.MakeVarUUId(action.VarId())]; found {
+				action.SetFrozen(true)
+			}
+			return nil
+		}
+	}
+	_, outcome, err := gw.connectionManager.localConnection.RunClientTransaction(&ctxn, varPosMap, translationCallback)
+	switch {
+	case err != nil:
+		return nil, err
+	case outcome == nil:
+		return nil, errRESTShutdown
+	case outcome.Which() == msgs.OUTCOME_COMMIT:
+		return eng.VectorClockFromData(outcome.Commit(), true), nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,182 @@
+package network
+
+import (
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	cmsgs "goshawkdb.io/common/capnp"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/client"
+	"goshawkdb.io/server/configuration"
+)
+
+// rootAppender appends values to a system root: the root's value
+// becomes the latest value, and the root's references are the most
+// recent values, newest first. Until the root has retain references,
+// each value is written into a new var. After that, the vars form a
+// fixed ring: each value overwrites the oldest var, which becomes the
+// first reference. So publishing never leaves vars unreachable, and
+// doesn't rely on the GarbageCollector (which is off by default). It
+// is used by the publishers which write into system roots
+// (MetricsPublisher, ClusterEventsPublisher), from a single
+// go-routine.
+//
+// Its cache remembers the root's version and references from its
+// last write, so normally a value is appended in a single txn. If
+// another node has written in the meantime, the write fails and
+// tells us the root's current state, and we try again. A topology
+// change forgets the cache.
+type rootAppender struct {
+	connectionManager *ConnectionManager
+	name              string
+	retain            int
+	maxAttempts       int
+	terminate         <-chan struct{}
+	topology          *configuration.Topology
+	cache             client.LocalTxnCache
+}
+
+func newRootAppender(cm *ConnectionManager, name string, retain, maxAttempts int, terminate <-chan struct{}) *rootAppender {
+	return &rootAppender{
+		connectionManager: cm,
+		name:              name,
+		retain:            retain,
+		maxAttempts:       maxAttempts,
+		terminate:         terminate,
+		cache:             make(client.LocalTxnCache),
+	}
+}
+
+// root returns the appender's root, provided some client is able to
+// read it.
+func (ra *rootAppender) root(topology *configuration.Topology) *configuration.Root {
+	for idx, name := range topology.RootNames() {
+		if name != ra.name {
+			continue
+		}
+		for _, roots := range topology.Fingerprints() {
+			if capability, found := roots[name]; found && (capability.Which() == cmsgs.CAPABILITY_READ || capability.Which() == cmsgs.CAPABILITY_READWRITE) {
+				return &topology.Roots[idx]
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// append writes value into the root. It returns false, with no
+// error, if there is no such root (or no client can read it), or if
+// we're shutting down.
+func (ra *rootAppender) append(topology *configuration.Topology, value []byte) (bool, error) {
+	if topology == nil || topology.IsBlank() {
+		return false, nil
+	}
+	root := ra.root(topology)
+	if root == nil {
+		return false, nil
+	}
+	if topology != ra.topology {
+		ra.topology = topology
+		ra.cache = make(client.LocalTxnCache)
+	}
+
+	var valueVUUId *common.VarUUId
+	txn, err := ra.connectionManager.localConnection.RunLocalTransaction(ra.cache, ra.maxAttempts, ra.terminate,
+		func(cache client.LocalTxnCache) (*cmsgs.ClientTxn, map[common.VarUUId]*common.Positions, error) {
+			rootVar, found := cache[*root.VarUUId]
+			if !found {
+				valueVUUId = nil
+				return client.ReadTxn(root.VarUUId, root.Positions), map[common.VarUUId]*common.Positions{*root.VarUUId: root.Positions}, nil
+			}
+			ctxn, varPosMap, vUUId := ra.write(root, rootVar, value)
+			valueVUUId = vUUId
+			return ctxn, varPosMap, nil
+		})
+	if err != nil {
+		return false, fmt.Errorf("Unable to write to %v: %v", ra.name, err)
+	} else if txn == nil || valueVUUId == nil {
+		// Shutdown, or the root has never been written.
+		return false, nil
+	}
+	// We never read the values back, so don't cache them.
+	delete(ra.cache, *valueVUUId)
+	return true, nil
+}
+
+// readRoot returns the current version, value and references of the
+// root. Returns a nil version if the root has never been written.
+// Reads go through the ConnectionManager's shared read cache.
+func (ra *rootAppender) readRoot(topology *configuration.Topology, root *configuration.Root) (*common.TxnId, []byte, []msgs.VarIdPos, error) {
+	rootVar, err := ra.connectionManager.readCache.Read(topology, root.VarUUId, root.Positions, ra.maxAttempts, ra.terminate)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Unable to read %v: %v", ra.name, err)
+	} else if rootVar == nil {
+		return nil, nil, nil, nil
+	}
+	return rootVar.Version, rootVar.Value, rootVar.References, nil
+}
+
+// write builds a txn which writes the value into a var, and makes
+// that var the root's first reference. If the root already has
+// retain references, the oldest is overwritten; otherwise a new var
+// is created. References beyond the number retained (if retain has
+// been lowered) are dropped. Returns the var written.
+func (ra *rootAppender) write(root *configuration.Root, rootVar *client.LocalVar, value []byte) (*cmsgs.ClientTxn, map[common.VarUUId]*common.Positions, *common.VarUUId) {
+	refs := rootVar.References
+	var oldest *msgs.VarIdPos
+	if len(refs) >= ra.retain {
+		oldest = &refs[ra.retain-1]
+		refs = refs[:ra.retain-1]
+	}
+
+	seg := capn.NewBuffer(nil)
+	ctxn := cmsgs.NewClientTxn(seg)
+	ctxn.SetRetry(false)
+	actions := cmsgs.NewClientActionList(seg, 2)
+	varPosMap := make(map[common.VarUUId]*common.Positions, len(refs)+1)
+	varPosMap[*root.VarUUId] = root.Positions
+
+	var valueVUUId *common.VarUUId
+	valueCapability := common.MaxCapability.Capability
+	valueAction := actions.At(1)
+	if oldest == nil {
+		valueVUUId = ra.connectionManager.localConnection.NextVarUUId()
+		valueAction.SetVarId(valueVUUId[:])
+		valueAction.SetCreate()
+		create := valueAction.Create()
+		create.SetValue(value)
+		create.SetReferences(cmsgs.NewClientVarIdPosList(seg, 0))
+	} else {
+		valueVUUId = common.MakeVarUUId(oldest.Id())
+		valueCapability = oldest.Capability()
+		positions := common.Positions(oldest.Positions())
+		varPosMap[*valueVUUId] = &positions
+		valueAction.SetVarId(valueVUUId[:])
+		valueAction.SetWrite()
+		write := valueAction.Write()
+		write.SetValue(value)
+		write.SetReferences(cmsgs.NewClientVarIdPosList(seg, 0))
+	}
+
+	rootAction := actions.At(0)
+	rootAction.SetVarId(root.VarUUId[:])
+	rootAction.SetReadwrite()
+	rw := rootAction.Readwrite()
+	rw.SetVersion(rootVar.Version[:])
+	rw.SetValue(value)
+	clientRefs := cmsgs.NewClientVarIdPosList(seg, len(refs)+1)
+	valueRef := clientRefs.At(0)
+	valueRef.SetVarId(valueVUUId[:])
+	valueRef.SetCapability(valueCapability)
+	for idx, ref := range refs {
+		clientRef := clientRefs.At(idx + 1)
+		clientRef.SetVarId(ref.Id())
+		clientRef.SetCapability(ref.Capability())
+		positions := common.Positions(ref.Positions())
+		varPosMap[*common.MakeVarUUId(ref.Id())] = &positions
+	}
+	rw.SetReferences(clientRefs)
+
+	ctxn.SetActions(actions)
+	return &ctxn, varPosMap, valueVUUId
+}
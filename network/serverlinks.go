@@ -0,0 +1,228 @@
+package network
+
+import (
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/paxos"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// serverLinks is the pool of parallel connections to a remote RM. The
+// primary connection is the one the ConnectionManager has always
+// had: it is established first. Messages are spread across the pool
+// by hashing their TxnId, so all the messages for a txn use the same
+// link and so arrive in order. Messages without a TxnId always use
+// the primary.
+//
+// A txn's link never changes whilst the pool exists: messages for a
+// link which is not yet established are held back, and sent over it,
+// in order, once it is. If a link is not established within
+// ServerLinkEstablishTimeout, its messages use the primary instead,
+// starting with those held back, and it is never established. Either
+// way, none of a txn's messages are ever sent over two different
+// connections, so per-txn FIFO (on which vote batching relies) holds.
+//
+// Both ends announce how many links they want in their handshake and
+// the pool has the smaller number. The end with the lower RMId dials
+// the extra links. The pool is torn down with its primary. If any
+// established link fails, the primary is shut down too: subscribers
+// are then told the connection was lost, just as if there were only
+// one connection, and so resend whatever might have been lost. In the
+// meantime, messages for the failed link are dropped.
+type serverLinks struct {
+	sync.Mutex
+	primary   serverLink
+	host      string
+	rmId      common.RMId
+	bootCount uint32
+	dialler   bool
+	links     []serverLink
+	states    []serverLinkState
+	held      [][][]byte
+	fallBack  *time.Timer
+}
+
+// serverLink is the part of a Connection used by the pool.
+type serverLink interface {
+	Send(msg []byte)
+	Shutdown(sync paxos.Blocking)
+	Status(sc *server.StatusConsumer)
+}
+
+type serverLinkState uint8
+
+const (
+	serverLinkPending     serverLinkState = iota // messages are held back
+	serverLinkEstablished serverLinkState = iota // messages are sent over the link
+	serverLinkPrimary     serverLinkState = iota // messages are sent over the primary
+	serverLinkLost        serverLinkState = iota // messages are dropped
+)
+
+func newServerLinks(cm *ConnectionManager, primary *connectionManagerMsgServerEstablished, count int) *serverLinks {
+	sl := makeServerLinks(primary.Connection, count)
+	sl.host = primary.host
+	sl.rmId = primary.rmId
+	sl.bootCount = primary.bootCount
+	sl.dialler = cm.RMId < primary.rmId
+	if sl.dialler {
+		for link := 1; link < count; link++ {
+			sl.links[link] = newConnectionToDialLink(sl.host, cm, uint8(link))
+		}
+	}
+	sl.fallBack = time.AfterFunc(server.ServerLinkEstablishTimeout, sl.usePrimary)
+	return sl
+}
+
+func makeServerLinks(primary serverLink, count int) *serverLinks {
+	sl := &serverLinks{
+		primary: primary,
+		links:   make([]serverLink, count),
+		states:  make([]serverLinkState, count),
+		held:    make([][][]byte, count),
+	}
+	sl.links[0] = primary
+	sl.states[0] = serverLinkEstablished
+	return sl
+}
+
+// serverLinkCount is the number of links in the pool to a remote RM
+// which announced that it wants remoteLinks links.
+func serverLinkCount(localLinks, remoteLinks uint8, remoteFeatures uint32) int {
+	count := localLinks
+	if remoteFeatures < server.FeatureServerLinks {
+		count = 1
+	} else if remoteLinks < count {
+		count = remoteLinks
+	}
+	if count == 0 {
+		count = 1
+	}
+	return int(count)
+}
+
+func (sl *serverLinks) Send(msg []byte) {
+	idx := 0
+	if seg, _, err := capn.ReadFromMemoryZeroCopy(msg); err == nil {
+		if txnId := paxos.MessageTxnId(msgs.ReadRootMessage(seg)); txnId != nil {
+			idx = sl.linkFor(txnId)
+		}
+	}
+	sl.Lock()
+	defer sl.Unlock()
+	switch sl.states[idx] {
+	case serverLinkEstablished:
+		sl.links[idx].Send(msg)
+	case serverLinkPending:
+		sl.held[idx] = append(sl.held[idx], msg)
+	case serverLinkPrimary:
+		sl.primary.Send(msg)
+	}
+}
+
+// linkFor only depends on the size of the pool, which never changes.
+func (sl *serverLinks) linkFor(txnId *common.TxnId) int {
+	hash := fnv.New32a()
+	hash.Write(txnId[:])
+	return int(hash.Sum32() % uint32(len(sl.links)))
+}
+
+// linkEstablished returns false if conn may not join the pool as
+// link, in which case it must be shut down. Otherwise, the messages
+// held back for the link are sent over it.
+func (sl *serverLinks) linkEstablished(conn serverLink, bootCount uint32, link uint8) bool {
+	sl.Lock()
+	defer sl.Unlock()
+	idx := int(link)
+	switch {
+	case bootCount != sl.bootCount || idx == 0 || idx >= len(sl.links) || sl.states[idx] != serverLinkPending:
+		return false
+	case sl.dialler && sl.links[idx] != conn:
+		return false
+	}
+	sl.links[idx] = conn
+	sl.states[idx] = serverLinkEstablished
+	for _, msg := range sl.held[idx] {
+		conn.Send(msg)
+	}
+	sl.held[idx] = nil
+	return true
+}
+
+// linkLost returns true iff conn was an established link in the pool.
+func (sl *serverLinks) linkLost(conn serverLink, link uint8) bool {
+	sl.Lock()
+	defer sl.Unlock()
+	idx := int(link)
+	if idx == 0 || idx >= len(sl.links) || sl.links[idx] != conn || sl.states[idx] != serverLinkEstablished {
+		return false
+	}
+	sl.states[idx] = serverLinkLost
+	return true
+}
+
+// usePrimary gives up on the links not yet established: their
+// messages are sent over the primary from now on, starting with those
+// held back. None of them has been sent over the link, so each txn
+// still only ever uses one connection.
+func (sl *serverLinks) usePrimary() {
+	sl.Lock()
+	defer sl.Unlock()
+	for idx, state := range sl.states {
+		if state != serverLinkPending {
+			continue
+		}
+		sl.states[idx] = serverLinkPrimary
+		for _, msg := range sl.held[idx] {
+			sl.primary.Send(msg)
+		}
+		sl.held[idx] = nil
+		if conn := sl.links[idx]; conn != nil {
+			sl.links[idx] = nil
+			conn.Shutdown(paxos.Async)
+		}
+	}
+}
+
+// shutdown shuts down every link in the pool except the primary.
+// Messages for them are dropped from now on.
+func (sl *serverLinks) shutdown(sync paxos.Blocking) {
+	sl.Lock()
+	if sl.fallBack != nil {
+		sl.fallBack.Stop()
+	}
+	links := make([]serverLink, 0, len(sl.links)-1)
+	for idx := 1; idx < len(sl.links); idx++ {
+		if sl.links[idx] != nil {
+			links = append(links, sl.links[idx])
+		}
+		sl.links[idx] = nil
+		sl.states[idx] = serverLinkLost
+		sl.held[idx] = nil
+	}
+	sl.Unlock()
+	for _, conn := range links {
+		conn.Shutdown(sync)
+	}
+}
+
+func (sl *serverLinks) status(sc *server.StatusConsumer) {
+	sl.Lock()
+	defer sl.Unlock()
+	counts := make(map[serverLinkState]int)
+	for _, state := range sl.states {
+		counts[state]++
+	}
+	sc.Emit(fmt.Sprintf("Server links to %v (%v): %v of %v established; %v pending; %v using the primary; %v lost; dialler? %v",
+		sl.host, sl.rmId, counts[serverLinkEstablished], len(sl.links), counts[serverLinkPending], counts[serverLinkPrimary], counts[serverLinkLost], sl.dialler))
+	for _, conn := range sl.links[1:] {
+		if conn != nil {
+			conn.Status(sc.Fork())
+		}
+	}
+	sc.Join()
+}
@@ -0,0 +1,97 @@
+package network
+
+import (
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/paxos"
+	"sync"
+	"testing"
+)
+
+// testServerLink records the messages sent over it, in order.
+type testServerLink struct {
+	sync.Mutex
+	sent [][]byte
+}
+
+func (tsl *testServerLink) Send(msg []byte) {
+	tsl.Lock()
+	tsl.sent = append(tsl.sent, msg)
+	tsl.Unlock()
+}
+func (tsl *testServerLink) Shutdown(blocking paxos.Blocking) {}
+func (tsl *testServerLink) Status(sc *server.StatusConsumer) {}
+
+type testServerLinkMsg struct {
+	txn int
+	seq int
+}
+
+// Links become established (or fall back to the primary) whilst
+// messages are being sent. Every txn's messages must all use one
+// connection, and arrive in the order they were sent.
+func TestServerLinksPerTxnOrder(t *testing.T) {
+	const links, txns, msgsPerTxn = 4, 64, 32
+	primary := &testServerLink{}
+	sl := makeServerLinks(primary, links)
+	conns := []*testServerLink{primary}
+	for idx := 1; idx < links; idx++ {
+		conns = append(conns, &testServerLink{})
+	}
+
+	msgIds := make(map[*byte]testServerLinkMsg)
+	toSend := make([][]byte, 0, txns*msgsPerTxn)
+	for seq := 0; seq < msgsPerTxn; seq++ {
+		for txn := 0; txn < txns; txn++ {
+			id := make([]byte, common.KeyLen)
+			id[0], id[1] = byte(txn), byte(txn>>8)
+			msg := paxos.MakeTxnSubmissionCompleteMsg(common.MakeTxnId(id))
+			msgIds[&msg[0]] = testServerLinkMsg{txn: txn, seq: seq}
+			toSend = append(toSend, msg)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, msg := range toSend {
+			sl.Send(msg)
+		}
+	}()
+	// The last link never becomes established, so falls back to the
+	// primary.
+	for idx := 1; idx < links-1; idx++ {
+		if !sl.linkEstablished(conns[idx], 0, uint8(idx)) {
+			t.Fatalf("Link %v refused", idx)
+		}
+	}
+	sl.usePrimary()
+	<-done
+	if sl.linkEstablished(conns[links-1], 0, uint8(links-1)) {
+		t.Fatal("Link established after falling back to the primary")
+	}
+
+	connOfTxn := make(map[int]int)
+	nextSeq := make(map[int]int)
+	for idx, conn := range conns {
+		for _, msg := range conn.sent {
+			m := msgIds[&msg[0]]
+			if c, found := connOfTxn[m.txn]; found && c != idx {
+				t.Fatalf("Txn %v sent over connections %v and %v", m.txn, c, idx)
+			}
+			connOfTxn[m.txn] = idx
+			if m.seq != nextSeq[m.txn] {
+				t.Fatalf("Txn %v: expected message %v; received %v", m.txn, nextSeq[m.txn], m.seq)
+			}
+			nextSeq[m.txn]++
+		}
+	}
+	for txn := 0; txn < txns; txn++ {
+		if nextSeq[txn] != msgsPerTxn {
+			t.Fatalf("Txn %v: %v of %v messages sent", txn, nextSeq[txn], msgsPerTxn)
+		}
+	}
+	if len(conns[links-1].sent) != 0 {
+		t.Fatal("Messages sent over a link which was never established")
+	}
+}
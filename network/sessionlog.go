@@ -0,0 +1,331 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goshawkdb.io/server"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A SessionLog records when clients connect, authenticate and
+// disconnect to a fixed size ring file, so that after an incident it
+// is possible to work out which clients were connected when, without
+// debug logging having been enabled. Unlike a paxos.Capture, an
+// existing file is carried on from rather than truncated, so that the
+// events leading up to a restart survive it. All the methods are safe
+// to call on a nil *SessionLog, which records nothing.
+//
+// The file starts with a header of magic (8 bytes), oldest record
+// offset (8), write offset (8) and record count (8). Each record is
+// length (4) and then the event as JSON, where length covers the
+// whole record. A length of 0 marks the point at which the writer
+// wrapped back to the start.
+type SessionLog struct {
+	sync.Mutex
+	file        *os.File
+	size        int64
+	records     []sessionLogRecordPos
+	writeOffset int64
+	seq         uint64
+	header      [sessionLogHeaderLen]byte
+}
+
+type sessionLogRecordPos struct {
+	offset int64
+	length int64
+}
+
+const (
+	sessionLogMagic           = "GSDBSES1"
+	sessionLogHeaderLen       = 32
+	sessionLogRecordHeaderLen = 4
+)
+
+const (
+	SessionStart        = "start"
+	SessionConnect      = "connect"
+	SessionAuthenticate = "authenticate"
+	SessionDisconnect   = "disconnect"
+)
+
+// SessionEvent is a single record in a SessionLog. Connection numbers
+// are only unique between start events: every session open at a
+// start event ended with the previous run of the server.
+type SessionEvent struct {
+	Seq         uint64    `json:"seq"`
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Connection  uint32    `json:"connection,omitempty"`
+	Host        string    `json:"host,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+func (se *SessionEvent) String() string {
+	str := fmt.Sprintf("%v %v %v", se.Time.Format(time.RFC3339Nano), se.Seq, se.Event)
+	if se.Event == SessionStart {
+		return str
+	}
+	str += fmt.Sprintf(" client connection %v from %v", se.Connection, se.Host)
+	if se.Fingerprint != "" {
+		str += fmt.Sprintf("; fingerprint %v", se.Fingerprint)
+	}
+	if se.Reason != "" {
+		str += fmt.Sprintf("; %v", se.Reason)
+	}
+	return str
+}
+
+func NewSessionLog(path string, size int64) (*SessionLog, error) {
+	if size < sessionLogHeaderLen+sessionLogRecordHeaderLen {
+		return nil, fmt.Errorf("Session log file size too small: %v", size)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sl := &SessionLog{
+		file:        file,
+		size:        size,
+		writeOffset: sessionLogHeaderLen,
+	}
+	copy(sl.header[:], sessionLogMagic)
+	if err = sl.resume(); err != nil {
+		log.Printf("SessionLog: starting afresh with %v: %v", path, err)
+		sl.records, sl.seq, sl.writeOffset = nil, 0, sessionLogHeaderLen
+		err = file.Truncate(0)
+	}
+	if err == nil {
+		err = sl.writeHeader()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	sl.record(&SessionEvent{Event: SessionStart})
+	return sl, nil
+}
+
+// resume picks up from the records already in the file, if any.
+func (sl *SessionLog) resume() error {
+	data, err := ioutil.ReadAll(sl.file)
+	if err != nil {
+		return err
+	} else if len(data) == 0 {
+		return nil
+	} else if int64(len(data)) > sl.size {
+		return fmt.Errorf("File is larger than %v bytes", sl.size)
+	}
+	writeOffset, err := scanSessionLog(data, func(offset, length int64, event *SessionEvent) error {
+		sl.records = append(sl.records, sessionLogRecordPos{offset: offset, length: length})
+		sl.seq = event.Seq
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sl.writeOffset = writeOffset
+	return nil
+}
+
+func (sl *SessionLog) Close() {
+	if sl == nil {
+		return
+	}
+	sl.Lock()
+	defer sl.Unlock()
+	if sl.file != nil {
+		sl.file.Close()
+		sl.file = nil
+	}
+}
+
+func (sl *SessionLog) connected(conn *Connection) {
+	if sl == nil {
+		return
+	}
+	sl.record(&SessionEvent{
+		Event:      SessionConnect,
+		Connection: conn.ConnectionNumber,
+		Host:       conn.remoteHost,
+	})
+}
+
+func (sl *SessionLog) authenticated(conn *Connection) {
+	if sl == nil {
+		return
+	}
+	sl.record(&SessionEvent{
+		Event:       SessionAuthenticate,
+		Connection:  conn.ConnectionNumber,
+		Host:        conn.remoteHost,
+		Fingerprint: hex.EncodeToString(conn.clientStats.fingerprint[:]),
+	})
+}
+
+func (sl *SessionLog) disconnected(conn *Connection, err error) {
+	if sl == nil {
+		return
+	}
+	event := &SessionEvent{
+		Event:      SessionDisconnect,
+		Connection: conn.ConnectionNumber,
+		Host:       conn.remoteHost,
+		Reason:     "closed",
+	}
+	if conn.clientStats != nil {
+		event.Fingerprint = hex.EncodeToString(conn.clientStats.fingerprint[:])
+	}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+	sl.record(event)
+}
+
+func (sl *SessionLog) record(event *SessionEvent) {
+	sl.Lock()
+	defer sl.Unlock()
+	if sl.file == nil {
+		return
+	}
+	sl.seq++
+	event.Seq = sl.seq
+	event.Time = time.Now()
+	data, err := json.Marshal(event)
+	if err != nil {
+		server.Log("SessionLog: unable to encode event:", err)
+		return
+	}
+	recLen := int64(sessionLogRecordHeaderLen + len(data))
+	if recLen > sl.size-sessionLogHeaderLen {
+		server.Log("SessionLog: event too large to record:", recLen)
+		return
+	}
+
+	if sl.writeOffset+recLen > sl.size {
+		// Wrap. Everything from the current write offset to the end
+		// of the file is lost.
+		for len(sl.records) != 0 && sl.records[0].offset >= sl.writeOffset {
+			sl.records = sl.records[1:]
+		}
+		if sl.writeOffset+4 <= sl.size {
+			if _, err := sl.file.WriteAt([]byte{0, 0, 0, 0}, sl.writeOffset); err != nil {
+				sl.failed(err)
+				return
+			}
+		}
+		sl.writeOffset = sessionLogHeaderLen
+	}
+	end := sl.writeOffset + recLen
+	for len(sl.records) != 0 && sl.records[0].offset >= sl.writeOffset && sl.records[0].offset < end {
+		sl.records = sl.records[1:]
+	}
+
+	rec := make([]byte, recLen)
+	binary.BigEndian.PutUint32(rec[0:4], uint32(recLen))
+	copy(rec[sessionLogRecordHeaderLen:], data)
+	if _, err := sl.file.WriteAt(rec, sl.writeOffset); err != nil {
+		sl.failed(err)
+		return
+	}
+	sl.records = append(sl.records, sessionLogRecordPos{offset: sl.writeOffset, length: recLen})
+	sl.writeOffset = end
+	if err := sl.writeHeader(); err != nil {
+		sl.failed(err)
+	}
+}
+
+func (sl *SessionLog) writeHeader() error {
+	oldest := sl.writeOffset
+	if len(sl.records) != 0 {
+		oldest = sl.records[0].offset
+	}
+	binary.BigEndian.PutUint64(sl.header[8:16], uint64(oldest))
+	binary.BigEndian.PutUint64(sl.header[16:24], uint64(sl.writeOffset))
+	binary.BigEndian.PutUint64(sl.header[24:32], uint64(len(sl.records)))
+	_, err := sl.file.WriteAt(sl.header[:], 0)
+	return err
+}
+
+func (sl *SessionLog) failed(err error) {
+	log.Println("SessionLog: error writing; recording stopped:", err)
+	sl.file.Close()
+	sl.file = nil
+}
+
+func (sl *SessionLog) Status(sc *server.StatusConsumer) {
+	if sl == nil {
+		sc.Emit("Session log: disabled")
+	} else {
+		sl.Lock()
+		sc.Emit(fmt.Sprintf("Session log: %v events held; %v written", len(sl.records), sl.seq))
+		sl.Unlock()
+	}
+	sc.Join()
+}
+
+// ReadSessionLog invokes fun on every event in the session log file
+// at path, oldest first.
+func ReadSessionLog(path string, fun func(*SessionEvent) error) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = scanSessionLog(data, func(offset, length int64, event *SessionEvent) error {
+		return fun(event)
+	})
+	return err
+}
+
+// scanSessionLog invokes fun on every record in data, oldest first,
+// and returns the write offset.
+func scanSessionLog(data []byte, fun func(offset, length int64, event *SessionEvent) error) (int64, error) {
+	if len(data) < sessionLogHeaderLen || !bytes.Equal(data[:8], []byte(sessionLogMagic)) {
+		return 0, errors.New("Not a session log file")
+	}
+	oldest := int64(binary.BigEndian.Uint64(data[8:16]))
+	writeOffset := int64(binary.BigEndian.Uint64(data[16:24]))
+	count := binary.BigEndian.Uint64(data[24:32])
+	size := int64(len(data))
+	if oldest < sessionLogHeaderLen || oldest > size || writeOffset < sessionLogHeaderLen || writeOffset > size {
+		return 0, errors.New("Corrupt session log file header")
+	} else if count == 0 {
+		return writeOffset, nil
+	}
+
+	read := func(from, to int64) error {
+		for pos := from; pos+4 <= to; {
+			recLen := int64(binary.BigEndian.Uint32(data[pos : pos+4]))
+			if recLen == 0 {
+				return nil // wrap marker
+			} else if recLen < sessionLogRecordHeaderLen || pos+recLen > to {
+				return fmt.Errorf("Corrupt session log record at %v", pos)
+			}
+			event := new(SessionEvent)
+			if err := json.Unmarshal(data[pos+sessionLogRecordHeaderLen:pos+recLen], event); err != nil {
+				return fmt.Errorf("Corrupt session log record at %v: %v", pos, err)
+			}
+			if err := fun(pos, recLen, event); err != nil {
+				return err
+			}
+			pos += recLen
+		}
+		return nil
+	}
+
+	if oldest < writeOffset {
+		return writeOffset, read(oldest, writeOffset)
+	}
+	if err := read(oldest, size); err != nil {
+		return 0, err
+	}
+	return writeOffset, read(sessionLogHeaderLen, writeOffset)
+}
@@ -0,0 +1,156 @@
+package network
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/configuration"
+	"goshawkdb.io/server/paxos"
+	eng "goshawkdb.io/server/txnengine"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	standbyPendingOutcomes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "standby_pending_outcomes",
+		Help:      "Number of outcomes held by this node's acceptors which each learner has yet to learn.",
+	}, []string{"rmid"})
+	standbyLagSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "standby_lag_seconds",
+		Help:      "Age of the oldest outcome held by this node's acceptors which each learner has yet to learn.",
+	}, []string{"rmid"})
+)
+
+func init() {
+	prometheus.MustRegister(standbyPendingOutcomes)
+	prometheus.MustRegister(standbyLagSeconds)
+}
+
+// StandbyMonitor periodically checks that the learners of the
+// configuration are keeping up. Every outcome of a txn which a
+// learner learns is held by our acceptors until the learner confirms
+// it has learnt it, so the number and age of such outcomes show how
+// far behind the learner is. A learner which is down or cut off
+// shows up as a steadily growing lag. If the lag exceeds
+// StandbyLagWarn, a warning is logged.
+type StandbyMonitor struct {
+	sync.Mutex
+	connectionManager *ConnectionManager
+	interval          time.Duration
+	topology          *configuration.Topology
+	learners          common.RMIds // only used by run
+	lags              map[common.RMId]*paxos.LearnerLag
+	lastChecked       time.Time
+	terminate         chan struct{}
+	terminated        chan struct{}
+}
+
+func NewStandbyMonitor(cm *ConnectionManager, interval time.Duration) *StandbyMonitor {
+	sm := &StandbyMonitor{
+		connectionManager: cm,
+		interval:          interval,
+		terminate:         make(chan struct{}),
+		terminated:        make(chan struct{}),
+	}
+	sm.topology = cm.AddTopologySubscriber(eng.ConnectionSubscriber, sm)
+	go sm.run()
+	return sm
+}
+
+func (sm *StandbyMonitor) Shutdown() {
+	sm.connectionManager.RemoveTopologySubscriberAsync(eng.ConnectionSubscriber, sm)
+	close(sm.terminate)
+	<-sm.terminated
+}
+
+func (sm *StandbyMonitor) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	sm.Lock()
+	sm.topology = topology
+	sm.Unlock()
+	done(true)
+}
+
+func (sm *StandbyMonitor) Status(sc *server.StatusConsumer) {
+	sm.Lock()
+	defer sm.Unlock()
+	if sm.interval == 0 {
+		sc.Emit("Standby monitor: disabled")
+	} else if len(sm.lags) == 0 {
+		sc.Emit(fmt.Sprintf("Standby monitor: every %v; no learners", sm.interval))
+	} else {
+		sc.Emit(fmt.Sprintf("Standby monitor: every %v; last checked %v", sm.interval, sm.lastChecked))
+		for rmId, lag := range sm.lags {
+			sc.Emit(fmt.Sprintf("- Learner %v: %v pending; oldest %v", rmId, lag.Pending, lag.Oldest))
+		}
+	}
+	sc.Join()
+}
+
+func (sm *StandbyMonitor) run() {
+	defer close(sm.terminated)
+	if sm.interval == 0 {
+		<-sm.terminate
+		return
+	}
+	ticker := time.NewTicker(sm.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sm.terminate:
+			return
+		case <-ticker.C:
+		}
+		sm.check()
+	}
+}
+
+func (sm *StandbyMonitor) check() {
+	sm.Lock()
+	topology := sm.topology
+	sm.Unlock()
+	var learners common.RMIds
+	if topology != nil && !topology.IsBlank() {
+		learners = topology.LearnerRMs()
+	}
+
+	// Forget the learners which have gone, so they don't linger in
+	// the metrics.
+	current := make(map[common.RMId]server.EmptyStruct, len(learners))
+	for _, rmId := range learners {
+		current[rmId] = server.EmptyStructVal
+	}
+	for _, rmId := range sm.learners {
+		if _, found := current[rmId]; !found {
+			standbyPendingOutcomes.DeleteLabelValues(fmt.Sprint(rmId))
+			standbyLagSeconds.DeleteLabelValues(fmt.Sprint(rmId))
+		}
+	}
+	sm.learners = learners
+
+	var lags map[common.RMId]*paxos.LearnerLag
+	now := time.Now()
+	if len(learners) != 0 {
+		lags = sm.connectionManager.Dispatchers.AcceptorDispatcher.LearnerLags(learners)
+	}
+	for rmId, lag := range lags {
+		behind := time.Duration(0)
+		if !lag.Oldest.IsZero() {
+			behind = now.Sub(lag.Oldest)
+		}
+		standbyPendingOutcomes.WithLabelValues(fmt.Sprint(rmId)).Set(float64(lag.Pending))
+		standbyLagSeconds.WithLabelValues(fmt.Sprint(rmId)).Set(behind.Seconds())
+		if behind > server.StandbyLagWarn {
+			log.Printf("Warning: learner %v is %v behind, with %v outcomes still to learn.\n", rmId, behind, lag.Pending)
+		}
+	}
+
+	sm.Lock()
+	sm.lags = lags
+	sm.lastChecked = now
+	sm.Unlock()
+}
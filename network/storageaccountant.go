@@ -0,0 +1,332 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	mdb "github.com/msackman/gomdb"
+	mdbs "github.com/msackman/gomdb/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/configuration"
+	"goshawkdb.io/server/db"
+	eng "goshawkdb.io/server/txnengine"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	rootStorageVars = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "root_storage_vars",
+		Help:      "Number of locally stored vars reachable from each root.",
+	}, []string{"root"})
+	rootStorageBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "root_storage_bytes",
+		Help:      "Bytes of locally stored vars (and their current values) reachable from each root.",
+	}, []string{"root"})
+	rootWidestReferences = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "root_widest_var_references",
+		Help:      "Most references held by any locally stored var reachable from each root.",
+	}, []string{"root"})
+)
+
+func init() {
+	prometheus.MustRegister(rootStorageVars)
+	prometheus.MustRegister(rootStorageBytes)
+	prometheus.MustRegister(rootWidestReferences)
+}
+
+// StorageAccountant periodically walks the reference graph from each
+// root, attributing var counts and bytes to the root from which they
+// are reachable. The walk only covers vars held by this node: a var
+// which is only reachable through vars held elsewhere is not
+// attributed. A var reachable from several roots is attributed to the
+// first of them (in root name order). The walk is done in small
+// batches, each in its own read-only txn, with a delay between
+// batches so that it doesn't compete with normal work. The walk also
+// finds the vars with the most references, which make every txn
+// writing them, and every update of them sent to clients, large.
+type StorageAccountant struct {
+	sync.Mutex
+	connectionManager *ConnectionManager
+	db                *db.Databases
+	topology          *configuration.Topology
+	usage             map[string]*storageUsage
+	widest            widestVars
+	completed         time.Time
+	duration          time.Duration
+	terminate         chan struct{}
+	terminated        chan struct{}
+}
+
+type storageUsage struct {
+	vars       uint64
+	bytes      uint64
+	widestRefs int
+}
+
+type widestVar struct {
+	VarUUId    string
+	Root       string
+	References int
+}
+
+// widestVars holds at most server.WidestVarsReported vars, most
+// references first.
+type widestVars []*widestVar
+
+func (wv widestVars) add(vUUId *common.VarUUId, root string, refs int) widestVars {
+	if refs == 0 || (len(wv) == server.WidestVarsReported && refs <= wv[len(wv)-1].References) {
+		return wv
+	}
+	if len(wv) == server.WidestVarsReported {
+		wv = wv[:len(wv)-1]
+	}
+	wv = append(wv, &widestVar{VarUUId: hex.EncodeToString(vUUId[:]), Root: root, References: refs})
+	sort.Sort(wv)
+	return wv
+}
+
+func (wv widestVars) Len() int           { return len(wv) }
+func (wv widestVars) Less(i, j int) bool { return wv[i].References > wv[j].References }
+func (wv widestVars) Swap(i, j int)      { wv[i], wv[j] = wv[j], wv[i] }
+
+func NewStorageAccountant(db *db.Databases, cm *ConnectionManager) *StorageAccountant {
+	sa := &StorageAccountant{
+		connectionManager: cm,
+		db:                db,
+		terminate:         make(chan struct{}),
+		terminated:        make(chan struct{}),
+	}
+	sa.topology = cm.AddTopologySubscriber(eng.ConnectionSubscriber, sa)
+	go sa.run()
+	return sa
+}
+
+func (sa *StorageAccountant) Shutdown() {
+	sa.connectionManager.RemoveTopologySubscriberAsync(eng.ConnectionSubscriber, sa)
+	close(sa.terminate)
+	<-sa.terminated
+}
+
+func (sa *StorageAccountant) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	sa.Lock()
+	sa.topology = topology
+	sa.Unlock()
+	done(true)
+}
+
+func (sa *StorageAccountant) Status(sc *server.StatusConsumer) {
+	sa.Lock()
+	defer sa.Unlock()
+	if sa.usage == nil {
+		sc.Emit("Storage usage: not yet calculated")
+	} else {
+		sc.Emit(fmt.Sprintf("Storage usage (calculated %v; took %v):", sa.completed, sa.duration))
+		for name, usage := range sa.usage {
+			sc.Emit(fmt.Sprintf("- %v: %v vars; %v bytes; widest var has %v references", name, usage.vars, usage.bytes, usage.widestRefs))
+		}
+	}
+	sc.Join()
+}
+
+// ServeWidestVars writes, as JSON, the locally stored vars with the
+// most references found by the most recent walk.
+func (sa *StorageAccountant) ServeWidestVars(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sa.Lock()
+	report := struct {
+		Completed time.Time
+		Vars      widestVars
+	}{
+		Completed: sa.completed,
+		Vars:      sa.widest,
+	}
+	sa.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Usage returns the number of vars attributed to the named root by
+// the most recent walk.
+func (sa *StorageAccountant) Usage(root string) (uint64, bool) {
+	sa.Lock()
+	defer sa.Unlock()
+	if usage, found := sa.usage[root]; found {
+		return usage.vars, true
+	}
+	return 0, false
+}
+
+func (sa *StorageAccountant) run() {
+	defer close(sa.terminated)
+	ticker := time.NewTicker(server.StorageAccountingInterval)
+	defer ticker.Stop()
+	for {
+		if err := sa.walk(); err != nil {
+			log.Println("Storage accounting error:", err)
+		}
+		select {
+		case <-sa.terminate:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (sa *StorageAccountant) walk() error {
+	sa.Lock()
+	topology := sa.topology
+	sa.Unlock()
+	if topology == nil || topology.IsBlank() || len(topology.Roots) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	names := topology.RootNames()
+	usage := make(map[string]*storageUsage, len(names))
+	visited := make(map[common.VarUUId]server.EmptyStruct)
+	var widest widestVars
+	for idx, name := range names {
+		rootUsage := &storageUsage{}
+		usage[name] = rootUsage
+		queue := []*common.VarUUId{topology.Roots[idx].VarUUId}
+		for len(queue) != 0 {
+			batchSize := server.StorageAccountingBatchSize
+			if batchSize > len(queue) {
+				batchSize = len(queue)
+			}
+			batch := queue[:batchSize]
+			queue = queue[batchSize:]
+			found, err := sa.walkBatch(batch, visited, name, rootUsage, &widest)
+			if err != nil {
+				return err
+			}
+			queue = append(queue, found...)
+			select {
+			case <-sa.terminate:
+				return nil
+			case <-time.After(server.StorageAccountingBatchDelay):
+			}
+		}
+	}
+
+	rootStorageVars.Reset()
+	rootStorageBytes.Reset()
+	rootWidestReferences.Reset()
+	for name, rootUsage := range usage {
+		rootStorageVars.WithLabelValues(name).Set(float64(rootUsage.vars))
+		rootStorageBytes.WithLabelValues(name).Set(float64(rootUsage.bytes))
+		rootWidestReferences.WithLabelValues(name).Set(float64(rootUsage.widestRefs))
+	}
+	sa.Lock()
+	sa.usage = usage
+	sa.widest = widest
+	sa.completed = time.Now()
+	sa.duration = sa.completed.Sub(start)
+	sa.Unlock()
+	return nil
+}
+
+// walkBatch accounts for the vars in batch and returns the (as yet
+// unvisited) vars they refer to.
+func (sa *StorageAccountant) walkBatch(batch []*common.VarUUId, visited map[common.VarUUId]server.EmptyStruct, root string, usage *storageUsage, widest *widestVars) ([]*common.VarUUId, error) {
+	res, err := sa.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+		found := []*common.VarUUId{}
+		for _, vUUId := range batch {
+			if sa.db.ReaderExpired(rtxn) {
+				rtxn.Error(db.ErrReaderExpired)
+				return nil
+			}
+			if _, seen := visited[*vUUId]; seen {
+				continue
+			}
+			visited[*vUUId] = server.EmptyStructVal
+			size, refs, err := sa.readVar(rtxn, vUUId)
+			if err != nil {
+				rtxn.Error(err)
+				return nil
+			} else if refs == nil {
+				// not held by us
+				continue
+			}
+			usage.vars++
+			usage.bytes += uint64(size)
+			if len(refs) > usage.widestRefs {
+				usage.widestRefs = len(refs)
+			}
+			*widest = widest.add(vUUId, root, len(refs))
+			for _, ref := range refs {
+				if _, seen := visited[*ref]; !seen {
+					found = append(found, ref)
+				}
+			}
+		}
+		return found
+	}).ResultError()
+	if err != nil {
+		return nil, err
+	}
+	found, _ := res.([]*common.VarUUId)
+	return found, nil
+}
+
+// readVar returns nil refs if the var is not held by us.
+func (sa *StorageAccountant) readVar(rtxn *mdbs.RTxn, vUUId *common.VarUUId) (int, []*common.VarUUId, error) {
+	varBytes, err := rtxn.Get(sa.db.Vars, vUUId[:])
+	if err == mdb.NotFound {
+		return 0, nil, nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+	seg, _, err := capn.ReadFromMemoryZeroCopy(varBytes)
+	if err != nil {
+		return 0, nil, err
+	}
+	varCap := msgs.ReadRootVar(seg)
+	txnId := common.MakeTxnId(varCap.WriteTxnId())
+	txnBytes := sa.db.ReadTxnBytesFromDisk(rtxn, txnId)
+	if txnBytes == nil {
+		return 0, nil, fmt.Errorf("Unable to find txn %v for var %v", txnId, vUUId)
+	}
+	size := len(varBytes)
+	refs := []*common.VarUUId{}
+	actions := eng.TxnReaderFromData(txnBytes).Actions(true).Actions()
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		if !bytes.Equal(action.VarId(), vUUId[:]) {
+			continue
+		}
+		var value []byte
+		var refsCap msgs.VarIdPos_List
+		switch action.Which() {
+		case msgs.ACTION_WRITE:
+			value, refsCap = action.Write().Value(), action.Write().References()
+		case msgs.ACTION_READWRITE:
+			value, refsCap = action.Readwrite().Value(), action.Readwrite().References()
+		case msgs.ACTION_CREATE:
+			value, refsCap = action.Create().Value(), action.Create().References()
+		default:
+			continue
+		}
+		size += len(value)
+		for idy, m := 0, refsCap.Len(); idy < m; idy++ {
+			refs = append(refs, common.MakeVarUUId(refsCap.At(idy).Id()))
+		}
+		break
+	}
+	return size, refs, nil
+}
@@ -0,0 +1,58 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server/paxos"
+	"net/http"
+)
+
+type txnInspectionReport struct {
+	TxnId string
+	*paxos.TxnInspection
+}
+
+// ServeTxn writes, as JSON, the state of the txn named by the txn
+// query parameter (in hex) on this node: its proposer and acceptor
+// state, and the TLCs, TSCs and TGCs they're waiting for. A POST with
+// force=abort additionally injects whatever messages the txn is
+// waiting for from RMs which have been permanently removed from the
+// cluster (see paxos.Dispatchers.InspectTxn). If there's nothing
+// which can safely be injected, the txn is not provably stuck and
+// the response status is 409 Conflict.
+func (cm *ConnectionManager) ServeTxn(w http.ResponseWriter, req *http.Request) {
+	force := false
+	switch req.Method {
+	case "GET":
+	case "POST":
+		if req.FormValue("force") != "abort" {
+			http.Error(w, "POST requires force=abort", http.StatusBadRequest)
+			return
+		}
+		force = true
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	txnIdStr := req.FormValue("txn")
+	txnIdBytes, err := hex.DecodeString(txnIdStr)
+	if err != nil || len(txnIdBytes) != common.KeyLen {
+		http.Error(w, "Illegal txn: must be a TxnId in hex", http.StatusBadRequest)
+		return
+	}
+	txnId := common.MakeTxnId(txnIdBytes)
+	report := &txnInspectionReport{
+		TxnId:         txnIdStr,
+		TxnInspection: cm.Dispatchers.InspectTxn(txnId, force),
+	}
+	if report.Proposer == nil && report.Acceptor == nil {
+		http.Error(w, "Txn not found on this node", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if force && !report.Injected() {
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"goshawkdb.io/common"
+	"net/http"
+)
+
+type varSubscribersReport struct {
+	VarUUId     string
+	RMId        common.RMId
+	Subscribers []*varSubscriberReport
+}
+
+// Every TxnId ends with the namespace of the connection which
+// submitted it: the client connection number, the submitter's boot
+// count and RMId. Connection number 0 is the node's own
+// LocalConnection.
+type varSubscriberReport struct {
+	TxnId            string
+	Submitter        common.RMId
+	BootCount        uint32
+	ClientConnection uint32
+	Connected        bool
+	RemoteHost       string `json:",omitempty"`
+	Fingerprint      string `json:",omitempty"`
+}
+
+// ServeSubscribers writes, as JSON, the txns subscribed on this node
+// to writes of the var named by the var query parameter (in hex),
+// and which client connection submitted each. A client which keeps
+// receiving updates of a var is one with a subscription here. Only
+// connections to this node can be identified: Connected is true iff
+// the submitting connection is still connected to this node.
+func (cm *ConnectionManager) ServeSubscribers(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	vUUIdStr := req.FormValue("var")
+	vUUIdBytes, err := hex.DecodeString(vUUIdStr)
+	if err != nil || len(vUUIdBytes) != common.KeyLen {
+		http.Error(w, "Illegal var: must be a VarUUId in hex", http.StatusBadRequest)
+		return
+	}
+	txnIds := cm.Dispatchers.VarDispatcher.Subscribers(common.MakeVarUUId(vUUIdBytes))
+	if txnIds == nil {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	report := &varSubscribersReport{
+		VarUUId:     vUUIdStr,
+		RMId:        cm.RMId,
+		Subscribers: make([]*varSubscriberReport, len(txnIds)),
+	}
+	for idx, txnId := range txnIds {
+		sub := &varSubscriberReport{
+			TxnId:            hex.EncodeToString(txnId[:]),
+			Submitter:        common.RMId(binary.BigEndian.Uint32(txnId[16:20])),
+			BootCount:        binary.BigEndian.Uint32(txnId[12:16]),
+			ClientConnection: binary.BigEndian.Uint32(txnId[8:12]),
+		}
+		if sub.Submitter == cm.RMId && sub.BootCount == cm.BootCount() {
+			switch conn := cm.GetClient(sub.BootCount, sub.ClientConnection).(type) {
+			case nil:
+			case *Connection:
+				sub.Connected = true
+				if identity := conn.clientIdentity(); identity != nil {
+					sub.RemoteHost = identity.remoteHost
+					sub.Fingerprint = hex.EncodeToString(identity.fingerprint[:])
+				}
+			default:
+				sub.Connected = true
+			}
+		}
+		report.Subscribers[idx] = sub
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
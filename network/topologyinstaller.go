@@ -0,0 +1,90 @@
+package network
+
+import (
+	"goshawkdb.io/server/configuration"
+	eng "goshawkdb.io/server/txnengine"
+	"sync"
+)
+
+// A topologyInstaller delivers topology changes to all the
+// subscribers of one type without blocking the ConnectionManager.
+// Subscribers such as the VarManagers and ProposerManagers do nothing
+// more than enqueue the change onto their own executor, but that
+// enqueue blocks if the executor is busy. Dispatching inline from the
+// ConnectionManager meant one busy executor held up installation to
+// every other executor and every other subscriber type, which on
+// large nodes dominated transition time.
+//
+// The correctness argument is this: every subscriber must see
+// topologies in the order in which they were set, but no subscriber
+// relies on the order in which other subscribers (of the same or a
+// different type) see them - each already processes changes
+// asynchronously on its own executor. So each type gets its own
+// installer, installers run independently of each other, and an
+// installer dispatches one topology to all its subscribers
+// concurrently, but only moves onto the next topology once every
+// dispatch of the previous one has returned (i.e. has been enqueued
+// by the subscriber).
+//
+// Only subscriber types whose TopologyChanged is safe to call from
+// any go-routine may use an installer. The ConnectionManager itself
+// and the emigrator expect to be called from the ConnectionManager's
+// go-routine and so are still dispatched inline.
+type topologyInstaller struct {
+	sync.Mutex
+	pending []*topologyInstall
+	running bool
+}
+
+type topologyInstall struct {
+	topology    *configuration.Topology
+	subscribers []eng.TopologySubscriber
+	done        func(bool)
+}
+
+func newTopologyInstallers() []*topologyInstaller {
+	installers := make([]*topologyInstaller, eng.TopologyChangeSubscriberTypeLimit)
+	for _, subType := range []eng.TopologyChangeSubscriberType{eng.VarSubscriber, eng.ProposerSubscriber, eng.AcceptorSubscriber, eng.ConnectionSubscriber} {
+		installers[subType] = &topologyInstaller{}
+	}
+	return installers
+}
+
+func (ti *topologyInstaller) install(topology *configuration.Topology, subscribers []eng.TopologySubscriber, done func(bool)) {
+	ti.Lock()
+	defer ti.Unlock()
+	ti.pending = append(ti.pending, &topologyInstall{
+		topology:    topology,
+		subscribers: subscribers,
+		done:        done,
+	})
+	if !ti.running {
+		ti.running = true
+		go ti.run()
+	}
+}
+
+func (ti *topologyInstaller) run() {
+	for {
+		ti.Lock()
+		if len(ti.pending) == 0 {
+			ti.running = false
+			ti.Unlock()
+			return
+		}
+		inst := ti.pending[0]
+		ti.pending[0] = nil
+		ti.pending = ti.pending[1:]
+		ti.Unlock()
+
+		var wg sync.WaitGroup
+		wg.Add(len(inst.subscribers))
+		for _, sub := range inst.subscribers {
+			go func(sub eng.TopologySubscriber) {
+				defer wg.Done()
+				sub.TopologyChanged(inst.topology, inst.done)
+			}(sub)
+		}
+		wg.Wait()
+	}
+}
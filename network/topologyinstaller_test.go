@@ -0,0 +1,152 @@
+package network
+
+import (
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/configuration"
+	eng "goshawkdb.io/server/txnengine"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingSubscriber struct {
+	sync.Mutex
+	block chan struct{}
+	seen  []*configuration.Topology
+}
+
+func (rs *recordingSubscriber) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	if rs.block != nil {
+		<-rs.block
+	}
+	// simulate a busy executor delaying the enqueue.
+	time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+	rs.Lock()
+	rs.seen = append(rs.seen, topology)
+	rs.Unlock()
+	done(true)
+}
+
+func (rs *recordingSubscriber) seenCount() int {
+	rs.Lock()
+	defer rs.Unlock()
+	return len(rs.seen)
+}
+
+func newTestTopologySubscribers() topologySubscribers {
+	subs := topologySubscribers{
+		subscribers: make([]map[eng.TopologySubscriber]server.EmptyStruct, eng.TopologyChangeSubscriberTypeLimit),
+		installers:  newTopologyInstallers(),
+	}
+	for idx := range subs.subscribers {
+		subs.subscribers[idx] = make(map[eng.TopologySubscriber]server.EmptyStruct)
+	}
+	return subs
+}
+
+type callbackFired struct {
+	subType eng.TopologyChangeSubscriberType
+	index   int
+}
+
+// Every subscriber must see every topology, in the order set, and
+// each callback must fire exactly once, and only once every
+// subscriber of its type has the topology.
+func TestTopologyInstallInvariants(t *testing.T) {
+	subs := newTestTopologySubscribers()
+	subTypes := []eng.TopologyChangeSubscriberType{eng.VarSubscriber, eng.ProposerSubscriber, eng.ConnectionSubscriber}
+	bySubType := make(map[eng.TopologyChangeSubscriberType][]*recordingSubscriber)
+	for _, subType := range subTypes {
+		for idx := 0; idx < 8; idx++ {
+			rs := &recordingSubscriber{}
+			subs.AddSubscriber(subType, rs)
+			bySubType[subType] = append(bySubType[subType], rs)
+		}
+	}
+
+	const topologyCount = 20
+	topologies := make([]*configuration.Topology, topologyCount)
+	fired := make(chan callbackFired, topologyCount*len(subTypes))
+	violations := make(chan string, topologyCount*len(subTypes))
+	for idx := range topologies {
+		topologies[idx] = &configuration.Topology{}
+		callbacks := make(map[eng.TopologyChangeSubscriberType]func())
+		for _, subType := range subTypes {
+			index, subTypeCopy := idx, subType
+			callbacks[subType] = func() {
+				for _, rs := range bySubType[subTypeCopy] {
+					if rs.seenCount() <= index {
+						violations <- "callback fired before all subscribers installed the topology"
+						break
+					}
+				}
+				fired <- callbackFired{subType: subTypeCopy, index: index}
+			}
+		}
+		subs.TopologyChanged(topologies[idx], callbacks)
+	}
+
+	counts := make(map[callbackFired]int)
+	timeout := time.After(10 * time.Second)
+	for len(counts) < topologyCount*len(subTypes) {
+		select {
+		case cf := <-fired:
+			counts[cf]++
+		case <-timeout:
+			t.Fatalf("Only %v of %v callbacks fired", len(counts), topologyCount*len(subTypes))
+		}
+	}
+	select {
+	case violation := <-violations:
+		t.Fatal(violation)
+	case cf := <-fired:
+		t.Fatalf("Callback fired more than once: %v", cf)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for subType, rss := range bySubType {
+		for _, rs := range rss {
+			if len(rs.seen) != topologyCount {
+				t.Fatalf("Subscriber of type %v saw %v topologies; expected %v", subType, len(rs.seen), topologyCount)
+			}
+			for idx, topology := range rs.seen {
+				if topology != topologies[idx] {
+					t.Fatalf("Subscriber of type %v saw topologies out of order at %v", subType, idx)
+				}
+			}
+		}
+	}
+}
+
+// A subscriber which is slow to accept a topology must not hold up
+// installation to subscribers of other types.
+func TestTopologyInstallIndependentTypes(t *testing.T) {
+	subs := newTestTopologySubscribers()
+	blocked := &recordingSubscriber{block: make(chan struct{})}
+	subs.AddSubscriber(eng.VarSubscriber, blocked)
+	subs.AddSubscriber(eng.ProposerSubscriber, &recordingSubscriber{})
+
+	varDone, proposerDone := make(chan struct{}), make(chan struct{})
+	subs.TopologyChanged(&configuration.Topology{}, map[eng.TopologyChangeSubscriberType]func(){
+		eng.VarSubscriber:      func() { close(varDone) },
+		eng.ProposerSubscriber: func() { close(proposerDone) },
+	})
+
+	select {
+	case <-proposerDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Proposer install held up by blocked var subscriber")
+	}
+	select {
+	case <-varDone:
+		t.Fatal("Var install completed whilst subscriber blocked")
+	default:
+	}
+	close(blocked.block)
+	select {
+	case <-varDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Var install did not complete once unblocked")
+	}
+}
@@ -0,0 +1,162 @@
+package network
+
+import (
+	"fmt"
+	"goshawkdb.io/common"
+	cmsgs "goshawkdb.io/common/capnp"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/configuration"
+	eng "goshawkdb.io/server/txnengine"
+	"log"
+	"sync"
+	"time"
+)
+
+// TopologyRequestWatcher lets clients manage the cluster: a client
+// granted write access to the TopologyRequestRootName root writes a
+// configuration, as JSON, to the root's value, and the watcher asks
+// the TopologyTransmogrifier to move to it, just as a SIGHUP would.
+// Every node watches the root, so the request is made even if some
+// nodes are down. The root is polled rather than watched for writes,
+// as it is generally not held on this node.
+//
+// If configurations must be signed, the value must be a signed
+// bundle, as made by `goshawkdb config sign`, rather than JSON:
+// write access to the root alone is not enough to change the cluster.
+//
+// The value the root has when the watcher first reads it has already
+// been dealt with (or was written whilst the cluster was being
+// changed by other means), so only later writes are requested.
+type TopologyRequestWatcher struct {
+	sync.Mutex
+	connectionManager *ConnectionManager
+	transmogrifier    *TopologyTransmogrifier
+	reader            *rootAppender // only used by run
+	topology          *configuration.Topology
+	rootVarUUId       *common.VarUUId
+	version           *common.TxnId
+	requested         uint64
+	lastRequested     time.Time
+	lastErr           error
+	terminate         chan struct{}
+	terminated        chan struct{}
+}
+
+func NewTopologyRequestWatcher(cm *ConnectionManager, tt *TopologyTransmogrifier) *TopologyRequestWatcher {
+	trw := &TopologyRequestWatcher{
+		connectionManager: cm,
+		transmogrifier:    tt,
+		terminate:         make(chan struct{}),
+		terminated:        make(chan struct{}),
+	}
+	trw.reader = newRootAppender(cm, server.TopologyRequestRootName, 1, server.TopologyRequestMaxAttempts, trw.terminate)
+	trw.topology = cm.AddTopologySubscriber(eng.ConnectionSubscriber, trw)
+	go trw.run()
+	return trw
+}
+
+func (trw *TopologyRequestWatcher) Shutdown() {
+	trw.connectionManager.RemoveTopologySubscriberAsync(eng.ConnectionSubscriber, trw)
+	close(trw.terminate)
+	<-trw.terminated
+}
+
+func (trw *TopologyRequestWatcher) TopologyChanged(topology *configuration.Topology, done func(bool)) {
+	trw.Lock()
+	trw.topology = topology
+	trw.Unlock()
+	done(true)
+}
+
+func (trw *TopologyRequestWatcher) Status(sc *server.StatusConsumer) {
+	trw.Lock()
+	defer trw.Unlock()
+	if trw.rootVarUUId == nil {
+		sc.Emit(fmt.Sprintf("Topology requests from %v: no client can write the root", server.TopologyRequestRootName))
+	} else {
+		sc.Emit(fmt.Sprintf("Topology requests from %v: root version %v; %v requested (last %v); last error: %v",
+			server.TopologyRequestRootName, trw.version, trw.requested, trw.lastRequested, trw.lastErr))
+	}
+	sc.Join()
+}
+
+func (trw *TopologyRequestWatcher) run() {
+	defer close(trw.terminated)
+	ticker := time.NewTicker(server.TopologyRequestPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-trw.terminate:
+			return
+		case <-ticker.C:
+		}
+		err := trw.poll()
+		if err != nil {
+			log.Println("Topology request error:", err)
+		}
+		trw.Lock()
+		trw.lastErr = err
+		trw.Unlock()
+	}
+}
+
+// root returns the root, provided some client is able to write it.
+func (trw *TopologyRequestWatcher) root(topology *configuration.Topology) *configuration.Root {
+	for idx, name := range topology.RootNames() {
+		if name != server.TopologyRequestRootName {
+			continue
+		}
+		for _, roots := range topology.Fingerprints() {
+			if capability, found := roots[name]; found && (capability.Which() == cmsgs.CAPABILITY_WRITE || capability.Which() == cmsgs.CAPABILITY_READWRITE) {
+				return &topology.Roots[idx]
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+func (trw *TopologyRequestWatcher) poll() error {
+	trw.Lock()
+	topology := trw.topology
+	trw.Unlock()
+	if topology == nil || topology.IsBlank() {
+		return nil
+	}
+	root := trw.root(topology)
+	if root == nil {
+		trw.Lock()
+		trw.rootVarUUId, trw.version = nil, nil
+		trw.Unlock()
+		return nil
+	}
+
+	version, value, _, err := trw.reader.readRoot(topology, root)
+	if err != nil {
+		return err
+	}
+
+	// A root that has never been written has a nil version, and its
+	// first write is a request.
+	trw.Lock()
+	first := trw.rootVarUUId == nil || trw.rootVarUUId.Compare(root.VarUUId) != common.EQ
+	changed := version != nil && (trw.version == nil || trw.version.Compare(version) != common.EQ)
+	trw.rootVarUUId, trw.version = root.VarUUId, version
+	trw.Unlock()
+	if first || !changed || len(value) == 0 {
+		return nil
+	}
+
+	config, err := trw.connectionManager.ConfigVerifier.ConfigurationFromData(value)
+	if err != nil {
+		return fmt.Errorf("Ignoring configuration written to %v at %v: %v", server.TopologyRequestRootName, version, err)
+	}
+	log.Printf("Requesting configuration change written to %v at %v.\n", server.TopologyRequestRootName, version)
+	trw.transmogrifier.RequestConfigurationChange(config, ConfigSourceClient, fmt.Sprintf("written at %v", version))
+
+	trw.Lock()
+	trw.requested++
+	trw.lastRequested = time.Now()
+	trw.Unlock()
+	return nil
+}
@@ -14,11 +14,13 @@ import (
 	msgs "goshawkdb.io/server/capnp"
 	"goshawkdb.io/server/client"
 	"goshawkdb.io/server/configuration"
+	ch "goshawkdb.io/server/consistenthash"
 	"goshawkdb.io/server/db"
 	"goshawkdb.io/server/paxos"
 	eng "goshawkdb.io/server/txnengine"
 	"log"
 	"math/rand"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -32,7 +34,12 @@ type TopologyTransmogrifier struct {
 	hostToConnection     map[string]paxos.Connection
 	activeConnections    map[common.RMId]paxos.Connection
 	migrations           map[uint32]map[common.RMId]*int32
+	configHistory        *configHistory
+	immigrationBatches   *immigrationBatches
+	immigrationStaging   *immigrationStaging
+	capacity             *migrationCapacity
 	task                 topologyTask
+	plan                 *transitionPlan
 	cellTail             *cc.ChanCellTail
 	enqueueQueryInner    func(topologyTransmogrifierMsg, *cc.ChanCell, cc.CurCellConsumer) (bool, cc.CurCellConsumer)
 	queryChan            <-chan topologyTransmogrifierMsg
@@ -60,11 +67,22 @@ func (tt *TopologyTransmogrifier) Shutdown() {
 
 type topologyTransmogrifierMsgRequestConfigChange struct {
 	topologyTransmogrifierMsgBasic
-	config *configuration.Configuration
-}
-
-func (tt *TopologyTransmogrifier) RequestConfigurationChange(config *configuration.Configuration) {
-	tt.enqueueQuery(topologyTransmogrifierMsgRequestConfigChange{config: config})
+	config  *configuration.Configuration
+	source  string
+	comment string
+}
+
+// RequestConfigurationChange asks for the cluster to move to
+// config. source (one of the ConfigSource constants) and comment are
+// recorded in the configuration history if config is applied. If
+// configurations must be signed, config is ignored unless it carries
+// a correctly signed bundle of itself, whatever its source.
+func (tt *TopologyTransmogrifier) RequestConfigurationChange(config *configuration.Configuration, source, comment string) {
+	tt.enqueueQuery(topologyTransmogrifierMsgRequestConfigChange{
+		config:  config,
+		source:  source,
+		comment: comment,
+	})
 }
 
 type topologyTransmogrifierMsgSetActiveConnections struct {
@@ -111,6 +129,23 @@ func (tt *TopologyTransmogrifier) MigrationCompleteReceived(sender common.RMId,
 	})
 }
 
+func (tt *TopologyTransmogrifier) Status(sc *server.StatusConsumer) {
+	enqueued := tt.enqueueQuery(topologyTransmogrifierMsgExe(func() error {
+		if tt.plan == nil || len(tt.plan.stages) <= 1 {
+			sc.Emit("Topology transition plan: none")
+		} else {
+			sc.Emit(fmt.Sprintf("Topology transition plan: %v", tt.plan))
+		}
+		sc.Emit(tt.immigrationStaging.String())
+		sc.Emit(tt.capacity.String())
+		sc.Join()
+		return nil
+	}))
+	if !enqueued {
+		sc.Join()
+	}
+}
+
 func (tt *TopologyTransmogrifier) enqueueQuery(msg topologyTransmogrifierMsg) bool {
 	var f cc.CurCellConsumer
 	f = func(cell *cc.ChanCell) (bool, cc.CurCellConsumer) {
@@ -119,21 +154,26 @@ func (tt *TopologyTransmogrifier) enqueueQuery(msg topologyTransmogrifierMsg) bo
 	return tt.cellTail.WithCell(f)
 }
 
-func NewTopologyTransmogrifier(db *db.Databases, cm *ConnectionManager, lc *client.LocalConnection, listenPort uint16, ss ShutdownSignaller, config *configuration.Configuration) (*TopologyTransmogrifier, <-chan struct{}) {
+func NewTopologyTransmogrifier(db *db.Databases, cm *ConnectionManager, lc *client.LocalConnection, listenPort uint16, ss ShutdownSignaller, config *configuration.Configuration, configComment string) (*TopologyTransmogrifier, <-chan struct{}) {
 	tt := &TopologyTransmogrifier{
-		db:                db,
-		connectionManager: cm,
-		localConnection:   lc,
-		migrations:        make(map[uint32]map[common.RMId]*int32),
-		listenPort:        listenPort,
-		rng:               rand.New(rand.NewSource(time.Now().UnixNano())),
-		shutdownSignaller: ss,
-		localEstablished:  make(chan struct{}),
+		db:                 db,
+		connectionManager:  cm,
+		localConnection:    lc,
+		migrations:         make(map[uint32]map[common.RMId]*int32),
+		configHistory:      newConfigHistory(db),
+		immigrationBatches: newImmigrationBatches(db),
+		immigrationStaging: newImmigrationStaging(db),
+		capacity:           newMigrationCapacity(),
+		listenPort:         listenPort,
+		rng:                rand.New(rand.NewSource(time.Now().UnixNano())),
+		shutdownSignaller:  ss,
+		localEstablished:   make(chan struct{}),
 	}
 	tt.task = &targetConfig{
 		TopologyTransmogrifier: tt,
 		config:                 &configuration.NextConfiguration{Configuration: config},
 	}
+	tt.configHistory.requested(config, ConfigSourceCommandLine, configComment)
 
 	var head *cc.ChanCellHead
 	head, tt.cellTail = cc.NewChanCellTail(
@@ -230,7 +270,12 @@ func (tt *TopologyTransmogrifier) actorLoop(head *cc.ChanCellHead) {
 				err = tt.setActive(msgT.topology)
 			case topologyTransmogrifierMsgRequestConfigChange:
 				server.Log("Topology: Topology change request:", msgT.config)
-				tt.selectGoal(&configuration.NextConfiguration{Configuration: msgT.config})
+				if verr := tt.connectionManager.ConfigVerifier.Verify(msgT.config); verr != nil {
+					log.Printf("Topology: Ignoring configuration change requested (%v): %v\n", msgT.source, verr)
+				} else {
+					tt.configHistory.requested(msgT.config, msgT.source, msgT.comment)
+					tt.selectGoal(&configuration.NextConfiguration{Configuration: msgT.config})
+				}
 			case topologyTransmogrifierMsgMigration:
 				err = tt.migrationReceived(msgT)
 			case topologyTransmogrifierMsgMigrationComplete:
@@ -291,6 +336,7 @@ func (tt *TopologyTransmogrifier) setActive(topology *configuration.Topology) er
 	}
 
 	if _, found := topology.RMsRemoved()[tt.connectionManager.RMId]; found {
+		tt.connectionManager.Decommissioner.removed(topology)
 		return errors.New("We have been removed from the cluster. Shutting down.")
 	}
 	tt.active = topology
@@ -304,6 +350,7 @@ func (tt *TopologyTransmogrifier) setActive(topology *configuration.Topology) er
 	if tt.task == nil {
 		if next := topology.Next(); next == nil {
 			tt.installTopology(topology, nil)
+			tt.configHistory.applied(topology)
 			localHost, remoteHosts, err := tt.active.LocalRemoteHosts(tt.listenPort)
 			if err != nil {
 				return err
@@ -319,12 +366,22 @@ func (tt *TopologyTransmogrifier) setActive(topology *configuration.Topology) er
 					delete(tt.migrations, version)
 				}
 			}
+			tt.immigrationBatches.forget(topology.Version)
+			tt.capacity.forget(topology.Version)
+			if err := tt.immigrationStaging.discard(topology.Version); err != nil {
+				log.Println("Topology: Unable to discard staged immigration batches:", err)
+			}
 
 			_, err = future.ResultError()
 			if err != nil {
 				return err
 			}
 
+			if plan := tt.plan; plan != nil && stageRemaining(topology.Configuration, plan.goal) {
+				log.Printf("Topology: Continuing staged transition %v.", plan)
+				tt.selectGoal(&configuration.NextConfiguration{Configuration: plan.goal})
+			}
+
 		} else {
 			tt.selectGoal(next)
 		}
@@ -380,11 +437,22 @@ func (tt *TopologyTransmogrifier) selectGoal(goal *configuration.NextConfigurati
 			log.Printf("Topology: Illegal config change: Currently changes to MaxRMCount are not supported, sorry.")
 			return
 
+		case tt.active.Version != 0 && !tt.active.LearnersCompatible(goal.Configuration):
+			log.Printf("Topology: Illegal config change: A host cannot become or cease to be a learner whilst it remains in Hosts.")
+			return
+
 		case goal.Version < tt.active.Version:
 			log.Printf("Topology: Ignoring config with version %v as newer version already active (%v).",
 				goal.Version, tt.active.Version)
 			return
 
+		case tt.active.IsFingerprintsDelta(goal.Configuration):
+			tt.selectFingerprintsDelta(goal)
+			return
+
+		case goal.Version == tt.active.Version && stageRemaining(tt.active.Configuration, goal.Configuration):
+			server.Log("Topology: Config transition to version", goal.Version, "has stages remaining.")
+
 		case goal.Version == tt.active.Version:
 			log.Printf("Topology: Config transition to version %v completed.", goal.Version)
 			return
@@ -421,10 +489,39 @@ func (tt *TopologyTransmogrifier) selectGoal(goal *configuration.NextConfigurati
 
 	if tt.task == nil {
 		server.Log("Topology: Creating new task")
-		tt.task = &targetConfig{
+		task := &targetConfig{
 			TopologyTransmogrifier: tt,
 			config:                 goal,
 		}
+		tt.task = task
+		task.trace("goal-selected", "activeVersion", tt.activeVersion())
+	}
+}
+
+func (tt *TopologyTransmogrifier) activeVersion() uint32 {
+	if tt.active == nil {
+		return 0
+	}
+	return tt.active.Version
+}
+
+// selectFingerprintsDelta starts applying goal as a fingerprints
+// delta, unless a full topology change is in progress.
+func (tt *TopologyTransmogrifier) selectFingerprintsDelta(goal *configuration.NextConfiguration) {
+	if tt.task != nil {
+		if _, isDelta := tt.task.(*fingerprintsDelta); !isDelta {
+			log.Printf("Topology: Ignoring client fingerprints change as a topology change is in progress.")
+			return
+		}
+		server.Log("Topology: Abandoning old fingerprints delta")
+		tt.task.abandon()
+	}
+	log.Printf("Topology: Applying client fingerprints change to version %v without migration.", goal.Version)
+	tt.task = &fingerprintsDelta{
+		targetConfig: &targetConfig{
+			TopologyTransmogrifier: tt,
+			config:                 goal,
+		},
 	}
 }
 
@@ -443,29 +540,53 @@ func (tt *TopologyTransmogrifier) enqueueTick(task topologyTask, tc *targetConfi
 	}
 }
 
-func (tt *TopologyTransmogrifier) migrationReceived(migration topologyTransmogrifierMsgMigration) error {
-	version := migration.migration.Version()
+// SetImmigrationMemoryBudget sets the number of bytes of received
+// migration batches which may be held in memory whilst they're
+// applied; beyond that they're staged on disk. 0 means unbounded.
+func (tt *TopologyTransmogrifier) SetImmigrationMemoryBudget(budget int) {
+	tt.enqueueQuery(topologyTransmogrifierMsgExe(func() error {
+		tt.immigrationStaging.budget = budget
+		return nil
+	}))
+}
+
+func (tt *TopologyTransmogrifier) migrationWanted(version uint32) bool {
 	if version <= tt.active.Version {
 		// This topology change has been completed. Ignore this migration.
-		return nil
+		return false
 	} else if next := tt.active.Next(); next != nil {
 		if version < next.Version {
 			// Whatever change that was for, it isn't happening any
 			// more. Ignore.
-			return nil
+			return false
 		} else if _, found := next.Pending[tt.connectionManager.RMId]; version == next.Version && !found {
 			// Migration is for the current topology change, but we've
 			// declared ourselves done, so Ignore.
-			return nil
+			return false
 		}
 	}
+	return true
+}
+
+func (tt *TopologyTransmogrifier) migrationReceived(migration topologyTransmogrifierMsgMigration) error {
+	version := migration.migration.Version()
+	if !tt.migrationWanted(version) {
+		return nil
+	}
+
+	sender := migration.sender
+	batchId := immigrationBatchIdOf(migration.migration)
+	txnCount := int32(migration.migration.Elems().Len())
+	if txnCount != 0 && !tt.immigrationBatches.started(version, sender, batchId) {
+		log.Printf("Topology: Ignoring immigration batch %v from %v (v%v): already applied.", batchId, sender, version)
+		return nil
+	}
 
 	senders, found := tt.migrations[version]
 	if !found {
 		senders = make(map[common.RMId]*int32)
 		tt.migrations[version] = senders
 	}
-	sender := migration.sender
 	inprogressPtr, found := senders[sender]
 	if found {
 		atomic.AddInt32(inprogressPtr, 1)
@@ -474,16 +595,28 @@ func (tt *TopologyTransmogrifier) migrationReceived(migration topologyTransmogri
 		inprogressPtr = &inprogress
 		senders[sender] = inprogressPtr
 	}
-	txnCount := int32(migration.migration.Elems().Len())
-	lsc := tt.newTxnLSC(txnCount, inprogressPtr)
-	tt.connectionManager.Dispatchers.ProposerDispatcher.ImmigrationReceived(migration.migration, lsc)
+	lsc := tt.newTxnLSC(version, sender, batchId, txnCount, inprogressPtr)
+	if txnCount == 0 || tt.immigrationStaging.add(migration.migration, lsc) {
+		tt.connectionManager.Dispatchers.ProposerDispatcher.ImmigrationReceived(migration.migration, lsc)
+	}
 	return nil
 }
 
+// applyStagedMigration applies a batch which was staged on disk, if
+// it is still wanted.
+func (tt *TopologyTransmogrifier) applyStagedMigration(migration *msgs.Migration, lsc *migrationTxnLocalStateChange) bool {
+	if !tt.migrationWanted(migration.Version()) {
+		return false
+	}
+	tt.connectionManager.Dispatchers.ProposerDispatcher.ImmigrationReceived(migration, lsc)
+	return true
+}
+
 func (tt *TopologyTransmogrifier) migrationCompleteReceived(migrationComplete topologyTransmogrifierMsgMigrationComplete) error {
 	version := migrationComplete.complete.Version()
 	sender := migrationComplete.sender
 	server.Log("Topology: MCR from", sender, "v", version)
+	configuration.TraceTopology(configuration.TopologyTraceId(version), tt.connectionManager.RMId, "migration-complete-received", "from", sender)
 	senders, found := tt.migrations[version]
 	if !found {
 		if version > tt.active.Version {
@@ -507,9 +640,12 @@ func (tt *TopologyTransmogrifier) migrationCompleteReceived(migrationComplete to
 	return nil
 }
 
-func (tt *TopologyTransmogrifier) newTxnLSC(txnCount int32, inprogressPtr *int32) eng.TxnLocalStateChange {
+func (tt *TopologyTransmogrifier) newTxnLSC(version uint32, sender common.RMId, batchId immigrationBatchId, txnCount int32, inprogressPtr *int32) *migrationTxnLocalStateChange {
 	return &migrationTxnLocalStateChange{
 		TopologyTransmogrifier: tt,
+		version:                version,
+		sender:                 sender,
+		batchId:                batchId,
 		pendingLocallyComplete: txnCount,
 		inprogressPtr:          inprogressPtr,
 	}
@@ -517,8 +653,12 @@ func (tt *TopologyTransmogrifier) newTxnLSC(txnCount int32, inprogressPtr *int32
 
 type migrationTxnLocalStateChange struct {
 	*TopologyTransmogrifier
+	version                uint32
+	sender                 common.RMId
+	batchId                immigrationBatchId
 	pendingLocallyComplete int32
 	inprogressPtr          *int32
+	size                   int
 }
 
 func (mtlsc *migrationTxnLocalStateChange) TxnBallotsComplete(...*eng.Ballot) {
@@ -528,14 +668,22 @@ func (mtlsc *migrationTxnLocalStateChange) TxnBallotsComplete(...*eng.Ballot) {
 // Careful: we're in the proposer dispatcher go routine here!
 func (mtlsc *migrationTxnLocalStateChange) TxnLocallyComplete(txn *eng.Txn) {
 	txn.CompletionReceived()
-	if atomic.AddInt32(&mtlsc.pendingLocallyComplete, -1) == 0 &&
-		atomic.AddInt32(mtlsc.inprogressPtr, -1) == 0 {
+	if atomic.AddInt32(&mtlsc.pendingLocallyComplete, -1) == 0 {
+		// The whole batch is now on disk, so record it before we could
+		// possibly declare the sender done.
 		mtlsc.enqueueQuery(topologyTransmogrifierMsgExe(func() error {
-			if mtlsc.task != nil {
-				return mtlsc.task.tick()
-			}
+			mtlsc.immigrationBatches.finished(mtlsc.version, mtlsc.sender, mtlsc.batchId)
+			mtlsc.immigrationStaging.released(mtlsc.size, mtlsc.applyStagedMigration)
 			return nil
 		}))
+		if atomic.AddInt32(mtlsc.inprogressPtr, -1) == 0 {
+			mtlsc.enqueueQuery(topologyTransmogrifierMsgExe(func() error {
+				if mtlsc.task != nil {
+					return mtlsc.task.tick()
+				}
+				return nil
+			}))
+		}
 	}
 }
 
@@ -603,9 +751,39 @@ func (task *targetConfig) tick() error {
 		return fmt.Errorf("Topology: Confused about what to do. Active topology is: %v; goal is %v",
 			task.active, task.config)
 	}
+	task.trace("phase", "phase", topologyTaskName(task.task), "activeVersion", task.activeVersion())
 	return nil
 }
 
+func topologyTaskName(task topologyTask) string {
+	switch task.(type) {
+	case *ensureLocalTopology:
+		return "ensure-local-topology"
+	case *joinCluster:
+		return "join-cluster"
+	case *installTargetOld:
+		return "install-target-old"
+	case *installTargetNew:
+		return "install-target-new"
+	case *awaitBarrier1:
+		return "await-barrier1"
+	case *awaitBarrier2:
+		return "await-barrier2"
+	case *migrate:
+		return "migrate"
+	case *installCompletion:
+		return "install-completion"
+	default:
+		return "unknown"
+	}
+}
+
+// trace logs event in the history of this task's transition. See
+// configuration.TraceTopology.
+func (task *targetConfig) trace(event string, fields ...interface{}) {
+	configuration.TraceTopology(configuration.TopologyTraceId(task.config.Version), task.connectionManager.RMId, event, fields...)
+}
+
 func (task *targetConfig) shareGoalWithAll() {
 	if task.sender != nil {
 		return
@@ -632,6 +810,7 @@ func (task *targetConfig) fatal(err error) error {
 	task.ensureRemoveTaskSender()
 	task.task = nil
 	log.Printf("Topology: fatal error: %v", err)
+	task.trace("fatal", "error", err)
 	return err
 }
 
@@ -639,12 +818,14 @@ func (task *targetConfig) error(err error) error {
 	task.ensureRemoveTaskSender()
 	task.task = nil
 	log.Printf("Topology: error: %v", err)
+	task.trace("error", "error", err)
 	return nil
 }
 
 func (task *targetConfig) completed() error {
 	task.ensureRemoveTaskSender()
 	log.Printf("Topology: task completed.")
+	task.trace("completed", "activeVersion", task.activeVersion())
 	task.task = nil
 	return nil
 }
@@ -866,6 +1047,60 @@ func (task *joinCluster) allJoining(allRMIds common.RMIds) error {
 	return task.setActive(active)
 }
 
+// fingerprintsDelta
+// Purpose is to change only the client fingerprints (and their
+// capabilities) of the active topology, moving it to the next
+// version in a single txn. Nothing else changes, so there is no need
+// for barriers or migration: every node observes the rewritten
+// topology and installs it as normal.
+
+type fingerprintsDelta struct {
+	*targetConfig
+}
+
+func (task *fingerprintsDelta) tick() error {
+	if task.active.Version >= task.config.Version {
+		log.Printf("Topology: Client fingerprints change to version %v completed.", task.config.Version)
+		return task.completed()
+	} else if !task.active.IsFingerprintsDelta(task.config.Configuration) {
+		log.Printf("Topology: Client fingerprints change overtaken by topology change.")
+		return task.completed()
+	}
+
+	if !task.isInRMs(task.active.RMs()) {
+		task.shareGoalWithAll()
+		log.Printf("Topology: Awaiting existing cluster members.")
+		// this step must be performed by the existing RMs
+		return nil
+	}
+
+	active, passive := task.partitionByActiveConnection(task.active.RMs())
+	if len(active) <= len(passive) {
+		log.Printf("Topology: Can not make progress at this time due to too many failures (failures: %v)",
+			passive)
+		return nil
+	}
+	fInc := ((len(active) + len(passive)) >> 1) + 1
+	active, passive = active[:fInc], append(active[fInc:], passive...)
+
+	targetTopology := task.active.Clone()
+	targetTopology.SetConfiguration(task.active.Configuration.WithFingerprintsOf(task.config.Configuration))
+
+	_, resubmit, err := task.rewriteTopology(task.active, targetTopology, active, passive)
+	if err != nil {
+		return task.fatal(err)
+	}
+	if resubmit {
+		server.Log("Topology: Installing client fingerprints requires resubmit.")
+		task.createOrAdvanceBackoff()
+		task.enqueueTick(task, task.targetConfig)
+		return nil
+	}
+	// Either committed or badread: either way, we'll observe the
+	// updated topology through the subscriber.
+	return nil
+}
+
 // installTargetOld
 // Purpose is to do a txn using the current topology in which we set
 // topology.Next to be the target topology. We calculate and store the
@@ -911,7 +1146,15 @@ func (task *installTargetOld) tick() error {
 	log.Printf("Topology: Calculated target topology: %v (new rootsRequired: %v, active: %v, passive: %v)", targetTopology.Next(), rootsRequired, active, passive)
 
 	if rootsRequired != 0 {
-		resubmit, roots, err := task.attemptCreateRoots(rootsRequired)
+		rootNames := newRootNames(targetTopology, rootsRequired)
+		relocated, err := task.relocatedRoots(rootNames)
+		if err != nil {
+			log.Printf("Topology: Unable to read roots being relocated: %v", err)
+			task.createOrAdvanceBackoff()
+			task.enqueueTick(task, task.targetConfig)
+			return nil
+		}
+		resubmit, roots, err := task.attemptCreateRoots(rootNames, relocated)
 		if err != nil {
 			return task.fatal(err)
 		}
@@ -947,6 +1190,16 @@ func (task *installTargetOld) calculateTargetTopology() (*configuration.Topology
 		return nil, 0, task.fatal(err)
 	}
 
+	// Removing several hosts at once may not be safe, in which case
+	// we only go as far as the first stage of the plan now.
+	plan := planTransition(task.active.Configuration, task.config.Configuration,
+		movedHosts(task.active.Configuration, task.config.Configuration, task.hostToConnection))
+	if len(plan.stages) > 1 && (task.plan == nil || task.plan.String() != plan.String()) {
+		log.Printf("Topology: Planned staged transition %v.", plan)
+	}
+	task.plan = plan
+	stage := plan.firstStage(task.active.Configuration)
+
 	hostsSurvived, hostsRemoved, hostsAdded :=
 		make(map[string]common.RMId),
 		make(map[string]common.RMId),
@@ -968,7 +1221,7 @@ func (task *installTargetOld) calculateTargetTopology() (*configuration.Topology
 	// 2. For each new host, if it is in the removed set, it's
 	// "survived". Else it's new. Don't care about correcting
 	// hostsRemoved.
-	for _, host := range task.config.Hosts {
+	for _, host := range stage.Hosts {
 		if rmId, found := hostsRemoved[host]; found {
 			hostsSurvived[host] = rmId
 		} else {
@@ -979,6 +1232,15 @@ func (task *installTargetOld) calculateTargetTopology() (*configuration.Topology
 		}
 	}
 
+	// Old hosts which are not in the new config may yet turn out to
+	// be RMs which have moved host (see 4. below).
+	rmIdToHostOld := make(map[common.RMId]string)
+	for host, rmId := range hostsRemoved {
+		if _, found := hostsSurvived[host]; !found && host != localHost {
+			rmIdToHostOld[rmId] = host
+		}
+	}
+
 	task.installTopology(task.active, nil)
 	task.connectionManager.SetDesiredServers(localHost, allRemoteHosts)
 
@@ -1002,12 +1264,23 @@ func (task *installTargetOld) calculateTargetTopology() (*configuration.Topology
 		rmIdsTranslation[rmId] = common.RMIdEmpty
 	}
 	// 4. All new hosts must have new RMIds, and we must be connected
-	// to them.
+	// to them. Unless a new host is an old RM which has moved host, in
+	// which case it survives under its new host.
+	hostsMoved := make(map[string]string)
 	for host := range hostsAdded {
 		cd, found := task.hostToConnection[host]
 		if !found {
 			return nil, 0, nil
 		}
+		if hostOld, moved := rmIdToHostOld[cd.RMId()]; moved {
+			log.Printf("Topology: %v has moved from %v to %v.\n", cd.RMId(), hostOld, host)
+			delete(hostsAdded, host)
+			delete(hostsRemoved, hostOld)
+			hostsMoved[hostOld] = host
+			rmIdsTranslation[cd.RMId()] = cd.RMId()
+			rmIdsSurvived = append(rmIdsSurvived, cd.RMId())
+			continue
+		}
 		hostsAdded[host] = cd
 		connsAdded = append(connsAdded, cd)
 	}
@@ -1062,7 +1335,11 @@ func (task *installTargetOld) calculateTargetTopology() (*configuration.Topology
 			connsAdded = append(connsAdded, hostsAdded[host]) // will not affect connsAddedCopy
 		default:
 			rmIdsNew = append(rmIdsNew, rmIdNew)
-			hostsNew = append(hostsNew, hostsOld[hostIdx])
+			host := hostsOld[hostIdx]
+			if hostNew, moved := hostsMoved[host]; moved {
+				host = hostNew
+			}
+			hostsNew = append(hostsNew, host)
 			hostIdx++
 		}
 	}
@@ -1074,7 +1351,7 @@ func (task *installTargetOld) calculateTargetTopology() (*configuration.Topology
 	}
 
 	targetTopology := task.active.Clone()
-	next := task.config.Configuration.Clone()
+	next := stage.Clone()
 	next.SetRMs(rmIdsNew)
 	next.Hosts = hostsNew
 
@@ -1107,9 +1384,13 @@ func (task *installTargetOld) calculateTargetTopology() (*configuration.Topology
 	rootsRequired := 0
 	rootIndices := make([]uint32, len(newNames))
 	for idx, name := range newNames {
-		if index, found := oldNames[name]; found {
+		if index, found := oldNames[name]; found && !task.rootMisplaced(name, &targetTopology.Roots[index], next) {
 			rootIndices[idx] = index
 		} else {
+			if found {
+				log.Printf("Topology: Relocating root %v to its pinned hosts.", name)
+				task.trace("root-relocating", "root", name, "from", targetTopology.Roots[index].VarUUId)
+			}
 			rootIndices[idx] = uint32(oldNamesCount + rootsRequired)
 			rootsRequired++
 		}
@@ -1130,6 +1411,77 @@ func (task *installTargetOld) calculateTargetTopology() (*configuration.Topology
 	return targetTopology, rootsRequired, nil
 }
 
+// rootMisplaced reports whether name is a system root which next
+// pins to hosts, but whose existing var is not held only by the RMs
+// of those hosts. Var positions can not be changed, so such a root is
+// recreated, pinned, with its current contents, and the old var left
+// to the GarbageCollector. Roots are created within the active
+// topology, so this only happens once the active topology has 2F+1
+// RMs on the pinned hosts. The topology var itself is held by every
+// RM, so has no placement to change. The topology request root is
+// never relocated: the TopologyRequestWatcher ignores the first
+// value it sees of a root var, so a request written to the old var
+// would be lost.
+func (task *installTargetOld) rootMisplaced(name string, root *configuration.Root, next *configuration.Configuration) bool {
+	if !strings.HasPrefix(name, server.SystemRootPrefix) || name == server.TopologyRequestRootName {
+		return false
+	}
+	hosts := next.PinnedHosts([]string{name})
+	if len(hosts) == 0 || len(task.active.RMsOfHosts(hosts)) < int(task.active.TwoFInc) {
+		return false
+	}
+	pinned := make(map[common.RMId]server.EmptyStruct)
+	for _, rmId := range next.RMsOfHosts(hosts) {
+		pinned[rmId] = server.EmptyStructVal
+	}
+	resolver := ch.NewResolver(next.VoterRMs(), (uint16(next.F)*2)+1)
+	rmIds, err := resolver.ResolveHashCodes((*capn.UInt8List)(root.Positions).ToArray())
+	if err != nil {
+		return false
+	}
+	for _, rmId := range rmIds {
+		if _, found := pinned[rmId]; !found {
+			return true
+		}
+	}
+	return false
+}
+
+// relocatedRoot is a root being relocated: its existing var, and
+// that var's contents when read. contents is nil if the var has never
+// been written.
+type relocatedRoot struct {
+	root     *configuration.Root
+	contents *client.LocalVar
+}
+
+// relocatedRoots reads the current state of each of the roots in
+// rootNames which already exists, and so is being relocated. The
+// roots are created by attemptCreateRoots in the same txn as the old
+// vars are read, at the versions read here, so a write to an old var
+// after it's read here causes the roots to be read and created
+// again, rather than being lost.
+func (task *installTargetOld) relocatedRoots(rootNames []string) (map[string]*relocatedRoot, error) {
+	oldNames := make(map[string]int, len(task.active.Roots))
+	for idx, name := range task.active.RootNames() {
+		oldNames[name] = idx
+	}
+	relocated := make(map[string]*relocatedRoot)
+	for _, name := range rootNames {
+		idx, found := oldNames[name]
+		if !found {
+			continue
+		}
+		root := &task.active.Roots[idx]
+		rootVar, err := task.connectionManager.readCache.Read(task.active, root.VarUUId, root.Positions, server.RootRelocationMaxAttempts, nil)
+		if err != nil {
+			return nil, err
+		}
+		relocated[name] = &relocatedRoot{root: root, contents: rootVar}
+	}
+	return relocated, nil
+}
+
 func calculateMigrationConditions(added, lost, survived []common.RMId, from, to *configuration.Configuration) configuration.Conds {
 	conditions := configuration.Conds(make(map[common.RMId]*configuration.CondSuppliers))
 	twoFIncOld := (uint16(from.F) * 2) + 1
@@ -1254,6 +1606,7 @@ func (task *awaitBarrier1) tick() error {
 	if !(next != nil && next.Version == task.config.Version && !task.active.NextBarrierReached1(task.connectionManager.RMId)) {
 		return task.completed()
 	}
+	task.sendMigrationEstimates(next)
 
 	localHost, err := task.firstLocalHost(task.active.Configuration)
 	if err != nil {
@@ -1286,6 +1639,7 @@ func (task *awaitBarrier1) tick() error {
 		active = append(newActive, active...)
 
 		log.Printf("Topology: Barrier1 reached. Active: %v, Passive: %v", active, passive)
+		task.trace("barrier1-reached")
 
 		topology := task.active.Clone()
 		next = topology.Next()
@@ -1368,6 +1722,7 @@ func (task *awaitBarrier2) tick() error {
 	if !(next != nil && next.Version == task.config.Version && !task.active.NextBarrierReached2(task.connectionManager.RMId)) {
 		return task.completed()
 	}
+	task.sendMigrationEstimates(next)
 
 	localHost, err := task.firstLocalHost(task.active.Configuration)
 	if err != nil {
@@ -1395,7 +1750,16 @@ func (task *awaitBarrier2) tick() error {
 		}
 		active = append(newActive, active...)
 
+		// Once we've reached barrier2, data can be sent to us, so we
+		// must be sure we have room for it before then.
+		if ok, err := task.ensureMigrationCapacity(next); err != nil {
+			return task.error(err)
+		} else if !ok {
+			return nil
+		}
+
 		log.Printf("Topology: Barrier2 reached. Active: %v, Passive: %v", active, passive)
+		task.trace("barrier2-reached")
 
 		topology := task.active.Clone()
 		next = topology.Next()
@@ -1457,6 +1821,7 @@ func (task *migrate) tick() error {
 	task.installTopology(task.active, nil)
 	task.connectionManager.SetDesiredServers(localHost, remoteHosts)
 	task.shareGoalWithAll()
+	task.sendMigrationEstimates(next)
 
 	if task.isInRMs(task.active.RMs()) {
 		// don't attempt any emigration unless we were in the old
@@ -1615,6 +1980,7 @@ func (task *targetConfig) createTopologyTransaction(read, write *configuration.T
 	txn := msgs.NewRootTxn(seg)
 	txn.SetSubmitter(uint32(task.connectionManager.RMId))
 	txn.SetSubmitterBootCount(task.connectionManager.BootCount())
+	txn.SetTraceId(configuration.TopologyTraceId(task.config.Version))
 
 	actionsSeg := capn.NewBuffer(nil)
 	actionsWrapper := msgs.NewRootActionListWrapper(actionsSeg)
@@ -1766,9 +2132,13 @@ func (task *targetConfig) createTopologyZero(config *configuration.NextConfigura
 
 func (task *targetConfig) rewriteTopology(read, write *configuration.Topology, active, passive common.RMIds) (*configuration.Topology, bool, error) {
 	txn := task.createTopologyTransaction(read, write, active, passive)
+	task.trace("txn-submitted", "active", active, "passive", passive)
 
 	// in general, we do backoff locally, so don't pass backoff through here
 	txnReader, result, err := task.localConnection.RunTransaction(txn, nil, nil, active...)
+	if err != nil {
+		task.trace("txn-failed", "error", err)
+	}
 	if result == nil || err != nil {
 		return nil, false, err
 	}
@@ -1777,13 +2147,16 @@ func (task *targetConfig) rewriteTopology(read, write *configuration.Topology, a
 		topology := write.Clone()
 		topology.DBVersion = txnId
 		server.Log("Topology Txn Committed ok with txnId", topology.DBVersion)
+		task.trace("txn-committed", "txnId", txnId, "version", write.Version)
 		return topology, false, nil
 	}
 	abort := result.Abort()
 	server.Log("Topology Txn Aborted", txnId)
 	if abort.Which() == msgs.OUTCOMEABORT_RESUBMIT {
+		task.trace("txn-aborted", "txnId", txnId, "resubmit", true)
 		return nil, true, nil
 	}
+	task.trace("txn-aborted", "txnId", txnId, "resubmit", false)
 	abortUpdates := abort.Rerun()
 	if abortUpdates.Len() != 1 {
 		return nil, false,
@@ -1818,27 +2191,71 @@ func (task *targetConfig) rewriteTopology(read, write *configuration.Topology, a
 	return topology, false, nil
 }
 
-func (task *targetConfig) attemptCreateRoots(rootCount int) (bool, configuration.Roots, error) {
+// attemptCreateRoots creates a root for each of rootNames. A root
+// being relocated is created with the value and references of its
+// old var, which is read in the same txn at the version they were
+// read at: if the old var has since been written, the txn aborts and
+// is resubmitted once the old var has been read again.
+func (task *targetConfig) attemptCreateRoots(rootNames []string, relocated map[string]*relocatedRoot) (bool, configuration.Roots, error) {
 	server.Log("Topology: Creating Roots.")
 
 	seg := capn.NewBuffer(nil)
 	ctxn := cmsgs.NewClientTxn(seg)
 	ctxn.SetRetry(false)
+	rootCount := len(rootNames)
 	roots := make([]configuration.Root, rootCount)
-	actions := cmsgs.NewClientActionList(seg, rootCount)
+	actions := cmsgs.NewClientActionList(seg, rootCount+len(relocated))
+	varPosMap := make(map[common.VarUUId]*common.Positions)
+	varHostsMap := make(map[common.VarUUId][]string)
 	for idx := range roots {
 		action := actions.At(idx)
 		vUUId := task.localConnection.NextVarUUId()
 		action.SetVarId(vUUId[:])
 		action.SetCreate()
 		create := action.Create()
-		create.SetValue([]byte{})
-		create.SetReferences(cmsgs.NewClientVarIdPosList(seg, 0))
+		if reloc, found := relocated[rootNames[idx]]; found && reloc.contents != nil {
+			rootVar := reloc.contents
+			create.SetValue(rootVar.Value)
+			clientRefs := cmsgs.NewClientVarIdPosList(seg, len(rootVar.References))
+			for idy, ref := range rootVar.References {
+				clientRef := clientRefs.At(idy)
+				clientRef.SetVarId(ref.Id())
+				clientRef.SetCapability(ref.Capability())
+				positions := common.Positions(ref.Positions())
+				varPosMap[*common.MakeVarUUId(ref.Id())] = &positions
+			}
+			create.SetReferences(clientRefs)
+		} else {
+			create.SetValue([]byte{})
+			create.SetReferences(cmsgs.NewClientVarIdPosList(seg, 0))
+		}
 		root := &roots[idx]
 		root.VarUUId = vUUId
+		if hosts := task.config.PinnedHosts(rootNames[idx : idx+1]); len(hosts) != 0 {
+			varHostsMap[*vUUId] = hosts
+		}
+	}
+	// The reads follow the creates, so the creates' indices match
+	// their roots'.
+	readIdx := rootCount
+	for _, name := range rootNames {
+		reloc, found := relocated[name]
+		if !found {
+			continue
+		}
+		action := actions.At(readIdx)
+		readIdx++
+		action.SetVarId(reloc.root.VarUUId[:])
+		action.SetRead()
+		if reloc.contents == nil {
+			action.Read().SetVersion(common.VersionZero[:])
+		} else {
+			action.Read().SetVersion(reloc.contents.Version[:])
+		}
+		varPosMap[*reloc.root.VarUUId] = reloc.root.Positions
 	}
 	ctxn.SetActions(actions)
-	txnReader, result, err := task.localConnection.RunClientTransaction(&ctxn, nil, nil)
+	txnReader, result, err := task.localConnection.RunPinnedClientTransaction(&ctxn, varPosMap, varHostsMap)
 	server.Log("Create root result", result, err)
 	if err != nil {
 		return false, nil, err
@@ -1867,9 +2284,29 @@ func (task *targetConfig) attemptCreateRoots(rootCount int) (bool, configuration
 	if result.Abort().Which() == msgs.OUTCOMEABORT_RESUBMIT {
 		return true, nil, nil
 	}
+	if len(relocated) != 0 {
+		// A root being relocated has been written since it was read.
+		server.Log("Topology: Root being relocated was modified; resubmitting.")
+		return true, nil, nil
+	}
 	return false, nil, fmt.Errorf("Internal error: creation of root gave rerun outcome")
 }
 
+// newRootNames returns the names of the roots which need creating
+// for targetTopology's next configuration, in the order in which
+// they are appended to targetTopology's roots.
+func newRootNames(targetTopology *configuration.Topology, rootsRequired int) []string {
+	names := make([]string, rootsRequired)
+	oldNamesCount := len(targetTopology.RootNames())
+	next := targetTopology.Next()
+	for idx, index := range next.RootIndices {
+		if idy := int(index) - oldNamesCount; idy >= 0 {
+			names[idy] = next.RootNames()[idx]
+		}
+	}
+	return names
+}
+
 // emigrator
 
 type emigrator struct {
@@ -1960,8 +2397,14 @@ type dbIterator struct {
 }
 
 func (it *dbIterator) iterate() {
+	// A learner's copies of vars are never authoritative, so a learner
+	// has nothing to send. It must still report that it's complete.
+	learner := it.topology.IsLearner(it.connectionManager.RMId)
 	ran, err := it.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
 		result, _ := rtxn.WithCursor(it.db.Vars, func(cursor *mdbs.Cursor) interface{} {
+			if learner {
+				return true
+			}
 			vUUIdBytes, varBytes, err := cursor.Get(nil, nil, mdb.FIRST)
 			for ; err == nil; vUUIdBytes, varBytes, err = cursor.Get(nil, nil, mdb.NEXT) {
 				seg, _, err := capn.ReadFromMemoryZeroCopy(varBytes)
@@ -2100,6 +2543,7 @@ func (it *dbIterator) ConnectedRMs(conns map[common.RMId]paxos.Connection) {
 			// ConnectionLost being called in the emigrator to do any
 			// necessary tidying up.
 			server.Log("Topology: Sending migration completion to", conn.RMId())
+			configuration.TraceTopology(configuration.TopologyTraceId(it.topology.Next().Version), it.connectionManager.RMId, "emigration-complete", "to", conn.RMId())
 			conn.Send(bites)
 		}
 	}
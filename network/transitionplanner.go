@@ -0,0 +1,178 @@
+package network
+
+import (
+	"fmt"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"goshawkdb.io/server/configuration"
+	"goshawkdb.io/server/paxos"
+	"sort"
+	"strings"
+)
+
+// Every var has 2F+1 replicas. Whilst a topology change goes quiet
+// and migrates, the replicas on the RMs being removed are still
+// counted on, so were a change to remove more than F RMs, or RMs in
+// several failure domains, then the further loss of a single failure
+// domain during the change could leave some vars with fewer than F+1
+// replicas. So a change which removes several hosts is planned as a
+// sequence of stages: each stage is a full topology change (quiet,
+// migrate, complete) which removes at most F hosts, all from one
+// failure domain. The first stage also adds any new hosts, so that
+// capacity only ever grows before it shrinks. Every stage has the
+// goal's version: a stable topology at the goal's version which still
+// has hosts the goal does not is simply part way through its stages.
+//
+// The plan is recalculated from the active topology at the start of
+// every stage, so it need not be persisted: any RM of the current
+// topology can carry on with the next stage. The
+// TopologyTransmogrifier keeps its latest plan only for logging and
+// status.
+type transitionPlan struct {
+	goal   *configuration.Configuration
+	stages [][]string // the hosts removed by each stage, in order
+}
+
+// planTransition plans the change from the configuration from to
+// to. moved are the hosts of from which are not in to only because
+// their RMs have moved host: they are not really removed.
+func planTransition(from, to *configuration.Configuration, moved map[string]server.EmptyStruct) *transitionPlan {
+	goalHosts := make(map[string]server.EmptyStruct, len(to.Hosts))
+	for _, host := range to.Hosts {
+		goalHosts[host] = server.EmptyStructVal
+	}
+	domainToHosts := make(map[string][]string)
+	for _, host := range from.Hosts {
+		if _, found := goalHosts[host]; found {
+			continue
+		} else if _, found := moved[host]; found {
+			continue
+		}
+		domain := from.FailureDomainOf(host)
+		domainToHosts[domain] = append(domainToHosts[domain], host)
+	}
+
+	// Biggest domains first, so that the removals which most reduce
+	// the spread of failure domains happen whilst the most hosts
+	// remain.
+	domains := make([]string, 0, len(domainToHosts))
+	for domain := range domainToHosts {
+		domains = append(domains, domain)
+	}
+	sort.Sort(domainsBySize{domains: domains, hosts: domainToHosts})
+
+	perStage := int(from.F)
+	if to.F < from.F {
+		perStage = int(to.F)
+	}
+	if perStage == 0 {
+		perStage = 1
+	}
+	plan := &transitionPlan{goal: to}
+	for _, domain := range domains {
+		hosts := domainToHosts[domain]
+		sort.Strings(hosts)
+		for len(hosts) > perStage {
+			plan.stages = append(plan.stages, hosts[:perStage])
+			hosts = hosts[perStage:]
+		}
+		plan.stages = append(plan.stages, hosts)
+	}
+	return plan
+}
+
+type domainsBySize struct {
+	domains []string
+	hosts   map[string][]string
+}
+
+func (dbs domainsBySize) Len() int { return len(dbs.domains) }
+func (dbs domainsBySize) Swap(i, j int) {
+	dbs.domains[i], dbs.domains[j] = dbs.domains[j], dbs.domains[i]
+}
+func (dbs domainsBySize) Less(i, j int) bool {
+	a, b := len(dbs.hosts[dbs.domains[i]]), len(dbs.hosts[dbs.domains[j]])
+	return a > b || (a == b && dbs.domains[i] < dbs.domains[j])
+}
+
+// movedHosts returns the hosts of from which are not in to, but
+// whose RMs we are connected to at hosts of to which are not in from.
+func movedHosts(from, to *configuration.Configuration, hostToConnection map[string]paxos.Connection) map[string]server.EmptyStruct {
+	fromHosts := make(map[string]server.EmptyStruct, len(from.Hosts))
+	for _, host := range from.Hosts {
+		fromHosts[host] = server.EmptyStructVal
+	}
+	rmIdToHost := make(map[common.RMId]string, len(from.Hosts))
+	hostIdx := 0
+	// rely on hosts and rms being in the same order.
+	for _, rmId := range from.RMs().NonEmpty() {
+		if hostIdx < len(from.Hosts) {
+			rmIdToHost[rmId] = from.Hosts[hostIdx]
+		}
+		hostIdx++
+	}
+	moved := make(map[string]server.EmptyStruct)
+	for _, host := range to.Hosts {
+		if _, found := fromHosts[host]; found {
+			continue
+		}
+		if cd, found := hostToConnection[host]; found {
+			if hostOld, found := rmIdToHost[cd.RMId()]; found {
+				moved[hostOld] = server.EmptyStructVal
+			}
+		}
+	}
+	return moved
+}
+
+// stageRemaining returns true iff from is a stable topology part way
+// through the stages of the change to to.
+func stageRemaining(from, to *configuration.Configuration) bool {
+	if from.Next() != nil || from.Version != to.Version || len(from.Hosts) <= len(to.Hosts) {
+		return false
+	}
+	fromHosts := make(map[string]server.EmptyStruct, len(from.Hosts))
+	for _, host := range from.Hosts {
+		fromHosts[host] = server.EmptyStructVal
+	}
+	for _, host := range to.Hosts {
+		if _, found := fromHosts[host]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// firstStage returns the configuration to change to now: the goal
+// itself if there is only one stage, otherwise the goal plus every
+// host which a later stage removes.
+func (plan *transitionPlan) firstStage(from *configuration.Configuration) *configuration.Configuration {
+	if len(plan.stages) <= 1 {
+		return plan.goal
+	}
+	hosts := make([]string, len(plan.goal.Hosts), len(from.Hosts)+len(plan.goal.Hosts))
+	copy(hosts, plan.goal.Hosts)
+	later := make(map[string]server.EmptyStruct)
+	for _, stage := range plan.stages[1:] {
+		for _, host := range stage {
+			later[host] = server.EmptyStructVal
+		}
+	}
+	for _, host := range from.Hosts {
+		if _, found := later[host]; found {
+			hosts = append(hosts, host)
+		}
+	}
+	return plan.goal.Staged(hosts, from)
+}
+
+func (plan *transitionPlan) String() string {
+	if len(plan.stages) == 0 {
+		return fmt.Sprintf("to version %v: no hosts removed", plan.goal.Version)
+	}
+	stages := make([]string, len(plan.stages))
+	for idx, stage := range plan.stages {
+		stages[idx] = fmt.Sprintf("%v: remove %v", idx+1, stage)
+	}
+	return fmt.Sprintf("to version %v in %v stages (%v)", plan.goal.Version, len(plan.stages), strings.Join(stages, "; "))
+}
@@ -0,0 +1,325 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mdb "github.com/msackman/gomdb"
+	mdbs "github.com/msackman/gomdb/server"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/db"
+	eng "goshawkdb.io/server/txnengine"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	db.DB.TxnJournal = &mdbs.DBISettings{Flags: mdb.CREATE}
+}
+
+// TxnJournal durably records, for auditing, the txns which this
+// node's proposers learn have committed: who submitted them, which
+// vars they wrote, and when the outcome was determined. Entries are
+// keyed by time, so can be queried by time range, and are pruned
+// once older than the retention period. A txn is recorded by every
+// node which holds one of its vars, but the submitting client's
+// fingerprint is only known to the node the client is connected to.
+// Entries are written to disk in batches, so the last few may be lost
+// if the node fails.
+type TxnJournal struct {
+	sync.Mutex
+	db                *db.Databases
+	connectionManager *ConnectionManager
+	retention         time.Duration
+	pending           []*txnJournalEntry
+	recorded          uint64
+	pruned            uint64
+	lastErr           error
+	terminate         chan struct{}
+	terminated        chan struct{}
+}
+
+type txnJournalEntry struct {
+	TxnId              string
+	Time               time.Time
+	Submitter          common.RMId
+	SubmitterBootCount uint32
+	ClientConnection   uint32
+	Fingerprint        string `json:",omitempty"`
+	Writes             []string
+	WritesUnknown      bool `json:",omitempty"`
+	txnId              *common.TxnId
+}
+
+type txnJournalQueryResult struct {
+	From      time.Time
+	To        time.Time
+	Truncated bool
+	Entries   []json.RawMessage
+}
+
+// NewTxnJournal returns a journal which retains entries for
+// retention. If retention is 0, nothing is recorded.
+func NewTxnJournal(db *db.Databases, retention time.Duration) *TxnJournal {
+	tj := &TxnJournal{
+		db:         db,
+		retention:  retention,
+		terminate:  make(chan struct{}),
+		terminated: make(chan struct{}),
+	}
+	go tj.run()
+	return tj
+}
+
+func (tj *TxnJournal) Shutdown() {
+	close(tj.terminate)
+	<-tj.terminated
+}
+
+func txnJournalDBKey(at time.Time, txnId *common.TxnId) []byte {
+	key := make([]byte, 8, 8+common.KeyLen)
+	if nanos := at.UnixNano(); nanos > 0 {
+		binary.BigEndian.PutUint64(key, uint64(nanos))
+	}
+	if txnId != nil {
+		key = append(key, txnId[:]...)
+	}
+	return key
+}
+
+// TxnCommitted is called on the proposer's executor, so we only
+// decode what we need and leave the writing to disk to run.
+func (tj *TxnJournal) TxnCommitted(txn *eng.TxnReader) {
+	if tj == nil || tj.retention == 0 {
+		return
+	}
+	txnId := txn.Id
+	txnCap := txn.Txn
+	entry := &txnJournalEntry{
+		TxnId:              hex.EncodeToString(txnId[:]),
+		Time:               time.Now(),
+		Submitter:          common.RMId(txnCap.Submitter()),
+		SubmitterBootCount: txnCap.SubmitterBootCount(),
+		ClientConnection:   binary.BigEndian.Uint32(txnId[8:12]),
+		txnId:              txnId,
+	}
+	if cm := tj.connectionManager; cm != nil && entry.Submitter == cm.RMId {
+		if conn, ok := cm.GetClient(entry.SubmitterBootCount, entry.ClientConnection).(*Connection); ok {
+			if identity := conn.clientIdentity(); identity != nil {
+				entry.Fingerprint = hex.EncodeToString(identity.fingerprint[:])
+			}
+		}
+	}
+	// A node which only learns of the outcome may only have the
+	// deflated txn, which doesn't say which vars were written.
+	entry.WritesUnknown = txn.IsDeflated()
+	actions := txn.Actions(true).Actions()
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		switch action.Which() {
+		case msgs.ACTION_WRITE, msgs.ACTION_READWRITE, msgs.ACTION_CREATE:
+			entry.Writes = append(entry.Writes, hex.EncodeToString(action.VarId()))
+		}
+	}
+	tj.Lock()
+	tj.pending = append(tj.pending, entry)
+	tj.Unlock()
+}
+
+func (tj *TxnJournal) Status(sc *server.StatusConsumer) {
+	tj.Lock()
+	defer tj.Unlock()
+	if tj.retention == 0 {
+		sc.Emit("Txn journal: disabled")
+	} else {
+		sc.Emit(fmt.Sprintf("Txn journal: retaining %v; %v recorded; %v pending; %v pruned; last error: %v",
+			tj.retention, tj.recorded, len(tj.pending), tj.pruned, tj.lastErr))
+	}
+	sc.Join()
+}
+
+func (tj *TxnJournal) run() {
+	defer close(tj.terminated)
+	if tj.retention == 0 {
+		<-tj.terminate
+		return
+	}
+	flushTicker := time.NewTicker(server.TxnJournalFlushInterval)
+	defer flushTicker.Stop()
+	pruneTicker := time.NewTicker(server.TxnJournalPruneInterval)
+	defer pruneTicker.Stop()
+	for {
+		var err error
+		select {
+		case <-tj.terminate:
+			if err = tj.flush(); err != nil {
+				log.Println("Txn journal error:", err)
+			}
+			return
+		case <-flushTicker.C:
+			err = tj.flush()
+		case <-pruneTicker.C:
+			err = tj.prune()
+		}
+		if err != nil {
+			log.Println("Txn journal error:", err)
+		}
+		tj.Lock()
+		tj.lastErr = err
+		tj.Unlock()
+	}
+}
+
+func (tj *TxnJournal) flush() error {
+	tj.Lock()
+	entries := tj.pending
+	tj.pending = nil
+	tj.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	_, err := tj.db.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
+		for _, entry := range entries {
+			value, err := json.Marshal(entry)
+			if err != nil {
+				rwtxn.Error(err)
+				return nil
+			}
+			if err := rwtxn.Put(tj.db.TxnJournal, txnJournalDBKey(entry.Time, entry.txnId), value, 0); err != nil {
+				rwtxn.Error(err)
+				return nil
+			}
+		}
+		return nil
+	}).ResultError()
+	if err == nil {
+		tj.Lock()
+		tj.recorded += uint64(len(entries))
+		tj.Unlock()
+	}
+	return err
+}
+
+// prune deletes entries older than the retention period, a batch at
+// a time so as not to hold up other writers.
+func (tj *TxnJournal) prune() error {
+	cutoff := txnJournalDBKey(time.Now().Add(-tj.retention), nil)
+	for {
+		res, err := tj.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+			res, _ := rtxn.WithCursor(tj.db.TxnJournal, func(cursor *mdbs.Cursor) interface{} {
+				keys := [][]byte{}
+				key, _, err := cursor.Get(nil, nil, mdb.FIRST)
+				for ; err == nil && len(keys) < server.TxnJournalBatchSize && string(key) < string(cutoff); key, _, err = cursor.Get(nil, nil, mdb.NEXT) {
+					keys = append(keys, append([]byte{}, key...))
+				}
+				if err != nil && err != mdb.NotFound {
+					cursor.Error(err)
+					return nil
+				}
+				return keys
+			})
+			return res
+		}).ResultError()
+		if err != nil {
+			return err
+		}
+		keys, _ := res.([][]byte)
+		if len(keys) == 0 {
+			return nil
+		}
+		_, err = tj.db.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
+			for _, key := range keys {
+				if err := rwtxn.Del(tj.db.TxnJournal, key, nil); err != nil && err != mdb.NotFound {
+					rwtxn.Error(err)
+					return nil
+				}
+			}
+			return nil
+		}).ResultError()
+		if err != nil {
+			return err
+		}
+		tj.Lock()
+		tj.pruned += uint64(len(keys))
+		tj.Unlock()
+		if len(keys) < server.TxnJournalBatchSize {
+			return nil
+		}
+	}
+}
+
+// ServeQuery writes, as JSON, the entries recorded between the from
+// and to query parameters (RFC3339; from defaults to the start of
+// the retention period, to defaults to now), oldest first, up to
+// limit entries.
+func (tj *TxnJournal) ServeQuery(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if tj.retention == 0 {
+		http.Error(w, "Txn journal is disabled", http.StatusNotFound)
+		return
+	}
+	query := req.URL.Query()
+	result := &txnJournalQueryResult{
+		From:    time.Now().Add(-tj.retention),
+		To:      time.Now(),
+		Entries: []json.RawMessage{},
+	}
+	for param, t := range map[string]*time.Time{"from": &result.From, "to": &result.To} {
+		if str := query.Get(param); str != "" {
+			parsed, err := time.Parse(time.RFC3339, str)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Illegal %v: %v", param, err), http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+	limit := server.TxnJournalQueryLimit
+	if str := query.Get("limit"); str != "" {
+		l, err := strconv.Atoi(str)
+		if err != nil || l <= 0 || l > server.TxnJournalQueryLimit {
+			http.Error(w, fmt.Sprintf("Illegal limit: must be between 1 and %v", server.TxnJournalQueryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = l
+	}
+
+	from, to := txnJournalDBKey(result.From, nil), txnJournalDBKey(result.To, nil)
+	res, err := tj.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+		res, _ := rtxn.WithCursor(tj.db.TxnJournal, func(cursor *mdbs.Cursor) interface{} {
+			entries := []json.RawMessage{}
+			key, value, err := cursor.Get(from, nil, mdb.SET_RANGE)
+			for ; err == nil && string(key) < string(to); key, value, err = cursor.Get(nil, nil, mdb.NEXT) {
+				if len(entries) == limit {
+					result.Truncated = true
+					break
+				}
+				entries = append(entries, json.RawMessage(append([]byte{}, value...)))
+			}
+			if err != nil && err != mdb.NotFound {
+				cursor.Error(err)
+				return nil
+			}
+			return entries
+		})
+		return res
+	}).ResultError()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries, ok := res.([]json.RawMessage); ok {
+		result.Entries = entries
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,109 @@
+package network
+
+import (
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/paxos"
+	"time"
+)
+
+var (
+	voteBatchesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "vote_batches_sent_total",
+		Help:      "Number of batches of paxos votes sent to other servers.",
+	})
+	votesBatched = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "votes_batched_total",
+		Help:      "Number of paxos votes sent to other servers within batches.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(voteBatchesSent)
+	prometheus.MustRegister(votesBatched)
+}
+
+// Under load, a server connection carries a stream of small 1A, 1B,
+// 2A and 2B messages for many different txns, each of which costs a
+// frame and a write of its own. So if the peer supports it, votes are
+// held for up to server.VoteBatchWindow, or until there are
+// server.VoteBatchMaxVotes of them, and then sent together in a single
+// voteBatch message. The peer handles each vote in the batch exactly
+// as if it had arrived on its own. Any other message sends the batch
+// first, so the order of messages on the connection is unchanged.
+type voteBatch struct {
+	votes [][]byte
+	timer *time.Timer
+}
+
+type connectionMsgFlushVotes struct{ connectionMsgBasic }
+
+// sendServerMessage sends msg to the peer server, adding it to the
+// batch if it's a vote.
+func (cr *connectionRun) sendServerMessage(msg []byte) error {
+	if cr.currentState != cr || cr.remoteFeatures < server.FeatureVoteBatches {
+		return cr.sendMessage(msg)
+	}
+	if seg, _, err := capn.ReadFromMemoryZeroCopy(msg); err != nil || !paxos.IsVote(msgs.ReadRootMessage(seg).Which()) {
+		if err := cr.flushVotes(); err != nil {
+			return err
+		}
+		return cr.sendMessage(msg)
+	}
+	cr.votes.votes = append(cr.votes.votes, msg)
+	if len(cr.votes.votes) >= server.VoteBatchMaxVotes {
+		return cr.flushVotes()
+	} else if cr.votes.timer == nil {
+		conn := cr.Connection
+		cr.votes.timer = time.AfterFunc(server.VoteBatchWindow, func() { conn.enqueueQuery(connectionMsgFlushVotes{}) })
+	}
+	return nil
+}
+
+func (cr *connectionRun) flushVotes() error {
+	votes := cr.votes.votes
+	cr.resetVotes()
+	switch len(votes) {
+	case 0:
+		return nil
+	case 1:
+		return cr.sendMessage(votes[0])
+	}
+	seg := capn.NewBuffer(nil)
+	msg := msgs.NewRootMessage(seg)
+	batch := seg.NewDataList(len(votes))
+	for idx, vote := range votes {
+		batch.Set(idx, vote)
+	}
+	msg.SetVoteBatch(batch)
+	voteBatchesSent.Inc()
+	votesBatched.Add(float64(len(votes)))
+	return cr.sendMessage(server.SegToBytes(seg))
+}
+
+// resetVotes drops any batched votes. Votes lost when a connection
+// restarts are resent, just as those in flight are.
+func (cr *connectionRun) resetVotes() {
+	if cr.votes.timer != nil {
+		cr.votes.timer.Stop()
+	}
+	cr.votes = voteBatch{}
+}
+
+func (cr *connectionRun) voteBatchReceived(batch msgs.Message) error {
+	for _, vote := range batch.VoteBatch().ToArray() {
+		seg, _, err := capn.ReadFromMemoryZeroCopy(vote)
+		if err != nil {
+			return cr.maybeRestartConnection(fmt.Errorf("Undecodable vote in batch from %v: %v", cr.remoteRMId, err))
+		}
+		if err := cr.handleMsgFromServer(msgs.ReadRootMessage(seg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,16 +2,28 @@ package paxos
 
 import (
 	"fmt"
-	capn "github.com/glycerine/go-capnproto"
 	mdbs "github.com/msackman/gomdb/server"
+	"github.com/prometheus/client_golang/prometheus"
 	"goshawkdb.io/common"
 	"goshawkdb.io/server"
 	msgs "goshawkdb.io/server/capnp"
 	"goshawkdb.io/server/configuration"
 	eng "goshawkdb.io/server/txnengine"
 	"log"
+	"sync/atomic"
+	"time"
 )
 
+var acceptorSubmissionOutcomesReleased = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "goshawkdb",
+	Name:      "acceptor_submission_outcomes_released_total",
+	Help:      "Number of acceptors which released their copy of the submitter's outcome on TSC whilst still awaiting TLCs.",
+})
+
+func init() {
+	prometheus.MustRegister(acceptorSubmissionOutcomesReleased)
+}
+
 type Acceptor struct {
 	txnId           *common.TxnId
 	acceptorManager *AcceptorManager
@@ -109,6 +121,7 @@ type acceptorReceiveBallots struct {
 	txnSubmitter          common.RMId
 	txnSubmitterBootCount uint32
 	txnSender             *RepeatingSender
+	created               time.Time
 }
 
 func (arb *acceptorReceiveBallots) init(a *Acceptor, txn *eng.TxnReader) {
@@ -117,6 +130,7 @@ func (arb *acceptorReceiveBallots) init(a *Acceptor, txn *eng.TxnReader) {
 	arb.txn = txn
 	arb.txnSubmitter = common.RMId(txn.Txn.Submitter())
 	arb.txnSubmitterBootCount = txn.Txn.SubmitterBootCount()
+	arb.created = time.Now()
 }
 
 func (arb *acceptorReceiveBallots) start() {
@@ -163,6 +177,9 @@ func (arb *acceptorReceiveBallots) BallotAccepted(instanceRMId common.RMId, inst
 	}
 	outcome := arb.ballotAccumulator.BallotReceived(instanceRMId, inst, vUUId, txn)
 	if outcome != nil && !outcome.Equal(arb.outcome) {
+		if arb.outcome == nil {
+			acceptorPhaseTwo.Observe(secondsSince(arb.created))
+		}
 		arb.outcome = outcome
 		arb.nextState(&arb.acceptorWriteToDisk)
 	}
@@ -192,7 +209,7 @@ func (arb *acceptorReceiveBallots) enqueueCreateTxnSender() {
 func (arb *acceptorReceiveBallots) createTxnSender() {
 	if arb.currentState == arb && arb.txnSender == nil {
 		arb.acceptorManager.RemoveServerConnectionSubscriber(arb)
-		seg := capn.NewBuffer(nil)
+		seg := server.NewPooledSegment(len(arb.txn.Data))
 		msg := msgs.NewRootMessage(seg)
 		msg.SetTxnSubmission(arb.txn.Data)
 		activeRMs := make([]common.RMId, 0, arb.txn.Txn.FInc()*2-1)
@@ -206,7 +223,7 @@ func (arb *acceptorReceiveBallots) createTxnSender() {
 			}
 		}
 		server.Log(arb.txnId, "Starting extra txn sender with actives:", activeRMs)
-		arb.txnSender = NewRepeatingSender(server.SegToBytes(seg), activeRMs...)
+		arb.txnSender = NewRepeatingSender(server.SegToBytesAndRelease(seg), activeRMs...)
 		arb.acceptorManager.AddServerConnectionSubscriber(arb.txnSender)
 	}
 }
@@ -233,17 +250,18 @@ func (awtd *acceptorWriteToDisk) start() {
 	outcomeCap := (*msgs.Outcome)(outcome)
 	awtd.sendToAll = awtd.sendToAll || outcomeCap.Which() == msgs.OUTCOME_COMMIT
 	sendToAll := awtd.sendToAll
-	stateSeg := capn.NewBuffer(nil)
+	stateSeg := server.NewPooledSegment(0)
 	state := msgs.NewRootAcceptorState(stateSeg)
 	state.SetOutcome(*outcomeCap)
 	state.SetSendToAll(awtd.sendToAll)
 	state.SetInstances(awtd.ballotAccumulator.AddInstancesToSeg(stateSeg))
 
-	data := server.SegToBytes(stateSeg)
+	data := server.SegToBytesAndRelease(stateSeg)
 
 	// to ensure correct order of writes, schedule the write from
 	// the current go-routine...
 	server.Log(awtd.txnId, "Writing 2B to disk...")
+	start := time.Now()
 	future := awtd.acceptorManager.DB.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
 		rwtxn.Put(awtd.acceptorManager.DB.BallotOutcomes, awtd.txnId[:], data, 0)
 		return true
@@ -253,6 +271,7 @@ func (awtd *acceptorWriteToDisk) start() {
 		if ran, err := future.ResultError(); err != nil {
 			panic(fmt.Sprintf("Error: %v Acceptor Write error: %v", awtd.txnId, err))
 		} else if ran != nil {
+			acceptorPhaseDisk.Observe(secondsSince(start))
 			server.Log(awtd.txnId, "Writing 2B to disk...done.")
 			awtd.acceptorManager.Exe.Enqueue(func() { awtd.writeDone(outcome, sendToAll) })
 		}
@@ -285,6 +304,7 @@ type acceptorAwaitLocallyComplete struct {
 	tscReceived   bool
 	twoBSender    *twoBTxnVotesSender
 	txnSubmitter  common.RMId
+	onDisk        time.Time
 }
 
 func (aalc *acceptorAwaitLocallyComplete) init(a *Acceptor, txn *eng.TxnReader) {
@@ -298,6 +318,7 @@ func (aalc *acceptorAwaitLocallyComplete) start() {
 		aalc.acceptorManager.RemoveServerConnectionSubscriber(aalc.twoBSender)
 		aalc.twoBSender = nil
 	}
+	aalc.onDisk = time.Now()
 
 	// If our outcome changes, it may look here like we're throwing
 	// away TLCs received from proposers/learners. However,
@@ -349,6 +370,9 @@ func (aalc *acceptorAwaitLocallyComplete) start() {
 		server.Log(aalc.txnId, "Adding sender for 2B")
 		submitter := common.RMId(aalc.ballotAccumulator.txn.Txn.Submitter())
 		aalc.twoBSender = newTwoBTxnVotesSender((*msgs.Outcome)(aalc.outcomeOnDisk), aalc.txnId, submitter, aalc.tgcRecipients...)
+		if aalc.tscReceived {
+			aalc.twoBSender.submissionComplete()
+		}
 		aalc.acceptorManager.AddServerConnectionSubscriber(aalc.twoBSender)
 	}
 }
@@ -371,6 +395,10 @@ func (aalc *acceptorAwaitLocallyComplete) TxnSubmissionCompleteReceived(sender c
 	if !aalc.tscReceived {
 		aalc.tscReceived = true
 		aalc.maybeDelete()
+		if aalc.currentState == aalc && aalc.twoBSender != nil {
+			aalc.twoBSender.submissionComplete()
+			acceptorSubmissionOutcomesReleased.Inc()
+		}
 	}
 }
 
@@ -398,6 +426,7 @@ func (aalc *acceptorAwaitLocallyComplete) TopologyChanged(topology *configuratio
 
 func (aalc *acceptorAwaitLocallyComplete) maybeDelete() {
 	if aalc.currentState == aalc && aalc.tscReceived && len(aalc.pendingTLC) == 0 {
+		acceptorPhaseTLC.Observe(secondsSince(aalc.onDisk))
 		aalc.nextState(nil)
 	}
 }
@@ -417,6 +446,7 @@ func (adfd *acceptorDeleteFromDisk) start() {
 		adfd.acceptorManager.RemoveServerConnectionSubscriber(adfd.twoBSender)
 		adfd.twoBSender = nil
 	}
+	start := time.Now()
 	future := adfd.acceptorManager.DB.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
 		rwtxn.Del(adfd.acceptorManager.DB.BallotOutcomes, adfd.txnId[:], nil)
 		return true
@@ -425,6 +455,7 @@ func (adfd *acceptorDeleteFromDisk) start() {
 		if ran, err := future.ResultError(); err != nil {
 			panic(fmt.Sprintf("Error: %v Acceptor Deletion error: %v", adfd.txnId, err))
 		} else if ran != nil {
+			acceptorPhaseDisk.Observe(secondsSince(start))
 			server.Log(adfd.txnId, "Deleted 2B from disk...done.")
 			adfd.acceptorManager.Exe.Enqueue(adfd.deletionDone)
 		}
@@ -441,7 +472,7 @@ func (adfd *acceptorDeleteFromDisk) deletionDone() {
 		adfd.nextState(nil)
 		adfd.acceptorManager.AcceptorFinished(adfd.txnId)
 
-		seg := capn.NewBuffer(nil)
+		seg := server.NewPooledSegment(0)
 		msg := msgs.NewRootMessage(seg)
 		tgc := msgs.NewTxnGloballyComplete(seg)
 		msg.SetTxnGloballyComplete(tgc)
@@ -449,21 +480,20 @@ func (adfd *acceptorDeleteFromDisk) deletionDone() {
 		server.Log(adfd.txnId, "Sending TGC to", adfd.tgcRecipients)
 		// If this gets lost it doesn't matter - the TLC will eventually
 		// get resent and we'll then send out another TGC.
-		NewOneShotSender(server.SegToBytes(seg), adfd.acceptorManager, adfd.tgcRecipients...)
+		adfd.acceptorManager.ResendScheduler().SendOnce(server.SegToBytesAndRelease(seg), adfd.tgcRecipients...)
 	}
 }
 
 // 2B Sender
 
 type twoBTxnVotesSender struct {
-	msg          []byte
-	recipients   []common.RMId
-	submitterMsg []byte
+	repeating
+	submitterMsg atomic.Value // []byte: see submissionComplete
 	submitter    common.RMId
 }
 
 func newTwoBTxnVotesSender(outcome *msgs.Outcome, txnId *common.TxnId, submitter common.RMId, recipients ...common.RMId) *twoBTxnVotesSender {
-	submitterSeg := capn.NewBuffer(nil)
+	submitterSeg := server.NewPooledSegment(0)
 	submitterMsg := msgs.NewRootMessage(submitterSeg)
 	submitterMsg.SetSubmissionOutcome(*outcome)
 
@@ -472,7 +502,7 @@ func newTwoBTxnVotesSender(outcome *msgs.Outcome, txnId *common.TxnId, submitter
 		abort.SetResubmit() // nuke out the updates as proposers don't need them.
 	}
 
-	seg := capn.NewBuffer(nil)
+	seg := server.NewPooledSegment(0)
 	msg := msgs.NewRootMessage(seg)
 	twoB := msgs.NewTwoBTxnVotes(seg)
 	msg.SetTwoBTxnVotes(twoB)
@@ -480,22 +510,38 @@ func newTwoBTxnVotesSender(outcome *msgs.Outcome, txnId *common.TxnId, submitter
 
 	server.Log(txnId, "Sending 2B to", recipients)
 
-	return &twoBTxnVotesSender{
-		msg:          server.SegToBytes(seg),
-		recipients:   recipients,
-		submitterMsg: server.SegToBytes(submitterSeg),
-		submitter:    submitter,
+	sender := &twoBTxnVotesSender{
+		repeating: newRepeating(server.SegToBytesAndRelease(seg), recipients),
+		submitter: submitter,
 	}
+	sender.submitterMsg.Store(server.SegToBytesAndRelease(submitterSeg))
+	return sender
+}
+
+// submissionComplete drops the outcome we send the submitter, once
+// it has told us (by TSC) that it has the outcome. For an abort, that
+// outcome carries the updates with which the submitter reruns the
+// txn: they are most of the outcome, and only the submitter uses
+// them, yet learners partitioned away from us can keep us sending 2Bs
+// for a long time. The outcome on disk is untouched, so should we
+// restart before we're done, the submitter is sent the whole outcome
+// once more. The publisher may be sending concurrently, hence the
+// atomic.
+func (s *twoBTxnVotesSender) submissionComplete() {
+	s.submitterMsg.Store([]byte(nil))
 }
 
 func (s *twoBTxnVotesSender) ConnectedRMs(conns map[common.RMId]Connection) {
 	for _, rmId := range s.recipients {
 		if conn, found := conns[rmId]; found {
+			s.sending(rmId)
 			conn.Send(s.msg)
 		}
 	}
 	if conn, found := conns[s.submitter]; found {
-		conn.Send(s.submitterMsg)
+		if msg := s.submitterMsg.Load().([]byte); msg != nil {
+			conn.Send(msg)
+		}
 	}
 }
 
@@ -504,12 +550,15 @@ func (s *twoBTxnVotesSender) ConnectionLost(common.RMId, map[common.RMId]Connect
 func (s *twoBTxnVotesSender) ConnectionEstablished(rmId common.RMId, conn Connection, conns map[common.RMId]Connection, done func()) {
 	for _, recipient := range s.recipients {
 		if recipient == rmId {
+			s.sending(rmId)
 			conn.Send(s.msg)
 			break
 		}
 	}
 	if s.submitter == rmId {
-		conn.Send(s.submitterMsg)
+		if msg := s.submitterMsg.Load().([]byte); msg != nil {
+			conn.Send(msg)
+		}
 	}
 	done()
 }
@@ -0,0 +1,88 @@
+package paxos
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/server/capnp"
+	"testing"
+)
+
+// testConnection records the messages sent to an RM.
+type testConnection struct {
+	rmId common.RMId
+	sent [][]byte
+}
+
+func (tc *testConnection) Host() string        { return "test" }
+func (tc *testConnection) RMId() common.RMId   { return tc.rmId }
+func (tc *testConnection) BootCount() uint32   { return 1 }
+func (tc *testConnection) TieBreak() uint32    { return 0 }
+func (tc *testConnection) ClusterUUId() uint64 { return 0 }
+func (tc *testConnection) Send(msg []byte)     { tc.sent = append(tc.sent, msg) }
+
+func testMessage(t *testing.T, data []byte) msgs.Message {
+	seg, _, err := capn.ReadFromMemoryZeroCopy(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs.ReadRootMessage(seg)
+}
+
+// An abort whose rerun carries one update.
+func testAbortOutcome(txnId *common.TxnId) *msgs.Outcome {
+	seg := capn.NewBuffer(nil)
+	outcome := msgs.NewRootOutcome(seg)
+	outcome.SetId(msgs.NewOutcomeIdList(seg, 0))
+	outcome.SetTxn([]byte{})
+	outcome.SetAbort()
+	updates := msgs.NewUpdateList(seg, 1)
+	update := updates.At(0)
+	update.SetTxnId(txnId[:])
+	update.SetActions([]byte{})
+	update.SetClock([]byte{})
+	outcome.Abort().SetRerun(updates)
+	return &outcome
+}
+
+// Once the submitter has sent TSC, a duplicate request for the
+// outcome (the submitter's connection being re-established) is not
+// answered, but learners are still sent their 2Bs. Until then, the
+// submitter is sent the whole outcome, updates and all.
+func TestTwoBSenderSubmissionComplete(t *testing.T) {
+	txnId := common.MakeTxnId(testProposerId(1))
+	submitter := &testConnection{rmId: 1}
+	learner := &testConnection{rmId: 2}
+	conns := map[common.RMId]Connection{submitter.rmId: submitter, learner.rmId: learner}
+	sender := newTwoBTxnVotesSender(testAbortOutcome(txnId), txnId, submitter.rmId, learner.rmId)
+
+	sender.ConnectedRMs(conns)
+	if len(submitter.sent) != 1 {
+		t.Fatalf("Expected the submitter to be sent 1 outcome; sent %v", len(submitter.sent))
+	}
+	msg := testMessage(t, submitter.sent[0])
+	if msg.Which() != msgs.MESSAGE_SUBMISSIONOUTCOME {
+		t.Fatalf("Expected the submitter to be sent its outcome; sent %v", msg.Which())
+	}
+	abort := msg.SubmissionOutcome().Abort()
+	if abort.Which() != msgs.OUTCOMEABORT_RERUN || abort.Rerun().Len() != 1 {
+		t.Fatal("Expected the submitter's outcome to keep its updates")
+	}
+	if len(learner.sent) != 1 || testMessage(t, learner.sent[0]).Which() != msgs.MESSAGE_TWOBTXNVOTES {
+		t.Fatal("Expected the learner to be sent a 2B")
+	}
+
+	sender.submissionComplete()
+	done := func() {}
+	sender.ConnectionEstablished(submitter.rmId, submitter, conns, done)
+	sender.ConnectionEstablished(learner.rmId, learner, conns, done)
+	if len(submitter.sent) != 1 {
+		t.Fatal("Expected the submitter not to be sent its outcome again after TSC")
+	}
+	if len(learner.sent) != 2 {
+		t.Fatalf("Expected the learner to be sent its 2B again; sent %v", len(learner.sent))
+	}
+	sender.ConnectedRMs(conns)
+	if len(submitter.sent) != 1 || len(learner.sent) != 3 {
+		t.Fatal("Expected only the learner to be sent its 2B again")
+	}
+}
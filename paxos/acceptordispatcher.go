@@ -11,19 +11,21 @@ import (
 	"goshawkdb.io/server/dispatcher"
 	eng "goshawkdb.io/server/txnengine"
 	"log"
+	"sync"
 )
 
 type AcceptorDispatcher struct {
 	dispatcher.Dispatcher
 	connectionManager ConnectionManager
 	acceptormanagers  []*AcceptorManager
+	recovery          *SubsystemRecovery
 }
 
 func NewAcceptorDispatcher(count uint8, rmId common.RMId, cm ConnectionManager, db *db.Databases) *AcceptorDispatcher {
 	ad := &AcceptorDispatcher{
 		acceptormanagers: make([]*AcceptorManager, count),
 	}
-	ad.Dispatcher.Init(count)
+	ad.Dispatcher.Init("AcceptorDispatcher", count)
 	for idx, exe := range ad.Executors {
 		ad.acceptormanagers[idx] = NewAcceptorManager(rmId, exe, cm, db)
 	}
@@ -52,8 +54,38 @@ func (ad *AcceptorDispatcher) TxnSubmissionCompleteReceived(sender common.RMId,
 	ad.withAcceptorManager(txnId, func(am *AcceptorManager) { am.TxnSubmissionCompleteReceived(sender, txnId, tsc) })
 }
 
+// LearnerLags returns, for each of learners, the outcomes which it has
+// yet to confirm it has learnt from any of our acceptors. It waits
+// for each AcceptorManager's executor in turn.
+func (ad *AcceptorDispatcher) LearnerLags(learners common.RMIds) map[common.RMId]*LearnerLag {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	lags := make(map[common.RMId]*LearnerLag, len(learners))
+	for _, rmId := range learners {
+		lags[rmId] = &LearnerLag{}
+	}
+	for idx, executor := range ad.Executors {
+		manager := ad.acceptormanagers[idx]
+		wg.Add(1)
+		if !executor.Offer(func() {
+			managerLags := manager.learnerLags(learners)
+			lock.Lock()
+			for rmId, lag := range managerLags {
+				lags[rmId].add(lag)
+			}
+			lock.Unlock()
+			wg.Done()
+		}) {
+			wg.Done()
+		}
+	}
+	wg.Wait()
+	return lags
+}
+
 func (ad *AcceptorDispatcher) Status(sc *server.StatusConsumer) {
 	sc.Emit("Acceptors")
+	sc.Emit(fmt.Sprintf("Queue limit: %v", ad.QueueLimit))
 	for idx, executor := range ad.Executors {
 		s := sc.Fork()
 		s.Emit(fmt.Sprintf("Acceptor Manager %v", idx))
@@ -64,6 +96,7 @@ func (ad *AcceptorDispatcher) Status(sc *server.StatusConsumer) {
 }
 
 func (ad *AcceptorDispatcher) loadFromDisk(db *db.Databases) {
+	ad.recovery = newSubsystemRecovery("acceptors", len(ad.Executors))
 	res, err := db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
 		res, _ := rtxn.WithCursor(db.BallotOutcomes, func(cursor *mdbs.Cursor) interface{} {
 			// cursor.Get returns a copy of the data. So it's fine for us
@@ -92,9 +125,11 @@ func (ad *AcceptorDispatcher) loadFromDisk(db *db.Databases) {
 		for txnId, acceptorState := range acceptorStates {
 			acceptorStateCopy := acceptorState
 			txnIdCopy := txnId
+			ad.recovery.loaded(txnIdCopy)
 			ad.withAcceptorManager(txnIdCopy, func(am *AcceptorManager) {
 				if err := am.loadFromData(txnIdCopy, acceptorStateCopy); err != nil {
 					log.Printf("AcceptorDispatcher error loading %v from disk: %v\n", txnIdCopy, err)
+					ad.recovery.failed()
 				}
 			})
 		}
@@ -102,9 +137,14 @@ func (ad *AcceptorDispatcher) loadFromDisk(db *db.Databases) {
 	}
 }
 
+func (ad *AcceptorDispatcher) awaitRecovery() *SubsystemRecovery {
+	ad.recovery.awaitManagers(ad.Executors, func(idx int) int { return len(ad.acceptormanagers[idx].acceptors) })
+	return ad.recovery
+}
+
 func (ad *AcceptorDispatcher) withAcceptorManager(txnId *common.TxnId, fun func(*AcceptorManager)) bool {
 	idx := uint8(txnId[server.MostRandomByteIndex]) % ad.ExecutorCount
 	executor := ad.Executors[idx]
 	manager := ad.acceptormanagers[idx]
-	return executor.Enqueue(func() { fun(manager) })
+	return executor.EnqueueFor(txnId, func() { fun(manager) })
 }
@@ -14,6 +14,7 @@ import (
 	"goshawkdb.io/server/db"
 	"goshawkdb.io/server/dispatcher"
 	eng "goshawkdb.io/server/txnengine"
+	"time"
 )
 
 func init() {
@@ -174,7 +175,7 @@ func (am *AcceptorManager) OneATxnVotesReceived(sender common.RMId, txnId *commo
 	copy(instIdSlice, txnId[:])
 	binary.BigEndian.PutUint32(instIdSlice[common.KeyLen:], uint32(instanceRMId))
 
-	replySeg := capn.NewBuffer(nil)
+	replySeg := server.NewPooledSegment(0)
 	msg := msgs.NewRootMessage(replySeg)
 	oneBTxnVotes := msgs.NewOneBTxnVotes(replySeg)
 	msg.SetOneBTxnVotes(oneBTxnVotes)
@@ -193,8 +194,8 @@ func (am *AcceptorManager) OneATxnVotesReceived(sender common.RMId, txnId *commo
 		am.ensureInstance(txnId, &instId, vUUId).OneATxnVotesReceived(&proposal, &promise)
 	}
 
-	// The proposal senders are repeating, so this use of OSS is fine.
-	NewOneShotSender(server.SegToBytes(replySeg), am, sender)
+	// The proposal senders are repeating, so this use of SendOnce is fine.
+	am.ResendScheduler().SendOnce(server.SegToBytesAndRelease(replySeg), sender)
 }
 
 func (am *AcceptorManager) TwoATxnVotesReceived(sender common.RMId, txn *eng.TxnReader, twoATxnVotes *msgs.TwoATxnVotes) {
@@ -227,7 +228,7 @@ func (am *AcceptorManager) TwoATxnVotesReceived(sender common.RMId, txn *eng.Txn
 	}
 
 	if len(failureInstances) != 0 {
-		replySeg := capn.NewBuffer(nil)
+		replySeg := server.NewPooledSegment(0)
 		msg := msgs.NewRootMessage(replySeg)
 		twoBTxnVotes := msgs.NewTwoBTxnVotes(replySeg)
 		msg.SetTwoBTxnVotes(twoBTxnVotes)
@@ -244,8 +245,8 @@ func (am *AcceptorManager) TwoATxnVotesReceived(sender common.RMId, txn *eng.Txn
 			failure.SetRoundNumberTooLow(uint32(inst.promiseNum >> 32))
 		}
 		server.Log(txnId, "Sending 2B failures to", sender, "; instance:", instanceRMId)
-		// The proposal senders are repeating, so this use of OSS is fine.
-		NewOneShotSender(server.SegToBytes(replySeg), am, sender)
+		// The proposal senders are repeating, so this use of SendOnce is fine.
+		am.ResendScheduler().SendOnce(server.SegToBytesAndRelease(replySeg), sender)
 	}
 }
 
@@ -260,15 +261,15 @@ func (am *AcceptorManager) TxnLocallyCompleteReceived(sender common.RMId, txnId
 		// back up, the proposers have sent us more TLCs, and we should
 		// just reply with TGCs.
 		server.Log(txnId, "TLC received from", sender, "(acceptor not found)")
-		seg := capn.NewBuffer(nil)
+		seg := server.NewPooledSegment(0)
 		msg := msgs.NewRootMessage(seg)
 		tgc := msgs.NewTxnGloballyComplete(seg)
 		msg.SetTxnGloballyComplete(tgc)
 		tgc.SetTxnId(txnId[:])
 		server.Log(txnId, "Sending single TGC to", sender)
-		// Use of OSS here is ok because this is the default action on
+		// Use of SendOnce here is ok because this is the default action on
 		// not finding state.
-		NewOneShotSender(server.SegToBytes(seg), am, sender)
+		am.ResendScheduler().SendOnce(server.SegToBytesAndRelease(seg), sender)
 	}
 }
 
@@ -307,6 +308,42 @@ func (am *AcceptorManager) Status(sc *server.StatusConsumer) {
 	sc.Join()
 }
 
+// LearnerLag describes the outcomes which a learner has yet to
+// confirm it has learnt: how many, and when the oldest was written to
+// disk by an acceptor.
+type LearnerLag struct {
+	Pending int
+	Oldest  time.Time
+}
+
+func (lag *LearnerLag) add(b *LearnerLag) {
+	lag.Pending += b.Pending
+	if !b.Oldest.IsZero() && (lag.Oldest.IsZero() || b.Oldest.Before(lag.Oldest)) {
+		lag.Oldest = b.Oldest
+	}
+}
+
+// learnerLags finds the acceptors which are still waiting for a TLC
+// from any of learners.
+func (am *AcceptorManager) learnerLags(learners common.RMIds) map[common.RMId]*LearnerLag {
+	lags := make(map[common.RMId]*LearnerLag, len(learners))
+	for _, rmId := range learners {
+		lags[rmId] = &LearnerLag{}
+	}
+	for _, aInst := range am.acceptors {
+		acc := aInst.acceptor
+		if acc == nil || acc.currentState != &acc.acceptorAwaitLocallyComplete {
+			continue
+		}
+		for _, rmId := range learners {
+			if _, found := acc.pendingTLC[rmId]; found {
+				lags[rmId].add(&LearnerLag{Pending: 1, Oldest: acc.onDisk})
+			}
+		}
+	}
+	return lags
+}
+
 type acceptorInstances struct {
 	acceptor  *Acceptor
 	instances []*instanceId
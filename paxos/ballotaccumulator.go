@@ -482,6 +482,8 @@ func (br badReads) AddToSeg(seg *capn.Segment) msgs.Update_List {
 				newAction.SetWrite()
 				newWrite := newAction.Write()
 				newWrite.SetValue(readWrite.Value())
+				newAction.SetValueCodec(action.ValueCodec())
+				newAction.SetFrozen(action.Frozen())
 				newWrite.SetReferences(readWrite.References())
 			case msgs.ACTION_CREATE:
 				create := action.Create()
@@ -490,6 +492,8 @@ func (br badReads) AddToSeg(seg *capn.Segment) msgs.Update_List {
 				newAction.SetWrite()
 				newWrite := newAction.Write()
 				newWrite.SetValue(create.Value())
+				newAction.SetValueCodec(action.ValueCodec())
+				newAction.SetFrozen(action.Frozen())
 				newWrite.SetReferences(create.References())
 			case msgs.ACTION_ROLL:
 				roll := action.Roll()
@@ -498,6 +502,8 @@ func (br badReads) AddToSeg(seg *capn.Segment) msgs.Update_List {
 				newAction.SetWrite()
 				newWrite := newAction.Write()
 				newWrite.SetValue(roll.Value())
+				newAction.SetValueCodec(action.ValueCodec())
+				newAction.SetFrozen(action.Frozen())
 				newWrite.SetReferences(roll.References())
 			default:
 				panic(fmt.Sprintf("Unexpected action type (%v) for badread of %v at %v",
@@ -0,0 +1,353 @@
+package paxos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	eng "goshawkdb.io/server/txnengine"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Capture records the consensus messages sent and received by this
+// node to a fixed size ring file, for later analysis with
+// cmd/paxosreplay. Capturing can be limited to a set of TxnIds. All
+// the methods are safe to call on a nil *Capture, which captures
+// nothing.
+//
+// The file starts with a header of magic (8 bytes), oldest record
+// offset (8), write offset (8) and record count (8). Each record is
+// length (4), seq (8), unix nanos (8), direction (1), peer RMId (4)
+// and then the message itself, where length covers the whole
+// record. A length of 0 marks the point at which the writer wrapped
+// back to the start.
+type Capture struct {
+	sync.Mutex
+	file        *os.File
+	size        int64
+	txnIds      map[common.TxnId]server.EmptyStruct
+	records     []captureRecordPos
+	writeOffset int64
+	seq         uint64
+	header      [captureHeaderLen]byte
+}
+
+type captureRecordPos struct {
+	offset int64
+	length int64
+}
+
+type CaptureDirection uint8
+
+const (
+	CaptureIncoming CaptureDirection = iota
+	CaptureOutgoing CaptureDirection = iota
+)
+
+func (cd CaptureDirection) String() string {
+	if cd == CaptureIncoming {
+		return "<-"
+	}
+	return "->"
+}
+
+const (
+	captureMagic           = "GSDBPXC1"
+	captureHeaderLen       = 32
+	captureRecordHeaderLen = 25
+)
+
+func NewCapture(path string, size int64, txnIds []*common.TxnId) (*Capture, error) {
+	if size < captureHeaderLen+captureRecordHeaderLen {
+		return nil, fmt.Errorf("Capture file size too small: %v", size)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{
+		file:        file,
+		size:        size,
+		writeOffset: captureHeaderLen,
+	}
+	if len(txnIds) != 0 {
+		c.txnIds = make(map[common.TxnId]server.EmptyStruct, len(txnIds))
+		for _, txnId := range txnIds {
+			c.txnIds[*txnId] = server.EmptyStructVal
+		}
+	}
+	copy(c.header[:], captureMagic)
+	if err = c.writeHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Capture) Close() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+// Incoming is called for every message we receive from sender
+// (including those we send to ourself).
+func (c *Capture) Incoming(sender common.RMId, msg msgs.Message) {
+	if c == nil {
+		return
+	}
+	if txnId := MessageTxnId(msg); txnId != nil && c.selected(txnId) {
+		c.write(CaptureIncoming, sender, server.SegToBytes(msg.Segment))
+	}
+}
+
+// Outgoing is called for every message we send to recipient.
+func (c *Capture) Outgoing(recipient common.RMId, data []byte) {
+	if c == nil {
+		return
+	}
+	seg, _, err := capn.ReadFromMemoryZeroCopy(data)
+	if err != nil {
+		return
+	}
+	if txnId := MessageTxnId(msgs.ReadRootMessage(seg)); txnId != nil && c.selected(txnId) {
+		c.write(CaptureOutgoing, recipient, data)
+	}
+}
+
+func (c *Capture) selected(txnId *common.TxnId) bool {
+	if c.txnIds == nil {
+		return true
+	}
+	_, found := c.txnIds[*txnId]
+	return found
+}
+
+func (c *Capture) write(direction CaptureDirection, peer common.RMId, data []byte) {
+	recLen := int64(captureRecordHeaderLen + len(data))
+	if recLen > c.size-captureHeaderLen {
+		server.Log("Capture: message too large to capture:", recLen)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.file == nil {
+		return
+	}
+
+	if c.writeOffset+recLen > c.size {
+		// Wrap. Everything from the current write offset to the end
+		// of the file is lost.
+		for len(c.records) != 0 && c.records[0].offset >= c.writeOffset {
+			c.records = c.records[1:]
+		}
+		if c.writeOffset+4 <= c.size {
+			if _, err := c.file.WriteAt([]byte{0, 0, 0, 0}, c.writeOffset); err != nil {
+				c.failed(err)
+				return
+			}
+		}
+		c.writeOffset = captureHeaderLen
+	}
+	end := c.writeOffset + recLen
+	for len(c.records) != 0 && c.records[0].offset >= c.writeOffset && c.records[0].offset < end {
+		c.records = c.records[1:]
+	}
+
+	c.seq++
+	rec := make([]byte, recLen)
+	binary.BigEndian.PutUint32(rec[0:4], uint32(recLen))
+	binary.BigEndian.PutUint64(rec[4:12], c.seq)
+	binary.BigEndian.PutUint64(rec[12:20], uint64(time.Now().UnixNano()))
+	rec[20] = byte(direction)
+	binary.BigEndian.PutUint32(rec[21:25], uint32(peer))
+	copy(rec[captureRecordHeaderLen:], data)
+	if _, err := c.file.WriteAt(rec, c.writeOffset); err != nil {
+		c.failed(err)
+		return
+	}
+	c.records = append(c.records, captureRecordPos{offset: c.writeOffset, length: recLen})
+	c.writeOffset = end
+	if err := c.writeHeader(); err != nil {
+		c.failed(err)
+	}
+}
+
+func (c *Capture) writeHeader() error {
+	oldest := c.writeOffset
+	if len(c.records) != 0 {
+		oldest = c.records[0].offset
+	}
+	binary.BigEndian.PutUint64(c.header[8:16], uint64(oldest))
+	binary.BigEndian.PutUint64(c.header[16:24], uint64(c.writeOffset))
+	binary.BigEndian.PutUint64(c.header[24:32], uint64(len(c.records)))
+	_, err := c.file.WriteAt(c.header[:], 0)
+	return err
+}
+
+func (c *Capture) failed(err error) {
+	log.Println("Capture: error writing; capturing stopped:", err)
+	c.file.Close()
+	c.file = nil
+}
+
+func (c *Capture) Status(sc *server.StatusConsumer) {
+	if c == nil {
+		sc.Emit("Paxos capture: disabled")
+	} else {
+		c.Lock()
+		sc.Emit(fmt.Sprintf("Paxos capture: %v records held; %v written; selected txns: %v", len(c.records), c.seq, len(c.txnIds)))
+		c.Unlock()
+	}
+	sc.Join()
+}
+
+// MessageTxnId returns the TxnId that a consensus message concerns,
+// or nil if the message is not a consensus message.
+func MessageTxnId(msg msgs.Message) *common.TxnId {
+	switch msg.Which() {
+	case msgs.MESSAGE_TXNSUBMISSION:
+		return eng.TxnReaderFromData(msg.TxnSubmission()).Id
+	case msgs.MESSAGE_SUBMISSIONOUTCOME:
+		return eng.TxnReaderFromData(msg.SubmissionOutcome().Txn()).Id
+	case msgs.MESSAGE_SUBMISSIONCOMPLETE:
+		return common.MakeTxnId(msg.SubmissionComplete().TxnId())
+	case msgs.MESSAGE_SUBMISSIONABORT:
+		return common.MakeTxnId(msg.SubmissionAbort().TxnId())
+	case msgs.MESSAGE_ONEATXNVOTES:
+		return common.MakeTxnId(msg.OneATxnVotes().TxnId())
+	case msgs.MESSAGE_ONEBTXNVOTES:
+		return common.MakeTxnId(msg.OneBTxnVotes().TxnId())
+	case msgs.MESSAGE_TWOATXNVOTES:
+		return eng.TxnReaderFromData(msg.TwoATxnVotes().Txn()).Id
+	case msgs.MESSAGE_TWOBTXNVOTES:
+		twoB := msg.TwoBTxnVotes()
+		if twoB.Which() == msgs.TWOBTXNVOTES_FAILURES {
+			return common.MakeTxnId(twoB.Failures().TxnId())
+		}
+		return eng.TxnReaderFromData(twoB.Outcome().Txn()).Id
+	case msgs.MESSAGE_TXNLOCALLYCOMPLETE:
+		return common.MakeTxnId(msg.TxnLocallyComplete().TxnId())
+	case msgs.MESSAGE_TXNGLOBALLYCOMPLETE:
+		return common.MakeTxnId(msg.TxnGloballyComplete().TxnId())
+	default:
+		return nil
+	}
+}
+
+// ParseTxnIds parses a comma separated list of hex TxnIds.
+func ParseTxnIds(str string) ([]*common.TxnId, error) {
+	txnIds := []*common.TxnId{}
+	for _, txnIdStr := range strings.Split(str, ",") {
+		txnIdStr = strings.TrimSpace(txnIdStr)
+		if txnIdStr == "" {
+			continue
+		}
+		txnIdBytes, err := hex.DecodeString(txnIdStr)
+		if err != nil {
+			return nil, err
+		} else if l := len(txnIdBytes); l != common.KeyLen {
+			return nil, fmt.Errorf("Invalid TxnId %v: expected %v bytes, and found %v", txnIdStr, common.KeyLen, l)
+		}
+		txnIds = append(txnIds, common.MakeTxnId(txnIdBytes))
+	}
+	return txnIds, nil
+}
+
+type CaptureRecord struct {
+	Seq       uint64
+	Time      time.Time
+	Direction CaptureDirection
+	Peer      common.RMId
+	TxnId     *common.TxnId
+	Message   msgs.Message
+}
+
+// ReadCapture invokes fun on every record in the capture file at
+// path, oldest first.
+func ReadCapture(path string, fun func(*CaptureRecord) error) error {
+	data, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < captureHeaderLen || !bytes.Equal(data[:8], []byte(captureMagic)) {
+		return errors.New("Not a capture file")
+	}
+	oldest := int64(binary.BigEndian.Uint64(data[8:16]))
+	writeOffset := int64(binary.BigEndian.Uint64(data[16:24]))
+	count := binary.BigEndian.Uint64(data[24:32])
+	if count == 0 {
+		return nil
+	}
+	size := int64(len(data))
+	if oldest < captureHeaderLen || oldest > size || writeOffset < captureHeaderLen || writeOffset > size {
+		return errors.New("Corrupt capture file header")
+	}
+
+	read := func(from, to int64) error {
+		for pos := from; pos+4 <= to; {
+			recLen := int64(binary.BigEndian.Uint32(data[pos : pos+4]))
+			if recLen == 0 {
+				return nil // wrap marker
+			} else if recLen < captureRecordHeaderLen || pos+recLen > to {
+				return fmt.Errorf("Corrupt capture record at %v", pos)
+			}
+			rec := data[pos : pos+recLen]
+			seg, _, err := capn.ReadFromMemoryZeroCopy(rec[captureRecordHeaderLen:])
+			if err != nil {
+				return err
+			}
+			msg := msgs.ReadRootMessage(seg)
+			err = fun(&CaptureRecord{
+				Seq:       binary.BigEndian.Uint64(rec[4:12]),
+				Time:      time.Unix(0, int64(binary.BigEndian.Uint64(rec[12:20]))),
+				Direction: CaptureDirection(rec[20]),
+				Peer:      common.RMId(binary.BigEndian.Uint32(rec[21:25])),
+				TxnId:     MessageTxnId(msg),
+				Message:   msg,
+			})
+			if err != nil {
+				return err
+			}
+			pos += recLen
+		}
+		return nil
+	}
+
+	if oldest < writeOffset {
+		return read(oldest, writeOffset)
+	}
+	if err = read(oldest, size); err != nil {
+		return err
+	}
+	return read(captureHeaderLen, writeOffset)
+}
+
+func readFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	buf := new(bytes.Buffer)
+	if _, err = io.Copy(buf, file); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,72 @@
+package paxos
+
+import (
+	"fmt"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"sync"
+)
+
+// DegradedRMs is the set of RMs which have told us their disks are
+// degraded. Submitters avoid such RMs as acceptors where they can. An
+// RM is forgotten as soon as its connection is lost: if it is still
+// degraded it tells us again when it reconnects. There is one per
+// node, and it is safe to use from any go-routine.
+type DegradedRMs struct {
+	sync.Mutex
+	rmIds map[common.RMId]server.EmptyStruct
+}
+
+func NewDegradedRMs(connPub ServerConnectionPublisher) *DegradedRMs {
+	d := &DegradedRMs{
+		rmIds: make(map[common.RMId]server.EmptyStruct),
+	}
+	connPub.AddServerConnectionSubscriber(d)
+	return d
+}
+
+func (d *DegradedRMs) Set(rmId common.RMId, degraded bool) {
+	d.Lock()
+	defer d.Unlock()
+	if degraded {
+		d.rmIds[rmId] = server.EmptyStructVal
+	} else {
+		delete(d.rmIds, rmId)
+	}
+}
+
+// RMs returns the current degraded RMs, or nil if there are none. The
+// result is not modified subsequently.
+func (d *DegradedRMs) RMs() map[common.RMId]server.EmptyStruct {
+	d.Lock()
+	defer d.Unlock()
+	if len(d.rmIds) == 0 {
+		return nil
+	}
+	rmIds := make(map[common.RMId]server.EmptyStruct, len(d.rmIds))
+	for rmId := range d.rmIds {
+		rmIds[rmId] = server.EmptyStructVal
+	}
+	return rmIds
+}
+
+func (d *DegradedRMs) ConnectedRMs(conns map[common.RMId]Connection) {}
+
+func (d *DegradedRMs) ConnectionLost(rmId common.RMId, conns map[common.RMId]Connection) {
+	d.Set(rmId, false)
+}
+
+func (d *DegradedRMs) ConnectionEstablished(rmId common.RMId, conn Connection, conns map[common.RMId]Connection, done func()) {
+	done()
+}
+
+func (d *DegradedRMs) Status(sc *server.StatusConsumer) {
+	d.Lock()
+	rmIds := make([]common.RMId, 0, len(d.rmIds))
+	for rmId := range d.rmIds {
+		rmIds = append(rmIds, rmId)
+	}
+	d.Unlock()
+	sc.Emit(fmt.Sprintf("Degraded RMs: %v", rmIds))
+	sc.Join()
+}
@@ -4,8 +4,11 @@ import (
 	mdb "github.com/msackman/gomdb"
 	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
+	"goshawkdb.io/server"
 	"goshawkdb.io/server/db"
 	eng "goshawkdb.io/server/txnengine"
+	"sync"
+	"time"
 )
 
 type Dispatchers struct {
@@ -14,9 +17,11 @@ type Dispatchers struct {
 	VarDispatcher      *eng.VarDispatcher
 	ProposerDispatcher *ProposerDispatcher
 	connectionManager  ConnectionManager
+	recoveryLock       sync.Mutex
+	recovery           *RecoveryReport
 }
 
-func NewDispatchers(cm ConnectionManager, rmId common.RMId, count uint8, db *db.Databases, lc eng.LocalConnection) *Dispatchers {
+func NewDispatchers(cm ConnectionManager, rmId common.RMId, count uint8, db *db.Databases, lc eng.LocalConnection, journal TxnJournal, clock server.Clock) *Dispatchers {
 	// It actually doesn't matter at this point what order we start up
 	// the acceptors. This is because we are called from the
 	// ConnectionManager constructor, and its actor loop hasn't been
@@ -28,14 +33,44 @@ func NewDispatchers(cm ConnectionManager, rmId common.RMId, count uint8, db *db.
 	d := &Dispatchers{
 		db:                 db,
 		AcceptorDispatcher: NewAcceptorDispatcher(count, rmId, cm, db),
-		VarDispatcher:      eng.NewVarDispatcher(count, rmId, cm, db, lc),
+		VarDispatcher:      eng.NewVarDispatcher(count, rmId, cm, db, lc, clock),
 		connectionManager:  cm,
 	}
-	d.ProposerDispatcher = NewProposerDispatcher(count, rmId, cm, db, d.VarDispatcher)
+	d.ProposerDispatcher = NewProposerDispatcher(count, rmId, cm, db, d.VarDispatcher, journal, clock)
+
+	// We must not wait here for recovery to finish: recovering txns
+	// may need the ConnectionManager, which isn't running yet.
+	go d.awaitRecovery()
 
 	return d
 }
 
+func (d *Dispatchers) awaitRecovery() {
+	report := &RecoveryReport{
+		Acceptors: d.AcceptorDispatcher.awaitRecovery(),
+		Proposers: d.ProposerDispatcher.awaitRecovery(),
+	}
+	// Vars are loaded by the proposers as they restart, so only once
+	// the proposers have been recovered do we know which vars to wait
+	// for.
+	vars := newSubsystemRecovery("vars", len(d.VarDispatcher.Executors))
+	vars.started = report.Proposers.started
+	vars.awaitManagers(d.VarDispatcher.Executors, d.VarDispatcher.ActiveVarCount)
+	report.Vars = vars
+	report.publish()
+	d.recoveryLock.Lock()
+	d.recovery = report
+	d.recoveryLock.Unlock()
+}
+
+// Recovery returns the report of what was recovered from disk at
+// startup, or nil if recovery is still in progress.
+func (d *Dispatchers) Recovery() *RecoveryReport {
+	d.recoveryLock.Lock()
+	defer d.recoveryLock.Unlock()
+	return d.recovery
+}
+
 func (d *Dispatchers) IsDatabaseEmpty() (bool, error) {
 	res, err := d.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
 		res, _ := rtxn.WithCursor(d.db.Vars, func(cursor *mdbs.Cursor) interface{} {
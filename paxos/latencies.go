@@ -0,0 +1,121 @@
+package paxos
+
+import (
+	"fmt"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeerLatencies is the smoothed round trip time to each connected RM,
+// as measured by heartbeat pings. If enabled, submitters use it to
+// choose the acceptors of each txn: rather than the acceptors being
+// the first RMs of the txn's allocations, they are the twoFInc
+// connected RMs with the lowest round trip times, wherever the txn's
+// vars are. As any fInc acceptors can decide the outcome, commit
+// latency is then bounded by the fInc fastest RMs, rather than by the
+// RMs that happen to hold the vars. An RM is forgotten as soon as its
+// connection is lost. There is one per node, and it is safe to use
+// from any go-routine.
+type PeerLatencies struct {
+	sync.Mutex
+	enabled bool
+	rtts    map[common.RMId]time.Duration
+}
+
+func NewPeerLatencies(connPub ServerConnectionPublisher) *PeerLatencies {
+	pl := &PeerLatencies{
+		rtts: make(map[common.RMId]time.Duration),
+	}
+	connPub.AddServerConnectionSubscriber(pl)
+	return pl
+}
+
+// SetChooseAcceptors enables or disables choosing acceptors by
+// latency.
+func (pl *PeerLatencies) SetChooseAcceptors(enabled bool) {
+	pl.Lock()
+	defer pl.Unlock()
+	pl.enabled = enabled
+}
+
+func (pl *PeerLatencies) Set(rmId common.RMId, rtt time.Duration) {
+	pl.Lock()
+	defer pl.Unlock()
+	pl.rtts[rmId] = rtt
+}
+
+// Acceptors returns the twoFInc candidates with the lowest round trip
+// times, self being the fastest of all and RMs yet to be measured the
+// slowest. It returns nil if choosing acceptors by latency is
+// disabled, if not every server in the cluster would honour the
+// choice, or if there are too few candidates, in which case the
+// acceptors are taken from the txn's allocations as usual.
+func (pl *PeerLatencies) Acceptors(fInc int, self common.RMId, candidates []common.RMId) common.RMIds {
+	twoFInc := fInc + fInc - 1
+	if len(candidates) < twoFInc || !server.FeatureEnabled(server.FeatureTxnAcceptors) {
+		return nil
+	}
+	pl.Lock()
+	if !pl.enabled {
+		pl.Unlock()
+		return nil
+	}
+	byRTT := make(rmIdsByRTT, len(candidates))
+	for idx, rmId := range candidates {
+		if rtt, found := pl.rtts[rmId]; rmId == self {
+			byRTT[idx] = rmIdRTT{rmId: rmId}
+		} else if found {
+			byRTT[idx] = rmIdRTT{rmId: rmId, rtt: rtt}
+		} else {
+			byRTT[idx] = rmIdRTT{rmId: rmId, rtt: math.MaxInt64}
+		}
+	}
+	pl.Unlock()
+
+	sort.Sort(byRTT)
+	acceptors := make(common.RMIds, twoFInc)
+	for idx := range acceptors {
+		acceptors[idx] = byRTT[idx].rmId
+	}
+	return acceptors
+}
+
+type rmIdRTT struct {
+	rmId common.RMId
+	rtt  time.Duration
+}
+
+type rmIdsByRTT []rmIdRTT
+
+func (r rmIdsByRTT) Len() int      { return len(r) }
+func (r rmIdsByRTT) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r rmIdsByRTT) Less(i, j int) bool {
+	return r[i].rtt < r[j].rtt || (r[i].rtt == r[j].rtt && r[i].rmId < r[j].rmId)
+}
+
+func (pl *PeerLatencies) ConnectedRMs(conns map[common.RMId]Connection) {}
+
+func (pl *PeerLatencies) ConnectionLost(rmId common.RMId, conns map[common.RMId]Connection) {
+	pl.Lock()
+	defer pl.Unlock()
+	delete(pl.rtts, rmId)
+}
+
+func (pl *PeerLatencies) ConnectionEstablished(rmId common.RMId, conn Connection, conns map[common.RMId]Connection, done func()) {
+	done()
+}
+
+func (pl *PeerLatencies) Status(sc *server.StatusConsumer) {
+	pl.Lock()
+	defer pl.Unlock()
+	if pl.enabled {
+		sc.Emit(fmt.Sprintf("Acceptors chosen by latency; RTTs: %v", pl.rtts))
+	} else {
+		sc.Emit("Acceptors chosen by allocation")
+	}
+	sc.Join()
+}
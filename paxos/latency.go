@@ -0,0 +1,46 @@
+package paxos
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Time spent in each phase of consensus, by role. Comparing the
+// phases shows whether txns are bound by the network (1 and 2), by
+// the disk (disk), or by waiting for a quorum of learners to finish
+// (tlc and tgc).
+//
+// Proposers:
+// - 1: from sending 1A to receiving F+1 1Bs, per instance.
+// - 2: from first sending 2A to all acceptors agreeing on the outcome.
+// - disk: writing and deleting proposer state.
+// - tgc: from sending TLCs to receiving TGCs from all acceptors.
+//
+// Acceptors:
+// - 2: from receiving the first 2A to the outcome being determined.
+// - disk: writing and deleting 2Bs.
+// - tlc: from the 2B being on disk to receiving all TLCs and the TSC.
+var paxosPhaseSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "goshawkdb",
+	Name:      "paxos_phase_seconds",
+	Help:      "Time spent in each phase of consensus.",
+	Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 18),
+}, []string{"role", "phase"})
+
+var (
+	proposerPhaseOne  = paxosPhaseSeconds.WithLabelValues("proposer", "1")
+	proposerPhaseTwo  = paxosPhaseSeconds.WithLabelValues("proposer", "2")
+	proposerPhaseDisk = paxosPhaseSeconds.WithLabelValues("proposer", "disk")
+	proposerPhaseTGC  = paxosPhaseSeconds.WithLabelValues("proposer", "tgc")
+	acceptorPhaseTwo  = paxosPhaseSeconds.WithLabelValues("acceptor", "2")
+	acceptorPhaseDisk = paxosPhaseSeconds.WithLabelValues("acceptor", "disk")
+	acceptorPhaseTLC  = paxosPhaseSeconds.WithLabelValues("acceptor", "tlc")
+)
+
+func init() {
+	prometheus.MustRegister(paxosPhaseSeconds)
+}
+
+func secondsSince(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
@@ -27,6 +27,9 @@ type ConnectionManager interface {
 type ServerConnectionPublisher interface {
 	AddServerConnectionSubscriber(obs ServerConnectionSubscriber)
 	RemoveServerConnectionSubscriber(obs ServerConnectionSubscriber)
+	ResendScheduler() *ResendScheduler
+	DegradedRMs() *DegradedRMs
+	PeerLatencies() *PeerLatencies
 }
 
 type ServerConnectionSubscriber interface {
@@ -50,6 +53,13 @@ type ClientConnection interface {
 	SubmissionOutcomeReceived(common.RMId, *eng.TxnReader, *msgs.Outcome)
 }
 
+// TxnJournal is told of every txn which a local proposer learns has
+// committed. It is called from the proposer's executor, so must not
+// block.
+type TxnJournal interface {
+	TxnCommitted(txn *eng.TxnReader)
+}
+
 type Shutdownable interface {
 	Shutdown(sync Blocking)
 }
@@ -73,6 +83,7 @@ func NewServerConnectionPublisherProxy(exe *dispatcher.Executor, upstream Server
 
 func (pub *serverConnectionPublisherProxy) AddServerConnectionSubscriber(obs ServerConnectionSubscriber) {
 	pub.subs[obs] = server.EmptyStructVal
+	SenderSubscribed(obs)
 	if pub.servers != nil {
 		obs.ConnectedRMs(pub.servers)
 	}
@@ -80,6 +91,19 @@ func (pub *serverConnectionPublisherProxy) AddServerConnectionSubscriber(obs Ser
 
 func (pub *serverConnectionPublisherProxy) RemoveServerConnectionSubscriber(obs ServerConnectionSubscriber) {
 	delete(pub.subs, obs)
+	SenderUnsubscribed(obs)
+}
+
+func (pub *serverConnectionPublisherProxy) ResendScheduler() *ResendScheduler {
+	return pub.upstream.ResendScheduler()
+}
+
+func (pub *serverConnectionPublisherProxy) DegradedRMs() *DegradedRMs {
+	return pub.upstream.DegradedRMs()
+}
+
+func (pub *serverConnectionPublisherProxy) PeerLatencies() *PeerLatencies {
+	return pub.upstream.PeerLatencies()
 }
 
 func (pub *serverConnectionPublisherProxy) ConnectedRMs(servers map[common.RMId]Connection) {
@@ -120,69 +144,20 @@ func (pub *serverConnectionPublisherProxy) ConnectionEstablished(gained common.R
 	})
 }
 
-type OneShotSender struct {
-	remaining map[common.RMId]server.EmptyStruct
-	msg       []byte
-	connPub   ServerConnectionPublisher
-}
-
-func NewOneShotSender(msg []byte, connPub ServerConnectionPublisher, recipients ...common.RMId) *OneShotSender {
-	remaining := make(map[common.RMId]server.EmptyStruct, len(recipients))
-	for _, rmId := range recipients {
-		remaining[rmId] = server.EmptyStructVal
-	}
-	oss := &OneShotSender{
-		remaining: remaining,
-		msg:       msg,
-		connPub:   connPub,
-	}
-	server.Log(oss, "Adding one shot sender with recipients", recipients)
-	connPub.AddServerConnectionSubscriber(oss)
-	return oss
-}
-
-func (s *OneShotSender) ConnectedRMs(conns map[common.RMId]Connection) {
-	for recipient := range s.remaining {
-		if conn, found := conns[recipient]; found {
-			delete(s.remaining, recipient)
-			conn.Send(s.msg)
-		}
-	}
-	if len(s.remaining) == 0 {
-		server.Log(s, "Removing one shot sender")
-		s.connPub.RemoveServerConnectionSubscriber(s)
-	}
-}
-
-func (s *OneShotSender) ConnectionLost(common.RMId, map[common.RMId]Connection) {}
-
-func (s *OneShotSender) ConnectionEstablished(rmId common.RMId, conn Connection, conns map[common.RMId]Connection, done func()) {
-	if _, found := s.remaining[rmId]; found {
-		delete(s.remaining, rmId)
-		conn.Send(s.msg)
-		if len(s.remaining) == 0 {
-			server.Log(s, "Removing one shot sender")
-			s.connPub.RemoveServerConnectionSubscriber(s)
-		}
-	}
-	done()
-}
-
 type RepeatingSender struct {
-	recipients []common.RMId
-	msg        []byte
+	repeating
 }
 
 func NewRepeatingSender(msg []byte, recipients ...common.RMId) *RepeatingSender {
 	return &RepeatingSender{
-		recipients: recipients,
-		msg:        msg,
+		repeating: newRepeating(msg, recipients),
 	}
 }
 
 func (s *RepeatingSender) ConnectedRMs(conns map[common.RMId]Connection) {
 	for _, recipient := range s.recipients {
 		if conn, found := conns[recipient]; found {
+			s.sending(recipient)
 			conn.Send(s.msg)
 		}
 	}
@@ -194,6 +169,7 @@ func (s *RepeatingSender) ConnectionEstablished(rmId common.RMId, conn Connectio
 	defer done()
 	for _, recipient := range s.recipients {
 		if recipient == rmId {
+			s.sending(rmId)
 			conn.Send(s.msg)
 			return
 		}
@@ -201,17 +177,18 @@ func (s *RepeatingSender) ConnectionEstablished(rmId common.RMId, conn Connectio
 }
 
 type RepeatingAllSender struct {
-	msg []byte
+	repeating
 }
 
 func NewRepeatingAllSender(msg []byte) *RepeatingAllSender {
 	return &RepeatingAllSender{
-		msg: msg,
+		repeating: newRepeating(msg, nil),
 	}
 }
 
 func (s *RepeatingAllSender) ConnectedRMs(conns map[common.RMId]Connection) {
-	for _, conn := range conns {
+	for rmId, conn := range conns {
+		s.sending(rmId)
 		conn.Send(s.msg)
 	}
 }
@@ -219,6 +196,7 @@ func (s *RepeatingAllSender) ConnectedRMs(conns map[common.RMId]Connection) {
 func (s *RepeatingAllSender) ConnectionLost(common.RMId, map[common.RMId]Connection) {}
 
 func (s *RepeatingAllSender) ConnectionEstablished(rmId common.RMId, conn Connection, conns map[common.RMId]Connection, done func()) {
+	s.sending(rmId)
 	conn.Send(s.msg)
 	done()
 }
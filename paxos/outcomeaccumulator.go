@@ -3,12 +3,94 @@ package paxos
 import (
 	"bytes"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"goshawkdb.io/common"
 	"goshawkdb.io/server"
 	msgs "goshawkdb.io/server/capnp"
 	"goshawkdb.io/server/configuration"
+	"sync"
+	"sync/atomic"
 )
 
+// When acceptors are flapping, proposers (and client submitters) can
+// be left waiting for outcomes for a long time, and their
+// accumulators pile up. We keep global counts of the accumulators
+// and outcomes held so that we can expose them, and so that client
+// connections can hold back new txns whilst we're under pressure.
+var accumulatorAccounting = &outcomeAccumulatorAccounting{}
+
+type outcomeAccumulatorAccounting struct {
+	sync.Mutex
+	accumulators int64
+	outcomes     int64
+	// relieved is non-nil only whilst we're under pressure, and is
+	// closed once we've dropped back below the low water mark.
+	relieved chan struct{}
+}
+
+func init() {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "outcome_accumulators",
+		Help:      "Number of live outcome accumulators.",
+	}, func() float64 { return float64(atomic.LoadInt64(&accumulatorAccounting.accumulators)) }))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "outcome_accumulator_outcomes",
+		Help:      "Number of distinct ballot outcomes held by live outcome accumulators.",
+	}, func() float64 { return float64(atomic.LoadInt64(&accumulatorAccounting.outcomes)) }))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "outcome_accumulator_pressure",
+		Help:      "1 if client reads are paused due to too many live outcome accumulators, 0 otherwise.",
+	}, func() float64 {
+		if OutcomeAccumulatorPressure() == nil {
+			return 0
+		}
+		return 1
+	}))
+}
+
+func (oaa *outcomeAccumulatorAccounting) accumulatorsChanged(delta int64) {
+	count := atomic.AddInt64(&oaa.accumulators, delta)
+	if (delta > 0 && count == server.OutcomeAccumulatorHighWater) ||
+		(delta < 0 && count == server.OutcomeAccumulatorLowWater-1) {
+		oaa.Lock()
+		defer oaa.Unlock()
+		// Re-read the count: another goroutine may have crossed back
+		// over the other water mark before we got the lock.
+		count = atomic.LoadInt64(&oaa.accumulators)
+		if count >= server.OutcomeAccumulatorHighWater && oaa.relieved == nil {
+			oaa.relieved = make(chan struct{})
+			server.Log("OutcomeAccumulator pressure on:", count)
+		} else if count < server.OutcomeAccumulatorLowWater && oaa.relieved != nil {
+			close(oaa.relieved)
+			oaa.relieved = nil
+			server.Log("OutcomeAccumulator pressure off:", count)
+		}
+	}
+}
+
+// OutcomeAccumulatorPressure returns nil if the number of live
+// accumulators is within bounds. Otherwise it returns a chan which
+// will be closed once enough accumulators have been released.
+func OutcomeAccumulatorPressure() <-chan struct{} {
+	accumulatorAccounting.Lock()
+	defer accumulatorAccounting.Unlock()
+	if accumulatorAccounting.relieved == nil {
+		return nil
+	}
+	return accumulatorAccounting.relieved
+}
+
+func OutcomeAccumulatorAccountingStatus(sc *server.StatusConsumer) {
+	sc.Emit(fmt.Sprintf("Live outcome accumulators: %v (outcomes held: %v; pressure: %v)",
+		atomic.LoadInt64(&accumulatorAccounting.accumulators),
+		atomic.LoadInt64(&accumulatorAccounting.outcomes),
+		OutcomeAccumulatorPressure() != nil))
+	sc.Join()
+}
+
 // OutcomeAccumulator groups together all the different outcomes we've
 // received for a given txn. Once we have at least fInc outcomes from
 // distinct acceptors which all have equal Clocks, we know we have a
@@ -20,6 +102,7 @@ type OutcomeAccumulator struct {
 	allKnownOutcomes []*txnOutcome
 	pendingTGC       int
 	fInc             int
+	released         bool
 }
 
 type acceptorIndexWithTxnOutcome struct {
@@ -42,6 +125,7 @@ func NewOutcomeAccumulator(fInc int, acceptors common.RMIds) *OutcomeAccumulator
 		ptr.idx = idx
 		acceptorOutcomes[rmId] = ptr
 	}
+	accumulatorAccounting.accumulatorsChanged(1)
 	return &OutcomeAccumulator{
 		acceptors:        acceptors,
 		acceptorOutcomes: acceptorOutcomes,
@@ -52,6 +136,18 @@ func NewOutcomeAccumulator(fInc int, acceptors common.RMIds) *OutcomeAccumulator
 	}
 }
 
+// Release must be called once the owner of the accumulator has no
+// further use for it, so that it stops counting towards the global
+// accounting.
+func (oa *OutcomeAccumulator) Release() {
+	if oa.released {
+		return
+	}
+	oa.released = true
+	atomic.AddInt64(&accumulatorAccounting.outcomes, -int64(len(oa.allKnownOutcomes)))
+	accumulatorAccounting.accumulatorsChanged(-1)
+}
+
 func (oa *OutcomeAccumulator) TopologyChange(topology *configuration.Topology) bool {
 	// We can only gain more RMsRemoved when a new topology is
 	// installed post barrier2 and migration. To get to barrier2, every
@@ -168,6 +264,9 @@ func (oa *OutcomeAccumulator) getOutcome(outcome *outcomeEqualId) *txnOutcome {
 			outcomeReceivedCount: 0,
 		}
 		oa.allKnownOutcomes = append(oa.allKnownOutcomes, empty)
+		if !oa.released {
+			atomic.AddInt64(&accumulatorAccounting.outcomes, 1)
+		}
 	} else {
 		empty.outcome = outcome
 		empty.acceptors = make([]common.RMId, len(oa.acceptors))
@@ -190,6 +289,18 @@ func (oa *OutcomeAccumulator) IsAllAborts() []common.RMId {
 	return nil
 }
 
+// pendingTGCFrom returns the acceptors from which we've yet to receive
+// a TGC.
+func (oa *OutcomeAccumulator) pendingTGCFrom() common.RMIds {
+	pending := make([]common.RMId, 0, oa.pendingTGC)
+	for _, rmId := range oa.acceptors {
+		if acceptorOutcome, found := oa.acceptorOutcomes[rmId]; found && !acceptorOutcome.tgcReceived {
+			pending = append(pending, rmId)
+		}
+	}
+	return pending
+}
+
 func (oa *OutcomeAccumulator) Status(sc *server.StatusConsumer) {
 	sc.Emit(fmt.Sprintf("- unique outcomes: %v", oa.allKnownOutcomes))
 	sc.Emit(fmt.Sprintf("- outcome decided? %v", oa.winningOutcome != nil))
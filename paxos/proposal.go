@@ -7,6 +7,7 @@ import (
 	"goshawkdb.io/server"
 	msgs "goshawkdb.io/server/capnp"
 	eng "goshawkdb.io/server/txnengine"
+	"time"
 )
 
 type proposal struct {
@@ -23,6 +24,7 @@ type proposal struct {
 	pending            []*proposalInstance
 	abortInstances     []common.RMId
 	finished           bool
+	twoASent           time.Time
 }
 
 func NewProposal(pm *ProposerManager, txn *eng.TxnReader, fInc int, ballots []*eng.Ballot, instanceRMId common.RMId, acceptors []common.RMId, skipPhase1 bool) *proposal {
@@ -94,7 +96,7 @@ func (p *proposal) maybeSendOneA() {
 	if len(pendingPromises) == 0 {
 		return
 	}
-	seg := capn.NewBuffer(nil)
+	seg := server.NewPooledSegment(0)
 	msg := msgs.NewRootMessage(seg)
 	sender := newProposalSender(p, pendingPromises)
 	oneACap := msgs.NewOneATxnVotes(seg)
@@ -108,7 +110,7 @@ func (p *proposal) maybeSendOneA() {
 		proposal := proposals.At(idx)
 		pi.addOneAToProposal(&proposal, sender)
 	}
-	sender.msg = server.SegToBytes(seg)
+	sender.msg = server.SegToBytesAndRelease(seg)
 	server.Log(txnId, "Adding sender for 1A")
 	p.proposerManager.AddServerConnectionSubscriber(sender)
 }
@@ -135,7 +137,7 @@ func (p *proposal) maybeSendTwoA() {
 	if len(pendingAccepts) == 0 {
 		return
 	}
-	seg := capn.NewBuffer(nil)
+	seg := server.NewPooledSegment(len(p.txn.Data))
 	msg := msgs.NewRootMessage(seg)
 	sender := newProposalSender(p, pendingAccepts)
 	twoACap := msgs.NewTwoATxnVotes(seg)
@@ -148,7 +150,10 @@ func (p *proposal) maybeSendTwoA() {
 		pi.addTwoAToAcceptRequest(seg, &acceptRequest, sender)
 	}
 	twoACap.SetTxn(p.txn.Data)
-	sender.msg = server.SegToBytes(seg)
+	sender.msg = server.SegToBytesAndRelease(seg)
+	if p.twoASent.IsZero() {
+		p.twoASent = p.proposerManager.Clock.Now()
+	}
 	server.Log(p.txn.Id, "Adding sender for 2A")
 	p.proposerManager.AddServerConnectionSubscriber(sender)
 }
@@ -170,6 +175,9 @@ func (p *proposal) FinishProposing() []common.RMId {
 		return nil
 	}
 	p.finished = true
+	if !p.twoASent.IsZero() {
+		proposerPhaseTwo.Observe(p.proposerManager.secondsSince(p.twoASent))
+	}
 	for _, pi := range p.instances {
 		if sender := pi.oneASender; sender != nil {
 			pi.oneASender = nil
@@ -256,6 +264,7 @@ type proposalOneA struct {
 	*proposalInstance
 	currentRoundNumber paxosNumber
 	oneASender         *proposalSender
+	oneASent           time.Time
 }
 
 func (oneA *proposalOneA) proposalInstanceComponentWitness() {}
@@ -276,6 +285,7 @@ func (oneA *proposalOneA) addOneAToProposal(proposalCap *msgs.TxnVoteProposal, s
 	proposalCap.SetVarId(oneA.ballot.VarUUId[:])
 	proposalCap.SetRoundNumber(uint64(oneA.currentRoundNumber))
 	oneA.oneASender = sender
+	oneA.oneASent = oneA.proposerManager.Clock.Now()
 	oneA.nextState(nil)
 }
 
@@ -336,6 +346,7 @@ func (oneB *proposalOneB) oneBTxnVotesReceived(sender common.RMId, promise *msgs
 	if !found {
 		oneB.promisesReceivedFrom = append(oneB.promisesReceivedFrom, sender)
 		if len(oneB.promisesReceivedFrom) == oneB.fInc {
+			proposerPhaseOne.Observe(oneB.proposerManager.secondsSince(oneB.oneASent))
 			oneB.oneASender.instanceComplete(oneB.proposalInstance)
 			oneB.oneASender = nil
 			oneB.nextState(nil)
@@ -10,6 +10,7 @@ import (
 	"goshawkdb.io/server/configuration"
 	eng "goshawkdb.io/server/txnengine"
 	"log"
+	"time"
 )
 
 type ProposerMode uint8
@@ -29,6 +30,7 @@ type Proposer struct {
 	acceptors       common.RMIds
 	topology        *configuration.Topology
 	fInc            int
+	traceId         uint64
 	currentState    proposerStateMachineComponent
 	proposerAwaitBallots
 	proposerReceiveOutcomes
@@ -50,6 +52,7 @@ func NewProposer(pm *ProposerManager, txn *eng.TxnReader, mode ProposerMode, top
 		acceptors:       GetAcceptorsFromTxn(txnCap),
 		topology:        topology,
 		fInc:            int(txnCap.FInc()),
+		traceId:         txnCap.TraceId(),
 	}
 	if mode == ProposerActiveVoter {
 		p.txn = eng.TxnFromReader(pm.Exe, pm.VarDispatcher, p, pm.RMId, txn)
@@ -197,6 +200,7 @@ type proposerAwaitBallots struct {
 	*Proposer
 	submitter          common.RMId
 	submitterBootCount uint32
+	abortRequested     bool
 }
 
 func (pab *proposerAwaitBallots) init(proposer *Proposer) {
@@ -224,6 +228,10 @@ func (pab *proposerAwaitBallots) String() string {
 func (pab *proposerAwaitBallots) TxnBallotsComplete(ballots ...*eng.Ballot) {
 	if pab.currentState == pab {
 		server.Log(pab.txnId, "TxnBallotsComplete callback. Acceptors:", pab.acceptors)
+		if pab.abortRequested {
+			txn := pab.txn.TxnReader
+			ballots = MakeAbortBallots(txn, AllocForRMId(txn.Txn, pab.proposerManager.RMId))
+		}
 		if !pab.allAcceptorsAgreed {
 			pab.proposerManager.NewPaxosProposals(pab.txn.TxnReader, pab.fInc, ballots, pab.acceptors, pab.proposerManager.RMId, true)
 		}
@@ -241,13 +249,24 @@ func (pab *proposerAwaitBallots) TxnBallotsComplete(ballots ...*eng.Ballot) {
 	}
 }
 
+// Abort votes to abort the txn, provided we've yet to vote. A retry
+// txn can take its outcome before its local ballots are complete, so
+// abort ballots are proposed immediately. Any other txn must not
+// receive its outcome until its local ballots are complete, so the
+// abort ballots are instead proposed in place of its local ballots
+// once they are.
 func (pab *proposerAwaitBallots) Abort() {
 	if pab.currentState == pab && !pab.allAcceptorsAgreed {
-		server.Log(pab.txnId, "Proposer Aborting")
-		txn := pab.txn.TxnReader
-		alloc := AllocForRMId(txn.Txn, pab.proposerManager.RMId)
-		ballots := MakeAbortBallots(txn, alloc)
-		pab.TxnBallotsComplete(ballots...)
+		if pab.txn.Retry {
+			server.Log(pab.txnId, "Proposer Aborting")
+			txn := pab.txn.TxnReader
+			alloc := AllocForRMId(txn.Txn, pab.proposerManager.RMId)
+			ballots := MakeAbortBallots(txn, alloc)
+			pab.TxnBallotsComplete(ballots...)
+		} else {
+			server.Log(pab.txnId, "Proposer Aborting once local ballots are complete")
+			pab.abortRequested = true
+		}
 	}
 }
 
@@ -331,8 +350,8 @@ func (pro *proposerReceiveOutcomes) BallotOutcomeReceived(sender common.RMId, ou
 			// We are destroying out state here. Thus even if this msg
 			// goes missing, if the acceptor sends us further 2Bs then
 			// we'll send back further TLCs from proposer manager. So the
-			// use of OSS here is correct.
-			NewOneShotSender(tlcMsg, pro.proposerManager, knownAcceptors...)
+			// use of SendOnce here is correct.
+			pro.proposerManager.ResendScheduler().SendOnce(tlcMsg, knownAcceptors...)
 			return
 		}
 	}
@@ -367,6 +386,10 @@ func (palc *proposerAwaitLocallyComplete) init(proposer *Proposer) {
 
 func (palc *proposerAwaitLocallyComplete) start() {
 	server.Log(palc.txnId, "Outcome for txn determined")
+	configuration.TraceTopology(palc.traceId, palc.proposerManager.RMId, "txn-outcome", "txnId", palc.txnId, "commit", palc.outcome.Which() == msgs.OUTCOME_COMMIT)
+	if palc.outcome.Which() == msgs.OUTCOME_COMMIT && palc.proposerManager.TxnJournal != nil {
+		palc.proposerManager.TxnJournal.TxnCommitted(eng.TxnReaderFromData(palc.outcome.Txn()))
+	}
 	if palc.txn == nil && palc.outcome.Which() == msgs.OUTCOME_COMMIT {
 		// We are a learner (either active or passive), and the result
 		// has turned out to be a commit.
@@ -408,7 +431,7 @@ func (palc *proposerAwaitLocallyComplete) maybeWriteToDisk() {
 		return
 	}
 
-	stateSeg := capn.NewBuffer(nil)
+	stateSeg := server.NewPooledSegment(0)
 	state := msgs.NewRootProposerState(stateSeg)
 	acceptorsCap := stateSeg.NewUInt32List(len(palc.acceptors))
 	state.SetAcceptors(acceptorsCap)
@@ -416,8 +439,9 @@ func (palc *proposerAwaitLocallyComplete) maybeWriteToDisk() {
 		acceptorsCap.Set(idx, uint32(rmId))
 	}
 
-	data := server.SegToBytes(stateSeg)
+	data := server.SegToBytesAndRelease(stateSeg)
 
+	start := palc.proposerManager.Clock.Now()
 	future := palc.proposerManager.DB.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
 		rwtxn.Put(palc.proposerManager.DB.Proposers, palc.txnId[:], data, 0)
 		return true
@@ -426,6 +450,7 @@ func (palc *proposerAwaitLocallyComplete) maybeWriteToDisk() {
 		if ran, err := future.ResultError(); err != nil {
 			panic(fmt.Sprintf("Error: %v when writing proposer to disk: %v\n", palc.txnId, err))
 		} else if ran != nil {
+			proposerPhaseDisk.Observe(palc.proposerManager.secondsSince(start))
 			palc.proposerManager.Exe.Enqueue(palc.writeDone)
 		}
 	}()
@@ -443,6 +468,7 @@ type proposerReceiveGloballyComplete struct {
 	*Proposer
 	tlcSender        *RepeatingSender
 	locallyCompleted bool
+	tlcSent          time.Time
 }
 
 func (prgc *proposerReceiveGloballyComplete) init(proposer *Proposer) {
@@ -453,6 +479,7 @@ func (prgc *proposerReceiveGloballyComplete) start() {
 	if !prgc.locallyCompleted {
 		prgc.locallyCompleted = true
 		prgc.mode = proposerTLCSender
+		prgc.tlcSent = prgc.proposerManager.Clock.Now()
 		tlcMsg := MakeTxnLocallyCompleteMsg(prgc.txnId)
 		prgc.tlcSender = NewRepeatingSender(tlcMsg, prgc.acceptors...)
 		server.Log(prgc.txnId, "Adding TLC Sender to", prgc.acceptors)
@@ -468,6 +495,7 @@ func (prgc *proposerReceiveGloballyComplete) String() string {
 func (prgc *proposerReceiveGloballyComplete) TxnGloballyCompleteReceived(sender common.RMId) {
 	if prgc.currentState == prgc {
 		if prgc.outcomeAccumulator.TxnGloballyCompleteReceived(sender) {
+			proposerPhaseTGC.Observe(prgc.proposerManager.secondsSince(prgc.tlcSent))
 			prgc.nextState()
 		}
 	}
@@ -507,6 +535,7 @@ func (paf *proposerAwaitFinished) TxnFinished(*eng.Txn) {
 	server.Log(paf.txnId, "Txn Finished Callback")
 	if paf.currentState == paf {
 		paf.nextState()
+		start := paf.proposerManager.Clock.Now()
 		future := paf.proposerManager.DB.ReadWriteTransaction(false, func(rwtxn *mdbs.RWTxn) interface{} {
 			rwtxn.Del(paf.proposerManager.DB.Proposers, paf.txnId[:], nil)
 			return true
@@ -515,6 +544,7 @@ func (paf *proposerAwaitFinished) TxnFinished(*eng.Txn) {
 			if ran, err := future.ResultError(); err != nil {
 				panic(fmt.Sprintf("Error: %v when deleting proposer from disk: %v\n", paf.txnId, err))
 			} else if ran != nil {
+				proposerPhaseDisk.Observe(paf.proposerManager.secondsSince(start))
 				paf.proposerManager.Exe.Enqueue(func() {
 					paf.proposerManager.RemoveServerConnectionSubscriber(paf.tlcSender)
 					paf.tlcSender = nil
@@ -0,0 +1,117 @@
+package paxos
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	eng "goshawkdb.io/server/txnengine"
+	"testing"
+)
+
+// testConnectionPublisher records the senders which would send
+// messages to other RMs.
+type testConnectionPublisher struct {
+	senders []ServerConnectionSubscriber
+}
+
+func (tcp *testConnectionPublisher) AddServerConnectionSubscriber(obs ServerConnectionSubscriber) {
+	tcp.senders = append(tcp.senders, obs)
+}
+func (tcp *testConnectionPublisher) RemoveServerConnectionSubscriber(obs ServerConnectionSubscriber) {
+}
+func (tcp *testConnectionPublisher) ResendScheduler() *ResendScheduler { return nil }
+func (tcp *testConnectionPublisher) DegradedRMs() *DegradedRMs         { return nil }
+func (tcp *testConnectionPublisher) PeerLatencies() *PeerLatencies     { return nil }
+
+func testProposerId(n byte) []byte {
+	id := make([]byte, common.KeyLen)
+	id[common.KeyLen-1] = n
+	return id
+}
+
+// A non-retry txn which creates vUUId, with the action allocated to
+// rmId.
+func testProposerTxn(txnId *common.TxnId, vUUId *common.VarUUId, rmId common.RMId) []byte {
+	actionsSeg := capn.NewBuffer(nil)
+	wrapper := msgs.NewRootActionListWrapper(actionsSeg)
+	actions := msgs.NewActionList(actionsSeg, 1)
+	wrapper.SetActions(actions)
+	action := actions.At(0)
+	action.SetVarId(vUUId[:])
+	action.SetCreate()
+	create := action.Create()
+	create.SetPositions(actionsSeg.NewUInt8List(1))
+	create.SetValue([]byte{})
+	create.SetReferences(msgs.NewVarIdPosList(actionsSeg, 0))
+
+	seg := capn.NewBuffer(nil)
+	txn := msgs.NewRootTxn(seg)
+	txn.SetId(txnId[:])
+	txn.SetRetry(false)
+	txn.SetSubmitter(uint32(rmId))
+	txn.SetSubmitterBootCount(1)
+	txn.SetActions(server.SegToBytes(actionsSeg))
+	allocations := msgs.NewAllocationList(seg, 1)
+	allocation := allocations.At(0)
+	allocation.SetRmId(uint32(rmId))
+	indices := seg.NewUInt16List(1)
+	indices.Set(0, 0)
+	allocation.SetActionIndices(indices)
+	allocation.SetActive(1)
+	txn.SetAllocations(allocations)
+	txn.SetFInc(1)
+	return server.SegToBytes(seg)
+}
+
+// When a client goes away, its submitter asks the proposers of its
+// outstanding txns to abort. A non-retry txn whose vars are still
+// voting must not be given an outcome until they have: the abort
+// ballots must be proposed in place of the local ballots once they
+// are complete.
+func TestProposerAbortAwaitsLocalBallots(t *testing.T) {
+	rmId := common.RMId(1)
+	vUUId := common.MakeVarUUId(testProposerId(1))
+	txnId := common.MakeTxnId(testProposerId(2))
+	pub := &testConnectionPublisher{}
+	pm := &ProposerManager{
+		ServerConnectionPublisher: pub,
+		RMId:                      rmId,
+		Clock:                     server.RealClock,
+		proposals:                 make(map[instanceIdPrefix]*proposal),
+		proposers:                 make(map[common.TxnId]*Proposer),
+	}
+	p := NewProposer(pm, eng.TxnReaderFromData(testProposerTxn(txnId, vUUId, rmId)), ProposerActiveVoter, nil)
+	// The txn's local vars are still voting: the proposer has started
+	// but its txn has not completed its ballots.
+	p.currentState = &p.proposerAwaitBallots
+
+	p.Abort()
+	if p.currentState != &p.proposerAwaitBallots || len(pm.proposals) != 0 || len(pub.senders) != 0 {
+		t.Fatalf("Abort proposed before local ballots were complete (state %v)", p.currentState)
+	}
+
+	clock := eng.NewVectorClock().AsMutable().Bump(vUUId, 1)
+	p.TxnBallotsComplete(eng.NewBallotBuilder(vUUId, eng.Commit, clock).ToBallot())
+	if p.currentState != &p.proposerReceiveOutcomes {
+		t.Fatalf("Expected to be receiving outcomes once local ballots were complete; in %v", p.currentState)
+	}
+	if len(pub.senders) != 1 {
+		t.Fatalf("Expected a single 2A sender; found %v", len(pub.senders))
+	}
+	sender, ok := pub.senders[0].(*proposalSender)
+	if !ok {
+		t.Fatalf("Expected a proposal sender; found %T", pub.senders[0])
+	}
+	seg, _, err := capn.ReadFromMemoryZeroCopy(sender.msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptRequests := msgs.ReadRootMessage(seg).TwoATxnVotes().AcceptRequests()
+	if acceptRequests.Len() != 1 {
+		t.Fatalf("Expected a single accept request; found %v", acceptRequests.Len())
+	}
+	if ballot := eng.BallotFromData(acceptRequests.At(0).Ballot()); !ballot.Aborted() {
+		t.Fatalf("Expected an abort ballot to be proposed; found %v", ballot)
+	}
+}
@@ -16,15 +16,16 @@ import (
 type ProposerDispatcher struct {
 	dispatcher.Dispatcher
 	proposermanagers []*ProposerManager
+	recovery         *SubsystemRecovery
 }
 
-func NewProposerDispatcher(count uint8, rmId common.RMId, cm ConnectionManager, db *db.Databases, varDispatcher *eng.VarDispatcher) *ProposerDispatcher {
+func NewProposerDispatcher(count uint8, rmId common.RMId, cm ConnectionManager, db *db.Databases, varDispatcher *eng.VarDispatcher, journal TxnJournal, clock server.Clock) *ProposerDispatcher {
 	pd := &ProposerDispatcher{
 		proposermanagers: make([]*ProposerManager, count),
 	}
-	pd.Dispatcher.Init(count)
+	pd.Dispatcher.Init("ProposerDispatcher", count)
 	for idx, exe := range pd.Executors {
-		pd.proposermanagers[idx] = NewProposerManager(exe, rmId, cm, db, varDispatcher)
+		pd.proposermanagers[idx] = NewProposerManager(exe, rmId, cm, db, varDispatcher, journal, clock)
 	}
 	pd.loadFromDisk(db)
 	return pd
@@ -79,6 +80,8 @@ func (pd *ProposerDispatcher) ImmigrationReceived(migration *msgs.Migration, sta
 
 func (pd *ProposerDispatcher) Status(sc *server.StatusConsumer) {
 	sc.Emit("Proposers")
+	sc.Emit(fmt.Sprintf("Queue limit: %v", pd.QueueLimit))
+	OutcomeAccumulatorAccountingStatus(sc.Fork())
 	for idx, executor := range pd.Executors {
 		s := sc.Fork()
 		s.Emit(fmt.Sprintf("Proposer Manager %v", idx))
@@ -89,6 +92,7 @@ func (pd *ProposerDispatcher) Status(sc *server.StatusConsumer) {
 }
 
 func (pd *ProposerDispatcher) loadFromDisk(db *db.Databases) {
+	pd.recovery = newSubsystemRecovery("proposers", len(pd.Executors))
 	res, err := db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
 		res, _ := rtxn.WithCursor(db.Proposers, func(cursor *mdbs.Cursor) interface{} {
 			// cursor.Get returns a copy of the data. So it's fine for us
@@ -117,9 +121,11 @@ func (pd *ProposerDispatcher) loadFromDisk(db *db.Databases) {
 		for txnId, proposerState := range proposerStates {
 			proposerStateCopy := proposerState
 			txnIdCopy := txnId
+			pd.recovery.loaded(txnIdCopy)
 			pd.withProposerManager(txnIdCopy, func(pm *ProposerManager) {
 				if err := pm.loadFromData(txnIdCopy, proposerStateCopy); err != nil {
 					log.Printf("ProposerDispatcher error loading %v from disk: %v\n", txnIdCopy, err)
+					pd.recovery.failed()
 				}
 			})
 		}
@@ -127,9 +133,14 @@ func (pd *ProposerDispatcher) loadFromDisk(db *db.Databases) {
 	}
 }
 
+func (pd *ProposerDispatcher) awaitRecovery() *SubsystemRecovery {
+	pd.recovery.awaitManagers(pd.Executors, func(idx int) int { return len(pd.proposermanagers[idx].proposers) })
+	return pd.recovery
+}
+
 func (pd *ProposerDispatcher) withProposerManager(txnId *common.TxnId, fun func(*ProposerManager)) bool {
 	idx := uint8(txnId[server.MostRandomByteIndex]) % pd.ExecutorCount
 	executor := pd.Executors[idx]
 	manager := pd.proposermanagers[idx]
-	return executor.Enqueue(func() { fun(manager) })
+	return executor.EnqueueFor(txnId, func() { fun(manager) })
 }
@@ -3,7 +3,6 @@ package paxos
 import (
 	"encoding/binary"
 	"fmt"
-	capn "github.com/glycerine/go-capnproto"
 	mdb "github.com/msackman/gomdb"
 	mdbs "github.com/msackman/gomdb/server"
 	"goshawkdb.io/common"
@@ -14,6 +13,7 @@ import (
 	"goshawkdb.io/server/dispatcher"
 	eng "goshawkdb.io/server/txnengine"
 	"log"
+	"time"
 )
 
 func init() {
@@ -33,12 +33,14 @@ type ProposerManager struct {
 	VarDispatcher *eng.VarDispatcher
 	Exe           *dispatcher.Executor
 	DB            *db.Databases
+	TxnJournal    TxnJournal
+	Clock         server.Clock
 	proposals     map[instanceIdPrefix]*proposal
 	proposers     map[common.TxnId]*Proposer
 	topology      *configuration.Topology
 }
 
-func NewProposerManager(exe *dispatcher.Executor, rmId common.RMId, cm ConnectionManager, db *db.Databases, varDispatcher *eng.VarDispatcher) *ProposerManager {
+func NewProposerManager(exe *dispatcher.Executor, rmId common.RMId, cm ConnectionManager, db *db.Databases, varDispatcher *eng.VarDispatcher, journal TxnJournal, clock server.Clock) *ProposerManager {
 	pm := &ProposerManager{
 		ServerConnectionPublisher: NewServerConnectionPublisherProxy(exe, cm),
 		RMId:          rmId,
@@ -48,12 +50,18 @@ func NewProposerManager(exe *dispatcher.Executor, rmId common.RMId, cm Connectio
 		VarDispatcher: varDispatcher,
 		Exe:           exe,
 		DB:            db,
+		TxnJournal:    journal,
+		Clock:         clock,
 		topology:      nil,
 	}
 	exe.Enqueue(func() { pm.topology = cm.AddTopologySubscriber(eng.ProposerSubscriber, pm) })
 	return pm
 }
 
+func (pm *ProposerManager) secondsSince(start time.Time) float64 {
+	return pm.Clock.Now().Sub(start).Seconds()
+}
+
 func (pm *ProposerManager) loadFromData(txnId *common.TxnId, data []byte) error {
 	if _, found := pm.proposers[*txnId]; !found {
 		proposer, err := ProposerFromData(pm, txnId, data, pm.topology)
@@ -141,6 +149,7 @@ func (pm *ProposerManager) TxnReceived(sender common.RMId, txn *eng.TxnReader) {
 				server.Log(txnId, "Aborting received txn due to non-matching topology.", txnCap.TopologyVersion())
 			}
 		}
+		configuration.TraceTopology(txnCap.TraceId(), pm.RMId, "txn-received", "txnId", txnId, "from", sender, "accepted", accept)
 		if accept {
 			proposer := NewProposer(pm, txn, ProposerActiveVoter, pm.topology)
 			pm.proposers[*txnId] = proposer
@@ -279,8 +288,8 @@ func (pm *ProposerManager) TwoBTxnVotesReceived(sender common.RMId, txnId *commo
 				server.Log(txnId, "Sending immediate TLC for unknown abort learner")
 				// We have no state here, and if we receive further 2Bs
 				// from the repeating sender at the acceptor then we will
-				// send further TLCs. So the use of OSS here is correct.
-				NewOneShotSender(MakeTxnLocallyCompleteMsg(txnId), pm, sender)
+				// send further TLCs. So the use of SendOnce here is correct.
+				pm.ResendScheduler().SendOnce(MakeTxnLocallyCompleteMsg(txnId), sender)
 			}
 		}
 
@@ -311,7 +320,10 @@ func (pm *ProposerManager) TxnSubmissionAbortReceived(sender common.RMId, txnId
 
 // from proposer
 func (pm *ProposerManager) TxnFinished(txnId *common.TxnId) {
-	delete(pm.proposers, *txnId)
+	if proposer, found := pm.proposers[*txnId]; found {
+		delete(pm.proposers, *txnId)
+		proposer.outcomeAccumulator.Release()
+	}
 }
 
 // We have an outcome by this point, so we should stop sending proposals.
@@ -345,7 +357,17 @@ func (pm *ProposerManager) Status(sc *server.StatusConsumer) {
 	sc.Join()
 }
 
+// GetAcceptorsFromTxn returns the txn's acceptors: those the
+// submitter chose explicitly if it did so, otherwise the first twoFInc
+// RMs of its allocations.
 func GetAcceptorsFromTxn(txnCap msgs.Txn) common.RMIds {
+	if chosen := txnCap.Acceptors(); chosen.Len() != 0 {
+		acceptors := make([]common.RMId, chosen.Len())
+		for idx := range acceptors {
+			acceptors[idx] = common.RMId(chosen.At(idx))
+		}
+		return acceptors
+	}
 	fInc := int(txnCap.FInc())
 	twoFInc := fInc + fInc - 1
 	acceptors := make([]common.RMId, twoFInc)
@@ -360,30 +382,30 @@ func GetAcceptorsFromTxn(txnCap msgs.Txn) common.RMIds {
 }
 
 func MakeTxnLocallyCompleteMsg(txnId *common.TxnId) []byte {
-	seg := capn.NewBuffer(nil)
+	seg := server.NewPooledSegment(0)
 	msg := msgs.NewRootMessage(seg)
 	tlc := msgs.NewTxnLocallyComplete(seg)
 	msg.SetTxnLocallyComplete(tlc)
 	tlc.SetTxnId(txnId[:])
-	return server.SegToBytes(seg)
+	return server.SegToBytesAndRelease(seg)
 }
 
 func MakeTxnSubmissionCompleteMsg(txnId *common.TxnId) []byte {
-	seg := capn.NewBuffer(nil)
+	seg := server.NewPooledSegment(0)
 	msg := msgs.NewRootMessage(seg)
 	tsc := msgs.NewTxnSubmissionComplete(seg)
 	msg.SetSubmissionComplete(tsc)
 	tsc.SetTxnId(txnId[:])
-	return server.SegToBytes(seg)
+	return server.SegToBytesAndRelease(seg)
 }
 
 func MakeTxnSubmissionAbortMsg(txnId *common.TxnId) []byte {
-	seg := capn.NewBuffer(nil)
+	seg := server.NewPooledSegment(0)
 	msg := msgs.NewRootMessage(seg)
 	tsa := msgs.NewTxnSubmissionAbort(seg)
 	msg.SetSubmissionAbort(tsa)
 	tsa.SetTxnId(txnId[:])
-	return server.SegToBytes(seg)
+	return server.SegToBytesAndRelease(seg)
 }
 
 func AllocForRMId(txn msgs.Txn, rmId common.RMId) *msgs.Allocation {
@@ -0,0 +1,135 @@
+package paxos
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server/dispatcher"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	recoveredCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "recovered",
+		Help:      "Number of acceptors, proposers and vars recovered from disk at startup.",
+	}, []string{"subsystem"})
+	recoveredFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "recovery_failures",
+		Help:      "Number of acceptors and proposers which could not be recovered from disk at startup.",
+	}, []string{"subsystem"})
+	recoverySeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "goshawkdb",
+		Name:      "recovery_seconds",
+		Help:      "Time taken to recover each subsystem at startup.",
+	}, []string{"subsystem"})
+)
+
+func init() {
+	prometheus.MustRegister(recoveredCount)
+	prometheus.MustRegister(recoveredFailures)
+	prometheus.MustRegister(recoverySeconds)
+}
+
+// RecoveryReport describes what was recovered from disk at
+// startup. The acceptors and proposers loaded from disk are those of
+// txns which had not completed when the server stopped, and vars are
+// loaded as those proposers restart. None of these should grow from
+// one boot to the next: if they do, txns are not being completed.
+type RecoveryReport struct {
+	Acceptors *SubsystemRecovery
+	Proposers *SubsystemRecovery
+	Vars      *SubsystemRecovery
+}
+
+// SubsystemRecovery describes the recovery of one subsystem. Managers
+// holds the count for each manager once recovery has finished. TxnIds
+// start with their submitter's txn counter, so Lowest is the txn
+// submitted earliest by its client, which is usually the oldest
+// outstanding.
+type SubsystemRecovery struct {
+	Name     string
+	Managers []int
+	Failures int
+	Lowest   *common.TxnId
+	Duration time.Duration
+	started  time.Time
+	failures int32
+}
+
+func newSubsystemRecovery(name string, managers int) *SubsystemRecovery {
+	return &SubsystemRecovery{
+		Name:     name,
+		Managers: make([]int, managers),
+		started:  time.Now(),
+	}
+}
+
+func (sr *SubsystemRecovery) Count() int {
+	count := 0
+	for _, c := range sr.Managers {
+		count += c
+	}
+	return count
+}
+
+func (sr *SubsystemRecovery) loaded(txnId *common.TxnId) {
+	if sr.Lowest == nil || txnId.Compare(sr.Lowest) == common.LT {
+		sr.Lowest = txnId
+	}
+}
+
+func (sr *SubsystemRecovery) failed() {
+	atomic.AddInt32(&sr.failures, 1)
+}
+
+// awaitManagers calls count on every executor once each has run
+// everything enqueued before it, and then completes sr. count is run
+// on the executor, so can safely inspect the manager's state.
+func (sr *SubsystemRecovery) awaitManagers(executors []*dispatcher.Executor, count func(idx int) int) {
+	var wg sync.WaitGroup
+	for idx, exe := range executors {
+		idxCopy := idx
+		wg.Add(1)
+		if !exe.Enqueue(func() {
+			sr.Managers[idxCopy] = count(idxCopy)
+			wg.Done()
+		}) {
+			wg.Done()
+		}
+	}
+	wg.Wait()
+	sr.Failures = int(atomic.LoadInt32(&sr.failures))
+	sr.Duration = time.Since(sr.started)
+}
+
+func (sr *SubsystemRecovery) String() string {
+	str := fmt.Sprintf("%v: %v recovered in %v (per manager: %v)", sr.Name, sr.Count(), sr.Duration, sr.Managers)
+	if sr.Failures != 0 {
+		str += fmt.Sprintf("; %v failed", sr.Failures)
+	}
+	if sr.Lowest != nil {
+		str += fmt.Sprintf("; lowest TxnId %v", sr.Lowest)
+	}
+	return str
+}
+
+func (rr *RecoveryReport) String() string {
+	if rr == nil {
+		return "in progress"
+	}
+	return fmt.Sprintf("%v; %v; %v", rr.Acceptors, rr.Proposers, rr.Vars)
+}
+
+func (rr *RecoveryReport) publish() {
+	for _, sr := range []*SubsystemRecovery{rr.Acceptors, rr.Proposers, rr.Vars} {
+		recoveredCount.WithLabelValues(sr.Name).Set(float64(sr.Count()))
+		recoveredFailures.WithLabelValues(sr.Name).Set(float64(sr.Failures))
+		recoverySeconds.WithLabelValues(sr.Name).Set(sr.Duration.Seconds())
+		log.Printf("Recovery: %v\n", sr)
+	}
+}
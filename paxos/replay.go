@@ -0,0 +1,210 @@
+package paxos
+
+import (
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/server/capnp"
+	eng "goshawkdb.io/server/txnengine"
+	"io"
+)
+
+// A Replayer feeds the captured messages of a single txn through the
+// same acceptor instance, ballot accumulator and outcome accumulator
+// logic that the live node uses, and reports the decisions each step
+// leads to. Only messages received by the capturing node drive the
+// state machines; messages it sent are reported so that the decisions
+// the node actually made can be compared with the replayed ones.
+type Replayer struct {
+	txnId     *common.TxnId
+	out       io.Writer
+	txn       *eng.TxnReader
+	instances map[replayInstanceKey]*instance
+	ballots   *BallotAccumulator
+	outcomes  *OutcomeAccumulator
+}
+
+var replayMessageNames = map[msgs.Message_Which]string{
+	msgs.MESSAGE_TXNSUBMISSION:       "TxnSubmission",
+	msgs.MESSAGE_SUBMISSIONOUTCOME:   "SubmissionOutcome",
+	msgs.MESSAGE_SUBMISSIONCOMPLETE:  "SubmissionComplete",
+	msgs.MESSAGE_SUBMISSIONABORT:     "SubmissionAbort",
+	msgs.MESSAGE_ONEATXNVOTES:        "OneATxnVotes",
+	msgs.MESSAGE_ONEBTXNVOTES:        "OneBTxnVotes",
+	msgs.MESSAGE_TWOATXNVOTES:        "TwoATxnVotes",
+	msgs.MESSAGE_TWOBTXNVOTES:        "TwoBTxnVotes",
+	msgs.MESSAGE_TXNLOCALLYCOMPLETE:  "TxnLocallyComplete",
+	msgs.MESSAGE_TXNGLOBALLYCOMPLETE: "TxnGloballyComplete",
+}
+
+type replayInstanceKey struct {
+	instanceRMId common.RMId
+	vUUId        common.VarUUId
+}
+
+func NewReplayer(txnId *common.TxnId, out io.Writer) *Replayer {
+	return &Replayer{
+		txnId:     txnId,
+		out:       out,
+		instances: make(map[replayInstanceKey]*instance),
+	}
+}
+
+func (r *Replayer) printf(format string, args ...interface{}) {
+	fmt.Fprintf(r.out, format, args...)
+}
+
+// Replay processes the next record. Records for other txns are
+// ignored.
+func (r *Replayer) Replay(rec *CaptureRecord) {
+	if rec.TxnId == nil || rec.TxnId.Compare(r.txnId) != common.EQ {
+		return
+	}
+	r.printf("%v %v %v %v %v\n", rec.Seq, rec.Time.Format("15:04:05.000000"), rec.Direction, rec.Peer, replayMessageNames[rec.Message.Which()])
+	if rec.Direction == CaptureOutgoing {
+		r.reportOutgoing(rec.Message)
+		return
+	}
+
+	msg := rec.Message
+	switch msg.Which() {
+	case msgs.MESSAGE_TXNSUBMISSION:
+		r.setTxn(eng.TxnReaderFromData(msg.TxnSubmission()))
+	case msgs.MESSAGE_ONEATXNVOTES:
+		r.oneA(msg.OneATxnVotes())
+	case msgs.MESSAGE_TWOATXNVOTES:
+		r.twoA(msg.TwoATxnVotes())
+	case msgs.MESSAGE_TWOBTXNVOTES:
+		r.twoB(rec.Peer, msg.TwoBTxnVotes())
+	case msgs.MESSAGE_TXNGLOBALLYCOMPLETE:
+		if r.outcomes != nil {
+			r.printf("\tproposer: TGC from %v; all TGCs received: %v\n", rec.Peer, r.outcomes.TxnGloballyCompleteReceived(rec.Peer))
+		}
+	}
+}
+
+// Finish reports the final replayed state.
+func (r *Replayer) Finish() {
+	r.printf("Replay of %v finished.\n", r.txnId)
+	if r.ballots != nil {
+		if r.ballots.outcome == nil {
+			r.printf("Acceptor: no outcome determined\n")
+		} else {
+			r.printf("Acceptor: %v\n", r.ballots.outcome)
+		}
+	}
+	if r.outcomes != nil {
+		if r.outcomes.winningOutcome == nil {
+			r.printf("Proposer: no outcome reached\n")
+		} else {
+			r.printf("Proposer: %v\n", r.outcomes.winningOutcome)
+		}
+		r.outcomes.Release()
+	}
+}
+
+func (r *Replayer) setTxn(txn *eng.TxnReader) {
+	if r.txn == nil {
+		r.txn = txn
+		r.printf("\ttxn: fInc %v; acceptors %v; retry %v\n", txn.Txn.FInc(), GetAcceptorsFromTxn(txn.Txn), txn.Txn.Retry())
+	} else {
+		r.txn = r.txn.Combine(txn)
+	}
+}
+
+func (r *Replayer) ensureInstance(instanceRMId common.RMId, vUUId *common.VarUUId) *instance {
+	key := replayInstanceKey{instanceRMId: instanceRMId, vUUId: *vUUId}
+	inst, found := r.instances[key]
+	if !found {
+		inst = &instance{vUUId: vUUId}
+		r.instances[key] = inst
+	}
+	return inst
+}
+
+func (r *Replayer) oneA(oneATxnVotes msgs.OneATxnVotes) {
+	instanceRMId := common.RMId(oneATxnVotes.RmId())
+	seg := capn.NewBuffer(nil)
+	proposals := oneATxnVotes.Proposals()
+	promises := msgs.NewTxnVotePromiseList(seg, proposals.Len())
+	for idx, l := 0, proposals.Len(); idx < l; idx++ {
+		proposal := proposals.At(idx)
+		promise := promises.At(idx)
+		vUUId := common.MakeVarUUId(proposal.VarId())
+		r.ensureInstance(instanceRMId, vUUId).OneATxnVotesReceived(&proposal, &promise)
+		r.printf("\tacceptor: 1A instance %v var %v round %v: ", instanceRMId, vUUId, paxosNumber(proposal.RoundNumber()))
+		switch promise.Which() {
+		case msgs.TXNVOTEPROMISE_FREECHOICE:
+			r.printf("promise (free choice)\n")
+		case msgs.TXNVOTEPROMISE_ACCEPTED:
+			r.printf("promise (previously accepted in round %v)\n", paxosNumber(promise.Accepted().RoundNumber()))
+		case msgs.TXNVOTEPROMISE_ROUNDNUMBERTOOLOW:
+			r.printf("round number too low (%v)\n", promise.RoundNumberTooLow())
+		}
+	}
+}
+
+func (r *Replayer) twoA(twoATxnVotes msgs.TwoATxnVotes) {
+	txn := eng.TxnReaderFromData(twoATxnVotes.Txn())
+	r.setTxn(txn)
+	if r.ballots == nil {
+		r.ballots = NewBallotAccumulator(r.txn)
+	}
+	instanceRMId := common.RMId(twoATxnVotes.RmId())
+	requests := twoATxnVotes.AcceptRequests()
+	for idx, l := 0, requests.Len(); idx < l; idx++ {
+		request := requests.At(idx)
+		ballot := eng.BallotFromData(request.Ballot())
+		roundNumber := paxosNumber(request.RoundNumber())
+		inst := r.ensureInstance(instanceRMId, ballot.VarUUId)
+		accepted, rejected := inst.TwoATxnVotesReceived(roundNumber, ballot)
+		r.printf("\tacceptor: 2A instance %v var %v round %v ballot %v: ", instanceRMId, ballot.VarUUId, roundNumber, ballot)
+		switch {
+		case accepted:
+			r.printf("accepted\n")
+			if outcome := r.ballots.BallotReceived(instanceRMId, inst, ballot.VarUUId, txn); outcome != nil {
+				r.printf("\tacceptor: outcome determined: %v\n", outcome)
+			}
+		case rejected:
+			r.printf("rejected (promised %v)\n", inst.promiseNum)
+		default:
+			r.printf("duplicate\n")
+		}
+	}
+}
+
+func (r *Replayer) twoB(sender common.RMId, twoBTxnVotes msgs.TwoBTxnVotes) {
+	if twoBTxnVotes.Which() == msgs.TWOBTXNVOTES_FAILURES {
+		failures := twoBTxnVotes.Failures()
+		nacks := failures.Nacks()
+		for idx, l := 0, nacks.Len(); idx < l; idx++ {
+			nack := nacks.At(idx)
+			r.printf("\tproposer: 2B failure instance %v var %v round %v (too low: %v)\n",
+				common.RMId(failures.RmId()), common.MakeVarUUId(nack.VarId()), paxosNumber(nack.RoundNumber()), nack.RoundNumberTooLow())
+		}
+		return
+	}
+	outcome := twoBTxnVotes.Outcome()
+	r.setTxn(eng.TxnReaderFromData(outcome.Txn()))
+	if r.outcomes == nil {
+		r.outcomes = NewOutcomeAccumulator(int(r.txn.Txn.FInc()), GetAcceptorsFromTxn(r.txn.Txn))
+	}
+	winner, allAgreed := r.outcomes.BallotOutcomeReceived(sender, &outcome)
+	r.printf("\tproposer: 2B from %v: %v\n", sender, (*outcomeEqualId)(&outcome))
+	if winner != nil {
+		r.printf("\tproposer: outcome reached: %v\n", (*outcomeEqualId)(winner))
+	}
+	if allAgreed {
+		r.printf("\tproposer: all acceptors agree\n")
+	}
+}
+
+func (r *Replayer) reportOutgoing(msg msgs.Message) {
+	if msg.Which() == msgs.MESSAGE_TWOBTXNVOTES {
+		twoB := msg.TwoBTxnVotes()
+		if twoB.Which() == msgs.TWOBTXNVOTES_OUTCOME {
+			outcome := twoB.Outcome()
+			r.printf("\tcaptured: acceptor sent %v\n", (*outcomeEqualId)(&outcome))
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package paxos
+
+import (
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"sync"
+	"time"
+)
+
+// ResendScheduler sends messages once to each of their recipients,
+// as soon as each recipient is connected. There is one per node,
+// shared by every sender: it subscribes to the ConnectionManager
+// once, rather than every message subscribing (and then
+// unsubscribing) itself, which under high txn rates was a lot of
+// churn. Messages for recipients which are not connected are queued
+// by recipient and message class, and identical messages (for
+// example, the same TLC, TSC or TGC from several proposers or
+// acceptors) are only queued, and so sent, once. It is safe to use
+// from any go-routine. Messages are sent without the lock held, as
+// sending to ourself dispatches the message synchronously, which may
+// schedule further sends.
+type ResendScheduler struct {
+	sync.Mutex
+	conns      map[common.RMId]Connection
+	pending    map[common.RMId]map[msgs.Message_Which]map[string]server.EmptyStruct
+	since      map[common.RMId]time.Time
+	queued     int
+	duplicates uint64
+}
+
+func NewResendScheduler(connPub ServerConnectionPublisher) *ResendScheduler {
+	rs := &ResendScheduler{
+		pending: make(map[common.RMId]map[msgs.Message_Which]map[string]server.EmptyStruct),
+		since:   make(map[common.RMId]time.Time),
+	}
+	connPub.AddServerConnectionSubscriber(rs)
+	sendersBacklog.Lock()
+	sendersBacklog.scheduler = rs
+	sendersBacklog.Unlock()
+	return rs
+}
+
+// SendOnce sends msg to each of the recipients, immediately if they
+// are connected, and otherwise once they connect.
+func (rs *ResendScheduler) SendOnce(msg []byte, recipients ...common.RMId) {
+	server.Log(rs, "Scheduling one shot send with recipients", recipients)
+	connected := make([]Connection, 0, len(recipients))
+	rs.Lock()
+	var class msgs.Message_Which
+	classified := false
+	for _, rmId := range recipients {
+		if conn, found := rs.conns[rmId]; found {
+			connected = append(connected, conn)
+			continue
+		}
+		if !classified {
+			class = messageClass(msg)
+			classified = true
+		}
+		classes, found := rs.pending[rmId]
+		if !found {
+			classes = make(map[msgs.Message_Which]map[string]server.EmptyStruct)
+			rs.pending[rmId] = classes
+			rs.since[rmId] = time.Now()
+		}
+		msgsForClass, found := classes[class]
+		if !found {
+			msgsForClass = make(map[string]server.EmptyStruct)
+			classes[class] = msgsForClass
+		}
+		if _, found := msgsForClass[string(msg)]; found {
+			rs.duplicates++
+		} else {
+			msgsForClass[string(msg)] = server.EmptyStructVal
+			rs.queued++
+		}
+	}
+	rs.Unlock()
+	for _, conn := range connected {
+		conn.Send(msg)
+	}
+}
+
+func messageClass(msg []byte) msgs.Message_Which {
+	seg, _, err := capn.ReadFromMemoryZeroCopy(msg)
+	if err != nil {
+		panic(fmt.Sprintf("Error when decoding message for resend: %v", err))
+	}
+	return msgs.ReadRootMessage(seg).Which()
+}
+
+type resend struct {
+	conn Connection
+	msg  []byte
+}
+
+// dequeue removes the msgs queued for rmId, appending them to
+// resends. It must be called with the lock held.
+func (rs *ResendScheduler) dequeue(rmId common.RMId, conn Connection, resends []resend) []resend {
+	classes, found := rs.pending[rmId]
+	if !found {
+		return resends
+	}
+	delete(rs.pending, rmId)
+	delete(rs.since, rmId)
+	for _, msgsForClass := range classes {
+		for msg := range msgsForClass {
+			resends = append(resends, resend{conn: conn, msg: []byte(msg)})
+		}
+		rs.queued -= len(msgsForClass)
+	}
+	return resends
+}
+
+func (rs *ResendScheduler) ConnectedRMs(conns map[common.RMId]Connection) {
+	var resends []resend
+	rs.Lock()
+	rs.conns = conns
+	for rmId, conn := range conns {
+		resends = rs.dequeue(rmId, conn, resends)
+	}
+	rs.Unlock()
+	for _, r := range resends {
+		r.conn.Send(r.msg)
+	}
+}
+
+func (rs *ResendScheduler) ConnectionLost(rmId common.RMId, conns map[common.RMId]Connection) {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.conns = conns
+}
+
+func (rs *ResendScheduler) ConnectionEstablished(rmId common.RMId, conn Connection, conns map[common.RMId]Connection, done func()) {
+	rs.Lock()
+	rs.conns = conns
+	resends := rs.dequeue(rmId, conn, nil)
+	rs.Unlock()
+	for _, r := range resends {
+		r.conn.Send(r.msg)
+	}
+	done()
+}
+
+// oldestQueued returns, for each recipient with msgs queued, when
+// the oldest of them was queued.
+func (rs *ResendScheduler) oldestQueued() map[common.RMId]time.Time {
+	rs.Lock()
+	defer rs.Unlock()
+	oldest := make(map[common.RMId]time.Time, len(rs.since))
+	for rmId, since := range rs.since {
+		oldest[rmId] = since
+	}
+	return oldest
+}
+
+func (rs *ResendScheduler) Status(sc *server.StatusConsumer) {
+	rs.Lock()
+	sc.Emit(fmt.Sprintf("Resend scheduler: %v msgs queued for %v servers; %v duplicates dropped", rs.queued, len(rs.pending), rs.duplicates))
+	for rmId, since := range rs.since {
+		sc.Emit(fmt.Sprintf("- %v: oldest queued %v ago", rmId, time.Since(since)))
+	}
+	rs.Unlock()
+	sc.Emit(fmt.Sprintf("Repeating senders: %v active", sendersBacklog.activeCount()))
+	sc.Join()
+}
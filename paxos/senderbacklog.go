@@ -0,0 +1,166 @@
+package paxos
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"sync"
+	"time"
+)
+
+var (
+	repeatingResends = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "goshawkdb",
+		Name:      "repeating_sender_resends_total",
+		Help:      "Number of messages repeating senders have sent again to a peer they had already sent them to.",
+	})
+	repeatingSendersDesc = prometheus.NewDesc("goshawkdb_repeating_senders",
+		"Number of active repeating senders, by the message they send.", []string{"message"}, nil)
+	oldestResendDesc = prometheus.NewDesc("goshawkdb_oldest_outstanding_resend_seconds",
+		"Age of the oldest message still to be acknowledged by (repeating) or delivered to (oneshot) each peer.", []string{"rmid", "sender"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(repeatingResends)
+	prometheus.MustRegister(sendersBacklog)
+}
+
+// A repeating sender sends its message to its recipients every time
+// they (re)connect, until it is unsubscribed, which is normally once
+// the recipients have acknowledged it: for example, a TLC sender is
+// unsubscribed once every acceptor has replied with a TSC. So a
+// sender which stays subscribed for a long time points to a peer
+// which isn't acknowledging, and to consensus cleanup lagging behind.
+// sendersBacklog tracks the repeating senders subscribed to every
+// ServerConnectionPublisher, along with the one shot sends queued by
+// the ResendScheduler, so that they can be exposed.
+var sendersBacklog = &senderBacklog{
+	active: make(map[*repeating]server.EmptyStruct),
+}
+
+type senderBacklog struct {
+	sync.Mutex
+	active    map[*repeating]server.EmptyStruct
+	scheduler *ResendScheduler
+}
+
+// repeating is embedded in each repeating sender. recipients is nil
+// if the message is sent to every peer.
+type repeating struct {
+	msg        []byte
+	recipients []common.RMId
+	started    time.Time
+	sent       []common.RMId
+	name       string
+}
+
+type repeatingSender interface {
+	repeatingState() *repeating
+}
+
+func newRepeating(msg []byte, recipients []common.RMId) repeating {
+	return repeating{
+		msg:        msg,
+		recipients: recipients,
+		started:    time.Now(),
+	}
+}
+
+func (r *repeating) repeatingState() *repeating { return r }
+
+// sending records that the message is about to be sent to rmId. It is
+// only called from the go-routine of the publisher the sender is
+// subscribed to.
+func (r *repeating) sending(rmId common.RMId) {
+	for _, sent := range r.sent {
+		if sent == rmId {
+			repeatingResends.Inc()
+			return
+		}
+	}
+	r.sent = append(r.sent, rmId)
+}
+
+// messageName must be called with the senderBacklog locked.
+func (r *repeating) messageName() string {
+	if r.name == "" {
+		switch messageClass(r.msg) {
+		case msgs.MESSAGE_TXNSUBMISSION:
+			r.name = "txn"
+		case msgs.MESSAGE_TWOBTXNVOTES:
+			r.name = "2b"
+		case msgs.MESSAGE_TXNLOCALLYCOMPLETE:
+			r.name = "tlc"
+		case msgs.MESSAGE_TOPOLOGYCHANGEREQUEST:
+			r.name = "topology"
+		default:
+			r.name = "other"
+		}
+	}
+	return r.name
+}
+
+// SenderSubscribed and SenderUnsubscribed must be called by every
+// ServerConnectionPublisher as subscribers come and go.
+func SenderSubscribed(obs ServerConnectionSubscriber) {
+	if rs, ok := obs.(repeatingSender); ok {
+		sendersBacklog.Lock()
+		sendersBacklog.active[rs.repeatingState()] = server.EmptyStructVal
+		sendersBacklog.Unlock()
+	}
+}
+
+func SenderUnsubscribed(obs ServerConnectionSubscriber) {
+	if rs, ok := obs.(repeatingSender); ok {
+		sendersBacklog.Lock()
+		delete(sendersBacklog.active, rs.repeatingState())
+		sendersBacklog.Unlock()
+	}
+}
+
+func (sb *senderBacklog) activeCount() int {
+	sb.Lock()
+	defer sb.Unlock()
+	return len(sb.active)
+}
+
+func (sb *senderBacklog) Describe(ch chan<- *prometheus.Desc) {
+	ch <- repeatingSendersDesc
+	ch <- oldestResendDesc
+}
+
+func (sb *senderBacklog) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	counts := make(map[string]int)
+	oldest := make(map[string]time.Time)
+	sb.Lock()
+	for r := range sb.active {
+		counts[r.messageName()]++
+		if r.recipients == nil {
+			if started, found := oldest["all"]; !found || r.started.Before(started) {
+				oldest["all"] = r.started
+			}
+		}
+		for _, rmId := range r.recipients {
+			key := rmId.String()
+			if started, found := oldest[key]; !found || r.started.Before(started) {
+				oldest[key] = r.started
+			}
+		}
+	}
+	scheduler := sb.scheduler
+	sb.Unlock()
+
+	for name, count := range counts {
+		ch <- prometheus.MustNewConstMetric(repeatingSendersDesc, prometheus.GaugeValue, float64(count), name)
+	}
+	for rmId, started := range oldest {
+		ch <- prometheus.MustNewConstMetric(oldestResendDesc, prometheus.GaugeValue, now.Sub(started).Seconds(), rmId, "repeating")
+	}
+	if scheduler != nil {
+		for rmId, queued := range scheduler.oldestQueued() {
+			ch <- prometheus.MustNewConstMetric(oldestResendDesc, prometheus.GaugeValue, now.Sub(queued).Seconds(), rmId.String(), "oneshot")
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package paxos
+
+import (
+	"fmt"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/configuration"
+)
+
+// TxnInspection is the state of a txn on this node, as seen by its
+// proposer and acceptor (either may be nil if this node has no
+// proposer or acceptor for the txn). It exists so that operators can
+// work out why a txn is stuck.
+type TxnInspection struct {
+	Proposer *ProposerInspection `json:",omitempty"`
+	Acceptor *AcceptorInspection `json:",omitempty"`
+}
+
+type ProposerInspection struct {
+	Mode               string
+	State              string
+	Acceptors          common.RMIds
+	Submitter          common.RMId `json:",omitempty"`
+	AllAcceptorsAgreed bool
+	LocallyComplete    bool
+	AwaitingTGC        common.RMIds `json:",omitempty"`
+	Injected           []string     `json:",omitempty"`
+}
+
+type AcceptorInspection struct {
+	State             string
+	OutcomeDetermined bool
+	Outcome           string `json:",omitempty"`
+	Submitter         common.RMId
+	PendingTLC        common.RMIds `json:",omitempty"`
+	TSCReceived       bool
+	TGCRecipients     common.RMIds `json:",omitempty"`
+	Instances         int
+	Injected          []string `json:",omitempty"`
+}
+
+// Injected returns true iff forcing the txn injected any messages.
+func (ti *TxnInspection) Injected() bool {
+	return (ti.Proposer != nil && len(ti.Proposer.Injected) != 0) ||
+		(ti.Acceptor != nil && len(ti.Acceptor.Injected) != 0)
+}
+
+// InspectTxn reports the state of the txn on this node. If force is
+// true then, before reporting, we inject whatever messages the txn is
+// waiting on from RMs which have been permanently removed from the
+// cluster: TLCs and TSCs to the acceptor, TGCs to the proposer, and,
+// if the txn's submitter has gone and the acceptors have not yet
+// agreed on an outcome, a TSA to the proposer, which makes it vote to
+// abort. These are exactly the messages a removed RM would have sent
+// had it stayed around, so forcing never changes an outcome which has
+// been agreed. Nothing is injected on behalf of RMs which are still
+// members (or are becoming members) of the cluster: those txns are
+// not provably stuck.
+func (d *Dispatchers) InspectTxn(txnId *common.TxnId, force bool) *TxnInspection {
+	ti := &TxnInspection{}
+	proposerChan := make(chan *ProposerInspection, 1)
+	if d.ProposerDispatcher.withProposerManager(txnId, func(pm *ProposerManager) {
+		proposerChan <- pm.inspectTxn(txnId, force)
+	}) {
+		ti.Proposer = <-proposerChan
+	}
+	acceptorChan := make(chan *AcceptorInspection, 1)
+	if d.AcceptorDispatcher.withAcceptorManager(txnId, func(am *AcceptorManager) {
+		acceptorChan <- am.inspectTxn(txnId, force)
+	}) {
+		ti.Acceptor = <-acceptorChan
+	}
+	return ti
+}
+
+// permanentlyRemoved returns true iff rmId has left the cluster for
+// good: it's neither in the current configuration, nor in any
+// configuration we're changing to.
+func permanentlyRemoved(topology *configuration.Topology, rmId common.RMId) bool {
+	if topology == nil || topology.IsBlank() || rmId == common.RMIdEmpty {
+		return false
+	}
+	if _, found := topology.RMsRemoved()[rmId]; found {
+		return true
+	}
+	for _, r := range topology.RMs() {
+		if r == rmId {
+			return false
+		}
+	}
+	if next := topology.Next(); next != nil {
+		for _, r := range next.RMs() {
+			if r == rmId {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (pm *ProposerManager) inspectTxn(txnId *common.TxnId, force bool) *ProposerInspection {
+	proposer, found := pm.proposers[*txnId]
+	if !found {
+		return nil
+	}
+	var injected []string
+	if force {
+		injected = proposer.forceResolve(pm.topology)
+	}
+	pi := proposer.inspect()
+	pi.Injected = injected
+	return pi
+}
+
+func (p *Proposer) inspect() *ProposerInspection {
+	pi := &ProposerInspection{
+		Mode:               fmt.Sprint(p.mode),
+		State:              fmt.Sprint(p.currentState),
+		Acceptors:          p.acceptors,
+		AllAcceptorsAgreed: p.allAcceptorsAgreed,
+		LocallyComplete:    p.locallyCompleted,
+	}
+	if p.txn != nil {
+		pi.Submitter = p.submitter
+	}
+	if p.currentState == &p.proposerReceiveGloballyComplete {
+		pi.AwaitingTGC = p.outcomeAccumulator.pendingTGCFrom()
+	}
+	return pi
+}
+
+func (p *Proposer) forceResolve(topology *configuration.Topology) []string {
+	injected := []string{}
+	switch p.currentState {
+	case &p.proposerAwaitBallots:
+		if !p.allAcceptorsAgreed && permanentlyRemoved(topology, p.submitter) {
+			injected = append(injected, fmt.Sprintf("TSA from %v", p.submitter))
+			p.Abort()
+		}
+	case &p.proposerReceiveGloballyComplete:
+		for _, rmId := range p.outcomeAccumulator.pendingTGCFrom() {
+			if permanentlyRemoved(topology, rmId) {
+				injected = append(injected, fmt.Sprintf("TGC from %v", rmId))
+				p.TxnGloballyCompleteReceived(rmId)
+			}
+		}
+	}
+	return injected
+}
+
+func (am *AcceptorManager) inspectTxn(txnId *common.TxnId, force bool) *AcceptorInspection {
+	aInst, found := am.acceptors[*txnId]
+	if !found {
+		return nil
+	}
+	var injected []string
+	if force && aInst.acceptor != nil {
+		injected = aInst.acceptor.forceResolve(am.Topology)
+	}
+	ai := &AcceptorInspection{
+		State:     "awaiting txn",
+		Instances: len(aInst.instances),
+		Injected:  injected,
+	}
+	if a := aInst.acceptor; a != nil {
+		aalc := &a.acceptorAwaitLocallyComplete
+		ai.State = fmt.Sprint(a.currentState)
+		ai.OutcomeDetermined = a.outcome != nil
+		if a.outcome != nil {
+			if (*msgs.Outcome)(a.outcome).Which() == msgs.OUTCOME_COMMIT {
+				ai.Outcome = "commit"
+			} else {
+				ai.Outcome = "abort"
+			}
+		}
+		ai.Submitter = aalc.txnSubmitter
+		ai.PendingTLC = make([]common.RMId, 0, len(aalc.pendingTLC))
+		for rmId := range aalc.pendingTLC {
+			ai.PendingTLC = append(ai.PendingTLC, rmId)
+		}
+		ai.TSCReceived = aalc.tscReceived
+		ai.TGCRecipients = aalc.tgcRecipients
+	}
+	return ai
+}
+
+func (a *Acceptor) forceResolve(topology *configuration.Topology) []string {
+	injected := []string{}
+	aalc := &a.acceptorAwaitLocallyComplete
+	if a.currentState != aalc {
+		return injected
+	}
+	removed := []common.RMId{}
+	for rmId := range aalc.pendingTLC {
+		if permanentlyRemoved(topology, rmId) {
+			removed = append(removed, rmId)
+		}
+	}
+	for idx := 0; idx < len(aalc.tgcRecipients); idx++ {
+		if permanentlyRemoved(topology, aalc.tgcRecipients[idx]) {
+			aalc.tgcRecipients = append(aalc.tgcRecipients[:idx], aalc.tgcRecipients[idx+1:]...)
+			idx--
+		}
+	}
+	for _, rmId := range removed {
+		injected = append(injected, fmt.Sprintf("TLC from %v", rmId))
+		aalc.TxnLocallyCompleteReceived(rmId)
+	}
+	if !aalc.tscReceived && permanentlyRemoved(topology, aalc.txnSubmitter) {
+		injected = append(injected, fmt.Sprintf("TSC from %v", aalc.txnSubmitter))
+		aalc.TxnSubmissionCompleteReceived(aalc.txnSubmitter)
+	}
+	return injected
+}
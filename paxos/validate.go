@@ -0,0 +1,119 @@
+package paxos
+
+import (
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"github.com/prometheus/client_golang/prometheus"
+	msgs "goshawkdb.io/server/capnp"
+	eng "goshawkdb.io/server/txnengine"
+)
+
+var malformedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "goshawkdb",
+	Name:      "malformed_messages_total",
+	Help:      "Number of messages from other servers rejected as malformed, by message type.",
+}, []string{"type"})
+
+func init() {
+	prometheus.MustRegister(malformedMessages)
+}
+
+// ValidateMessage checks that msg, received from another server, can
+// be safely dispatched: that the txns, ballots and clocks nested
+// within it, which are decoded lazily and assumed to be well formed,
+// can all be decoded. A malformed message is the fault of the
+// connection it arrived on, and should be dealt with there, rather
+// than being left to panic deep within the txn engine.
+func ValidateMessage(msg msgs.Message) error {
+	which := msg.Which()
+	err := eng.Decode(fmt.Sprintf("message %v", which), func() error {
+		switch which {
+		case msgs.MESSAGE_TXNSUBMISSION:
+			_, err := eng.DecodeTxnReader(msg.TxnSubmission())
+			return err
+		case msgs.MESSAGE_SUBMISSIONOUTCOME:
+			return validateOutcome(msg.SubmissionOutcome())
+		case msgs.MESSAGE_TWOATXNVOTES:
+			twoA := msg.TwoATxnVotes()
+			if _, err := eng.DecodeTxnReader(twoA.Txn()); err != nil {
+				return err
+			}
+			requests := twoA.AcceptRequests()
+			for idx, l := 0, requests.Len(); idx < l; idx++ {
+				if _, err := eng.DecodeBallot(requests.At(idx).Ballot()); err != nil {
+					return err
+				}
+			}
+			return nil
+		case msgs.MESSAGE_TWOBTXNVOTES:
+			if twoB := msg.TwoBTxnVotes(); twoB.Which() == msgs.TWOBTXNVOTES_OUTCOME {
+				return validateOutcome(twoB.Outcome())
+			}
+			return nil
+		case msgs.MESSAGE_VOTEBATCH:
+			votes := msg.VoteBatch()
+			for idx, l := 0, votes.Len(); idx < l; idx++ {
+				seg, _, err := capn.ReadFromMemoryZeroCopy(votes.At(idx))
+				if err != nil {
+					return err
+				}
+				vote := msgs.ReadRootMessage(seg)
+				if !IsVote(vote.Which()) {
+					return fmt.Errorf("Batch contains message %v, which is not a vote", vote.Which())
+				} else if err := ValidateMessage(vote); err != nil {
+					return err
+				}
+			}
+			return nil
+		case msgs.MESSAGE_MIGRATION:
+			elems := msg.Migration().Elems()
+			for idx, l := 0, elems.Len(); idx < l; idx++ {
+				if _, err := eng.DecodeTxnReader(elems.At(idx).Txn()); err != nil {
+					return err
+				}
+			}
+			return nil
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		malformedMessages.WithLabelValues(fmt.Sprint(which)).Inc()
+	}
+	return err
+}
+
+// IsVote returns true iff messages of type which may be batched.
+func IsVote(which msgs.Message_Which) bool {
+	switch which {
+	case msgs.MESSAGE_ONEATXNVOTES, msgs.MESSAGE_ONEBTXNVOTES, msgs.MESSAGE_TWOATXNVOTES, msgs.MESSAGE_TWOBTXNVOTES:
+		return true
+	default:
+		return false
+	}
+}
+
+func validateOutcome(outcome msgs.Outcome) error {
+	if _, err := eng.DecodeTxnReader(outcome.Txn()); err != nil {
+		return err
+	}
+	if outcome.Which() == msgs.OUTCOME_COMMIT {
+		_, err := eng.DecodeVectorClock(outcome.Commit())
+		return err
+	}
+	if abort := outcome.Abort(); abort.Which() == msgs.OUTCOMEABORT_RERUN {
+		updates := abort.Rerun()
+		for idx, l := 0, updates.Len(); idx < l; idx++ {
+			update := updates.At(idx)
+			if len(update.Actions()) != 0 {
+				if _, err := eng.DecodeTxnActions(update.Actions()); err != nil {
+					return err
+				}
+			}
+			if _, err := eng.DecodeVectorClock(update.Clock()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
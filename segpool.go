@@ -0,0 +1,97 @@
+package server
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	"sync"
+	"sync/atomic"
+)
+
+// Most messages we build are short lived: a segment is allocated,
+// filled in, turned into bytes by SegToBytes, and then dropped. To
+// cut down on the garbage that creates, such segments can be drawn
+// from a pool and handed back once the bytes have been taken. The
+// pool is divided into size classes so that a segment which grew
+// large isn't handed out for a tiny message (and vice versa).
+//
+// Capnp relies on newly allocated space within a segment being
+// zeroed, so buffers are zeroed as they are released.
+var segmentSizeClasses = [...]int{256, 1024, 4096, 16384}
+
+var segmentPools [len(segmentSizeClasses)]sync.Pool
+
+// Buffers this much bigger than the largest size class are left for
+// the GC rather than pooled.
+const segmentPoolMaxCap = 4 * 16384
+
+type SegmentPoolStats struct {
+	Gets     uint64
+	Misses   uint64
+	Releases uint64
+	Discards uint64
+}
+
+var segmentPoolStats SegmentPoolStats
+
+func init() {
+	for idx := range segmentPools {
+		size := segmentSizeClasses[idx]
+		segmentPools[idx].New = func() interface{} {
+			atomic.AddUint64(&segmentPoolStats.Misses, 1)
+			return make([]byte, 0, size)
+		}
+	}
+}
+
+// NewPooledSegment returns a segment backed by a buffer from the
+// pool with room for at least sizeHint bytes (0 is fine if you don't
+// know). Once the segment has been passed to SegToBytes (or is
+// otherwise finished with), and nothing else refers to it or to any
+// struct within it, it should be given back with ReleaseSegment. If
+// it's never released, it's simply garbage collected as normal.
+func NewPooledSegment(sizeHint int) *capn.Segment {
+	atomic.AddUint64(&segmentPoolStats.Gets, 1)
+	idx := 0
+	for ; idx < len(segmentSizeClasses)-1 && segmentSizeClasses[idx] < sizeHint; idx++ {
+	}
+	buf := segmentPools[idx].Get().([]byte)
+	return capn.NewBuffer(buf[:0])
+}
+
+// ReleaseSegment returns the segment's buffer to the pool. The
+// segment must not be used afterwards.
+func ReleaseSegment(seg *capn.Segment) {
+	if seg == nil {
+		return
+	}
+	buf := seg.Data
+	seg.Data = nil
+	c := cap(buf)
+	if c < segmentSizeClasses[0] || c > segmentPoolMaxCap {
+		atomic.AddUint64(&segmentPoolStats.Discards, 1)
+		return
+	}
+	for idx := range buf {
+		buf[idx] = 0
+	}
+	idx := len(segmentSizeClasses) - 1
+	for ; idx > 0 && segmentSizeClasses[idx] > c; idx-- {
+	}
+	atomic.AddUint64(&segmentPoolStats.Releases, 1)
+	segmentPools[idx].Put(buf[:0])
+}
+
+// SegToBytesAndRelease is SegToBytes followed by ReleaseSegment.
+func SegToBytesAndRelease(seg *capn.Segment) []byte {
+	data := SegToBytes(seg)
+	ReleaseSegment(seg)
+	return data
+}
+
+func GetSegmentPoolStats() SegmentPoolStats {
+	return SegmentPoolStats{
+		Gets:     atomic.LoadUint64(&segmentPoolStats.Gets),
+		Misses:   atomic.LoadUint64(&segmentPoolStats.Misses),
+		Releases: atomic.LoadUint64(&segmentPoolStats.Releases),
+		Discards: atomic.LoadUint64(&segmentPoolStats.Discards),
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	msgs "goshawkdb.io/server/capnp"
+	"runtime"
+	"testing"
+)
+
+func buildOneA(seg *capn.Segment, proposalCount int) {
+	msg := msgs.NewRootMessage(seg)
+	oneA := msgs.NewOneATxnVotes(seg)
+	msg.SetOneATxnVotes(oneA)
+	oneA.SetTxnId(make([]byte, 20))
+	oneA.SetRmId(1)
+	proposals := msgs.NewTxnVoteProposalList(seg, proposalCount)
+	oneA.SetProposals(proposals)
+	varId := make([]byte, 20)
+	for idx := 0; idx < proposalCount; idx++ {
+		varId[0] = byte(idx)
+		proposal := proposals.At(idx)
+		proposal.SetVarId(varId)
+		proposal.SetRoundNumber(uint64(idx))
+	}
+}
+
+func TestSegmentPoolReuseIsZeroed(t *testing.T) {
+	for idx := 0; idx < 100; idx++ {
+		seg := NewPooledSegment(0)
+		buildOneA(seg, 1+idx%10)
+		pooled := SegToBytesAndRelease(seg)
+		seg = capn.NewBuffer(nil)
+		buildOneA(seg, 1+idx%10)
+		unpooled := SegToBytes(seg)
+		if string(pooled) != string(unpooled) {
+			t.Fatalf("Pooled segment produced different bytes on iteration %v", idx)
+		}
+	}
+}
+
+func benchmarkSegments(b *testing.B, proposalCount int, pooled bool) {
+	b.ReportAllocs()
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for idx := 0; idx < b.N; idx++ {
+		if pooled {
+			seg := NewPooledSegment(0)
+			buildOneA(seg, proposalCount)
+			SegToBytesAndRelease(seg)
+		} else {
+			seg := capn.NewBuffer(nil)
+			buildOneA(seg, proposalCount)
+			SegToBytes(seg)
+		}
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.Logf("%v ops: %v GCs; %v bytes allocated", b.N, after.NumGC-before.NumGC, after.TotalAlloc-before.TotalAlloc)
+}
+
+func BenchmarkSegmentUnpooledSmall(b *testing.B) { benchmarkSegments(b, 1, false) }
+func BenchmarkSegmentPooledSmall(b *testing.B)   { benchmarkSegments(b, 1, true) }
+func BenchmarkSegmentUnpooledLarge(b *testing.B) { benchmarkSegments(b, 64, false) }
+func BenchmarkSegmentPooledLarge(b *testing.B)   { benchmarkSegments(b, 64, true) }
+
+func BenchmarkSegmentPooledParallel(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			seg := NewPooledSegment(0)
+			buildOneA(seg, 8)
+			SegToBytesAndRelease(seg)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package txnengine
+
+import (
+	"goshawkdb.io/common"
+	"sync"
+)
+
+// VarCommits tells observers of every write committed to a var held
+// by this node, once the write has been applied to the var, so that
+// any read of the var which starts afterwards sees the write. Rolls
+// don't change a var's value, so observers aren't told of them.
+type VarCommits struct {
+	sync.RWMutex
+	observers []func(*common.VarUUId, *common.TxnId)
+}
+
+func NewVarCommits() *VarCommits {
+	return &VarCommits{}
+}
+
+// AddObserver adds a function to be called for every committed
+// write. It is called from the VarManagers' go-routines, so it must
+// be quick and must not block.
+func (vc *VarCommits) AddObserver(observer func(*common.VarUUId, *common.TxnId)) {
+	vc.Lock()
+	defer vc.Unlock()
+	vc.observers = append(vc.observers, observer)
+}
+
+func (vc *VarCommits) committed(vUUId *common.VarUUId, txnId *common.TxnId) {
+	vc.RLock()
+	defer vc.RUnlock()
+	for _, observer := range vc.observers {
+		observer(vUUId, txnId)
+	}
+}
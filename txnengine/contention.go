@@ -0,0 +1,112 @@
+package txnengine
+
+import (
+	"bytes"
+	"fmt"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"sort"
+	"sync"
+)
+
+// VarContention describes the reads and writes in a var's current
+// frame which are still awaiting their outcome. Vars with many such
+// actions are where txns are contending. At most
+// server.ContentionTxnIdsMax of the TxnIds involved are recorded.
+type VarContention struct {
+	VarUUId *common.VarUUId
+	Reads   int
+	Writes  int
+	TxnIds  []*common.TxnId
+}
+
+func (vc *VarContention) Pending() int {
+	return vc.Reads + vc.Writes
+}
+
+func (vc *VarContention) String() string {
+	return fmt.Sprintf("%v: %v pending (%v reads, %v writes): %v", vc.VarUUId, vc.Pending(), vc.Reads, vc.Writes, vc.TxnIds)
+}
+
+type contentionByPending []*VarContention
+
+func (s contentionByPending) Len() int      { return len(s) }
+func (s contentionByPending) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s contentionByPending) Less(i, j int) bool {
+	if pi, pj := s[i].Pending(), s[j].Pending(); pi != pj {
+		return pi > pj
+	}
+	return bytes.Compare(s[i].VarUUId[:], s[j].VarUUId[:]) < 0
+}
+
+func (f *frame) contention() *VarContention {
+	vc := &VarContention{VarUUId: f.v.UUId}
+	for node := f.reads.First(); node != nil; node = node.Next() {
+		if status := node.Value.(txnStatus); status == uncommitted || status == postponed {
+			vc.Reads++
+			vc.addTxnId(node.Key.(*localAction).Id)
+		}
+	}
+	for node := f.writes.First(); node != nil; node = node.Next() {
+		if status := node.Value.(txnStatus); status == uncommitted || status == postponed {
+			vc.Writes++
+			vc.addTxnId(node.Key.(*localAction).Id)
+		}
+	}
+	return vc
+}
+
+func (vc *VarContention) addTxnId(txnId *common.TxnId) {
+	if len(vc.TxnIds) < server.ContentionTxnIdsMax {
+		vc.TxnIds = append(vc.TxnIds, txnId)
+	}
+}
+
+// contention returns the limit most contended vars of this manager.
+func (vm *VarManager) contention(limit int) []*VarContention {
+	result := []*VarContention{}
+	for _, v := range vm.active {
+		if v.curFrame == nil {
+			continue
+		}
+		if vc := v.curFrame.contention(); vc.Pending() != 0 {
+			result = append(result, vc)
+		}
+	}
+	return topContention(result, limit)
+}
+
+func topContention(vcs []*VarContention, limit int) []*VarContention {
+	sort.Sort(contentionByPending(vcs))
+	if len(vcs) > limit {
+		vcs = vcs[:limit]
+	}
+	return vcs
+}
+
+// Contention returns the limit most contended vars across all the
+// VarManagers, most contended first. It blocks until every
+// VarManager has been inspected.
+func (vd *VarDispatcher) Contention(limit int) []*VarContention {
+	var (
+		lock   sync.Mutex
+		wg     sync.WaitGroup
+		result []*VarContention
+	)
+	for idx, executor := range vd.Executors {
+		manager := vd.varmanagers[idx]
+		wg.Add(1)
+		enqueued := executor.Offer(func() {
+			vcs := manager.contention(limit)
+			lock.Lock()
+			result = append(result, vcs...)
+			lock.Unlock()
+			wg.Done()
+		})
+		if !enqueued {
+			wg.Done()
+		}
+	}
+	wg.Wait()
+	return topContention(result, limit)
+}
@@ -0,0 +1,169 @@
+package txnengine
+
+import (
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/server/capnp"
+)
+
+// Malformed capnp data fails in two ways: capn can refuse to read the
+// segment at all, or the segment is readable but contains pointers or
+// lists which are out of bounds, in which case the generated accessors
+// panic. The FromData functions are for data we wrote ourselves, and
+// treat either as fatal. The Decode functions are for data which may
+// be corrupt (from the network, or read back from disk), and return
+// an error instead, having checked everything that will later be read
+// without further checks.
+
+// Decode runs fun, turning a panic within it into an error.
+func Decode(what string, fun func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Error when decoding %v: %v", what, r)
+		}
+	}()
+	if err = fun(); err != nil {
+		err = fmt.Errorf("Error when decoding %v: %v", what, err)
+	}
+	return
+}
+
+func checkKeyLen(what string, key []byte) error {
+	if len(key) != common.KeyLen {
+		return fmt.Errorf("%v has length %v", what, len(key))
+	}
+	return nil
+}
+
+// DecodeTxnReader is TxnReaderFromData for data which may be corrupt.
+// The actions are decoded, and the allocations checked against them.
+func DecodeTxnReader(data []byte) (*TxnReader, error) {
+	var txn *TxnReader
+	err := Decode("transaction", func() error {
+		seg, _, err := capn.ReadFromMemoryZeroCopy(data)
+		if err != nil {
+			return err
+		}
+		txnCap := msgs.ReadRootTxn(seg)
+		if err = checkKeyLen("TxnId", txnCap.Id()); err != nil {
+			return err
+		}
+		txn = &TxnReader{
+			Data: data,
+			Txn:  txnCap,
+			Id:   common.MakeTxnId(txnCap.Id()),
+		}
+		if err = checkActions(txn.Actions(true)); err != nil {
+			return err
+		}
+		actionsLen := txn.actions.actionsCap.Len()
+		allocations := txnCap.Allocations()
+		for idx, l := 0, allocations.Len(); idx < l; idx++ {
+			indices := allocations.At(idx).ActionIndices()
+			for idy, m := 0, indices.Len(); idy < m; idy++ {
+				if index := int(indices.At(idy)); index >= actionsLen {
+					return fmt.Errorf("Allocation action index %v out of range (%v actions)", index, actionsLen)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+// DecodeTxnActions is TxnActionsFromData for data which may be
+// corrupt.
+func DecodeTxnActions(data []byte) (*TxnActions, error) {
+	actions := &TxnActions{Data: data}
+	if err := Decode("actions", func() error { return checkActions(actions) }); err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
+
+func checkActions(actions *TxnActions) error {
+	actionsCap := actions.Actions()
+	for idx, l := 0, actionsCap.Len(); idx < l; idx++ {
+		if err := checkKeyLen("VarUUId", actionsCap.At(idx).VarId()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeBallot is BallotFromData for data which may be corrupt. The
+// ballot's clock, and the txn of a bad read vote, are decoded too.
+func DecodeBallot(data []byte) (*Ballot, error) {
+	var ballot *Ballot
+	err := Decode("ballot", func() error {
+		seg, _, err := capn.ReadFromMemoryZeroCopy(data)
+		if err != nil {
+			return err
+		}
+		ballotCap := msgs.ReadRootBallot(seg)
+		if err = checkKeyLen("VarUUId", ballotCap.VarId()); err != nil {
+			return err
+		}
+		clock, err := DecodeVectorClock(ballotCap.Clock())
+		if err != nil {
+			return err
+		}
+		voteCap := ballotCap.Vote()
+		if voteCap.Which() == msgs.VOTE_ABORTBADREAD {
+			badRead := voteCap.AbortBadRead()
+			if err = checkKeyLen("TxnId", badRead.TxnId()); err != nil {
+				return err
+			} else if _, err = DecodeTxnActions(badRead.TxnActions()); err != nil {
+				return err
+			}
+		}
+		ballot = &Ballot{
+			VarUUId: common.MakeVarUUId(ballotCap.VarId()),
+			Data:    data,
+			VoteCap: &voteCap,
+			Clock:   clock,
+			Vote:    Vote(voteCap.Which()),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ballot, nil
+}
+
+// DecodeVectorClock is VectorClockFromData, with forceDecode, for data
+// which may be corrupt.
+func DecodeVectorClock(data []byte) (*VectorClock, error) {
+	vc := &VectorClock{data: data}
+	err := Decode("vector clock", func() error {
+		if len(data) == 0 {
+			vc.decode()
+			return nil
+		}
+		seg, _, err := capn.ReadFromMemoryZeroCopy(data)
+		if err != nil {
+			return err
+		}
+		vcCap := msgs.ReadRootVectorClock(seg)
+		keys := vcCap.VarUuids()
+		if keys.Len() != vcCap.Values().Len() {
+			return fmt.Errorf("%v keys but %v values", keys.Len(), vcCap.Values().Len())
+		}
+		for idx, l := 0, keys.Len(); idx < l; idx++ {
+			if err := checkKeyLen("VarUUId", keys.At(idx)); err != nil {
+				return err
+			}
+		}
+		vc.decode()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vc, nil
+}
@@ -0,0 +1,51 @@
+package txnengine
+
+import (
+	"goshawkdb.io/common"
+	"math/rand"
+	"testing"
+)
+
+// corrupt returns a copy of data, truncated and with some bytes
+// replaced.
+func corrupt(rng *rand.Rand, data []byte) []byte {
+	result := append([]byte{}, data[:rng.Intn(len(data)+1)]...)
+	for n := rng.Intn(4); n > 0 && len(result) > 0; n-- {
+		result[rng.Intn(len(result))] = byte(rng.Intn(256))
+	}
+	return result
+}
+
+// Decoders must never panic, however corrupt their input.
+func TestDecodeCorrupt(t *testing.T) {
+	vUUId := common.MakeVarUUId(testFrameId(1))
+	txnId := common.MakeTxnId(testFrameId(2))
+	txn := testFrameCreateTxn(txnId, vUUId, 1)
+	clock := testFrameClock(vUUId, 3)
+	ballot := NewBallotBuilder(vUUId, AbortDeadlock, NewVectorClock().AsMutable().Bump(vUUId, 3)).ToBallot().Data
+
+	if _, err := DecodeTxnReader(txn); err != nil {
+		t.Fatal(err)
+	}
+	if vc, err := DecodeVectorClock(clock); err != nil {
+		t.Fatal(err)
+	} else if vc.At(vUUId) != 3 {
+		t.Fatalf("Expected clock of 3 for %v; got %v", vUUId, vc)
+	}
+	if b, err := DecodeBallot(ballot); err != nil {
+		t.Fatal(err)
+	} else if b.Vote != AbortDeadlock || b.VarUUId.Compare(vUUId) != common.EQ {
+		t.Fatalf("Ballot decoded wrongly: %v", b)
+	}
+
+	if _, err := DecodeTxnReader(txn[:len(txn)/2]); err == nil {
+		t.Fatal("Expected error decoding truncated txn")
+	}
+
+	rng := rand.New(rand.NewSource(0))
+	for idx := 0; idx < 10000; idx++ {
+		DecodeTxnReader(corrupt(rng, txn))
+		DecodeVectorClock(corrupt(rng, clock))
+		DecodeBallot(corrupt(rng, ballot))
+	}
+}
@@ -25,6 +25,7 @@ type frame struct {
 	frameTxnActions  *TxnActions
 	frameTxnClock    *VectorClockMutable // the clock (including merge missing) of the frame txn
 	frameWritesClock *VectorClockMutable // max elems from all writes of all txns in parent frame
+	frozen           bool                // the frame txn froze the var
 	readVoteClock    *VectorClockMutable
 	positionsFound   bool
 	mask             *VectorClockMutable
@@ -43,11 +44,12 @@ func NewFrame(parent *frame, v *Var, txnId *common.TxnId, txnActions *TxnActions
 		frameTxnActions:  txnActions,
 		frameTxnClock:    txnClock,
 		frameWritesClock: writesClock,
+		frozen:           frameActionFrozen(v.UUId, txnActions),
 		positionsFound:   false,
 	}
 	if parent == nil {
 		f.mask = NewVectorClock().AsMutable()
-		f.scheduleBackoff = server.NewBinaryBackoffEngine(v.rng, server.VarRollDelayMin, server.VarRollDelayMax)
+		f.scheduleBackoff = server.NewBinaryBackoffEngineWithClock(v.rng, v.vm.Clock, server.VarRollDelayMin, server.VarRollDelayMax)
 	} else {
 		f.mask = parent.mask
 		f.scheduleBackoff = parent.scheduleBackoff
@@ -247,6 +249,9 @@ func (fo *frameOpen) AddWrite(action *localAction) {
 	switch {
 	case fo.currentState != fo:
 		panic(fmt.Sprintf("%v AddWrite called for %v with frame in state %v", fo.v, txn, fo.currentState))
+	case fo.frozen:
+		action.VoteBadRead(fo.frameTxnClock, fo.frameTxnId, fo.frameTxnActions)
+		fo.v.maybeMakeInactive()
 	case fo.rwPresent || (fo.maxUncommittedRead != nil && action.Compare(fo.maxUncommittedRead) == sl.LT) || found || len(fo.learntFutureReads) != 0:
 		action.VoteDeadlock(fo.frameTxnClock)
 	case fo.writes.Get(action) == nil:
@@ -315,6 +320,9 @@ func (fo *frameOpen) AddReadWrite(action *localAction) {
 	switch {
 	case fo.currentState != fo:
 		panic(fmt.Sprintf("%v AddReadWrite called for %v with frame in state %v", fo.v, txn, fo.currentState))
+	case fo.frozen && !action.permittedOnFrozen():
+		action.VoteBadRead(fo.frameTxnClock, fo.frameTxnId, fo.frameTxnActions)
+		fo.v.maybeMakeInactive()
 	case fo.writes.Len() != 0 || fo.writes.Len() != 0 || (fo.maxUncommittedRead != nil && action.Compare(fo.maxUncommittedRead) == sl.LT) || fo.frameTxnActions == nil || len(fo.learntFutureReads) != 0:
 		action.VoteDeadlock(fo.frameTxnClock)
 	case fo.frameTxnId.Compare(action.readVsn) != common.EQ:
@@ -516,7 +524,7 @@ func (fo *frameOpen) maybeStartWrites() {
 		fo.maybeCreateChild()
 	} else {
 		fo.calculateWriteVoteClock()
-		now := time.Now()
+		now := fo.v.vm.Clock.Now()
 		for node := fo.writes.First(); node != nil; {
 			next := node.Next()
 			if node.Value == postponed {
@@ -749,7 +757,7 @@ func (fo *frameOpen) maybeStartRollFrom(rescheduling bool) {
 				multiplier += node.Key.(*localAction).TxnReader.Actions(true).Actions().Len()
 			}
 		}
-		now := time.Now()
+		now := fo.v.vm.Clock.Now()
 		quietDuration := server.VarRollTimeExpectation * time.Duration(multiplier)
 		probOfZero := fo.v.poisson.P(quietDuration, 0, now)
 		elapsed := time.Duration(0)
@@ -772,6 +780,18 @@ func (fo *frameOpen) maybeStartRollFrom(rescheduling bool) {
 	}
 }
 
+// rollNow starts a roll immediately if the frame can roll, rather
+// than waiting for the var to go quiet. Only frames without writes
+// can roll, and once rolled, a frame of committed reads is empty, so
+// the var can be evicted from memory.
+func (fo *frameOpen) rollNow() bool {
+	if fo.v.vm.RollAllowed && fo.basicRollCondition(true) {
+		fo.startRoll(rollCallback{frameOpen: fo})
+		return true
+	}
+	return false
+}
+
 func (fo *frameOpen) scheduleRoll() {
 	server.Log(fo.frame, "Roll callback scheduled")
 	// fmt.Printf("s%v(%v|%v)\n", fo.v.UUId, probOfZero, fo.scheduleBackoff.Cur)
@@ -784,6 +804,7 @@ func (fo *frameOpen) scheduleRoll() {
 
 func (fo *frameOpen) startRoll(rollCB rollCallback) {
 	fo.rollActive = true
+	fo.v.vm.frameRecorder.record(FrameEventRoll, fo.v, nil)()
 	// must do roll txn creation in the main go-routine
 	ctxn, varPosMap := fo.createRollClientTxn()
 	server.Log(fo.frame, "Starting roll")
@@ -841,6 +862,8 @@ func (rc rollCallback) rollTranslationCallback(cAction *cmsgs.ClientAction, acti
 			return AbortRollNotFirst
 		}
 	}
+	// a roll copies the value, so must keep the var frozen.
+	action.SetFrozen(rc.frozen)
 	return nil
 }
 
@@ -868,6 +891,8 @@ func (fo *frameOpen) createRollClientTxn() (*cmsgs.ClientTxn, map[common.VarUUId
 	action.SetRoll()
 	roll := action.Roll()
 	roll.SetVersion(fo.frameTxnId[:])
+	// the value is copied as is, so must keep its codec.
+	action.SetValueCodec(origWrite.ValueCodec())
 	var refs msgs.VarIdPos_List
 	switch origWrite.Which() {
 	case msgs.ACTION_WRITE:
@@ -0,0 +1,317 @@
+package txnengine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// A FrameRecorder records the events which drive the frames of each
+// Var to a log file, together with the frame each event leaves the
+// Var in, so that the events can later be replayed through a fresh
+// Var (see FrameReplayer) to check that the frame logic still reaches
+// the same conclusions. One recorder is shared by all the
+// VarManagers. All the methods are safe to call on a nil
+// *FrameRecorder, which records nothing.
+//
+// The file starts with magic (8 bytes) and the recording RMId
+// (4). Each record is length (4), kind (1), flags (1), VarUUId, TxnId
+// and resulting frame TxnId (KeyLen each), and then five fields, each
+// of length (4) and data: txn, clock, writes clock, positions and
+// resulting frame clock. The length covers the whole record.
+type FrameRecorder struct {
+	sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	records uint64
+}
+
+type FrameEventKind uint8
+
+const (
+	FrameEventLoad     FrameEventKind = iota
+	FrameEventTxn      FrameEventKind = iota
+	FrameEventOutcome  FrameEventKind = iota
+	FrameEventPreAbort FrameEventKind = iota
+	FrameEventComplete FrameEventKind = iota
+	FrameEventRoll     FrameEventKind = iota
+)
+
+func (k FrameEventKind) String() string {
+	switch k {
+	case FrameEventLoad:
+		return "Load"
+	case FrameEventTxn:
+		return "Txn"
+	case FrameEventOutcome:
+		return "Outcome"
+	case FrameEventPreAbort:
+		return "PreAbort"
+	case FrameEventComplete:
+		return "Complete"
+	case FrameEventRoll:
+		return "Roll"
+	default:
+		return fmt.Sprintf("Unknown(%d)", uint8(k))
+	}
+}
+
+// A FrameEvent is a single record of a frame log. Which fields are
+// set depends on Kind:
+//
+//   - Load: the Var has been created or loaded from disk. TxnId is
+//     the frame txn (nil for a new Var), Txn its actions, Clock and
+//     Writes the frame's txn and writes clocks.
+//   - Txn: an action has been received. Txn is the whole txn.
+//   - Outcome: the outcome of an action has been received. Clock is
+//     the outcome clock, unless Aborted. Txn is set if the action
+//     was never received (we're a learner), and Writes and Positions
+//     are also set if the action is an immigrant.
+//   - PreAbort: the txn aborted before its outcome was known.
+//   - Complete: the txn is globally complete.
+//   - Roll: the Var started a roll of its frame.
+//
+// In every case FrameTxnId and FrameClock are the Var's current frame
+// after the event.
+type FrameEvent struct {
+	RMId       common.RMId
+	Kind       FrameEventKind
+	VarUUId    *common.VarUUId
+	TxnId      *common.TxnId
+	Txn        []byte
+	Clock      []byte
+	Writes     []byte
+	Positions  []byte
+	Aborted    bool
+	FrameTxnId *common.TxnId
+	FrameClock []byte
+}
+
+func (ev *FrameEvent) String() string {
+	return fmt.Sprintf("%v %v %v (aborted? %v) -> frame %v %v",
+		ev.Kind, ev.VarUUId, ev.TxnId, ev.Aborted, ev.FrameTxnId, VectorClockFromData(ev.FrameClock, true).AsMutable())
+}
+
+const (
+	frameLogMagic           = "GSDBFRL1"
+	frameLogHeaderLen       = 12
+	frameLogRecordHeaderLen = 6 + 3*common.KeyLen
+	frameLogFields          = 5
+
+	frameLogHasTxnId      = 1
+	frameLogHasFrameTxnId = 2
+	frameLogAborted       = 4
+)
+
+func NewFrameRecorder(path string, rmId common.RMId) (*FrameRecorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fr := &FrameRecorder{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}
+	header := make([]byte, frameLogHeaderLen)
+	copy(header, frameLogMagic)
+	binary.BigEndian.PutUint32(header[8:], uint32(rmId))
+	if _, err = fr.writer.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return fr, nil
+}
+
+func (fr *FrameRecorder) Close() {
+	if fr == nil {
+		return
+	}
+	fr.Lock()
+	defer fr.Unlock()
+	if fr.file != nil {
+		if err := fr.writer.Flush(); err != nil {
+			log.Println("FrameRecorder: error when flushing:", err)
+		}
+		fr.file.Close()
+		fr.file = nil
+	}
+}
+
+func frameRecordNothing() {}
+
+// record is called at the start of each event. It captures the event
+// immediately (the event may mutate the action), and returns the
+// function to call once the event has been processed, which records
+// the frame the Var has been left in.
+func (fr *FrameRecorder) record(kind FrameEventKind, v *Var, action *localAction) func() {
+	if fr == nil {
+		return frameRecordNothing
+	}
+	ev := &FrameEvent{
+		Kind:    kind,
+		VarUUId: v.UUId,
+	}
+	switch kind {
+	case FrameEventLoad:
+		f := v.curFrame
+		ev.TxnId = f.frameTxnId
+		if f.frameTxnActions != nil {
+			ev.Txn = f.frameTxnActions.Data
+		}
+		ev.Clock = f.frameTxnClock.AsData()
+		ev.Writes = f.frameWritesClock.AsData()
+		if v.positions != nil {
+			ev.Positions = (*capn.UInt8List)(v.positions).ToArray()
+		}
+	case FrameEventRoll:
+		ev.TxnId = v.curFrame.frameTxnId
+	default:
+		ev.TxnId = action.Id
+	}
+	switch kind {
+	case FrameEventTxn:
+		ev.Txn = action.TxnReader.Data
+	case FrameEventOutcome:
+		ev.Aborted = action.aborted
+		if !action.aborted {
+			ev.Clock = action.outcomeClock.AsData()
+		}
+		if !action.voter {
+			ev.Txn = action.TxnReader.Data
+		}
+		if action.IsImmigrant() {
+			ev.Writes = action.writesClock.AsData()
+			ev.Positions = (*capn.UInt8List)(action.createPositions).ToArray()
+		}
+	}
+	return func() {
+		ev.FrameTxnId = v.curFrame.frameTxnId
+		ev.FrameClock = v.curFrame.frameTxnClock.AsData()
+		fr.write(ev)
+	}
+}
+
+func (fr *FrameRecorder) write(ev *FrameEvent) {
+	fields := [frameLogFields][]byte{ev.Txn, ev.Clock, ev.Writes, ev.Positions, ev.FrameClock}
+	recLen := frameLogRecordHeaderLen + 4*frameLogFields
+	for _, field := range fields {
+		recLen += len(field)
+	}
+	rec := make([]byte, recLen)
+	binary.BigEndian.PutUint32(rec[0:4], uint32(recLen))
+	rec[4] = byte(ev.Kind)
+	copy(rec[6:], ev.VarUUId[:])
+	if ev.TxnId != nil {
+		rec[5] |= frameLogHasTxnId
+		copy(rec[6+common.KeyLen:], ev.TxnId[:])
+	}
+	if ev.FrameTxnId != nil {
+		rec[5] |= frameLogHasFrameTxnId
+		copy(rec[6+2*common.KeyLen:], ev.FrameTxnId[:])
+	}
+	if ev.Aborted {
+		rec[5] |= frameLogAborted
+	}
+	pos := frameLogRecordHeaderLen
+	for _, field := range fields {
+		binary.BigEndian.PutUint32(rec[pos:pos+4], uint32(len(field)))
+		pos += 4
+		pos += copy(rec[pos:], field)
+	}
+
+	fr.Lock()
+	defer fr.Unlock()
+	if fr.file == nil {
+		return
+	}
+	if _, err := fr.writer.Write(rec); err != nil {
+		log.Println("FrameRecorder: error writing; recording stopped:", err)
+		fr.file.Close()
+		fr.file = nil
+		return
+	}
+	fr.records++
+}
+
+func (fr *FrameRecorder) Status(sc *server.StatusConsumer) {
+	if fr == nil {
+		sc.Emit("Frame recording: disabled")
+	} else {
+		fr.Lock()
+		sc.Emit(fmt.Sprintf("Frame recording: %v records written", fr.records))
+		fr.Unlock()
+	}
+	sc.Join()
+}
+
+// ReadFrameLog invokes fun on every record in the frame log at path,
+// in the order they were recorded.
+func ReadFrameLog(path string, fun func(*FrameEvent) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	buf := new(bytes.Buffer)
+	if _, err = io.Copy(buf, file); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if len(data) < frameLogHeaderLen || !bytes.Equal(data[:8], []byte(frameLogMagic)) {
+		return errors.New("Not a frame log")
+	}
+	rmId := common.RMId(binary.BigEndian.Uint32(data[8:12]))
+
+	for pos := frameLogHeaderLen; pos < len(data); {
+		if pos+4 > len(data) {
+			return fmt.Errorf("Truncated frame log record at %v", pos)
+		}
+		recLen := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if recLen < frameLogRecordHeaderLen+4*frameLogFields || pos+recLen > len(data) {
+			return fmt.Errorf("Corrupt frame log record at %v", pos)
+		}
+		rec := data[pos : pos+recLen]
+		ev := &FrameEvent{
+			RMId:    rmId,
+			Kind:    FrameEventKind(rec[4]),
+			VarUUId: common.MakeVarUUId(rec[6 : 6+common.KeyLen]),
+			Aborted: rec[5]&frameLogAborted != 0,
+		}
+		if rec[5]&frameLogHasTxnId != 0 {
+			ev.TxnId = common.MakeTxnId(rec[6+common.KeyLen : 6+2*common.KeyLen])
+		}
+		if rec[5]&frameLogHasFrameTxnId != 0 {
+			ev.FrameTxnId = common.MakeTxnId(rec[6+2*common.KeyLen : 6+3*common.KeyLen])
+		}
+		fields := [frameLogFields]*[]byte{&ev.Txn, &ev.Clock, &ev.Writes, &ev.Positions, &ev.FrameClock}
+		fieldPos := frameLogRecordHeaderLen
+		for _, field := range fields {
+			if fieldPos+4 > recLen {
+				return fmt.Errorf("Corrupt frame log record at %v", pos)
+			}
+			fieldLen := int(binary.BigEndian.Uint32(rec[fieldPos : fieldPos+4]))
+			fieldPos += 4
+			if fieldPos+fieldLen > recLen {
+				return fmt.Errorf("Corrupt frame log record at %v", pos)
+			}
+			if fieldLen != 0 {
+				*field = rec[fieldPos : fieldPos+fieldLen]
+			}
+			fieldPos += fieldLen
+		}
+		if err = fun(ev); err != nil {
+			return err
+		}
+		pos += recLen
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package txnengine
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testFrameId(n byte) []byte {
+	id := make([]byte, common.KeyLen)
+	id[common.KeyLen-1] = n
+	return id
+}
+
+// A txn which creates vUUId, with the action allocated to rmId.
+func testFrameCreateTxn(txnId *common.TxnId, vUUId *common.VarUUId, rmId common.RMId) []byte {
+	actionsSeg := capn.NewBuffer(nil)
+	wrapper := msgs.NewRootActionListWrapper(actionsSeg)
+	actions := msgs.NewActionList(actionsSeg, 1)
+	wrapper.SetActions(actions)
+	action := actions.At(0)
+	action.SetVarId(vUUId[:])
+	action.SetCreate()
+	create := action.Create()
+	create.SetPositions(actionsSeg.NewUInt8List(1))
+	create.SetValue([]byte{})
+	create.SetReferences(msgs.NewVarIdPosList(actionsSeg, 0))
+
+	seg := capn.NewBuffer(nil)
+	txn := msgs.NewRootTxn(seg)
+	txn.SetId(txnId[:])
+	txn.SetActions(server.SegToBytes(actionsSeg))
+	allocations := msgs.NewAllocationList(seg, 1)
+	allocation := allocations.At(0)
+	allocation.SetRmId(uint32(rmId))
+	indices := seg.NewUInt16List(1)
+	indices.Set(0, 0)
+	allocation.SetActionIndices(indices)
+	allocation.SetActive(1)
+	txn.SetAllocations(allocations)
+	return server.SegToBytes(seg)
+}
+
+func testFrameClock(vUUId *common.VarUUId, v uint64) []byte {
+	return NewVectorClock().AsMutable().Bump(vUUId, v).AsData()
+}
+
+// The events of a var being created, in the frames expected.
+func testFrameEvents(rmId common.RMId) []*FrameEvent {
+	vUUId := common.MakeVarUUId(testFrameId(1))
+	txnId := common.MakeTxnId(testFrameId(2))
+	one, two := testFrameClock(vUUId, 1), testFrameClock(vUUId, 2)
+	return []*FrameEvent{
+		{RMId: rmId, Kind: FrameEventLoad, VarUUId: vUUId, Clock: one, Writes: one, FrameClock: one},
+		{RMId: rmId, Kind: FrameEventTxn, VarUUId: vUUId, TxnId: txnId, Txn: testFrameCreateTxn(txnId, vUUId, rmId), FrameClock: one},
+		{RMId: rmId, Kind: FrameEventOutcome, VarUUId: vUUId, TxnId: txnId, Clock: two, FrameTxnId: txnId, FrameClock: two},
+		{RMId: rmId, Kind: FrameEventComplete, VarUUId: vUUId, TxnId: txnId, FrameTxnId: txnId, FrameClock: two},
+	}
+}
+
+func testReplay(t *testing.T, events []*FrameEvent, rec *FrameRecorder) error {
+	replayer := NewFrameReplayer()
+	defer replayer.Close()
+	replayer.SetFrameRecorder(rec)
+	for _, ev := range events {
+		if err := replayer.Replay(ev); err != nil {
+			return err
+		}
+	}
+	if replayer.Skipped != 0 {
+		t.Fatalf("Skipped %v events", replayer.Skipped)
+	}
+	return nil
+}
+
+func TestFrameReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "framelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frames")
+
+	rmId := common.RMId(1)
+	rec, err := NewFrameRecorder(path, rmId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testReplay(t, testFrameEvents(rmId), rec); err != nil {
+		t.Fatal(err)
+	}
+	rec.Close()
+
+	recorded := []*FrameEvent{}
+	if err = ReadFrameLog(path, func(ev *FrameEvent) error {
+		recorded = append(recorded, ev)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if l := len(recorded); l != len(testFrameEvents(rmId)) {
+		t.Fatalf("Expected %v recorded events; found %v", len(testFrameEvents(rmId)), l)
+	}
+	if err = testReplay(t, recorded, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change to the frame logic shows up as a divergence.
+	last := recorded[len(recorded)-1]
+	last.FrameClock = testFrameClock(last.VarUUId, 3)
+	if err = testReplay(t, recorded, nil); err == nil {
+		t.Fatal("Expected replay to diverge")
+	}
+}
@@ -0,0 +1,281 @@
+package txnengine
+
+import (
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	tw "github.com/msackman/gotimerwheel"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/dispatcher"
+	"time"
+)
+
+// A FrameReplayer feeds the events of a frame log (see FrameRecorder)
+// through fresh Vars, and checks that after each event, each Var is
+// left with the same frame txn and frame clock as was recorded. A Var
+// is replayed from each Load event for it: events for Vars which have
+// not been loaded since recording started are skipped.
+//
+// The replayed Vars have no disk: each frame is written as soon as
+// the event which created it has been processed, and before the next
+// event. The replayed txns do nothing when their actions vote or
+// become locally complete: instead, the effects of the txns (their
+// outcomes, pre-aborts and completions) are taken from the log. Rolls
+// are never started by a replay: the roll txns themselves are
+// replayed from the log like any other txn.
+type FrameReplayer struct {
+	vars     dispatcher.Dispatcher
+	inert    dispatcher.Dispatcher
+	vm       *VarManager
+	replayed map[common.VarUUId]*replayVar
+	Events   uint64
+	Skipped  uint64
+}
+
+type replayVar struct {
+	v       *Var
+	actions map[common.TxnId]*localAction
+}
+
+func NewFrameReplayer() *FrameReplayer {
+	fr := &FrameReplayer{
+		replayed: make(map[common.VarUUId]*replayVar),
+	}
+	fr.vars.Init("FrameReplayer", 1)
+	// The txns' callbacks are enqueued onto an executor which has
+	// already been shut down, and so are dropped.
+	fr.inert.Init("FrameReplayerInert", 1)
+	fr.inert.Shutdown()
+	fr.vm = &VarManager{
+		active:      make(map[common.VarUUId]*Var),
+		RollAllowed: false,
+		Clock:       server.RealClock,
+		tw:          tw.NewTimerWheel(time.Now(), 25*time.Millisecond),
+		exe:         fr.vars.Executors[0],
+		frozen:      NewFrozenVars(),
+	}
+	return fr
+}
+
+// SetFrameRecorder records the replayed events to rec, as if the
+// replay were live.
+func (fr *FrameReplayer) SetFrameRecorder(rec *FrameRecorder) {
+	fr.apply(func() { fr.vm.frameRecorder = rec })
+}
+
+func (fr *FrameReplayer) Close() {
+	fr.apply(func() {
+		if fr.vm.beaterTerminator != nil {
+			close(fr.vm.beaterTerminator)
+			fr.vm.beaterTerminator = nil
+		}
+	})
+	fr.vars.Shutdown()
+}
+
+// apply runs fun on the Vars' executor and waits for it, and for any
+// frame writes it leads to, to finish.
+func (fr *FrameReplayer) apply(fun func()) {
+	done := make(chan bool)
+	fr.vars.Executors[0].Enqueue(func() {
+		fun()
+		done <- true
+	})
+	<-done
+	for writing := true; writing; {
+		fr.vars.Executors[0].Enqueue(func() {
+			result := false
+			for _, rv := range fr.replayed {
+				result = result || rv.v.writeInProgress != nil
+			}
+			done <- result
+		})
+		writing = <-done
+	}
+}
+
+// Replay processes the next event of the log. An error is returned if
+// the replay diverges from the log.
+func (fr *FrameReplayer) Replay(ev *FrameEvent) (err error) {
+	fr.Events++
+	fr.apply(func() {
+		err = fr.replay(ev)
+	})
+	return err
+}
+
+func (fr *FrameReplayer) replay(ev *FrameEvent) error {
+	rv, found := fr.replayed[*ev.VarUUId]
+	if ev.Kind == FrameEventLoad {
+		var err error
+		if found {
+			err = fr.check(rv.v, ev, "reloaded as")
+		}
+		fr.load(ev)
+		return err
+	} else if !found {
+		fr.Skipped++
+		return nil
+	}
+
+	v := rv.v
+	fr.vm.active[*v.UUId] = v
+	switch ev.Kind {
+	case FrameEventTxn:
+		action, err := fr.replayAction(ev, true)
+		if err != nil {
+			return err
+		}
+		rv.actions[*action.Id] = action
+		v.ReceiveTxn(action)
+
+	case FrameEventOutcome:
+		action, found := rv.actions[*ev.TxnId]
+		if !found {
+			var err error
+			if action, err = fr.replayAction(ev, false); err != nil {
+				return err
+			}
+			rv.actions[*action.Id] = action
+		}
+		if ev.Aborted {
+			action.aborted = true
+		} else {
+			action.Txn.outcomeClock = VectorClockFromData(ev.Clock, true)
+			action.outcomeClock = action.Txn.outcomeClock
+		}
+		v.ReceiveTxnOutcome(action)
+		if ev.Aborted || action.frame == nil {
+			delete(rv.actions, *action.Id)
+		}
+
+	case FrameEventPreAbort:
+		action, found := rv.actions[*ev.TxnId]
+		if !found || action.frame == nil {
+			return fmt.Errorf("%v: txn not replayed onto a frame", ev)
+		}
+		action.preAbortedBool = true
+		v.txnPreAborted(action)
+		delete(rv.actions, *action.Id)
+
+	case FrameEventComplete:
+		action, found := rv.actions[*ev.TxnId]
+		if !found || action.frame == nil {
+			return fmt.Errorf("%v: txn not replayed onto a frame", ev)
+		}
+		v.TxnGloballyComplete(action)
+		delete(rv.actions, *action.Id)
+
+	case FrameEventRoll:
+	default:
+		return fmt.Errorf("%v: unexpected event", ev)
+	}
+	return fr.check(v, ev, "left in")
+}
+
+func (fr *FrameReplayer) load(ev *FrameEvent) {
+	v := newVar(ev.VarUUId, fr.vm.exe, nil, fr.vm)
+	if len(ev.Positions) != 0 {
+		v.positions = replayPositions(ev.Positions)
+	}
+	var actions *TxnActions
+	if len(ev.Txn) != 0 {
+		actions = TxnActionsFromData(ev.Txn, true)
+	}
+	v.curFrame = NewFrame(nil, v, ev.TxnId, actions,
+		VectorClockFromData(ev.Clock, true).AsMutable(), VectorClockFromData(ev.Writes, true).AsMutable())
+	v.curFrameOnDisk = v.curFrame
+	seg := capn.NewBuffer(nil)
+	varCap := msgs.NewRootVar(seg)
+	varCap.SetId(v.UUId[:])
+	v.varCap = &varCap
+	fr.vm.active[*v.UUId] = v
+	fr.replayed[*v.UUId] = &replayVar{
+		v:       v,
+		actions: make(map[common.TxnId]*localAction),
+	}
+	fr.vm.frameRecorder.record(FrameEventLoad, v, nil)()
+}
+
+// replayAction creates, from the event's txn, the action for the
+// event's Var.
+func (fr *FrameReplayer) replayAction(ev *FrameEvent, voter bool) (*localAction, error) {
+	if len(ev.Txn) == 0 {
+		return nil, fmt.Errorf("%v: txn not known", ev)
+	}
+	reader := TxnReaderFromData(ev.Txn)
+	exe := fr.inert.Executors[0]
+
+	var txn *Txn
+	if len(ev.Writes) != 0 {
+		// an immigrant: see ImmigrationTxnFromCap
+		txn = TxnFromReader(exe, nil, nil, ev.RMId, reader)
+		txnActions := reader.Actions(true)
+		txn.localActions = []localAction{{
+			Txn:             txn,
+			vUUId:           ev.VarUUId,
+			writeTxnActions: txnActions,
+			createPositions: replayPositions(ev.Positions),
+			writesClock:     VectorClockFromData(ev.Writes, false),
+		}}
+		actionsList := txnActions.Actions()
+		for idx, l := 0, actionsList.Len(); idx < l; idx++ {
+			if actionCap := actionsList.At(idx); common.MakeVarUUId(actionCap.VarId()).Compare(ev.VarUUId) == common.EQ {
+				txn.localActions[0].writeAction = &actionCap
+				break
+			}
+		}
+	} else {
+		txn = TxnFromReader(exe, nil, nil, ev.RMId, reader)
+		for idx := range txn.localActions {
+			if txn.localActions[idx].vUUId.Compare(ev.VarUUId) == common.EQ {
+				txn.localActions = txn.localActions[idx : idx+1]
+				break
+			}
+		}
+	}
+	if len(txn.localActions) != 1 || txn.localActions[0].vUUId.Compare(ev.VarUUId) != common.EQ {
+		return nil, fmt.Errorf("%v: txn has no action for var", ev)
+	}
+
+	txn.voter = voter
+	txn.txnDetermineLocalBallots.init(txn)
+	txn.txnAwaitLocalBallots.init(txn)
+	txn.txnReceiveOutcome.init(txn)
+	txn.txnAwaitLocallyComplete.init(txn)
+	txn.txnReceiveCompletion.init(txn)
+	if voter {
+		txn.currentState = &txn.txnAwaitLocalBallots
+	} else {
+		txn.currentState = &txn.txnReceiveOutcome
+	}
+	return &txn.localActions[0], nil
+}
+
+func (fr *FrameReplayer) check(v *Var, ev *FrameEvent, verb string) error {
+	f := v.curFrame
+	clock := VectorClockFromData(ev.FrameClock, true)
+	sameTxnId := (f.frameTxnId == nil && ev.FrameTxnId == nil) ||
+		(f.frameTxnId != nil && ev.FrameTxnId != nil && f.frameTxnId.Compare(ev.FrameTxnId) == common.EQ)
+	if !sameTxnId || !replayClocksEqual(f.frameTxnClock, clock) {
+		return fmt.Errorf("%v: replayed var %v frame %v %v", ev, verb, f.frameTxnId, f.frameTxnClock)
+	}
+	return nil
+}
+
+func replayClocksEqual(a, b VectorClockInterface) bool {
+	return a.Len() == b.Len() && a.ForEach(func(vUUId *common.VarUUId, v uint64) bool {
+		return b.At(vUUId) == v
+	})
+}
+
+func replayPositions(positions []byte) *common.Positions {
+	seg := capn.NewBuffer(nil)
+	list := seg.NewUInt8List(len(positions))
+	for idx, p := range positions {
+		list.Set(idx, p)
+	}
+	result := common.Positions(list)
+	return &result
+}
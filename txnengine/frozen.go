@@ -0,0 +1,173 @@
+package txnengine
+
+import (
+	"bytes"
+	"fmt"
+	capn "github.com/glycerine/go-capnproto"
+	"goshawkdb.io/common"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"sync"
+)
+
+// A write (or readwrite or create) action with its frozen flag set
+// freezes the var it writes: once the txn commits, the var's value
+// and references can never change again. The frame of a frozen var
+// votes AbortBadRead for every write, except for the var's own rolls,
+// which copy the value verbatim and carry the frozen flag on.
+//
+// Because a frozen var never changes, any copy of it is as good as
+// the original. So every node keeps a cache of the frozen vars it
+// learns of, from which reads can be answered locally without
+// consensus. Nodes holding a var gossip it to every other node when
+// it is frozen; other nodes also learn of frozen vars lazily, from
+// the outcomes of reads that did go through consensus.
+type FrozenVars struct {
+	sync.RWMutex
+	vars    map[common.VarUUId]*LocalRead
+	gossip  func(*common.VarUUId, *LocalRead)
+	learnt  uint64
+	evicted uint64
+	hits    uint64
+}
+
+func NewFrozenVars() *FrozenVars {
+	return &FrozenVars{
+		vars: make(map[common.VarUUId]*LocalRead),
+	}
+}
+
+// SetGossip sets the function called when a var held by this node is
+// frozen.
+func (fv *FrozenVars) SetGossip(gossip func(*common.VarUUId, *LocalRead)) {
+	fv.Lock()
+	defer fv.Unlock()
+	fv.gossip = gossip
+}
+
+// Get returns the frozen state of the var, or nil if this node
+// doesn't know the var to be frozen.
+func (fv *FrozenVars) Get(vUUId *common.VarUUId) *LocalRead {
+	fv.Lock()
+	defer fv.Unlock()
+	lr, found := fv.vars[*vUUId]
+	if found {
+		fv.hits++
+	}
+	return lr
+}
+
+func (fv *FrozenVars) Learn(vUUId *common.VarUUId, lr *LocalRead) {
+	if lr == nil || !lr.Frozen {
+		return
+	}
+	fv.Lock()
+	defer fv.Unlock()
+	fv.learn(vUUId, lr)
+}
+
+func (fv *FrozenVars) learn(vUUId *common.VarUUId, lr *LocalRead) {
+	if _, found := fv.vars[*vUUId]; found {
+		return
+	}
+	if len(fv.vars) >= server.FrozenVarsCacheLimit {
+		// Anything evicted can be learnt again from a quorum read.
+		for k := range fv.vars {
+			delete(fv.vars, k)
+			fv.evicted++
+			break
+		}
+	}
+	fv.vars[*vUUId] = lr
+	fv.learnt++
+}
+
+// LearnFromUpdates learns any frozen vars written by updates: for
+// example the updates carried by the outcome of a read, or received
+// by gossip.
+func (fv *FrozenVars) LearnFromUpdates(updates *msgs.Update_List) {
+	for idx, l := 0, updates.Len(); idx < l; idx++ {
+		update := updates.At(idx)
+		actions := TxnActionsFromData(update.Actions(), true).Actions()
+		for idy, m := 0, actions.Len(); idy < m; idy++ {
+			action := actions.At(idy)
+			if action.Which() != msgs.ACTION_WRITE || !action.Frozen() {
+				continue
+			}
+			write := action.Write()
+			fv.Learn(common.MakeVarUUId(action.VarId()), &LocalRead{
+				Version:    common.MakeTxnId(update.TxnId()),
+				Value:      ActionValue(&action, write.Value()),
+				References: write.References().ToArray(),
+				Clock:      VectorClockFromData(update.Clock(), true).AsMutable(),
+				Frozen:     true,
+			})
+		}
+	}
+}
+
+// frozenLocally is called on the var's executor when a var held by
+// this node is frozen.
+func (fv *FrozenVars) frozenLocally(vUUId *common.VarUUId, lr *LocalRead) {
+	if lr == nil {
+		return
+	}
+	fv.Lock()
+	fv.learn(vUUId, lr)
+	gossip := fv.gossip
+	fv.Unlock()
+	if gossip != nil {
+		gossip(vUUId, lr)
+	}
+}
+
+func (fv *FrozenVars) Status(sc *server.StatusConsumer) {
+	fv.RLock()
+	defer fv.RUnlock()
+	sc.Emit(fmt.Sprintf("Frozen vars: %v cached; %v learnt; %v evicted; %v local reads", len(fv.vars), fv.learnt, fv.evicted, fv.hits))
+	sc.Join()
+}
+
+// SetUpdate fills in update with the frozen state of the var, as a
+// write action.
+func (lr *LocalRead) SetUpdate(vUUId *common.VarUUId, update msgs.Update) {
+	seg := capn.NewBuffer(nil)
+	wrapper := msgs.NewRootActionListWrapper(seg)
+	actions := msgs.NewActionList(seg, 1)
+	wrapper.SetActions(actions)
+	action := actions.At(0)
+	action.SetVarId(vUUId[:])
+	action.SetWrite()
+	write := action.Write()
+	write.SetValue(lr.Value)
+	refs := msgs.NewVarIdPosList(seg, len(lr.References))
+	for idx, ref := range lr.References {
+		refs.Set(idx, ref)
+	}
+	write.SetReferences(refs)
+	action.SetFrozen(lr.Frozen)
+	update.SetTxnId(lr.Version[:])
+	update.SetActions(server.SegToBytes(seg))
+	update.SetClock(lr.Clock.AsData())
+}
+
+// frameActionFrozen returns true iff the action of the frame txn on
+// the var froze it.
+func frameActionFrozen(vUUId *common.VarUUId, txnActions *TxnActions) bool {
+	if txnActions == nil {
+		return false
+	}
+	actions := txnActions.Actions()
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		if action := actions.At(idx); bytes.Equal(action.VarId(), vUUId[:]) {
+			return action.Frozen()
+		}
+	}
+	return false
+}
+
+// permittedOnFrozen returns true iff the action may write a frozen
+// var: only the var's own rolls may.
+func (action *localAction) permittedOnFrozen() bool {
+	return action.roll && action.writeAction.Frozen()
+}
@@ -0,0 +1,135 @@
+package txnengine
+
+import (
+	capn "github.com/glycerine/go-capnproto"
+	mdbs "github.com/msackman/gomdb/server"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/server/capnp"
+	"goshawkdb.io/server/db"
+	"sort"
+	"sync"
+)
+
+// hotVars records which vars a VarManager has used most recently.
+// Every use is stamped with the next tick; once twice limit vars are
+// recorded, all but the limit most recent are forgotten, so each use
+// costs amortised constant time.
+type hotVars struct {
+	limit int
+	tick  uint64
+	ticks map[common.VarUUId]uint64
+}
+
+func (hv *hotVars) touch(vUUId *common.VarUUId) {
+	if hv.limit == 0 {
+		return
+	}
+	hv.tick++
+	hv.ticks[*vUUId] = hv.tick
+	if len(hv.ticks) >= 2*hv.limit {
+		for _, h := range hv.hottest(len(hv.ticks))[hv.limit:] {
+			delete(hv.ticks, *h.vUUId)
+		}
+	}
+}
+
+// hottest returns at most limit vars, most recently used first.
+func (hv *hotVars) hottest(limit int) []hotVar {
+	hvs := make([]hotVar, 0, len(hv.ticks))
+	for vUUId, tick := range hv.ticks {
+		vUUIdCopy := vUUId
+		hvs = append(hvs, hotVar{vUUId: &vUUIdCopy, tick: tick})
+	}
+	sort.Sort(hotVarsByTick(hvs))
+	if len(hvs) > limit {
+		hvs = hvs[:limit]
+	}
+	return hvs
+}
+
+type hotVar struct {
+	vUUId *common.VarUUId
+	tick  uint64
+}
+
+type hotVarsByTick []hotVar
+
+func (s hotVarsByTick) Len() int           { return len(s) }
+func (s hotVarsByTick) Less(i, j int) bool { return s[i].tick > s[j].tick }
+func (s hotVarsByTick) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// TrackHotVars makes every VarManager record the limit vars it has
+// used most recently (or, with 0, stop recording).
+func (vd *VarDispatcher) TrackHotVars(limit int) {
+	perManager := (limit + int(vd.ExecutorCount) - 1) / int(vd.ExecutorCount)
+	for idx, executor := range vd.Executors {
+		manager := vd.varmanagers[idx]
+		executor.Enqueue(func() {
+			manager.hot.limit = perManager
+			if perManager == 0 {
+				manager.hot.ticks = nil
+			} else if manager.hot.ticks == nil {
+				manager.hot.ticks = make(map[common.VarUUId]uint64)
+			}
+		})
+	}
+}
+
+// HotVars returns the vars most recently used by the VarManagers: an
+// equal share of limit from each, most recently used first. It waits
+// for each VarManager's executor in turn.
+func (vd *VarDispatcher) HotVars(limit int) []*common.VarUUId {
+	perManager := (limit + int(vd.ExecutorCount) - 1) / int(vd.ExecutorCount)
+	var (
+		lock   sync.Mutex
+		wg     sync.WaitGroup
+		result []*common.VarUUId
+	)
+	for idx, executor := range vd.Executors {
+		manager := vd.varmanagers[idx]
+		wg.Add(1)
+		enqueued := executor.Enqueue(func() {
+			hvs := manager.hot.hottest(perManager)
+			lock.Lock()
+			for _, h := range hvs {
+				result = append(result, h.vUUId)
+			}
+			lock.Unlock()
+			wg.Done()
+		})
+		if !enqueued {
+			wg.Done()
+		}
+	}
+	wg.Wait()
+	return result
+}
+
+// WarmVars reads the records of the vars, and the txns of their
+// current frames, from disk, without loading the vars. Idle vars are
+// not kept in memory, so this is not to fill a cache of ours: it
+// brings the pages which hold them into the OS page cache, so that
+// loading them soon after restarting does not wait for the disk.
+// Returns the number of vars found.
+func WarmVars(db *db.Databases, vUUIds []*common.VarUUId) (int, error) {
+	result, err := db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
+		found := 0
+		for _, vUUId := range vUUIds {
+			bites, err := rtxn.Get(db.Vars, vUUId[:])
+			if err != nil {
+				continue
+			}
+			found++
+			if seg, _, err := capn.ReadFromMemoryZeroCopy(bites); err == nil {
+				if txnId := msgs.ReadRootVar(seg).WriteTxnId(); len(txnId) == common.KeyLen {
+					db.ReadTxnBytesFromDisk(rtxn, common.MakeTxnId(txnId))
+				}
+			}
+		}
+		return found
+	}).ResultError()
+	if err != nil || result == nil {
+		return 0, err
+	}
+	return result.(int), nil
+}
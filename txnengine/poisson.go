@@ -7,20 +7,22 @@ import (
 )
 
 type Poisson struct {
+	clock  server.Clock
 	events []time.Time
 	front  int
 	back   int
 	length int
 }
 
-func NewPoisson() *Poisson {
+func NewPoisson(clock server.Clock) *Poisson {
 	return &Poisson{
+		clock:  clock,
 		events: make([]time.Time, server.PoissonSamples),
 	}
 }
 
 func (p *Poisson) AddNow() {
-	p.AddThen(time.Now())
+	p.AddThen(p.clock.Now())
 }
 
 func (p *Poisson) AddThen(now time.Time) {
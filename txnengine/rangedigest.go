@@ -0,0 +1,75 @@
+package txnengine
+
+import (
+	"goshawkdb.io/common"
+	"hash/fnv"
+	"sync"
+)
+
+// A RangeDigest summarises the commits to the vars held by this node
+// whose first position is Prefix. Digest is the XOR of a hash of each
+// (var, txn) write, so it is independent of the order in which the
+// VarManagers observed the commits. A client cache can hold on to the
+// digests it last saw and only re-read vars in ranges whose digests
+// have changed. Digests are not persisted, so they change whenever
+// the node restarts, which is safe (if wasteful) for such caches.
+type RangeDigest struct {
+	Prefix  uint8
+	Commits uint64
+	Digest  uint64
+}
+
+const rangeDigestCount = 256
+
+func rangeDigestPrefix(v *Var) uint8 {
+	if v.positions != nil && len(*v.positions) != 0 {
+		return (*v.positions)[0]
+	}
+	return 0
+}
+
+func (vm *VarManager) recordCommit(v *Var, txnId *common.TxnId) {
+	if vm.rangeDigests == nil {
+		vm.rangeDigests = make([]RangeDigest, rangeDigestCount)
+	}
+	hash := fnv.New64a()
+	hash.Write(v.UUId[:])
+	hash.Write(txnId[:])
+	rd := &vm.rangeDigests[rangeDigestPrefix(v)]
+	rd.Commits++
+	rd.Digest ^= hash.Sum64()
+}
+
+// RangeDigests combines the digests from every VarManager, returning
+// only ranges which have seen commits.
+func (vd *VarDispatcher) RangeDigests() []RangeDigest {
+	combined := make([]RangeDigest, rangeDigestCount)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for idx, executor := range vd.Executors {
+		manager := vd.varmanagers[idx]
+		wg.Add(1)
+		enqueued := executor.Offer(func() {
+			defer wg.Done()
+			lock.Lock()
+			defer lock.Unlock()
+			for idy, rd := range manager.rangeDigests {
+				combined[idy].Commits += rd.Commits
+				combined[idy].Digest ^= rd.Digest
+			}
+		})
+		if !enqueued {
+			wg.Done()
+		}
+	}
+	wg.Wait()
+
+	result := []RangeDigest{}
+	for idx, rd := range combined {
+		if rd.Commits != 0 {
+			rd.Prefix = uint8(idx)
+			result = append(result, rd)
+		}
+	}
+	return result
+}
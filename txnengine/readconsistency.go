@@ -0,0 +1,118 @@
+package txnengine
+
+import (
+	"bytes"
+	"fmt"
+	"goshawkdb.io/common"
+	msgs "goshawkdb.io/server/capnp"
+	"strings"
+)
+
+// ReadConsistency is the consistency a client asks for when reading
+// vars. ReadQuorum reads go through consensus, and so always observe
+// the latest committed state. ReadLocal reads are served from the
+// current frame of the var held by the node the client is connected
+// to, without consensus: they are fast, but may be stale, and are
+// only possible when that node holds a copy of the var. Where they
+// are not possible, the read falls back to ReadQuorum. Only the REST
+// gateway can ask for ReadLocal: the client schema has no way to
+// carry it.
+type ReadConsistency uint8
+
+const (
+	ReadQuorum ReadConsistency = iota
+	ReadLocal  ReadConsistency = iota
+)
+
+func (rc ReadConsistency) String() string {
+	switch rc {
+	case ReadQuorum:
+		return "quorum"
+	case ReadLocal:
+		return "local"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(rc))
+	}
+}
+
+func ParseReadConsistency(str string) (ReadConsistency, error) {
+	switch strings.ToLower(str) {
+	case "", "quorum", "leader":
+		return ReadQuorum, nil
+	case "local":
+		return ReadLocal, nil
+	default:
+		return ReadQuorum, fmt.Errorf("Unknown read consistency: %v", str)
+	}
+}
+
+// LocalRead is the state of a var as held by this node. If Frozen,
+// the state can never change (see FrozenVars).
+type LocalRead struct {
+	Version    *common.TxnId
+	Value      []byte
+	References []msgs.VarIdPos
+	Clock      *VectorClockMutable
+	Frozen     bool
+}
+
+// LocalRead returns the state of the var from its current frame on
+// this node, or nil if this node does not hold the var or it has
+// never been written. Frozen vars are answered from FrozenVars,
+// whether or not this node holds them.
+func (vd *VarDispatcher) LocalRead(vUUId *common.VarUUId) *LocalRead {
+	if lr := vd.Frozen.Get(vUUId); lr != nil {
+		return lr
+	}
+	resultChan := make(chan *LocalRead, 1)
+	enqueued := vd.withVarManager(vUUId, func(vm *VarManager) {
+		vm.ApplyToVar(func(v *Var) {
+			if v == nil {
+				resultChan <- nil
+			} else {
+				resultChan <- v.localRead()
+				v.maybeMakeInactive()
+			}
+		}, false, vUUId)
+	})
+	if !enqueued {
+		return nil
+	}
+	return <-resultChan
+}
+
+func (v *Var) localRead() *LocalRead {
+	f := v.curFrame
+	if f == nil || f.frameTxnId == nil || f.frameTxnActions == nil {
+		return nil
+	}
+	actions := f.frameTxnActions.Actions()
+	for idx, l := 0, actions.Len(); idx < l; idx++ {
+		action := actions.At(idx)
+		if !bytes.Equal(action.VarId(), v.UUId[:]) {
+			continue
+		}
+		var value []byte
+		var refs msgs.VarIdPos_List
+		switch action.Which() {
+		case msgs.ACTION_WRITE:
+			value, refs = action.Write().Value(), action.Write().References()
+		case msgs.ACTION_READWRITE:
+			value, refs = action.Readwrite().Value(), action.Readwrite().References()
+		case msgs.ACTION_CREATE:
+			value, refs = action.Create().Value(), action.Create().References()
+		case msgs.ACTION_ROLL:
+			value, refs = action.Roll().Value(), action.Roll().References()
+		default:
+			continue
+		}
+		return &LocalRead{
+			Version:    f.frameTxnId,
+			Value:      ActionValue(&action, value),
+			References: refs.ToArray(),
+			Clock:      f.frameTxnClock.Clone(),
+			Frozen:     f.frozen,
+		}
+	}
+	return nil
+}
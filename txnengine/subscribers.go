@@ -0,0 +1,47 @@
+package txnengine
+
+import (
+	"bytes"
+	"goshawkdb.io/common"
+	"sort"
+)
+
+// Subscribers returns the TxnIds of the txns subscribed to writes of
+// the var on this node, in order. These are retry txns waiting for
+// the var to change. A var with subscribers is always active, so if
+// the var is not active, or this node does not hold it, the result
+// is empty. The result is nil only if the var's manager is shutting
+// down.
+func (vd *VarDispatcher) Subscribers(vUUId *common.VarUUId) []*common.TxnId {
+	resultChan := make(chan []*common.TxnId, 1)
+	enqueued := vd.withVarManager(vUUId, func(vm *VarManager) {
+		vm.ApplyToVar(func(v *Var) {
+			if v == nil {
+				resultChan <- []*common.TxnId{}
+			} else {
+				resultChan <- v.subscriberTxnIds()
+				v.maybeMakeInactive()
+			}
+		}, false, vUUId)
+	})
+	if !enqueued {
+		return nil
+	}
+	return <-resultChan
+}
+
+func (v *Var) subscriberTxnIds() []*common.TxnId {
+	txnIds := make([]*common.TxnId, 0, len(v.subscribers))
+	for txnId := range v.subscribers {
+		txnIdCopy := txnId
+		txnIds = append(txnIds, &txnIdCopy)
+	}
+	sort.Sort(txnIdsByBytes(txnIds))
+	return txnIds
+}
+
+type txnIdsByBytes []*common.TxnId
+
+func (s txnIdsByBytes) Len() int           { return len(s) }
+func (s txnIdsByBytes) Less(i, j int) bool { return bytes.Compare(s[i][:], s[j][:]) < 0 }
+func (s txnIdsByBytes) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
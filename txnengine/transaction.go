@@ -443,14 +443,7 @@ func (talb *txnAwaitLocalBallots) preAbort() {
 					if action.frame.v != v {
 						panic(fmt.Sprintf("%v error (%v): %v has gone idle in the meantime somehow!", talb.Id, talb, action.vUUId))
 					}
-					switch {
-					case action.IsRead() && action.IsWrite():
-						action.frame.ReadWriteAborted(action, true)
-					case action.IsRead():
-						action.frame.ReadAborted(action)
-					default:
-						action.frame.WriteAborted(action, true)
-					}
+					v.txnPreAborted(action)
 				}
 			}
 			talb.vd.ApplyToVar(f, false, action.vUUId)
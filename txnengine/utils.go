@@ -84,6 +84,8 @@ func (tr *TxnReader) AsDeflated() *TxnReader {
 		root.SetAllocations(cap.Allocations())
 		root.SetFInc(cap.FInc())
 		root.SetTopologyVersion(cap.TopologyVersion())
+		root.SetAcceptors(cap.Acceptors())
+		root.SetTraceId(cap.TraceId())
 
 		tr.deflated = &TxnReader{
 			Id:      tr.Id,
@@ -0,0 +1,112 @@
+package txnengine
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"goshawkdb.io/server"
+	msgs "goshawkdb.io/server/capnp"
+	"io/ioutil"
+	"strings"
+)
+
+// Var values can be compressed transparently. A value is compressed
+// once, when it enters the cluster (from a client or the REST
+// gateway), and is then carried compressed in txn payloads, on disk
+// and in migration batches. It is only decompressed when handed back
+// out to a client or subscriber. The codec used is recorded in the
+// Action, so nodes always know how to decompress regardless of their
+// own settings. Older nodes ignore the codec field, so values are
+// only compressed once every node in the cluster supports
+// server.FeatureValueCompression.
+type ValueCodec uint8
+
+const (
+	ValueCodecNone    ValueCodec = iota
+	ValueCodecDeflate ValueCodec = iota
+)
+
+var valueCodecNames = map[ValueCodec]string{
+	ValueCodecNone:    "none",
+	ValueCodecDeflate: "deflate",
+}
+
+func (vc ValueCodec) String() string {
+	if name, found := valueCodecNames[vc]; found {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(vc))
+}
+
+func ParseValueCodec(name string) (ValueCodec, error) {
+	for vc, vcName := range valueCodecNames {
+		if strings.EqualFold(name, vcName) {
+			return vc, nil
+		}
+	}
+	return ValueCodecNone, fmt.Errorf("Unknown value codec: %v", name)
+}
+
+// ValueCompression configures which values are compressed: values
+// shorter than MinSize are left alone, as are values which do not
+// shrink when compressed.
+type ValueCompression struct {
+	Codec   ValueCodec
+	MinSize int
+}
+
+var valueCompression = ValueCompression{Codec: ValueCodecNone}
+
+// SetValueCompression must be called before any txns are processed.
+func SetValueCompression(vc ValueCompression) {
+	valueCompression = vc
+}
+
+func CurrentValueCompression() ValueCompression {
+	return valueCompression
+}
+
+func (vc ValueCompression) String() string {
+	if vc.Codec == ValueCodecNone {
+		return "none"
+	}
+	return fmt.Sprintf("%v (values of at least %v bytes)", vc.Codec, vc.MinSize)
+}
+
+// CompressActionValue compresses value according to the current
+// settings, records the codec used in action, and returns the value
+// to be stored in action.
+func CompressActionValue(action *msgs.Action, value []byte) []byte {
+	codec := ValueCodecNone
+	if valueCompression.Codec == ValueCodecDeflate && len(value) >= valueCompression.MinSize && len(value) != 0 &&
+		server.FeatureEnabled(server.FeatureValueCompression) {
+		buf := new(bytes.Buffer)
+		if w, err := flate.NewWriter(buf, flate.DefaultCompression); err == nil {
+			if _, err = w.Write(value); err == nil && w.Close() == nil && buf.Len() < len(value) {
+				codec, value = ValueCodecDeflate, buf.Bytes()
+			}
+		}
+	}
+	action.SetValueCodec(uint8(codec))
+	return value
+}
+
+// ActionValue returns the decompressed form of value, which must have
+// come from action. A value which fails to decompress means the txn
+// is corrupt, which we can do nothing about.
+func ActionValue(action *msgs.Action, value []byte) []byte {
+	switch codec := ValueCodec(action.ValueCodec()); codec {
+	case ValueCodecNone:
+		return value
+	case ValueCodecDeflate:
+		r := flate.NewReader(bytes.NewReader(value))
+		defer r.Close()
+		decompressed, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(fmt.Sprintf("Unable to decompress value of %v: %v", action.VarId(), err))
+		}
+		return decompressed
+	default:
+		panic(fmt.Sprintf("Unknown value codec %v for %v", codec, action.VarId()))
+	}
+}
@@ -34,11 +34,29 @@ type Var struct {
 }
 
 func VarFromData(data []byte, exe *dispatcher.Executor, db *db.Databases, vm *VarManager) (*Var, error) {
-	seg, _, err := capn.ReadFromMemoryZeroCopy(data)
+	var (
+		varCap                     msgs.Var
+		writeTxnClock, writesClock *VectorClock
+	)
+	err := Decode("var", func() error {
+		seg, _, err := capn.ReadFromMemoryZeroCopy(data)
+		if err != nil {
+			return err
+		}
+		varCap = msgs.ReadRootVar(seg)
+		if err = checkKeyLen("VarUUId", varCap.Id()); err != nil {
+			return err
+		} else if err = checkKeyLen("TxnId", varCap.WriteTxnId()); err != nil {
+			return err
+		} else if writeTxnClock, err = DecodeVectorClock(varCap.WriteTxnClock()); err != nil {
+			return err
+		}
+		writesClock, err = DecodeVectorClock(varCap.WritesClock())
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	varCap := msgs.ReadRootVar(seg)
 
 	v := newVar(common.MakeVarUUId(varCap.Id()), exe, db, vm)
 	positions := varCap.Positions()
@@ -47,17 +65,22 @@ func VarFromData(data []byte, exe *dispatcher.Executor, db *db.Databases, vm *Va
 	}
 
 	writeTxnId := common.MakeTxnId(varCap.WriteTxnId())
-	writeTxnClock := VectorClockFromData(varCap.WriteTxnClock(), true).AsMutable()
-	writesClock := VectorClockFromData(varCap.WritesClock(), true).AsMutable()
 	server.Log(v.UUId, "Restored", writeTxnId)
 
 	if result, err := db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
 		return db.ReadTxnBytesFromDisk(rtxn, writeTxnId)
 	}).ResultError(); err == nil && result != nil {
-		txn := TxnReaderFromData(result.([]byte))
-		v.curFrame = NewFrame(nil, v, writeTxnId, txn.Actions(false), writeTxnClock, writesClock)
+		txn, err := DecodeTxnReader(result.([]byte))
+		if err != nil {
+			return nil, err
+		}
+		v.curFrame = NewFrame(nil, v, writeTxnId, txn.Actions(false), writeTxnClock.AsMutable(), writesClock.AsMutable())
 		v.curFrameOnDisk = v.curFrame
 		v.varCap = &varCap
+		if v.curFrame.frozen {
+			vm.frozen.Learn(v.UUId, v.localRead())
+		}
+		vm.frameRecorder.record(FrameEventLoad, v, nil)()
 		return v, nil
 	} else {
 		return nil, err
@@ -76,6 +99,7 @@ func NewVar(uuid *common.VarUUId, exe *dispatcher.Executor, db *db.Databases, vm
 	varCap.SetId(v.UUId[:])
 	v.varCap = &varCap
 
+	vm.frameRecorder.record(FrameEventLoad, v, nil)()
 	return v
 }
 
@@ -84,7 +108,7 @@ func newVar(uuid *common.VarUUId, exe *dispatcher.Executor, db *db.Databases, vm
 	return &Var{
 		UUId:            uuid,
 		positions:       nil,
-		poisson:         NewPoisson(),
+		poisson:         NewPoisson(vm.Clock),
 		curFrame:        nil,
 		curFrameOnDisk:  nil,
 		writeInProgress: nil,
@@ -107,6 +131,7 @@ func (v *Var) RemoveWriteSubscriber(txnId *common.TxnId) {
 
 func (v *Var) ReceiveTxn(action *localAction) {
 	server.Log(v.UUId, "ReceiveTxn", action)
+	defer v.vm.frameRecorder.record(FrameEventTxn, v, action)()
 	isRead, isWrite := action.IsRead(), action.IsWrite()
 
 	if isRead && action.Retry {
@@ -139,6 +164,7 @@ func (v *Var) ReceiveTxn(action *localAction) {
 
 func (v *Var) ReceiveTxnOutcome(action *localAction) {
 	server.Log(v.UUId, "ReceiveTxnOutcome", action)
+	defer v.vm.frameRecorder.record(FrameEventOutcome, v, action)()
 	isRead, isWrite := action.IsRead(), action.IsWrite()
 
 	switch {
@@ -177,6 +203,21 @@ func (v *Var) ReceiveTxnOutcome(action *localAction) {
 	}
 }
 
+// txnPreAborted is called when the txn of an action which has been
+// added to a frame aborts before its outcome is known.
+func (v *Var) txnPreAborted(action *localAction) {
+	server.Log(v.UUId, "TxnPreAborted", action)
+	defer v.vm.frameRecorder.record(FrameEventPreAbort, v, action)()
+	switch {
+	case action.IsRead() && action.IsWrite():
+		action.frame.ReadWriteAborted(action, true)
+	case action.IsRead():
+		action.frame.ReadAborted(action)
+	default:
+		action.frame.WriteAborted(action, true)
+	}
+}
+
 func (v *Var) SetCurFrame(f *frame, action *localAction, positions *common.Positions) {
 	server.Log(v.UUId, "SetCurFrame", action)
 	v.curFrame = f
@@ -185,6 +226,14 @@ func (v *Var) SetCurFrame(f *frame, action *localAction, positions *common.Posit
 		v.positions = positions
 	}
 
+	if action.writeAction.Which() != msgs.ACTION_ROLL {
+		v.vm.recordCommit(v, f.frameTxnId)
+		v.vm.commits.committed(v.UUId, f.frameTxnId)
+		if f.frozen {
+			v.vm.frozen.frozenLocally(v.UUId, v.localRead())
+		}
+	}
+
 	if len(v.subscribers) != 0 {
 		actionCap := action.writeAction
 		var (
@@ -194,15 +243,15 @@ func (v *Var) SetCurFrame(f *frame, action *localAction, positions *common.Posit
 		switch actionCap.Which() {
 		case msgs.ACTION_WRITE:
 			write := actionCap.Write()
-			value = write.Value()
+			value = ActionValue(actionCap, write.Value())
 			references = write.References()
 		case msgs.ACTION_READWRITE:
 			rw := actionCap.Readwrite()
-			value = rw.Value()
+			value = ActionValue(actionCap, rw.Value())
 			references = rw.References()
 		case msgs.ACTION_CREATE:
 			create := actionCap.Create()
-			value = create.Value()
+			value = ActionValue(actionCap, create.Value())
 			references = create.References()
 		case msgs.ACTION_ROLL: // deliberately do nothing
 		default:
@@ -250,6 +299,13 @@ func (v *Var) maybeWriteFrame(f *frame, action *localAction, positions *common.P
 	varCap.SetWritesClock(f.frameWritesClock.AsData())
 	varData := server.SegToBytes(varSeg)
 
+	if v.db == nil {
+		// Replaying a frame log (see FrameReplayer): there's no disk,
+		// so the write is done as soon as the executor gets to it.
+		v.applyToVar(func() { v.frameWritten(f) })
+		return
+	}
+
 	txnBytes := action.TxnReader.Data
 
 	// to ensure correct order of writes, schedule the write from
@@ -270,19 +326,22 @@ func (v *Var) maybeWriteFrame(f *frame, action *localAction, positions *common.P
 			panic(fmt.Sprintf("Var error when writing to disk: %v\n", err))
 		} else if ran != nil {
 			// Switch back to the right go-routine
-			v.applyToVar(func() {
-				server.Log(v.UUId, "Wrote", f.frameTxnId)
-				v.curFrameOnDisk = f
-				for ancestor := f.parent; ancestor != nil && ancestor.DescendentOnDisk(); ancestor = ancestor.parent {
-				}
-				v.writeInProgress()
-			})
+			v.applyToVar(func() { v.frameWritten(f) })
 		}
 	}()
 }
 
+func (v *Var) frameWritten(f *frame) {
+	server.Log(v.UUId, "Wrote", f.frameTxnId)
+	v.curFrameOnDisk = f
+	for ancestor := f.parent; ancestor != nil && ancestor.DescendentOnDisk(); ancestor = ancestor.parent {
+	}
+	v.writeInProgress()
+}
+
 func (v *Var) TxnGloballyComplete(action *localAction) {
 	server.Log(v.UUId, "Txn globally complete", action)
+	defer v.vm.frameRecorder.record(FrameEventComplete, v, action)()
 	if action.frame.v != v {
 		panic(fmt.Sprintf("%v frame var has changed %p -> %p (%v)", v.UUId, action.frame.v, v, action))
 	}
@@ -340,6 +399,7 @@ func (v *Var) Status(sc *server.StatusConsumer) {
 	}
 	sc.Emit("- CurFrame:")
 	v.curFrame.Status(sc.Fork())
+	sc.Emit(fmt.Sprintf("- Frozen? %v", v.curFrame.frozen))
 	sc.Emit(fmt.Sprintf("- Subscribers: %v", len(v.subscribers)))
 	sc.Emit(fmt.Sprintf("- Idle? %v", v.isIdle()))
 	sc.Emit(fmt.Sprintf("- IsOnDisk? %v", v.isOnDisk(false)))
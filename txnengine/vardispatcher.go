@@ -9,6 +9,8 @@ import (
 	"goshawkdb.io/server/configuration"
 	"goshawkdb.io/server/db"
 	"goshawkdb.io/server/dispatcher"
+	"sync"
+	"sync/atomic"
 )
 
 type TopologyPublisher interface {
@@ -35,15 +37,19 @@ const (
 type VarDispatcher struct {
 	dispatcher.Dispatcher
 	varmanagers []*VarManager
+	Frozen      *FrozenVars
+	Commits     *VarCommits
 }
 
-func NewVarDispatcher(count uint8, rmId common.RMId, cm TopologyPublisher, db *db.Databases, lc LocalConnection) *VarDispatcher {
+func NewVarDispatcher(count uint8, rmId common.RMId, cm TopologyPublisher, db *db.Databases, lc LocalConnection, clock server.Clock) *VarDispatcher {
 	vd := &VarDispatcher{
 		varmanagers: make([]*VarManager, count),
+		Frozen:      NewFrozenVars(),
+		Commits:     NewVarCommits(),
 	}
-	vd.Dispatcher.Init(count)
+	vd.Dispatcher.Init("VarDispatcher", count)
 	for idx, exe := range vd.Executors {
-		vd.varmanagers[idx] = NewVarManager(exe, rmId, cm, db, lc)
+		vd.varmanagers[idx] = NewVarManager(exe, rmId, cm, db, lc, vd.Frozen, vd.Commits, clock)
 	}
 	return vd
 }
@@ -52,8 +58,66 @@ func (vd *VarDispatcher) ApplyToVar(fun func(*Var), createIfMissing bool, vUUId
 	vd.withVarManager(vUUId, func(vm *VarManager) { vm.ApplyToVar(fun, createIfMissing, vUUId) })
 }
 
+// ActiveVarCount returns the number of vars loaded by the idx'th
+// VarManager. It must only be called from that VarManager's executor.
+func (vd *VarDispatcher) ActiveVarCount(idx int) int {
+	return len(vd.varmanagers[idx].active)
+}
+
+// ResidentVarCount returns the number of vars loaded by all the
+// VarManagers. It waits for each VarManager's executor in turn.
+func (vd *VarDispatcher) ResidentVarCount() int {
+	var wg sync.WaitGroup
+	count := int64(0)
+	for idx, executor := range vd.Executors {
+		manager := vd.varmanagers[idx]
+		wg.Add(1)
+		if !executor.Enqueue(func() {
+			atomic.AddInt64(&count, int64(len(manager.active)))
+			wg.Done()
+		}) {
+			wg.Done()
+		}
+	}
+	wg.Wait()
+	return int(atomic.LoadInt64(&count))
+}
+
+// RelieveMemoryPressure asks every VarManager to roll read-only
+// frames now, up to limit each, so that their vars can be evicted.
+// Returns the number of rolls started. It waits for each VarManager's
+// executor in turn, but as the work is optional, busy executors may
+// refuse it.
+func (vd *VarDispatcher) RelieveMemoryPressure(limit int) int {
+	var wg sync.WaitGroup
+	count := int64(0)
+	for idx, executor := range vd.Executors {
+		manager := vd.varmanagers[idx]
+		wg.Add(1)
+		if !executor.Offer(func() {
+			atomic.AddInt64(&count, int64(manager.relieveMemoryPressure(limit)))
+			wg.Done()
+		}) {
+			wg.Done()
+		}
+	}
+	wg.Wait()
+	return int(atomic.LoadInt64(&count))
+}
+
+// SetFrameRecorder starts (or, with nil, stops) recording the events
+// which drive the frames of every Var to fr.
+func (vd *VarDispatcher) SetFrameRecorder(fr *FrameRecorder) {
+	for idx, executor := range vd.Executors {
+		manager := vd.varmanagers[idx]
+		executor.Enqueue(func() { manager.frameRecorder = fr })
+	}
+}
+
 func (vd *VarDispatcher) Status(sc *server.StatusConsumer) {
 	sc.Emit("Vars")
+	sc.Emit(fmt.Sprintf("Queue limit: %v", vd.QueueLimit))
+	vd.Frozen.Status(sc.Fork())
 	for idx, executor := range vd.Executors {
 		s := sc.Fork()
 		s.Emit(fmt.Sprintf("Var Manager %v", idx))
@@ -63,11 +127,21 @@ func (vd *VarDispatcher) Status(sc *server.StatusConsumer) {
 	sc.Join()
 }
 
+// PendingFor returns the amount of work waiting for the VarManager
+// of vUUId.
+func (vd *VarDispatcher) PendingFor(vUUId *common.VarUUId) int {
+	return vd.Executors[vd.executorIndex(vUUId)].Pending()
+}
+
+func (vd *VarDispatcher) executorIndex(vUUId *common.VarUUId) uint8 {
+	return uint8(vUUId[server.MostRandomByteIndex]) % vd.ExecutorCount
+}
+
 func (vd *VarDispatcher) withVarManager(vUUId *common.VarUUId, fun func(*VarManager)) bool {
-	idx := uint8(vUUId[server.MostRandomByteIndex]) % vd.ExecutorCount
+	idx := vd.executorIndex(vUUId)
 	executor := vd.Executors[idx]
 	manager := vd.varmanagers[idx]
-	return executor.Enqueue(func() { fun(manager) })
+	return executor.EnqueueFor(vUUId, func() { fun(manager) })
 }
 
 type TranslationCallback func(*cmsgs.ClientAction, *msgs.Action, []common.RMId, map[common.RMId]bool) error
@@ -10,6 +10,7 @@ import (
 	"goshawkdb.io/server/configuration"
 	"goshawkdb.io/server/db"
 	"goshawkdb.io/server/dispatcher"
+	"log"
 	"time"
 )
 
@@ -19,26 +20,37 @@ type VarManager struct {
 	RMId             common.RMId
 	db               *db.Databases
 	active           map[common.VarUUId]*Var
+	quarantined      map[common.VarUUId]error
 	RollAllowed      bool
+	Clock            server.Clock
 	onDisk           func(bool)
 	tw               *tw.TimerWheel
 	beaterTerminator chan struct{}
 	exe              *dispatcher.Executor
+	rangeDigests     []RangeDigest
+	frozen           *FrozenVars
+	commits          *VarCommits
+	frameRecorder    *FrameRecorder
+	hot              hotVars
 }
 
 func init() {
 	db.DB.Vars = &mdbs.DBISettings{Flags: mdb.CREATE}
 }
 
-func NewVarManager(exe *dispatcher.Executor, rmId common.RMId, tp TopologyPublisher, db *db.Databases, lc LocalConnection) *VarManager {
+func NewVarManager(exe *dispatcher.Executor, rmId common.RMId, tp TopologyPublisher, db *db.Databases, lc LocalConnection, frozen *FrozenVars, commits *VarCommits, clock server.Clock) *VarManager {
 	vm := &VarManager{
 		LocalConnection: lc,
 		RMId:            rmId,
 		db:              db,
 		active:          make(map[common.VarUUId]*Var),
+		quarantined:     make(map[common.VarUUId]error),
 		RollAllowed:     false,
-		tw:              tw.NewTimerWheel(time.Now(), 25*time.Millisecond),
+		Clock:           clock,
+		tw:              tw.NewTimerWheel(clock.Now(), 25*time.Millisecond),
 		exe:             exe,
+		frozen:          frozen,
+		commits:         commits,
 	}
 	exe.Enqueue(func() {
 		vm.Topology = tp.AddTopologySubscriber(VarSubscriber, vm)
@@ -93,6 +105,7 @@ func (vm *VarManager) TopologyChanged(topology *configuration.Topology, done fun
 }
 
 func (vm *VarManager) ApplyToVar(fun func(*Var), createIfMissing bool, uuid *common.VarUUId) {
+	vm.hot.touch(uuid)
 	v, shutdown := vm.find(uuid)
 	if shutdown {
 		return
@@ -142,9 +155,19 @@ func (vm *VarManager) SetInactive(v *Var) {
 	}
 }
 
+// find returns the var, loading it from disk if necessary, and
+// whether the var can not be used (because we're shutting down, or
+// the var is quarantined).
+//
+// A var whose record on disk can not be decoded is quarantined: it is
+// left on disk untouched, and never loaded, so txns which involve it
+// never progress. It must not be treated as missing, as that would
+// recreate it, losing its value and history.
 func (vm *VarManager) find(uuid *common.VarUUId) (*Var, bool) {
 	if v, found := vm.active[*uuid]; found {
 		return v, false
+	} else if _, found := vm.quarantined[*uuid]; found {
+		return nil, true
 	}
 
 	result, err := vm.db.ReadonlyTransaction(func(rtxn *mdbs.RTxn) interface{} {
@@ -164,7 +187,9 @@ func (vm *VarManager) find(uuid *common.VarUUId) (*Var, bool) {
 	} else if bites, ok := result.([]byte); ok {
 		v, err := VarFromData(bites, vm.exe, vm.db, vm)
 		if err != nil {
-			panic(fmt.Sprintf("Error when recreating %v: %v", uuid, err))
+			log.Printf("Quarantining %v: %v\n", uuid, err)
+			vm.quarantined[*uuid] = err
+			return nil, true
 		} else if v == nil { // shutdown
 			return v, true
 		} else {
@@ -176,11 +201,33 @@ func (vm *VarManager) find(uuid *common.VarUUId) (*Var, bool) {
 	}
 }
 
+// relieveMemoryPressure rolls up to limit read-only frames now, so
+// that their vars can be evicted sooner. Returns the number of rolls
+// started.
+func (vm *VarManager) relieveMemoryPressure(limit int) int {
+	started := 0
+	for _, v := range vm.active {
+		if started >= limit {
+			break
+		}
+		if v.UUId.Compare(configuration.TopologyVarUUId) != common.EQ && v.curFrame.rollNow() {
+			started++
+		}
+	}
+	return started
+}
+
 func (vm *VarManager) Status(sc *server.StatusConsumer) {
 	sc.Emit(fmt.Sprintf("- Active Vars: %v", len(vm.active)))
+	for vUUId, err := range vm.quarantined {
+		sc.Emit(fmt.Sprintf("- Quarantined: %v: %v", vUUId, err))
+	}
 	sc.Emit(fmt.Sprintf("- Callbacks: %v", vm.tw.Length()))
 	sc.Emit(fmt.Sprintf("- Beater live? %v", vm.beaterTerminator != nil))
 	sc.Emit(fmt.Sprintf("- Roll allowed? %v", vm.RollAllowed))
+	for _, vc := range vm.contention(server.ContentionStatusVars) {
+		sc.Emit(fmt.Sprintf("- Contended: %v", vc))
+	}
 	for _, v := range vm.active {
 		v.Status(sc.Fork())
 	}
@@ -198,7 +245,7 @@ func (vm *VarManager) ScheduleCallback(interval time.Duration, fun tw.Event) {
 }
 
 func (vm *VarManager) beat() {
-	vm.tw.AdvanceTo(time.Now(), 32)
+	vm.tw.AdvanceTo(vm.Clock.Now(), 32)
 	// fmt.Println("done:", )
 	if vm.tw.IsEmpty() && vm.beaterTerminator != nil {
 		close(vm.beaterTerminator)
@@ -214,7 +261,7 @@ func (vm *VarManager) beater(terminate chan struct{}) {
 		case <-terminate:
 			return
 		default:
-			vm.exe.Enqueue(vm.beat)
+			vm.exe.OfferIdempotent(vm.beat)
 		}
 	}
 }
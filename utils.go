@@ -30,7 +30,8 @@ func SegToBytes(seg *capn.Segment) []byte {
 	if seg == nil {
 		log.Fatal("SegToBytes called with nil segment!")
 	}
-	buf := new(bytes.Buffer)
+	// 16 bytes covers the stream header of a single segment message.
+	buf := bytes.NewBuffer(make([]byte, 0, len(seg.Data)+16))
 	if _, err := seg.WriteTo(buf); err != nil {
 		log.Fatal("Error when writing segment to bytes:", err)
 	}
@@ -45,6 +46,7 @@ func (es EmptyStruct) String() string { return "" }
 
 type BinaryBackoffEngine struct {
 	rng    *rand.Rand
+	clock  Clock
 	min    time.Duration
 	max    time.Duration
 	period time.Duration
@@ -52,11 +54,18 @@ type BinaryBackoffEngine struct {
 }
 
 func NewBinaryBackoffEngine(rng *rand.Rand, min, max time.Duration) *BinaryBackoffEngine {
+	return NewBinaryBackoffEngineWithClock(rng, RealClock, min, max)
+}
+
+// NewBinaryBackoffEngineWithClock is NewBinaryBackoffEngine, but After
+// waits on clock rather than real time.
+func NewBinaryBackoffEngineWithClock(rng *rand.Rand, clock Clock, min, max time.Duration) *BinaryBackoffEngine {
 	if min <= 0 {
 		return nil
 	}
 	return &BinaryBackoffEngine{
 		rng:    rng,
+		clock:  clock,
 		min:    min,
 		max:    max,
 		period: min,
@@ -75,13 +84,11 @@ func (bbe *BinaryBackoffEngine) Advance() time.Duration {
 }
 
 func (bbe *BinaryBackoffEngine) After(fun func()) {
-	duration := bbe.Cur
-	go func() {
-		if duration > 0 {
-			time.Sleep(duration)
-		}
-		fun()
-	}()
+	if duration := bbe.Cur; duration > 0 {
+		bbe.clock.AfterFunc(duration, fun)
+	} else {
+		go fun()
+	}
 }
 
 func (bbe *BinaryBackoffEngine) Shrink(roundToZero time.Duration) {